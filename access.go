@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Actions roles may grant besides the audited instance actions.
+const (
+	accessActionSchedules = "schedules"
+	accessActionAudit     = "audit"
+	accessActionAny       = "*"
+)
+
+// accessActions are the actions roles may grant.
+var accessActions = []string{
+	scheduleActionStart, scheduleActionStop, scheduleActionScale, auditActionCheck,
+	actionSettings, actionBackup, actionRestart, actionMaintenanceWindow, actionStorage, actionDatabaseFlags,
+	actionExport, actionImport, actionClone, actionFailover, actionPromote, actionUsers, actionAuthorizedNetworks, actionRestore, accessActionSchedules, accessActionOverrides, accessActionAudit,
+}
+
+// AccessRole grants actions on instances. Projects and Instances are glob
+// patterns such as "dev-*", empty means any.
+type AccessRole struct {
+	Actions   []string `yaml:"actions"`
+	Projects  []string `yaml:"projects"`
+	Instances []string `yaml:"instances"`
+}
+
+func (role AccessRole) allowsAction(action string) bool {
+	return slices.Contains(role.Actions, accessActionAny) || slices.Contains(role.Actions, action)
+}
+
+func (role AccessRole) allows(action string, project string, instance string) bool {
+	return role.allowsAction(action) && matchesAny(role.Projects, project) && matchesAny(role.Instances, instance)
+}
+
+// AccessBinding gives roles to callers. Principals are glob patterns over
+// the identity of the caller: "api-key#1" for the first AUTH_API_KEYS key,
+// "hmac" for signed requests and the email of OIDC tokens, such as
+// "*@example.com".
+type AccessBinding struct {
+	Principals []string `yaml:"principals"`
+	Roles      []string `yaml:"roles"`
+}
+
+// AccessConfig limits what each caller of the API may do. Without bindings
+// every authenticated caller may do everything, as before. With bindings a
+// caller may only do what the roles bound to it grant.
+type AccessConfig struct {
+	Roles    map[string]AccessRole `yaml:"roles"`
+	Bindings []AccessBinding       `yaml:"bindings"`
+}
+
+func (a AccessConfig) enabled() bool {
+	return len(a.Bindings) > 0
+}
+
+func (a AccessConfig) validate(auth AuthConfig) error {
+	var errs []error
+	if a.enabled() && !auth.enabled() {
+		errs = append(errs, errors.New("access.bindings: require authentication, set AUTH_API_KEYS, AUTH_HMAC_SECRET, AUTH_OIDC_AUDIENCE or TLS_CLIENT_CA_FILE"))
+	}
+
+	names := make([]string, 0, len(a.Roles))
+	for name := range a.Roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		role, prefix := a.Roles[name], "access.roles."+name
+		if len(role.Actions) == 0 {
+			errs = append(errs, fmt.Errorf("%s.actions: is required", prefix))
+		}
+		for i, action := range role.Actions {
+			if action != accessActionAny && !slices.Contains(accessActions, action) {
+				errs = append(errs, fmt.Errorf("%s.actions[%d]: %q is not one of *, %s", prefix, i, action, strings.Join(accessActions, ", ")))
+			}
+		}
+		errs = append(errs, validatePatterns(prefix+".projects", role.Projects)...)
+		errs = append(errs, validatePatterns(prefix+".instances", role.Instances)...)
+	}
+
+	for i, binding := range a.Bindings {
+		prefix := fmt.Sprintf("access.bindings[%d]", i)
+		if len(binding.Principals) == 0 {
+			errs = append(errs, fmt.Errorf("%s.principals: is required", prefix))
+		}
+		errs = append(errs, validatePatterns(prefix+".principals", binding.Principals)...)
+		if len(binding.Roles) == 0 {
+			errs = append(errs, fmt.Errorf("%s.roles: is required", prefix))
+		}
+		for j, role := range binding.Roles {
+			if _, ok := a.Roles[role]; !ok {
+				errs = append(errs, fmt.Errorf("%s.roles[%d]: %q is not a role of access.roles", prefix, j, role))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// roles are the roles bound to principal.
+func (a AccessConfig) roles(principal string) []AccessRole {
+	var roles []AccessRole
+	for _, binding := range a.Bindings {
+		if matchesAny(binding.Principals, principal) {
+			for _, name := range binding.Roles {
+				roles = append(roles, a.Roles[name])
+			}
+		}
+	}
+	return roles
+}
+
+// allows reports whether principal may apply action to the instance.
+func (a AccessConfig) allows(principal string, action string, project string, instance string) bool {
+	if !a.enabled() {
+		return true
+	}
+	return slices.ContainsFunc(a.roles(principal), func(role AccessRole) bool {
+		return role.allows(action, project, instance)
+	})
+}
+
+// allowsAction reports whether principal may apply action to any instance
+// at all, for requests that only name their instances in the body.
+func (a AccessConfig) allowsAction(principal string, action string) bool {
+	if !a.enabled() {
+		return true
+	}
+	return slices.ContainsFunc(a.roles(principal), func(role AccessRole) bool {
+		return role.allowsAction(action)
+	})
+}
+
+// accessPolicy is the running AccessConfig.
+var accessPolicy reloadable[AccessConfig]
+
+// withAccess rejects with 403 the requests whose caller may not apply
+// action, to the targeted instance when targeted is set. Handlers acting
+// on instances named in the body check each of them with accessAllowed.
+func withAccess(action string, targeted bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, access := requestPrincipal(r), requestAccess(r)
+		allowed := access.allowsAction(principal, action)
+		if targeted {
+			allowed = access.allows(principal, action, targetProject(r), targetInstance(r))
+		}
+		if !allowed {
+			writeErrorResponse(w, r, http.StatusForbidden, msgForbidden, "", principal, action)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessAllowed reports whether the caller of r may apply action to the
+// instance.
+func accessAllowed(r *http.Request, action string, project string, instance string) bool {
+	return requestAccess(r).allows(requestPrincipal(r), action, project, instance)
+}
+
+// errForbidden is the reason reported for instances of bulk and batch
+// requests the caller may not act on.
+var errForbidden = errors.New("not allowed for the caller")
+
+func matchesAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	})
+}
+
+func validatePatterns(field string, patterns []string) []error {
+	var errs []error
+	for i, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: %q is not a valid pattern", field, i, pattern))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	alloydb "google.golang.org/api/alloydb/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// alloyDBAPI is an AlloyDB client. The Go client has no activation policy
+// on instances yet, so instances are patched over plain HTTP on the same
+// transport.
+type alloyDBAPI struct {
+	service *alloydb.Service
+	client  *http.Client
+}
+
+// setActivationPolicy patches the activation policy of an instance, named
+// by its full resource name, and returns the name of the operation.
+func (api *alloyDBAPI) setActivationPolicy(ctx context.Context, instance string, policy string) (string, error) {
+	body, err := json.Marshal(map[string]string{"activationPolicy": policy})
+	if err != nil {
+		return "", err
+	}
+	url := api.service.BasePath + "v1/" + instance + "?updateMask=activationPolicy"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return "", err
+	}
+
+	var operation alloydb.Operation
+	if err := json.NewDecoder(resp.Body).Decode(&operation); err != nil {
+		return "", err
+	}
+	return operation.Name, nil
+}
+
+// alloyDBProvider manages AlloyDB clusters through the activation policy of
+// their primary instance. Read pool instances stop and start along with
+// the primary, so the state of a cluster is the state of its primary.
+type alloyDBProvider struct{}
+
+func (alloyDBProvider) list(ctx context.Context, project string) ([]DataStore, error) {
+	api, err := alloyDBService(project)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	var stores []DataStore
+	err = api.service.Projects.Locations.Clusters.List("projects/"+project+"/locations/-").Pages(ctx, func(page *alloydb.ListClustersResponse) error {
+		for _, cluster := range page.Clusters {
+			primary, err := alloyDBPrimary(ctx, api, cluster.Name)
+			if err != nil {
+				return err
+			}
+			stores = append(stores, newAlloyDBStore(project, cluster, primary))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stores, nil
+}
+
+func (alloyDBProvider) get(ctx context.Context, project string, location string, name string) (DataStore, error) {
+	api, err := alloyDBService(project)
+	if err != nil {
+		return DataStore{}, err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	cluster, err := api.service.Projects.Locations.Clusters.Get(fmt.Sprintf("projects/%s/locations/%s/clusters/%s", project, location, name)).Context(ctx).Do()
+	if err != nil {
+		return DataStore{}, err
+	}
+	primary, err := alloyDBPrimary(ctx, api, cluster.Name)
+	if err != nil {
+		return DataStore{}, err
+	}
+	return newAlloyDBStore(project, cluster, primary), nil
+}
+
+func (alloyDBProvider) start(ctx context.Context, store DataStore) (string, error) {
+	return setAlloyDBActivationPolicy(ctx, store, "ALWAYS")
+}
+
+func (alloyDBProvider) stop(ctx context.Context, store DataStore) (string, error) {
+	return setAlloyDBActivationPolicy(ctx, store, "NEVER")
+}
+
+func setAlloyDBActivationPolicy(ctx context.Context, store DataStore, policy string) (string, error) {
+	api, err := alloyDBService(store.Project)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	cluster := fmt.Sprintf("projects/%s/locations/%s/clusters/%s", store.Project, store.Location, store.Name)
+	primary, err := alloyDBPrimary(ctx, api, cluster)
+	if err != nil {
+		return "", err
+	}
+	if primary == nil {
+		return "", fmt.Errorf("cluster %s has no primary instance", store.Name)
+	}
+	return api.setActivationPolicy(ctx, primary.Name, policy)
+}
+
+// alloyDBPrimary returns the primary instance of a cluster, nil for
+// clusters without one such as secondary clusters.
+func alloyDBPrimary(ctx context.Context, api *alloyDBAPI, cluster string) (*alloydb.Instance, error) {
+	var primary *alloydb.Instance
+	err := api.service.Projects.Locations.Clusters.Instances.List(cluster).Pages(ctx, func(page *alloydb.ListInstancesResponse) error {
+		for _, instance := range page.Instances {
+			if instance.InstanceType == "PRIMARY" {
+				primary = instance
+			}
+		}
+		return nil
+	})
+	return primary, err
+}
+
+func newAlloyDBStore(project string, cluster *alloydb.Cluster, primary *alloydb.Instance) DataStore {
+	location, name := resourceLocation(cluster.Name)
+	store := DataStore{Kind: storeKindAlloyDB, Project: project, Location: location, Name: name, State: cluster.State, Labels: cluster.Labels}
+	if primary != nil && cluster.State == "READY" {
+		store.State = primary.State
+	}
+	if store.State == "READY" {
+		store.State = storeStateRunning
+	}
+	return store
+}
+
+// resourceLocation splits a resource name such as
+// projects/p/locations/l/clusters/c into its location and last segment.
+func resourceLocation(name string) (string, string) {
+	parts := strings.Split(name, "/")
+	location := ""
+	if len(parts) > 3 && parts[2] == "locations" {
+		location = parts[3]
+	}
+	return location, parts[len(parts)-1]
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// Audit backends selectable with AUDIT_BACKEND.
+const (
+	auditBackendNone         = "none"
+	auditBackendFile         = "file"
+	auditBackendCloudLogging = "cloud_logging"
+	auditBackendFirestore    = "firestore"
+)
+
+// auditActionCheck is the action of audited instance reads.
+const auditActionCheck = "check"
+
+const (
+	defaultAuditFile       = "audit.jsonl"
+	defaultAuditLogName    = "scheduler-db-audit"
+	defaultAuditCollection = "scheduler-db-audit"
+	defaultAuditQueryLimit = 100
+	maxAuditQueryLimit     = 1000
+	auditWriteTimeout      = 10 * time.Second
+)
+
+// AuditEntry is one audited request.
+type AuditEntry struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Principal  string    `json:"principal"`
+	Action     string    `json:"action"`
+	Project    string    `json:"project,omitempty"`
+	Instance   string    `json:"instance,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Payload    string    `json:"payload,omitempty"`
+	StatusCode int       `json:"status_code"`
+	Result     string    `json:"result"`
+	Operation  string    `json:"operation,omitempty"`
+	// URI is the Cloud Storage file of exports and imports.
+	URI   string `json:"uri,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Source is set for actions that didn't come through the API, such as
+	// schedule runs.
+	Source string `json:"source,omitempty"`
+}
+
+// auditQuery filters GET /v1/audit. Empty fields match everything.
+type auditQuery struct {
+	Project   string
+	Instance  string
+	Action    string
+	Principal string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func (q auditQuery) matches(entry AuditEntry) bool {
+	return (q.Project == "" || entry.Project == q.Project) &&
+		(q.Instance == "" || entry.Instance == q.Instance) &&
+		(q.Action == "" || entry.Action == q.Action) &&
+		(q.Principal == "" || entry.Principal == q.Principal) &&
+		(q.Since.IsZero() || !entry.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || entry.Time.Before(q.Until))
+}
+
+// auditStore persists audit entries. query returns the newest entries
+// first, at most q.Limit of them.
+type auditStore interface {
+	append(ctx context.Context, entry AuditEntry) error
+	query(ctx context.Context, q auditQuery) ([]AuditEntry, error)
+}
+
+// auditLog is where audited requests are recorded, nil disables auditing.
+var auditLog auditStore
+
+// AuditConfig selects the audit backend.
+type AuditConfig struct {
+	Backend    string
+	File       string
+	Project    string
+	LogName    string
+	Collection string
+}
+
+func (a AuditConfig) validate() error {
+	switch a.Backend {
+	case auditBackendNone, auditBackendFile, auditBackendCloudLogging, auditBackendFirestore:
+		return nil
+	}
+	return fmt.Errorf("AUDIT_BACKEND: %q is not one of none, file, cloud_logging, firestore", a.Backend)
+}
+
+// open builds the configured backend.
+func (a AuditConfig) open(ctx context.Context) (auditStore, error) {
+	switch a.Backend {
+	case auditBackendFile:
+		return &fileAuditStore{path: a.File}, nil
+	case auditBackendCloudLogging:
+		return newCloudLoggingAuditStore(ctx, a.Project, a.LogName)
+	case auditBackendFirestore:
+		return newFirestoreAuditStore(ctx, a.Project, a.Collection)
+	}
+	return nil, nil
+}
+
+type auditContextKey struct{}
+
+// auditRecord is the entry of the request being audited. Handlers add the
+// operation and error through it while it is in flight.
+type auditRecord struct {
+	mu    sync.Mutex
+	entry AuditEntry
+}
+
+// auditOperation records the operation started by an audited request.
+func auditOperation(r *http.Request, name string) {
+	if record, ok := r.Context().Value(auditContextKey{}).(*auditRecord); ok {
+		record.mu.Lock()
+		record.entry.Operation = name
+		record.mu.Unlock()
+	}
+}
+
+// auditURI records the Cloud Storage file an audited request exported to or
+// imported from.
+func auditURI(r *http.Request, uri string) {
+	if record, ok := r.Context().Value(auditContextKey{}).(*auditRecord); ok {
+		record.mu.Lock()
+		record.entry.URI = uri
+		record.mu.Unlock()
+	}
+}
+
+// auditError records why an audited request failed.
+func auditError(r *http.Request, description string) {
+	if record, ok := r.Context().Value(auditContextKey{}).(*auditRecord); ok {
+		record.mu.Lock()
+		record.entry.Error = description
+		record.mu.Unlock()
+	}
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(statusCode int) {
+	if s.status == 0 {
+		s.status = statusCode
+	}
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// withAudit records every request to next in auditLog once it is answered.
+// Instance actions record their target, bulk actions leave it empty.
+func withAudit(action string, targeted bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if targeted {
+			annotateRequest(r, slog.String("project", targetProject(r)), slog.String("instance", targetInstance(r)))
+		}
+		if auditLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		record := &auditRecord{entry: AuditEntry{
+			ID:        randomID(8),
+			Time:      time.Now().UTC(),
+			Principal: requestPrincipal(r),
+			Action:    action,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+		}}
+		if targeted {
+			record.entry.Project, record.entry.Instance = targetProject(r), targetInstance(r)
+		}
+		if r.Body != nil {
+			body, _ := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes.load()+1))
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			if payload := sanitizeBody(body); payload != nil && int64(len(body)) <= maxBodyBytes.load() {
+				record.entry.Payload = string(payload)
+			}
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, record)))
+
+		record.mu.Lock()
+		entry := record.entry
+		record.mu.Unlock()
+
+		entry.StatusCode = recorder.status
+		entry.Result = "success"
+		if entry.StatusCode >= http.StatusBadRequest {
+			entry.Result = "failure"
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+		defer cancel()
+		if err := auditLog.append(ctx, entry); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to write audit entry", "audit_id", entry.ID, "error", err)
+		}
+	})
+}
+
+// auditAction records a start or stop that didn't come through the API,
+// e.g. a schedule run, so the audit log covers every change of an instance.
+func auditAction(action triggeredAction, operation *sqladmin.Operation, err error) {
+	if auditLog == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		ID:        randomID(8),
+		Time:      time.Now().UTC(),
+		Principal: action.TriggeredBy,
+		Action:    action.Action,
+		Project:   action.Project,
+		Instance:  action.Instance,
+		Result:    "success",
+		Source:    action.Source,
+	}
+	if operation != nil {
+		entry.Operation, entry.URI = operation.Name, operationURI(operation)
+	}
+	if err != nil {
+		entry.Result, entry.Error = "failure", err.Error()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+	defer cancel()
+	if err := auditLog.append(ctx, entry); err != nil {
+		slog.Error("Failed to write audit entry", "audit_id", entry.ID, "error", err)
+	}
+}
+
+// AuditListData is the payload of GET /v1/audit.
+type AuditListData struct {
+	Entries []AuditEntryData `json:"entries"`
+}
+
+// AuditEntryData is an AuditEntry as returned to clients, with its time in
+// the configured response format.
+type AuditEntryData struct {
+	AuditEntry
+	Time interface{} `json:"time"`
+}
+
+var errAuditDisabled = errors.New("AUDIT_BACKEND is none")
+
+// auditHandler queries the audit log, newest entries first.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+	if auditLog == nil {
+		writeErrorResponse(w, r, http.StatusNotFound, msgAuditDisabled, errAuditDisabled)
+		return
+	}
+
+	q, errs := parseAuditQuery(r)
+	if len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	entries, err := auditLog.query(r.Context(), q)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgAuditQueryFailed, err)
+		return
+	}
+	data := AuditListData{Entries: make([]AuditEntryData, 0, len(entries))}
+	for _, entry := range entries {
+		data.Entries = append(data.Entries, AuditEntryData{AuditEntry: entry, Time: formatTimestamp(entry.Time)})
+	}
+
+	writeSuccessResponse(w, r, http.StatusOK, msgAuditListed, data)
+}
+
+func parseAuditQuery(r *http.Request) (auditQuery, validationErrors) {
+	values := r.URL.Query()
+	q := auditQuery{
+		Project:   values.Get("project"),
+		Instance:  values.Get("instance"),
+		Action:    values.Get("action"),
+		Principal: values.Get("principal"),
+		Limit:     defaultAuditQueryLimit,
+	}
+
+	var errs validationErrors
+	bounds := []struct {
+		name   string
+		target *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}}
+	for _, bound := range bounds {
+		if raw := values.Get(bound.name); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				errs = append(errs, fieldError{Field: bound.name, Message: "must be an RFC 3339 timestamp"})
+			}
+			*bound.target = t
+		}
+	}
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxAuditQueryLimit {
+			errs = append(errs, fieldError{Field: "limit", Message: fmt.Sprintf("must be between 1 and %d", maxAuditQueryLimit)})
+		}
+		q.Limit = limit
+	}
+	return q, errs
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/logging/v2"
+)
+
+// errAuditQueryDone stops paging once enough entries were found.
+var errAuditQueryDone = errors.New("audit query done")
+
+// fileAuditStore appends entries to a local JSON lines file.
+type fileAuditStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (s *fileAuditStore) append(_ context.Context, entry AuditEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(raw, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileAuditStore) query(_ context.Context, q auditQuery) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var matched []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid audit file %s: %w", s.path, err)
+		}
+		if q.matches(entry) {
+			matched = append(matched, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, 0, min(len(matched), q.Limit))
+	for i := len(matched) - 1; i >= 0 && len(entries) < q.Limit; i-- {
+		entries = append(entries, matched[i])
+	}
+	return entries, nil
+}
+
+// cloudLoggingAuditStore writes entries as structured log entries of one
+// log, queried back with the Logging API.
+type cloudLoggingAuditStore struct {
+	service *logging.Service
+	project string
+	logName string
+}
+
+func newCloudLoggingAuditStore(ctx context.Context, project string, logName string) (*cloudLoggingAuditStore, error) {
+	service, err := logging.NewService(ctx, credentials.load().options()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud Logging client: %w", err)
+	}
+	return &cloudLoggingAuditStore{service: service, project: project, logName: logName}, nil
+}
+
+func (s *cloudLoggingAuditStore) fullLogName() string {
+	return fmt.Sprintf("projects/%s/logs/%s", s.project, s.logName)
+}
+
+func (s *cloudLoggingAuditStore) append(ctx context.Context, entry AuditEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	severity := "NOTICE"
+	if entry.Result == "failure" {
+		severity = "WARNING"
+	}
+
+	_, err = s.service.Entries.Write(&logging.WriteLogEntriesRequest{
+		LogName:  s.fullLogName(),
+		Resource: &logging.MonitoredResource{Type: "global"},
+		Entries: []*logging.LogEntry{{
+			InsertId:    entry.ID,
+			Timestamp:   entry.Time.Format(time.RFC3339Nano),
+			Severity:    severity,
+			JsonPayload: raw,
+		}},
+	}).Context(ctx).Do()
+	return err
+}
+
+func (s *cloudLoggingAuditStore) query(ctx context.Context, q auditQuery) ([]AuditEntry, error) {
+	filters := []string{fmt.Sprintf("logName=%q", s.fullLogName())}
+	for field, value := range map[string]string{"project": q.Project, "instance": q.Instance, "action": q.Action, "principal": q.Principal} {
+		if value != "" {
+			filters = append(filters, fmt.Sprintf("jsonPayload.%s=%q", field, value))
+		}
+	}
+	if !q.Since.IsZero() {
+		filters = append(filters, fmt.Sprintf("timestamp>=%q", q.Since.Format(time.RFC3339Nano)))
+	}
+	if !q.Until.IsZero() {
+		filters = append(filters, fmt.Sprintf("timestamp<%q", q.Until.Format(time.RFC3339Nano)))
+	}
+
+	resp, err := s.service.Entries.List(&logging.ListLogEntriesRequest{
+		ResourceNames: []string{"projects/" + s.project},
+		Filter:        strings.Join(filters, " AND "),
+		OrderBy:       "timestamp desc",
+		PageSize:      int64(q.Limit),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, 0, len(resp.Entries))
+	for _, logEntry := range resp.Entries {
+		var entry AuditEntry
+		if err := json.Unmarshal(logEntry.JsonPayload, &entry); err != nil {
+			return nil, fmt.Errorf("invalid audit log entry %s: %w", logEntry.InsertId, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// firestoreAuditStore keeps one document per entry in a collection of the
+// default database.
+type firestoreAuditStore struct {
+	service    *firestore.Service
+	project    string
+	collection string
+}
+
+func newFirestoreAuditStore(ctx context.Context, project string, collection string) (*firestoreAuditStore, error) {
+	service, err := firestore.NewService(ctx, credentials.load().options()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Firestore client: %w", err)
+	}
+	return &firestoreAuditStore{service: service, project: project, collection: collection}, nil
+}
+
+func (s *firestoreAuditStore) parent() string {
+	return fmt.Sprintf("projects/%s/databases/(default)/documents", s.project)
+}
+
+func (s *firestoreAuditStore) append(ctx context.Context, entry AuditEntry) error {
+	fields := map[string]firestore.Value{
+		"time":        {TimestampValue: entry.Time.Format(time.RFC3339Nano)},
+		"status_code": {IntegerValue: int64(entry.StatusCode)},
+	}
+	for name, value := range entry.strings() {
+		fields[name] = firestore.Value{StringValue: value}
+	}
+
+	_, err := s.service.Projects.Databases.Documents.CreateDocument(s.parent(), s.collection, &firestore.Document{Fields: fields}).
+		DocumentId(entry.ID).Context(ctx).Do()
+	return err
+}
+
+// query pages through the collection newest first and filters on this
+// side, which needs no composite index. Paging stops at q.Since.
+func (s *firestoreAuditStore) query(ctx context.Context, q auditQuery) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := s.service.Projects.Databases.Documents.List(s.parent(), s.collection).
+		OrderBy("time desc").PageSize(int64(maxAuditQueryLimit)).
+		Pages(ctx, func(resp *firestore.ListDocumentsResponse) error {
+			for _, document := range resp.Documents {
+				entry := auditEntryFromDocument(document)
+				if !q.Since.IsZero() && entry.Time.Before(q.Since) {
+					return errAuditQueryDone
+				}
+				if !q.matches(entry) {
+					continue
+				}
+				entries = append(entries, entry)
+				if len(entries) == q.Limit {
+					return errAuditQueryDone
+				}
+			}
+			return nil
+		})
+	if err != nil && !errors.Is(err, errAuditQueryDone) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// strings returns the string fields of the entry by their JSON name.
+func (e AuditEntry) strings() map[string]string {
+	return map[string]string{
+		"id":        e.ID,
+		"principal": e.Principal,
+		"action":    e.Action,
+		"project":   e.Project,
+		"instance":  e.Instance,
+		"method":    e.Method,
+		"path":      e.Path,
+		"payload":   e.Payload,
+		"result":    e.Result,
+		"operation": e.Operation,
+		"uri":       e.URI,
+		"error":     e.Error,
+	}
+}
+
+func auditEntryFromDocument(document *firestore.Document) AuditEntry {
+	str := func(name string) string { return document.Fields[name].StringValue }
+
+	t, _ := time.Parse(time.RFC3339Nano, document.Fields["time"].TimestampValue)
+	return AuditEntry{
+		ID:         str("id"),
+		Time:       t,
+		Principal:  str("principal"),
+		Action:     str("action"),
+		Project:    str("project"),
+		Instance:   str("instance"),
+		Method:     str("method"),
+		Path:       str("path"),
+		Payload:    str("payload"),
+		StatusCode: int(document.Fields["status_code"].IntegerValue),
+		Result:     str("result"),
+		Operation:  str("operation"),
+		URI:        str("uri"),
+		Error:      str("error"),
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+// Request headers read by the authenticators.
+const (
+	apiKeyHeader             = "X-API-Key"
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+)
+
+// maxSignatureSkew is how far the timestamp of a signed request may be from
+// the server clock, bounding how long a captured request can be replayed.
+const maxSignatureSkew = 5 * time.Minute
+
+// errNoCredentials is returned by an authenticator when the request doesn't
+// carry its kind of credentials, so the next one can be tried.
+var errNoCredentials = errors.New("no credentials")
+
+// authenticator verifies one kind of request credentials and returns the
+// identity of the caller.
+type authenticator interface {
+	authenticate(r *http.Request) (string, error)
+}
+
+// AuthConfig selects the authenticators protecting the public API. A
+// request is accepted when any configured authenticator accepts it. With
+// none configured the API is open, as it always was.
+// ClientCerts accepts the verified client certificates of mutual TLS, it
+// is set along with TLS_CLIENT_CA_FILE.
+type AuthConfig struct {
+	APIKeys      []string
+	HMACSecret   string
+	OIDCAudience string
+	OIDCEmails   []string
+	ClientCerts  bool
+}
+
+func (a AuthConfig) enabled() bool {
+	return len(a.APIKeys) > 0 || a.HMACSecret != "" || a.OIDCAudience != "" || a.ClientCerts
+}
+
+func (a AuthConfig) validate() error {
+	switch {
+	case len(a.OIDCEmails) > 0 && a.OIDCAudience == "":
+		return errors.New("AUTH_OIDC_EMAILS requires AUTH_OIDC_AUDIENCE")
+	case a.OIDCAudience != "" && len(a.OIDCEmails) == 0:
+		// Any Google account can get a token for any audience.
+		return errors.New("AUTH_OIDC_AUDIENCE requires AUTH_OIDC_EMAILS")
+	}
+	return nil
+}
+
+func (a AuthConfig) authenticators() []authenticator {
+	var authenticators []authenticator
+	if len(a.APIKeys) > 0 {
+		authenticators = append(authenticators, apiKeyAuthenticator{keys: a.APIKeys})
+	}
+	if a.HMACSecret != "" {
+		authenticators = append(authenticators, hmacAuthenticator{secret: []byte(a.HMACSecret), now: time.Now})
+	}
+	if a.OIDCAudience != "" {
+		authenticators = append(authenticators, oidcAuthenticator{audience: a.OIDCAudience, emails: a.OIDCEmails})
+	}
+	if a.ClientCerts {
+		authenticators = append(authenticators, clientCertAuthenticator{})
+	}
+	return authenticators
+}
+
+// authenticators protect the public API, none means it is open.
+var authenticators reloadable[[]authenticator]
+
+type principalContextKey struct{}
+
+// requestPrincipal is the caller identity set by withAuth, empty when the
+// API is open.
+func requestPrincipal(r *http.Request) string {
+	principal, _ := r.Context().Value(principalContextKey{}).(string)
+	return principal
+}
+
+// withAuth rejects requests that none of the configured authenticators
+// accept with 401.
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(authenticators.load()) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		failure := errNoCredentials
+		for _, auth := range authenticators.load() {
+			principal, err := auth.authenticate(r)
+			if err == nil {
+				annotateRequest(r, slog.String("principal", principal))
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, principal)))
+				return
+			}
+			if !errors.Is(err, errNoCredentials) {
+				failure = err
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scheduler-db"`)
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgUnauthorized, failure)
+	})
+}
+
+// apiKeyAuthenticator accepts a static key sent in the X-API-Key header.
+type apiKeyAuthenticator struct {
+	keys []string
+}
+
+func (a apiKeyAuthenticator) authenticate(r *http.Request) (string, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return "", errNoCredentials
+	}
+
+	for i, candidate := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(candidate)) == 1 {
+			return "api-key#" + strconv.Itoa(i+1), nil
+		}
+	}
+	return "", errors.New("invalid API key")
+}
+
+// hmacAuthenticator accepts requests signed with a shared secret: X-Signature
+// is "sha256=" followed by the hex HMAC-SHA256 of
+// "<timestamp>\n<method>\n<request URI>\n<body>", with the Unix timestamp
+// sent in X-Signature-Timestamp.
+type hmacAuthenticator struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func (a hmacAuthenticator) authenticate(r *http.Request) (string, error) {
+	signature, ok := strings.CutPrefix(r.Header.Get(signatureHeader), "sha256=")
+	if !ok {
+		return "", errNoCredentials
+	}
+
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.New("invalid or missing " + signatureTimestampHeader)
+	}
+	if skew := a.now().Sub(time.Unix(seconds, 0)).Abs(); skew > maxSignatureSkew {
+		return "", fmt.Errorf("signature timestamp is %s off", skew.Truncate(time.Second))
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodyBytes.load()))
+		if err != nil {
+			return "", err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := signRequest(a.secret, timestamp, r.Method, r.URL.RequestURI(), body)
+	got, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, expected) {
+		return "", errors.New("invalid request signature")
+	}
+	return "hmac", nil
+}
+
+func signRequest(secret []byte, timestamp string, method string, uri string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", timestamp, method, uri)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// validateIDToken verifies a Google-signed ID token, replaced in tests.
+var validateIDToken = idtoken.Validate
+
+// oidcAuthenticator accepts Google-signed OIDC ID tokens, as sent by Cloud
+// Scheduler and Cloud Tasks in the Authorization header, of the service
+// accounts in emails. The email must be verified.
+type oidcAuthenticator struct {
+	audience string
+	emails   []string
+}
+
+func (a oidcAuthenticator) authenticate(r *http.Request) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", errNoCredentials
+	}
+
+	payload, err := validateIDToken(r.Context(), token, a.audience)
+	if err != nil {
+		return "", fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	email, _ := payload.Claims["email"].(string)
+	if verified, _ := payload.Claims["email_verified"].(bool); email == "" || !verified {
+		return "", errors.New("ID token has no verified email")
+	}
+	if !slices.Contains(a.emails, email) {
+		return "", fmt.Errorf("ID token of %q is not allowed", email)
+	}
+	return email, nil
+}
+
+// clientCertAuthenticator accepts requests over mutual TLS. The TLS
+// handshake has already verified the certificate against the client CAs,
+// the caller is named cert:<common name>, or cert:<first DNS name> for
+// certificates without one.
+type clientCertAuthenticator struct{}
+
+func (clientCertAuthenticator) authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", errNoCredentials
+	}
+
+	certificate := r.TLS.VerifiedChains[0][0]
+	name := certificate.Subject.CommonName
+	if name == "" && len(certificate.DNSNames) > 0 {
+		name = certificate.DNSNames[0]
+	}
+	if name == "" {
+		return "", errors.New("client certificate has no common name or DNS name")
+	}
+	return "cert:" + name, nil
+}
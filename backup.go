@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// BackupRequest is the optional body of POST /v1/instances/{instance}/backup.
+type BackupRequest struct {
+	Description string `json:"description"`
+}
+
+// backupHandler takes an on-demand backup of an instance.
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	var payload BackupRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(w, r, &payload); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	project, instance := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	backupRun := newBackupRun(payload.Description, requestPrincipal(r))
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunCall(http.MethodPost, sqlAdminInstancePath(project, instance)+"/backupRuns", backupRun))
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	operation, err := sqlService.BackupRuns.Insert(project, instance, backupRun).Context(ctx).Do()
+	event := newNotificationEvent(actionBackup, actionSourceAPI, requestPrincipal(r), project, instance)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgBackupFailed, err)
+		return
+	}
+
+	operations.track(event, operation)
+	writeOperationResponse(w, r, project, instance, operation, wait, timeout, operationSteps{}, msgBackupStarted, msgBackupFailed)
+}
+
+// actionBackup names backups in notifications and the audit log.
+const actionBackup = "backup"
+
+func newBackupRun(description string, triggeredBy string) *sqladmin.BackupRun {
+	if description == "" {
+		if triggeredBy == "" {
+			triggeredBy = "anonymous"
+		}
+		description = "On-demand backup by scheduler-db (" + triggeredBy + ")"
+	}
+	return &sqladmin.BackupRun{Description: description}
+}
+
+// backupBeforeStop takes a backup and waits for it to finish, up to timeout
+// or maxWaitTimeout when unset, so the instance is only stopped once it has
+// a fresh backup.
+func backupBeforeStop(ctx context.Context, sqlService *sqladmin.Service, event NotificationEvent, timeout time.Duration) (*sqladmin.Operation, error) {
+	event.Action = actionBackup
+
+	callCtx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	operation, err := sqlService.BackupRuns.Insert(event.Project, event.Instance, newBackupRun("Backup before stop by scheduler-db ("+event.TriggeredBy+")", "")).Context(callCtx).Do()
+	notifyAction(event, operation, err)
+	if err != nil {
+		return nil, err
+	}
+	operations.track(event, operation)
+
+	operation, err = awaitOrdered(ctx, event.Project, operation, timeout)
+	if err != nil {
+		return operation, fmt.Errorf("backup %s: %w", operation.Name, err)
+	}
+	return operation, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// maxBatchItems bounds the size of a POST /v1/batch request.
+const maxBatchItems = 100
+
+// actionBatch names batch requests in the audit log.
+const actionBatch = "batch"
+
+// BatchItem is one start or stop of a batch. Project defaults to
+// PROJECT_ID.
+type BatchItem struct {
+	Project  string `json:"project"`
+	Instance string `json:"instance"`
+	Action   string `json:"action"`
+}
+
+// BatchRequest is the body accepted by POST /v1/batch.
+type BatchRequest struct {
+	Items []BatchItem `json:"items"`
+}
+
+func (req *BatchRequest) validate() validationErrors {
+	var errs validationErrors
+	switch {
+	case len(req.Items) == 0:
+		return validationErrors{{Field: "items", Message: "at least one item is required"}}
+	case len(req.Items) > maxBatchItems:
+		return validationErrors{{Field: "items", Message: fmt.Sprintf("at most %d items are allowed", maxBatchItems)}}
+	}
+
+	seen := make(map[string]int)
+	for i, item := range req.Items {
+		field := fmt.Sprintf("items[%d]", i)
+		if item.Instance == "" {
+			errs = append(errs, fieldError{Field: field + ".instance", Message: "is required"})
+		}
+		if _, ok := scheduleActivationPolicies[item.Action]; !ok {
+			errs = append(errs, fieldError{Field: field + ".action", Message: "must be 'start' or 'stop'"})
+		}
+		key := item.target(projectID.load())
+		if first, ok := seen[key]; ok && item.Instance != "" {
+			errs = append(errs, fieldError{Field: field, Message: fmt.Sprintf("targets the same instance as items[%d]", first)})
+		}
+		seen[key] = i
+	}
+	return errs
+}
+
+// target is the project/instance of the item.
+func (item BatchItem) target(defaultProject string) string {
+	if item.Project == "" {
+		return defaultProject + "/" + item.Instance
+	}
+	return item.Project + "/" + item.Instance
+}
+
+// batchHandler starts or stops a list of instances through the job queue,
+// and answers with the result of each item in request order. Like
+// the by-label endpoints, instances already in the requested state are
+// skipped and one failing item doesn't stop the others.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	var payload BatchRequest
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if errs := payload.validate(); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	data := BulkResponseData{DryRun: isDryRun(r), Matched: len(payload.Items)}
+	items := make([]bulkItem, 0, len(payload.Items))
+	for _, item := range payload.Items {
+		if item.Project == "" {
+			item.Project = projectID.load()
+		}
+		items = append(items, bulkItem{Project: item.Project, Instance: item.Instance, Run: func(ctx context.Context) BulkResult {
+			if !accessAllowed(r, item.Action, item.Project, item.Instance) {
+				return BulkResult{Project: item.Project, Instance: item.Instance, Outcome: bulkOutcomeFailed, Reason: errForbidden.Error()}
+			}
+			return runBatchItem(ctx, item, data.DryRun, isForced(r), requestPrincipal(r))
+		}})
+	}
+	data.Batch, data.Results = bulkQueue.run(r.Context(), actionBatch, requestPrincipal(r), items)
+	data.count()
+
+	if data.DryRun {
+		writeSuccessResponse(w, r, http.StatusOK, msgBatchDryRun, data, data.Matched, data.Changed)
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgBatchFinished, data, data.Matched, data.Changed, data.Failed)
+}
+
+// runBatchItem applies one item, reporting a missing instance or unusable
+// credentials as a failed item.
+func runBatchItem(ctx context.Context, item BatchItem, dryRun bool, force bool, principal string) BulkResult {
+	failed := func(err error) BulkResult {
+		recordAction(item.Action, actionSourceBulk, err)
+		return BulkResult{Project: item.Project, Instance: item.Instance, Outcome: bulkOutcomeFailed, Reason: err.Error()}
+	}
+
+	sqlService, err := sqlAdminService(item.Project)
+	if err != nil {
+		return failed(err)
+	}
+
+	callCtx, cancel := sqlAdminContext(ctx)
+	instance, err := sqlService.Instances.Get(item.Project, item.Instance).Context(callCtx).Do()
+	cancel()
+	if err != nil {
+		return failed(err)
+	}
+
+	return applyActivation(ctx, sqlService, item.Action, actionSourceBulk, instance, dryRun, force, principal)
+}
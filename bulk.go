@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// Outcomes reported per instance by the bulk endpoints.
+const (
+	bulkOutcomeChanged = "changed"
+	bulkOutcomeSkipped = "skipped"
+	bulkOutcomeFailed  = "failed"
+	bulkOutcomeDryRun  = "dry_run"
+)
+
+// LabelSelectorRequest is the body accepted by /v1/start-by-label and
+// /v1/stop-by-label.
+type LabelSelectorRequest struct {
+	Labels   map[string]string `json:"labels"`
+	Projects []string          `json:"projects"`
+}
+
+func (req *LabelSelectorRequest) validate() validationErrors {
+	var errs validationErrors
+	if len(req.Labels) == 0 {
+		errs = append(errs, fieldError{Field: "labels", Message: "at least one label is required"})
+	}
+	for i, project := range req.Projects {
+		if strings.TrimSpace(project) == "" {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("projects[%d]", i), Message: "must not be empty"})
+		}
+	}
+	return errs
+}
+
+// BulkResult is the outcome of a bulk action on one instance.
+type BulkResult struct {
+	Project   string              `json:"project"`
+	Instance  string              `json:"instance"`
+	State     string              `json:"state"`
+	Outcome   string              `json:"outcome"`
+	Reason    string              `json:"reason,omitempty"`
+	Operation *sqladmin.Operation `json:"operation,omitempty"`
+	Patch     *DryRunData         `json:"patch,omitempty"`
+}
+
+// BulkResponseData is the payload of the bulk endpoints. In a dry run,
+// Changed counts the instances that would have been changed. Batch is the
+// id the request had in the job queue.
+type BulkResponseData struct {
+	Batch     string       `json:"batch,omitempty"`
+	DryRun    bool         `json:"dry_run,omitempty"`
+	Matched   int          `json:"matched"`
+	Changed   int          `json:"changed"`
+	Failed    int          `json:"failed"`
+	Cancelled int          `json:"cancelled,omitempty"`
+	Results   []BulkResult `json:"results"`
+}
+
+// count tallies the outcomes of the results.
+func (data *BulkResponseData) count() {
+	for _, result := range data.Results {
+		switch result.Outcome {
+		case bulkOutcomeChanged, bulkOutcomeDryRun:
+			data.Changed++
+		case bulkOutcomeFailed:
+			data.Failed++
+		case bulkOutcomeCancelled:
+			data.Cancelled++
+		}
+	}
+}
+
+// bulkActivationHandler starts or stops every instance carrying all of the
+// requested labels, through the job queue. Instances already in the
+// requested state are skipped, and one failing instance doesn't stop the
+// others from being processed.
+func bulkActivationHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+			return
+		}
+
+		var payload LabelSelectorRequest
+		if err := decodeJSONBody(w, r, &payload); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		if errs := payload.validate(); len(errs) > 0 {
+			writeDecodeError(w, r, errs)
+			return
+		}
+
+		projects := payload.Projects
+		if len(projects) == 0 {
+			projects = defaultProjects(r)
+		}
+
+		data := BulkResponseData{DryRun: isDryRun(r), Results: []BulkResult{}}
+		var (
+			items   []bulkItem
+			indexes []int
+		)
+		for _, project := range projects {
+			sqlService, err := sqlAdminService(project)
+			if err != nil {
+				writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+				return
+			}
+
+			instances, err := listProjectInstances(r.Context(), project)
+			if err != nil {
+				writeErrorResponse(w, r, http.StatusInternalServerError, msgListInstancesFailed, err, project)
+				return
+			}
+
+			for _, instance := range instances {
+				if !matchLabels(instance, payload.Labels) {
+					continue
+				}
+				data.Matched++
+				if !accessAllowed(r, action, instance.Project, instance.Name) {
+					data.Results = append(data.Results, BulkResult{Project: instance.Project, Instance: instance.Name, State: instance.State, Outcome: bulkOutcomeSkipped, Reason: errForbidden.Error()})
+					continue
+				}
+				items = append(items, bulkItem{Project: instance.Project, Instance: instance.Name, Run: func(ctx context.Context) BulkResult {
+					return applyActivation(ctx, sqlService, action, actionSourceBulk, instance, data.DryRun, isForced(r), requestPrincipal(r))
+				}})
+				indexes = append(indexes, len(data.Results))
+				data.Results = append(data.Results, BulkResult{})
+			}
+		}
+
+		var results []BulkResult
+		data.Batch, results = bulkQueue.run(r.Context(), action, requestPrincipal(r), items)
+		for i, result := range results {
+			data.Results[indexes[i]] = result
+		}
+		data.count()
+
+		if data.DryRun {
+			writeSuccessResponse(w, r, http.StatusOK, msgBulkDryRun, data, data.Matched, data.Changed)
+			return
+		}
+		writeSuccessResponse(w, r, http.StatusOK, msgBulkFinished, data, data.Matched, data.Changed, data.Failed)
+	}
+}
+
+// applyActivation starts or stops one instance of a bulk request or one
+// replica, or only reports the Patch call when dryRun is set. force skips
+// the connection check of stops.
+func applyActivation(ctx context.Context, sqlService *sqladmin.Service, action string, source string, instance *sqladmin.DatabaseInstance, dryRun bool, force bool, principal string) BulkResult {
+	result := BulkResult{Project: instance.Project, Instance: instance.Name, State: instance.State}
+
+	switch {
+	case action == scheduleActionStop && instance.State != "RUNNABLE":
+		result.Outcome, result.Reason = bulkOutcomeSkipped, "instance is not running"
+		return result
+	case action == scheduleActionStart && instance.State == "RUNNABLE":
+		result.Outcome, result.Reason = bulkOutcomeSkipped, "instance is already running"
+		return result
+	}
+	if err := policies.load().check(action, instance, policyNow()); err != nil {
+		recordAction(action, source, err)
+		result.Outcome, result.Reason = bulkOutcomeSkipped, err.Error()
+		return result
+	}
+	if action == scheduleActionStop {
+		if err := checkConnections(ctx, instance.Project, instance.Name, force); err != nil {
+			recordAction(action, source, err)
+			result.Outcome, result.Reason = bulkOutcomeFailed, err.Error()
+			return result
+		}
+	}
+
+	policy := scheduleActivationPolicies[action]
+	if dryRun {
+		result.Outcome, result.Patch = bulkOutcomeDryRun, newDryRunPatch(instance.Project, instance.Name, &sqladmin.DatabaseInstance{
+			Settings: &sqladmin.Settings{ActivationPolicy: policy},
+		})
+		return result
+	}
+
+	operation, err := controllerFor(sqlService).SetActivationPolicy(ctx, instance.Project, instance.Name, policy)
+	recordAction(action, source, err)
+	event := newNotificationEvent(action, source, principal, instance.Project, instance.Name)
+	notifyAction(event, operation, err)
+	if err != nil {
+		result.Outcome, result.Reason = bulkOutcomeFailed, err.Error()
+		return result
+	}
+
+	operations.track(event, operation)
+	result.Outcome, result.Operation = bulkOutcomeChanged, operation
+	return result
+}
+
+// listProjectInstances returns every Cloud SQL instance of a project, sorted
+// by name, following pagination.
+func listProjectInstances(ctx context.Context, project string) ([]*sqladmin.DatabaseInstance, error) {
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	var instances []*sqladmin.DatabaseInstance
+	err = sqlService.Instances.List(project).Pages(ctx, func(page *sqladmin.InstancesListResponse) error {
+		instances = append(instances, page.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	return instances, nil
+}
+
+// matchLabels reports whether the instance carries every label in selector.
+func matchLabels(instance *sqladmin.DatabaseInstance, selector map[string]string) bool {
+	var labels map[string]string
+	if instance.Settings != nil {
+		labels = instance.Settings.UserLabels
+	}
+	for key, value := range selector {
+		if got, ok := labels[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultCheckCacheTTL is used when CHECK_CACHE_TTL is not set.
+const defaultCheckCacheTTL = 30 * time.Second
+
+type cachedInstance struct {
+	data      *SQLInstancesData
+	fetchedAt time.Time
+}
+
+// instanceCache keeps the last known state of each instance so frequent
+// /check pollers don't each cost a SQL Admin API call.
+type instanceCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedInstance
+}
+
+func newInstanceCache(ttl time.Duration) *instanceCache {
+	return &instanceCache{
+		ttl:     ttl,
+		entries: make(map[string]cachedInstance),
+	}
+}
+
+// get returns the instance state and how old it is. A cache miss, an expired
+// entry or fresh=true triggers a live SQL Admin call whose result replaces
+// the cached entry.
+func (c *instanceCache) get(ctx context.Context, projectID string, instanceID string, fresh bool) (*SQLInstancesData, time.Duration, error) {
+	key := projectID + "/" + instanceID
+
+	if !fresh && c.ttl > 0 {
+		c.mu.Lock()
+		entry, ok := c.entries[key]
+		c.mu.Unlock()
+
+		if age := time.Since(entry.fetchedAt); ok && age < c.ttl {
+			return entry.data, age, nil
+		}
+	}
+
+	data, err := checkStatusInstances(ctx, projectID, instanceID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	c.mu.Lock()
+	c.entries[key] = cachedInstance{data: data, fetchedAt: time.Now()}
+	c.mu.Unlock()
+
+	return data, 0, nil
+}
+
+// invalidate drops the cached state of an instance, so the next /check
+// after an action reads the instance live instead of the state before it.
+func (c *instanceCache) invalidate(projectID string, instanceID string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, projectID+"/"+instanceID)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// chainOutcomeBlocked is the outcome of a chain step that didn't run
+// because a step it waits for failed.
+const chainOutcomeBlocked = "blocked"
+
+// Chain is a set of targets started and stopped together in dependency
+// order, e.g. a database, then the VM of the app using it. Chains are
+// declared in the config file and run by schedules naming them.
+type Chain struct {
+	ID    string      `yaml:"id" json:"id"`
+	Steps []ChainStep `yaml:"steps" json:"steps"`
+}
+
+// ChainStep is one target of a chain. A start runs it once the steps of
+// DependsOn are running, a stop once the steps depending on it are
+// stopped. Timeout bounds how long the step may take to reach its state,
+// maxWaitTimeout by default. Project defaults to the project of the
+// schedule and Kind to cloudsql.
+type ChainStep struct {
+	ID        string        `yaml:"id" json:"id"`
+	Project   string        `yaml:"project" json:"project,omitempty"`
+	Kind      string        `yaml:"kind" json:"kind,omitempty"`
+	Location  string        `yaml:"location" json:"location,omitempty"`
+	Instance  string        `yaml:"instance" json:"instance"`
+	DependsOn []string      `yaml:"depends_on" json:"depends_on,omitempty"`
+	Timeout   time.Duration `yaml:"timeout" json:"timeout,omitempty"`
+}
+
+// ChainStepResult is the outcome of one step of a chain run. Outcome is
+// changed, skipped when the target already was in the requested state,
+// failed, blocked or dry_run.
+type ChainStepResult struct {
+	Step      string `json:"step"`
+	Kind      string `json:"kind"`
+	Project   string `json:"project"`
+	Instance  string `json:"instance"`
+	Outcome   string `json:"outcome"`
+	Operation string `json:"operation,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// chains are the chains of the config file, by id.
+var chains reloadable[map[string]Chain]
+
+// unknownChain reports whether a schedule names a chain that isn't in the
+// config file.
+func unknownChain(id string) bool {
+	_, ok := chains.load()[id]
+	return id != "" && !ok
+}
+
+func indexChains(items []Chain) map[string]Chain {
+	index := make(map[string]Chain, len(items))
+	for _, chain := range items {
+		index[chain.ID] = chain
+	}
+	return index
+}
+
+// validateChains checks the chains of the config file, reporting problems
+// by their position in it. Dependencies must name steps of the same chain
+// and must not form a cycle.
+func validateChains(items []Chain) error {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, chain := range items {
+		prefix := fmt.Sprintf("chains[%d]", i)
+		if chain.ID == "" {
+			errs = append(errs, fmt.Errorf("%s.id: is required", prefix))
+		} else if seen[chain.ID] {
+			errs = append(errs, fmt.Errorf("%s.id: %q is used twice", prefix, chain.ID))
+		}
+		seen[chain.ID] = true
+		if len(chain.Steps) == 0 {
+			errs = append(errs, fmt.Errorf("%s.steps: at least one step is required", prefix))
+		}
+
+		steps := make(map[string]bool)
+		for j, step := range chain.Steps {
+			stepPrefix := fmt.Sprintf("%s.steps[%d]", prefix, j)
+			if step.ID == "" {
+				errs = append(errs, fmt.Errorf("%s.id: is required", stepPrefix))
+			} else if steps[step.ID] {
+				errs = append(errs, fmt.Errorf("%s.id: %q is used twice", stepPrefix, step.ID))
+			}
+			steps[step.ID] = true
+			if step.Instance == "" {
+				errs = append(errs, fmt.Errorf("%s.instance: is required", stepPrefix))
+			}
+			switch {
+			case step.Kind == "" || step.Kind == storeKindCloudSQL:
+			case !slices.Contains(storeKinds, step.Kind):
+				errs = append(errs, fmt.Errorf("%s.kind: must be 'cloudsql', 'alloydb', 'redis' or 'gce'", stepPrefix))
+			case step.Location == "":
+				errs = append(errs, fmt.Errorf("%s.location: is required for %s steps", stepPrefix, step.Kind))
+			}
+			if step.Timeout < 0 {
+				errs = append(errs, fmt.Errorf("%s.timeout: must not be negative", stepPrefix))
+			}
+		}
+		for j, step := range chain.Steps {
+			for k, dependency := range step.DependsOn {
+				if dependency == step.ID || !steps[dependency] {
+					errs = append(errs, fmt.Errorf("%s.steps[%d].depends_on[%d]: %q is not another step of the chain", prefix, j, k, dependency))
+				}
+			}
+		}
+		if len(errs) == 0 {
+			if cycle := chain.cycle(); cycle != "" {
+				errs = append(errs, fmt.Errorf("%s.steps: dependencies form a cycle through %q", prefix, cycle))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// cycle returns a step on a dependency cycle, empty when there is none.
+func (c Chain) cycle() string {
+	pending := make(map[string]int, len(c.Steps))
+	dependents := make(map[string][]string)
+	for _, step := range c.Steps {
+		pending[step.ID] = len(step.DependsOn)
+		for _, dependency := range step.DependsOn {
+			dependents[dependency] = append(dependents[dependency], step.ID)
+		}
+	}
+
+	var ready []string
+	for _, step := range c.Steps {
+		if pending[step.ID] == 0 {
+			ready = append(ready, step.ID)
+		}
+	}
+	for len(ready) > 0 {
+		id := ready[0]
+		ready = ready[1:]
+		delete(pending, id)
+		for _, dependent := range dependents[id] {
+			if pending[dependent]--; pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	for _, step := range c.Steps {
+		if _, ok := pending[step.ID]; ok {
+			return step.ID
+		}
+	}
+	return ""
+}
+
+// waitsFor maps each step to the steps it waits for: its dependencies on
+// start, the steps depending on it on stop.
+func (c Chain) waitsFor(action string) map[string][]string {
+	waits := make(map[string][]string, len(c.Steps))
+	for _, step := range c.Steps {
+		if action != scheduleActionStop {
+			waits[step.ID] = append(waits[step.ID], step.DependsOn...)
+			continue
+		}
+		for _, dependency := range step.DependsOn {
+			waits[dependency] = append(waits[dependency], step.ID)
+		}
+	}
+	return waits
+}
+
+// runChain starts or stops every step of chain, each once the steps it
+// waits for reached their state, independent steps in parallel. A failed
+// step blocks the steps waiting for it, the others still run. The error
+// lists every failed and blocked step.
+func runChain(ctx context.Context, chain Chain, action triggeredAction) ([]ChainStepResult, error) {
+	waits := chain.waitsFor(action.Action)
+	index := make(map[string]int, len(chain.Steps))
+	done := make(map[string]chan struct{}, len(chain.Steps))
+	for i, step := range chain.Steps {
+		index[step.ID] = i
+		done[step.ID] = make(chan struct{})
+	}
+
+	results := make([]ChainStepResult, len(chain.Steps))
+	var wg sync.WaitGroup
+	for i, step := range chain.Steps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[step.ID])
+
+			var blockedBy []string
+			for _, id := range waits[step.ID] {
+				<-done[id]
+				if outcome := results[index[id]].Outcome; outcome == bulkOutcomeFailed || outcome == chainOutcomeBlocked {
+					blockedBy = append(blockedBy, id)
+				}
+			}
+			results[i] = runChainStep(ctx, step, action, blockedBy)
+		}()
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, result := range results {
+		if result.Outcome == bulkOutcomeFailed || result.Outcome == chainOutcomeBlocked {
+			errs = append(errs, fmt.Errorf("step %s: %s", result.Step, result.Error))
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// runChainStep applies the action of the chain to one step and waits for
+// the target to reach the requested state.
+func runChainStep(ctx context.Context, step ChainStep, action triggeredAction, blockedBy []string) ChainStepResult {
+	action.Instance = step.Instance
+	if step.Project != "" {
+		action.Project = step.Project
+	}
+	kind := step.Kind
+	if kind == "" {
+		kind = storeKindCloudSQL
+	}
+	result := ChainStepResult{Step: step.ID, Kind: kind, Project: action.Project, Instance: step.Instance}
+	attrs := action.attrs("step", step.ID, "kind", kind)
+	if len(blockedBy) > 0 {
+		result.Outcome = chainOutcomeBlocked
+		result.Error = fmt.Sprintf("blocked by %v", blockedBy)
+		slog.Warn("Chain step blocked", append(attrs, "blocked_by", blockedBy)...)
+		return result
+	}
+
+	timeout := step.Timeout
+	if timeout == 0 {
+		timeout = maxWaitTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	store, operation, err := runStoreAction(ctx, kind, step.Location, action)
+	if err == nil && operation == "" {
+		result.Outcome = bulkOutcomeSkipped
+		if dryRun.load() {
+			result.Outcome = bulkOutcomeDryRun
+		}
+		return result
+	}
+	if err == nil {
+		result.Operation = operation
+		state := storeStateRunning
+		if action.Action == scheduleActionStop {
+			state = storeStateStopped
+		}
+		err = waitForStoreState(ctx, storeProviders[kind], store, state)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("not %s after %s", state, timeout)
+		}
+		// Steps waiting for a database need it to accept connections.
+		if err == nil && kind == storeKindCloudSQL && action.Action != scheduleActionStop {
+			_, err = warmUpInstance(ctx, action.Project, step.Instance)
+		}
+	}
+	if err != nil {
+		result.Outcome, result.Error = bulkOutcomeFailed, err.Error()
+		slog.Error("Chain step failed", append(attrs, "error", err)...)
+		return result
+	}
+	result.Outcome = bulkOutcomeChanged
+	slog.Info("Chain step done", attrs...)
+	return result
+}
+
+// waitForStoreState polls store every waitPollInterval until it is in
+// state or ctx is done.
+func waitForStoreState(ctx context.Context, provider storeProvider, store DataStore, state string) error {
+	for {
+		current, err := provider.get(ctx, store.Project, store.Location, store.Name)
+		if err == nil && current.State == state {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(waitPollInterval):
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChaosConfig describes the failures injected into SQL Admin calls. It is
+// meant for staging, to exercise retry and notification paths.
+type ChaosConfig struct {
+	// ErrorRate is the probability (0-1) a call fails with one of Codes.
+	ErrorRate float64
+	Codes     []int
+	// TimeoutRate is the probability (0-1) a call hangs for Delay and then
+	// fails as if the connection timed out.
+	TimeoutRate float64
+	Delay       time.Duration
+	// Methods limits injection to these HTTP methods, all when empty.
+	Methods []string
+}
+
+func (c ChaosConfig) enabled() bool {
+	return c.ErrorRate > 0 || c.TimeoutRate > 0
+}
+
+// chaosTransport fails a random share of requests before they leave the
+// process. With a per-request probability, bulk operations see partial
+// failures naturally.
+type chaosTransport struct {
+	base   http.RoundTripper
+	config ChaosConfig
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.applies(req.Method) {
+		return t.base.RoundTrip(req)
+	}
+
+	if rand.Float64() < t.config.TimeoutRate {
+		timer := time.NewTimer(t.config.Delay)
+		defer timer.Stop()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-timer.C:
+			return nil, fmt.Errorf("chaos: injected timeout after %s: %w", t.config.Delay, context.DeadlineExceeded)
+		}
+	}
+
+	if len(t.config.Codes) > 0 && rand.Float64() < t.config.ErrorRate {
+		return chaosResponse(req, t.config.Codes[rand.IntN(len(t.config.Codes))]), nil
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+func (t *chaosTransport) applies(method string) bool {
+	if len(t.config.Methods) == 0 {
+		return true
+	}
+	for _, m := range t.config.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// chaosResponse mimics a SQL Admin error response for statusCode.
+func chaosResponse(req *http.Request, statusCode int) *http.Response {
+	reason := map[int]string{
+		http.StatusConflict:           "operationInProgress",
+		http.StatusTooManyRequests:    "rateLimitExceeded",
+		http.StatusServiceUnavailable: "backendError",
+	}[statusCode]
+	if reason == "" {
+		reason = "chaos"
+	}
+
+	body := fmt.Sprintf(`{"error":{"code":%d,"message":"chaos: injected %s","errors":[{"reason":%q,"message":"chaos: injected failure","domain":"global"}]}}`,
+		statusCode, http.StatusText(statusCode), reason)
+
+	header := make(http.Header)
+	header.Set("Content-Type", contentTypeJSON)
+	if statusCode == http.StatusTooManyRequests {
+		header.Set("Retry-After", "1")
+	}
+
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader([]byte(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// parseStatusCodes parses a comma separated list such as "409,429,503".
+func parseStatusCodes(value string) ([]int, error) {
+	var codes []int
+	for _, item := range splitList(value) {
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("%q is not an HTTP error status", item)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// Output formats of the CLI commands.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// Exit codes of the CLI commands.
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+)
+
+// cliTimeout bounds a whole CLI command, waiting included.
+const cliTimeout = maxWaitTimeout + time.Minute
+
+// command is a subcommand of the binary.
+type command struct {
+	summary string
+	run     func(args []string, stdout io.Writer, stderr io.Writer) int
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve":    {"serve the HTTP API (the default without a command)", func(args []string, _ io.Writer, _ io.Writer) int { return serve(args) }},
+		"start":    {"start an instance", activateCommand(scheduleActionStart)},
+		"stop":     {"stop an instance", activateCommand(scheduleActionStop)},
+		"status":   {"show the state of an instance", statusCommand},
+		"list":     {"list the instances of the managed projects", listCommand},
+		"run-once": {"run the schedules due since their last run, then exit", runOnceCommand},
+		"help":     {"show this help", func(_ []string, stdout io.Writer, _ io.Writer) int { printUsage(stdout); return exitOK }},
+	}
+}
+
+// runCommand dispatches to a subcommand. Without one, or with only flags,
+// the HTTP API is served so existing deployments keep working.
+func runCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return serve(args)
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown command %q\n\n", args[0])
+		printUsage(stderr)
+		return exitUsage
+	}
+	return cmd.run(args[1:], stdout, stderr)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, commands[name].summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
+// cliOptions are the flags shared by the commands acting on instances.
+type cliOptions struct {
+	config   string
+	project  string
+	instance string
+	output   string
+
+	// cfg is the configuration loaded by setup.
+	cfg *Config
+}
+
+func newCLIFlags(name string, stderr io.Writer, options *cliOptions, withInstance bool) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&options.config, "config", "", "YAML or JSON config file, overrides CONFIG_FILE")
+	flags.StringVar(&options.project, "project", "", "project, overrides PROJECT_ID")
+	if withInstance {
+		flags.StringVar(&options.instance, "instance", "", "instance, overrides INSTANCE_ID")
+	}
+	flags.StringVar(&options.output, "output", outputText, "output format, text or json")
+	return flags
+}
+
+// setup loads the configuration the way serve does, with the flags winning
+// over the environment, and prepares the SQL Admin client.
+func (o *cliOptions) setup() error {
+	if o.output != outputText && o.output != outputJSON {
+		return fmt.Errorf("--output: must be text or json, got %q", o.output)
+	}
+	for name, value := range map[string]string{"CONFIG_FILE": o.config, "PROJECT_ID": o.project, "INSTANCE_ID": o.instance} {
+		if value != "" {
+			os.Setenv(name, value)
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	// The simulator only lives as long as serve.
+	cfg.Simulate = false
+
+	configureLogging(cfg.LogFormat)
+	logLevel.Set(cfg.LogLevel)
+	if err := configureSQLAdmin(cfg); err != nil {
+		return err
+	}
+	cfg.apply()
+	o.cfg = cfg
+	return nil
+}
+
+// parseCLI parses the flags and sets up the command. It reports why it
+// failed on stderr, the command then exits with exitUsage.
+func parseCLI(flags *flag.FlagSet, args []string, options *cliOptions, stderr io.Writer) bool {
+	if err := flags.Parse(args); err != nil {
+		return false
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(stderr, "Unexpected arguments: %s\n", strings.Join(flags.Args(), " "))
+		flags.Usage()
+		return false
+	}
+	if err := options.setup(); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return false
+	}
+	return true
+}
+
+// finishCLI waits for the notifications of the command and reports err.
+func finishCLI(err error, stderr io.Writer) int {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	notifications.wait(ctx)
+
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// CLIActionResult is what start and stop print.
+type CLIActionResult struct {
+	Action    string              `json:"action"`
+	Project   string              `json:"project"`
+	Instance  string              `json:"instance"`
+	Result    string              `json:"result"`
+	State     string              `json:"state,omitempty"`
+	Operation *sqladmin.Operation `json:"operation,omitempty"`
+}
+
+// Results of start and stop.
+const (
+	cliResultRequested = "requested"
+	cliResultDone      = "done"
+	cliResultSkipped   = "skipped"
+	cliResultDryRun    = "dry_run"
+)
+
+// activateOptions are the flags of start and stop.
+type activateOptions struct {
+	cliOptions
+	wait             bool
+	timeout          time.Duration
+	dryRun           bool
+	backupBeforeStop bool
+	force            bool
+}
+
+func activateCommand(action string) func(args []string, stdout io.Writer, stderr io.Writer) int {
+	return func(args []string, stdout io.Writer, stderr io.Writer) int {
+		var options activateOptions
+		flags := newCLIFlags(action, stderr, &options.cliOptions, true)
+		flags.BoolVar(&options.wait, "wait", false, "wait for the operation to finish")
+		flags.DurationVar(&options.timeout, "timeout", defaultWaitTimeout, "how long --wait waits")
+		flags.BoolVar(&options.dryRun, "dry-run", false, "only report what would be done")
+		if action == scheduleActionStop {
+			flags.BoolVar(&options.backupBeforeStop, "backup-before-stop", false, "take a backup and wait for it before stopping")
+			flags.BoolVar(&options.force, "force", false, "stop even with open connections")
+		}
+
+		if !parseCLI(flags, args, &options.cliOptions, stderr) {
+			return exitUsage
+		}
+		dryRun.store(dryRun.load() || options.dryRun)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cliTimeout)
+		defer cancel()
+		return finishCLI(cliActivate(ctx, stdout, action, options), stderr)
+	}
+}
+
+// cliActivate starts or stops projectID/instanceID, as set up from the
+// flags, like a schedule would.
+func cliActivate(ctx context.Context, stdout io.Writer, action string, options activateOptions) error {
+	result := CLIActionResult{Action: action, Project: projectID.load(), Instance: instanceID.load(), Result: cliResultRequested}
+
+	triggeredBy := "cli"
+	if user := os.Getenv("USER"); user != "" {
+		triggeredBy += " (" + user + ")"
+	}
+	operation, err := runTriggeredAction(ctx, triggeredAction{
+		Action:           action,
+		Project:          projectID.load(),
+		Instance:         instanceID.load(),
+		Source:           actionSourceCLI,
+		TriggeredBy:      triggeredBy,
+		BackupBeforeStop: options.backupBeforeStop,
+		Force:            options.force,
+	})
+	if err != nil {
+		return err
+	}
+	result.Operation = operation
+
+	switch {
+	case operation == nil:
+		// Nothing was patched, either the instance is already in the
+		// requested state or this is a dry run.
+		status, err := checkStatusInstances(ctx, projectID.load(), instanceID.load())
+		if err != nil {
+			return err
+		}
+		result.State, result.Result = status.State, cliResultSkipped
+		if (status.State == "RUNNABLE") != (action == scheduleActionStart) {
+			result.Result = cliResultDryRun
+		}
+	case options.wait:
+		operation, err = waitForOperation(ctx, projectID.load(), operation, options.timeout)
+		if operation.Status == "DONE" {
+			operations.finished(operation, err)
+		}
+		result.Operation = operation
+		if err != nil {
+			return fmt.Errorf("%s %s/%s: %w", action, projectID.load(), instanceID.load(), err)
+		}
+		status, err := checkStatusInstances(ctx, projectID.load(), instanceID.load())
+		if err != nil {
+			return err
+		}
+		result.State, result.Result = status.State, cliResultDone
+	}
+
+	if options.output == outputJSON {
+		return writeJSON(stdout, result)
+	}
+
+	line := fmt.Sprintf("%s %s/%s: %s", action, result.Project, result.Instance, strings.ReplaceAll(result.Result, "_", " "))
+	if result.Operation != nil {
+		line += ", operation " + result.Operation.Name
+	}
+	if result.State != "" {
+		line += ", state " + result.State
+	}
+	_, err = fmt.Fprintln(stdout, line)
+	return err
+}
+
+func statusCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	var options cliOptions
+	flags := newCLIFlags("status", stderr, &options, true)
+	if !parseCLI(flags, args, &options, stderr) {
+		return exitUsage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cliTimeout)
+	defer cancel()
+	return finishCLI(cliStatus(ctx, stdout, options.output), stderr)
+}
+
+// cliStatus prints the state of projectID/instanceID.
+func cliStatus(ctx context.Context, stdout io.Writer, output string) error {
+	status, err := checkStatusInstances(ctx, projectID.load(), instanceID.load())
+	if err != nil {
+		return err
+	}
+	if output == outputJSON {
+		return writeJSON(stdout, status)
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Instance:\t%s/%s\n", projectID.load(), status.Name)
+	fmt.Fprintf(tw, "State:\t%s\n", status.State)
+	fmt.Fprintf(tw, "Version:\t%s\n", status.DatabaseVersion)
+	fmt.Fprintf(tw, "Tier:\t%s\n", status.Tier)
+	fmt.Fprintf(tw, "Region:\t%s\n", status.Region)
+	return tw.Flush()
+}
+
+func listCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	var (
+		options cliOptions
+		filter  instanceFilter
+		labels  string
+	)
+	flags := newCLIFlags("list", stderr, &options, false)
+	flags.StringVar(&filter.State, "state", "", "only list instances in this state")
+	flags.StringVar(&filter.Region, "region", "", "only list instances in this region")
+	flags.StringVar(&labels, "label", "", "only list instances with these labels, key=value[,key=value]")
+
+	instanceRequired = false
+	if !parseCLI(flags, args, &options, stderr) {
+		return exitUsage
+	}
+
+	selector, err := parseLabelSelector(labels)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error: --label:", err)
+		return exitUsage
+	}
+	filter.Labels = selector
+
+	projects := managedProjects.load()
+	if options.project != "" || len(projects) == 0 {
+		projects = []string{projectID.load()}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cliTimeout)
+	defer cancel()
+	return finishCLI(cliList(ctx, stdout, options.output, projects, filter), stderr)
+}
+
+// parseLabelSelector parses key=value[,key=value].
+func parseLabelSelector(raw string) (map[string]string, error) {
+	selector := map[string]string{}
+	for _, pair := range splitList(raw) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("must be key=value, got %q", pair)
+		}
+		selector[key] = value
+	}
+	return selector, nil
+}
+
+// cliList prints the instances of projects matching filter.
+func cliList(ctx context.Context, stdout io.Writer, output string, projects []string, filter instanceFilter) error {
+	data := InstanceListData{Instances: []InstanceSummary{}}
+	for _, project := range projects {
+		instances, err := listProjectInstances(ctx, project)
+		if err != nil {
+			return fmt.Errorf("failed to list instances of %s: %w", project, err)
+		}
+		for _, instance := range instances {
+			if filter.match(instance) {
+				data.Instances = append(data.Instances, newInstanceSummary(instance))
+			}
+		}
+	}
+	data.TotalSize = len(data.Instances)
+
+	if output == outputJSON {
+		return writeJSON(stdout, data)
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tNAME\tSTATE\tVERSION\tTIER\tREGION")
+	for _, instance := range data.Instances {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", instance.Project, instance.Name, instance.State, instance.DatabaseVersion, instance.Tier, instance.Region)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	alloydb "google.golang.org/api/alloydb/v1"
+	compute "google.golang.org/api/compute/v1"
+	monitoring "google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+	redis "google.golang.org/api/redis/v1"
+	"google.golang.org/api/sqladmin/v1"
+	htransport "google.golang.org/api/transport/http"
+
+	"scheduler-db/pkg/sqlctl"
+)
+
+// defaultSQLAdminCallTimeout is used when SQLADMIN_CALL_TIMEOUT is not set.
+// It leaves room for the retries of a call.
+const defaultSQLAdminCallTimeout = time.Minute
+
+var (
+	// sqlAdminEndpoint overrides the SQL Admin API base URL. It is only set
+	// in simulation mode.
+	sqlAdminEndpoint string
+
+	// monitoringEndpoint overrides the Cloud Monitoring API base URL, set
+	// along with sqlAdminEndpoint.
+	monitoringEndpoint string
+
+	// alloyDBEndpoint, redisEndpoint and computeEndpoint override the
+	// AlloyDB, Memorystore for Redis and Compute Engine API base URLs, set
+	// along with sqlAdminEndpoint.
+	alloyDBEndpoint string
+	redisEndpoint   string
+	computeEndpoint string
+
+	// sqlAdminTransport is the transport below authentication, wrapped by
+	// the debugging modes. nil means http.DefaultTransport.
+	sqlAdminTransport reloadable[http.RoundTripper]
+
+	// sqlAdminOffline is set when requests never reach Google (simulation
+	// or replay), so no credentials are attached.
+	sqlAdminOffline reloadable[bool]
+
+	// sqlAdminCallTimeout bounds each SQL Admin call, retries included. Set
+	// from SQLADMIN_CALL_TIMEOUT, 0 leaves calls bounded by their context
+	// only.
+	sqlAdminCallTimeout reloadable[time.Duration]
+
+	// sqlAdminClient holds the shared clients, one per credential source,
+	// built on first use and dropped whenever the settings above change.
+	sqlAdminClient struct {
+		mu       sync.Mutex
+		services map[string]*sqladmin.Service
+	}
+
+	// monitoringClient holds the Cloud Monitoring clients the same way.
+	monitoringClient struct {
+		mu       sync.Mutex
+		services map[string]*monitoring.Service
+	}
+
+	// alloyDBClient, redisClient and computeClient hold the clients of the
+	// other data store kinds the same way.
+	alloyDBClient struct {
+		mu       sync.Mutex
+		services map[string]*alloyDBAPI
+	}
+	redisClient struct {
+		mu       sync.Mutex
+		services map[string]*redis.Service
+	}
+	computeClient struct {
+		mu       sync.Mutex
+		services map[string]*compute.Service
+	}
+)
+
+// configureSQLAdmin prepares the transport chain shared by every SQL Admin
+// client according to the debugging modes in cfg.
+func configureSQLAdmin(cfg *Config) error {
+	defer resetSQLAdminService()
+	defer resetReadiness()
+
+	var transport http.RoundTripper
+	offline := cfg.Simulate
+
+	switch {
+	case cfg.ReplayDir != "":
+		replayer, err := newReplayTransport(cfg.ReplayDir)
+		if err != nil {
+			return fmt.Errorf("replay: %w", err)
+		}
+		transport = replayer
+		offline = true
+	case cfg.RecordDir != "":
+		recorder, err := newRecordingTransport(http.DefaultTransport, cfg.RecordDir)
+		if err != nil {
+			return fmt.Errorf("record: %w", err)
+		}
+		transport = recorder
+	}
+
+	if cfg.Chaos.enabled() {
+		base := transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		transport = &chaosTransport{base: base, config: cfg.Chaos}
+	}
+	sqlAdminTransport.store(transport)
+
+	sqlAdminOffline.store(offline)
+	sqlAdminRetry.store(cfg.Retry)
+	sqlAdminCallTimeout.store(cfg.SQLAdminCallTimeout)
+	fallback := newCredentialProvider(cfg.CredentialsFile, cfg.CredentialsJSON)
+	credentials.store(fallback)
+	projectCredentials.store(newProjectCredentialProviders(cfg.ProjectCredentials, fallback))
+	configureImpersonation(cfg.Impersonate)
+	return nil
+}
+
+// sqlAdminContext derives the context of one SQL Admin call from ctx,
+// usually the request context so the call is cancelled when the client
+// goes away.
+func sqlAdminContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := sqlAdminCallTimeout.load()
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// sqlAdminService returns the SQL Admin client for calls on project, shared
+// by every project using the same credentials. Credentials are loaded when
+// the client is built, so a rotated key is picked up after
+// resetSQLAdminService.
+func sqlAdminService(project string) (*sqladmin.Service, error) {
+	provider := credentialsFor(project)
+
+	sqlAdminClient.mu.Lock()
+	defer sqlAdminClient.mu.Unlock()
+
+	if service, ok := sqlAdminClient.services[provider.String()]; ok {
+		return service, nil
+	}
+
+	service, err := newSQLAdminService(context.Background(), provider)
+	if err != nil {
+		return nil, err
+	}
+	if sqlAdminClient.services == nil {
+		sqlAdminClient.services = make(map[string]*sqladmin.Service)
+	}
+	sqlAdminClient.services[provider.String()] = service
+	return service, nil
+}
+
+// sqlClientFor returns the client behind the controller of project. Tests
+// replace it with a sqlctltest.Fake.
+var sqlClientFor = func(project string) (sqlctl.Client, error) {
+	service, err := sqlAdminService(project)
+	if err != nil {
+		return nil, err
+	}
+	return sqlctl.NewClient(service), nil
+}
+
+// sqlController returns the controller acting on the instances of project,
+// with the poll interval and call timeout of the current settings.
+func sqlController(project string) (*sqlctl.Controller, error) {
+	client, err := sqlClientFor(project)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlctl.Controller{Client: client, PollInterval: waitPollInterval, CallTimeout: sqlAdminCallTimeout.load()}, nil
+}
+
+// controllerFor wraps an already resolved service in a controller.
+func controllerFor(service *sqladmin.Service) *sqlctl.Controller {
+	return &sqlctl.Controller{Client: sqlctl.NewClient(service), PollInterval: waitPollInterval, CallTimeout: sqlAdminCallTimeout.load()}
+}
+
+// resetSQLAdminService drops the shared clients so the next calls rebuild
+// them.
+func resetSQLAdminService() {
+	sqlAdminClient.mu.Lock()
+	defer sqlAdminClient.mu.Unlock()
+
+	sqlAdminClient.services = nil
+
+	monitoringClient.mu.Lock()
+	defer monitoringClient.mu.Unlock()
+
+	monitoringClient.services = nil
+
+	alloyDBClient.mu.Lock()
+	defer alloyDBClient.mu.Unlock()
+
+	alloyDBClient.services = nil
+
+	redisClient.mu.Lock()
+	defer redisClient.mu.Unlock()
+
+	redisClient.services = nil
+
+	computeClient.mu.Lock()
+	defer computeClient.mu.Unlock()
+
+	computeClient.services = nil
+}
+
+// newSQLAdminService builds a SQL Admin client using provider from the
+// current settings.
+func newSQLAdminService(ctx context.Context, provider credentialProvider) (*sqladmin.Service, error) {
+	opts, err := googleClientOptions(ctx, provider, sqlAdminEndpoint, sqlAdminLimiter)
+	if err != nil {
+		return nil, err
+	}
+	return sqladmin.NewService(ctx, opts...)
+}
+
+// monitoringService returns the Cloud Monitoring client for reads on
+// project, shared like the SQL Admin clients.
+func monitoringService(project string) (*monitoring.Service, error) {
+	provider := credentialsFor(project)
+
+	monitoringClient.mu.Lock()
+	defer monitoringClient.mu.Unlock()
+
+	if service, ok := monitoringClient.services[provider.String()]; ok {
+		return service, nil
+	}
+
+	opts, err := googleClientOptions(context.Background(), provider, monitoringEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	service, err := monitoring.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if monitoringClient.services == nil {
+		monitoringClient.services = make(map[string]*monitoring.Service)
+	}
+	monitoringClient.services[provider.String()] = service
+	return service, nil
+}
+
+// alloyDBService returns the AlloyDB client for calls on project, shared
+// like the SQL Admin clients.
+func alloyDBService(project string) (*alloyDBAPI, error) {
+	provider := credentialsFor(project)
+
+	alloyDBClient.mu.Lock()
+	defer alloyDBClient.mu.Unlock()
+
+	if api, ok := alloyDBClient.services[provider.String()]; ok {
+		return api, nil
+	}
+
+	client, err := googleHTTPClient(context.Background(), provider, nil)
+	if err != nil {
+		return nil, err
+	}
+	opts := []option.ClientOption{option.WithHTTPClient(client)}
+	if alloyDBEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(alloyDBEndpoint))
+	}
+	service, err := alloydb.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	api := &alloyDBAPI{service: service, client: client}
+	if alloyDBClient.services == nil {
+		alloyDBClient.services = make(map[string]*alloyDBAPI)
+	}
+	alloyDBClient.services[provider.String()] = api
+	return api, nil
+}
+
+// redisService returns the Memorystore for Redis client for calls on
+// project, shared like the SQL Admin clients.
+func redisService(project string) (*redis.Service, error) {
+	provider := credentialsFor(project)
+
+	redisClient.mu.Lock()
+	defer redisClient.mu.Unlock()
+
+	if service, ok := redisClient.services[provider.String()]; ok {
+		return service, nil
+	}
+
+	opts, err := googleClientOptions(context.Background(), provider, redisEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	service, err := redis.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if redisClient.services == nil {
+		redisClient.services = make(map[string]*redis.Service)
+	}
+	redisClient.services[provider.String()] = service
+	return service, nil
+}
+
+// computeService returns the Compute Engine client for calls on project,
+// shared like the SQL Admin clients.
+func computeService(project string) (*compute.Service, error) {
+	provider := credentialsFor(project)
+
+	computeClient.mu.Lock()
+	defer computeClient.mu.Unlock()
+
+	if service, ok := computeClient.services[provider.String()]; ok {
+		return service, nil
+	}
+
+	opts, err := googleClientOptions(context.Background(), provider, computeEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	service, err := compute.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if computeClient.services == nil {
+		computeClient.services = make(map[string]*compute.Service)
+	}
+	computeClient.services[provider.String()] = service
+	return service, nil
+}
+
+// googleClientOptions puts a client on the transport chain of the current
+// settings, authenticated with provider unless requests stay offline and
+// paced by limiter unless nil.
+func googleClientOptions(ctx context.Context, provider credentialProvider, endpoint string, limiter *qpsLimiter) ([]option.ClientOption, error) {
+	client, err := googleHTTPClient(ctx, provider, limiter)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []option.ClientOption{option.WithHTTPClient(client)}
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	return opts, nil
+}
+
+// googleHTTPClient is an HTTP client on the transport chain of the current
+// settings, authenticated with provider unless requests stay offline. Only
+// the SQL Admin client is paced by a limiter, the other APIs have quotas of
+// their own.
+func googleHTTPClient(ctx context.Context, provider credentialProvider, limiter *qpsLimiter) (*http.Client, error) {
+	base := sqlAdminTransport.load()
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	base = traceSQLAdmin(instrumentSQLAdmin(base))
+	if limiter != nil {
+		base = &qpsTransport{base: base, limiter: limiter}
+	}
+	base = retrySQLAdmin(base, sqlAdminRetry.load())
+
+	if sqlAdminOffline.load() {
+		return &http.Client{Transport: base}, nil
+	}
+	transport, err := htransport.NewTransport(ctx, base,
+		append(provider.options(), option.WithScopes(sqladmin.CloudPlatformScope))...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// actionClone names clones in notifications and the audit log.
+const actionClone = "clone"
+
+// cloneSettingsTimeout bounds the wait for a clone to be created before its
+// tier and labels are applied. Clones of large instances take a while.
+const cloneSettingsTimeout = 2 * time.Hour
+
+// validInstanceName matches Cloud SQL instance ids.
+var validInstanceName = regexp.MustCompile(`^[a-z]([a-z0-9-]{0,96}[a-z0-9])?$`)
+
+// CloneRequest is the body of POST /v1/instances/{instance}/clone. Tier
+// and Labels are applied to the clone once it exists. StopCron gives the
+// clone a stop schedule, without it the clone inherits the stop schedules
+// of the source.
+type CloneRequest struct {
+	Name     string            `json:"name"`
+	Tier     string            `json:"tier"`
+	Labels   map[string]string `json:"labels"`
+	StopCron string            `json:"stop_cron"`
+	Timezone string            `json:"timezone"`
+}
+
+func (req *CloneRequest) validate(source string) validationErrors {
+	var errs validationErrors
+	switch {
+	case req.Name == "":
+		errs = append(errs, fieldError{Field: "name", Message: "is required"})
+	case !validInstanceName.MatchString(req.Name):
+		errs = append(errs, fieldError{Field: "name", Message: "must be a Cloud SQL instance id: lowercase letters, digits and hyphens, starting with a letter"})
+	case req.Name == source:
+		errs = append(errs, fieldError{Field: "name", Message: "must differ from the source instance"})
+	}
+	if req.Tier != "" && !validTier.MatchString(req.Tier) {
+		errs = append(errs, fieldError{Field: "tier", Message: "must be a Cloud SQL tier such as 'db-custom-2-7680'"})
+	}
+	if req.StopCron != "" {
+		if _, err := cron.ParseStandard(req.StopCron); err != nil {
+			errs = append(errs, fieldError{Field: "stop_cron", Message: "is not a valid cron expression: " + err.Error()})
+		}
+	}
+	if req.Timezone != "" {
+		if req.StopCron == "" {
+			errs = append(errs, fieldError{Field: "timezone", Message: "only applies with stop_cron"})
+		} else if _, err := time.LoadLocation(req.Timezone); err != nil {
+			errs = append(errs, fieldError{Field: "timezone", Message: "is not a valid IANA timezone"})
+		}
+	}
+	return errs
+}
+
+// settings are the settings applied to the clone once created, nil when
+// there are none.
+func (req *CloneRequest) settings() *sqladmin.Settings {
+	if req.Tier == "" && len(req.Labels) == 0 {
+		return nil
+	}
+	return &sqladmin.Settings{Tier: req.Tier, UserLabels: req.Labels}
+}
+
+// CloneResult is the answer of a clone: the clone operation, the stop
+// schedules created for the clone and, after waiting, its state.
+type CloneResult struct {
+	Operation *sqladmin.Operation `json:"operation"`
+	Clone     string              `json:"clone"`
+	Instance  *SQLInstancesData   `json:"instance,omitempty"`
+	Schedules []ScheduleData      `json:"schedules"`
+}
+
+// cloneHandler clones an instance into a new one, e.g. to refresh a dev
+// database from production. The clone gets stop schedules right away so it
+// doesn't keep running, and its tier and labels are applied in the
+// background once it is created.
+func cloneHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	project, source := targetProject(r), targetInstance(r)
+	var payload CloneRequest
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if errs := payload.validate(source); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	body := &sqladmin.InstancesCloneRequest{CloneContext: &sqladmin.CloneContext{DestinationInstanceName: payload.Name}}
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunCall(http.MethodPost, sqlAdminInstancePath(project, source)+"/clone", body))
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	operation, err := sqlService.Instances.Clone(project, source, body).Context(ctx).Do()
+	event := newNotificationEvent(actionClone, actionSourceAPI, requestPrincipal(r), project, source)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgCloneFailed, err)
+		return
+	}
+	operations.track(event, operation)
+	auditOperation(r, operation.Name)
+	annotateRequest(r, slog.String("operation", operation.Name))
+
+	result := CloneResult{Operation: operation, Clone: payload.Name, Schedules: []ScheduleData{}}
+	created, err := cloneSchedules(project, source, payload)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create the stop schedules of the clone", "clone", payload.Name, "error", err)
+	}
+	result.Schedules = append(result.Schedules, newScheduleDataList(created)...)
+
+	if settings := payload.settings(); settings != nil {
+		go applyCloneSettings(project, payload.Name, operation, settings, requestPrincipal(r))
+	}
+
+	if !wait {
+		writeSuccessResponse(w, r, http.StatusOK, msgCloneStarted, result, payload.Name)
+		return
+	}
+
+	result.Operation, err = waitForOperation(r.Context(), project, operation, timeout)
+	if result.Operation.Status == "DONE" {
+		operations.finished(result.Operation, err)
+	}
+	if errors.Is(err, errOperationWaitTimeout) {
+		writeErrorResponse(w, r, http.StatusRequestTimeout, msgOperationTimedOut, err, operation.Name, timeout)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgCloneFailed, err)
+		return
+	}
+	result.Instance, _, err = inventoryCache.load().get(r.Context(), project, payload.Name, true)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgCloneStarted, result, payload.Name)
+}
+
+// cloneSchedules creates the stop schedules of a clone: one on StopCron
+// when set, otherwise a copy of each active stop schedule of the source.
+func cloneSchedules(project string, source string, req CloneRequest) ([]Schedule, error) {
+	var specs []Schedule
+	if req.StopCron != "" {
+		specs = append(specs, Schedule{Action: scheduleActionStop, Cron: req.StopCron, Timezone: req.Timezone})
+	} else {
+		for _, schedule := range schedules.list(false) {
+			if schedule.Project == project && schedule.Instance == source && schedule.Action == scheduleActionStop {
+				specs = append(specs, Schedule{Action: scheduleActionStop, Cron: schedule.Cron, Timezone: schedule.Timezone})
+			}
+		}
+	}
+
+	var created []Schedule
+	for _, spec := range specs {
+		spec.Project, spec.Instance = project, req.Name
+		schedule, err := schedules.create(spec)
+		if err != nil {
+			return created, err
+		}
+		created = append(created, schedule)
+	}
+	return created, nil
+}
+
+// applyCloneSettings waits for the clone to be created and then patches its
+// tier and labels, which a clone request can't set.
+func applyCloneSettings(project string, clone string, operation *sqladmin.Operation, settings *sqladmin.Settings, principal string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cloneSettingsTimeout)
+	defer cancel()
+
+	if _, err := waitForOperation(ctx, project, operation, cloneSettingsTimeout); err != nil {
+		slog.Error("Clone not created, its settings were not applied", "project", project, "clone", clone, "error", err)
+		return
+	}
+
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		slog.Error("Failed to apply the settings of the clone", "project", project, "clone", clone, "error", err)
+		return
+	}
+	callCtx, cancelCall := sqlAdminContext(ctx)
+	patch, err := sqlService.Instances.Patch(project, clone, &sqladmin.DatabaseInstance{Settings: settings}).Context(callCtx).Do()
+	cancelCall()
+	event := newNotificationEvent(actionSettings, actionSourceAPI, principal, project, clone)
+	notifyAction(event, patch, err)
+	if err != nil {
+		slog.Error("Failed to apply the settings of the clone", "project", project, "clone", clone, "error", err)
+		return
+	}
+	operations.track(event, patch)
+	slog.Info("Applying the settings of the clone", "project", project, "clone", clone, "tier", settings.Tier, "operation", patch.Name)
+}
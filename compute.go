@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"path"
+	"sort"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// computeProvider starts and stops Compute Engine VMs, e.g. the bastions
+// and application servers of a development environment, so they follow
+// the schedules of their databases. The location of a VM is its zone.
+type computeProvider struct{}
+
+func (computeProvider) list(ctx context.Context, project string) ([]DataStore, error) {
+	service, err := computeService(project)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	var stores []DataStore
+	err = service.Instances.AggregatedList(project).Pages(ctx, func(page *compute.InstanceAggregatedList) error {
+		for _, scope := range page.Items {
+			for _, instance := range scope.Instances {
+				stores = append(stores, newComputeStore(project, instance))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(stores, func(i, j int) bool { return stores[i].Name < stores[j].Name })
+	return stores, nil
+}
+
+func (computeProvider) get(ctx context.Context, project string, location string, name string) (DataStore, error) {
+	service, err := computeService(project)
+	if err != nil {
+		return DataStore{}, err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	instance, err := service.Instances.Get(project, location, name).Context(ctx).Do()
+	if err != nil {
+		return DataStore{}, err
+	}
+	return newComputeStore(project, instance), nil
+}
+
+func (computeProvider) start(ctx context.Context, store DataStore) (string, error) {
+	service, err := computeService(store.Project)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	operation, err := service.Instances.Start(store.Project, store.Location, store.Name).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return operation.Name, nil
+}
+
+func (computeProvider) stop(ctx context.Context, store DataStore) (string, error) {
+	service, err := computeService(store.Project)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	operation, err := service.Instances.Stop(store.Project, store.Location, store.Name).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return operation.Name, nil
+}
+
+// newComputeStore maps a VM to a data store. Stopped VMs are TERMINATED in
+// Compute Engine.
+func newComputeStore(project string, instance *compute.Instance) DataStore {
+	store := DataStore{Kind: storeKindCompute, Project: project, Location: path.Base(instance.Zone), Name: instance.Name, State: instance.Status, Labels: instance.Labels}
+	switch instance.Status {
+	case "RUNNING":
+		store.State = storeStateRunning
+	case "TERMINATED":
+		store.State = storeStateStopped
+	}
+	return store
+}
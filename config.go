@@ -0,0 +1,760 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// startupCheckTimeout bounds the SQL Admin calls made by Config.verify.
+const startupCheckTimeout = 30 * time.Second
+
+// Config holds everything read from the environment at startup.
+type Config struct {
+	ProjectID          string
+	InstanceID         string
+	CredentialsFile    string
+	CredentialsJSON    string
+	Projects           []string
+	ProjectCredentials map[string]string
+	Impersonate        string
+	Port               string
+	AdminPort          string
+	CheckCacheTTL      time.Duration
+	HandlerTimeout     time.Duration
+	ReadHeaderTimeout  time.Duration
+	IdleTimeout        time.Duration
+	MaxHeaderBytes     int64
+	KeepAlives         bool
+	H2C                bool
+	MaxBodyBytes       int64
+	StartupChecks      bool
+	DryRun             bool
+	IncludeReplicas    bool
+	ShutdownTimeout    time.Duration
+	LogLevel           slog.Level
+	LogFormat          string
+	TLS                TLSConfig
+	CORS               CORSConfig
+	Auth               AuthConfig
+	Access             AccessConfig
+	Policies           Policies
+	Notify             NotifyConfig
+	Audit              AuditConfig
+	State              StateConfig
+	Leader             LeaderConfig
+	Tracing            TracingConfig
+	PubSub             PubSubConfig
+	Holidays           HolidayConfig
+	Operator           OperatorConfig
+	WakeProxy          WakeProxyConfig
+	WarmUp             WarmUpConfig
+	Pricing            PricingConfig
+
+	Simulate              bool
+	SimulateLatencyScale  float64
+	RecordDir             string
+	ReplayDir             string
+	Chaos                 ChaosConfig
+	Retry                 RetryConfig
+	RateLimit             RateLimitConfig
+	ConnectionCheck       ConnectionCheckConfig
+	IdleStop              IdleStopConfig
+	Reconcile             ReconcileConfig
+	ShrinkCheckMaxUsage   float64
+	SQLAdminCallTimeout   time.Duration
+	SQLAdminQPS           float64
+	BulkConcurrency       int
+	IdempotencyTTL        time.Duration
+	IdempotencyWindow     time.Duration
+	EventsPollInterval    time.Duration
+	FeatureFlags          map[featureFlag]bool
+	ResponseLocation      *time.Location
+	ResponseTimeFormat    string
+	SchedulesFile         string
+	TrashRetention        time.Duration
+	OverridesFile         string
+	DelayedActionsFile    string
+	SchedulerStateFile    string
+	SchedulerCatchUp      time.Duration
+	Scheduler             bool
+	DeclaredSchedules     []Schedule
+	Chains                []Chain
+	Tenants               []Tenant
+	PendingOperationsFile string
+	LegacySunset          time.Time
+	SecretsRefresh        time.Duration
+	// Secrets are the SHA-256 digests of the secrets read from Secret
+	// Manager, by setting, so a rotation is seen as a change.
+	Secrets map[string]string
+}
+
+// instanceRequired is cleared by commands that act on no instance in
+// particular, such as list, so INSTANCE_ID may be left unset.
+var instanceRequired = true
+
+// loadConfig reads the configuration from CONFIG_FILE, if set, and the
+// environment, which overrides the file. Every invalid or missing value is
+// reported, not just the first one.
+func loadConfig() (*Config, error) {
+	env := &envReader{}
+
+	var file *configFile
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		var err error
+		if file, err = readConfigFile(path); err != nil {
+			return nil, fmt.Errorf("CONFIG_FILE: %w", err)
+		}
+		env.file = file.values()
+	}
+
+	cfg := &Config{
+		ProjectID:             env.required("PROJECT_ID"),
+		InstanceID:            env.string("INSTANCE_ID", ""),
+		CredentialsFile:       env.string("CREDENTIALS_FILE", ""),
+		CredentialsJSON:       env.string("CREDENTIALS_JSON", ""),
+		Projects:              env.list("PROJECTS"),
+		Port:                  env.port("PORT", "80"),
+		AdminPort:             env.port("ADMIN_PORT", "8081"),
+		CheckCacheTTL:         env.duration("CHECK_CACHE_TTL", defaultCheckCacheTTL),
+		HandlerTimeout:        env.duration("HANDLER_TIMEOUT", defaultHandlerTimeout),
+		ReadHeaderTimeout:     env.duration("READ_HEADER_TIMEOUT", defaultReadHeaderTimeout),
+		IdleTimeout:           env.duration("IDLE_TIMEOUT", defaultIdleTimeout),
+		MaxHeaderBytes:        env.positiveInt("MAX_HEADER_BYTES", defaultMaxHeaderBytes),
+		KeepAlives:            env.bool("KEEP_ALIVES", true),
+		H2C:                   env.bool("H2C", false),
+		MaxBodyBytes:          env.positiveInt("MAX_BODY_BYTES", defaultMaxBodyBytes),
+		StartupChecks:         env.bool("STARTUP_CHECKS", true),
+		DryRun:                env.bool("DRY_RUN", false),
+		IncludeReplicas:       env.bool("INCLUDE_REPLICAS", false),
+		ShutdownTimeout:       env.duration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout),
+		LogLevel:              env.logLevel("LOG_LEVEL"),
+		LogFormat:             env.oneOf("LOG_FORMAT", logFormatText, logFormatJSON),
+		PendingOperationsFile: env.string("PENDING_OPERATIONS_FILE", defaultPendingOperationsFile),
+		Simulate:              env.bool("SIMULATE", false),
+		SimulateLatencyScale:  env.nonNegativeFloat("SIMULATE_LATENCY_SCALE", 1),
+		RecordDir:             env.string("RECORD_DIR", ""),
+		ReplayDir:             env.string("REPLAY_DIR", ""),
+		ResponseLocation:      env.location("RESPONSE_TIMEZONE", time.UTC),
+		ResponseTimeFormat:    env.string("RESPONSE_TIME_FORMAT", timeFormatRFC3339),
+		SchedulesFile:         env.string("SCHEDULES_FILE", defaultSchedulesFile),
+		TrashRetention:        env.duration("SCHEDULE_TRASH_RETENTION", defaultTrashRetention),
+		OverridesFile:         env.string("OVERRIDES_FILE", defaultOverridesFile),
+		DelayedActionsFile:    env.string("DELAYED_ACTIONS_FILE", defaultDelayedActionsFile),
+		SchedulerStateFile:    env.string("SCHEDULER_STATE_FILE", defaultSchedulerStateFile),
+		SchedulerCatchUp:      env.duration("SCHEDULER_CATCH_UP", defaultSchedulerCatchUp),
+		Scheduler:             env.bool("SCHEDULER", true),
+		LegacySunset:          env.date("LEGACY_API_SUNSET"),
+		SQLAdminCallTimeout:   env.duration("SQLADMIN_CALL_TIMEOUT", defaultSQLAdminCallTimeout),
+		SQLAdminQPS:           env.nonNegativeFloat("SQLADMIN_QPS", 0),
+		BulkConcurrency:       int(env.positiveInt("BULK_CONCURRENCY", defaultBulkConcurrency)),
+		IdempotencyTTL:        env.duration("IDEMPOTENCY_TTL", defaultIdempotencyTTL),
+		IdempotencyWindow:     env.duration("IDEMPOTENCY_WINDOW", 0),
+		EventsPollInterval:    env.duration("EVENTS_POLL_INTERVAL", defaultEventsPollInterval),
+		SecretsRefresh:        env.duration("SECRETS_REFRESH_INTERVAL", defaultSecretsRefreshInterval),
+		Retry: RetryConfig{
+			MaxAttempts:    int(env.positiveInt("SQLADMIN_RETRY_MAX_ATTEMPTS", defaultRetryMaxAttempts)),
+			Deadline:       env.duration("SQLADMIN_RETRY_DEADLINE", defaultRetryDeadline),
+			InitialBackoff: env.duration("SQLADMIN_RETRY_INITIAL_BACKOFF", defaultRetryInitialBackoff),
+		},
+		ConnectionCheck: ConnectionCheckConfig{
+			Enabled:        env.bool("STOP_CONNECTION_CHECK", false),
+			MaxConnections: env.nonNegativeInt("STOP_MAX_CONNECTIONS", 0),
+		},
+		IdleStop: IdleStopConfig{
+			After:          env.duration("IDLE_STOP_AFTER", defaultIdleStopAfter),
+			GracePeriod:    env.duration("IDLE_STOP_GRACE_PERIOD", defaultIdleStopGracePeriod),
+			MaxConnections: env.nonNegativeInt("IDLE_STOP_MAX_CONNECTIONS", 0),
+			MaxCPU:         env.nonNegativeFloat("IDLE_STOP_MAX_CPU", defaultIdleStopMaxCPU),
+		},
+		Reconcile: ReconcileConfig{
+			Interval: env.duration("RECONCILE_INTERVAL", defaultReconcileInterval),
+		},
+		ShrinkCheckMaxUsage: env.nonNegativeFloat("SHRINK_CHECK_MAX_USAGE", defaultShrinkCheckMaxUsage),
+		RateLimit: RateLimitConfig{
+			PerMinute: env.nonNegativeFloat("RATE_LIMIT_PER_MINUTE", 0),
+			Burst:     int(env.positiveInt("RATE_LIMIT_BURST", defaultRateLimitBurst)),
+		},
+		Chaos: ChaosConfig{
+			ErrorRate:   env.probability("CHAOS_ERROR_RATE"),
+			Codes:       env.statusCodes("CHAOS_ERROR_CODES", []int{http.StatusConflict, http.StatusTooManyRequests, http.StatusServiceUnavailable}),
+			TimeoutRate: env.probability("CHAOS_TIMEOUT_RATE"),
+			Delay:       env.duration("CHAOS_TIMEOUT_DELAY", 30*time.Second),
+			Methods:     env.list("CHAOS_METHODS"),
+		},
+		Auth: AuthConfig{
+			APIKeys:      env.list("AUTH_API_KEYS"),
+			HMACSecret:   env.string("AUTH_HMAC_SECRET", ""),
+			OIDCAudience: env.string("AUTH_OIDC_AUDIENCE", ""),
+			OIDCEmails:   env.list("AUTH_OIDC_EMAILS"),
+		},
+		Audit: AuditConfig{
+			Backend:    env.string("AUDIT_BACKEND", auditBackendFile),
+			File:       env.string("AUDIT_FILE", defaultAuditFile),
+			Project:    env.string("AUDIT_PROJECT", env.lookup("PROJECT_ID")),
+			LogName:    env.string("AUDIT_LOG_NAME", defaultAuditLogName),
+			Collection: env.string("AUDIT_FIRESTORE_COLLECTION", defaultAuditCollection),
+		},
+		State: StateConfig{
+			Backend:    env.string("STATE_BACKEND", stateBackendFile),
+			Project:    env.string("STATE_PROJECT", env.lookup("PROJECT_ID")),
+			Collection: env.string("STATE_FIRESTORE_COLLECTION", defaultStateCollection),
+		},
+		Leader: LeaderConfig{
+			Backend:   env.string("LEADER_ELECTION", leaderElectionNone),
+			Lease:     env.string("LEADER_ELECTION_LEASE", defaultLeaderLease),
+			Namespace: env.string("LEADER_ELECTION_NAMESPACE", ""),
+			Identity:  env.string("LEADER_ELECTION_IDENTITY", ""),
+			Duration:  env.duration("LEADER_ELECTION_DURATION", defaultLeaderDuration),
+		},
+		Tracing: TracingConfig{
+			Exporter:    env.string("TRACING_EXPORTER", tracingExporterNone),
+			Endpoint:    env.string("TRACING_OTLP_ENDPOINT", ""),
+			Project:     env.string("TRACING_PROJECT", env.lookup("PROJECT_ID")),
+			SampleRatio: env.nonNegativeFloat("TRACING_SAMPLE_RATIO", 1),
+		},
+		PubSub: PubSubConfig{
+			Subscription:    env.string("PUBSUB_SUBSCRIPTION", ""),
+			DeadLetterTopic: env.string("PUBSUB_DEAD_LETTER_TOPIC", ""),
+			MaxMessages:     int(env.positiveInt("PUBSUB_MAX_MESSAGES", defaultPubSubMaxMessages)),
+		},
+		Holidays: HolidayConfig{
+			Dates:           env.list("HOLIDAYS"),
+			ICalURL:         env.string("HOLIDAYS_ICAL_URL", ""),
+			RefreshInterval: env.duration("HOLIDAYS_REFRESH_INTERVAL", defaultHolidayRefreshInterval),
+		},
+		Operator: OperatorConfig{
+			Enabled:        env.bool("KUBERNETES_OPERATOR", false),
+			Namespace:      env.string("KUBERNETES_NAMESPACE", ""),
+			APIURL:         env.string("KUBERNETES_API_URL", ""),
+			ResyncInterval: env.duration("KUBERNETES_RESYNC_INTERVAL", defaultOperatorResyncInterval),
+		},
+		WakeProxy: WakeProxyConfig{
+			Listen:       env.string("WAKE_PROXY_LISTEN", ""),
+			Target:       env.string("WAKE_PROXY_TARGET", ""),
+			Project:      env.string("WAKE_PROXY_PROJECT", env.lookup("PROJECT_ID")),
+			Instance:     env.string("WAKE_PROXY_INSTANCE", env.lookup("INSTANCE_ID")),
+			StartTimeout: env.duration("WAKE_PROXY_START_TIMEOUT", maxWaitTimeout),
+		},
+		WarmUp: WarmUpConfig{
+			Probe:   env.oneOf("WARMUP_PROBE", warmUpProbeNone, warmUpProbeTCP),
+			IPType:  env.oneOf("WARMUP_IP_TYPE", warmUpIPPrivate, warmUpIPPublic),
+			Port:    int(env.nonNegativeInt("WARMUP_PORT", 0)),
+			Timeout: env.duration("WARMUP_TIMEOUT", defaultWarmUpTimeout),
+		},
+		Pricing: PricingConfig{
+			Currency:            env.string("SAVINGS_CURRENCY", defaultSavingsCurrency),
+			VCPUHourlyPrice:     env.nonNegativeFloat("SAVINGS_VCPU_HOURLY_PRICE", defaultVCPUHourlyPrice),
+			MemoryGBHourlyPrice: env.nonNegativeFloat("SAVINGS_MEMORY_GB_HOURLY_PRICE", defaultMemoryGBHourlyPrice),
+		},
+		Notify: NotifyConfig{
+			SlackWebhookURL:      env.string("NOTIFY_SLACK_WEBHOOK_URL", ""),
+			GoogleChatWebhookURL: env.string("NOTIFY_GOOGLE_CHAT_WEBHOOK_URL", ""),
+			WebhookURLs:          env.list("NOTIFY_WEBHOOK_URLS"),
+			Template:             env.string("NOTIFY_TEMPLATE", defaultNotifyTemplate),
+			Email: EmailConfig{
+				From:           env.string("NOTIFY_EMAIL_FROM", ""),
+				To:             env.list("NOTIFY_EMAIL_TO"),
+				SMTPAddr:       env.string("NOTIFY_EMAIL_SMTP_ADDR", ""),
+				SMTPUsername:   env.string("NOTIFY_EMAIL_SMTP_USERNAME", ""),
+				SMTPPassword:   env.string("NOTIFY_EMAIL_SMTP_PASSWORD", ""),
+				SendGridAPIKey: env.string("NOTIFY_EMAIL_SENDGRID_API_KEY", ""),
+			},
+		},
+		CORS: CORSConfig{
+			AllowedOrigins:   env.list("CORS_ALLOWED_ORIGINS"),
+			AllowedMethods:   env.list("CORS_ALLOWED_METHODS"),
+			AllowedHeaders:   env.list("CORS_ALLOWED_HEADERS"),
+			AllowCredentials: env.bool("CORS_ALLOW_CREDENTIALS", false),
+			MaxAge:           env.duration("CORS_MAX_AGE", defaultCORSMaxAge),
+		},
+		TLS: TLSConfig{
+			CertFile:      env.string("TLS_CERT_FILE", ""),
+			KeyFile:       env.string("TLS_KEY_FILE", ""),
+			AutocertHosts: env.list("TLS_AUTOCERT_HOSTS"),
+			AutocertCache: env.string("TLS_AUTOCERT_CACHE_DIR", "autocert-cache"),
+			AutocertEmail: env.string("TLS_AUTOCERT_EMAIL", ""),
+			ClientCAFile:  env.string("TLS_CLIENT_CA_FILE", ""),
+			ClientAuth:    env.oneOf("TLS_CLIENT_AUTH", tlsClientAuthRequire, tlsClientAuthOptional),
+		},
+	}
+
+	if len(cfg.Projects) == 0 {
+		cfg.Projects = []string{cfg.ProjectID}
+	}
+	if file != nil {
+		cfg.DeclaredSchedules = file.schedules(env, cfg.ProjectID)
+		cfg.Access = file.Access
+		cfg.Policies = file.Policies
+		cfg.Reconcile.Instances = file.Reconcile.Instances
+		cfg.Chains = file.Chains
+		cfg.Tenants = file.Tenants
+		cfg.Notify.Email.Recipients = file.Notify.EmailRecipients
+	}
+
+	for _, origin := range cfg.CORS.AllowedOrigins {
+		if origin != "*" && !strings.Contains(origin, "://") {
+			env.fail("CORS_ALLOWED_ORIGINS", origin, "must be * or an origin such as https://dash.example.com")
+		}
+	}
+	if len(cfg.CORS.AllowedMethods) == 0 {
+		cfg.CORS.AllowedMethods = defaultCORSMethods
+	}
+	if len(cfg.CORS.AllowedHeaders) == 0 {
+		cfg.CORS.AllowedHeaders = defaultCORSHeaders
+	}
+
+	if err := validateTimeFormat(cfg.ResponseTimeFormat); err != nil {
+		env.fail("RESPONSE_TIME_FORMAT", cfg.ResponseTimeFormat, err.Error())
+	}
+
+	flags, err := parseFeatureFlags(env.string("FEATURE_FLAGS", ""))
+	if err != nil {
+		env.fail("FEATURE_FLAGS", env.string("FEATURE_FLAGS", ""), err.Error())
+	}
+	cfg.FeatureFlags = flags
+
+	projectCredentials, err := parseProjectCredentials(env.list("PROJECT_CREDENTIALS"))
+	if err != nil {
+		env.fail("PROJECT_CREDENTIALS", env.string("PROJECT_CREDENTIALS", ""), err.Error())
+	}
+	cfg.ProjectCredentials = projectCredentials
+	for i := range cfg.Tenants {
+		if cfg.Tenants[i].Project == "" {
+			cfg.Tenants[i].Project = cfg.ProjectID
+		}
+	}
+	if err := validateTenants(cfg.Tenants, cfg.ProjectCredentials); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	scheduled, err := tenantSchedules(cfg.Tenants, cfg.DeclaredSchedules)
+	if err != nil {
+		env.errs = append(env.errs, err)
+	}
+	cfg.DeclaredSchedules = append(cfg.DeclaredSchedules, scheduled...)
+	for _, tenant := range cfg.Tenants {
+		if tenant.Credentials != "" {
+			if cfg.ProjectCredentials == nil {
+				cfg.ProjectCredentials = make(map[string]string)
+			}
+			cfg.ProjectCredentials[tenant.Project] = tenant.Credentials
+		}
+		if !slices.Contains(cfg.Projects, tenant.Project) {
+			cfg.Projects = append(cfg.Projects, tenant.Project)
+		}
+	}
+	cfg.Impersonate = env.string("IMPERSONATE_SERVICE_ACCOUNT", "")
+	if account := cfg.Impersonate; account != "" && !validServiceAccount(impersonatedAccount(account, cfg.ProjectID)) {
+		env.fail("IMPERSONATE_SERVICE_ACCOUNT", account, "must be the email of a service account, such as 'sql-scheduler@{project}.iam.gserviceaccount.com'")
+	}
+	for _, project := range sortedKeys(projectCredentials) {
+		if !slices.Contains(cfg.Projects, project) {
+			cfg.Projects = append(cfg.Projects, project)
+		}
+	}
+
+	idleLabels, err := parseLabelSelector(env.string("IDLE_STOP_LABELS", defaultIdleStopLabels))
+	if err != nil {
+		env.fail("IDLE_STOP_LABELS", env.string("IDLE_STOP_LABELS", ""), err.Error())
+	}
+	cfg.IdleStop.Labels = idleLabels
+
+	tierPrices, err := parseTierPrices(env.list("SAVINGS_TIER_PRICES"))
+	if err != nil {
+		env.fail("SAVINGS_TIER_PRICES", env.string("SAVINGS_TIER_PRICES", ""), err.Error())
+	}
+	cfg.Pricing.TierPrices = tierPrices
+
+	if instanceRequired {
+		env.required("INSTANCE_ID")
+	}
+	if err := cfg.TLS.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	cfg.Auth.ClientCerts = cfg.TLS.ClientCAFile != ""
+	if err := validateChains(cfg.Chains); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if err := cfg.Auth.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if err := cfg.Policies.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if err := cfg.Access.validate(cfg.Auth); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if err := cfg.Audit.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if err := cfg.State.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if err := cfg.Leader.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if err := cfg.Tracing.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if err := cfg.PubSub.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if err := cfg.Holidays.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if cfg.EventsPollInterval < time.Second {
+		env.fail("EVENTS_POLL_INTERVAL", cfg.EventsPollInterval.String(), "must be at least 1s")
+	}
+	if cfg.SchedulerCatchUp < 0 {
+		env.fail("SCHEDULER_CATCH_UP", cfg.SchedulerCatchUp.String(), "must not be negative")
+	}
+	if cfg.WarmUp.Port > 65535 {
+		env.fail("WARMUP_PORT", strconv.Itoa(cfg.WarmUp.Port), "must be a port number")
+	}
+	if cfg.Operator.ResyncInterval < time.Second {
+		env.fail("KUBERNETES_RESYNC_INTERVAL", cfg.Operator.ResyncInterval.String(), "must be at least 1s")
+	}
+	if cfg.ShrinkCheckMaxUsage > 1 {
+		env.fail("SHRINK_CHECK_MAX_USAGE", strconv.FormatFloat(cfg.ShrinkCheckMaxUsage, 'g', -1, 64), "must be a share between 0 and 1")
+	}
+	for i := range cfg.Reconcile.Instances {
+		if cfg.Reconcile.Instances[i].Project == "" {
+			cfg.Reconcile.Instances[i].Project = cfg.ProjectID
+		}
+	}
+	if err := cfg.Reconcile.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if err := cfg.IdleStop.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if err := cfg.WakeProxy.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if err := cfg.Notify.validate(); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if cfg.RecordDir != "" && cfg.ReplayDir != "" {
+		env.fail("REPLAY_DIR", cfg.ReplayDir, "can't be combined with RECORD_DIR")
+	}
+	if cfg.AdminPort == cfg.Port {
+		env.fail("ADMIN_PORT", cfg.AdminPort, "must differ from PORT")
+	}
+
+	cfg.Secrets = env.secrets.digests
+	return cfg, errors.Join(env.errs...)
+}
+
+// verify checks that the configuration is usable against GCP: the
+// credentials load, the projects are reachable and the instance resolves.
+func (c *Config) verify(ctx context.Context) error {
+	perProject := projectCredentials.load()
+	if !c.Simulate && c.ReplayDir == "" {
+		if err := credentials.load().verify(); err != nil {
+			return fmt.Errorf("credentials: %w", err)
+		}
+		for _, project := range sortedKeys(perProject) {
+			if err := perProject[project].verify(); err != nil {
+				return fmt.Errorf("PROJECT_CREDENTIALS: %s: %w", project, err)
+			}
+		}
+	}
+
+	for _, project := range sortedKeys(perProject) {
+		provider := perProject[project]
+		sqlService, err := newSQLAdminService(ctx, provider)
+		if err != nil {
+			return fmt.Errorf("PROJECT_CREDENTIALS: %s is not usable: %w", provider, err)
+		}
+		if _, err := sqlService.Instances.List(project).MaxResults(1).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("PROJECT_CREDENTIALS: project %q is not accessible with %s: %w", project, provider, err)
+		}
+	}
+
+	sqlService, err := newSQLAdminService(ctx, credentialsFor(c.ProjectID))
+	if err != nil {
+		return fmt.Errorf("credentials: %s is not usable: %w", credentialsFor(c.ProjectID), err)
+	}
+
+	if _, err := sqlService.Instances.List(c.ProjectID).MaxResults(1).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("PROJECT_ID: project %q is not accessible: %w", c.ProjectID, err)
+	}
+
+	if _, err := sqlService.Instances.Get(c.ProjectID, c.InstanceID).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("INSTANCE_ID: instance %q not found in project %q: %w", c.InstanceID, c.ProjectID, err)
+	}
+
+	return nil
+}
+
+// apply publishes the configuration to the package level settings used by
+// the handlers. Settings a reload may change are reloadable, so requests in
+// flight read either the old or the new value.
+func (c *Config) apply() {
+	activeConfig.store(c)
+	projectID.store(c.ProjectID)
+	managedProjects.store(c.Projects)
+	instanceID.store(c.InstanceID)
+	port = c.Port
+	adminPort = c.AdminPort
+	inventoryCache.store(newInstanceCache(c.CheckCacheTTL))
+	handlerTimeout = c.HandlerTimeout
+	readHeaderTimeout = c.ReadHeaderTimeout
+	idleTimeout = c.IdleTimeout
+	maxHeaderBytes = int(c.MaxHeaderBytes)
+	keepAlives = c.KeepAlives
+	enableH2C = c.H2C
+	maxBodyBytes.store(c.MaxBodyBytes)
+	idempotencyTTL.store(c.IdempotencyTTL)
+	idempotencyWindow.store(c.IdempotencyWindow)
+	events.configure(c.EventsPollInterval)
+	rateLimits.configure(c.RateLimit)
+	sqlAdminLimiter.configure(c.SQLAdminQPS)
+	bulkQueue.configure(c.BulkConcurrency)
+	connectionCheck.store(c.ConnectionCheck)
+	warmUp.store(c.WarmUp)
+	idleStops.configure(c.IdleStop)
+	reconciles.configure(c.Reconcile)
+	shrinkCheckMaxUsage.store(c.ShrinkCheckMaxUsage)
+	features.replace(c.FeatureFlags)
+	responseLocation.store(c.ResponseLocation)
+	responseTimeFormat.store(c.ResponseTimeFormat)
+	legacySunset.store(c.LegacySunset)
+	cors.store(c.CORS)
+	dryRun.store(c.DryRun)
+	includeReplicasDefault.store(c.IncludeReplicas)
+	authenticators.store(c.Auth.authenticators())
+	accessPolicy.store(c.Access)
+	policies.store(c.Policies)
+	chains.store(indexChains(c.Chains))
+	tenants.store(indexTenants(c.Tenants))
+	notifications.configure(c.Notify)
+	holidays.configure(c.Holidays)
+	pricing.store(c.Pricing)
+	logLevel.Set(c.LogLevel)
+}
+
+// envReader reads typed environment variables, collecting an error for each
+// invalid one instead of stopping at the first. Variables that are not set
+// fall back to the values of the config file.
+type envReader struct {
+	errs    []error
+	file    map[string]string
+	secrets secretReader
+}
+
+// lookup returns the value of setting name, read from Secret Manager when
+// it is a secret: reference.
+func (e *envReader) lookup(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		value = e.file[name]
+	}
+	reference, ok := strings.CutPrefix(value, secretReferencePrefix)
+	if !ok {
+		return value
+	}
+	if e.secrets.failed[name] {
+		return ""
+	}
+	secret, err := e.secrets.read(name, reference)
+	if err != nil {
+		e.secrets.failed[name] = true
+		e.fail(name, value, err.Error())
+		return ""
+	}
+	return secret
+}
+
+func (e *envReader) list(name string) []string {
+	return splitList(e.lookup(name))
+}
+
+func (e *envReader) fail(name string, value string, reason string) {
+	e.errs = append(e.errs, fmt.Errorf("%s: invalid value %q, %s", name, value, reason))
+}
+
+func (e *envReader) string(name string, def string) string {
+	if value := strings.TrimSpace(e.lookup(name)); value != "" {
+		return value
+	}
+	return def
+}
+
+func (e *envReader) required(name string) string {
+	value := strings.TrimSpace(e.lookup(name))
+	if value == "" {
+		e.errs = append(e.errs, fmt.Errorf("%s: is required", name))
+	}
+	return value
+}
+
+func (e *envReader) port(name string, def string) string {
+	value := e.string(name, def)
+	if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+		e.fail(name, value, "must be a number between 1 and 65535")
+	}
+	return value
+}
+
+func (e *envReader) duration(name string, def time.Duration) time.Duration {
+	value := e.lookup(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		e.fail(name, value, "must be a non-negative duration such as '30s'")
+		return def
+	}
+	return d
+}
+
+func (e *envReader) positiveInt(name string, def int64) int64 {
+	value := e.lookup(name)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		e.fail(name, value, "must be a positive integer")
+		return def
+	}
+	return n
+}
+
+func (e *envReader) nonNegativeInt(name string, def int64) int64 {
+	value := e.lookup(name)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		e.fail(name, value, "must be a non-negative integer")
+		return def
+	}
+	return n
+}
+
+func (e *envReader) nonNegativeFloat(name string, def float64) float64 {
+	value := e.lookup(name)
+	if value == "" {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		e.fail(name, value, "must be a non-negative number")
+		return def
+	}
+	return f
+}
+
+func (e *envReader) probability(name string) float64 {
+	value := e.lookup(name)
+	if value == "" {
+		return 0
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 || f > 1 {
+		e.fail(name, value, "must be a number between 0 and 1")
+		return 0
+	}
+	return f
+}
+
+func (e *envReader) statusCodes(name string, def []int) []int {
+	value := e.lookup(name)
+	if value == "" {
+		return def
+	}
+
+	codes, err := parseStatusCodes(value)
+	if err != nil {
+		e.fail(name, value, err.Error())
+		return def
+	}
+	return codes
+}
+
+func (e *envReader) location(name string, def *time.Location) *time.Location {
+	value := e.lookup(name)
+	if value == "" {
+		return def
+	}
+
+	location, err := time.LoadLocation(value)
+	if err != nil {
+		e.fail(name, value, "must be an IANA timezone such as 'Asia/Jakarta'")
+		return def
+	}
+	return location
+}
+
+func (e *envReader) date(name string) time.Time {
+	value := e.lookup(name)
+	if value == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		e.fail(name, value, "must be a date such as '2025-12-31'")
+		return time.Time{}
+	}
+	return t
+}
+
+func (e *envReader) bool(name string, def bool) bool {
+	value := e.lookup(name)
+	if value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.fail(name, value, "must be true or false")
+		return def
+	}
+	return b
+}
+
+// oneOf reads a value restricted to choices, the first being the default.
+func (e *envReader) oneOf(name string, choices ...string) string {
+	value := strings.ToLower(strings.TrimSpace(e.lookup(name)))
+	if value == "" {
+		return choices[0]
+	}
+	for _, choice := range choices {
+		if value == choice {
+			return value
+		}
+	}
+	e.fail(name, value, "must be one of "+strings.Join(choices, ", "))
+	return choices[0]
+}
+
+func (e *envReader) logLevel(name string) slog.Level {
+	value := e.lookup(name)
+	if value == "" {
+		return slog.LevelInfo
+	}
+
+	level, err := parseLogLevel(value)
+	if err != nil {
+		e.fail(name, value, err.Error())
+		return slog.LevelInfo
+	}
+	return level
+}
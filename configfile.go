@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the structure of CONFIG_FILE. Every setting maps to the
+// environment variable named by its env tag, and a set environment variable
+// always wins over the file. JSON files are accepted as well since JSON is
+// valid YAML.
+type configFile struct {
+	ProjectID          string   `yaml:"project_id" env:"PROJECT_ID"`
+	InstanceID         string   `yaml:"instance_id" env:"INSTANCE_ID"`
+	Projects           []string `yaml:"projects" env:"PROJECTS"`
+	CredentialsFile    string   `yaml:"credentials_file" env:"CREDENTIALS_FILE"`
+	CredentialsJSON    string   `yaml:"credentials_json" env:"CREDENTIALS_JSON"`
+	ProjectCredentials []string `yaml:"project_credentials" env:"PROJECT_CREDENTIALS"`
+	Impersonate        string   `yaml:"impersonate_service_account" env:"IMPERSONATE_SERVICE_ACCOUNT"`
+	FeatureFlags       []string `yaml:"feature_flags" env:"FEATURE_FLAGS"`
+	DryRun             string   `yaml:"dry_run" env:"DRY_RUN"`
+	IncludeReplicas    string   `yaml:"include_replicas" env:"INCLUDE_REPLICAS"`
+	SQLAdminTimeout    string   `yaml:"sqladmin_call_timeout" env:"SQLADMIN_CALL_TIMEOUT"`
+	SQLAdminQPS        string   `yaml:"sqladmin_qps" env:"SQLADMIN_QPS"`
+	BulkConcurrency    string   `yaml:"bulk_concurrency" env:"BULK_CONCURRENCY"`
+	SecretsRefresh     string   `yaml:"secrets_refresh_interval" env:"SECRETS_REFRESH_INTERVAL"`
+
+	Server struct {
+		Port              string `yaml:"port" env:"PORT"`
+		AdminPort         string `yaml:"admin_port" env:"ADMIN_PORT"`
+		HandlerTimeout    string `yaml:"handler_timeout" env:"HANDLER_TIMEOUT"`
+		ReadHeaderTimeout string `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT"`
+		IdleTimeout       string `yaml:"idle_timeout" env:"IDLE_TIMEOUT"`
+		MaxHeaderBytes    string `yaml:"max_header_bytes" env:"MAX_HEADER_BYTES"`
+		MaxBodyBytes      string `yaml:"max_body_bytes" env:"MAX_BODY_BYTES"`
+		KeepAlives        string `yaml:"keep_alives" env:"KEEP_ALIVES"`
+		H2C               string `yaml:"h2c" env:"H2C"`
+		StartupChecks     string `yaml:"startup_checks" env:"STARTUP_CHECKS"`
+		ShutdownTimeout   string `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+		PendingOperations string `yaml:"pending_operations_file" env:"PENDING_OPERATIONS_FILE"`
+		CheckCacheTTL     string `yaml:"check_cache_ttl" env:"CHECK_CACHE_TTL"`
+		LegacyAPISunset   string `yaml:"legacy_api_sunset" env:"LEGACY_API_SUNSET"`
+
+		CORS struct {
+			AllowedOrigins   []string `yaml:"allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+			AllowedMethods   []string `yaml:"allowed_methods" env:"CORS_ALLOWED_METHODS"`
+			AllowedHeaders   []string `yaml:"allowed_headers" env:"CORS_ALLOWED_HEADERS"`
+			AllowCredentials string   `yaml:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS"`
+			MaxAge           string   `yaml:"max_age" env:"CORS_MAX_AGE"`
+		} `yaml:"cors"`
+
+		TLS struct {
+			CertFile         string   `yaml:"cert_file" env:"TLS_CERT_FILE"`
+			KeyFile          string   `yaml:"key_file" env:"TLS_KEY_FILE"`
+			AutocertHosts    []string `yaml:"autocert_hosts" env:"TLS_AUTOCERT_HOSTS"`
+			AutocertCacheDir string   `yaml:"autocert_cache_dir" env:"TLS_AUTOCERT_CACHE_DIR"`
+			AutocertEmail    string   `yaml:"autocert_email" env:"TLS_AUTOCERT_EMAIL"`
+			ClientCAFile     string   `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+			ClientAuth       string   `yaml:"client_auth" env:"TLS_CLIENT_AUTH"`
+		} `yaml:"tls"`
+	} `yaml:"server"`
+
+	Log struct {
+		Level  string `yaml:"level" env:"LOG_LEVEL"`
+		Format string `yaml:"format" env:"LOG_FORMAT"`
+	} `yaml:"log"`
+
+	Auth struct {
+		APIKeys      []string `yaml:"api_keys" env:"AUTH_API_KEYS"`
+		HMACSecret   string   `yaml:"hmac_secret" env:"AUTH_HMAC_SECRET"`
+		OIDCAudience string   `yaml:"oidc_audience" env:"AUTH_OIDC_AUDIENCE"`
+		OIDCEmails   []string `yaml:"oidc_emails" env:"AUTH_OIDC_EMAILS"`
+	} `yaml:"auth"`
+
+	Idempotency struct {
+		TTL    string `yaml:"ttl" env:"IDEMPOTENCY_TTL"`
+		Window string `yaml:"window" env:"IDEMPOTENCY_WINDOW"`
+	} `yaml:"idempotency"`
+
+	StopConnections struct {
+		Check          string `yaml:"check" env:"STOP_CONNECTION_CHECK"`
+		MaxConnections string `yaml:"max_connections" env:"STOP_MAX_CONNECTIONS"`
+	} `yaml:"stop_connections"`
+
+	IdleStop struct {
+		After          string   `yaml:"after" env:"IDLE_STOP_AFTER"`
+		GracePeriod    string   `yaml:"grace_period" env:"IDLE_STOP_GRACE_PERIOD"`
+		Labels         []string `yaml:"labels" env:"IDLE_STOP_LABELS"`
+		MaxConnections string   `yaml:"max_connections" env:"IDLE_STOP_MAX_CONNECTIONS"`
+		MaxCPU         string   `yaml:"max_cpu" env:"IDLE_STOP_MAX_CPU"`
+	} `yaml:"idle_stop"`
+
+	Reconcile struct {
+		Interval string `yaml:"interval" env:"RECONCILE_INTERVAL"`
+		// Instances are only read from the file.
+		Instances []DesiredState `yaml:"instances"`
+	} `yaml:"reconcile"`
+
+	ShrinkCheck struct {
+		MaxUsage string `yaml:"max_usage" env:"SHRINK_CHECK_MAX_USAGE"`
+	} `yaml:"shrink_check"`
+
+	RateLimit struct {
+		PerMinute string `yaml:"per_minute" env:"RATE_LIMIT_PER_MINUTE"`
+		Burst     string `yaml:"burst" env:"RATE_LIMIT_BURST"`
+	} `yaml:"rate_limit"`
+
+	Events struct {
+		PollInterval string `yaml:"poll_interval" env:"EVENTS_POLL_INTERVAL"`
+	} `yaml:"events"`
+
+	Retry struct {
+		MaxAttempts    string `yaml:"max_attempts" env:"SQLADMIN_RETRY_MAX_ATTEMPTS"`
+		Deadline       string `yaml:"deadline" env:"SQLADMIN_RETRY_DEADLINE"`
+		InitialBackoff string `yaml:"initial_backoff" env:"SQLADMIN_RETRY_INITIAL_BACKOFF"`
+	} `yaml:"sqladmin_retry"`
+
+	Audit struct {
+		Backend             string `yaml:"backend" env:"AUDIT_BACKEND"`
+		File                string `yaml:"file" env:"AUDIT_FILE"`
+		Project             string `yaml:"project" env:"AUDIT_PROJECT"`
+		LogName             string `yaml:"log_name" env:"AUDIT_LOG_NAME"`
+		FirestoreCollection string `yaml:"firestore_collection" env:"AUDIT_FIRESTORE_COLLECTION"`
+	} `yaml:"audit"`
+
+	State struct {
+		Backend             string `yaml:"backend" env:"STATE_BACKEND"`
+		Project             string `yaml:"project" env:"STATE_PROJECT"`
+		FirestoreCollection string `yaml:"firestore_collection" env:"STATE_FIRESTORE_COLLECTION"`
+	} `yaml:"state"`
+
+	LeaderElection struct {
+		Backend   string `yaml:"backend" env:"LEADER_ELECTION"`
+		Lease     string `yaml:"lease" env:"LEADER_ELECTION_LEASE"`
+		Namespace string `yaml:"namespace" env:"LEADER_ELECTION_NAMESPACE"`
+		Identity  string `yaml:"identity" env:"LEADER_ELECTION_IDENTITY"`
+		Duration  string `yaml:"duration" env:"LEADER_ELECTION_DURATION"`
+	} `yaml:"leader_election"`
+
+	Tracing struct {
+		Exporter     string `yaml:"exporter" env:"TRACING_EXPORTER"`
+		OTLPEndpoint string `yaml:"otlp_endpoint" env:"TRACING_OTLP_ENDPOINT"`
+		Project      string `yaml:"project" env:"TRACING_PROJECT"`
+		SampleRatio  string `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+	} `yaml:"tracing"`
+
+	PubSub struct {
+		Subscription    string `yaml:"subscription" env:"PUBSUB_SUBSCRIPTION"`
+		DeadLetterTopic string `yaml:"dead_letter_topic" env:"PUBSUB_DEAD_LETTER_TOPIC"`
+		MaxMessages     string `yaml:"max_messages" env:"PUBSUB_MAX_MESSAGES"`
+	} `yaml:"pubsub"`
+
+	Holidays struct {
+		Dates           []string `yaml:"dates" env:"HOLIDAYS"`
+		ICalURL         string   `yaml:"ical_url" env:"HOLIDAYS_ICAL_URL"`
+		RefreshInterval string   `yaml:"refresh_interval" env:"HOLIDAYS_REFRESH_INTERVAL"`
+	} `yaml:"holidays"`
+
+	Kubernetes struct {
+		Operator       string `yaml:"operator" env:"KUBERNETES_OPERATOR"`
+		Namespace      string `yaml:"namespace" env:"KUBERNETES_NAMESPACE"`
+		APIURL         string `yaml:"api_url" env:"KUBERNETES_API_URL"`
+		ResyncInterval string `yaml:"resync_interval" env:"KUBERNETES_RESYNC_INTERVAL"`
+	} `yaml:"kubernetes"`
+
+	WakeProxy struct {
+		Listen       string `yaml:"listen" env:"WAKE_PROXY_LISTEN"`
+		Target       string `yaml:"target" env:"WAKE_PROXY_TARGET"`
+		Project      string `yaml:"project" env:"WAKE_PROXY_PROJECT"`
+		Instance     string `yaml:"instance" env:"WAKE_PROXY_INSTANCE"`
+		StartTimeout string `yaml:"start_timeout" env:"WAKE_PROXY_START_TIMEOUT"`
+	} `yaml:"wake_proxy"`
+
+	WarmUp struct {
+		Probe   string `yaml:"probe" env:"WARMUP_PROBE"`
+		IPType  string `yaml:"ip_type" env:"WARMUP_IP_TYPE"`
+		Port    string `yaml:"port" env:"WARMUP_PORT"`
+		Timeout string `yaml:"timeout" env:"WARMUP_TIMEOUT"`
+	} `yaml:"warm_up"`
+
+	Savings struct {
+		Currency            string   `yaml:"currency" env:"SAVINGS_CURRENCY"`
+		VCPUHourlyPrice     string   `yaml:"vcpu_hourly_price" env:"SAVINGS_VCPU_HOURLY_PRICE"`
+		MemoryGBHourlyPrice string   `yaml:"memory_gb_hourly_price" env:"SAVINGS_MEMORY_GB_HOURLY_PRICE"`
+		TierPrices          []string `yaml:"tier_prices" env:"SAVINGS_TIER_PRICES"`
+	} `yaml:"savings"`
+
+	Notify struct {
+		SlackWebhookURL      string   `yaml:"slack_webhook_url" env:"NOTIFY_SLACK_WEBHOOK_URL"`
+		GoogleChatWebhookURL string   `yaml:"google_chat_webhook_url" env:"NOTIFY_GOOGLE_CHAT_WEBHOOK_URL"`
+		WebhookURLs          []string `yaml:"webhook_urls" env:"NOTIFY_WEBHOOK_URLS"`
+		Template             string   `yaml:"template" env:"NOTIFY_TEMPLATE"`
+		EmailFrom            string   `yaml:"email_from" env:"NOTIFY_EMAIL_FROM"`
+		EmailTo              []string `yaml:"email_to" env:"NOTIFY_EMAIL_TO"`
+		EmailSMTPAddr        string   `yaml:"email_smtp_addr" env:"NOTIFY_EMAIL_SMTP_ADDR"`
+		EmailSMTPUsername    string   `yaml:"email_smtp_username" env:"NOTIFY_EMAIL_SMTP_USERNAME"`
+		EmailSMTPPassword    string   `yaml:"email_smtp_password" env:"NOTIFY_EMAIL_SMTP_PASSWORD"`
+		EmailSendGridAPIKey  string   `yaml:"email_sendgrid_api_key" env:"NOTIFY_EMAIL_SENDGRID_API_KEY"`
+		// EmailRecipients is only read from the file.
+		EmailRecipients []EmailRecipients `yaml:"email_recipients"`
+	} `yaml:"notify"`
+
+	Responses struct {
+		Timezone   string `yaml:"timezone" env:"RESPONSE_TIMEZONE"`
+		TimeFormat string `yaml:"time_format" env:"RESPONSE_TIME_FORMAT"`
+	} `yaml:"responses"`
+
+	Access AccessConfig `yaml:"access"`
+
+	// Policies are only read from the file.
+	Policies Policies `yaml:"policies"`
+
+	// Chains are only read from the file.
+	Chains []Chain `yaml:"chains"`
+
+	// Tenants are only read from the file.
+	Tenants []Tenant `yaml:"tenants"`
+
+	Schedules struct {
+		File           string             `yaml:"file" env:"SCHEDULES_FILE"`
+		TrashRetention string             `yaml:"trash_retention" env:"SCHEDULE_TRASH_RETENTION"`
+		OverridesFile  string             `yaml:"overrides_file" env:"OVERRIDES_FILE"`
+		DelayedFile    string             `yaml:"delayed_actions_file" env:"DELAYED_ACTIONS_FILE"`
+		StateFile      string             `yaml:"scheduler_state_file" env:"SCHEDULER_STATE_FILE"`
+		CatchUp        string             `yaml:"catch_up" env:"SCHEDULER_CATCH_UP"`
+		Scheduler      string             `yaml:"scheduler" env:"SCHEDULER"`
+		Items          []DeclaredSchedule `yaml:"items"`
+	} `yaml:"schedules"`
+}
+
+// DeclaredSchedule is a schedule defined in the config file. Its id keeps
+// it stable across restarts so edits in the file update the stored schedule
+// instead of adding another one.
+type DeclaredSchedule struct {
+	ID              string `yaml:"id" json:"id"`
+	ScheduleRequest `yaml:",inline"`
+}
+
+// readConfigFile parses path strictly, so misspelled keys are reported with
+// their line instead of being silently ignored.
+func readConfigFile(path string) (*configFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file configFile
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &file, nil
+}
+
+// values flattens the file into the environment variables it stands for.
+func (c *configFile) values() map[string]string {
+	values := make(map[string]string)
+	flattenConfig(reflect.ValueOf(c).Elem(), values)
+	return values
+}
+
+func flattenConfig(v reflect.Value, values map[string]string) {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+
+		name := field.Tag.Get("env")
+		switch {
+		case value.Kind() == reflect.Struct:
+			flattenConfig(value, values)
+		case name == "":
+		case value.Kind() == reflect.Slice:
+			if value.Len() > 0 {
+				values[name] = strings.Join(value.Interface().([]string), ",")
+			}
+		case value.String() != "":
+			values[name] = value.String()
+		}
+	}
+}
+
+// schedules validates the declared schedules, reporting problems by their
+// position in the file. project is used for entries without one.
+func (c *configFile) schedules(env *envReader, project string) []Schedule {
+	var items []Schedule
+	seen := make(map[string]bool)
+	for i, declared := range c.Schedules.Items {
+		prefix := "schedules.items[" + strconv.Itoa(i) + "]"
+		if declared.ID == "" {
+			env.errs = append(env.errs, fmt.Errorf("%s.id: is required", prefix))
+		} else if seen[declared.ID] {
+			env.errs = append(env.errs, fmt.Errorf("%s.id: %q is used twice", prefix, declared.ID))
+		}
+		seen[declared.ID] = true
+
+		for _, err := range declared.validate() {
+			env.errs = append(env.errs, fmt.Errorf("%s.%s: %s", prefix, err.Field, err.Message))
+		}
+		if declared.Chain != "" && !slices.ContainsFunc(c.Chains, func(chain Chain) bool { return chain.ID == declared.Chain }) {
+			env.errs = append(env.errs, fmt.Errorf("%s.chain: %q is not a chain of chains", prefix, declared.Chain))
+		}
+
+		items = append(items, declared.schedule(project))
+	}
+	return items
+}
+
+// schedule is the declared schedule as stored, in project unless it names
+// its own.
+func (d DeclaredSchedule) schedule(project string) Schedule {
+	if d.Project != "" {
+		project = d.Project
+	}
+	return Schedule{
+		ID:               d.ID,
+		Project:          project,
+		Instance:         d.Instance,
+		Action:           d.Action,
+		Cron:             d.Cron,
+		Timezone:         d.Timezone,
+		Kind:             d.Kind,
+		Location:         d.Location,
+		Chain:            d.Chain,
+		BackupBeforeStop: d.BackupBeforeStop,
+		ExportBeforeStop: d.ExportBeforeStop,
+		Tier:             d.Tier,
+		NotifyEmails:     d.NotifyEmails,
+	}
+}
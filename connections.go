@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	connectionsMetric = "cloudsql.googleapis.com/database/network/connections"
+	// connectionsLookback is how far back the newest connection count is
+	// looked for. Cloud SQL reports it every minute.
+	connectionsLookback = 5 * time.Minute
+)
+
+// ConnectionCheckConfig makes stops refuse instances that still have more
+// than MaxConnections open connections.
+type ConnectionCheckConfig struct {
+	Enabled        bool
+	MaxConnections int64
+}
+
+// connectionCheck is set from STOP_CONNECTION_CHECK and
+// STOP_MAX_CONNECTIONS.
+var connectionCheck reloadable[ConnectionCheckConfig]
+
+var errConnectionsActive = errors.New("instance has active connections")
+
+// connectionsError is returned when a stop is refused, with the count that
+// caused it.
+type connectionsError struct {
+	Connections int64
+	Max         int64
+}
+
+func (e *connectionsError) Error() string {
+	return fmt.Sprintf("%s: %d open, at most %d allowed", errConnectionsActive, e.Connections, e.Max)
+}
+
+func (e *connectionsError) Unwrap() error { return errConnectionsActive }
+
+// isForced reports whether a stop request overrides the connection check.
+func isForced(r *http.Request) bool {
+	return r.URL.Query().Get("force") == "true"
+}
+
+// checkConnections refuses a stop while the instance has more open
+// connections than allowed, unless force is set or the check is disabled.
+// An instance that reported no count recently is let through.
+func checkConnections(ctx context.Context, project string, instance string, force bool) error {
+	if !connectionCheck.load().Enabled || force {
+		return nil
+	}
+
+	connections, reported, err := activeConnections(ctx, project, instance)
+	if err != nil {
+		return fmt.Errorf("failed to read the connection count: %w", err)
+	}
+	if !reported {
+		slog.Info("No connection count reported, stopping anyway", "project", project, "instance", instance)
+		return nil
+	}
+	if connections > connectionCheck.load().MaxConnections {
+		return &connectionsError{Connections: connections, Max: connectionCheck.load().MaxConnections}
+	}
+	return nil
+}
+
+// activeConnections reads the newest count of open connections from Cloud
+// Monitoring, summed over the databases of the instance. reported is false
+// when nothing was reported within connectionsLookback.
+func activeConnections(ctx context.Context, project string, instance string) (int64, bool, error) {
+	total, reported, err := latestMetric(ctx, project, instance, connectionsMetric)
+	return int64(total), reported, err
+}
+
+// latestMetric reads the newest value of a Cloud SQL metric of the instance
+// from Cloud Monitoring, summed over its time series. reported is false when
+// nothing was reported within connectionsLookback.
+func latestMetric(ctx context.Context, project string, instance string, metric string) (float64, bool, error) {
+	service, err := monitoringService(project)
+	if err != nil {
+		return 0, false, err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	now := time.Now()
+	response, err := service.Projects.TimeSeries.List("projects/" + project).
+		Filter(fmt.Sprintf(`metric.type = %q AND resource.labels.database_id = "%s:%s"`, metric, project, instance)).
+		IntervalStartTime(now.Add(-connectionsLookback).Format(time.RFC3339)).
+		IntervalEndTime(now.Format(time.RFC3339)).
+		Context(ctx).Do()
+	if err != nil {
+		return 0, false, err
+	}
+
+	var total float64
+	var reported bool
+	for _, series := range response.TimeSeries {
+		// Points come newest first.
+		if len(series.Points) == 0 || series.Points[0].Value == nil {
+			continue
+		}
+		value := series.Points[0].Value
+		switch {
+		case value.Int64Value != nil:
+			total += float64(*value.Int64Value)
+		case value.DoubleValue != nil:
+			total += *value.DoubleValue
+		}
+		reported = true
+	}
+	return total, reported, nil
+}
+
+// writeConnectionsError answers a stop refused by checkConnections.
+func writeConnectionsError(w http.ResponseWriter, r *http.Request, instance string, err error) {
+	var refused *connectionsError
+	if errors.As(err, &refused) {
+		writeErrorResponse(w, r, http.StatusConflict, msgConnectionsActive, err, instance, refused.Connections, refused.Max)
+		return
+	}
+	writeErrorResponse(w, r, http.StatusInternalServerError, msgConnectionCheckFailed, err, instance)
+}
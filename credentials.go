@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// legacyCredentialsFile is the key file older deployments ship next to the
+// binary. It is still picked up when nothing else is configured.
+const legacyCredentialsFile = "service_account.json"
+
+// impersonateSourcePrefix marks PROJECT_CREDENTIALS sources naming a
+// service account to impersonate.
+const impersonateSourcePrefix = "impersonate:"
+
+// credentialProvider supplies the credentials attached to Google API
+// clients.
+type credentialProvider interface {
+	// options returns the client options selecting the credentials.
+	options() []option.ClientOption
+	// verify reports early whether the credentials can be loaded.
+	verify() error
+	String() string
+}
+
+// adcCredentials uses Application Default Credentials: the metadata server
+// (workload identity on Cloud Run and GKE), gcloud user credentials, or the
+// key file named by GOOGLE_APPLICATION_CREDENTIALS.
+type adcCredentials struct{}
+
+func (adcCredentials) options() []option.ClientOption { return nil }
+
+func (adcCredentials) verify() error { return nil }
+
+func (adcCredentials) String() string {
+	if file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); file != "" {
+		return "application default credentials (" + file + ")"
+	}
+	return "application default credentials"
+}
+
+// keyFileCredentials uses a service account key file.
+type keyFileCredentials struct {
+	path string
+}
+
+func (c keyFileCredentials) options() []option.ClientOption {
+	return []option.ClientOption{option.WithCredentialsFile(c.path)}
+}
+
+func (c keyFileCredentials) verify() error {
+	if _, err := os.Stat(c.path); err != nil {
+		return fmt.Errorf("credentials file: %w", err)
+	}
+	return nil
+}
+
+func (c keyFileCredentials) String() string {
+	return "key file " + c.path
+}
+
+// keyJSONCredentials uses the content of a service account key, usually
+// read from Secret Manager with CREDENTIALS_JSON=secret:..., so no key file
+// is kept on disk.
+type keyJSONCredentials struct {
+	data []byte
+}
+
+func (c keyJSONCredentials) options() []option.ClientOption {
+	return []option.ClientOption{option.WithCredentialsJSON(c.data)}
+}
+
+func (c keyJSONCredentials) verify() error {
+	_, err := c.clientEmail()
+	return err
+}
+
+func (c keyJSONCredentials) String() string {
+	if email, err := c.clientEmail(); err == nil && email != "" {
+		return "key of " + email
+	}
+	return "key JSON"
+}
+
+func (c keyJSONCredentials) clientEmail() (string, error) {
+	var key struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if err := json.Unmarshal(c.data, &key); err != nil {
+		return "", fmt.Errorf("credentials JSON: %w", err)
+	}
+	return key.ClientEmail, nil
+}
+
+// impersonatedCredentials act as another service account, with access
+// tokens from the IAM Credentials generateAccessToken method called with
+// the base credentials. The identity of the service then only needs
+// roles/iam.serviceAccountTokenCreator on the accounts it impersonates,
+// which hold the Cloud SQL roles of their project.
+type impersonatedCredentials struct {
+	target string
+	base   credentialProvider
+
+	mu     sync.Mutex
+	tokens oauth2.TokenSource
+}
+
+func newImpersonatedCredentials(target string, base credentialProvider) *impersonatedCredentials {
+	return &impersonatedCredentials{target: target, base: base}
+}
+
+func (c *impersonatedCredentials) options() []option.ClientOption {
+	return []option.ClientOption{option.WithTokenSource(c)}
+}
+
+// Token returns an access token of the target account. The token source is
+// built on first use and kept once it could be, it refreshes the token
+// before it expires.
+func (c *impersonatedCredentials) Token() (*oauth2.Token, error) {
+	c.mu.Lock()
+	if c.tokens == nil {
+		tokens, err := impersonate.CredentialsTokenSource(context.Background(), impersonate.CredentialsConfig{
+			TargetPrincipal: c.target,
+			Scopes:          []string{sqladmin.CloudPlatformScope},
+		}, c.base.options()...)
+		if err != nil {
+			c.mu.Unlock()
+			return nil, fmt.Errorf("impersonate %s: %w", c.target, err)
+		}
+		c.tokens = tokens
+	}
+	tokens := c.tokens
+	c.mu.Unlock()
+	return tokens.Token()
+}
+
+func (c *impersonatedCredentials) verify() error {
+	return c.base.verify()
+}
+
+func (c *impersonatedCredentials) String() string {
+	return "service account " + c.target + " impersonated with " + c.base.String()
+}
+
+// credentials is the provider used by every Google API client, except the
+// clients of projects in projectCredentials or with impersonation.
+var credentials = newReloadable[credentialProvider](adcCredentials{})
+
+// projectCredentials are the providers of projects with their own
+// credentials, set from PROJECT_CREDENTIALS.
+var projectCredentials reloadable[map[string]credentialProvider]
+
+// impersonation is the service account the clients of the other projects
+// impersonate, set from IMPERSONATE_SERVICE_ACCOUNT. {project} in it is
+// replaced with the project. Empty uses credentials as they are.
+var impersonation struct {
+	mu        sync.Mutex
+	template  string
+	providers map[string]*impersonatedCredentials
+}
+
+// configureImpersonation sets IMPERSONATE_SERVICE_ACCOUNT, forgetting the
+// tokens of the previous accounts.
+func configureImpersonation(template string) {
+	impersonation.mu.Lock()
+	defer impersonation.mu.Unlock()
+
+	impersonation.template = template
+	impersonation.providers = make(map[string]*impersonatedCredentials)
+}
+
+// credentialsFor returns the provider of the clients of project.
+func credentialsFor(project string) credentialProvider {
+	if provider, ok := projectCredentials.load()[project]; ok {
+		return provider
+	}
+
+	impersonation.mu.Lock()
+	defer impersonation.mu.Unlock()
+
+	if impersonation.template == "" {
+		return credentials.load()
+	}
+	target := impersonatedAccount(impersonation.template, project)
+	provider, ok := impersonation.providers[target]
+	if !ok {
+		provider = newImpersonatedCredentials(target, credentials.load())
+		impersonation.providers[target] = provider
+	}
+	return provider
+}
+
+// impersonatedAccount is the account of template for project.
+func impersonatedAccount(template string, project string) string {
+	return strings.ReplaceAll(template, "{project}", project)
+}
+
+// validServiceAccount reports whether email looks like the address of a
+// service account.
+func validServiceAccount(email string) bool {
+	name, domain, ok := strings.Cut(email, "@")
+	return ok && name != "" && strings.Contains(domain, ".")
+}
+
+// parseProjectCredentials reads a list of project=source pairs. The source
+// is a service account key file, "adc" for application default credentials
+// when the default is a key file, or "impersonate:" followed by the email
+// of a service account to impersonate.
+func parseProjectCredentials(items []string) (map[string]string, error) {
+	sources := make(map[string]string, len(items))
+	for _, item := range items {
+		project, source, ok := strings.Cut(item, "=")
+		if !ok || project == "" || source == "" {
+			return nil, fmt.Errorf("%q is not a project=source pair such as 'prod-project=/secrets/prod.json'", item)
+		}
+		if target, ok := strings.CutPrefix(source, impersonateSourcePrefix); ok && !validServiceAccount(target) {
+			return nil, fmt.Errorf("%q is not the email of a service account to impersonate", target)
+		}
+		sources[project] = source
+	}
+	return sources, nil
+}
+
+// newProjectCredentialProviders builds the providers of PROJECT_CREDENTIALS.
+// Impersonating projects use base as their caller.
+func newProjectCredentialProviders(sources map[string]string, base credentialProvider) map[string]credentialProvider {
+	providers := make(map[string]credentialProvider, len(sources))
+	for project, source := range sources {
+		if target, ok := strings.CutPrefix(source, impersonateSourcePrefix); ok {
+			providers[project] = newImpersonatedCredentials(target, base)
+		} else if source == "adc" {
+			providers[project] = adcCredentials{}
+		} else {
+			providers[project] = keyFileCredentials{path: source}
+		}
+	}
+	return providers
+}
+
+// newCredentialProvider prefers Application Default Credentials. A key is
+// only used when set explicitly with CREDENTIALS_JSON or CREDENTIALS_FILE,
+// or, for deployments predating ADC support, when service_account.json
+// exists and GOOGLE_APPLICATION_CREDENTIALS is not set.
+func newCredentialProvider(file string, key string) credentialProvider {
+	if key != "" {
+		return keyJSONCredentials{data: []byte(key)}
+	}
+	if file != "" {
+		return keyFileCredentials{path: file}
+	}
+
+	if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
+		if _, err := os.Stat(legacyCredentialsFile); err == nil {
+			slog.Warn(fmt.Sprintf("Using %s found in the working directory. Set CREDENTIALS_FILE=%s explicitly, or remove it to use application default credentials.", legacyCredentialsFile, legacyCredentialsFile))
+			return keyFileCredentials{path: legacyCredentialsFile}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Ignoring "+legacyCredentialsFile, "error", err)
+		}
+	}
+
+	return adcCredentials{}
+}
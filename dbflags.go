@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// actionDatabaseFlags names database flag changes in notifications and the
+// audit log.
+const actionDatabaseFlags = "database_flags"
+
+// timezoneOffsetPattern matches MYSQL_TIMEZONE_OFFSET values such as
+// "+07:00".
+var timezoneOffsetPattern = regexp.MustCompile(`^[+-]?\d{1,2}:\d{2}$`)
+
+// DatabaseFlag is a database flag set on an instance. Type and
+// RequiresRestart come from the flags Cloud SQL supports for the database
+// version, and are empty for flags it no longer lists.
+type DatabaseFlag struct {
+	Name            string `json:"name"`
+	Value           string `json:"value"`
+	Type            string `json:"type,omitempty"`
+	RequiresRestart bool   `json:"requires_restart,omitempty"`
+}
+
+// DatabaseFlagsData is the answer of GET /v1/instances/{instance}/flags.
+type DatabaseFlagsData struct {
+	DatabaseVersion string         `json:"database_version"`
+	Flags           []DatabaseFlag `json:"flags"`
+}
+
+// DatabaseFlagsRequest is the body of PATCH /v1/instances/{instance}/flags.
+// Flags maps names to their new value, null removes the flag and flags left
+// out keep their value. Flags taking no value are set with "".
+type DatabaseFlagsRequest struct {
+	Flags map[string]*string `json:"flags"`
+}
+
+// validate checks the request against the flags Cloud SQL supports for the
+// instance's database version, by name.
+func (req *DatabaseFlagsRequest) validate(version string, supported map[string]*sqladmin.Flag) validationErrors {
+	if len(req.Flags) == 0 {
+		return validationErrors{{Field: "flags", Message: "must set or remove at least one flag"}}
+	}
+
+	var errs validationErrors
+	for _, name := range sortedKeys(req.Flags) {
+		value := req.Flags[name]
+		if value == nil {
+			continue
+		}
+		field := "flags." + name
+		flag, ok := supported[name]
+		if !ok {
+			errs = append(errs, fieldError{Field: field, Message: "is not a flag of " + version})
+			continue
+		}
+		if message := checkFlagValue(flag, *value); message != "" {
+			errs = append(errs, fieldError{Field: field, Message: message})
+		}
+	}
+	return errs
+}
+
+// checkFlagValue returns what is wrong with value for flag, "" when it is
+// valid.
+func checkFlagValue(flag *sqladmin.Flag, value string) string {
+	switch flag.Type {
+	case "NONE":
+		if value != "" {
+			return "takes no value, set it to \"\""
+		}
+	case "BOOLEAN":
+		if value != "on" && value != "off" {
+			return "must be 'on' or 'off'"
+		}
+	case "INTEGER":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "must be an integer"
+		}
+		if len(flag.AllowedIntValues) > 0 {
+			if !slices.Contains(flag.AllowedIntValues, n) {
+				return fmt.Sprintf("must be one of %v", []int64(flag.AllowedIntValues))
+			}
+		} else if (flag.MinValue != 0 || flag.MaxValue != 0) && (n < flag.MinValue || n > flag.MaxValue) {
+			return fmt.Sprintf("must be between %d and %d", flag.MinValue, flag.MaxValue)
+		}
+	case "FLOAT":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "must be a number"
+		}
+		if (flag.MinValue != 0 || flag.MaxValue != 0) && (f < float64(flag.MinValue) || f > float64(flag.MaxValue)) {
+			return fmt.Sprintf("must be between %d and %d", flag.MinValue, flag.MaxValue)
+		}
+	case "STRING":
+		if len(flag.AllowedStringValues) > 0 && !slices.Contains(flag.AllowedStringValues, value) {
+			return "must be one of " + strings.Join(flag.AllowedStringValues, ", ")
+		}
+	case "REPEATED_STRING":
+		for _, item := range strings.Split(value, ",") {
+			if len(flag.AllowedStringValues) > 0 && !slices.Contains(flag.AllowedStringValues, strings.TrimSpace(item)) {
+				return "must be a comma-separated list of " + strings.Join(flag.AllowedStringValues, ", ")
+			}
+		}
+	case "MYSQL_TIMEZONE_OFFSET":
+		if !timezoneOffsetPattern.MatchString(value) {
+			return "must be an offset between -12:59 and +13:00"
+		}
+	}
+	return ""
+}
+
+// apply merges the request into the current flags. Cloud SQL replaces the
+// whole list, so every flag is sent, sorted by name.
+func (req *DatabaseFlagsRequest) apply(current []*sqladmin.DatabaseFlags) []*sqladmin.DatabaseFlags {
+	values := make(map[string]string, len(current)+len(req.Flags))
+	for _, flag := range current {
+		values[flag.Name] = flag.Value
+	}
+	for name, value := range req.Flags {
+		if value == nil {
+			delete(values, name)
+		} else {
+			values[name] = *value
+		}
+	}
+
+	flags := make([]*sqladmin.DatabaseFlags, 0, len(values))
+	for _, name := range sortedKeys(values) {
+		flags = append(flags, &sqladmin.DatabaseFlags{Name: name, Value: values[name]})
+	}
+	return flags
+}
+
+// restartFlags returns the flags changed by the request that restart the
+// instance, sorted by name.
+func (req *DatabaseFlagsRequest) restartFlags(current []*sqladmin.DatabaseFlags, supported map[string]*sqladmin.Flag) []string {
+	values := make(map[string]string, len(current))
+	for _, flag := range current {
+		values[flag.Name] = flag.Value
+	}
+
+	var names []string
+	for _, name := range sortedKeys(req.Flags) {
+		value, set := values[name]
+		changed := req.Flags[name] == nil && set || req.Flags[name] != nil && (!set || *req.Flags[name] != value)
+		if flag := supported[name]; changed && flag != nil && flag.RequiresRestart {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// supportedFlags lists the flags Cloud SQL supports for a database version,
+// by name.
+func supportedFlags(ctx context.Context, sqlService *sqladmin.Service, version string) (map[string]*sqladmin.Flag, error) {
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	list, err := sqlService.Flags.List().DatabaseVersion(version).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	flags := make(map[string]*sqladmin.Flag, len(list.Items))
+	for _, flag := range list.Items {
+		if len(flag.AppliesTo) == 0 || slices.Contains(flag.AppliesTo, version) {
+			flags[flag.Name] = flag
+		}
+	}
+	return flags, nil
+}
+
+// databaseFlagsHandler shows the database flags of an instance on GET and
+// changes them through a Settings patch on PATCH, e.g. max_connections or
+// log_min_duration_statement. Values are checked against the flags Cloud
+// SQL supports for the instance's database version. Cloud SQL restarts the
+// instance for some flags, such changes are announced in a Warning header.
+func databaseFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPatch {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	var payload DatabaseFlagsRequest
+	if r.Method == http.MethodPatch {
+		if err := decodeJSONBody(w, r, &payload); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	project, name := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	instance, err := getInstance(r.Context(), sqlService, project, name)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	supported, err := supportedFlags(r.Context(), sqlService, instance.DatabaseVersion)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgDatabaseFlagsListFailed, err, instance.DatabaseVersion)
+		return
+	}
+	current := instance.Settings.DatabaseFlags
+
+	if r.Method == http.MethodGet {
+		data := DatabaseFlagsData{DatabaseVersion: instance.DatabaseVersion, Flags: make([]DatabaseFlag, 0, len(current))}
+		for _, flag := range current {
+			item := DatabaseFlag{Name: flag.Name, Value: flag.Value}
+			if definition := supported[flag.Name]; definition != nil {
+				item.Type, item.RequiresRestart = definition.Type, definition.RequiresRestart
+			}
+			data.Flags = append(data.Flags, item)
+		}
+		writeSuccessResponse(w, r, http.StatusOK, msgDatabaseFlagsFound, data)
+		return
+	}
+
+	if errs := payload.validate(instance.DatabaseVersion, supported); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	succeeded := msgDatabaseFlagsPatched
+	if restart := payload.restartFlags(current, supported); len(restart) > 0 {
+		w.Header().Set("Warning", fmt.Sprintf("299 scheduler-db %q", "changing "+strings.Join(restart, ", ")+" restarts the instance"))
+		succeeded = msgDatabaseFlagsPatchedRestart
+	}
+
+	patch := &sqladmin.DatabaseInstance{Settings: &sqladmin.Settings{
+		DatabaseFlags: payload.apply(current),
+		// Removing the last flag sends an empty list.
+		ForceSendFields: []string{"DatabaseFlags"},
+	}}
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunPatch(project, name, patch))
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	operation, err := sqlService.Instances.Patch(project, name, patch).Context(ctx).Do()
+	event := newNotificationEvent(actionDatabaseFlags, actionSourceAPI, requestPrincipal(r), project, name)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgDatabaseFlagsPatchFailed, err)
+		return
+	}
+
+	operations.track(event, operation)
+	writeOperationResponse(w, r, project, name, operation, wait, timeout, operationSteps{}, succeeded, msgDatabaseFlagsPatchFailed)
+}
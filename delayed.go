@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDelayedActionsFile = "delayed-actions.json"
+
+	// maxActionDelay bounds how far ahead a one-off action may run,
+	// recurring changes belong in the schedules.
+	maxActionDelay = 30 * 24 * time.Hour
+
+	// delayedActionGrace is how late a one-off action still runs, e.g.
+	// after a restart. Older ones are dropped: a stop meant for last night
+	// shouldn't hit the instance the next morning.
+	delayedActionGrace = time.Hour
+)
+
+var errDelayedActionNotFound = errors.New("delayed action not found")
+
+// DelayedAction is a start, stop or scale of an instance to run once, at
+// At, e.g. stopping a database after tonight's migration.
+type DelayedAction struct {
+	ID        string    `json:"id"`
+	Project   string    `json:"project"`
+	Instance  string    `json:"instance"`
+	Action    string    `json:"action"`
+	Tier      string    `json:"tier,omitempty"`
+	At        time.Time `json:"at"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// delayedStore keeps the pending one-off actions in memory and persists
+// every change to a JSON file. Actions leave the store when they run or
+// are cancelled.
+type delayedStore struct {
+	mu      sync.Mutex
+	path    string
+	now     func() time.Time
+	actions map[string]*DelayedAction
+}
+
+var delayedActions = newDelayedStore("")
+
+func newDelayedStore(path string) *delayedStore {
+	return &delayedStore{path: path, now: time.Now, actions: make(map[string]*DelayedAction)}
+}
+
+// load reads the delayed actions file from the state backend. A missing
+// file is an empty store.
+func (s *delayedStore) load() error {
+	raw, _, err := state.read(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var items []*DelayedAction
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return fmt.Errorf("invalid delayed actions file %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.actions = make(map[string]*DelayedAction, len(items))
+	for _, item := range items {
+		s.actions[item.ID] = item
+	}
+	return nil
+}
+
+// save writes the store atomically. Callers must hold s.mu.
+func (s *delayedStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	raw, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = state.write(s.path, raw)
+	return err
+}
+
+// sorted returns copies of the actions, the first to run first. Callers
+// must hold s.mu.
+func (s *delayedStore) sorted() []DelayedAction {
+	items := make([]DelayedAction, 0, len(s.actions))
+	for _, action := range s.actions {
+		items = append(items, *action)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].At.Equal(items[j].At) {
+			return items[i].At.Before(items[j].At)
+		}
+		return items[i].ID < items[j].ID
+	})
+	return items
+}
+
+// list returns the pending actions.
+func (s *delayedStore) list() []DelayedAction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sorted()
+}
+
+func (s *delayedStore) get(id string) (DelayedAction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	action, ok := s.actions[id]
+	if !ok {
+		return DelayedAction{}, errDelayedActionNotFound
+	}
+	return *action, nil
+}
+
+func (s *delayedStore) create(action DelayedAction) (DelayedAction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	action.ID = randomID(8)
+	action.CreatedAt = s.now().UTC()
+	s.actions[action.ID] = &action
+	if err := s.save(); err != nil {
+		delete(s.actions, action.ID)
+		return DelayedAction{}, err
+	}
+	return action, nil
+}
+
+// delete cancels a pending action.
+func (s *delayedStore) delete(id string) (DelayedAction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	action, ok := s.actions[id]
+	if !ok {
+		return DelayedAction{}, errDelayedActionNotFound
+	}
+	delete(s.actions, id)
+	if err := s.save(); err != nil {
+		s.actions[id] = action
+		return DelayedAction{}, err
+	}
+	return *action, nil
+}
+
+// takeDue removes the actions due at now from the store and returns them,
+// so each runs once even when the run fails. Actions more than
+// delayedActionGrace late are dropped and returned as missed.
+func (s *delayedStore) takeDue() (due []DelayedAction, missed []DelayedAction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for _, action := range s.sorted() {
+		switch {
+		case action.At.After(now):
+			continue
+		case now.Sub(action.At) > delayedActionGrace:
+			missed = append(missed, action)
+		default:
+			due = append(due, action)
+		}
+		delete(s.actions, action.ID)
+	}
+	if len(due)+len(missed) > 0 {
+		if err := s.save(); err != nil {
+			slog.Error("Failed to save delayed actions", "error", err)
+		}
+	}
+	return due, missed
+}
+
+// run runs the due actions every schedulerInterval until stop is closed.
+func (s *delayedStore) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.runDue(context.Background())
+		}
+	}
+}
+
+// delayedRun is a delayed action that ran, with the error of the run.
+type delayedRun struct {
+	action DelayedAction
+	err    error
+}
+
+// runDue runs the actions that are due and returns what ran. While
+// automated actions are paused or left to the leader they are kept, and
+// dropped once missed by more than delayedActionGrace.
+func (s *delayedStore) runDue(ctx context.Context) []delayedRun {
+	if automationHeld(s.now()) {
+		return nil
+	}
+	due, missed := s.takeDue()
+	for _, action := range missed {
+		slog.Warn("Delayed action missed, dropped", "delayed_action", action.ID, "action", action.Action, "project", action.Project, "instance", action.Instance, "at", action.At)
+	}
+
+	runs := make([]delayedRun, 0, len(due))
+	for _, action := range due {
+		_, err := runTriggeredAction(ctx, triggeredAction{
+			Action:      action.Action,
+			Project:     action.Project,
+			Instance:    action.Instance,
+			Source:      actionSourceDelayed,
+			TriggeredBy: delayedActionTrigger(action),
+			Tier:        action.Tier,
+		})
+		if !dryRun.load() {
+			recordAction(action.Action, actionSourceDelayed, err)
+		}
+		if err != nil {
+			slog.Error("Delayed action failed", "delayed_action", action.ID, "action", action.Action, "project", action.Project, "instance", action.Instance, "error", err)
+		}
+		runs = append(runs, delayedRun{action: action, err: err})
+	}
+	return runs
+}
+
+// delayedActionTrigger names who asked for a delayed action in logs and
+// notifications.
+func delayedActionTrigger(action DelayedAction) string {
+	if action.CreatedBy == "" {
+		return "delayed action " + action.ID
+	}
+	return "delayed action " + action.ID + " of " + action.CreatedBy
+}
+
+// DelayedActionRequest is the body of POST /v1/schedule-once. The action
+// runs at At, an RFC3339 time, or After a duration such as "2h" from now.
+type DelayedActionRequest struct {
+	Project  string `json:"project"`
+	Instance string `json:"instance"`
+	Action   string `json:"action"`
+	Tier     string `json:"tier"`
+	At       string `json:"at"`
+	After    string `json:"after"`
+	Reason   string `json:"reason"`
+}
+
+func (req *DelayedActionRequest) validate(now time.Time) (time.Time, validationErrors) {
+	var errs validationErrors
+	if req.Instance == "" {
+		errs = append(errs, fieldError{Field: "instance", Message: "is required"})
+	}
+	switch req.Action {
+	case scheduleActionStart, scheduleActionStop:
+		if req.Tier != "" {
+			errs = append(errs, fieldError{Field: "tier", Message: "only applies to scale actions"})
+		}
+	case scheduleActionScale:
+		if !validTier.MatchString(req.Tier) {
+			errs = append(errs, fieldError{Field: "tier", Message: "must be a machine tier such as 'db-custom-2-7680'"})
+		}
+	case "":
+		errs = append(errs, fieldError{Field: "action", Message: "is required"})
+	default:
+		errs = append(errs, fieldError{Field: "action", Message: "must be 'start', 'stop' or 'scale'"})
+	}
+
+	var at time.Time
+	switch {
+	case req.At == "" && req.After == "":
+		errs = append(errs, fieldError{Message: "body must contain at or after"})
+		return at, errs
+	case req.At != "" && req.After != "":
+		errs = append(errs, fieldError{Field: "after", Message: "can't be combined with at"})
+		return at, errs
+	case req.At != "":
+		parsed, err := time.Parse(time.RFC3339, req.At)
+		if err != nil {
+			errs = append(errs, fieldError{Field: "at", Message: "must be an RFC3339 time such as '2025-06-06T22:00:00+07:00'"})
+			return at, errs
+		}
+		at = parsed
+	default:
+		delay, err := time.ParseDuration(req.After)
+		if err != nil {
+			errs = append(errs, fieldError{Field: "after", Message: "must be a duration such as '90m'"})
+			return at, errs
+		}
+		at = now.Add(delay)
+	}
+
+	field := "at"
+	if req.After != "" {
+		field = "after"
+	}
+	switch {
+	case !at.After(now):
+		errs = append(errs, fieldError{Field: field, Message: "must be in the future"})
+	case at.Sub(now) > maxActionDelay:
+		errs = append(errs, fieldError{Field: field, Message: fmt.Sprintf("must be within %s", maxActionDelay)})
+	}
+	return at, errs
+}
+
+// DelayedActionData is the API representation of a DelayedAction.
+type DelayedActionData struct {
+	ID        string      `json:"id"`
+	Project   string      `json:"project"`
+	Instance  string      `json:"instance"`
+	Action    string      `json:"action"`
+	Tier      string      `json:"tier,omitempty"`
+	At        interface{} `json:"at"`
+	Reason    string      `json:"reason,omitempty"`
+	CreatedBy string      `json:"created_by,omitempty"`
+	CreatedAt interface{} `json:"created_at"`
+}
+
+func newDelayedActionData(action DelayedAction) DelayedActionData {
+	return DelayedActionData{
+		ID:        action.ID,
+		Project:   action.Project,
+		Instance:  action.Instance,
+		Action:    action.Action,
+		Tier:      action.Tier,
+		At:        formatTimestamp(action.At),
+		Reason:    action.Reason,
+		CreatedBy: action.CreatedBy,
+		CreatedAt: formatTimestamp(action.CreatedAt),
+	}
+}
+
+// delayedActionsHandler serves GET /v1/schedule-once, the pending actions
+// the caller may take (?instance= narrows them down), and POST
+// /v1/schedule-once.
+func delayedActionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		instance := r.URL.Query().Get("instance")
+		data := []DelayedActionData{}
+		for _, action := range delayedActions.list() {
+			if instance != "" && action.Instance != instance || !accessAllowed(r, action.Action, action.Project, action.Instance) {
+				continue
+			}
+			data = append(data, newDelayedActionData(action))
+		}
+		writeSuccessResponse(w, r, http.StatusOK, msgDelayedActionsListed, data)
+	case http.MethodPost:
+		createDelayedActionHandler(w, r)
+	default:
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+	}
+}
+
+func createDelayedActionHandler(w http.ResponseWriter, r *http.Request) {
+	var payload DelayedActionRequest
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	at, errs := payload.validate(delayedActions.now())
+	if len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	project := payload.Project
+	if project == "" {
+		project = projectID.load()
+	}
+	if !accessAllowed(r, payload.Action, project, payload.Instance) {
+		writeErrorResponse(w, r, http.StatusForbidden, msgForbidden, "", requestPrincipal(r), payload.Action)
+		return
+	}
+
+	action, err := delayedActions.create(DelayedAction{
+		Project:   project,
+		Instance:  payload.Instance,
+		Action:    payload.Action,
+		Tier:      payload.Tier,
+		At:        at.UTC(),
+		Reason:    payload.Reason,
+		CreatedBy: requestPrincipal(r),
+	})
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgDelayedActionSaveFailed, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Delayed action created", "delayed_action", action.ID, "action", action.Action, "project", project, "instance", action.Instance, "at", action.At)
+	writeSuccessResponse(w, r, http.StatusCreated, msgDelayedActionCreated, newDelayedActionData(action), action.Action, action.Instance)
+}
+
+// delayedActionHandler serves GET and DELETE /v1/schedule-once/{id}.
+// DELETE cancels the action.
+func delayedActionHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	action, err := delayedActions.get(id)
+	if err == nil && !accessAllowed(r, action.Action, action.Project, action.Instance) {
+		err = errDelayedActionNotFound
+	}
+
+	message := msgDelayedActionFetched
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		if err == nil {
+			action, err = delayedActions.delete(id)
+		}
+		message = msgDelayedActionCancelled
+	default:
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	switch {
+	case errors.Is(err, errDelayedActionNotFound):
+		writeErrorResponse(w, r, http.StatusNotFound, msgDelayedActionNotFound, err, id)
+	case err != nil:
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgDelayedActionSaveFailed, err)
+	default:
+		writeSuccessResponse(w, r, http.StatusOK, message, newDelayedActionData(action))
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// dryRun makes every start, stop and settings change a dry run, including
+// scheduled ones. Set from DRY_RUN.
+var dryRun reloadable[bool]
+
+// DryRunData is answered instead of an operation by dry runs: the call
+// that would have been sent to the SQL Admin API.
+type DryRunData struct {
+	DryRun bool        `json:"dry_run"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Body   interface{} `json:"body"`
+
+	// BackupFirst is set when a stop would take a backup first.
+	BackupFirst bool `json:"backup_before_stop,omitempty"`
+
+	// ExportFirst is the export a stop would run first.
+	ExportFirst *sqladmin.ExportContext `json:"export_before_stop,omitempty"`
+
+	// Replicas are the dry runs of the replicas of the instance, when
+	// include_replicas is set.
+	Replicas []BulkResult `json:"replicas,omitempty"`
+}
+
+func newDryRunPatch(project string, instance string, body *sqladmin.DatabaseInstance) *DryRunData {
+	return newDryRunCall(http.MethodPatch, sqlAdminInstancePath(project, instance), body)
+}
+
+func newDryRunCall(method string, url string, body interface{}) *DryRunData {
+	return &DryRunData{DryRun: true, Method: method, URL: url, Body: body}
+}
+
+// sqlAdminInstancePath is the path of an instance in the SQL Admin API.
+func sqlAdminInstancePath(project string, instance string) string {
+	return fmt.Sprintf("/v1/projects/%s/instances/%s", project, instance)
+}
+
+// isDryRun reports whether r must not mutate anything, either because it
+// asked with ?dry_run=true or because DRY_RUN is set.
+func isDryRun(r *http.Request) bool {
+	return dryRun.load() || r.URL.Query().Get("dry_run") == "true"
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// notifyResultUnexpectedState reports a scheduled action finding its
+// instance in a state such as FAILED or MAINTENANCE.
+const notifyResultUnexpectedState = "unexpected_state"
+
+// sendGridEndpoint is the SendGrid v3 mail API, overridden by tests.
+var sendGridEndpoint = "https://api.sendgrid.com/v3/mail/send"
+
+// emailTemplate renders the body of notification emails.
+var emailTemplate = template.Must(template.New("email").Parse(`{{.Text}}
+
+Action:       {{.Action}}
+Instance:     {{.Project}}/{{.Instance}}
+Result:       {{.Result}}
+Source:       {{.Source}}
+Triggered by: {{.TriggeredBy}}
+{{with .Schedule}}Schedule:     {{.}}
+{{end}}{{with .Operation}}Operation:    {{.}}
+{{end}}{{with .Error}}Error:        {{.}}
+{{end}}Time:         {{.Time.Format "2006-01-02T15:04:05Z07:00"}}
+`))
+
+// EmailRecipients are the addresses emailed about the instances matching
+// Projects and Instances, glob patterns such as "dev-*", empty means any.
+type EmailRecipients struct {
+	Projects  []string `yaml:"projects"`
+	Instances []string `yaml:"instances"`
+	To        []string `yaml:"to"`
+}
+
+// EmailConfig emails the outcome of scheduled actions and instances found
+// in an unexpected state, through an SMTP server or the SendGrid API. To
+// gets every email, Recipients those of their instances and the
+// notify_emails of a schedule those of its runs.
+type EmailConfig struct {
+	From           string
+	To             []string
+	SMTPAddr       string
+	SMTPUsername   string
+	SMTPPassword   string
+	SendGridAPIKey string
+	Recipients     []EmailRecipients
+}
+
+func (e EmailConfig) enabled() bool {
+	return e.SMTPAddr != "" || e.SendGridAPIKey != ""
+}
+
+func (e EmailConfig) validate() error {
+	if !e.enabled() {
+		return nil
+	}
+
+	var errs []error
+	if e.SMTPAddr != "" && e.SendGridAPIKey != "" {
+		errs = append(errs, errors.New("NOTIFY_EMAIL_SMTP_ADDR and NOTIFY_EMAIL_SENDGRID_API_KEY: set only one"))
+	}
+	if e.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(e.SMTPAddr); err != nil {
+			errs = append(errs, fmt.Errorf("NOTIFY_EMAIL_SMTP_ADDR: %q is not a host:port address", e.SMTPAddr))
+		}
+	}
+	if e.From == "" {
+		errs = append(errs, errors.New("NOTIFY_EMAIL_FROM: is required to send emails"))
+	} else if _, err := mail.ParseAddress(e.From); err != nil {
+		errs = append(errs, fmt.Errorf("NOTIFY_EMAIL_FROM: %q is not an email address", e.From))
+	}
+	errs = append(errs, validateEmails("NOTIFY_EMAIL_TO", e.To)...)
+	for i, recipients := range e.Recipients {
+		prefix := fmt.Sprintf("notify.email_recipients[%d]", i)
+		if len(recipients.To) == 0 {
+			errs = append(errs, fmt.Errorf("%s.to: is required", prefix))
+		}
+		errs = append(errs, validateEmails(prefix+".to", recipients.To)...)
+		errs = append(errs, validatePatterns(prefix+".projects", recipients.Projects)...)
+		errs = append(errs, validatePatterns(prefix+".instances", recipients.Instances)...)
+	}
+	return errors.Join(errs...)
+}
+
+func validateEmails(field string, addresses []string) []error {
+	var errs []error
+	for i, address := range addresses {
+		if _, err := mail.ParseAddress(address); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: %q is not an email address", field, i, address))
+		}
+	}
+	return errs
+}
+
+// emailSender sends notification emails with an EmailConfig.
+type emailSender struct {
+	config EmailConfig
+	client *http.Client
+}
+
+// wants reports whether event is emailed: runs of schedules and delayed
+// actions, whatever their result, stops of idle instances and their
+// warnings, corrections of the reconciler, and instances found in an
+// unexpected state.
+func (s *emailSender) wants(event NotificationEvent) bool {
+	return event.Source == actionSourceSchedule || event.Source == actionSourceDelayed || event.Source == actionSourceIdle || event.Source == actionSourceReconcile ||
+		event.Result == notifyResultUnexpectedState
+}
+
+// recipients are the addresses event is emailed to, without duplicates.
+func (s *emailSender) recipients(event NotificationEvent) []string {
+	to := slices.Clone(s.config.To)
+	for _, recipients := range s.config.Recipients {
+		if matchesAny(recipients.Projects, event.Project) && matchesAny(recipients.Instances, event.Instance) {
+			to = append(to, recipients.To...)
+		}
+	}
+	if event.Schedule != "" && schedules != nil {
+		if schedule, err := schedules.get(event.Schedule); err == nil {
+			to = append(to, schedule.NotifyEmails...)
+		}
+	}
+	slices.Sort(to)
+	return slices.Compact(to)
+}
+
+func (s *emailSender) send(event NotificationEvent) error {
+	to := s.recipients(event)
+	if len(to) == 0 {
+		return nil
+	}
+
+	subject := fmt.Sprintf("[scheduler-db] %s %s/%s %s", event.Action, event.Project, event.Instance, event.Result)
+	var body bytes.Buffer
+	if err := emailTemplate.Execute(&body, event); err != nil {
+		return err
+	}
+	if s.config.SendGridAPIKey != "" {
+		return s.sendGrid(to, subject, body.String())
+	}
+	return s.sendSMTP(to, subject, body.String())
+}
+
+// sendSMTP delivers the email through the SMTP server, upgrading to TLS
+// when the server offers it.
+func (s *emailSender) sendSMTP(to []string, subject string, body string) error {
+	conn, err := net.DialTimeout("tcp", s.config.SMTPAddr, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+
+	host, _, _ := net.SplitHostPort(s.config.SMTPAddr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			return err
+		}
+	}
+	if s.config.SMTPUsername != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.config.SMTPUsername, s.config.SMTPPassword, host)); err != nil {
+			return err
+		}
+	}
+
+	from, _ := mail.ParseAddress(s.config.From)
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, address := range to {
+		recipient, _ := mail.ParseAddress(address)
+		if err := client.Rcpt(recipient.Address); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	message := "From: " + s.config.From + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n")
+	if _, err := w.Write([]byte(message)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// sendGrid delivers the email through the SendGrid v3 mail API.
+func (s *emailSender) sendGrid(to []string, subject string, body string) error {
+	type address struct {
+		Email string `json:"email"`
+		Name  string `json:"name,omitempty"`
+	}
+	parse := func(raw string) address {
+		parsed, _ := mail.ParseAddress(raw)
+		return address{Email: parsed.Address, Name: parsed.Name}
+	}
+
+	recipients := make([]address, 0, len(to))
+	for _, raw := range to {
+		recipients = append(recipients, parse(raw))
+	}
+	payload, err := json.Marshal(map[string]any{
+		"personalizations": []map[string]any{{"to": recipients}},
+		"from":             parse(s.config.From),
+		"subject":          subject,
+		"content":          []map[string]string{{"type": "text/plain", "value": body}},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sendGridEndpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.config.SendGridAPIKey)
+	req.Header.Set("Content-Type", contentTypeJSON)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sendgrid answered %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyUnexpectedState reports a triggered action finding its instance
+// neither running nor stopped, e.g. FAILED or in MAINTENANCE.
+func notifyUnexpectedState(event NotificationEvent, state string) {
+	if state == "RUNNABLE" || state == "STOPPED" {
+		return
+	}
+	event.Result, event.Error = notifyResultUnexpectedState, "instance is in state "+state
+	notifications.send(event)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+
+	"scheduler-db/pkg/sqlctl"
+)
+
+const (
+	defaultEventsPollInterval = 10 * time.Second
+	eventsHeartbeatInterval   = 15 * time.Second
+	// eventsBufferSize is how many events a slow client may lag behind
+	// before it misses some.
+	eventsBufferSize = 64
+)
+
+// Types of the events streamed by GET /v1/events.
+const (
+	eventStateChanged     = "state_changed"
+	eventOperationStarted = "operation_started"
+	eventOperationDone    = "operation_done"
+	eventOperationFailed  = "operation_failed"
+)
+
+// InstanceEvent is one event of GET /v1/events. From and To are set for
+// state changes, the operation fields for operation events.
+type InstanceEvent struct {
+	ID            uint64      `json:"id"`
+	Type          string      `json:"type"`
+	Time          interface{} `json:"time"`
+	Project       string      `json:"project"`
+	Instance      string      `json:"instance"`
+	From          string      `json:"from,omitempty"`
+	To            string      `json:"to,omitempty"`
+	Action        string      `json:"action,omitempty"`
+	Operation     string      `json:"operation,omitempty"`
+	OperationType string      `json:"operation_type,omitempty"`
+	Error         string      `json:"error,omitempty"`
+}
+
+type eventSubscriber struct {
+	project  string
+	instance string
+	events   chan InstanceEvent
+}
+
+func (s *eventSubscriber) matches(event InstanceEvent) bool {
+	return (s.project == "" || s.project == event.Project) && (s.instance == "" || s.instance == event.Instance)
+}
+
+// eventHub fans instance events out to the clients of GET /v1/events. While
+// anyone listens, it polls the instances of PROJECTS for state changes and
+// the operations started by the service until they finish.
+type eventHub struct {
+	mu          sync.Mutex
+	interval    time.Duration
+	subscribers map[*eventSubscriber]struct{}
+	states      map[string]string
+	stopPoll    chan struct{}
+	nextID      uint64
+	closed      bool
+}
+
+var events = newEventHub()
+
+func newEventHub() *eventHub {
+	return &eventHub{interval: defaultEventsPollInterval, subscribers: make(map[*eventSubscriber]struct{})}
+}
+
+// configure sets the poll interval, used from the next poll on.
+func (h *eventHub) configure(interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.interval = interval
+	if interval <= 0 {
+		h.interval = defaultEventsPollInterval
+	}
+}
+
+// subscribe registers a client, starting the poller for the first one. The
+// channel is closed when the hub shuts down.
+func (h *eventHub) subscribe(project string, instance string) *eventSubscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subscriber := &eventSubscriber{project: project, instance: instance, events: make(chan InstanceEvent, eventsBufferSize)}
+	if h.closed {
+		close(subscriber.events)
+		return subscriber
+	}
+	h.subscribers[subscriber] = struct{}{}
+	if h.stopPoll == nil {
+		h.stopPoll = make(chan struct{})
+		go h.poll(h.stopPoll)
+	}
+	return subscriber
+}
+
+// unsubscribe removes a client, stopping the poller after the last one.
+func (h *eventHub) unsubscribe(subscriber *eventSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[subscriber]; !ok {
+		return
+	}
+	delete(h.subscribers, subscriber)
+	if len(h.subscribers) == 0 && h.stopPoll != nil {
+		close(h.stopPoll)
+		h.stopPoll, h.states = nil, nil
+	}
+}
+
+// close ends every stream, so a graceful shutdown doesn't wait for them.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for subscriber := range h.subscribers {
+		close(subscriber.events)
+		delete(h.subscribers, subscriber)
+	}
+	if h.stopPoll != nil {
+		close(h.stopPoll)
+		h.stopPoll = nil
+	}
+}
+
+// publish sends event to the matching clients. Clients too slow to keep up
+// miss it rather than holding up the others.
+func (h *eventHub) publish(event InstanceEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.subscribers) == 0 {
+		return
+	}
+	h.nextID++
+	event.ID = h.nextID
+	event.Time = formatTimestamp(time.Now())
+	for subscriber := range h.subscribers {
+		if !subscriber.matches(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			slog.Warn("Event stream client is too slow, event dropped", "event", event.Type, "project", event.Project, "instance", event.Instance)
+		}
+	}
+}
+
+// publishOperation reports an operation of a tracked action.
+func (h *eventHub) publishOperation(eventType string, pending pendingOperation, err error) {
+	event := InstanceEvent{
+		Type:          eventType,
+		Project:       pending.Project,
+		Instance:      pending.Instance,
+		Action:        pending.Action,
+		Operation:     pending.Name,
+		OperationType: pending.Type,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	h.publish(event)
+}
+
+func (h *eventHub) poll(stop <-chan struct{}) {
+	for {
+		h.pollOnce(context.Background(), stop)
+
+		h.mu.Lock()
+		interval := h.interval
+		h.mu.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// pollOnce compares the instance states with the previous poll and checks
+// whether the operations started by the service finished. The first poll
+// only records the states.
+func (h *eventHub) pollOnce(ctx context.Context, stop <-chan struct{}) {
+	states := make(map[string]string)
+	for _, project := range managedProjects.load() {
+		instances, err := listProjectInstances(ctx, project)
+		if err != nil {
+			slog.Error("Failed to poll instances for events", "project", project, "error", err)
+			return
+		}
+		for _, instance := range instances {
+			states[instance.Project+"/"+instance.Name] = instance.State
+		}
+	}
+
+	h.mu.Lock()
+	select {
+	case <-stop:
+		// The last client left during the poll.
+		h.mu.Unlock()
+		return
+	default:
+	}
+	previous := h.states
+	h.states = states
+	h.mu.Unlock()
+
+	if previous != nil {
+		for _, key := range sortedKeys(states) {
+			if from, ok := previous[key]; ok && from != states[key] {
+				project, instance, _ := strings.Cut(key, "/")
+				h.publish(InstanceEvent{Type: eventStateChanged, Project: project, Instance: instance, From: from, To: states[key]})
+			}
+		}
+	}
+
+	for _, pending := range operations.pending() {
+		operation, err := getOperation(ctx, pending.Project, pending.Name)
+		if err != nil {
+			slog.Error("Failed to poll operation for events", pending.attrs("error", err)...)
+			continue
+		}
+		if operation.Status == "DONE" {
+			operations.finished(operation, sqlctl.OperationError(operation))
+		}
+	}
+}
+
+func getOperation(ctx context.Context, project string, name string) (*sqladmin.Operation, error) {
+	controller, err := sqlController(project)
+	if err != nil {
+		return nil, err
+	}
+	return controller.Operation(ctx, project, name)
+}
+
+// eventsHandler streams instance events as Server-Sent Events, optionally
+// only those of ?project= and ?instance=. Events of instances the caller may
+// not check are left out. A comment line is sent every 15s so proxies don't
+// close idle streams.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	// Subscribe before answering, so a client that got the headers sees
+	// every event of the actions it takes next.
+	subscriber := events.subscribe(r.URL.Query().Get("project"), r.URL.Query().Get("instance"))
+	defer events.unsubscribe(subscriber)
+
+	controller := http.NewResponseController(w)
+	// Streams outlive the server's write timeout.
+	controller.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", defaultEventsPollInterval.Milliseconds())
+	if err := controller.Flush(); err != nil {
+		slog.ErrorContext(r.Context(), "Response can't be streamed", "error", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event, ok := <-subscriber.events:
+			if !ok {
+				return
+			}
+			if !accessAllowed(r, auditActionCheck, event.Project, event.Instance) {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// actionExport names exports in notifications and the audit log.
+const actionExport = "export"
+
+// Formats of an export.
+const (
+	exportFormatSQL = "sql"
+	exportFormatCSV = "csv"
+)
+
+// ExportRequest is the body of POST /v1/instances/{instance}/export and the
+// export_before_stop of stops and stop schedules. A URI ending with a slash
+// is a folder, the file is named after the instance and the time of the
+// export so each run writes a new one.
+type ExportRequest struct {
+	URI       string   `json:"uri" yaml:"uri"`
+	Format    string   `json:"format" yaml:"format"`
+	Databases []string `json:"databases" yaml:"databases"`
+	// Query selects the rows of a CSV export.
+	Query string `json:"query" yaml:"query"`
+}
+
+func (req *ExportRequest) validate() validationErrors {
+	var errs validationErrors
+	switch {
+	case req.URI == "":
+		errs = append(errs, fieldError{Field: "uri", Message: "is required"})
+	case !strings.HasPrefix(req.URI, "gs://") || len(req.URI) == len("gs://"):
+		errs = append(errs, fieldError{Field: "uri", Message: "must be a Cloud Storage URI such as 'gs://bucket/exports/'"})
+	}
+	switch req.Format {
+	case "", exportFormatSQL:
+		if req.Query != "" {
+			errs = append(errs, fieldError{Field: "query", Message: "only applies to CSV exports"})
+		}
+	case exportFormatCSV:
+		if req.Query == "" {
+			errs = append(errs, fieldError{Field: "query", Message: "is required for CSV exports"})
+		}
+		if len(req.Databases) > 1 {
+			errs = append(errs, fieldError{Field: "databases", Message: "must list at most one database for CSV exports"})
+		}
+	default:
+		errs = append(errs, fieldError{Field: "format", Message: "must be 'sql' or 'csv'"})
+	}
+	for i, database := range req.Databases {
+		if database == "" {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("databases[%d]", i), Message: "must not be empty"})
+		}
+	}
+	return errs
+}
+
+// exportContext is the export of instance at now. SQL exports are
+// compressed when the file is named by the scheduler.
+func (req *ExportRequest) exportContext(instance string, now time.Time) *sqladmin.ExportContext {
+	format := req.Format
+	if format == "" {
+		format = exportFormatSQL
+	}
+
+	uri := req.URI
+	if strings.HasSuffix(uri, "/") {
+		uri += fmt.Sprintf("%s-%s.%s.gz", instance, now.UTC().Format("20060102-150405"), format)
+	}
+
+	export := &sqladmin.ExportContext{Uri: uri, FileType: strings.ToUpper(format), Databases: req.Databases}
+	if format == exportFormatCSV {
+		export.CsvExportOptions = &sqladmin.ExportContextCsvExportOptions{SelectQuery: req.Query}
+	}
+	return export
+}
+
+// ExportResult is the answer of an export: the operation, the file written
+// and, after waiting, the state of the instance.
+type ExportResult struct {
+	Operation *sqladmin.Operation `json:"operation"`
+	URI       string              `json:"uri"`
+	Instance  *SQLInstancesData   `json:"instance,omitempty"`
+}
+
+// exportHandler exports databases of an instance to Cloud Storage.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	var payload ExportRequest
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if errs := payload.validate(); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	project, instance := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	body := &sqladmin.InstancesExportRequest{ExportContext: payload.exportContext(instance, time.Now())}
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunCall(http.MethodPost, sqlAdminInstancePath(project, instance)+"/export", body))
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	operation, err := sqlService.Instances.Export(project, instance, body).Context(ctx).Do()
+	event := newNotificationEvent(actionExport, actionSourceAPI, requestPrincipal(r), project, instance)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgExportFailed, err)
+		return
+	}
+	operations.track(event, operation)
+	auditOperation(r, operation.Name)
+	auditURI(r, body.ExportContext.Uri)
+	annotateRequest(r, slog.String("operation", operation.Name), slog.String("uri", body.ExportContext.Uri))
+
+	result := ExportResult{Operation: operation, URI: body.ExportContext.Uri}
+	if !wait {
+		writeSuccessResponse(w, r, http.StatusOK, msgExportStarted, result, result.URI)
+		return
+	}
+
+	result.Operation, err = waitForOperation(r.Context(), project, operation, timeout)
+	if result.Operation.Status == "DONE" {
+		operations.finished(result.Operation, err)
+	}
+	if errors.Is(err, errOperationWaitTimeout) {
+		writeErrorResponse(w, r, http.StatusRequestTimeout, msgOperationTimedOut, err, operation.Name, timeout)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgExportFailed, err)
+		return
+	}
+	result.Instance, _, err = inventoryCache.load().get(r.Context(), project, instance, true)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgExportStarted, result, result.URI)
+}
+
+// exportBeforeStop exports the instance and waits for the export to finish,
+// up to timeout or maxWaitTimeout when unset, so the instance is only
+// stopped once its data is in Cloud Storage.
+func exportBeforeStop(ctx context.Context, sqlService *sqladmin.Service, event NotificationEvent, req *ExportRequest, timeout time.Duration) (*sqladmin.Operation, error) {
+	event.Action = actionExport
+
+	callCtx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	body := &sqladmin.InstancesExportRequest{ExportContext: req.exportContext(event.Instance, time.Now())}
+	operation, err := sqlService.Instances.Export(event.Project, event.Instance, body).Context(callCtx).Do()
+	notifyAction(event, operation, err)
+	if err != nil {
+		return nil, err
+	}
+	operations.track(event, operation)
+
+	operation, err = awaitOrdered(ctx, event.Project, operation, timeout)
+	if err != nil {
+		return operation, fmt.Errorf("export %s to %s: %w", operation.Name, body.ExportContext.Uri, err)
+	}
+	return operation, nil
+}
+
+// operationURI is the Cloud Storage file of an export or import operation,
+// empty for other operations.
+func operationURI(operation *sqladmin.Operation) string {
+	switch {
+	case operation == nil:
+		return ""
+	case operation.ExportContext != nil:
+		return operation.ExportContext.Uri
+	case operation.ImportContext != nil:
+		return operation.ImportContext.Uri
+	}
+	return ""
+}
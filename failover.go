@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// actionFailover names failovers in notifications and the audit log.
+const actionFailover = "failover"
+
+// availabilityRegional is the availability type of instances with a
+// standby in another zone.
+const availabilityRegional = "REGIONAL"
+
+// FailoverResult is the answer of a failover: the operation, the settings
+// version it was requested for and, after waiting, the zone the primary
+// moved to and the state of the instance.
+type FailoverResult struct {
+	Operation       *sqladmin.Operation `json:"operation"`
+	SettingsVersion int64               `json:"settings_version"`
+	PreviousZone    string              `json:"previous_zone,omitempty"`
+	Zone            string              `json:"zone,omitempty"`
+	Instance        *SQLInstancesData   `json:"instance,omitempty"`
+}
+
+// failoverHandler fails a high availability instance over to its standby,
+// for disaster recovery drills. Like restarts, it refuses while another
+// operation is in progress instead of queueing behind it.
+func failoverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	project, name := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	instance, err := getInstance(r.Context(), sqlService, project, name)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	if instance.State != "RUNNABLE" {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInstanceNotRunnable, "", instance.State)
+		return
+	}
+	if availability := instance.Settings.AvailabilityType; availability != availabilityRegional {
+		writeErrorResponse(w, r, http.StatusConflict, msgFailoverNotHA, "availability type is "+availability, availability)
+		return
+	}
+
+	running, err := runningOperation(r.Context(), sqlService, project, name)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgFailoverFailed, err)
+		return
+	}
+	if running != nil {
+		writeErrorResponse(w, r, http.StatusConflict, msgFailoverBlocked, "operation "+running.Name+" is "+running.Status, running.OperationType)
+		return
+	}
+
+	if isDryRun(r) {
+		body := &sqladmin.InstancesFailoverRequest{FailoverContext: &sqladmin.FailoverContext{SettingsVersion: instance.Settings.SettingsVersion}}
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunCall(http.MethodPost, sqlAdminInstancePath(project, name)+"/failover", body))
+		return
+	}
+
+	operation, version, err := failover(r.Context(), sqlService, project, instance)
+	event := newNotificationEvent(actionFailover, actionSourceAPI, requestPrincipal(r), project, name)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgFailoverFailed, err)
+		return
+	}
+	operations.track(event, operation)
+	auditOperation(r, operation.Name)
+	annotateRequest(r, slog.String("operation", operation.Name), slog.String("zone", instance.GceZone))
+
+	result := FailoverResult{Operation: operation, SettingsVersion: version, PreviousZone: instance.GceZone}
+	if !wait {
+		writeSuccessResponse(w, r, http.StatusOK, msgFailoverStarted, result)
+		return
+	}
+
+	result.Operation, err = waitForOperation(r.Context(), project, operation, timeout)
+	if result.Operation.Status == "DONE" {
+		operations.finished(result.Operation, err)
+	}
+	if errors.Is(err, errOperationWaitTimeout) {
+		writeErrorResponse(w, r, http.StatusRequestTimeout, msgOperationTimedOut, err, operation.Name, timeout)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgFailoverFailed, err)
+		return
+	}
+
+	after, err := getInstance(r.Context(), sqlService, project, name)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	result.Zone = after.GceZone
+	result.Instance, _, err = inventoryCache.load().get(r.Context(), project, name, true)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgFailoverDone, result, result.PreviousZone, result.Zone)
+}
+
+// failover requests the failover of instance with its settings version,
+// which Cloud SQL requires to match the current one. When the settings
+// changed since instance was read, it is read again and the failover
+// requested once more. It returns the operation and the version used.
+func failover(ctx context.Context, sqlService *sqladmin.Service, project string, instance *sqladmin.DatabaseInstance) (*sqladmin.Operation, int64, error) {
+	version := instance.Settings.SettingsVersion
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := sqlAdminContext(ctx)
+		body := &sqladmin.InstancesFailoverRequest{FailoverContext: &sqladmin.FailoverContext{SettingsVersion: version}}
+		operation, err := sqlService.Instances.Failover(project, instance.Name, body).Context(callCtx).Do()
+		cancel()
+
+		var apiErr *googleapi.Error
+		if attempt > 0 || !errors.As(err, &apiErr) || apiErr.Code != http.StatusPreconditionFailed {
+			return operation, version, err
+		}
+		slog.InfoContext(ctx, "Settings version changed, reading it again before the failover", "project", project, "instance", instance.Name, "settings_version", version)
+		current, err := getInstance(ctx, sqlService, project, instance.Name)
+		if err != nil {
+			return nil, version, err
+		}
+		version = current.Settings.SettingsVersion
+	}
+}
+
+// getInstance reads the full description of an instance.
+func getInstance(ctx context.Context, sqlService *sqladmin.Service, project string, name string) (*sqladmin.DatabaseInstance, error) {
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	instance, err := sqlService.Instances.Get(project, name).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	if instance.Settings == nil {
+		instance.Settings = &sqladmin.Settings{}
+	}
+	return instance, nil
+}
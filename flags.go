@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// featureFlag gates a subsystem that is rolled out gradually.
+type featureFlag string
+
+const (
+	flagReconciler      featureFlag = "reconciler"
+	flagAutoStop        featureFlag = "auto_stop"
+	flagResizeSchedules featureFlag = "resize_schedules"
+)
+
+// knownFlags lists every flag with its description. All flags default to
+// disabled.
+var knownFlags = map[featureFlag]string{
+	flagReconciler:      "Correct drift between desired and actual activation policy.",
+	flagAutoStop:        "Stop instances found idle.",
+	flagResizeSchedules: "Run scheduled machine tier changes.",
+}
+
+type featureFlags struct {
+	mu     sync.RWMutex
+	values map[featureFlag]bool
+}
+
+var features = &featureFlags{values: make(map[featureFlag]bool)}
+
+func (f *featureFlags) enabled(flag featureFlag) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.values[flag]
+}
+
+func (f *featureFlags) set(flag featureFlag, enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[flag] = enabled
+}
+
+func (f *featureFlags) replace(values map[featureFlag]bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.values = make(map[featureFlag]bool, len(values))
+	for flag, enabled := range values {
+		f.values[flag] = enabled
+	}
+}
+
+// FeatureFlagStatus is one entry of GET /admin/flags.
+type FeatureFlagStatus struct {
+	Name        featureFlag `json:"name"`
+	Enabled     bool        `json:"enabled"`
+	Description string      `json:"description"`
+}
+
+func (f *featureFlags) list() []FeatureFlagStatus {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	statuses := make([]FeatureFlagStatus, 0, len(knownFlags))
+	for flag, description := range knownFlags {
+		statuses = append(statuses, FeatureFlagStatus{Name: flag, Enabled: f.values[flag], Description: description})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// parseFeatureFlags parses FEATURE_FLAGS, e.g. "reconciler,auto_stop=false".
+// A bare name enables the flag.
+func parseFeatureFlags(value string) (map[featureFlag]bool, error) {
+	flags := make(map[featureFlag]bool)
+	for _, item := range splitList(value) {
+		name, raw, hasValue := strings.Cut(item, "=")
+		flag := featureFlag(strings.TrimSpace(name))
+		if _, ok := knownFlags[flag]; !ok {
+			return nil, fmt.Errorf("unknown feature flag %q", flag)
+		}
+
+		enabled := true
+		if hasValue {
+			b, err := strconv.ParseBool(strings.TrimSpace(raw))
+			if err != nil {
+				return nil, fmt.Errorf("feature flag %q: %q is not true or false", flag, raw)
+			}
+			enabled = b
+		}
+		flags[flag] = enabled
+	}
+	return flags, nil
+}
+
+// FeatureFlagRequest is the body accepted by PATCH /admin/flags/{name}.
+type FeatureFlagRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+func (req *FeatureFlagRequest) validate() validationErrors {
+	if req.Enabled == nil {
+		return validationErrors{{Field: "enabled", Message: "is required"}}
+	}
+	return nil
+}
+
+func listFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	writeSuccessResponse(w, r, http.StatusOK, msgFlagsListed, features.list())
+}
+
+// setFlagHandler toggles a flag at runtime. The change is not persisted and
+// is lost on restart, FEATURE_FLAGS remains the source of truth.
+func setFlagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	flag := featureFlag(r.PathValue("name"))
+	if _, ok := knownFlags[flag]; !ok {
+		writeErrorResponse(w, r, http.StatusNotFound, msgUnknownFlag, "", flag)
+		return
+	}
+
+	var payload FeatureFlagRequest
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if errs := payload.validate(); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	features.set(flag, *payload.Enabled)
+	writeSuccessResponse(w, r, http.StatusOK, msgFlagUpdated, FeatureFlagStatus{
+		Name:        flag,
+		Enabled:     *payload.Enabled,
+		Description: knownFlags[flag],
+	})
+}
@@ -0,0 +1,207 @@
+// Package function exposes the start, stop and status of a Cloud SQL
+// instance as an HTTP function for the Functions Framework, so it can be
+// deployed as a Cloud Function triggered by Cloud Scheduler instead of
+// running the HTTP server. It is registered as SQLScheduler.
+//
+// Requests are POSTs with a JSON body, every field optional:
+//
+//	{"project": "my-project", "instance": "my-instance", "action": "stop", "wait": "2m"}
+//
+// project and instance default to PROJECT_ID and INSTANCE_ID, action to
+// status. Callers are authenticated by Cloud Functions IAM, the function
+// itself doesn't check them.
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"google.golang.org/api/sqladmin/v1"
+
+	"scheduler-db/pkg/sqlctl"
+)
+
+// Actions of a request.
+const (
+	actionStart  = "start"
+	actionStop   = "stop"
+	actionStatus = "status"
+)
+
+// maxWait bounds the wait of a request, below the default timeout of a
+// Cloud Function.
+const maxWait = 5 * time.Minute
+
+func init() {
+	functions.HTTP("SQLScheduler", SQLScheduler)
+}
+
+// Request is the body of a call.
+type Request struct {
+	Project  string `json:"project"`
+	Instance string `json:"instance"`
+	Action   string `json:"action"`
+	// Wait, a Go duration, waits for the operation to finish.
+	Wait string `json:"wait"`
+}
+
+// Response is the answer of a call. Result is started, done, skipped or
+// status, Error is set on failures.
+type Response struct {
+	Project   string              `json:"project"`
+	Instance  string              `json:"instance"`
+	Action    string              `json:"action"`
+	Result    string              `json:"result,omitempty"`
+	State     string              `json:"state,omitempty"`
+	Operation *sqladmin.Operation `json:"operation,omitempty"`
+	Error     string              `json:"error,omitempty"`
+}
+
+// Results of a call.
+const (
+	resultStarted = "started"
+	resultDone    = "done"
+	resultSkipped = "skipped"
+	resultStatus  = "status"
+)
+
+var (
+	// newController builds the controller, replaced in tests.
+	newController = func(ctx context.Context) (*sqlctl.Controller, error) {
+		return sqlctl.NewFromOptions(ctx)
+	}
+
+	// controller is shared by the calls served by an instance of the
+	// function.
+	controller struct {
+		once sync.Once
+		c    *sqlctl.Controller
+		err  error
+	}
+)
+
+func sharedController() (*sqlctl.Controller, error) {
+	controller.once.Do(func() {
+		controller.c, controller.err = newController(context.Background())
+	})
+	return controller.c, controller.err
+}
+
+// SQLScheduler starts, stops or reads the state of an instance. Starting a
+// running instance or stopping a stopped one is skipped, not an error, so
+// Cloud Scheduler doesn't retry it.
+func SQLScheduler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeResponse(w, http.StatusMethodNotAllowed, Response{Error: "only POST is allowed"})
+		return
+	}
+
+	var req Request
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			writeResponse(w, http.StatusBadRequest, Response{Error: "invalid body: " + err.Error()})
+			return
+		}
+	}
+	if req.Project == "" {
+		req.Project = os.Getenv("PROJECT_ID")
+	}
+	if req.Instance == "" {
+		req.Instance = os.Getenv("INSTANCE_ID")
+	}
+	if req.Action == "" {
+		req.Action = actionStatus
+	}
+
+	resp := Response{Project: req.Project, Instance: req.Instance, Action: req.Action}
+	var wait time.Duration
+	switch {
+	case req.Project == "" || req.Instance == "":
+		resp.Error = "project and instance are required, in the body or as PROJECT_ID and INSTANCE_ID"
+	case req.Action != actionStart && req.Action != actionStop && req.Action != actionStatus:
+		resp.Error = "action must be start, stop or status"
+	case req.Wait != "":
+		var err error
+		if wait, err = time.ParseDuration(req.Wait); err != nil || wait <= 0 || wait > maxWait {
+			resp.Error = "wait must be a duration up to " + maxWait.String()
+		}
+	}
+	if resp.Error != "" {
+		writeResponse(w, http.StatusBadRequest, resp)
+		return
+	}
+
+	c, err := sharedController()
+	if err != nil {
+		resp.Error = err.Error()
+		writeResponse(w, http.StatusInternalServerError, resp)
+		return
+	}
+
+	status, err := run(r.Context(), c, req, wait, &resp)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Action failed", "action", req.Action, "project", req.Project, "instance", req.Instance, "error", err)
+		resp.Error = err.Error()
+	}
+	writeResponse(w, status, resp)
+}
+
+// run applies the action of req and fills resp, returning the status code
+// of the answer.
+func run(ctx context.Context, c *sqlctl.Controller, req Request, wait time.Duration, resp *Response) (int, error) {
+	var (
+		operation *sqladmin.Operation
+		err       error
+	)
+	switch req.Action {
+	case actionStatus:
+		resp.Result = resultStatus
+	case actionStart:
+		operation, err = c.Start(ctx, req.Project, req.Instance)
+	case actionStop:
+		operation, err = c.Stop(ctx, req.Project, req.Instance)
+	}
+
+	switch {
+	case errors.Is(err, sqlctl.ErrAlreadyRunning), errors.Is(err, sqlctl.ErrNotRunning):
+		resp.Result = resultSkipped
+	case err != nil:
+		return http.StatusBadGateway, err
+	case operation != nil:
+		resp.Result, resp.Operation = resultStarted, operation
+		if wait > 0 {
+			waitCtx, cancel := context.WithTimeout(ctx, wait)
+			defer cancel()
+			resp.Operation, err = c.Wait(waitCtx, req.Project, operation)
+			if errors.Is(err, sqlctl.ErrWaitTimeout) {
+				return http.StatusAccepted, nil
+			}
+			if err != nil {
+				return http.StatusBadGateway, err
+			}
+			resp.Result = resultDone
+		}
+	}
+
+	status, err := c.Status(ctx, req.Project, req.Instance)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	resp.State = status.State
+	return http.StatusOK, nil
+}
+
+func writeResponse(w http.ResponseWriter, status int, resp Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
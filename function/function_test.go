@@ -0,0 +1,78 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+
+	"scheduler-db/pkg/sqlctl"
+	"scheduler-db/pkg/sqlctl/sqlctltest"
+)
+
+func call(t *testing.T, method string, body string) (int, Response) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	SQLScheduler(rec, httptest.NewRequest(method, "/", strings.NewReader(body)))
+	var resp Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid answer %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, resp
+}
+
+func TestSQLScheduler(t *testing.T) {
+	fake := sqlctltest.NewFake()
+	fake.AddInstance(&sqladmin.DatabaseInstance{Name: "dev-db", Project: "dev-project"})
+	previous := newController
+	newController = func(context.Context) (*sqlctl.Controller, error) {
+		return &sqlctl.Controller{Client: fake, PollInterval: time.Millisecond}, nil
+	}
+	// The controller is built once per instance of the function, drop it so
+	// the next run gets a fresh fake.
+	t.Cleanup(func() {
+		newController = previous
+		controller.once, controller.c, controller.err = sync.Once{}, nil, nil
+	})
+	t.Setenv("PROJECT_ID", "dev-project")
+	t.Setenv("INSTANCE_ID", "dev-db")
+
+	if code, resp := call(t, http.MethodPost, ""); code != http.StatusOK || resp.Result != resultStatus || resp.State != "RUNNABLE" {
+		t.Errorf("status = %d %+v", code, resp)
+	}
+
+	fake.Polls = 2
+	code, resp := call(t, http.MethodPost, `{"action":"stop","wait":"10s"}`)
+	if code != http.StatusOK || resp.Result != resultDone || resp.State != "STOPPED" {
+		t.Errorf("stop = %d %+v", code, resp)
+	}
+
+	// Cloud Scheduler retries are harmless.
+	if code, resp := call(t, http.MethodPost, `{"action":"stop"}`); code != http.StatusOK || resp.Result != resultSkipped {
+		t.Errorf("second stop = %d %+v", code, resp)
+	}
+
+	if code, resp := call(t, http.MethodPost, `{"project":"dev-project","instance":"dev-db","action":"start"}`); code != http.StatusOK || resp.Result != resultStarted || resp.Operation == nil {
+		t.Errorf("start = %d %+v", code, resp)
+	}
+
+	for _, body := range []string{`{"action":"pause"}`, `{"action":"start","wait":"1h"}`, `{"instance":`} {
+		if code, _ := call(t, http.MethodPost, body); code != http.StatusBadRequest {
+			t.Errorf("%s answered %d, want 400", body, code)
+		}
+	}
+	if code, _ := call(t, http.MethodGet, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET answered %d", code)
+	}
+
+	if code, resp := call(t, http.MethodPost, `{"instance":"missing","action":"stop"}`); code != http.StatusBadGateway || resp.Error == "" {
+		t.Errorf("missing instance = %d %+v", code, resp)
+	}
+}
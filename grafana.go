@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Targets of the Grafana datasource.
+const (
+	// grafanaTargetUptime is one series per instance, 1 while it runs and 0
+	// while it is stopped.
+	grafanaTargetUptime = "uptime"
+	// grafanaTargetActions is one series per action counting the starts,
+	// stops and scales of each interval, and a failed series counting those
+	// that failed.
+	grafanaTargetActions = "actions"
+)
+
+const (
+	defaultGrafanaPeriod        = 24 * time.Hour
+	defaultGrafanaMaxDataPoints = 1000
+	minGrafanaInterval          = time.Minute
+)
+
+var grafanaTargets = []string{grafanaTargetUptime, grafanaTargetActions}
+
+// grafanaActions are the actions charted by the actions target and the
+// annotations.
+var grafanaActions = []string{scheduleActionStart, scheduleActionStop, scheduleActionScale}
+
+// GrafanaRange is the time range of a dashboard.
+type GrafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// GrafanaFilter narrows a target down to a project or an instance. It is
+// the payload of a JSON datasource query.
+type GrafanaFilter struct {
+	Project  string `json:"project"`
+	Instance string `json:"instance"`
+}
+
+// GrafanaTarget is one query of a panel.
+type GrafanaTarget struct {
+	Target  string          `json:"target"`
+	RefID   string          `json:"refId"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// filter is the payload of the target. Grafana sends an empty string when
+// the query has none.
+func (t GrafanaTarget) filter() (GrafanaFilter, error) {
+	var filter GrafanaFilter
+	if len(t.Payload) == 0 || t.Payload[0] != '{' {
+		return filter, nil
+	}
+	err := json.Unmarshal(t.Payload, &filter)
+	return filter, err
+}
+
+// GrafanaQueryRequest is the body Grafana posts to /v1/grafana/query. The
+// many other fields it sends are ignored.
+type GrafanaQueryRequest struct {
+	Range         GrafanaRange    `json:"range"`
+	IntervalMs    int64           `json:"intervalMs"`
+	MaxDataPoints int             `json:"maxDataPoints"`
+	Targets       []GrafanaTarget `json:"targets"`
+}
+
+func (req *GrafanaQueryRequest) validate() validationErrors {
+	var errs validationErrors
+	if req.Range.From.IsZero() || req.Range.To.IsZero() {
+		errs = append(errs, fieldError{Field: "range", Message: "from and to are required"})
+	} else if !req.Range.To.After(req.Range.From) {
+		errs = append(errs, fieldError{Field: "range.to", Message: "must be after from"})
+	}
+	for i, target := range req.Targets {
+		if !slices.Contains(grafanaTargets, target.Target) {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("targets[%d].target", i), Message: "must be uptime or actions"})
+		}
+		if _, err := target.filter(); err != nil {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("targets[%d].payload", i), Message: "must be an object with project and instance"})
+		}
+	}
+	return errs
+}
+
+// interval is the width of the buckets of the actions target: intervalMs,
+// widened so the range fits in maxDataPoints, and at least a minute.
+func (req *GrafanaQueryRequest) interval() time.Duration {
+	interval := time.Duration(req.IntervalMs) * time.Millisecond
+	points := req.MaxDataPoints
+	if points <= 0 {
+		points = defaultGrafanaMaxDataPoints
+	}
+	if fit := req.Range.To.Sub(req.Range.From) / time.Duration(points); interval < fit {
+		interval = fit
+	}
+	return max(interval, minGrafanaInterval)
+}
+
+// GrafanaTimeSeries is a series of the answer of /v1/grafana/query. Each
+// datapoint is a value and a Unix time in milliseconds.
+type GrafanaTimeSeries struct {
+	Target     string       `json:"target"`
+	RefID      string       `json:"refId,omitempty"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// GrafanaAnnotationRequest is the body Grafana posts to
+// /v1/grafana/annotations.
+type GrafanaAnnotationRequest struct {
+	Range      GrafanaRange `json:"range"`
+	Annotation struct {
+		Query string `json:"query"`
+	} `json:"annotation"`
+}
+
+// GrafanaAnnotation marks an action on the time axis of a panel.
+type GrafanaAnnotation struct {
+	Time  int64    `json:"time"`
+	Title string   `json:"title"`
+	Text  string   `json:"text"`
+	Tags  []string `json:"tags"`
+}
+
+// GrafanaMetric is an entry of the metric picker of the query editor.
+type GrafanaMetric struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// grafanaHandler answers the connection test of the datasource.
+func grafanaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+	if auditLog == nil {
+		writeErrorResponse(w, r, http.StatusNotFound, msgAuditDisabled, errAuditDisabled)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// grafanaSearchHandler lists the targets, as names on /search and as
+// label/value pairs on /metrics, the two forms datasource versions ask for.
+func grafanaSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+	if r.URL.Path == "/v1/grafana/search" {
+		writeGrafanaJSON(w, grafanaTargets)
+		return
+	}
+	metrics := make([]GrafanaMetric, 0, len(grafanaTargets))
+	for _, target := range grafanaTargets {
+		metrics = append(metrics, GrafanaMetric{Label: target, Value: target})
+	}
+	writeGrafanaJSON(w, metrics)
+}
+
+// grafanaQueryHandler returns the series of the requested targets, derived
+// from the audit log. POST takes the body of the JSON datasource. GET takes
+// ?target=, ?from= and ?to= (RFC 3339 or Unix milliseconds, the last day
+// by default), ?project= and ?instance=, for the Infinity datasource.
+func grafanaQueryHandler(w http.ResponseWriter, r *http.Request) {
+	var payload GrafanaQueryRequest
+	switch r.Method {
+	case http.MethodPost:
+		if err := decodeGrafanaBody(w, r, &payload); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+	case http.MethodGet:
+		var errs validationErrors
+		if payload, errs = parseGrafanaQuery(r); len(errs) > 0 {
+			writeDecodeError(w, r, errs)
+			return
+		}
+	default:
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+	if errs := payload.validate(); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+	if auditLog == nil {
+		writeErrorResponse(w, r, http.StatusNotFound, msgAuditDisabled, errAuditDisabled)
+		return
+	}
+
+	series := []GrafanaTimeSeries{}
+	for _, target := range payload.Targets {
+		filter, _ := target.filter()
+		items, err := grafanaSeries(r.Context(), target.Target, filter, payload.Range, payload.interval())
+		if err != nil {
+			writeErrorResponse(w, r, http.StatusInternalServerError, msgAuditQueryFailed, err)
+			return
+		}
+		for i := range items {
+			items[i].RefID = target.RefID
+		}
+		series = append(series, items...)
+	}
+	writeGrafanaJSON(w, series)
+}
+
+// grafanaAnnotationsHandler returns the starts, stops and scales of the
+// range as annotations. The query of the annotation, when set, is the
+// instance to show.
+func grafanaAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+	var payload GrafanaAnnotationRequest
+	if err := decodeGrafanaBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if auditLog == nil {
+		writeErrorResponse(w, r, http.StatusNotFound, msgAuditDisabled, errAuditDisabled)
+		return
+	}
+
+	q := auditQuery{Instance: payload.Annotation.Query, Since: payload.Range.From, Until: payload.Range.To}
+	entries, _, err := auditEntries(r.Context(), q, grafanaActions...)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgAuditQueryFailed, err)
+		return
+	}
+	annotations := make([]GrafanaAnnotation, 0, len(entries))
+	for _, entry := range entries {
+		source := entry.Source
+		if source == "" {
+			source = actionSourceAPI
+		}
+		text := fmt.Sprintf("%s by %s (%s): %s", entry.Action, entry.Principal, source, entry.Result)
+		if entry.Error != "" {
+			text += ", " + entry.Error
+		}
+		annotations = append(annotations, GrafanaAnnotation{
+			Time:  entry.Time.UnixMilli(),
+			Title: entry.Action + " " + entry.Instance,
+			Text:  text,
+			Tags:  []string{entry.Action, entry.Result, entry.Instance},
+		})
+	}
+	writeGrafanaJSON(w, annotations)
+}
+
+// grafanaSeries computes the series of target over rng.
+func grafanaSeries(ctx context.Context, target string, filter GrafanaFilter, rng GrafanaRange, interval time.Duration) ([]GrafanaTimeSeries, error) {
+	to := minTime(rng.To, time.Now())
+	q := auditQuery{Project: filter.Project, Instance: filter.Instance, Until: to}
+	if target == grafanaTargetUptime {
+		q.Since = rng.From.Add(-activationLookback)
+		entries, _, err := auditEntries(ctx, q, scheduleActionStart, scheduleActionStop)
+		if err != nil {
+			return nil, err
+		}
+		return uptimeSeries(entries, rng.From, to), nil
+	}
+	q.Since = rng.From
+	entries, _, err := auditEntries(ctx, q, grafanaActions...)
+	if err != nil {
+		return nil, err
+	}
+	return actionSeries(entries, rng.From, to, interval), nil
+}
+
+// uptimeSeries turns the successful starts and stops, oldest first, into a
+// step series per instance: a point at from with the state the instance
+// was in, one at each change and one at to. Instances whose state before
+// their first action in the range is unknown start at that action.
+func uptimeSeries(entries []AuditEntry, from time.Time, to time.Time) []GrafanaTimeSeries {
+	const running, stopped = 1, 0
+	states := make(map[string]float64)
+	series := make(map[string]*GrafanaTimeSeries)
+	for _, entry := range entries {
+		if entry.Instance == "" || entry.Result != "success" {
+			continue
+		}
+		key := entry.Project + "/" + entry.Instance
+		state := float64(running)
+		if entry.Action == scheduleActionStop {
+			state = stopped
+		}
+		if entry.Time.Before(from) {
+			states[key] = state
+			continue
+		}
+		s, ok := series[key]
+		if !ok {
+			s = &GrafanaTimeSeries{Target: key}
+			if previous, known := states[key]; known {
+				s.Datapoints = append(s.Datapoints, [2]float64{previous, float64(from.UnixMilli())})
+			}
+			series[key] = s
+		}
+		s.Datapoints = append(s.Datapoints, [2]float64{state, float64(entry.Time.UnixMilli())})
+		states[key] = state
+	}
+	for key, state := range states {
+		s, ok := series[key]
+		if !ok {
+			s = &GrafanaTimeSeries{Target: key, Datapoints: [][2]float64{{state, float64(from.UnixMilli())}}}
+			series[key] = s
+		}
+		s.Datapoints = append(s.Datapoints, [2]float64{state, float64(to.UnixMilli())})
+	}
+
+	items := make([]GrafanaTimeSeries, 0, len(series))
+	for _, key := range sortedKeys(series) {
+		items = append(items, *series[key])
+	}
+	return items
+}
+
+// actionSeries counts the actions, oldest first, in buckets of interval
+// from from to to: one series per action for those that succeeded and a
+// failed series for the others. Every bucket has a point, so empty ones
+// chart as zero.
+func actionSeries(entries []AuditEntry, from time.Time, to time.Time, interval time.Duration) []GrafanaTimeSeries {
+	const failed = "failed"
+	names := append(slices.Clone(grafanaActions), failed)
+	buckets := int(to.Sub(from)/interval) + 1
+	counts := make(map[string][]float64, len(names))
+	for _, name := range names {
+		counts[name] = make([]float64, buckets)
+	}
+	for _, entry := range entries {
+		i := int(entry.Time.Sub(from) / interval)
+		if i < 0 || i >= buckets {
+			continue
+		}
+		name := entry.Action
+		if entry.Result != "success" {
+			name = failed
+		}
+		if _, ok := counts[name]; ok {
+			counts[name][i]++
+		}
+	}
+
+	items := make([]GrafanaTimeSeries, 0, len(names))
+	for _, name := range names {
+		s := GrafanaTimeSeries{Target: name, Datapoints: make([][2]float64, buckets)}
+		for i, count := range counts[name] {
+			s.Datapoints[i] = [2]float64{count, float64(from.Add(time.Duration(i) * interval).UnixMilli())}
+		}
+		items = append(items, s)
+	}
+	return items
+}
+
+// parseGrafanaQuery reads the query of GET /v1/grafana/query.
+func parseGrafanaQuery(r *http.Request) (GrafanaQueryRequest, validationErrors) {
+	values := r.URL.Query()
+	now := time.Now()
+	req := GrafanaQueryRequest{Range: GrafanaRange{From: now.Add(-defaultGrafanaPeriod), To: now}}
+	filter, _ := json.Marshal(GrafanaFilter{Project: values.Get("project"), Instance: values.Get("instance")})
+	req.Targets = []GrafanaTarget{{Target: values.Get("target"), Payload: filter}}
+
+	var errs validationErrors
+	for _, bound := range []struct {
+		name   string
+		target *time.Time
+	}{{"from", &req.Range.From}, {"to", &req.Range.To}} {
+		raw := values.Get(bound.name)
+		if raw == "" {
+			continue
+		}
+		if ms, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			*bound.target = time.UnixMilli(ms)
+		} else if t, err := time.Parse(time.RFC3339, raw); err == nil {
+			*bound.target = t
+		} else {
+			errs = append(errs, fieldError{Field: bound.name, Message: "must be an RFC 3339 timestamp or Unix milliseconds"})
+		}
+	}
+	return req, errs
+}
+
+// decodeGrafanaBody decodes a request of Grafana. Unlike decodeJSONBody it
+// accepts unknown fields, Grafana sends many this service doesn't use.
+func decodeGrafanaBody(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes.load())
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
+		return describeDecodeError(err)
+	}
+	return nil
+}
+
+// writeGrafanaJSON writes v as is, without the response envelope Grafana
+// doesn't expect.
+func writeGrafanaJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// readinessTTL is how long a SQL Admin reachability result is reused,
+	// so frequent probes don't eat into the API quota.
+	readinessTTL = 10 * time.Second
+	// readinessTimeout bounds the SQL Admin call of a probe, below the
+	// default timeout of Kubernetes and Cloud Run probes.
+	readinessTimeout = 3 * time.Second
+)
+
+// readiness caches the outcome of the last SQL Admin reachability check.
+var readiness struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// ReadinessData is the payload of GET /readyz, the result of each check.
+type ReadinessData struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// readyzHandler reports whether the service can take traffic: the
+// configuration is loaded, the credentials load and the SQL Admin API
+// answers. Unlike /healthz, a failure here is not a reason to restart the
+// process, only to stop routing requests to it.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	data := ReadinessData{Status: "ready", Checks: map[string]string{}}
+	var errs []error
+	check := func(name string, err error) {
+		data.Checks[name] = "ok"
+		if err != nil {
+			data.Checks[name] = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	config := activeConfig.load()
+	if config == nil {
+		check("config", errors.New("not loaded"))
+	} else {
+		check("config", nil)
+	}
+	check("credentials", verifyCredentials())
+	if config != nil {
+		check("sqladmin", sqlAdminReachable(r.Context(), config.ProjectID))
+	}
+
+	if len(errs) > 0 {
+		writeErrorResponse(w, r, http.StatusServiceUnavailable, msgNotReady, errors.Join(errs...))
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgReady, data)
+}
+
+// verifyCredentials checks that the default and per-project credentials
+// load. Nothing is checked when requests never reach Google.
+func verifyCredentials() error {
+	if sqlAdminOffline.load() {
+		return nil
+	}
+	if err := credentials.load().verify(); err != nil {
+		return err
+	}
+	for _, project := range sortedKeys(projectCredentials.load()) {
+		if err := projectCredentials.load()[project].verify(); err != nil {
+			return fmt.Errorf("%s: %w", project, err)
+		}
+	}
+	return nil
+}
+
+// sqlAdminReachable lists at most one instance of project, reusing the
+// result for readinessTTL.
+func sqlAdminReachable(ctx context.Context, project string) error {
+	readiness.mu.Lock()
+	defer readiness.mu.Unlock()
+
+	if !readiness.checkedAt.IsZero() && time.Since(readiness.checkedAt) < readinessTTL {
+		return readiness.err
+	}
+
+	readiness.err = func() error {
+		sqlService, err := sqlAdminService(project)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+		defer cancel()
+		_, err = sqlService.Instances.List(project).MaxResults(1).Context(ctx).Do()
+		return err
+	}()
+	readiness.checkedAt = time.Now()
+	return readiness.err
+}
+
+// resetReadiness forgets the cached result, e.g. once the clients changed.
+func resetReadiness() {
+	readiness.mu.Lock()
+	defer readiness.mu.Unlock()
+
+	readiness.checkedAt = time.Time{}
+}
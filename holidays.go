@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHolidayRefreshInterval = 24 * time.Hour
+	holidayFetchTimeout           = 30 * time.Second
+
+	// maxHolidayCalendarBytes bounds the iCal download, a national holiday
+	// calendar is a few hundred kilobytes at most.
+	maxHolidayCalendarBytes = 4 << 20
+)
+
+// HolidayConfig lists the days start schedules don't run on, given as dates
+// and/or an iCal calendar such as Google's public holiday calendars.
+type HolidayConfig struct {
+	Dates           []string
+	ICalURL         string
+	RefreshInterval time.Duration
+}
+
+func (h HolidayConfig) validate() error {
+	var errs []error
+	for _, date := range h.Dates {
+		if _, err := time.Parse(time.DateOnly, date); err != nil {
+			errs = append(errs, fmt.Errorf("HOLIDAYS: %q is not a date such as '2025-12-25'", date))
+		}
+	}
+	if h.ICalURL != "" {
+		if u, err := url.Parse(h.ICalURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("HOLIDAYS_ICAL_URL: %q is not an http(s) URL", h.ICalURL))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// holidayCalendar answers whether a day is a holiday from the static dates
+// and the last successful download of the iCal calendar.
+type holidayCalendar struct {
+	mu      sync.Mutex
+	config  HolidayConfig
+	static  map[string]string
+	fetched map[string]string
+	refresh chan struct{}
+	client  *http.Client
+}
+
+var holidays = &holidayCalendar{refresh: make(chan struct{}, 1), client: &http.Client{Timeout: holidayFetchTimeout}}
+
+// configure replaces the calendar settings. A new iCal URL drops the days
+// of the previous one and is fetched on the next refresh.
+func (c *holidayCalendar) configure(config HolidayConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.static = make(map[string]string, len(config.Dates))
+	for _, date := range config.Dates {
+		c.static[date] = "holiday"
+	}
+	if config.ICalURL != c.config.ICalURL {
+		c.fetched = nil
+		select {
+		case c.refresh <- struct{}{}:
+		default:
+		}
+	}
+	c.config = config
+}
+
+// holiday returns the name of the holiday on the day of t, in t's location,
+// or "" when it is a working day.
+func (c *holidayCalendar) holiday(t time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	date := t.Format(time.DateOnly)
+	if name, ok := c.static[date]; ok {
+		return name
+	}
+	return c.fetched[date]
+}
+
+// run downloads the iCal calendar at startup and every refresh interval
+// until stop is closed. A failed download keeps the previous days.
+func (c *holidayCalendar) run(stop <-chan struct{}) {
+	for {
+		c.mu.Lock()
+		config := c.config
+		c.mu.Unlock()
+
+		if config.ICalURL != "" {
+			if err := c.fetch(context.Background(), config.ICalURL); err != nil {
+				slog.Error("Failed to refresh the holiday calendar", "url", config.ICalURL, "error", err)
+			}
+		}
+
+		interval := config.RefreshInterval
+		if interval <= 0 {
+			interval = defaultHolidayRefreshInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-c.refresh:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *holidayCalendar) fetch(ctx context.Context, calendarURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, calendarURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	days, err := parseICalHolidays(io.LimitReader(resp.Body, maxHolidayCalendarBytes))
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config.ICalURL == calendarURL {
+		c.fetched = days
+	}
+	slog.Info("Refreshed the holiday calendar", "url", calendarURL, "days", len(days))
+	return nil
+}
+
+// parseICalHolidays reads the all-day events of an iCal calendar into a map
+// of date to event summary. Multi-day events cover every day up to their
+// exclusive DTEND. Recurrence rules are not expanded, holiday calendars list
+// every occurrence.
+func parseICalHolidays(r io.Reader) (map[string]string, error) {
+	days := make(map[string]string)
+
+	var (
+		lines   []string
+		scanner = bufio.NewScanner(r)
+	)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		// Long lines are folded onto continuation lines starting with a
+		// space or a tab.
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var (
+		inEvent           bool
+		start, end        time.Time
+		summary, rawStart string
+	)
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, _, _ = strings.Cut(name, ";")
+
+		switch strings.ToUpper(name) {
+		case "BEGIN":
+			if value == "VEVENT" {
+				inEvent, start, end, summary, rawStart = true, time.Time{}, time.Time{}, "", ""
+			}
+		case "DTSTART":
+			start, rawStart = parseICalDate(value), value
+		case "DTEND":
+			end = parseICalDate(value)
+		case "SUMMARY":
+			summary = strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\\`, `\`).Replace(value)
+		case "END":
+			if value != "VEVENT" || !inEvent {
+				continue
+			}
+			inEvent = false
+			if start.IsZero() {
+				return nil, fmt.Errorf("event %q has an invalid DTSTART %q", summary, rawStart)
+			}
+			if summary == "" {
+				summary = "holiday"
+			}
+			if !end.After(start) {
+				end = start.AddDate(0, 0, 1)
+			}
+			for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+				days[day.Format(time.DateOnly)] = summary
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseICalDate reads the date part of a DATE or DATE-TIME value, the zero
+// time when it is invalid.
+func parseICalDate(value string) time.Time {
+	if len(value) < 8 {
+		return time.Time{}
+	}
+	day, err := time.Parse("20060102", value[:8])
+	if err != nil {
+		return time.Time{}
+	}
+	return day
+}
+
+// skippedHoliday returns the holiday a start schedule firing at t skips, ""
+// when it runs. t is in the schedule's timezone, so the holiday is the one
+// of the schedule's local day. Stops always run.
+func (s Schedule) skippedHoliday(t time.Time) string {
+	if s.Action != scheduleActionStart {
+		return ""
+	}
+	return holidays.holiday(t)
+}
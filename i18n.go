@@ -0,0 +1,549 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// messageKey identifies a human-readable message. The key itself is returned
+// to clients as "message_code" and must stay stable across releases, while the
+// translated text may change freely.
+type messageKey string
+
+const (
+	msgMethodNotAllowed              messageKey = "method_not_allowed"
+	msgServiceAccountNotFound        messageKey = "service_account_not_found"
+	msgInstanceNotFound              messageKey = "instance_not_found"
+	msgInstanceNotRunnable           messageKey = "instance_not_runnable"
+	msgStartFailed                   messageKey = "start_failed"
+	msgStartSucceeded                messageKey = "start_succeeded"
+	msgStopFailed                    messageKey = "stop_failed"
+	msgStopSucceeded                 messageKey = "stop_succeeded"
+	msgCheckSucceeded                messageKey = "check_succeeded"
+	msgInvalidWaitState              messageKey = "invalid_wait_state"
+	msgInvalidWaitTimeout            messageKey = "invalid_wait_timeout"
+	msgWaitTimedOut                  messageKey = "wait_timed_out"
+	msgRequestTimedOut               messageKey = "request_timed_out"
+	msgValidationFailed              messageKey = "validation_failed"
+	msgReadBodyFailed                messageKey = "read_body_failed"
+	msgInvalidJSON                   messageKey = "invalid_json"
+	msgInvalidActivationPolicy       messageKey = "invalid_activation_policy"
+	msgBodyTooLarge                  messageKey = "body_too_large"
+	msgSettingsPatchFailed           messageKey = "settings_patch_failed"
+	msgSettingsPatched               messageKey = "settings_patched"
+	msgHealthy                       messageKey = "healthy"
+	msgFlagsListed                   messageKey = "flags_listed"
+	msgUnknownFlag                   messageKey = "unknown_flag"
+	msgFlagUpdated                   messageKey = "flag_updated"
+	msgSchedulesListed               messageKey = "schedules_listed"
+	msgScheduleFetched               messageKey = "schedule_fetched"
+	msgScheduleCreated               messageKey = "schedule_created"
+	msgScheduleDeleted               messageKey = "schedule_deleted"
+	msgScheduleRestored              messageKey = "schedule_restored"
+	msgScheduleNotFound              messageKey = "schedule_not_found"
+	msgScheduleNotDeleted            messageKey = "schedule_not_deleted"
+	msgScheduleSaveFailed            messageKey = "schedule_save_failed"
+	msgReloaded                      messageKey = "reloaded"
+	msgReloadInvalidConfig           messageKey = "reload_invalid_config"
+	msgReloadFailed                  messageKey = "reload_failed"
+	msgOperationTimedOut             messageKey = "operation_timed_out"
+	msgListInstancesFailed           messageKey = "list_instances_failed"
+	msgBulkFinished                  messageKey = "bulk_finished"
+	msgUnauthorized                  messageKey = "unauthorized"
+	msgInstancesListed               messageKey = "instances_listed"
+	msgDryRun                        messageKey = "dry_run"
+	msgBulkDryRun                    messageKey = "bulk_dry_run"
+	msgAuditListed                   messageKey = "audit_listed"
+	msgAuditDisabled                 messageKey = "audit_disabled"
+	msgAuditQueryFailed              messageKey = "audit_query_failed"
+	msgReplicaStopFailed             messageKey = "replica_stop_failed"
+	msgBackupStarted                 messageKey = "backup_started"
+	msgBackupFailed                  messageKey = "backup_failed"
+	msgInvalidIdempotencyKey         messageKey = "invalid_idempotency_key"
+	msgIdempotencyKeyReused          messageKey = "idempotency_key_reused"
+	msgMaintenanceWindowFound        messageKey = "maintenance_window_found"
+	msgMaintenanceWindowPatched      messageKey = "maintenance_window_patched"
+	msgMaintenanceWindowPatchFailed  messageKey = "maintenance_window_patch_failed"
+	msgSchedulePreview               messageKey = "schedule_preview"
+	msgRestartStarted                messageKey = "restart_started"
+	msgRestartFailed                 messageKey = "restart_failed"
+	msgRestartBlocked                messageKey = "restart_blocked"
+	msgSavingsEstimated              messageKey = "savings_estimated"
+	msgReady                         messageKey = "ready"
+	msgNotReady                      messageKey = "not_ready"
+	msgScaled                        messageKey = "scaled"
+	msgTierUnchanged                 messageKey = "tier_unchanged"
+	msgScaleFailed                   messageKey = "scale_failed"
+	msgRateLimited                   messageKey = "rate_limited"
+	msgBatchFinished                 messageKey = "batch_finished"
+	msgBatchDryRun                   messageKey = "batch_dry_run"
+	msgConnectionsActive             messageKey = "connections_active"
+	msgConnectionCheckFailed         messageKey = "connection_check_failed"
+	msgSchedulesSynced               messageKey = "schedules_synced"
+	msgSchedulesSyncDryRun           messageKey = "schedules_sync_dry_run"
+	msgCloneStarted                  messageKey = "clone_started"
+	msgCloneFailed                   messageKey = "clone_failed"
+	msgExportStarted                 messageKey = "export_started"
+	msgExportFailed                  messageKey = "export_failed"
+	msgImportStarted                 messageKey = "import_started"
+	msgImportDone                    messageKey = "import_done"
+	msgImportFailed                  messageKey = "import_failed"
+	msgImportBlocked                 messageKey = "import_blocked"
+	msgImportNotFound                messageKey = "import_not_found"
+	msgImportProgress                messageKey = "import_progress"
+	msgForbidden                     messageKey = "forbidden"
+	msgStartBlocked                  messageKey = "start_blocked"
+	msgStopRefused                   messageKey = "stop_refused"
+	msgOverridesListed               messageKey = "overrides_listed"
+	msgOverrideFetched               messageKey = "override_fetched"
+	msgOverrideCreated               messageKey = "override_created"
+	msgOverrideDeleted               messageKey = "override_deleted"
+	msgOverrideNotFound              messageKey = "override_not_found"
+	msgOverrideSaveFailed            messageKey = "override_save_failed"
+	msgFailoverStarted               messageKey = "failover_started"
+	msgFailoverDone                  messageKey = "failover_done"
+	msgFailoverFailed                messageKey = "failover_failed"
+	msgFailoverNotHA                 messageKey = "failover_not_ha"
+	msgFailoverBlocked               messageKey = "failover_blocked"
+	msgScheduleCalendar              messageKey = "schedule_calendar"
+	msgDatabaseFlagsFound            messageKey = "database_flags_found"
+	msgDatabaseFlagsPatched          messageKey = "database_flags_patched"
+	msgDatabaseFlagsPatchedRestart   messageKey = "database_flags_patched_restart"
+	msgDatabaseFlagsPatchFailed      messageKey = "database_flags_patch_failed"
+	msgDatabaseFlagsListFailed       messageKey = "database_flags_list_failed"
+	msgStoresListed                  messageKey = "stores_listed"
+	msgListStoresFailed              messageKey = "list_stores_failed"
+	msgStoreKindUnknown              messageKey = "store_kind_unknown"
+	msgStoreNotFound                 messageKey = "store_not_found"
+	msgStoreStartRequested           messageKey = "store_start_requested"
+	msgStoreStopRequested            messageKey = "store_stop_requested"
+	msgStoreUnchanged                messageKey = "store_unchanged"
+	msgStoreActionFailed             messageKey = "store_action_failed"
+	msgUsersListed                   messageKey = "users_listed"
+	msgUsersListFailed               messageKey = "users_list_failed"
+	msgUserCreated                   messageKey = "user_created"
+	msgUserCreateFailed              messageKey = "user_create_failed"
+	msgUserPasswordRotated           messageKey = "user_password_rotated"
+	msgUserPasswordRotateFailed      messageKey = "user_password_rotate_failed"
+	msgUserDeleted                   messageKey = "user_deleted"
+	msgUserDeleteFailed              messageKey = "user_delete_failed"
+	msgBackupsListed                 messageKey = "backups_listed"
+	msgBackupsListFailed             messageKey = "backups_list_failed"
+	msgBackupNotFound                messageKey = "backup_not_found"
+	msgRestoreConfirmationRequired   messageKey = "restore_confirmation_required"
+	msgRestoreConfirmationInvalid    messageKey = "restore_confirmation_invalid"
+	msgRestoreStarted                messageKey = "restore_started"
+	msgRestoreFailed                 messageKey = "restore_failed"
+	msgBatchesListed                 messageKey = "batches_listed"
+	msgBatchNotFound                 messageKey = "batch_not_found"
+	msgBatchCancelled                messageKey = "batch_cancelled"
+	msgInternalError                 messageKey = "internal_error"
+	msgWarmUpFailed                  messageKey = "warm_up_failed"
+	msgPromoteNotReplica             messageKey = "promote_not_replica"
+	msgPromoteConfirmationRequired   messageKey = "promote_confirmation_required"
+	msgPromoteConfirmationInvalid    messageKey = "promote_confirmation_invalid"
+	msgPromoteStarted                messageKey = "promote_started"
+	msgPromoteFailed                 messageKey = "promote_failed"
+	msgStorageFound                  messageKey = "storage_found"
+	msgStoragePatched                messageKey = "storage_patched"
+	msgStoragePatchFailed            messageKey = "storage_patch_failed"
+	msgStorageShrinkUnsupported      messageKey = "storage_shrink_unsupported"
+	msgPolicyViolation               messageKey = "policy_violation"
+	msgPolicyCheckFailed             messageKey = "policy_check_failed"
+	msgTenantNotFound                messageKey = "tenant_not_found"
+	msgDelayedActionsListed          messageKey = "delayed_actions_listed"
+	msgDelayedActionFetched          messageKey = "delayed_action_fetched"
+	msgDelayedActionCreated          messageKey = "delayed_action_created"
+	msgDelayedActionCancelled        messageKey = "delayed_action_cancelled"
+	msgDelayedActionNotFound         messageKey = "delayed_action_not_found"
+	msgDelayedActionSaveFailed       messageKey = "delayed_action_save_failed"
+	msgAuthorizedNetworksFound       messageKey = "authorized_networks_found"
+	msgAuthorizedNetworkAdded        messageKey = "authorized_network_added"
+	msgAuthorizedNetworkRemoved      messageKey = "authorized_network_removed"
+	msgAuthorizedNetworkExists       messageKey = "authorized_network_exists"
+	msgAuthorizedNetworkNotFound     messageKey = "authorized_network_not_found"
+	msgAuthorizedNetworksPatchFailed messageKey = "authorized_networks_patch_failed"
+	msgSchedulerPaused               messageKey = "scheduler_paused"
+	msgSchedulerResumed              messageKey = "scheduler_resumed"
+)
+
+const defaultLanguage = "en"
+
+var messageCatalog = map[string]map[messageKey]string{
+	"en": {
+		msgMethodNotAllowed:              "Method not allowed.",
+		msgServiceAccountNotFound:        "Service Account not found.",
+		msgInstanceNotFound:              "Instances not found.",
+		msgInstanceNotRunnable:           "Instance currently in %s state.",
+		msgStartFailed:                   "Failed to start instance.",
+		msgStartSucceeded:                "Instance successfully started. Check console for details.",
+		msgStopFailed:                    "Failed to stop instance.",
+		msgStopSucceeded:                 "Instance successfully stopped. Check console for details.",
+		msgCheckSucceeded:                "Successfully fetch instances detail.",
+		msgInvalidWaitState:              "Invalid value %q for wait_for_state.",
+		msgInvalidWaitTimeout:            "Invalid value for timeout. Must be a duration such as '120s'.",
+		msgWaitTimedOut:                  "Timed out waiting for instance to reach %s state, currently in %s state.",
+		msgRequestTimedOut:               "Request did not complete within %s.",
+		msgValidationFailed:              "Request validation failed. See errors for details.",
+		msgReadBodyFailed:                "Failed to read request body.",
+		msgInvalidJSON:                   "Invalid JSON format.",
+		msgInvalidActivationPolicy:       "Invalid value for ActivationPolicy. Must be 'ALWAYS' or 'NEVER'.",
+		msgBodyTooLarge:                  "Request body exceeds the %d bytes limit.",
+		msgSettingsPatchFailed:           "Failed to update instance settings.",
+		msgSettingsPatched:               "Instance settings successfully updated. Check console for details.",
+		msgHealthy:                       "Service is healthy.",
+		msgFlagsListed:                   "Successfully fetch feature flags.",
+		msgUnknownFlag:                   "Feature flag %q does not exist.",
+		msgFlagUpdated:                   "Feature flag successfully updated.",
+		msgSchedulesListed:               "Successfully fetch schedules.",
+		msgScheduleFetched:               "Successfully fetch schedule detail.",
+		msgScheduleCreated:               "Schedule successfully created.",
+		msgScheduleDeleted:               "Schedule moved to trash. Restore it before purge_at to undo.",
+		msgScheduleRestored:              "Schedule successfully restored.",
+		msgScheduleNotFound:              "Schedule %s not found.",
+		msgScheduleNotDeleted:            "Schedule %s is not deleted.",
+		msgScheduleSaveFailed:            "Failed to save schedules.",
+		msgReloaded:                      "Configuration reloaded.",
+		msgReloadInvalidConfig:           "Configuration is invalid, the running configuration was kept.",
+		msgReloadFailed:                  "Failed to reload configuration, the running configuration was kept.",
+		msgOperationTimedOut:             "Operation %s did not finish within %s, it keeps running in the background.",
+		msgListInstancesFailed:           "Failed to list instances of project %s.",
+		msgBulkFinished:                  "%d instances matched, %d changed, %d failed. Check results for details.",
+		msgUnauthorized:                  "Authentication required.",
+		msgInstancesListed:               "Successfully fetch instances.",
+		msgDryRun:                        "Dry run, nothing was changed. See data for the request that would have been sent.",
+		msgBulkDryRun:                    "%d instances matched, %d would be changed. Dry run, nothing was changed.",
+		msgAuditListed:                   "Successfully fetch audit entries.",
+		msgAuditDisabled:                 "Audit log is disabled.",
+		msgAuditQueryFailed:              "Failed to query the audit log.",
+		msgReplicaStopFailed:             "Failed to stop the replicas, the primary instance was left running.",
+		msgBackupStarted:                 "Backup successfully started. Check console for details.",
+		msgBackupFailed:                  "Failed to back up instance, it was left unchanged.",
+		msgInvalidIdempotencyKey:         "Invalid Idempotency-Key header.",
+		msgIdempotencyKeyReused:          "The %s was already used for a different request.",
+		msgMaintenanceWindowFound:        "Maintenance window retrieved.",
+		msgMaintenanceWindowPatched:      "Maintenance window successfully updated. Check console for details.",
+		msgMaintenanceWindowPatchFailed:  "Failed to update the maintenance window.",
+		msgSchedulePreview:               "Upcoming scheduled actions retrieved.",
+		msgRestartStarted:                "Instance restart requested. Check console for details.",
+		msgRestartFailed:                 "Failed to restart the instance.",
+		msgRestartBlocked:                "Instance cannot be restarted while a %s operation is in progress.",
+		msgSavingsEstimated:              "Successfully estimate savings.",
+		msgReady:                         "Service is ready.",
+		msgNotReady:                      "Service is not ready.",
+		msgScaled:                        "Instance tier changed from %s to %s.",
+		msgTierUnchanged:                 "Instance is already on tier %s.",
+		msgScaleFailed:                   "Failed to change the instance tier to %s.",
+		msgRateLimited:                   "Too many requests, retry in %ds.",
+		msgBatchFinished:                 "%d items, %d changed, %d failed. Check results for details.",
+		msgBatchDryRun:                   "%d items, %d would be changed. Dry run, nothing was changed.",
+		msgConnectionsActive:             "%s has %d open connections, at most %d are allowed. Retry later or add ?force=true.",
+		msgConnectionCheckFailed:         "Failed to read the open connections of %s.",
+		msgSchedulesSynced:               "Schedules synced: %d created, %d updated, %d deleted.",
+		msgSchedulesSyncDryRun:           "%d schedules would be created, %d updated and %d deleted. Dry run, nothing was changed.",
+		msgCloneStarted:                  "Clone %s requested. Check console for details.",
+		msgCloneFailed:                   "Failed to clone the instance.",
+		msgExportStarted:                 "Export to %s requested. Check console for details.",
+		msgExportFailed:                  "Failed to export the instance.",
+		msgImportStarted:                 "Import of %s requested. Check console for details.",
+		msgImportDone:                    "Import of %s finished.",
+		msgImportFailed:                  "Failed to import into the instance.",
+		msgImportBlocked:                 "Instance cannot import while a %s operation is in progress.",
+		msgImportNotFound:                "Import operation %s not found for this instance.",
+		msgImportProgress:                "Import is %s.",
+		msgForbidden:                     "%s is not allowed to %s here.",
+		msgStartBlocked:                  "Instance cannot be started while a %s operation is in progress.",
+		msgStopRefused:                   "Instance cannot be stopped while in %s state.",
+		msgOverridesListed:               "Successfully fetch overrides.",
+		msgOverrideFetched:               "Successfully fetch override detail.",
+		msgOverrideCreated:               "Override successfully created.",
+		msgOverrideDeleted:               "Override ended, the schedules run again.",
+		msgOverrideNotFound:              "Override %s not found.",
+		msgOverrideSaveFailed:            "Failed to save overrides.",
+		msgFailoverStarted:               "Failover of instance started.",
+		msgFailoverDone:                  "Instance failed over from %s to %s.",
+		msgFailoverFailed:                "Failed to fail over instance.",
+		msgFailoverNotHA:                 "Instance has no standby to fail over to, its availability type is %s.",
+		msgFailoverBlocked:               "Instance cannot fail over while a %s operation is in progress.",
+		msgScheduleCalendar:              "%d scheduled actions in the next %d days.",
+		msgDatabaseFlagsFound:            "Database flags retrieved.",
+		msgDatabaseFlagsPatched:          "Database flags successfully updated. Check console for details.",
+		msgDatabaseFlagsPatchedRestart:   "Database flags successfully updated, the instance restarts to apply them.",
+		msgDatabaseFlagsPatchFailed:      "Failed to update the database flags.",
+		msgDatabaseFlagsListFailed:       "Failed to list the database flags supported by %s.",
+		msgStoresListed:                  "Successfully fetch data stores.",
+		msgListStoresFailed:              "Failed to list the %s data stores of project %s.",
+		msgStoreKindUnknown:              "Unknown data store kind %s, use cloudsql, alloydb, redis or gce.",
+		msgStoreNotFound:                 "Data store not found.",
+		msgStoreStartRequested:           "Start of the data store requested.",
+		msgStoreStopRequested:            "Stop of the data store requested.",
+		msgStoreUnchanged:                "Data store is already in the requested state, nothing was changed.",
+		msgStoreActionFailed:             "Failed to %s the data store.",
+		msgUsersListed:                   "Successfully fetch database users.",
+		msgUsersListFailed:               "Failed to list the database users.",
+		msgUserCreated:                   "User %s created.",
+		msgUserCreateFailed:              "Failed to create user %s.",
+		msgUserPasswordRotated:           "Password of user %s changed.",
+		msgUserPasswordRotateFailed:      "Failed to change the password of user %s.",
+		msgUserDeleted:                   "User %s deleted.",
+		msgUserDeleteFailed:              "Failed to delete user %s.",
+		msgBackupsListed:                 "Successfully fetch backups.",
+		msgBackupsListFailed:             "Failed to list backups.",
+		msgBackupNotFound:                "Backup %d not found.",
+		msgRestoreConfirmationRequired:   "Restoring overwrites the data of %s. Send the request again with confirmation_token to confirm, nothing was changed.",
+		msgRestoreConfirmationInvalid:    "Confirmation token is invalid or expired, request a new one.",
+		msgRestoreStarted:                "Restore from backup started.",
+		msgRestoreFailed:                 "Failed to restore from backup.",
+		msgBatchesListed:                 "Successfully list active batches.",
+		msgBatchNotFound:                 "Batch %s is not active.",
+		msgBatchCancelled:                "%d pending items cancelled.",
+		msgInternalError:                 "The request failed unexpectedly. Report the request_id to the operators.",
+		msgWarmUpFailed:                  "Instance %s is running but its database does not accept connections yet.",
+		msgPromoteNotReplica:             "Instance %s is not a read replica.",
+		msgPromoteConfirmationRequired:   "Promoting %s stops its replication from %s for good. Send the request again with confirmation_token to confirm, nothing was changed.",
+		msgPromoteConfirmationInvalid:    "Confirmation token is invalid or expired, request a new one.",
+		msgPromoteStarted:                "Replica promotion started.",
+		msgPromoteFailed:                 "Failed to promote the replica.",
+		msgStorageFound:                  "Storage settings retrieved.",
+		msgStoragePatched:                "Storage settings successfully updated. Check console for details.",
+		msgStoragePatchFailed:            "Failed to update the storage settings.",
+		msgStorageShrinkUnsupported:      "The disk of %s is %d GB and can't be shrunk.",
+		msgPolicyViolation:               "%s on %s is blocked by policy %s.",
+		msgPolicyCheckFailed:             "Failed to check the policies for %s.",
+		msgTenantNotFound:                "Tenant %q not found.",
+		msgDelayedActionsListed:          "Successfully fetch delayed actions.",
+		msgDelayedActionFetched:          "Successfully fetch delayed action detail.",
+		msgDelayedActionCreated:          "%s of %s successfully scheduled.",
+		msgDelayedActionCancelled:        "Delayed action cancelled.",
+		msgDelayedActionNotFound:         "Delayed action %s not found.",
+		msgDelayedActionSaveFailed:       "Failed to save delayed actions.",
+		msgAuthorizedNetworksFound:       "Successfully fetch authorized networks.",
+		msgAuthorizedNetworkAdded:        "Authorized network added.",
+		msgAuthorizedNetworkRemoved:      "Authorized network removed.",
+		msgAuthorizedNetworkExists:       "%s is already an authorized network of %s.",
+		msgAuthorizedNetworkNotFound:     "%s is not an authorized network of %s.",
+		msgAuthorizedNetworksPatchFailed: "Failed to change the authorized networks.",
+		msgSchedulerPaused:               "Automated actions successfully paused.",
+		msgSchedulerResumed:              "Automated actions successfully resumed.",
+	},
+	"id": {
+		msgMethodNotAllowed:              "Metode tidak diizinkan.",
+		msgServiceAccountNotFound:        "Service Account tidak ditemukan.",
+		msgInstanceNotFound:              "Instance tidak ditemukan.",
+		msgInstanceNotRunnable:           "Instance saat ini dalam status %s.",
+		msgStartFailed:                   "Gagal menjalankan instance.",
+		msgStartSucceeded:                "Instance berhasil dijalankan. Cek console untuk detail.",
+		msgStopFailed:                    "Gagal menghentikan instance.",
+		msgStopSucceeded:                 "Instance berhasil dihentikan. Cek console untuk detail.",
+		msgCheckSucceeded:                "Berhasil mengambil detail instance.",
+		msgInvalidWaitState:              "Nilai %q untuk wait_for_state tidak valid.",
+		msgInvalidWaitTimeout:            "Nilai timeout tidak valid. Harus berupa durasi seperti '120s'.",
+		msgWaitTimedOut:                  "Batas waktu habis menunggu instance mencapai status %s, saat ini dalam status %s.",
+		msgRequestTimedOut:               "Request tidak selesai dalam %s.",
+		msgValidationFailed:              "Validasi request gagal. Lihat errors untuk detail.",
+		msgReadBodyFailed:                "Gagal membaca body request.",
+		msgInvalidJSON:                   "Format JSON tidak valid.",
+		msgInvalidActivationPolicy:       "Nilai ActivationPolicy tidak valid. Harus 'ALWAYS' atau 'NEVER'.",
+		msgBodyTooLarge:                  "Body request melebihi batas %d byte.",
+		msgSettingsPatchFailed:           "Gagal memperbarui settings instance.",
+		msgSettingsPatched:               "Settings instance berhasil diperbarui. Cek console untuk detail.",
+		msgHealthy:                       "Service dalam kondisi sehat.",
+		msgFlagsListed:                   "Berhasil mengambil feature flag.",
+		msgUnknownFlag:                   "Feature flag %q tidak ditemukan.",
+		msgFlagUpdated:                   "Feature flag berhasil diperbarui.",
+		msgSchedulesListed:               "Berhasil mengambil daftar jadwal.",
+		msgScheduleFetched:               "Berhasil mengambil detail jadwal.",
+		msgScheduleCreated:               "Jadwal berhasil dibuat.",
+		msgScheduleDeleted:               "Jadwal dipindahkan ke tempat sampah. Pulihkan sebelum purge_at untuk membatalkan.",
+		msgScheduleRestored:              "Jadwal berhasil dipulihkan.",
+		msgScheduleNotFound:              "Jadwal %s tidak ditemukan.",
+		msgScheduleNotDeleted:            "Jadwal %s tidak dalam tempat sampah.",
+		msgScheduleSaveFailed:            "Gagal menyimpan jadwal.",
+		msgReloaded:                      "Konfigurasi berhasil dimuat ulang.",
+		msgReloadInvalidConfig:           "Konfigurasi tidak valid, konfigurasi yang berjalan tetap digunakan.",
+		msgReloadFailed:                  "Gagal memuat ulang konfigurasi, konfigurasi yang berjalan tetap digunakan.",
+		msgOperationTimedOut:             "Operasi %s tidak selesai dalam %s, operasi tetap berjalan di latar belakang.",
+		msgListInstancesFailed:           "Gagal mengambil daftar instance pada project %s.",
+		msgBulkFinished:                  "%d instance cocok, %d diubah, %d gagal. Lihat results untuk detail.",
+		msgUnauthorized:                  "Autentikasi diperlukan.",
+		msgInstancesListed:               "Berhasil mengambil daftar instance.",
+		msgDryRun:                        "Dry run, tidak ada yang diubah. Lihat data untuk request yang akan dikirim.",
+		msgBulkDryRun:                    "%d instance cocok, %d akan diubah. Dry run, tidak ada yang diubah.",
+		msgAuditListed:                   "Berhasil mengambil catatan audit.",
+		msgAuditDisabled:                 "Audit log tidak aktif.",
+		msgAuditQueryFailed:              "Gagal mengambil audit log.",
+		msgReplicaStopFailed:             "Gagal menghentikan replica, instance primary tetap berjalan.",
+		msgBackupStarted:                 "Backup berhasil dimulai. Cek console untuk detail.",
+		msgBackupFailed:                  "Gagal melakukan backup instance, instance tidak diubah.",
+		msgInvalidIdempotencyKey:         "Header Idempotency-Key tidak valid.",
+		msgIdempotencyKeyReused:          "%s sudah digunakan untuk permintaan yang berbeda.",
+		msgMaintenanceWindowFound:        "Maintenance window berhasil diambil.",
+		msgMaintenanceWindowPatched:      "Maintenance window berhasil diperbarui. Cek console untuk detail.",
+		msgMaintenanceWindowPatchFailed:  "Gagal memperbarui maintenance window.",
+		msgSchedulePreview:               "Jadwal aksi berikutnya berhasil diambil.",
+		msgRestartStarted:                "Restart instance berhasil diminta. Cek console untuk detail.",
+		msgRestartFailed:                 "Gagal me-restart instance.",
+		msgRestartBlocked:                "Instance tidak dapat di-restart selama operasi %s sedang berjalan.",
+		msgSavingsEstimated:              "Berhasil menghitung estimasi penghematan.",
+		msgReady:                         "Layanan siap menerima permintaan.",
+		msgNotReady:                      "Layanan belum siap menerima permintaan.",
+		msgScaled:                        "Tier instance berhasil diubah dari %s ke %s.",
+		msgTierUnchanged:                 "Instance sudah menggunakan tier %s.",
+		msgScaleFailed:                   "Gagal mengubah tier instance ke %s.",
+		msgRateLimited:                   "Terlalu banyak permintaan, coba lagi dalam %d detik.",
+		msgBatchFinished:                 "%d item, %d diubah, %d gagal. Lihat results untuk detail.",
+		msgBatchDryRun:                   "%d item, %d akan diubah. Dry run, tidak ada yang diubah.",
+		msgConnectionsActive:             "%s memiliki %d koneksi terbuka, maksimal %d diizinkan. Coba lagi nanti atau tambahkan ?force=true.",
+		msgConnectionCheckFailed:         "Gagal membaca koneksi terbuka %s.",
+		msgSchedulesSynced:               "Jadwal disinkronkan: %d dibuat, %d diubah, %d dihapus.",
+		msgSchedulesSyncDryRun:           "%d jadwal akan dibuat, %d diubah dan %d dihapus. Dry run, tidak ada yang diubah.",
+		msgCloneStarted:                  "Clone %s diminta. Cek console untuk detail.",
+		msgCloneFailed:                   "Gagal meng-clone instance.",
+		msgExportStarted:                 "Export ke %s diminta. Cek console untuk detail.",
+		msgExportFailed:                  "Gagal meng-export instance.",
+		msgImportStarted:                 "Import %s diminta. Cek console untuk detail.",
+		msgImportDone:                    "Import %s selesai.",
+		msgImportFailed:                  "Gagal meng-import ke instance.",
+		msgImportBlocked:                 "Instance tidak dapat meng-import selama operasi %s sedang berjalan.",
+		msgImportNotFound:                "Operasi import %s tidak ditemukan untuk instance ini.",
+		msgImportProgress:                "Import dalam status %s.",
+		msgForbidden:                     "%s tidak diizinkan melakukan %s di sini.",
+		msgStartBlocked:                  "Instance tidak dapat dijalankan selama operasi %s sedang berjalan.",
+		msgStopRefused:                   "Instance tidak dapat dihentikan selama dalam status %s.",
+		msgOverridesListed:               "Berhasil mengambil daftar override.",
+		msgOverrideFetched:               "Berhasil mengambil detail override.",
+		msgOverrideCreated:               "Override berhasil dibuat.",
+		msgOverrideDeleted:               "Override diakhiri, jadwal kembali berjalan.",
+		msgOverrideNotFound:              "Override %s tidak ditemukan.",
+		msgOverrideSaveFailed:            "Gagal menyimpan override.",
+		msgFailoverStarted:               "Failover instance dimulai.",
+		msgFailoverDone:                  "Instance berhasil failover dari %s ke %s.",
+		msgFailoverFailed:                "Gagal melakukan failover instance.",
+		msgFailoverNotHA:                 "Instance tidak memiliki standby untuk failover, tipe ketersediaannya %s.",
+		msgFailoverBlocked:               "Instance tidak dapat failover selama operasi %s sedang berjalan.",
+		msgScheduleCalendar:              "%d aksi terjadwal dalam %d hari ke depan.",
+		msgDatabaseFlagsFound:            "Database flags berhasil diambil.",
+		msgDatabaseFlagsPatched:          "Database flags berhasil diperbarui. Cek console untuk detail.",
+		msgDatabaseFlagsPatchedRestart:   "Database flags berhasil diperbarui, instance di-restart untuk menerapkannya.",
+		msgDatabaseFlagsPatchFailed:      "Gagal memperbarui database flags.",
+		msgDatabaseFlagsListFailed:       "Gagal mengambil daftar database flags yang didukung %s.",
+		msgStoresListed:                  "Berhasil mengambil daftar data store.",
+		msgListStoresFailed:              "Gagal mengambil daftar data store %s pada project %s.",
+		msgStoreKindUnknown:              "Jenis data store %s tidak dikenal, gunakan cloudsql, alloydb, redis atau gce.",
+		msgStoreNotFound:                 "Data store tidak ditemukan.",
+		msgStoreStartRequested:           "Permintaan start data store berhasil dikirim.",
+		msgStoreStopRequested:            "Permintaan stop data store berhasil dikirim.",
+		msgStoreUnchanged:                "Data store sudah dalam kondisi yang diminta, tidak ada perubahan.",
+		msgStoreActionFailed:             "Gagal melakukan %s pada data store.",
+		msgUsersListed:                   "Berhasil mengambil daftar user database.",
+		msgUsersListFailed:               "Gagal mengambil daftar user database.",
+		msgUserCreated:                   "User %s berhasil dibuat.",
+		msgUserCreateFailed:              "Gagal membuat user %s.",
+		msgUserPasswordRotated:           "Password user %s berhasil diganti.",
+		msgUserPasswordRotateFailed:      "Gagal mengganti password user %s.",
+		msgUserDeleted:                   "User %s berhasil dihapus.",
+		msgUserDeleteFailed:              "Gagal menghapus user %s.",
+		msgBackupsListed:                 "Berhasil mengambil daftar backup.",
+		msgBackupsListFailed:             "Gagal mengambil daftar backup.",
+		msgBackupNotFound:                "Backup %d tidak ditemukan.",
+		msgRestoreConfirmationRequired:   "Restore akan menimpa data %s. Kirim ulang request dengan confirmation_token untuk konfirmasi, belum ada perubahan.",
+		msgRestoreConfirmationInvalid:    "Confirmation token tidak valid atau kedaluwarsa, minta token baru.",
+		msgRestoreStarted:                "Restore dari backup berhasil dimulai.",
+		msgRestoreFailed:                 "Gagal melakukan restore dari backup.",
+		msgBatchesListed:                 "Berhasil menampilkan batch yang aktif.",
+		msgBatchNotFound:                 "Batch %s tidak aktif.",
+		msgBatchCancelled:                "%d item yang menunggu dibatalkan.",
+		msgInternalError:                 "Request gagal secara tak terduga. Laporkan request_id ke operator.",
+		msgWarmUpFailed:                  "Instance %s sudah berjalan tetapi databasenya belum menerima koneksi.",
+		msgPromoteNotReplica:             "Instance %s bukan read replica.",
+		msgPromoteConfirmationRequired:   "Promote %s akan menghentikan replikasi dari %s secara permanen. Kirim ulang request dengan confirmation_token untuk konfirmasi, belum ada perubahan.",
+		msgPromoteConfirmationInvalid:    "Confirmation token tidak valid atau kedaluwarsa, minta token baru.",
+		msgPromoteStarted:                "Promote replica dimulai.",
+		msgPromoteFailed:                 "Gagal mempromosikan replica.",
+		msgStorageFound:                  "Pengaturan storage berhasil diambil.",
+		msgStoragePatched:                "Pengaturan storage berhasil diperbarui. Cek console untuk detail.",
+		msgStoragePatchFailed:            "Gagal memperbarui pengaturan storage.",
+		msgStorageShrinkUnsupported:      "Disk %s berukuran %d GB dan tidak bisa diperkecil.",
+		msgPolicyViolation:               "%s pada %s diblokir oleh policy %s.",
+		msgPolicyCheckFailed:             "Gagal memeriksa policy untuk %s.",
+		msgTenantNotFound:                "Tenant %q tidak ditemukan.",
+		msgDelayedActionsListed:          "Berhasil mengambil daftar aksi tertunda.",
+		msgDelayedActionFetched:          "Berhasil mengambil detail aksi tertunda.",
+		msgDelayedActionCreated:          "%s untuk %s berhasil dijadwalkan.",
+		msgDelayedActionCancelled:        "Aksi tertunda dibatalkan.",
+		msgDelayedActionNotFound:         "Aksi tertunda %s tidak ditemukan.",
+		msgDelayedActionSaveFailed:       "Gagal menyimpan aksi tertunda.",
+		msgAuthorizedNetworksFound:       "Berhasil mengambil daftar authorized network.",
+		msgAuthorizedNetworkAdded:        "Authorized network berhasil ditambahkan.",
+		msgAuthorizedNetworkRemoved:      "Authorized network berhasil dihapus.",
+		msgAuthorizedNetworkExists:       "%s sudah menjadi authorized network %s.",
+		msgAuthorizedNetworkNotFound:     "%s bukan authorized network %s.",
+		msgAuthorizedNetworksPatchFailed: "Gagal mengubah authorized network.",
+		msgSchedulerPaused:               "Aksi otomatis berhasil dijeda.",
+		msgSchedulerResumed:              "Aksi otomatis berhasil dilanjutkan.",
+	},
+}
+
+// translate returns the message for key in lang, falling back to English.
+func translate(lang string, key messageKey, args ...interface{}) string {
+	text, ok := messageCatalog[lang][key]
+	if !ok {
+		text, ok = messageCatalog[defaultLanguage][key]
+	}
+	if !ok {
+		text = string(key)
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// requestLanguage picks the supported language with the highest q-value from
+// the Accept-Language header.
+func requestLanguage(r *http.Request) string {
+	if r == nil {
+		return defaultLanguage
+	}
+
+	type candidate struct {
+		lang    string
+		quality float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if v, err := strconv.ParseFloat(q, 64); err == nil {
+					quality = v
+				}
+			}
+		}
+
+		base, _, _ := strings.Cut(tag, "-")
+		if _, ok := messageCatalog[base]; ok && quality > 0 {
+			candidates = append(candidates, candidate{lang: base, quality: quality})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return defaultLanguage
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].quality > candidates[j].quality
+	})
+	return candidates[0].lang
+}
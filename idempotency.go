@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultIdempotencyTTL is used when IDEMPOTENCY_TTL is not set.
+const defaultIdempotencyTTL = 24 * time.Hour
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+var (
+	// idempotencyTTL is how long the result of a request with an
+	// Idempotency-Key is replayed. Set from IDEMPOTENCY_TTL.
+	idempotencyTTL reloadable[time.Duration]
+
+	// idempotencyWindow derives a key from the target and the time window
+	// for requests without an Idempotency-Key, 0 leaves them alone. Set
+	// from IDEMPOTENCY_WINDOW.
+	idempotencyWindow reloadable[time.Duration]
+)
+
+// perRequestHeaders are set by the outer middleware for each request and
+// are not replayed.
+var perRequestHeaders = map[string]bool{
+	requestIDHeader:    true,
+	"Content-Encoding": true,
+	"Content-Length":   true,
+	"Vary":             true,
+}
+
+// idempotentResult is the answer to the first request with a key, replayed
+// to the later ones. done is closed once it is filled in.
+type idempotentResult struct {
+	done     chan struct{}
+	bodyHash [sha256.Size]byte
+	status   int
+	header   http.Header
+	body     []byte
+	expires  time.Time
+}
+
+// idempotencyStore remembers the results of recent mutating requests by key.
+// It lives in memory, so keys are only honoured by the replica that saw
+// them first.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	results map[string]*idempotentResult
+	now     func() time.Time
+}
+
+var idempotencyKeys = &idempotencyStore{results: make(map[string]*idempotentResult), now: time.Now}
+
+// claim returns the result stored under key, or registers a pending one the
+// caller must complete when the key is new. Expired results are dropped on
+// the way.
+func (s *idempotencyStore) claim(key string, bodyHash [sha256.Size]byte) (result *idempotentResult, first bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for k, stored := range s.results {
+		if isClosed(stored.done) && now.After(stored.expires) {
+			delete(s.results, k)
+		}
+	}
+
+	if stored, ok := s.results[key]; ok {
+		return stored, false
+	}
+	result = &idempotentResult{done: make(chan struct{}), bodyHash: bodyHash}
+	s.results[key] = result
+	return result, true
+}
+
+// complete stores the answer of the first request. 5xx answers are not
+// kept so a retry after a server error acts again, nor are requests that
+// panicked or never answered.
+func (s *idempotencyStore) complete(key string, result *idempotentResult, status int, header http.Header, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status == 0 || status >= http.StatusInternalServerError {
+		delete(s.results, key)
+	} else {
+		result.status, result.header, result.body = status, header, body
+		result.expires = s.now().Add(idempotencyTTL.load())
+	}
+	close(result.done)
+}
+
+func isClosed(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// idempotencyKey is the key of a mutating request, scoped to the caller and
+// the target so keys of different clients or endpoints never collide. Without
+// an Idempotency-Key header and with IDEMPOTENCY_WINDOW set, requests for the
+// same target within one window share a key.
+func idempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	switch {
+	case len(key) > maxIdempotencyKeyLength:
+		return "", fmt.Errorf("%s is longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+	case strings.IndexFunc(key, func(c rune) bool { return c < ' ' || c > '~' }) >= 0:
+		return "", fmt.Errorf("%s must only contain printable ASCII characters", idempotencyKeyHeader)
+	case key == "" && idempotencyWindow.load() > 0:
+		key = fmt.Sprintf("auto:%d", idempotencyKeys.now().UnixNano()/int64(idempotencyWindow.load()))
+	case key == "":
+		return "", nil
+	}
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s", requestPrincipal(r), r.Method, r.URL.RequestURI(), key), nil
+}
+
+// teeRecorder passes a response through while keeping a copy of it.
+type teeRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (t *teeRecorder) WriteHeader(statusCode int) {
+	if t.status == 0 {
+		t.status = statusCode
+	}
+	t.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (t *teeRecorder) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	t.body.Write(b)
+	return t.ResponseWriter.Write(b)
+}
+
+func (t *teeRecorder) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// withIdempotency answers a repeated mutating request with the result of the
+// first one instead of acting again, e.g. when Cloud Scheduler retries a
+// /stop. Requests reusing a key with another body are rejected, requests
+// arriving while the first is in flight wait for its result.
+func withIdempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := idempotencyKey(r)
+		if err != nil {
+			writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidIdempotencyKey, err)
+			return
+		}
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			body, _ = io.ReadAll(io.LimitReader(r.Body, maxBodyBytes.load()+1))
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		}
+		bodyHash := sha256.Sum256(body)
+
+		var result *idempotentResult
+		for result == nil || result.status == 0 {
+			// A result left without a status was dropped by complete after
+			// a server error, so the key is claimed again to act again.
+			var first bool
+			result, first = idempotencyKeys.claim(key, bodyHash)
+			if first {
+				recorder := &teeRecorder{ResponseWriter: w}
+				defer func() {
+					idempotencyKeys.complete(key, result, recorder.status, w.Header().Clone(), recorder.body.Bytes())
+				}()
+				next.ServeHTTP(recorder, r)
+				return
+			}
+
+			if result.bodyHash != bodyHash {
+				writeErrorResponse(w, r, http.StatusUnprocessableEntity, msgIdempotencyKeyReused, "request body differs from the earlier request with this key", idempotencyKeyHeader)
+				return
+			}
+
+			select {
+			case <-result.done:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		slog.InfoContext(r.Context(), "Replaying the result of an earlier request with the same idempotency key", "path", r.URL.Path)
+		for name, values := range result.header {
+			if !perRequestHeaders[name] {
+				w.Header()[name] = values
+			}
+		}
+		w.Header().Set(idempotentReplayedHeader, "true")
+		w.WriteHeader(result.status)
+		w.Write(result.body)
+	})
+}
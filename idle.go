@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	cpuUtilizationMetric = "cloudsql.googleapis.com/database/cpu/utilization"
+
+	// idleCheckInterval is how often running instances are checked for
+	// idleness. Cloud SQL reports its metrics every minute.
+	idleCheckInterval = time.Minute
+
+	defaultIdleStopAfter       = time.Hour
+	defaultIdleStopGracePeriod = 15 * time.Minute
+	defaultIdleStopMaxCPU      = 0.05
+	defaultIdleStopLabels      = "auto-stop=true"
+)
+
+// notifyResultIdleWarning announces the stop of an idle instance once the
+// grace period starts.
+const notifyResultIdleWarning = "idle_warning"
+
+// IdleStopConfig stops running instances carrying Labels once they have
+// been idle for After: at most MaxConnections open connections and a CPU
+// utilization (0-1) of at most MaxCPU. A warning is notified GracePeriod
+// before the stop. It only runs with the auto_stop feature flag.
+type IdleStopConfig struct {
+	After          time.Duration
+	GracePeriod    time.Duration
+	Labels         map[string]string
+	MaxConnections int64
+	MaxCPU         float64
+}
+
+func (c IdleStopConfig) validate() error {
+	var errs []error
+	if c.After <= 0 {
+		errs = append(errs, errors.New("IDLE_STOP_AFTER: must be positive"))
+	}
+	if c.GracePeriod >= c.After {
+		errs = append(errs, fmt.Errorf("IDLE_STOP_GRACE_PERIOD: %s must be shorter than IDLE_STOP_AFTER %s", c.GracePeriod, c.After))
+	}
+	if len(c.Labels) == 0 {
+		errs = append(errs, errors.New("IDLE_STOP_LABELS: at least one label is required"))
+	}
+	if c.MaxCPU > 1 {
+		errs = append(errs, fmt.Errorf("IDLE_STOP_MAX_CPU: %g is not a utilization between 0 and 1", c.MaxCPU))
+	}
+	return errors.Join(errs...)
+}
+
+// idleInstance is an instance found idle, since when and whether the stop
+// was announced.
+type idleInstance struct {
+	since  time.Time
+	warned bool
+}
+
+// idleStopper follows how long running instances have been idle and stops
+// them. Idleness is only tracked in memory, a restart starts the count
+// again, which delays stops but never hastens them.
+type idleStopper struct {
+	mu     sync.Mutex
+	config IdleStopConfig
+	now    func() time.Time
+	idle   map[string]*idleInstance
+}
+
+var idleStops = &idleStopper{now: time.Now, idle: make(map[string]*idleInstance)}
+
+// configure replaces the settings, the config is validated. Instances
+// already found idle keep their count.
+func (s *idleStopper) configure(config IdleStopConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+}
+
+// run checks the instances every idleCheckInterval until stop is closed.
+func (s *idleStopper) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.check(context.Background())
+		}
+	}
+}
+
+// check looks at every running instance of the managed projects carrying
+// the labels, and warns about or stops those idle long enough. Instances
+// that stopped, lost their labels or are in use again are forgotten.
+func (s *idleStopper) check(ctx context.Context) {
+	if !features.enabled(flagAutoStop) {
+		s.mu.Lock()
+		clear(s.idle)
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	config := s.config
+	s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, project := range managedProjects.load() {
+		instances, err := listProjectInstances(ctx, project)
+		if err != nil {
+			slog.Error("Failed to list instances for the idle check", "project", project, "error", err)
+			continue
+		}
+		for _, instance := range instances {
+			if instance.State != "RUNNABLE" || !matchLabels(instance, config.Labels) {
+				continue
+			}
+			key := instance.Project + "/" + instance.Name
+			seen[key] = true
+			s.checkInstance(ctx, config, instance.Project, instance.Name, key)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.idle {
+		if !seen[key] {
+			delete(s.idle, key)
+		}
+	}
+}
+
+func (s *idleStopper) checkInstance(ctx context.Context, config IdleStopConfig, project string, name string, key string) {
+	idle, err := isIdle(ctx, config, project, name)
+	if err != nil {
+		slog.Error("Failed to read the activity of the instance", "project", project, "instance", name, "error", err)
+		return
+	}
+
+	now := s.now()
+	s.mu.Lock()
+	state, tracked := s.idle[key]
+	switch {
+	case !idle:
+		delete(s.idle, key)
+	case !tracked:
+		state = &idleInstance{since: now}
+		s.idle[key] = state
+	}
+	s.mu.Unlock()
+
+	if !idle {
+		if tracked && state.warned {
+			slog.Info("Idle instance in use again, stop cancelled", "project", project, "instance", name)
+		}
+		return
+	}
+	if !tracked {
+		slog.Info("Instance is idle", "project", project, "instance", name, "stop_at", now.Add(config.After))
+		return
+	}
+	if override := overrides.skipping(project, name, scheduleActionStop, now); override != nil || automationHeld(now) {
+		return
+	}
+
+	stopAt := state.since.Add(config.After)
+	switch {
+	case !now.Before(stopAt):
+		s.mu.Lock()
+		delete(s.idle, key)
+		s.mu.Unlock()
+
+		_, err := runTriggeredAction(ctx, triggeredAction{
+			Action:      scheduleActionStop,
+			Project:     project,
+			Instance:    name,
+			Source:      actionSourceIdle,
+			TriggeredBy: "idle since " + state.since.UTC().Format(time.RFC3339),
+			Force:       true,
+		})
+		if !dryRun.load() {
+			recordAction(scheduleActionStop, actionSourceIdle, err)
+		}
+		if err != nil {
+			slog.Error("Failed to stop the idle instance", "project", project, "instance", name, "error", err)
+		}
+	case !state.warned && !now.Before(stopAt.Add(-config.GracePeriod)):
+		s.mu.Lock()
+		state.warned = true
+		s.mu.Unlock()
+
+		slog.Info("Idle instance stops after the grace period", "project", project, "instance", name, "stop_at", stopAt)
+		triggeredBy := "idle since " + state.since.UTC().Format(time.RFC3339) + ", stops at " + stopAt.UTC().Format(time.RFC3339) + " unless used"
+		event := newNotificationEvent(scheduleActionStop, actionSourceIdle, triggeredBy, project, name)
+		event.Result = notifyResultIdleWarning
+		notifications.send(event)
+	}
+}
+
+// isIdle reports whether the instance has at most MaxConnections open
+// connections and a CPU utilization of at most MaxCPU. An instance
+// reporting no metrics, e.g. one that just started, is not idle.
+func isIdle(ctx context.Context, config IdleStopConfig, project string, instance string) (bool, error) {
+	connections, reported, err := activeConnections(ctx, project, instance)
+	if err != nil || !reported || connections > config.MaxConnections {
+		return false, err
+	}
+	cpu, reported, err := latestMetric(ctx, project, instance, cpuUtilizationMetric)
+	if err != nil || !reported || cpu > config.MaxCPU {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// actionImport names imports in notifications and the audit log.
+const actionImport = "import"
+
+// ImportRequest is the body of POST /v1/instances/{instance}/import. SQL
+// dumps may create their own databases, Database is required for CSV files
+// and Table names the table they are loaded into.
+type ImportRequest struct {
+	URI      string   `json:"uri"`
+	Database string   `json:"database"`
+	Format   string   `json:"format"`
+	Table    string   `json:"table"`
+	Columns  []string `json:"columns"`
+}
+
+func (req *ImportRequest) validate() validationErrors {
+	var errs validationErrors
+	switch {
+	case req.URI == "":
+		errs = append(errs, fieldError{Field: "uri", Message: "is required"})
+	case !strings.HasPrefix(req.URI, "gs://") || strings.HasSuffix(req.URI, "/"):
+		errs = append(errs, fieldError{Field: "uri", Message: "must be a Cloud Storage file such as 'gs://bucket/exports/dump.sql.gz'"})
+	}
+	switch req.Format {
+	case "", exportFormatSQL:
+		if req.Table != "" || len(req.Columns) > 0 {
+			errs = append(errs, fieldError{Field: "table", Message: "only applies to CSV imports"})
+		}
+	case exportFormatCSV:
+		if req.Database == "" {
+			errs = append(errs, fieldError{Field: "database", Message: "is required for CSV imports"})
+		}
+		if req.Table == "" {
+			errs = append(errs, fieldError{Field: "table", Message: "is required for CSV imports"})
+		}
+	default:
+		errs = append(errs, fieldError{Field: "format", Message: "must be 'sql' or 'csv'"})
+	}
+	return errs
+}
+
+func (req *ImportRequest) importContext() *sqladmin.ImportContext {
+	format := req.Format
+	if format == "" {
+		format = exportFormatSQL
+	}
+	imported := &sqladmin.ImportContext{Uri: req.URI, Database: req.Database, FileType: strings.ToUpper(format)}
+	if format == exportFormatCSV {
+		imported.CsvImportOptions = &sqladmin.ImportContextCsvImportOptions{Table: req.Table, Columns: req.Columns}
+	}
+	return imported
+}
+
+// Statuses of an import besides PENDING and RUNNING.
+const (
+	importStatusDone   = "DONE"
+	importStatusFailed = "FAILED"
+)
+
+// ImportProgress is where an import stands. Errors are the errors Cloud SQL
+// reported for a FAILED import, e.g. a missing file or a failing statement.
+type ImportProgress struct {
+	Operation      string                     `json:"operation"`
+	Status         string                     `json:"status"`
+	URI            string                     `json:"uri"`
+	Database       string                     `json:"database,omitempty"`
+	StartedAt      interface{}                `json:"started_at,omitempty"`
+	EndedAt        interface{}                `json:"ended_at,omitempty"`
+	ElapsedSeconds int64                      `json:"elapsed_seconds"`
+	Errors         []*sqladmin.OperationError `json:"errors,omitempty"`
+}
+
+func newImportProgress(operation *sqladmin.Operation, now time.Time) ImportProgress {
+	progress := ImportProgress{Operation: operation.Name, Status: operation.Status}
+	if operation.ImportContext != nil {
+		progress.URI, progress.Database = operation.ImportContext.Uri, operation.ImportContext.Database
+	}
+	if operation.Status == importStatusDone && operation.Error != nil && len(operation.Error.Errors) > 0 {
+		progress.Status, progress.Errors = importStatusFailed, operation.Error.Errors
+	}
+
+	started, err := time.Parse(time.RFC3339Nano, operation.StartTime)
+	if err != nil {
+		return progress
+	}
+	progress.StartedAt = formatTimestamp(started)
+	end := now
+	if ended, err := time.Parse(time.RFC3339Nano, operation.EndTime); err == nil {
+		progress.EndedAt, end = formatTimestamp(ended), ended
+	}
+	progress.ElapsedSeconds = int64(end.Sub(started).Seconds())
+	return progress
+}
+
+// ImportResult is the answer of an import: the operation, its progress and,
+// after waiting, the state of the instance.
+type ImportResult struct {
+	Operation *sqladmin.Operation `json:"operation"`
+	Progress  ImportProgress      `json:"progress"`
+	Instance  *SQLInstancesData   `json:"instance,omitempty"`
+}
+
+// importHandler loads a SQL dump or CSV file from Cloud Storage into an
+// instance on POST, and reports the progress of an import on GET with
+// ?operation=. Imports run on running instances only and are refused while
+// another operation is in progress, Cloud SQL would queue them otherwise.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		importProgressHandler(w, r)
+		return
+	case http.MethodPost:
+	default:
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	var payload ImportRequest
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if errs := payload.validate(); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	project, instance := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	status, err := checkStatusInstances(r.Context(), project, instance)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	if status.State != "RUNNABLE" {
+		writeErrorResponse(w, r, http.StatusConflict, msgInstanceNotRunnable, "", status.State)
+		return
+	}
+	running, err := runningOperation(r.Context(), sqlService, project, instance)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgImportFailed, err)
+		return
+	}
+	if running != nil {
+		writeErrorResponse(w, r, http.StatusConflict, msgImportBlocked, "operation "+running.Name+" is "+running.Status, running.OperationType)
+		return
+	}
+
+	body := &sqladmin.InstancesImportRequest{ImportContext: payload.importContext()}
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunCall(http.MethodPost, sqlAdminInstancePath(project, instance)+"/import", body))
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	operation, err := sqlService.Instances.Import(project, instance, body).Context(ctx).Do()
+	event := newNotificationEvent(actionImport, actionSourceAPI, requestPrincipal(r), project, instance)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgImportFailed, err)
+		return
+	}
+	operations.track(event, operation)
+	auditOperation(r, operation.Name)
+	auditURI(r, payload.URI)
+	annotateRequest(r, slog.String("operation", operation.Name), slog.String("uri", payload.URI))
+
+	if operation.ImportContext == nil {
+		operation.ImportContext = body.ImportContext
+	}
+	if !wait {
+		writeSuccessResponse(w, r, http.StatusOK, msgImportStarted, ImportResult{Operation: operation, Progress: newImportProgress(operation, time.Now())}, payload.URI)
+		return
+	}
+
+	operation, err = waitForOperation(r.Context(), project, operation, timeout)
+	if operation.Status == "DONE" {
+		operations.finished(operation, err)
+	}
+	if errors.Is(err, errOperationWaitTimeout) {
+		writeErrorResponse(w, r, http.StatusRequestTimeout, msgOperationTimedOut, err, operation.Name, timeout)
+		return
+	}
+	if err != nil && operation.Error != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgImportFailed, operation.Error)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgImportFailed, err)
+		return
+	}
+
+	result := ImportResult{Operation: operation, Progress: newImportProgress(operation, time.Now())}
+	result.Instance, _, err = inventoryCache.load().get(r.Context(), project, instance, true)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgImportDone, result, payload.URI)
+}
+
+// importProgressHandler reports the progress of the import ?operation= of
+// the instance, for imports that outlast a wait.
+func importProgressHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("operation")
+	if name == "" {
+		writeDecodeError(w, r, validationErrors{{Field: "operation", Message: "is required"}})
+		return
+	}
+
+	project, instance := targetProject(r), targetInstance(r)
+	controller, err := sqlController(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	operation, err := controller.Operation(r.Context(), project, name)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound || err == nil && (operation.OperationType != "IMPORT" || operation.TargetId != instance) {
+		writeErrorResponse(w, r, http.StatusNotFound, msgImportNotFound, "", name)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgImportFailed, err)
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgImportProgress, newImportProgress(operation, time.Now()), operation.Status)
+}
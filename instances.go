@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// InstanceSummary is one entry of GET /v1/instances.
+type InstanceSummary struct {
+	Project          string            `json:"project"`
+	Name             string            `json:"name"`
+	State            string            `json:"state"`
+	DatabaseVersion  string            `json:"database_version"`
+	Region           string            `json:"region"`
+	Tier             string            `json:"tier"`
+	ActivationPolicy string            `json:"activation_policy"`
+	Labels           map[string]string `json:"labels,omitempty"`
+}
+
+// InstanceListData is the payload of GET /v1/instances.
+type InstanceListData struct {
+	Instances     []InstanceSummary `json:"instances"`
+	TotalSize     int               `json:"total_size"`
+	NextPageToken string            `json:"next_page_token,omitempty"`
+}
+
+// instanceFilter narrows GET /v1/instances, empty fields match anything.
+type instanceFilter struct {
+	State  string
+	Region string
+	Labels map[string]string
+}
+
+func (f instanceFilter) match(instance *sqladmin.DatabaseInstance) bool {
+	if f.State != "" && instance.State != f.State {
+		return false
+	}
+	if f.Region != "" && instance.Region != f.Region {
+		return false
+	}
+	return matchLabels(instance, f.Labels)
+}
+
+// listInstancesHandler lists the instances of one or more projects, with
+// optional state, region and label filters, a page at a time. Instances the
+// caller may not check are left out.
+func listInstancesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := instanceFilter{State: query.Get("state"), Region: query.Get("region"), Labels: map[string]string{}}
+
+	var errs validationErrors
+	if filter.State != "" && !instanceStates[filter.State] {
+		errs = append(errs, fieldError{Field: "state", Message: "is not a Cloud SQL instance state"})
+	}
+	for _, selector := range query["label"] {
+		for _, pair := range strings.Split(selector, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || key == "" {
+				errs = append(errs, fieldError{Field: "label", Message: "must be key=value, got " + strconv.Quote(pair)})
+				continue
+			}
+			filter.Labels[key] = value
+		}
+	}
+
+	pageSize := defaultPageSize
+	if value := query.Get("page_size"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			errs = append(errs, fieldError{Field: "page_size", Message: "must be a positive integer"})
+		}
+		pageSize = min(n, maxPageSize)
+	}
+	offset, err := decodePageToken(query.Get("page_token"))
+	if err != nil {
+		errs = append(errs, fieldError{Field: "page_token", Message: "is invalid"})
+	}
+	if len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	projects := splitList(query.Get("projects"))
+	if len(projects) == 0 {
+		projects = defaultProjects(r)
+	}
+
+	var matched []InstanceSummary
+	for _, project := range projects {
+		instances, err := listProjectInstances(r.Context(), project)
+		if err != nil {
+			writeErrorResponse(w, r, http.StatusInternalServerError, msgListInstancesFailed, err, project)
+			return
+		}
+		for _, instance := range instances {
+			if filter.match(instance) && accessAllowed(r, auditActionCheck, project, instance.Name) {
+				matched = append(matched, newInstanceSummary(instance))
+			}
+		}
+	}
+
+	data := InstanceListData{Instances: []InstanceSummary{}, TotalSize: len(matched)}
+	if offset < len(matched) {
+		end := min(offset+pageSize, len(matched))
+		data.Instances = matched[offset:end]
+		if end < len(matched) {
+			data.NextPageToken = encodePageToken(end)
+		}
+	}
+
+	writeSuccessResponse(w, r, http.StatusOK, msgInstancesListed, data)
+}
+
+func newInstanceSummary(instance *sqladmin.DatabaseInstance) InstanceSummary {
+	summary := InstanceSummary{
+		Project:         instance.Project,
+		Name:            instance.Name,
+		State:           instance.State,
+		DatabaseVersion: instance.DatabaseVersion,
+		Region:          instance.Region,
+	}
+	if instance.Settings != nil {
+		summary.Tier = instance.Settings.Tier
+		summary.ActivationPolicy = instance.Settings.ActivationPolicy
+		summary.Labels = instance.Settings.UserLabels
+	}
+	return summary
+}
+
+// Page tokens are opaque to clients so the pagination scheme can change.
+func encodePageToken(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodePageToken(token string) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.Atoi(string(raw))
+	if err != nil || offset < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return offset, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultBulkConcurrency is the default of BULK_CONCURRENCY.
+const defaultBulkConcurrency = 5
+
+// bulkOutcomeCancelled is the outcome of a bulk item whose batch was
+// cancelled before it ran.
+const bulkOutcomeCancelled = "cancelled"
+
+var errBatchCancelled = errors.New("batch was cancelled before the item ran")
+
+var (
+	bulkQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "scheduler_db_bulk_queue_depth",
+		Help: "Items of batch and by-label requests waiting for a worker.",
+	})
+	bulkJobsRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "scheduler_db_bulk_jobs_running",
+		Help: "Items of batch and by-label requests being applied.",
+	})
+)
+
+// bulkItem is the action of a bulk request on one instance.
+type bulkItem struct {
+	Project  string
+	Instance string
+	Run      func(ctx context.Context) BulkResult
+}
+
+// bulkJob is one item of a batch, waiting in the queue or running.
+type bulkJob struct {
+	batch *bulkBatch
+	index int
+	item  bulkItem
+}
+
+// bulkBatch is the queued items of one batch or by-label request.
+type bulkBatch struct {
+	ID        string
+	Action    string
+	Principal string
+	Created   time.Time
+
+	ctx     context.Context
+	total   int
+	pending int
+	running int
+	results []BulkResult
+	done    chan struct{}
+}
+
+// BatchStatus is an active batch in GET /v1/batches.
+type BatchStatus struct {
+	ID        string      `json:"id"`
+	Action    string      `json:"action"`
+	Principal string      `json:"principal"`
+	CreatedAt interface{} `json:"created_at"`
+	Total     int         `json:"total"`
+	Pending   int         `json:"pending"`
+	Running   int         `json:"running"`
+	Done      int         `json:"done"`
+	// Cancelled is the number of pending items a cancellation dropped.
+	Cancelled int `json:"cancelled,omitempty"`
+}
+
+// BatchesData is the answer of GET /v1/batches.
+type BatchesData struct {
+	Batches []BatchStatus `json:"batches"`
+}
+
+// jobQueue runs the items of bulk requests, all requests together, on at
+// most workers goroutines, in the order they were submitted.
+type jobQueue struct {
+	mu      sync.Mutex
+	workers int
+	running int
+	pending []*bulkJob
+	batches map[string]*bulkBatch
+}
+
+var bulkQueue = newJobQueue(defaultBulkConcurrency)
+
+func newJobQueue(workers int) *jobQueue {
+	return &jobQueue{workers: workers, batches: make(map[string]*bulkBatch)}
+}
+
+// configure changes the number of workers. Running items are not
+// interrupted, more start at once when it grows.
+func (q *jobQueue) configure(workers int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.workers = workers
+	q.dispatch()
+}
+
+// run queues the items of a batch and waits until each has run or was
+// cancelled, returning their results in order. When ctx is done, the
+// items still pending are cancelled.
+func (q *jobQueue) run(ctx context.Context, action string, principal string, items []bulkItem) (string, []BulkResult) {
+	batch := &bulkBatch{
+		ID:        randomID(8),
+		Action:    action,
+		Principal: principal,
+		Created:   time.Now(),
+		ctx:       ctx,
+		total:     len(items),
+		pending:   len(items),
+		results:   make([]BulkResult, len(items)),
+		done:      make(chan struct{}),
+	}
+	if len(items) == 0 {
+		return batch.ID, batch.results
+	}
+
+	q.mu.Lock()
+	q.batches[batch.ID] = batch
+	for i, item := range items {
+		q.pending = append(q.pending, &bulkJob{batch: batch, index: i, item: item})
+	}
+	q.dispatch()
+	q.mu.Unlock()
+
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		q.cancel(batch.ID)
+		<-batch.done
+	}
+	return batch.ID, batch.results
+}
+
+// dispatch starts pending items while workers are free. q.mu must be held.
+func (q *jobQueue) dispatch() {
+	for q.running < q.workers && len(q.pending) > 0 {
+		job := q.pending[0]
+		q.pending = q.pending[1:]
+		q.running++
+		job.batch.pending--
+		job.batch.running++
+		go q.work(job)
+	}
+	q.updateMetrics()
+}
+
+func (q *jobQueue) work(job *bulkJob) {
+	result := job.item.Run(job.batch.ctx)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.running--
+	job.batch.running--
+	job.batch.results[job.index] = result
+	q.settle(job.batch)
+	q.dispatch()
+}
+
+// settle closes a batch once none of its items are pending or running.
+// q.mu must be held.
+func (q *jobQueue) settle(batch *bulkBatch) {
+	if batch.pending == 0 && batch.running == 0 {
+		delete(q.batches, batch.ID)
+		close(batch.done)
+	}
+}
+
+// cancel drops the pending items of a batch, reported as cancelled. Items
+// already running finish. It returns the batch as it was left, false when
+// no such batch is active.
+func (q *jobQueue) cancel(id string) (BatchStatus, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	batch, ok := q.batches[id]
+	if !ok {
+		return BatchStatus{}, false
+	}
+	var cancelled []*bulkJob
+	q.pending = slices.DeleteFunc(q.pending, func(job *bulkJob) bool {
+		if job.batch == batch {
+			cancelled = append(cancelled, job)
+			return true
+		}
+		return false
+	})
+	for _, job := range cancelled {
+		batch.results[job.index] = BulkResult{Project: job.item.Project, Instance: job.item.Instance, Outcome: bulkOutcomeCancelled, Reason: errBatchCancelled.Error()}
+	}
+	batch.pending -= len(cancelled)
+	status := batch.status()
+	status.Cancelled = len(cancelled)
+	q.settle(batch)
+	q.updateMetrics()
+	return status, true
+}
+
+// list returns the active batches of principal, oldest first.
+func (q *jobQueue) list(principal string) []BatchStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var batches []*bulkBatch
+	for _, batch := range q.batches {
+		if batch.Principal == principal {
+			batches = append(batches, batch)
+		}
+	}
+	slices.SortFunc(batches, func(a, b *bulkBatch) int { return a.Created.Compare(b.Created) })
+	statuses := make([]BatchStatus, 0, len(batches))
+	for _, batch := range batches {
+		statuses = append(statuses, batch.status())
+	}
+	return statuses
+}
+
+// owner returns the principal of an active batch.
+func (q *jobQueue) owner(id string) (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	batch, ok := q.batches[id]
+	if !ok {
+		return "", false
+	}
+	return batch.Principal, true
+}
+
+func (q *jobQueue) updateMetrics() {
+	bulkQueueDepth.Set(float64(len(q.pending)))
+	bulkJobsRunning.Set(float64(q.running))
+}
+
+func (b *bulkBatch) status() BatchStatus {
+	return BatchStatus{
+		ID:        b.ID,
+		Action:    b.Action,
+		Principal: b.Principal,
+		CreatedAt: formatTimestamp(b.Created),
+		Total:     b.total,
+		Pending:   b.pending,
+		Running:   b.running,
+		Done:      b.total - b.pending - b.running,
+	}
+}
+
+// batchesHandler lists the batch and by-label requests of the caller that
+// are still running.
+func batchesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgBatchesListed, BatchesData{Batches: bulkQueue.list(requestPrincipal(r))})
+}
+
+// batchCancelHandler cancels the pending items of a batch of the caller on
+// DELETE. The request that submitted it then answers with them cancelled.
+func batchCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	id := r.PathValue("id")
+	if owner, ok := bulkQueue.owner(id); !ok || owner != requestPrincipal(r) {
+		writeErrorResponse(w, r, http.StatusNotFound, msgBatchNotFound, "", id)
+		return
+	}
+	status, ok := bulkQueue.cancel(id)
+	if !ok {
+		writeErrorResponse(w, r, http.StatusNotFound, msgBatchNotFound, "", id)
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgBatchCancelled, status, status.Cancelled)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Paths of the credentials Kubernetes mounts into every pod.
+const (
+	kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubeTokenFile         = kubeServiceAccountDir + "/token"
+	kubeCAFile            = kubeServiceAccountDir + "/ca.crt"
+)
+
+// errWatchExpired is returned by watch when the resource version is too
+// old, the caller has to list again.
+var errWatchExpired = errors.New("watch expired")
+
+// kubeClient is a minimal client of the Kubernetes REST API for one custom
+// resource, enough for the operator mode without pulling in client-go.
+type kubeClient struct {
+	base      string
+	tokenFile string
+	http      *http.Client
+	resource  string
+}
+
+// newKubeClient talks to apiURL, e.g. the address of `kubectl proxy`, or to
+// the API server of the cluster the pod runs in when empty.
+func newKubeClient(apiURL string, resource string) (*kubeClient, error) {
+	client := &kubeClient{base: strings.TrimSuffix(apiURL, "/"), resource: resource, http: &http.Client{}}
+	if client.base != "" {
+		return client, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster, set KUBERNETES_API_URL")
+	}
+	ca, err := os.ReadFile(kubeCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", kubeCAFile)
+	}
+
+	client.base = "https://" + net.JoinHostPort(host, port)
+	client.tokenFile = kubeTokenFile
+	client.http.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}
+	return client, nil
+}
+
+// kubeList is the subset of a list response the client reads.
+type kubeList[T any] struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []T `json:"items"`
+}
+
+// kubeEvent is one line of a watch stream.
+type kubeEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// kubeStatus is the error body returned by the API server.
+type kubeStatus struct {
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Code    int    `json:"code"`
+}
+
+// kubeError is an error answer of the API server, Code being its HTTP
+// status.
+type kubeError struct {
+	Method  string
+	Path    string
+	Status  string
+	Code    int
+	Message string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("%s %s: %s: %s", e.Method, e.Path, e.Status, e.Message)
+}
+
+// path is the collection of the resource, cluster wide when namespace is "".
+func (c *kubeClient) path(namespace string, name string, subresource string) string {
+	path := "/apis/" + cloudSQLScheduleGroup + "/" + cloudSQLScheduleVersion
+	if namespace != "" {
+		path += "/namespaces/" + url.PathEscape(namespace)
+	}
+	path += "/" + c.resource
+	if name != "" {
+		path += "/" + url.PathEscape(name)
+	}
+	if subresource != "" {
+		path += "/" + subresource
+	}
+	return path
+}
+
+func (c *kubeClient) do(ctx context.Context, method string, path string, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.tokenFile != "" {
+		// Re-read on every call, projected tokens are rotated.
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var status kubeStatus
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(raw, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(raw))
+		}
+		if resp.StatusCode == http.StatusGone {
+			return nil, errWatchExpired
+		}
+		return nil, &kubeError{Method: method, Path: path, Status: resp.Status, Code: resp.StatusCode, Message: status.Message}
+	}
+	return resp, nil
+}
+
+// listCloudSQLSchedules returns the schedules of namespace, all namespaces
+// when "", and the resource version to watch from.
+func (c *kubeClient) listCloudSQLSchedules(ctx context.Context, namespace string) ([]CloudSQLSchedule, string, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.path(namespace, "", ""), "", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var list kubeList[CloudSQLSchedule]
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+	return list.Items, list.Metadata.ResourceVersion, nil
+}
+
+// watchCloudSQLSchedules calls handle for every change after
+// resourceVersion until timeout, when the API server ends the watch.
+func (c *kubeClient) watchCloudSQLSchedules(ctx context.Context, namespace string, resourceVersion string, timeout time.Duration, handle func(eventType string, schedule CloudSQLSchedule)) error {
+	query := url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {resourceVersion},
+		"timeoutSeconds":      {fmt.Sprint(int(timeout.Seconds()))},
+		"allowWatchBookmarks": {"true"},
+	}
+	resp, err := c.do(ctx, http.MethodGet, c.path(namespace, "", "")+"?"+query.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event kubeEvent
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		if event.Type == "ERROR" {
+			var status kubeStatus
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return errWatchExpired
+			}
+			return fmt.Errorf("watch: %s", status.Message)
+		}
+
+		var schedule CloudSQLSchedule
+		if err := json.Unmarshal(event.Object, &schedule); err != nil {
+			return err
+		}
+		if event.Type != "BOOKMARK" {
+			handle(event.Type, schedule)
+		}
+	}
+}
+
+// updateCloudSQLScheduleStatus replaces the status of a schedule through
+// the status subresource. The resource version makes it fail with a
+// conflict when the schedule changed since it was read.
+func (c *kubeClient) updateCloudSQLScheduleStatus(ctx context.Context, schedule CloudSQLSchedule) error {
+	schedule.APIVersion = cloudSQLScheduleGroup + "/" + cloudSQLScheduleVersion
+	schedule.Kind = "CloudSQLSchedule"
+	body, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPut, c.path(schedule.Metadata.Namespace, schedule.Metadata.Name, "status"), "application/json", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
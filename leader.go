@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Leader election backends, selected by LEADER_ELECTION.
+const (
+	leaderElectionNone       = "none"
+	leaderElectionKubernetes = "kubernetes"
+	leaderElectionFirestore  = "firestore"
+)
+
+const (
+	defaultLeaderLease    = "scheduler-db"
+	defaultLeaderDuration = 15 * time.Second
+
+	// kubeNamespaceFile holds the namespace of the pod.
+	kubeNamespaceFile = kubeServiceAccountDir + "/namespace"
+
+	// kubeMicroTime is the layout of the times of a Lease.
+	kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var leaderGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "scheduler_db_leader",
+	Help: "1 while this replica holds the leadership and runs automated actions, 0 otherwise.",
+})
+
+// errLeaseConflict is returned by a leaseLock when the lease changed since
+// it was read, another replica got there first.
+var errLeaseConflict = errors.New("the lease changed concurrently")
+
+// leaseRecord is the leadership lease: who holds it and when they last
+// renewed it. version is what the backend checks to refuse concurrent
+// updates.
+type leaseRecord struct {
+	Holder   string
+	Renewed  time.Time
+	Duration time.Duration
+	version  string
+}
+
+// leaseLock stores the lease. get returns nil when there is none yet.
+type leaseLock interface {
+	get(ctx context.Context) (*leaseRecord, error)
+	create(ctx context.Context, record leaseRecord) error
+	update(ctx context.Context, record leaseRecord) error
+}
+
+// LeaderConfig enables leader election between the replicas of the
+// service. Lease names the Kubernetes Lease or the Firestore document,
+// Namespace is the namespace of the Lease. An empty Identity stands for the
+// host name with a random suffix.
+type LeaderConfig struct {
+	Backend   string
+	Lease     string
+	Namespace string
+	Identity  string
+	Duration  time.Duration
+}
+
+func (c LeaderConfig) enabled() bool {
+	return c.Backend != leaderElectionNone
+}
+
+func (c LeaderConfig) validate() error {
+	switch c.Backend {
+	case leaderElectionNone, leaderElectionKubernetes, leaderElectionFirestore:
+	default:
+		return fmt.Errorf("LEADER_ELECTION: %q is not one of none, kubernetes, firestore", c.Backend)
+	}
+	if c.Duration < 3*time.Second {
+		return fmt.Errorf("LEADER_ELECTION_DURATION: %s must be at least 3s", c.Duration)
+	}
+	return nil
+}
+
+// open builds the lock of the configured backend. The Kubernetes one talks
+// to apiURL like the operator, the Firestore one keeps its document in the
+// collection of the state backend.
+func (c LeaderConfig) open(ctx context.Context, apiURL string, state StateConfig) (leaseLock, error) {
+	if c.Backend == leaderElectionFirestore {
+		service, err := firestore.NewService(ctx, credentials.load().options()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Firestore client: %w", err)
+		}
+		name := fmt.Sprintf("projects/%s/databases/(default)/documents/%s/%s", state.Project, state.Collection, c.Lease)
+		return &firestoreLease{service: service, name: name}, nil
+	}
+
+	client, err := newKubeClient(apiURL, "leases")
+	if err != nil {
+		return nil, err
+	}
+	namespace := c.Namespace
+	if namespace == "" {
+		namespace = "default"
+		if raw, err := os.ReadFile(kubeNamespaceFile); err == nil {
+			namespace = strings.TrimSpace(string(raw))
+		}
+	}
+	return &kubeLease{client: client, namespace: namespace, name: c.Lease}, nil
+}
+
+// kubeLease is a coordination.k8s.io/v1 Lease, as used by the controllers
+// of Kubernetes itself.
+type kubeLease struct {
+	client    *kubeClient
+	namespace string
+	name      string
+}
+
+// kubeLeaseObject is the subset of a Lease the lock reads and writes.
+type kubeLeaseObject struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace,omitempty"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+	} `json:"spec"`
+}
+
+func (l *kubeLease) path(name string) string {
+	path := "/apis/coordination.k8s.io/v1/namespaces/" + l.namespace + "/leases"
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+func (l *kubeLease) get(ctx context.Context) (*leaseRecord, error) {
+	resp, err := l.client.do(ctx, http.MethodGet, l.path(l.name), "", nil)
+	var kubeErr *kubeError
+	if errors.As(err, &kubeErr) && kubeErr.Code == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var lease kubeLeaseObject
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return nil, err
+	}
+	record := &leaseRecord{
+		Holder:   lease.Spec.HolderIdentity,
+		Duration: time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second,
+		version:  lease.Metadata.ResourceVersion,
+	}
+	if lease.Spec.RenewTime != "" {
+		record.Renewed, _ = time.Parse(time.RFC3339Nano, lease.Spec.RenewTime)
+	}
+	return record, nil
+}
+
+func (l *kubeLease) object(record leaseRecord) kubeLeaseObject {
+	lease := kubeLeaseObject{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+	lease.Metadata.Name, lease.Metadata.Namespace, lease.Metadata.ResourceVersion = l.name, l.namespace, record.version
+	lease.Spec.HolderIdentity = record.Holder
+	lease.Spec.LeaseDurationSeconds = int(record.Duration / time.Second)
+	if !record.Renewed.IsZero() {
+		lease.Spec.RenewTime = record.Renewed.UTC().Format(kubeMicroTime)
+	}
+	return lease
+}
+
+func (l *kubeLease) create(ctx context.Context, record leaseRecord) error {
+	record.version = ""
+	return l.write(ctx, http.MethodPost, l.path(""), record)
+}
+
+func (l *kubeLease) update(ctx context.Context, record leaseRecord) error {
+	return l.write(ctx, http.MethodPut, l.path(l.name), record)
+}
+
+func (l *kubeLease) write(ctx context.Context, method string, path string, record leaseRecord) error {
+	body, err := json.Marshal(l.object(record))
+	if err != nil {
+		return err
+	}
+	resp, err := l.client.do(ctx, method, path, contentTypeJSON, body)
+	var kubeErr *kubeError
+	if errors.As(err, &kubeErr) && kubeErr.Code == http.StatusConflict {
+		return errLeaseConflict
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// firestoreLease is a Firestore document, updated with its update time as
+// precondition.
+type firestoreLease struct {
+	service *firestore.Service
+	name    string
+}
+
+func (l *firestoreLease) get(ctx context.Context) (*leaseRecord, error) {
+	document, err := l.service.Projects.Databases.Documents.Get(l.name).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record := &leaseRecord{Holder: document.Fields["holder"].StringValue, version: document.UpdateTime}
+	record.Duration = time.Duration(document.Fields["lease_duration_seconds"].IntegerValue) * time.Second
+	if renewed := document.Fields["renew_time"].TimestampValue; renewed != "" {
+		record.Renewed, _ = time.Parse(time.RFC3339Nano, renewed)
+	}
+	return record, nil
+}
+
+func (l *firestoreLease) document(record leaseRecord) *firestore.Document {
+	fields := map[string]firestore.Value{
+		"holder":                 {StringValue: record.Holder},
+		"lease_duration_seconds": {IntegerValue: int64(record.Duration / time.Second)},
+	}
+	if !record.Renewed.IsZero() {
+		fields["renew_time"] = firestore.Value{TimestampValue: record.Renewed.UTC().Format(time.RFC3339Nano)}
+	}
+	return &firestore.Document{Fields: fields}
+}
+
+func (l *firestoreLease) create(ctx context.Context, record leaseRecord) error {
+	_, err := l.service.Projects.Databases.Documents.Patch(l.name, l.document(record)).
+		CurrentDocumentExists(false).Context(ctx).Do()
+	return firestoreLeaseError(err)
+}
+
+func (l *firestoreLease) update(ctx context.Context, record leaseRecord) error {
+	_, err := l.service.Projects.Databases.Documents.Patch(l.name, l.document(record)).
+		CurrentDocumentUpdateTime(record.version).Context(ctx).Do()
+	return firestoreLeaseError(err)
+}
+
+// firestoreLeaseError maps the failed preconditions to errLeaseConflict.
+func firestoreLeaseError(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && (apiErr.Code == http.StatusConflict ||
+		apiErr.Code == http.StatusBadRequest && strings.Contains(apiErr.Body+apiErr.Message, "FAILED_PRECONDITION")) {
+		return errLeaseConflict
+	}
+	return err
+}
+
+// LeaderStatus tells which replica runs automated actions. Holder is empty
+// while nobody holds the lease.
+type LeaderStatus struct {
+	Identity string `json:"identity"`
+	Leader   bool   `json:"leader"`
+	Holder   string `json:"holder,omitempty"`
+}
+
+// leaderElector makes sure a single replica runs automated actions:
+// schedules, desired states, idle stops, delayed actions, the removal of
+// expired authorized networks and the operator. Every replica serves the
+// API. The leader renews the lease every third of its duration, the others
+// take it over once it went unrenewed for a whole duration, going by their
+// own clock so clocks need not agree. A leader that fails to renew for a
+// duration steps down before anyone may take over.
+type leaderElector struct {
+	mu       sync.Mutex
+	lock     leaseLock
+	identity string
+	duration time.Duration
+	now      func() time.Time
+
+	leader     bool
+	holder     string
+	renewedAt  time.Time
+	observed   leaseRecord
+	observedAt time.Time
+}
+
+// leadership is the running elector. Without a lock, leader election is off
+// and the replica always leads.
+var leadership = &leaderElector{now: time.Now}
+
+func newLeaderElector(lock leaseLock, identity string, duration time.Duration) *leaderElector {
+	if identity == "" {
+		hostname, _ := os.Hostname()
+		identity = hostname + "-" + randomID(4)
+	}
+	return &leaderElector{lock: lock, identity: identity, duration: duration, now: time.Now}
+}
+
+// leading reports whether this replica runs automated actions.
+func (e *leaderElector) leading() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lock == nil || e.leader
+}
+
+// status reports the leadership, nil when leader election is off.
+func (e *leaderElector) status() *LeaderStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lock == nil {
+		return nil
+	}
+	return &LeaderStatus{Identity: e.identity, Leader: e.leader, Holder: e.holder}
+}
+
+// automationHeld reports whether automated actions are held back at now:
+// paused, or left to the replica holding the leadership.
+func automationHeld(now time.Time) bool {
+	return !leadership.leading() || pauses.active(now)
+}
+
+// run tries to acquire or renew the lease every third of its duration until
+// stop is closed, then releases it.
+func (e *leaderElector) run(stop <-chan struct{}) {
+	if e.lock == nil {
+		return
+	}
+	ticker := time.NewTicker(e.duration / 3)
+	defer ticker.Stop()
+
+	for {
+		e.tryLogged()
+		select {
+		case <-stop:
+			e.release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *leaderElector) tryLogged() {
+	ctx, cancel := context.WithTimeout(context.Background(), e.duration/3)
+	defer cancel()
+	if err := e.try(ctx); err != nil {
+		slog.Error("Failed to acquire or renew the leadership lease", "identity", e.identity, "error", err)
+	}
+}
+
+// try acquires the lease when it is free or expired, renews it when held,
+// and follows the holder otherwise.
+func (e *leaderElector) try(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+	current, err := e.lock.get(ctx)
+	if err != nil {
+		e.renewFailed(now)
+		return err
+	}
+
+	record := leaseRecord{Holder: e.identity, Renewed: now, Duration: e.duration}
+	if current == nil {
+		err = e.lock.create(ctx, record)
+	} else {
+		if current.Holder != e.observed.Holder || !current.Renewed.Equal(e.observed.Renewed) || current.version != e.observed.version {
+			e.observed, e.observedAt = *current, now
+		}
+		expires := current.Duration
+		if expires <= 0 {
+			expires = e.duration
+		}
+		if current.Holder != "" && current.Holder != e.identity && now.Before(e.observedAt.Add(expires)) {
+			e.holder = current.Holder
+			e.setLeader(false)
+			return nil
+		}
+		record.version = current.version
+		err = e.lock.update(ctx, record)
+	}
+
+	switch {
+	case errors.Is(err, errLeaseConflict):
+		e.setLeader(false)
+		return nil
+	case err != nil:
+		e.renewFailed(now)
+		return err
+	}
+	e.observed, e.observedAt, e.renewedAt = record, now, now
+	e.holder = e.identity
+	e.setLeader(true)
+	return nil
+}
+
+// renewFailed steps down once the lease couldn't be renewed for a whole
+// duration, as other replicas may take it over from then on.
+func (e *leaderElector) renewFailed(now time.Time) {
+	if e.leader && !now.Before(e.renewedAt.Add(e.duration)) {
+		e.setLeader(false)
+	}
+}
+
+func (e *leaderElector) setLeader(leader bool) {
+	if leader == e.leader {
+		return
+	}
+	e.leader = leader
+	if leader {
+		leaderGauge.Set(1)
+		slog.Info("Became the leader, running automated actions", "identity", e.identity)
+		return
+	}
+	leaderGauge.Set(0)
+	slog.Warn("Lost the leadership, automated actions left to the holder", "identity", e.identity, "holder", e.holder)
+}
+
+// release frees the lease on shutdown so another replica takes over without
+// waiting for it to expire.
+func (e *leaderElector) release() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.leader {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+	e.holder = ""
+	e.setLeader(false)
+	current, err := e.lock.get(ctx)
+	if err == nil && current != nil && current.Holder == e.identity {
+		err = e.lock.update(ctx, leaseRecord{Duration: e.duration, version: current.version})
+	}
+	if err != nil {
+		slog.Error("Failed to release the leadership lease", "identity", e.identity, "error", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log formats selectable with LOG_FORMAT.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// requestIDHeader carries the request ID in both directions. A valid ID
+// sent by the client, a load balancer or Cloud Scheduler is kept so logs
+// can be correlated across hops.
+const requestIDHeader = "X-Request-Id"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// logLevel is the minimum level logged, set from LOG_LEVEL and changed by a
+// reload.
+var logLevel = new(slog.LevelVar)
+
+// parseLogLevel accepts debug, info, warn and error.
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return 0, fmt.Errorf("must be one of debug, info, warn, error")
+	}
+	return level, nil
+}
+
+// configureLogging routes slog, and the standard log package through it,
+// to stderr in the given format. The JSON format uses the field names of
+// Cloud Logging structured logs so severities are picked up.
+func configureLogging(format string) {
+	slog.SetDefault(slog.New(&contextHandler{newLogHandler(os.Stderr, format)}))
+}
+
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	if format != logFormatJSON {
+		return slog.NewTextHandler(w, &slog.HandlerOptions{Level: logLevel})
+	}
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.LevelKey:
+				return slog.String("severity", cloudLoggingSeverity(a.Value.Any().(slog.Level)))
+			case slog.MessageKey:
+				a.Key = "message"
+			}
+			return a
+		},
+	})
+}
+
+func cloudLoggingSeverity(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	}
+	return "DEBUG"
+}
+
+// contextHandler adds the request ID of the context to every record logged
+// with one of the *Context functions.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if log, ok := ctx.Value(requestLogContextKey{}).(*requestLog); ok {
+		record.AddAttrs(slog.String("request_id", log.id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestLogContextKey struct{}
+
+// requestLog collects the fields of a request's log line while it is in
+// flight.
+type requestLog struct {
+	id    string
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// requestID returns the ID of the request, empty outside withRequestLog.
+func requestID(r *http.Request) string {
+	if log, ok := r.Context().Value(requestLogContextKey{}).(*requestLog); ok {
+		return log.id
+	}
+	return ""
+}
+
+// annotateRequest adds fields, such as the instance acted on or the
+// operation started, to the log line of the request.
+func annotateRequest(r *http.Request, attrs ...slog.Attr) {
+	if log, ok := r.Context().Value(requestLogContextKey{}).(*requestLog); ok {
+		log.mu.Lock()
+		log.attrs = append(log.attrs, attrs...)
+		log.mu.Unlock()
+	}
+}
+
+// withRequestLog assigns every request an ID, returned in X-Request-Id, and
+// logs one line per request once it is answered.
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = randomID(8)
+		}
+		record := &requestLog{id: id}
+		w.Header().Set(requestIDHeader, id)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), requestLogContextKey{}, record))
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+
+		record.mu.Lock()
+		attrs := append([]slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+		}, record.attrs...)
+		record.mu.Unlock()
+		if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", span.TraceID().String()))
+		}
+
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", strings.TrimSpace(err.Error()))
+	os.Exit(1)
+}
@@ -2,17 +2,21 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 	"google.golang.org/api/googleapi"
-	"google.golang.org/api/option"
 	"google.golang.org/api/sqladmin/v1"
 )
 
@@ -24,17 +28,44 @@ type SQLInstancesData struct {
 	Tier            string `json:"tier"`
 }
 
-type TemplateSuccessResponse struct {
-	StatusCode int              `json:"status_code"`
-	StatusText string           `json:"status_text"`
-	Message    string           `json:"message"`
-	Timestamp  string           `json:"timestamp"`
-	Data       SQLInstancesData `json:"data"`
+// SuccessEnvelope is the body of every successful response. Data is the
+// payload of the endpoint, one of the typed structs listed for it in
+// apiEndpoints, never a raw SQL Admin resource other than an operation.
+type SuccessEnvelope struct {
+	APIVersion  string      `json:"api_version"`
+	StatusCode  int         `json:"status_code"`
+	StatusText  string      `json:"status_text"`
+	Message     string      `json:"message"`
+	MessageCode messageKey  `json:"message_code"`
+	Timestamp   interface{} `json:"timestamp"`
+	Data        interface{} `json:"data"`
 }
 
-type TemplateErrorResponse struct {
-	Type        string `json:"type"`
-	Description string `json:"description"`
+// ErrorEnvelope is the body of every error response. Errors holds the
+// field errors of a validation_error or the Cloud SQL errors of an
+// operation_failed, State and Operation what blocked an
+// invalid_transition.
+type ErrorEnvelope struct {
+	APIVersion       string      `json:"api_version"`
+	StatusCode       int         `json:"status_code"`
+	StatusText       string      `json:"status_text"`
+	Message          string      `json:"message"`
+	MessageCode      messageKey  `json:"message_code"`
+	Timestamp        interface{} `json:"timestamp"`
+	ErrorType        string      `json:"error_type"`
+	ErrorDescription string      `json:"error_description"`
+	RequestID        string      `json:"request_id,omitempty"`
+	Errors           interface{} `json:"errors,omitempty"`
+	State            string      `json:"state,omitempty"`
+	Operation        string      `json:"operation,omitempty"`
+	Policy           string      `json:"policy,omitempty"`
+}
+
+// CheckResponseData is the /check payload, the instance details plus the
+// age in seconds of the cached state they were read from.
+type CheckResponseData struct {
+	*SQLInstancesData
+	CacheAge int `json:"cache_age"`
 }
 
 type ErrorJSON struct {
@@ -43,202 +74,641 @@ type ErrorJSON struct {
 }
 
 var (
-	projectID  string
-	instanceID string
-	port       string
+	projectID         reloadable[string]
+	managedProjects   reloadable[[]string]
+	instanceID        reloadable[string]
+	port              string
+	adminPort         string
+	inventoryCache    reloadable[*instanceCache]
+	handlerTimeout    time.Duration
+	readHeaderTimeout time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+	keepAlives        bool
+	enableH2C         bool
+	maxBodyBytes      reloadable[int64]
 )
 
 func init() {
 	if os.Getenv("ENV") == "local" {
 		err := godotenv.Load(".env")
 		if err != nil {
-			log.Print("Error loading .env file")
+			slog.Warn("Error loading .env file", "error", err)
+		}
+	}
+}
+
+func main() {
+	os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// serve runs the HTTP API until SIGTERM or an interrupt.
+func serve(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	simulate := flags.Bool("simulate", false, "serve against an in-memory fake Cloud SQL instead of GCP")
+	configPath := flags.String("config", "", "YAML or JSON config file, overrides CONFIG_FILE")
+	flags.Parse(args)
+
+	if *configPath != "" {
+		os.Setenv("CONFIG_FILE", *configPath)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	configureLogging(cfg.LogFormat)
+	logLevel.Set(cfg.LogLevel)
+
+	if *simulate {
+		cfg.Simulate = true
+	}
+	if cfg.Simulate {
+		sqlAdminEndpoint, err = startSimulator(cfg)
+		if err != nil {
+			fatal("Failed to start the simulator", err)
 		}
+		monitoringEndpoint = sqlAdminEndpoint
+		alloyDBEndpoint, redisEndpoint = sqlAdminEndpoint, sqlAdminEndpoint
+		computeEndpoint = sqlAdminEndpoint + "compute/v1/"
+		slog.Info("Simulation mode, SQL Admin API served by the simulator", "endpoint", sqlAdminEndpoint)
 	}
+	if err := configureSQLAdmin(cfg); err != nil {
+		fatal("Invalid SQL Admin settings", err)
+	}
+	if cfg.StartupChecks {
+		ctx, cancel := context.WithTimeout(context.Background(), startupCheckTimeout)
+		err := cfg.verify(ctx)
+		cancel()
+		if err != nil {
+			fatal("Startup checks failed", err)
+		}
+	}
+	cfg.apply()
 
-	projectID = os.Getenv("PROJECT_ID")
-	instanceID = os.Getenv("INSTANCE_ID")
-	port = os.Getenv("PORT")
+	shutdownTracing, err := cfg.Tracing.setup(context.Background())
+	if err != nil {
+		fatal("Failed to set up tracing", err)
+	}
+	state, err = cfg.State.open(context.Background(), cfg.stateDocuments())
+	if err != nil {
+		fatal("Failed to open the state backend", err)
+	}
+	if cfg.Leader.enabled() {
+		lock, err := cfg.Leader.open(context.Background(), cfg.Operator.APIURL, cfg.State)
+		if err != nil {
+			fatal("Failed to set up leader election", err)
+		}
+		leadership = newLeaderElector(lock, cfg.Leader.Identity, cfg.Leader.Duration)
+	}
+	schedules = newScheduleStore(cfg.SchedulesFile, cfg.TrashRetention)
+	if err := schedules.load(); err != nil {
+		fatal("Failed to load schedules", err)
+	}
+	if err := schedules.declare(cfg.DeclaredSchedules); err != nil {
+		fatal("Failed to declare schedules", err)
+	}
+	overrides = newOverrideStore(cfg.OverridesFile)
+	if err := overrides.load(); err != nil {
+		fatal("Failed to load overrides", err)
+	}
+	delayedActions = newDelayedStore(cfg.DelayedActionsFile)
+	if err := delayedActions.load(); err != nil {
+		fatal("Failed to load delayed actions", err)
+	}
+	auditLog, err = cfg.Audit.open(context.Background())
+	if err != nil {
+		fatal("Failed to open the audit log", err)
+	}
+
+	operations = newOperationTracker(cfg.PendingOperationsFile)
+	if err := operations.resume(context.Background()); err != nil {
+		slog.Error("Failed to resume pending operations", "error", err)
+	}
 
-	if port == "" {
-		port = "80"
+	var background sync.WaitGroup
+	stopSchedules := make(chan struct{})
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		schedules.runPurge(stopSchedules)
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		leadership.run(stopSchedules)
+	}()
+	if cfg.Scheduler {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			sched := newScheduler(schedules)
+			sched.checkpoint, sched.catchUp = cfg.SchedulerStateFile, cfg.SchedulerCatchUp
+			sched.run(stopSchedules)
+		}()
 	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		holidays.run(stopSchedules)
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		idleStops.run(stopSchedules)
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		reconciles.run(stopSchedules)
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		delayedActions.run(stopSchedules)
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		networkSweeps.run(stopSchedules)
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runSecretsRefresh(stopSchedules)
+	}()
+	if cfg.PubSub.enabled() {
+		subscriber, err := newPubSubSubscriber(context.Background(), cfg.PubSub, cfg.ProjectID)
+		if err != nil {
+			fatal("Failed to subscribe to Pub/Sub", err)
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			subscriber.run(stopSchedules)
+		}()
+	}
+
+	if cfg.Operator.Enabled {
+		op, err := newOperator(cfg.Operator)
+		if err != nil {
+			fatal("Failed to start the Kubernetes operator", err)
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			op.run(stopSchedules)
+		}()
+	}
+
+	if cfg.WakeProxy.enabled() {
+		proxy, err := newWakeProxy(cfg.WakeProxy)
+		if err != nil {
+			fatal("Failed to start the wake proxy", err)
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			proxy.run(stopSchedules)
+		}()
+	}
+
+	if cfg.DryRun {
+		slog.Warn("DRY_RUN is set, instances are never modified")
+	}
+	if !cfg.Auth.enabled() {
+		slog.Warn("No AUTH_* settings, the public API is open to anyone who can reach it")
+	}
+
+	tlsConfig, err := cfg.TLS.serverTLSConfig()
+	if err != nil {
+		fatal("Invalid TLS settings", err)
+	}
+
+	server := newServer(":"+port, newPublicHandler(), maxWaitTimeout+handlerTimeout)
+	server.TLSConfig = tlsConfig
+	server.RegisterOnShutdown(events.close)
+	adminServer := newServer(":"+adminPort, withRecovery(newAdminMux()), adminWriteTimeout)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	serveErrs := make(chan error, 2)
+	go func() {
+		slog.Info("Admin server running", "url", "http://localhost:"+adminPort)
+		serveErrs <- adminServer.ListenAndServe()
+	}()
+	go func() {
+		if tlsConfig != nil {
+			slog.Info("Server running", "url", "https://localhost:"+port)
+			serveErrs <- server.ListenAndServeTLS("", "")
+			return
+		}
+		slog.Info("Server running", "url", "http://localhost:"+port)
+		serveErrs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErrs:
+		fatal("Server stopped", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("Shutting down, waiting for in-flight requests and operations", "timeout", cfg.ShutdownTimeout.String())
+	shutdown(cfg.ShutdownTimeout, []*http.Server{server, adminServer}, stopSchedules, &background)
+	flushCtx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("Failed to flush the last spans", "error", err)
+	}
+	cancel()
+	slog.Info("Shutdown complete")
+	return 0
 }
 
-func main() {
-	http.HandleFunc("/stop", stopInstancesHandler)
-	http.HandleFunc("/start", startInstanceHandler)
-	http.HandleFunc("/check", checkInstancesHandler)
+// shutdown stops accepting requests, lets in-flight requests and scheduled
+// runs finish, then waits for the SQL Admin operations they started. The
+// operations still running at the deadline are saved for the next process.
+func shutdown(timeout time.Duration, servers []*http.Server, stopSchedules chan struct{}, background *sync.WaitGroup) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Error("Server did not shut down cleanly", "addr", server.Addr, "error", err)
+			}
+		}()
+	}
 
-	fmt.Println("Server running at http://localhost:" + port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+	close(stopSchedules)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		background.Wait()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("Requests or scheduled runs still in flight at the shutdown deadline")
 	}
+
+	if err := operations.drain(ctx); err != nil {
+		slog.Error("Failed to save pending operations", "error", err)
+	}
+	notifications.wait(ctx)
 }
 
 func startInstanceHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		writeErrorResponse(w, http.StatusMethodNotAllowed, "Method not allowed.", "")
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
 		return
 	}
 
-	ctx := context.Background()
-	sqlService, err := sqladmin.NewService(ctx, option.WithCredentialsFile("service_account.json"))
+	project, instance := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
 	if err != nil {
-		writeErrorResponse(w, http.StatusUnauthorized, "Service Account not found.", err)
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
 		return
 	}
 
-	_, err = checkStatusInstances(projectID, instanceID)
+	status, err := checkStatusInstances(r.Context(), project, instance)
 	if err != nil {
-		writeErrorResponse(w, http.StatusInternalServerError, "Instances not found.", err.Error())
+		recordAction(scheduleActionStart, actionSourceAPI, err)
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
 		return
 	}
-
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		writeErrorResponse(w, http.StatusBadRequest, "Failed to read request body.", err)
+	if !writeTransitionError(w, r, sqlService, scheduleActionStart, project, instance, status.State) {
 		return
 	}
 
-	var payload map[string]interface{}
-	if err := json.Unmarshal(body, &payload); err != nil {
-		writeErrorResponse(w, http.StatusBadRequest, "Invalid JSON format.", err)
+	var payload ActivationPolicyRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(w, r, &payload); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+	}
+	if errs := payload.validate(scheduleActionStart); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
 		return
 	}
 
-	activationPolicy, ok := payload["ActivationPolicy"].(string)
-	if !ok || (activationPolicy != "ALWAYS" && activationPolicy != "NEVER") {
-		writeErrorResponse(w, http.StatusBadRequest, "Invalid value for ActivationPolicy. Must be 'ALWAYS' or 'NEVER'.", "")
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
 		return
 	}
 
 	payloadDoStartInstances := &sqladmin.DatabaseInstance{
 		Settings: &sqladmin.Settings{
-			ActivationPolicy: activationPolicy, // START
+			ActivationPolicy: payload.ActivationPolicy, // START
 		},
 	}
 
-	doStartInstances, err := sqlService.Instances.Patch(projectID, instanceID, payloadDoStartInstances).Do()
+	replicaInstances, err := targetReplicas(r, sqlService, project, instance)
 	if err != nil {
-		writeErrorResponse(w, http.StatusInternalServerError, "Failed to start instance.", err)
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
 		return
 	}
 
-	writeSuccessResponse(w, http.StatusOK, "Instance successfully started. Check console for details.", *doStartInstances)
+	if isDryRun(r) {
+		patch := newDryRunPatch(project, instance, payloadDoStartInstances)
+		patch.Replicas = dryRunReplicas(r, sqlService, scheduleActionStart, replicaInstances)
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, patch)
+		return
+	}
+
+	doStartInstances, err := controllerFor(sqlService).SetActivationPolicy(r.Context(), project, instance, payload.ActivationPolicy)
+	recordAction(scheduleActionStart, actionSourceAPI, err)
+	event := newNotificationEvent(scheduleActionStart, actionSourceAPI, requestPrincipal(r), project, instance)
+	notifyAction(event, doStartInstances, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgStartFailed, err)
+		return
+	}
+
+	operations.track(event, doStartInstances)
+
+	// Replicas can only replicate from a running primary.
+	var replicas []BulkResult
+	if len(replicaInstances) > 0 {
+		doStartInstances, err = awaitOrdered(r.Context(), project, doStartInstances, timeout)
+		if err != nil {
+			writeErrorResponse(w, r, http.StatusInternalServerError, msgStartFailed, err)
+			return
+		}
+		replicas = startReplicas(r, sqlService, replicaInstances)
+	}
+
+	writeOperationResponse(w, r, project, instance, doStartInstances, wait, timeout, operationSteps{Replicas: replicas, WarmUp: true}, msgStartSucceeded, msgStartFailed)
 }
 
 func stopInstancesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		writeErrorResponse(w, http.StatusMethodNotAllowed, "Method not allowed.", "")
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
 		return
 	}
 
-	ctx := context.Background()
-	sqlService, err := sqladmin.NewService(ctx, option.WithCredentialsFile("service_account.json"))
+	project, instance := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
 	if err != nil {
-		writeErrorResponse(w, http.StatusUnauthorized, "Service Account not found.", err)
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
 		return
 	}
 
-	status, err := checkStatusInstances(projectID, instanceID)
+	status, err := checkStatusInstances(r.Context(), project, instance)
 	if err != nil {
-		writeErrorResponse(w, http.StatusInternalServerError, "Instances not found.", err.Error())
+		recordAction(scheduleActionStop, actionSourceAPI, err)
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
 		return
 	}
-
-	if status.State != "RUNNABLE" {
-		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Instance currently in %s state.", status.State), "")
+	if !writeTransitionError(w, r, sqlService, scheduleActionStop, project, instance, status.State) {
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		writeErrorResponse(w, http.StatusBadRequest, "Failed to read request body.", err)
+	if status.State != "RUNNABLE" {
+		recordAction(scheduleActionStop, actionSourceAPI, errInstanceNotRunnable)
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInstanceNotRunnable, "", status.State)
 		return
 	}
 
-	var payload map[string]interface{}
-	if err := json.Unmarshal(body, &payload); err != nil {
-		writeErrorResponse(w, http.StatusBadRequest, "Invalid JSON format.", err)
+	var payload ActivationPolicyRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(w, r, &payload); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+	}
+	if errs := payload.validate(scheduleActionStop); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
 		return
 	}
 
-	activationPolicy, ok := payload["ActivationPolicy"].(string)
-	if !ok || (activationPolicy != "ALWAYS" && activationPolicy != "NEVER") {
-		writeErrorResponse(w, http.StatusBadRequest, "Invalid value for ActivationPolicy. Must be 'ALWAYS' or 'NEVER'.", "")
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
 		return
 	}
 
 	payloadDoStopInstances := &sqladmin.DatabaseInstance{
 		Settings: &sqladmin.Settings{
-			ActivationPolicy: activationPolicy, // STOP
+			ActivationPolicy: payload.ActivationPolicy, // STOP
 
 		},
 	}
 
-	doStopInstances, err := sqlService.Instances.Patch(projectID, instanceID, payloadDoStopInstances).Do()
+	replicaInstances, err := targetReplicas(r, sqlService, project, instance)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+
+	if payload.ActivationPolicy == "NEVER" {
+		if err := checkConnections(r.Context(), project, instance, isForced(r)); err != nil {
+			recordAction(scheduleActionStop, actionSourceAPI, err)
+			writeConnectionsError(w, r, instance, err)
+			return
+		}
+	}
+
+	if isDryRun(r) {
+		patch := newDryRunPatch(project, instance, payloadDoStopInstances)
+		patch.BackupFirst = payload.BackupBeforeStop
+		if payload.ExportBeforeStop != nil {
+			patch.ExportFirst = payload.ExportBeforeStop.exportContext(instance, time.Now())
+		}
+		patch.Replicas = dryRunReplicas(r, sqlService, scheduleActionStop, replicaInstances)
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, patch)
+		return
+	}
+
+	event := newNotificationEvent(scheduleActionStop, actionSourceAPI, requestPrincipal(r), project, instance)
+
+	var backup *sqladmin.Operation
+	if payload.BackupBeforeStop {
+		backup, err = backupBeforeStop(r.Context(), sqlService, event, timeout)
+		if err != nil {
+			recordAction(scheduleActionStop, actionSourceAPI, err)
+			writeErrorResponse(w, r, http.StatusInternalServerError, msgBackupFailed, err)
+			return
+		}
+	}
+	var export *sqladmin.Operation
+	if payload.ExportBeforeStop != nil {
+		export, err = exportBeforeStop(r.Context(), sqlService, event, payload.ExportBeforeStop, timeout)
+		if export != nil {
+			auditURI(r, operationURI(export))
+		}
+		if err != nil {
+			recordAction(scheduleActionStop, actionSourceAPI, err)
+			writeErrorResponse(w, r, http.StatusInternalServerError, msgExportFailed, err)
+			return
+		}
+	}
+
+	// Stopping the primary under running replicas breaks replication.
+	replicas, err := stopReplicas(r, sqlService, replicaInstances, timeout)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgReplicaStopFailed, err)
+		return
+	}
+
+	doStopInstances, err := controllerFor(sqlService).SetActivationPolicy(r.Context(), project, instance, payload.ActivationPolicy)
+	recordAction(scheduleActionStop, actionSourceAPI, err)
+	notifyAction(event, doStopInstances, err)
 	if err != nil {
-		writeErrorResponse(w, http.StatusInternalServerError, "Failed to stop instance.", err)
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgStopFailed, err)
 		return
 	}
 
-	writeSuccessResponse(w, http.StatusOK, "Instance successfully stopped. Check console for details.", *doStopInstances)
+	operations.track(event, doStopInstances)
+	writeOperationResponse(w, r, project, instance, doStopInstances, wait, timeout, operationSteps{Backup: backup, Export: export, Replicas: replicas}, msgStopSucceeded, msgStopFailed)
 }
 
 func checkInstancesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		writeErrorResponse(w, http.StatusMethodNotAllowed, "Method not allowed.", "")
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
 		return
 	}
-	ctx := context.Background()
-	_, err := sqladmin.NewService(ctx, option.WithCredentialsFile("service_account.json"))
+	_, err := sqlAdminService(targetProject(r))
 	if err != nil {
-		writeErrorResponse(w, http.StatusUnauthorized, "Service Account not found.", err)
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
 		return
 	}
 
-	instance, err := checkStatusInstances(projectID, instanceID)
-	if err != nil {
-		writeErrorResponse(w, http.StatusInternalServerError, "Instances not found.", err.Error())
+	var (
+		instance *SQLInstancesData
+		age      time.Duration
+	)
+
+	if target := r.URL.Query().Get("wait_for_state"); target != "" {
+		if !instanceStates[target] {
+			writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitState, "", target)
+			return
+		}
+
+		timeout, err := parseWaitTimeout(r.URL.Query().Get("timeout"))
+		if err != nil {
+			writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+			return
+		}
+
+		instance, err = waitForState(r.Context(), targetProject(r), targetInstance(r), target, timeout)
+		if errors.Is(err, errWaitTimeout) {
+			writeErrorResponse(w, r, http.StatusRequestTimeout, msgWaitTimedOut, err, target, instance.State)
+			return
+		}
+		if err != nil {
+			writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+			return
+		}
+	} else {
+		fresh := r.URL.Query().Get("fresh") == "true"
+		instance, age, err = inventoryCache.load().get(r.Context(), targetProject(r), targetInstance(r), fresh)
+		if err != nil {
+			writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+			return
+		}
+	}
+
+	responseData := &CheckResponseData{
+		SQLInstancesData: &SQLInstancesData{
+			Name:            instance.Name,
+			DatabaseVersion: instance.DatabaseVersion,
+			Region:          instance.Region,
+			State:           instance.State,
+			Tier:            instance.Tier,
+		},
+		CacheAge: int(age.Seconds()),
+	}
+
+	w.Header().Set("Age", strconv.Itoa(responseData.CacheAge))
+	if checkNotModified(w, r, instanceETag(responseData.SQLInstancesData)) {
 		return
 	}
 
-	responseData := &SQLInstancesData{
-		Name:            instance.Name,
-		DatabaseVersion: instance.DatabaseVersion,
-		Region:          instance.Region,
-		State:           instance.State,
-		Tier:            instance.Tier,
+	writeSuccessResponse(w, r, http.StatusOK, msgCheckSucceeded, responseData)
+}
+
+func writeSuccessResponse(w http.ResponseWriter, r *http.Request, statusCode int, message messageKey, data interface{}, args ...interface{}) {
+	lang := requestLanguage(r)
+	response := SuccessEnvelope{
+		APIVersion:  apiVersion,
+		StatusCode:  statusCode,
+		StatusText:  http.StatusText(statusCode),
+		Message:     translate(lang, message, args...),
+		MessageCode: message,
+		Timestamp:   formatTimestamp(time.Now()),
+		Data:        data,
 	}
 
-	writeSuccessResponse(w, http.StatusOK, "Successfully fetch instances detail.", responseData)
+	w.Header().Set("Content-Language", lang)
+	encodeResponse(w, r, statusCode, response)
 }
 
-func writeSuccessResponse(w http.ResponseWriter, statusCode int, message string, data interface{}) {
-	response := map[string]interface{}{
-		"data":        data,
-		"status_code": statusCode,
-		"status_text": http.StatusText(statusCode),
-		"message":     message,
-		"timestamp":   time.Now().Format(time.RFC3339),
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, statusCode int, message messageKey, err interface{}, args ...interface{}) {
+	// A call cut short by its deadline is reported as a gateway timeout, not
+	// as a failure of the service.
+	if e, ok := err.(error); ok && statusCode == http.StatusInternalServerError && errors.Is(e, context.DeadlineExceeded) {
+		statusCode = http.StatusGatewayTimeout
 	}
+	response := errorEnvelope(r, statusCode, message, err, args...)
+	auditError(r, response.ErrorDescription)
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(response)
+	w.Header().Set("Content-Language", requestLanguage(r))
+	encodeResponse(w, r, statusCode, response)
 }
 
-func writeErrorResponse(w http.ResponseWriter, statusCode int, message string, err interface{}) {
+func errorEnvelope(r *http.Request, statusCode int, message messageKey, err interface{}, args ...interface{}) ErrorEnvelope {
 	var errorType string
 	var errorDescription string
+	var fields validationErrors
+	var operationErrors []*sqladmin.OperationError
+	var transition *transitionError
+	var blocked *policyError
 
 	switch e := err.(type) {
+	case validationErrors:
+		errorType = "validation_error"
+		errorDescription = e.Error()
+		fields = e
 	case *googleapi.Error:
 		errorType = fmt.Sprintf("googleapi_%d", e.Code)
 		errorDescription = e.Message
+	case *sqladmin.OperationErrors:
+		errorType = "operation_failed"
+		messages := make([]string, 0, len(e.Errors))
+		for _, operationError := range e.Errors {
+			messages = append(messages, operationError.Code+": "+operationError.Message)
+		}
+		errorDescription = strings.Join(messages, "; ")
+		operationErrors = e.Errors
+	case *transitionError:
+		errorType = "invalid_transition"
+		errorDescription = e.Error()
+		transition = e
+	case *policyError:
+		errorType = "policy_violation"
+		errorDescription = e.Error()
+		blocked = e
 	case error:
 		errorType = "internal_error"
+		switch {
+		case errors.Is(e, context.DeadlineExceeded):
+			errorType = "timeout"
+		case errors.Is(e, errRateLimited):
+			errorType = "rate_limited"
+		}
 		errorDescription = e.Error()
 	case string:
 		errorType = "internal_error"
@@ -248,38 +718,52 @@ func writeErrorResponse(w http.ResponseWriter, statusCode int, message string, e
 		errorDescription = fmt.Sprintf("%v", e)
 	}
 
-	response := map[string]interface{}{
-		"status_code":       statusCode,
-		"status_text":       http.StatusText(statusCode),
-		"message":           message,
-		"timestamp":         time.Now().Format(time.RFC3339),
-		"error_type":        errorType,
-		"error_description": errorDescription,
+	response := ErrorEnvelope{
+		APIVersion:       apiVersion,
+		StatusCode:       statusCode,
+		StatusText:       http.StatusText(statusCode),
+		Message:          translate(requestLanguage(r), message, args...),
+		MessageCode:      message,
+		Timestamp:        formatTimestamp(time.Now()),
+		ErrorType:        errorType,
+		ErrorDescription: errorDescription,
+		RequestID:        requestID(r),
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(response)
+	if len(fields) > 0 {
+		response.Errors = fields
+	}
+	if len(operationErrors) > 0 {
+		response.Errors = operationErrors
+	}
+	if transition != nil {
+		response.State = transition.State
+		response.Operation = transition.operationName()
+	}
+	if blocked != nil {
+		response.Policy = blocked.Rule
+	}
+	return response
 }
 
-func checkStatusInstances(projectID string, instanceID string) (*SQLInstancesData, error) {
-	ctx := context.Background()
-	sqlService, err := sqladmin.NewService(ctx, option.WithCredentialsFile("service_account.json"))
+func checkStatusInstances(ctx context.Context, projectID string, instanceID string) (*SQLInstancesData, error) {
+	controller, err := sqlController(projectID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find Service Account: %w", err)
 	}
 
-	instance, err := sqlService.Instances.Get(projectID, instanceID).Do()
+	instance, err := controller.Status(ctx, projectID, instanceID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get instance details, instances not found.: %w", err)
 	}
 
+	observeInstanceState(projectID, instanceID, instance.State)
+
 	responseData := &SQLInstancesData{
 		Name:            instance.Name,
 		DatabaseVersion: instance.DatabaseVersion,
 		Region:          instance.Region,
 		State:           instance.State,
-		Tier:            instance.Settings.Tier,
+		Tier:            instance.Tier,
 	}
 
 	return responseData, nil
@@ -0,0 +1,5145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+	"google.golang.org/api/pubsub/v1"
+	"google.golang.org/api/sqladmin/v1"
+
+	"scheduler-db/pkg/sqlctl"
+	"scheduler-db/pkg/sqlctl/sqlctltest"
+)
+
+const (
+	testProject  = "test-project"
+	testInstance = "test-db"
+)
+
+// testEnv wires the handlers to a fake SQL Admin API served by httptest, so
+// tests run end-to-end over HTTP without GCP credentials.
+type testEnv struct {
+	t      *testing.T
+	fake   *fakeSQLAdmin
+	server *httptest.Server
+
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	env := &testEnv{t: t, now: time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC)}
+
+	env.fake = newFakeSQLAdmin(1)
+	env.fake.now = env.clock
+	env.fake.addInstance(&sqladmin.DatabaseInstance{
+		Name:            testInstance,
+		Project:         testProject,
+		DatabaseVersion: "POSTGRES_15",
+		Region:          "asia-southeast2",
+		Settings:        &sqladmin.Settings{Tier: "db-f1-micro", UserLabels: map[string]string{"env": "dev"}},
+	})
+
+	api := httptest.NewServer(env.fake)
+	t.Cleanup(api.Close)
+
+	cfg := &Config{
+		ProjectID:           testProject,
+		InstanceID:          testInstance,
+		Projects:            []string{testProject},
+		Port:                "0",
+		CheckCacheTTL:       time.Minute,
+		HandlerTimeout:      5 * time.Second,
+		ReadHeaderTimeout:   time.Second,
+		MaxBodyBytes:        1024,
+		ResponseLocation:    time.UTC,
+		ResponseTimeFormat:  timeFormatRFC3339,
+		BulkConcurrency:     defaultBulkConcurrency,
+		ShrinkCheckMaxUsage: defaultShrinkCheckMaxUsage,
+		Simulate:            true,
+	}
+	cfg.apply()
+	schedules = newScheduleStore(filepath.Join(t.TempDir(), "schedules.json"), 24*time.Hour)
+	schedules.now = env.clock
+	overrides = newOverrideStore(filepath.Join(t.TempDir(), "overrides.json"))
+	overrides.now = env.clock
+	delayedActions = newDelayedStore(filepath.Join(t.TempDir(), "delayed-actions.json"))
+	delayedActions.now = env.clock
+	pauses = &schedulerPause{now: env.clock}
+	operations = newOperationTracker("")
+	auditLog = &fileAuditStore{path: filepath.Join(t.TempDir(), "audit.jsonl")}
+	sqlAdminEndpoint = api.URL + "/"
+	monitoringEndpoint = api.URL + "/"
+	alloyDBEndpoint, redisEndpoint = api.URL+"/", api.URL+"/"
+	computeEndpoint = api.URL + "/compute/v1/"
+	sqlAdminOffline.store(true)
+	sqlAdminRetry.store(RetryConfig{})
+	idempotencyKeys = &idempotencyStore{results: make(map[string]*idempotentResult), now: env.clock}
+	resetSQLAdminService()
+	t.Cleanup(func() {
+		sqlAdminEndpoint = ""
+		monitoringEndpoint = ""
+		alloyDBEndpoint, redisEndpoint, computeEndpoint = "", "", ""
+		sqlAdminOffline.store(false)
+		sqlAdminTransport.store(nil)
+		resetSQLAdminService()
+	})
+
+	env.server = httptest.NewServer(newPublicHandler())
+	t.Cleanup(env.server.Close)
+
+	return env
+}
+
+func (e *testEnv) clock() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.now
+}
+
+// advance moves the fake's clock so pending operations complete.
+func (e *testEnv) advance(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.now = e.now.Add(d)
+}
+
+// instance returns the fake's current view of the test instance.
+func (e *testEnv) instance() *sqladmin.DatabaseInstance {
+	e.fake.mu.Lock()
+	defer e.fake.mu.Unlock()
+
+	e.fake.advance()
+	return e.fake.instances[testProject+"/"+testInstance]
+}
+
+func (e *testEnv) do(method string, path string, body string, headers ...string) (*http.Response, map[string]interface{}) {
+	e.t.Helper()
+
+	req, err := http.NewRequest(method, e.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var reader io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		reader = gz
+	}
+
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	var envelope map[string]interface{}
+	if len(raw) > 0 && strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		if err := json.Unmarshal(raw, &envelope); err != nil {
+			e.t.Fatalf("%s %s: invalid JSON %q: %v", method, path, raw, err)
+		}
+	}
+	return resp, envelope
+}
+
+func expectStatus(t *testing.T, resp *http.Response, envelope map[string]interface{}, want int) {
+	t.Helper()
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: status = %d, want %d (body %v)", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, want, envelope)
+	}
+}
+
+func dataField(envelope map[string]interface{}, key string) interface{} {
+	data, _ := envelope["data"].(map[string]interface{})
+	return data[key]
+}
+
+func TestCheckReturnsInstance(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodGet, "/check", "")
+	expectStatus(t, resp, body, http.StatusOK)
+
+	if got := dataField(body, "state"); got != "RUNNABLE" {
+		t.Errorf("state = %v, want RUNNABLE", got)
+	}
+	if got := dataField(body, "tier"); got != "db-f1-micro" {
+		t.Errorf("tier = %v, want db-f1-micro", got)
+	}
+	if body["message_code"] != string(msgCheckSucceeded) {
+		t.Errorf("message_code = %v", body["message_code"])
+	}
+}
+
+func TestCheckRejectsWrongMethod(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodPost, "/check", "")
+	expectStatus(t, resp, body, http.StatusMethodNotAllowed)
+}
+
+func TestCheckETag(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodGet, "/check", "")
+	expectStatus(t, resp, body, http.StatusOK)
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("missing ETag")
+	}
+
+	resp, body = env.do(http.MethodGet, "/check", "", "If-None-Match", etag, "Accept-Encoding", "gzip")
+	expectStatus(t, resp, body, http.StatusNotModified)
+}
+
+func TestCheckLocalizedAndCompressed(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodGet, "/check", "", "Accept-Language", "id-ID,en;q=0.5", "Accept-Encoding", "gzip")
+	expectStatus(t, resp, body, http.StatusOK)
+
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Error("response is not gzip encoded")
+	}
+	if body["message"] != messageCatalog["id"][msgCheckSucceeded] {
+		t.Errorf("message = %v, want Indonesian", body["message"])
+	}
+}
+
+func TestResponseTimestampFormat(t *testing.T) {
+	env := newTestEnv(t)
+
+	jakarta, err := time.LoadLocation("Asia/Jakarta")
+	if err != nil {
+		t.Skip("tzdata not available:", err)
+	}
+	responseLocation.store(jakarta)
+
+	_, body := env.do(http.MethodGet, "/check", "")
+	if ts, _ := body["timestamp"].(string); !strings.HasSuffix(ts, "+07:00") {
+		t.Errorf("timestamp = %v, want +07:00 offset", body["timestamp"])
+	}
+
+	responseTimeFormat.store(timeFormatEpochMillis)
+	_, body = env.do(http.MethodGet, "/check", "")
+	if _, ok := body["timestamp"].(float64); !ok {
+		t.Errorf("timestamp = %v, want epoch millis number", body["timestamp"])
+	}
+}
+
+func TestCheckYAML(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, _ := env.do(http.MethodGet, "/check", "", "Accept", "application/yaml")
+	if got := resp.Header.Get("Content-Type"); got != contentTypeYAML {
+		t.Errorf("Content-Type = %q, want %q", got, contentTypeYAML)
+	}
+}
+
+func TestStopThenStart(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodPost, "/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	env.advance(simulatedStopLatency)
+
+	resp, body = env.do(http.MethodGet, "/check?fresh=true", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := dataField(body, "state"); got != "STOPPED" {
+		t.Fatalf("state after stop = %v, want STOPPED", got)
+	}
+
+	// A stopped instance can't be stopped again.
+	resp, body = env.do(http.MethodPost, "/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body = env.do(http.MethodPost, "/start", `{"ActivationPolicy":"ALWAYS"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	env.advance(simulatedStartLatency)
+
+	resp, body = env.do(http.MethodGet, "/check?fresh=true", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := dataField(body, "state"); got != "RUNNABLE" {
+		t.Fatalf("state after start = %v, want RUNNABLE", got)
+	}
+}
+
+func TestCheckServesCachedState(t *testing.T) {
+	env := newTestEnv(t)
+
+	env.do(http.MethodGet, "/check", "")
+	// Stopped behind the service's back, e.g. from the console.
+	env.fake.mu.Lock()
+	instance := env.fake.instances[testProject+"/"+testInstance]
+	instance.State, instance.Settings.ActivationPolicy = "STOPPED", "NEVER"
+	env.fake.mu.Unlock()
+
+	_, body := env.do(http.MethodGet, "/check", "")
+	if got := dataField(body, "state"); got != "RUNNABLE" {
+		t.Errorf("cached state = %v, want RUNNABLE", got)
+	}
+
+	_, body = env.do(http.MethodGet, "/check?fresh=true", "")
+	if got := dataField(body, "state"); got != "STOPPED" {
+		t.Errorf("fresh state = %v, want STOPPED", got)
+	}
+
+	// Actions of the service drop the cached state.
+	env.do(http.MethodPost, "/start", `{"ActivationPolicy":"ALWAYS"}`)
+	env.advance(simulatedStartLatency)
+	_, body = env.do(http.MethodGet, "/check", "")
+	if got := dataField(body, "state"); got != "RUNNABLE" {
+		t.Errorf("state after start = %v, want RUNNABLE", got)
+	}
+}
+
+func TestStartValidation(t *testing.T) {
+	env := newTestEnv(t)
+
+	tests := []struct {
+		name  string
+		body  string
+		want  int
+		code  messageKey
+		field string
+	}{
+		{"malformed", `{"ActivationPolicy":`, http.StatusBadRequest, msgInvalidJSON, ""},
+		{"trailing data", `{} {}`, http.StatusBadRequest, msgInvalidJSON, ""},
+		{"unknown field", `{"ActivationPolicy":"ALWAYS","Force":true}`, http.StatusBadRequest, msgValidationFailed, "Force"},
+		{"wrong type", `{"ActivationPolicy":1}`, http.StatusBadRequest, msgInvalidActivationPolicy, "ActivationPolicy"},
+		{"invalid policy", `{"ActivationPolicy":"SOMETIMES"}`, http.StatusBadRequest, msgInvalidActivationPolicy, "ActivationPolicy"},
+		{"contradictory policy", `{"ActivationPolicy":"NEVER"}`, http.StatusBadRequest, msgInvalidActivationPolicy, "ActivationPolicy"},
+		{"mixed errors", `{"ActivationPolicy":"SOMETIMES","backup_before_stop":true}`, http.StatusBadRequest, msgValidationFailed, "ActivationPolicy"},
+		{"too large", `{"ActivationPolicy":"` + strings.Repeat("A", 2048) + `"}`, http.StatusRequestEntityTooLarge, msgBodyTooLarge, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := env.do(http.MethodPost, "/start", tt.body)
+			expectStatus(t, resp, body, tt.want)
+			if body["message_code"] != string(tt.code) {
+				t.Errorf("message_code = %v, want %s", body["message_code"], tt.code)
+			}
+
+			if tt.field == "" {
+				return
+			}
+			errs, _ := body["errors"].([]interface{})
+			if len(errs) == 0 {
+				t.Fatalf("missing errors array in %v", body)
+			}
+			if got := errs[0].(map[string]interface{})["field"]; got != tt.field {
+				t.Errorf("field = %v, want %s", got, tt.field)
+			}
+		})
+	}
+}
+
+func TestActivationPolicyFromEndpoint(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodPost, "/stop", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedStopLatency)
+	if got := env.instance().Settings.ActivationPolicy; got != "NEVER" {
+		t.Errorf("policy after a stop without body = %q, want NEVER", got)
+	}
+
+	resp, body = env.do(http.MethodPost, "/start", `{"ActivationPolicy":" always "}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedStartLatency)
+	if got := env.instance().Settings.ActivationPolicy; got != "ALWAYS" {
+		t.Errorf("policy after a start = %q, want ALWAYS", got)
+	}
+
+	resp, body = env.do(http.MethodPost, "/stop", `{"ActivationPolicy":"ALWAYS"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	if got := env.instance().Settings.ActivationPolicy; got != "ALWAYS" {
+		t.Errorf("policy after a contradictory stop = %q, want ALWAYS", got)
+	}
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if body["api_version"] != apiVersion {
+		t.Errorf("api_version = %v", body["api_version"])
+	}
+	if operation, ok := dataField(body, "operation").(map[string]interface{}); !ok || operation["operationType"] != "UPDATE" {
+		t.Errorf("stop data = %v, want an operation result", body["data"])
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/missing/stop", "")
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+	for _, field := range []string{"api_version", "status_code", "status_text", "message", "message_code", "timestamp", "error_type", "error_description"} {
+		if _, ok := body[field]; !ok {
+			t.Errorf("error envelope without %s: %v", field, body)
+		}
+	}
+	if _, ok := body["state"]; ok {
+		t.Errorf("error envelope with empty fields: %v", body)
+	}
+}
+
+func TestTransitionGuard(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodPost, "/stop", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	stop := dataField(body, "operation").(map[string]interface{})["name"]
+
+	resp, body = env.do(http.MethodPost, "/start", "")
+	expectStatus(t, resp, body, http.StatusConflict)
+	if body["message_code"] != "start_blocked" || body["error_type"] != "invalid_transition" || body["operation"] != stop {
+		t.Errorf("start during a stop = %v, want start_blocked with operation %v", body, stop)
+	}
+
+	env.advance(simulatedStopLatency)
+	resp, body = env.do(http.MethodPost, "/start", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedStartLatency)
+
+	instance := env.instance()
+	for _, state := range []string{"MAINTENANCE", "FAILED"} {
+		env.fake.mu.Lock()
+		instance.State = state
+		env.fake.mu.Unlock()
+
+		resp, body = env.do(http.MethodPost, "/stop", "")
+		expectStatus(t, resp, body, http.StatusConflict)
+		if body["message_code"] != "stop_refused" || body["state"] != state {
+			t.Errorf("stop in %s = %v, want stop_refused with the state", state, body)
+		}
+	}
+}
+
+func TestWaitForState(t *testing.T) {
+	env := newTestEnv(t)
+
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+
+	env.do(http.MethodPost, "/stop", `{"ActivationPolicy":"NEVER"}`)
+
+	resp, body := env.do(http.MethodGet, "/check?wait_for_state=STOPPED&timeout=50ms", "")
+	expectStatus(t, resp, body, http.StatusRequestTimeout)
+
+	env.advance(simulatedStopLatency)
+
+	resp, body = env.do(http.MethodGet, "/check?wait_for_state=STOPPED&timeout=1s", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := dataField(body, "state"); got != "STOPPED" {
+		t.Errorf("state = %v, want STOPPED", got)
+	}
+
+	resp, body = env.do(http.MethodGet, "/check?wait_for_state=ASLEEP", "")
+	expectStatus(t, resp, body, http.StatusBadRequest)
+}
+
+func TestPatchSettingsAllowList(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodPatch, "/v1/instances/"+testInstance+"/settings", `{"tier":"db-custom-8-32768"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body = env.do(http.MethodPatch, "/v1/instances/"+testInstance+"/settings", `{"userLabels":{"team":"payments"}}`)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	env.advance(simulatedPatchLatency)
+
+	labels := env.instance().Settings.UserLabels
+	if labels["team"] != "payments" || labels["env"] != "dev" {
+		t.Errorf("labels = %v, want merged team and env labels", labels)
+	}
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	env := newTestEnv(t)
+	dir := t.TempDir()
+
+	recorder, err := newRecordingTransport(http.DefaultTransport, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlAdminTransport.store(recorder)
+	resetSQLAdminService()
+
+	resp, recorded := env.do(http.MethodGet, "/check?fresh=true", "")
+	expectStatus(t, resp, recorded, http.StatusOK)
+
+	replayer, err := newReplayTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlAdminTransport.store(replayer)
+	resetSQLAdminService()
+	// Nothing reaches the fake anymore, its state no longer matters.
+	env.fake.instances = map[string]*sqladmin.DatabaseInstance{}
+
+	resp, replayed := env.do(http.MethodGet, "/check?fresh=true", "")
+	expectStatus(t, resp, replayed, http.StatusOK)
+	if got, want := dataField(replayed, "name"), dataField(recorded, "name"); got != want {
+		t.Errorf("replayed name = %v, want %v", got, want)
+	}
+
+	resp, body := env.do(http.MethodPost, "/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+}
+
+func TestSanitizeBody(t *testing.T) {
+	got := string(sanitizeBody([]byte(`{"name":"app","password":"hunter\"2"}`)))
+	if strings.Contains(got, "hunter") || !strings.Contains(got, `"REDACTED"`) {
+		t.Errorf("sanitizeBody = %s", got)
+	}
+}
+
+func TestChaosInjectsErrors(t *testing.T) {
+	env := newTestEnv(t)
+	sqlAdminTransport.store(&chaosTransport{
+		base:   http.DefaultTransport,
+		config: ChaosConfig{ErrorRate: 1, Codes: []int{http.StatusTooManyRequests}, Methods: []string{http.MethodGet}},
+	})
+	resetSQLAdminService()
+
+	resp, body := env.do(http.MethodGet, "/check?fresh=true", "")
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+	if !strings.Contains(body["error_description"].(string), "429") {
+		t.Errorf("error_description = %v, want injected 429", body["error_description"])
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	newTestEnv(t)
+	resetReadiness()
+	t.Cleanup(resetReadiness)
+	admin := httptest.NewServer(newAdminMux())
+	t.Cleanup(admin.Close)
+
+	probe := func(path string) int {
+		resp, err := http.Get(admin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := probe("/readyz"); status != http.StatusOK {
+		t.Errorf("readyz = %d, want 200", status)
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	sqlAdminEndpoint = down.URL + "/"
+	resetSQLAdminService()
+	if status := probe("/readyz"); status != http.StatusOK {
+		t.Errorf("readyz = %d, want the cached 200", status)
+	}
+
+	resetReadiness()
+	if status := probe("/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("readyz = %d with the SQL Admin API down, want 503", status)
+	}
+	if status := probe("/healthz"); status != http.StatusOK {
+		t.Errorf("healthz = %d, the process is still up", status)
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	newTestEnv(t)
+	admin := httptest.NewServer(newAdminMux())
+	t.Cleanup(admin.Close)
+
+	flags, err := parseFeatureFlags("reconciler, auto_stop=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	features.replace(flags)
+
+	if !features.enabled(flagReconciler) || features.enabled(flagAutoStop) {
+		t.Fatalf("flags = %v", features.list())
+	}
+	if _, err := parseFeatureFlags("teleport"); err == nil {
+		t.Error("unknown flag accepted")
+	}
+
+	req, _ := http.NewRequest(http.MethodPatch, admin.URL+"/admin/flags/auto_stop", strings.NewReader(`{"enabled":true}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !features.enabled(flagAutoStop) {
+		t.Errorf("toggle: status %d, auto_stop %v", resp.StatusCode, features.enabled(flagAutoStop))
+	}
+
+	req, _ = http.NewRequest(http.MethodPatch, admin.URL+"/admin/flags/teleport", strings.NewReader(`{"enabled":true}`))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown flag: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestSchedulerPause(t *testing.T) {
+	env := newTestEnv(t)
+	admin := httptest.NewServer(newAdminMux())
+	t.Cleanup(admin.Close)
+	post := func(path string, payload string) (int, map[string]interface{}) {
+		resp, err := http.Post(admin.URL+path, contentTypeJSON, strings.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+	schedulerStatus := func() interface{} {
+		resp, err := http.Get(admin.URL + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return dataField(body, "scheduler")
+	}
+
+	for _, payload := range []string{`{"for":"-1h"}`, `{"until":"2024-06-03T08:00:00Z"}`, `{"for":"1h","until":"2024-06-03T12:00:00Z"}`, `{"for":"720h"}`} {
+		if status, body := post("/scheduler/pause", payload); status != http.StatusBadRequest {
+			t.Errorf("pause with %s = %d %v, want 400", payload, status, body)
+		}
+	}
+
+	status, body := post("/scheduler/pause", `{"for":"2h","reason":"database migration"}`)
+	want := map[string]interface{}{"state": "paused", "reason": "database migration", "since": "2024-06-03T09:00:00Z", "until": "2024-06-03T11:00:00Z"}
+	if status != http.StatusOK || !reflect.DeepEqual(body["data"], want) {
+		t.Errorf("pause = %d %v, want %v", status, body["data"], want)
+	}
+	if got := schedulerStatus(); !reflect.DeepEqual(got, want) {
+		t.Errorf("healthz scheduler = %v, want %v", got, want)
+	}
+
+	// Schedules firing while paused are skipped, not caught up.
+	resp, body := env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"stop","cron":"0 10 * * *"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	sched := newScheduler(schedules)
+	sched.now = env.clock
+	sched.last = env.clock()
+	env.advance(time.Hour + time.Minute)
+	sched.tick()
+	env.advance(simulatedStopLatency)
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Errorf("state = %s, the scheduled stop ran while paused", state)
+	}
+
+	// The pause ends on its own.
+	env.advance(time.Hour)
+	sched.tick()
+	if got := schedulerStatus(); !reflect.DeepEqual(got, map[string]interface{}{"state": "running"}) {
+		t.Errorf("healthz scheduler = %v after the pause ended", got)
+	}
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Errorf("state = %s, the skipped stop was caught up", state)
+	}
+
+	if status, _ := post("/scheduler/pause", ""); status != http.StatusOK || !pauses.active(env.clock()) {
+		t.Errorf("open pause = %d", status)
+	}
+	if status, body := post("/scheduler/resume", ""); status != http.StatusOK || !reflect.DeepEqual(body["data"], map[string]interface{}{"state": "running"}) {
+		t.Errorf("resume = %d %v", status, body["data"])
+	}
+}
+
+func TestScheduleTrash(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodPost, "/v1/schedules", `{"instance":"sql-test","action":"stop","cron":"0 20 * * 1-5","timezone":"Asia/Jakarta"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	id := dataField(body, "id").(string)
+	if project := dataField(body, "project"); project != testProject {
+		t.Errorf("project = %v, want default %s", project, testProject)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/schedules", `{"instance":"sql-test","action":"pause","cron":"every day"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body = env.do(http.MethodPost, "/v1/schedules/"+id+"/restore", "")
+	expectStatus(t, resp, body, http.StatusConflict)
+
+	resp, body = env.do(http.MethodDelete, "/v1/schedules/"+id, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if purgeAt := dataField(body, "purge_at"); purgeAt != "2024-06-04T09:00:00Z" {
+		t.Errorf("purge_at = %v", purgeAt)
+	}
+
+	_, body = env.do(http.MethodGet, "/v1/schedules", "")
+	if items := body["data"].([]interface{}); len(items) != 0 {
+		t.Errorf("active schedules = %v, want none", items)
+	}
+	_, body = env.do(http.MethodGet, "/v1/schedules?deleted=true", "")
+	if items := body["data"].([]interface{}); len(items) != 1 {
+		t.Errorf("trash = %v, want the deleted schedule", items)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/schedules/"+id+"/restore", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if deletedAt := dataField(body, "deleted_at"); deletedAt != nil {
+		t.Errorf("deleted_at = %v after restore", deletedAt)
+	}
+
+	// Survives a restart.
+	reloaded := newScheduleStore(schedules.path, schedules.retention)
+	if err := reloaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.get(id); err != nil {
+		t.Fatalf("schedule lost on reload: %v", err)
+	}
+
+	env.do(http.MethodDelete, "/v1/schedules/"+id, "")
+	env.advance(23 * time.Hour)
+	if purged, _ := schedules.purge(); len(purged) != 0 {
+		t.Fatalf("purged %d schedules before retention elapsed", len(purged))
+	}
+	env.advance(2 * time.Hour)
+	if purged, _ := schedules.purge(); len(purged) != 1 {
+		t.Fatalf("purged %d schedules after retention, want 1", len(purged))
+	}
+
+	resp, body = env.do(http.MethodGet, "/v1/schedules/"+id, "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	env := newTestEnv(t)
+	legacySunset.store(time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC))
+	t.Cleanup(func() { legacySunset.store(time.Time{}) })
+
+	resp, body := env.do(http.MethodGet, "/v1/instances/"+testInstance, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := resp.Header.Get("API-Version"); got != "v1" {
+		t.Errorf("API-Version = %q, want v1", got)
+	}
+	if resp.Header.Get("Deprecation") != "" {
+		t.Error("versioned route marked deprecated")
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/missing/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+
+	resp, body = env.do(http.MethodGet, "/check", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if resp.Header.Get("Deprecation") != "true" {
+		t.Errorf("Deprecation = %q on legacy route", resp.Header.Get("Deprecation"))
+	}
+	if got := resp.Header.Get("Sunset"); got != "Mon, 30 Jun 2025 00:00:00 GMT" {
+		t.Errorf("Sunset = %q", got)
+	}
+	if got, want := resp.Header.Get("Link"), `</v1/instances/`+testInstance+`>; rel="successor-version"`; got != want {
+		t.Errorf("Link = %q, want %q", got, want)
+	}
+
+	// The schedule routes served before /v1 keep working.
+	resp, body = env.do(http.MethodGet, "/schedules", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if got, want := resp.Header.Get("Link"), `</v1/schedules>; rel="successor-version"`; got != want || resp.Header.Get("Deprecation") != "true" {
+		t.Errorf("Deprecation = %q, Link = %q, want %q", resp.Header.Get("Deprecation"), got, want)
+	}
+	resp, body = env.do(http.MethodGet, "/schedules/missing", "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+	if got, want := resp.Header.Get("Link"), `</v1/schedules/missing>; rel="successor-version"`; got != want {
+		t.Errorf("Link = %q, want %q", got, want)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	env := newTestEnv(t)
+	admin := httptest.NewServer(newAdminMux())
+	t.Cleanup(admin.Close)
+
+	t.Setenv("PROJECT_ID", testProject)
+	t.Setenv("INSTANCE_ID", testInstance)
+	t.Setenv("PORT", "9090")
+	t.Setenv("CHECK_CACHE_TTL", "0")
+
+	reload := func() (int, map[string]interface{}) {
+		t.Helper()
+		resp, err := http.Post(admin.URL+"/admin/reload", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	status, body := reload()
+	if status != http.StatusOK {
+		t.Fatalf("reload: status %d, body %v", status, body)
+	}
+	data := body["data"].(map[string]interface{})
+	if !strings.Contains(fmt.Sprint(data["changed"]), "CheckCacheTTL") {
+		t.Errorf("changed = %v, want CheckCacheTTL", data["changed"])
+	}
+	if !strings.Contains(fmt.Sprint(data["restart_required"]), "Port") || port != "0" {
+		t.Errorf("restart_required = %v, port = %q: PORT must only apply on restart", data["restart_required"], port)
+	}
+	if inventoryCache.load().ttl != 0 {
+		t.Errorf("cache TTL = %v after reload, want 0", inventoryCache.load().ttl)
+	}
+
+	// Requests keep being served while a reload replaces the settings they
+	// read, go test -race flags any that are not published safely.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 5 {
+			if resp, err := http.Get(env.server.URL + "/v1/instances/" + testInstance); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+	for range 5 {
+		if status, body = reload(); status != http.StatusOK {
+			t.Errorf("reload during requests: status %d, body %v", status, body)
+		}
+	}
+	wg.Wait()
+
+	t.Setenv("CHECK_CACHE_TTL", "soon")
+	if status, body = reload(); status != http.StatusBadRequest {
+		t.Errorf("invalid config: status %d, body %v", status, body)
+	}
+	if activeConfig.load().CheckCacheTTL != 0 {
+		t.Errorf("invalid config was applied")
+	}
+}
+
+func TestTargetInstanceFromRequest(t *testing.T) {
+	env := newTestEnv(t)
+	env.fake.addInstance(&sqladmin.DatabaseInstance{
+		Name:            "reporting",
+		Project:         "analytics",
+		DatabaseVersion: "MYSQL_8_0",
+		Region:          "asia-southeast2",
+		Settings:        &sqladmin.Settings{Tier: "db-g1-small"},
+	})
+
+	resp, body := env.do(http.MethodGet, "/v1/projects/analytics/instances/reporting", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := dataField(body, "name"); got != "reporting" {
+		t.Errorf("name = %v, want reporting", got)
+	}
+
+	resp, body = env.do(http.MethodPost, "/stop?project=analytics&instance=reporting", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if got, want := resp.Header.Get("Link"), `</v1/projects/analytics/instances/reporting/stop>; rel="successor-version"`; got != want {
+		t.Errorf("Link = %q, want %q", got, want)
+	}
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Errorf("configured instance state = %s, only reporting should stop", state)
+	}
+
+	resp, body = env.do(http.MethodGet, "/v1/projects/analytics/instances/"+testInstance, "")
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+}
+
+func TestSyncSchedules(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodPost, "/v1/schedules", `{"instance":"sql-test","action":"start","cron":"0 8 * * 1-5"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	manual := dataField(body, "id").(string)
+
+	desired := `{"schedules":[
+		{"id":"dev-stop","instance":"sql-test","action":"stop","cron":"0 20 * * 1-5"},
+		{"id":"dev-start","instance":"sql-test","action":"start","cron":"0 7 * * 1-5","timezone":"Asia/Jakarta"}
+	]}`
+	counts := func(body map[string]interface{}) [4]int {
+		data := body["data"].(map[string]interface{})
+		return [4]int{len(data["created"].([]interface{})), len(data["updated"].([]interface{})), len(data["deleted"].([]interface{})), int(data["unchanged"].(float64))}
+	}
+
+	resp, body = env.do(http.MethodPut, "/v1/schedules?dry_run=true", desired)
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := counts(body); got != [4]int{2, 0, 1, 0} {
+		t.Errorf("dry run created/updated/deleted/unchanged = %v", got)
+	}
+	if items := schedules.list(false); len(items) != 1 || items[0].ID != manual {
+		t.Fatalf("dry run changed the schedules: %+v", items)
+	}
+
+	resp, body = env.do(http.MethodPut, "/v1/schedules", desired)
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := counts(body); got != [4]int{2, 0, 1, 0} {
+		t.Errorf("created/updated/deleted/unchanged = %v", got)
+	}
+	if _, err := schedules.get("dev-stop"); err != nil {
+		t.Error(err)
+	}
+	if schedule, _ := schedules.get(manual); schedule.DeletedAt == nil {
+		t.Error("schedule missing from the set not moved to the trash")
+	}
+
+	// Applying the same set again is a no-op.
+	resp, body = env.do(http.MethodPut, "/v1/schedules", desired)
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := counts(body); got != [4]int{0, 0, 0, 2} {
+		t.Errorf("second sync created/updated/deleted/unchanged = %v", got)
+	}
+
+	resp, body = env.do(http.MethodPut, "/v1/schedules", `{"schedules":[{"id":"dev-stop","instance":"sql-test","action":"stop","cron":"30 20 * * 1-5"}]}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := counts(body); got != [4]int{0, 1, 1, 0} {
+		t.Errorf("edit created/updated/deleted/unchanged = %v", got)
+	}
+	if schedule, _ := schedules.get("dev-stop"); schedule.Cron != "30 20 * * 1-5" {
+		t.Errorf("cron = %q after sync", schedule.Cron)
+	}
+
+	resp, body = env.do(http.MethodPut, "/v1/schedules", `{"schedules":[{"id":"a","instance":"sql-test","action":"stop","cron":"0 20 * * *"},{"id":"a","instance":"sql-test","action":"start","cron":"0 8 * * *"}]}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+}
+
+func TestSchedulerRunsDueSchedules(t *testing.T) {
+	env := newTestEnv(t)
+
+	// 16:00 in Jakarta when the test clock starts.
+	resp, body := env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"stop","cron":"0 20 * * 1-5","timezone":"Asia/Jakarta"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	if next := dataField(body, "next_run_at"); next != "2024-06-03T13:00:00Z" {
+		t.Errorf("next_run_at = %v", next)
+	}
+	id := dataField(body, "id").(string)
+
+	sched := newScheduler(schedules)
+	sched.now = env.clock
+	sched.last = env.clock()
+
+	env.advance(time.Hour)
+	sched.tick()
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Fatalf("state = %s before the schedule fired", state)
+	}
+
+	env.advance(3*time.Hour + time.Minute)
+	sched.tick()
+	env.advance(time.Minute)
+	if state := env.instance().State; state != "STOPPED" {
+		t.Fatalf("state = %s after the stop schedule fired", state)
+	}
+	if schedule, _ := schedules.get(id); schedule.LastRunAt == nil || schedule.LastError != "" {
+		t.Errorf("run not recorded: %+v", schedule)
+	}
+
+	// Edits to the file are picked up without a restart.
+	raw := `[{"project":"` + testProject + `","instance":"` + testInstance + `","action":"start","cron":"30 13 * * *"}]`
+	if err := os.WriteFile(schedules.path, []byte(raw), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := env.clock().Add(time.Minute)
+	os.Chtimes(schedules.path, future, future)
+
+	env.advance(30 * time.Minute)
+	sched.tick()
+	env.advance(time.Minute)
+	if items := schedules.list(false); len(items) != 1 || items[0].Action != scheduleActionStart {
+		t.Fatalf("schedules after reload = %+v", items)
+	}
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Errorf("state = %s after the reloaded start schedule fired", state)
+	}
+}
+
+func TestSchedulerCatchesUpAfterRestart(t *testing.T) {
+	env := newTestEnv(t)
+	checkpoint := filepath.Join(t.TempDir(), "scheduler-state.json")
+	restart := func() *scheduler {
+		sched := newScheduler(schedules)
+		sched.now, sched.checkpoint, sched.catchUp = env.clock, checkpoint, time.Hour
+		return sched
+	}
+
+	if restart().recover() {
+		t.Error("recovered without a checkpoint")
+	}
+	resp, body := env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"stop","cron":"30 9 * * *"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	id := dataField(body, "id").(string)
+	sched := restart()
+	sched.last = env.clock()
+	sched.tick()
+
+	// The process is down when the stop fires at 09:30.
+	env.advance(time.Hour)
+	sched = restart()
+	if !sched.recover() || !sched.last.Equal(time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC)) {
+		t.Fatalf("recovered from %s, want the last tick", sched.last)
+	}
+	sched.tick()
+	env.advance(simulatedStopLatency)
+	if state := env.instance().State; state != "STOPPED" {
+		t.Fatalf("state = %s, the missed stop was not caught up", state)
+	}
+	schedule, _ := schedules.get(id)
+	ranAt := *schedule.LastRunAt
+
+	// Runs recorded after the checkpoint are not repeated.
+	if _, err := state.write(checkpoint, []byte(`{"last_tick":"2024-06-03T09:00:00Z"}`)); err != nil {
+		t.Fatal(err)
+	}
+	env.advance(time.Minute)
+	sched = restart()
+	sched.recover()
+	sched.tick()
+	if schedule, _ := schedules.get(id); !schedule.LastRunAt.Equal(ranAt) {
+		t.Errorf("stop ran again at %s after the restart", schedule.LastRunAt)
+	}
+
+	// Runs older than the catch up window are dropped.
+	if _, err := state.write(checkpoint, []byte(`{"last_tick":"2024-06-02T09:00:00Z"}`)); err != nil {
+		t.Fatal(err)
+	}
+	sched = restart()
+	if !sched.recover() || !sched.last.Equal(env.clock().Add(-time.Hour)) {
+		t.Errorf("recovered from %s, want one hour ago", sched.last)
+	}
+}
+
+func TestTriggeredActionWithFakeClient(t *testing.T) {
+	fake := sqlctltest.NewFake()
+	fake.AddInstance(&sqladmin.DatabaseInstance{Name: testInstance, Project: testProject})
+	clientFor := sqlClientFor
+	sqlClientFor = func(string) (sqlctl.Client, error) { return fake, nil }
+	t.Cleanup(func() { sqlClientFor = clientFor })
+
+	stop := triggeredAction{Action: scheduleActionStop, Project: testProject, Instance: testInstance, Source: actionSourceSchedule}
+	operation, err := runTriggeredAction(context.Background(), stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if operation == nil || fake.Instance(testProject, testInstance).State != "STOPPED" {
+		t.Fatalf("instance not stopped, operation %+v", operation)
+	}
+	if done, err := operationDone(context.Background(), testProject, operation.Name); !done || err != nil {
+		t.Errorf("operationDone = %v, %v", done, err)
+	}
+
+	// Stopping again leaves the instance alone.
+	if operation, err := runTriggeredAction(context.Background(), stop); operation != nil || err != nil {
+		t.Errorf("second stop = %+v, %v", operation, err)
+	}
+	if calls := fake.Calls("PatchInstance"); calls != 1 {
+		t.Errorf("PatchInstance called %d times, want 1", calls)
+	}
+
+	stop.Instance = "missing"
+	if _, err := runTriggeredAction(context.Background(), stop); err == nil {
+		t.Error("stop of a missing instance succeeded")
+	}
+}
+
+func TestWakeProxy(t *testing.T) {
+	env := newTestEnv(t)
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+
+	env.fake.mu.Lock()
+	instance := env.fake.instances[testProject+"/"+testInstance]
+	instance.State, instance.Settings.ActivationPolicy = "STOPPED", "NEVER"
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+
+	// The database: an echo server.
+	database, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	go func() {
+		for {
+			conn, err := database.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	proxy, err := newWakeProxy(WakeProxyConfig{
+		Listen:       "127.0.0.1:0",
+		Target:       database.Addr().String(),
+		Project:      testProject,
+		Instance:     testInstance,
+		StartTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		proxy.run(stop)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+
+	// Both connections share one start.
+	var wg sync.WaitGroup
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			ping := fmt.Sprintf("ping %d", i)
+			if _, err := conn.Write([]byte(ping)); err != nil {
+				t.Error(err)
+				return
+			}
+			reply := make([]byte, len(ping))
+			if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != ping {
+				t.Errorf("reply = %q, %v", reply, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Errorf("state = %s after a connection through the proxy", state)
+	}
+	env.fake.mu.Lock()
+	starts := 0
+	for _, operation := range env.fake.operations {
+		if operation.op.OperationType == "UPDATE" {
+			starts++
+		}
+	}
+	env.fake.mu.Unlock()
+	if starts != 1 {
+		t.Errorf("%d patches, want 1", starts)
+	}
+
+	// Connections to the running instance are forwarded on its cached state.
+	counting := &countingTransport{base: http.DefaultTransport}
+	sqlAdminTransport.store(counting)
+	resetSQLAdminService()
+	t.Cleanup(func() {
+		sqlAdminTransport.store(nil)
+		resetSQLAdminService()
+	})
+	for i := range 3 {
+		conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		ping := fmt.Sprintf("again %d", i)
+		conn.Write([]byte(ping))
+		reply := make([]byte, len(ping))
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != ping {
+			t.Errorf("reply = %q, %v", reply, err)
+		}
+		conn.Close()
+	}
+	if calls := counting.calls.Load(); calls != 0 {
+		t.Errorf("%d SQL Admin calls for connections to a running instance, want 0", calls)
+	}
+}
+
+// countingTransport counts the requests made through it.
+type countingTransport struct {
+	base  http.RoundTripper
+	calls atomic.Int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.calls.Add(1)
+	return c.base.RoundTrip(req)
+}
+
+func TestWaitForOperation(t *testing.T) {
+	env := newTestEnv(t)
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop?wait=true&timeout=50ms", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusRequestTimeout)
+	if body["message_code"] != "operation_timed_out" {
+		t.Errorf("message_code = %v", body["message_code"])
+	}
+
+	env.advance(time.Minute)
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/start?wait=true", `{"ActivationPolicy":"ALWAYS"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	data := body["data"].(map[string]interface{})
+	if status := data["operation"].(map[string]interface{})["status"]; status != "DONE" {
+		t.Errorf("operation status = %v, want DONE", status)
+	}
+	if state := data["instance"].(map[string]interface{})["state"]; state != "RUNNABLE" {
+		t.Errorf("instance state = %v, want RUNNABLE", state)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop?wait=true&timeout=soon", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Errorf("state = %s, a rejected request must not stop the instance", state)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	env := newTestEnv(t)
+	interval, probeInterval := waitPollInterval, warmUpProbeInterval
+	waitPollInterval, warmUpProbeInterval = 10*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { waitPollInterval, warmUpProbeInterval = interval, probeInterval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	_, port, _ := net.SplitHostPort(address)
+	portNumber, _ := strconv.Atoi(port)
+	listener.Close()
+
+	env.fake.mu.Lock()
+	env.fake.instances[testProject+"/"+testInstance].IpAddresses = []*sqladmin.IpMapping{
+		{Type: "PRIMARY", IpAddress: "192.0.2.10"},
+		{Type: "PRIVATE", IpAddress: "127.0.0.1"},
+	}
+	env.fake.mu.Unlock()
+	warmUp.store(WarmUpConfig{Probe: warmUpProbeTCP, IPType: warmUpIPPrivate, Port: portNumber, Timeout: 100 * time.Millisecond})
+	t.Cleanup(func() { warmUp.store(WarmUpConfig{}) })
+
+	env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop?wait=true", `{"ActivationPolicy":"NEVER"}`)
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/start?wait=true", `{"ActivationPolicy":"ALWAYS"}`)
+	expectStatus(t, resp, body, http.StatusGatewayTimeout)
+	if body["message_code"] != "warm_up_failed" {
+		t.Errorf("message_code = %v, want warm_up_failed while nothing listens", body["message_code"])
+	}
+
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop?wait=true", `{"ActivationPolicy":"NEVER"}`)
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/start?wait=true", `{"ActivationPolicy":"ALWAYS"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	warm, _ := body["data"].(map[string]interface{})["warm_up"].(map[string]interface{})
+	if warm["address"] != address {
+		t.Errorf("warm_up = %v, want the private IP on %s probed", warm, port)
+	}
+
+	if got := defaultDatabasePort("MYSQL_8_0"); got != 3306 {
+		t.Errorf("MySQL port = %d", got)
+	}
+}
+
+func TestCredentialProvider(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+
+	if _, ok := newCredentialProvider("", "").(adcCredentials); !ok {
+		t.Error("ADC not used by default")
+	}
+	if got := newCredentialProvider("/secrets/key.json", ""); got != (keyFileCredentials{path: "/secrets/key.json"}) {
+		t.Errorf("explicit key file: got %v", got)
+	}
+
+	if err := os.WriteFile(legacyCredentialsFile, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := newCredentialProvider("", ""); got != (keyFileCredentials{path: legacyCredentialsFile}) {
+		t.Errorf("legacy key file: got %v", got)
+	}
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "/secrets/adc.json")
+	if _, ok := newCredentialProvider("", "").(adcCredentials); !ok {
+		t.Error("GOOGLE_APPLICATION_CREDENTIALS must win over the legacy key file")
+	}
+}
+
+func TestProjectCredentials(t *testing.T) {
+	t.Setenv("PROJECT_ID", "dev")
+	t.Setenv("INSTANCE_ID", "db")
+	t.Setenv("PROJECT_CREDENTIALS", "prod=/secrets/prod.json,stage=adc,ops=impersonate:sql-scheduler@ops.iam.gserviceaccount.com")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(cfg.Projects, []string{"dev", "ops", "prod", "stage"}) {
+		t.Errorf("projects = %v, want the projects with credentials added", cfg.Projects)
+	}
+
+	previous := projectCredentials.load()
+	projectCredentials.store(newProjectCredentialProviders(cfg.ProjectCredentials, credentials.load()))
+	sqlAdminOffline.store(true)
+	resetSQLAdminService()
+	t.Cleanup(func() {
+		projectCredentials.store(previous)
+		sqlAdminOffline.store(false)
+		resetSQLAdminService()
+	})
+
+	if got := credentialsFor("prod"); got != (keyFileCredentials{path: "/secrets/prod.json"}) {
+		t.Errorf("prod credentials = %v", got)
+	}
+	if got := credentialsFor("dev"); got != credentials.load() {
+		t.Errorf("dev credentials = %v, want the default", got)
+	}
+	if got, ok := credentialsFor("ops").(*impersonatedCredentials); !ok || got.target != "sql-scheduler@ops.iam.gserviceaccount.com" || got.base != credentials.load() {
+		t.Errorf("ops credentials = %v", credentialsFor("ops"))
+	}
+
+	configureImpersonation("sql-scheduler@{project}.iam.gserviceaccount.com")
+	t.Cleanup(func() { configureImpersonation("") })
+	impersonated, ok := credentialsFor("dev").(*impersonatedCredentials)
+	if !ok || impersonated.target != "sql-scheduler@dev.iam.gserviceaccount.com" || credentialsFor("dev") != impersonated {
+		t.Errorf("dev credentials = %v, want the dev account impersonated", credentialsFor("dev"))
+	}
+	if _, ok := credentialsFor("prod").(keyFileCredentials); !ok {
+		t.Errorf("prod credentials = %v, want PROJECT_CREDENTIALS to win", credentialsFor("prod"))
+	}
+	configureImpersonation("")
+
+	dev, _ := sqlAdminService("dev")
+	stage, _ := sqlAdminService("stage")
+	prod, _ := sqlAdminService("prod")
+	if dev != stage || dev == prod {
+		t.Error("projects must share a client exactly when they share credentials")
+	}
+
+	for _, value := range []string{"prod", "prod=impersonate:prod"} {
+		t.Setenv("PROJECT_CREDENTIALS", value)
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "PROJECT_CREDENTIALS") {
+			t.Errorf("%s: err = %v, want PROJECT_CREDENTIALS rejected", value, err)
+		}
+	}
+	t.Setenv("PROJECT_CREDENTIALS", "")
+	t.Setenv("IMPERSONATE_SERVICE_ACCOUNT", "sql-scheduler")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "IMPERSONATE_SERVICE_ACCOUNT") {
+		t.Errorf("err = %v, want IMPERSONATE_SERVICE_ACCOUNT rejected", err)
+	}
+}
+
+func TestSecretManager(t *testing.T) {
+	var mu sync.Mutex
+	secrets := map[string]string{
+		"projects/ops/secrets/api-keys/versions/latest": "key-one,key-two",
+		"projects/ops/secrets/api-keys/versions/1":      "key-zero",
+		"projects/ops/secrets/slack/versions/latest":    "https://hooks.slack.com/services/one",
+		"projects/ops/secrets/sa-key/versions/latest":   `{"type":"service_account","client_email":"scheduler@ops.iam.gserviceaccount.com"}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), ":access")
+		value, ok := secrets[name]
+		if !ok {
+			http.Error(w, `{"error":{"code":404,"message":"secret not found"}}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":    name,
+			"payload": map[string]string{"data": base64.StdEncoding.EncodeToString([]byte(value))},
+		})
+	}))
+	t.Cleanup(server.Close)
+	secretManagerEndpoint = server.URL + "/"
+	t.Cleanup(func() { secretManagerEndpoint = "" })
+
+	newTestEnv(t)
+	t.Setenv("PROJECT_ID", testProject)
+	t.Setenv("INSTANCE_ID", testInstance)
+	t.Setenv("AUTH_API_KEYS", "secret:projects/ops/secrets/api-keys")
+	t.Setenv("CREDENTIALS_JSON", "secret:projects/ops/secrets/sa-key")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(cfg.Auth.APIKeys, []string{"key-one", "key-two"}) {
+		t.Errorf("API keys = %v, want the latest version of the secret", cfg.Auth.APIKeys)
+	}
+	if got := cfg.Secrets["AUTH_API_KEYS"]; got != secretDigest("key-one,key-two") {
+		t.Errorf("secrets = %v, want the digest of AUTH_API_KEYS", cfg.Secrets)
+	}
+	if got := newCredentialProvider(cfg.CredentialsFile, cfg.CredentialsJSON).String(); got != "key of scheduler@ops.iam.gserviceaccount.com" {
+		t.Errorf("credentials = %q, want the key from Secret Manager", got)
+	}
+
+	t.Setenv("AUTH_API_KEYS", "secret:projects/ops/secrets/api-keys/versions/1")
+	if cfg, err = loadConfig(); err != nil || !slices.Equal(cfg.Auth.APIKeys, []string{"key-zero"}) {
+		t.Errorf("pinned version: keys = %v, err = %v", cfg.Auth.APIKeys, err)
+	}
+	for _, value := range []string{"secret:api-keys", "secret:projects/ops/secrets/missing"} {
+		t.Setenv("AUTH_API_KEYS", value)
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "AUTH_API_KEYS") {
+			t.Errorf("%s: err = %v, want AUTH_API_KEYS rejected", value, err)
+		}
+	}
+	t.Setenv("AUTH_API_KEYS", "")
+	t.Setenv("CREDENTIALS_JSON", "")
+
+	// The refresh applies a rotated secret and leaves the configuration
+	// alone while nothing changed.
+	t.Setenv("NOTIFY_SLACK_WEBHOOK_URL", "secret:projects/ops/secrets/slack")
+	refreshSecrets(context.Background())
+	if got := activeConfig.load().Notify.SlackWebhookURL; got != "https://hooks.slack.com/services/one" {
+		t.Fatalf("webhook = %q, want the secret applied", got)
+	}
+	applied := activeConfig.load()
+	refreshSecrets(context.Background())
+	if activeConfig.load() != applied {
+		t.Error("configuration reloaded although no secret changed")
+	}
+
+	mu.Lock()
+	secrets["projects/ops/secrets/slack/versions/latest"] = "https://hooks.slack.com/services/two"
+	mu.Unlock()
+	refreshSecrets(context.Background())
+	if got := activeConfig.load().Notify.SlackWebhookURL; got != "https://hooks.slack.com/services/two" {
+		t.Errorf("webhook = %q after rotation, want the new version", got)
+	}
+}
+
+func TestStopByLabel(t *testing.T) {
+	env := newTestEnv(t)
+	fleet := map[string]string{"dev-api": "ALWAYS", "dev-jobs": "NEVER", "prod-api": "ALWAYS"}
+	for name, policy := range fleet {
+		env.fake.addInstance(&sqladmin.DatabaseInstance{
+			Name:     name,
+			Project:  testProject,
+			Settings: &sqladmin.Settings{ActivationPolicy: policy, UserLabels: map[string]string{"env": name[:strings.Index(name, "-")], "auto-schedule": "true"}},
+		})
+	}
+
+	resp, body := env.do(http.MethodPost, "/v1/stop-by-label", `{"labels":{}}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body = env.do(http.MethodPost, "/v1/stop-by-label", `{"labels":{"env":"dev","auto-schedule":"true"}}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if matched, changed := dataField(body, "matched"), dataField(body, "changed"); matched != 2.0 || changed != 1.0 {
+		t.Errorf("matched %v, changed %v, want 2 and 1", matched, changed)
+	}
+
+	env.advance(time.Minute)
+	env.fake.mu.Lock()
+	defer env.fake.mu.Unlock()
+	env.fake.advance()
+	for name, want := range map[string]string{"dev-api": "STOPPED", "dev-jobs": "STOPPED", "prod-api": "RUNNABLE", testInstance: "RUNNABLE"} {
+		if state := env.fake.instances[testProject+"/"+name].State; state != want {
+			t.Errorf("%s state = %s, want %s", name, state, want)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	env := newTestEnv(t)
+	authenticators.store(AuthConfig{
+		APIKeys:      []string{"old-key", "new-key"},
+		HMACSecret:   "shh",
+		OIDCAudience: "https://scheduler.example.com",
+		OIDCEmails:   []string{"scheduler@test-project.iam.gserviceaccount.com"},
+	}.authenticators())
+
+	validate := validateIDToken
+	validateIDToken = func(ctx context.Context, token string, audience string) (*idtoken.Payload, error) {
+		if token == "forged" {
+			return nil, errors.New("bad signature")
+		}
+		email, unverified := strings.CutPrefix(token, "unverified:")
+		return &idtoken.Payload{Audience: audience, Claims: map[string]interface{}{"email": email, "email_verified": !unverified}}, nil
+	}
+	t.Cleanup(func() { validateIDToken = validate })
+
+	resp, body := env.do(http.MethodGet, "/check", "")
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+
+	resp, body = env.do(http.MethodGet, "/check", "", "X-API-Key", "new-key")
+	expectStatus(t, resp, body, http.StatusOK)
+	resp, body = env.do(http.MethodGet, "/check", "", "X-API-Key", "guess")
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+
+	path, payload := "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := "sha256=" + hex.EncodeToString(signRequest([]byte("shh"), timestamp, http.MethodPost, path, []byte(payload)))
+	resp, body = env.do(http.MethodPost, path, `{"ActivationPolicy":"ALWAYS"}`, "X-Signature", signature, "X-Signature-Timestamp", timestamp)
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+	resp, body = env.do(http.MethodPost, path, payload, "X-Signature", signature, "X-Signature-Timestamp", timestamp)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	resp, body = env.do(http.MethodGet, "/check", "", "Authorization", "Bearer scheduler@test-project.iam.gserviceaccount.com")
+	expectStatus(t, resp, body, http.StatusOK)
+	resp, body = env.do(http.MethodGet, "/check", "", "Authorization", "Bearer intruder@example.com")
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+	resp, body = env.do(http.MethodGet, "/check", "", "Authorization", "Bearer forged")
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+	resp, body = env.do(http.MethodGet, "/check", "", "Authorization", "Bearer unverified:scheduler@test-project.iam.gserviceaccount.com")
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+
+	// Tokens for the audience alone would let in any Google account.
+	if err := (AuthConfig{OIDCAudience: "https://scheduler.example.com"}).validate(); err == nil || !strings.Contains(err.Error(), "AUTH_OIDC_EMAILS") {
+		t.Errorf("validate() = %v, want AUTH_OIDC_EMAILS required", err)
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	env := newTestEnv(t)
+	env.fake.addInstance(&sqladmin.DatabaseInstance{Name: "prod-db", Project: testProject, Settings: &sqladmin.Settings{UserLabels: map[string]string{"env": "dev"}}})
+	auth := AuthConfig{APIKeys: []string{"cron-key", "admin-key", "viewer-key"}}
+	authenticators.store(auth.authenticators())
+	accessPolicy.store(AccessConfig{
+		Roles: map[string]AccessRole{
+			"nightly-stop": {Actions: []string{scheduleActionStop}, Instances: []string{"test-*"}},
+			"viewer":       {Actions: []string{auditActionCheck}, Instances: []string{"test-*"}},
+			"admin":        {Actions: []string{accessActionAny}},
+		},
+		Bindings: []AccessBinding{
+			{Principals: []string{"api-key#1"}, Roles: []string{"nightly-stop"}},
+			{Principals: []string{"api-key#2"}, Roles: []string{"admin"}},
+			{Principals: []string{"api-key#3"}, Roles: []string{"viewer"}},
+		},
+	})
+	if err := accessPolicy.load().validate(auth); err != nil {
+		t.Fatal(err)
+	}
+	cron, admin, viewer := []string{"X-API-Key", "cron-key"}, []string{"X-API-Key", "admin-key"}, []string{"X-API-Key", "viewer-key"}
+
+	// The event stream only carries the instances the caller may check.
+	events = newEventHub()
+	events.configure(10 * time.Millisecond)
+	t.Cleanup(func() { events.close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, env.server.URL+"/v1/events", nil)
+	req.Header.Set(viewer[0], viewer[1])
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stream.Body.Close() })
+	streamed := make(chan InstanceEvent, 16)
+	go func() {
+		scanner := bufio.NewScanner(stream.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var event InstanceEvent
+				json.Unmarshal([]byte(data), &event)
+				streamed <- event
+			}
+		}
+	}()
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/prod-db/stop", `{"ActivationPolicy":"NEVER"}`, cron...)
+	expectStatus(t, resp, body, http.StatusForbidden)
+	if body["message_code"] != string(msgForbidden) {
+		t.Errorf("message_code = %v, want %s", body["message_code"], msgForbidden)
+	}
+	resp, body = env.do(http.MethodGet, "/v1/instances/"+testInstance, "", cron...)
+	expectStatus(t, resp, body, http.StatusForbidden)
+	resp, body = env.do(http.MethodGet, "/v1/schedules", "", cron...)
+	expectStatus(t, resp, body, http.StatusForbidden)
+	resp, body = env.do(http.MethodGet, "/v1/instances/"+testInstance+"/users", "", cron...)
+	expectStatus(t, resp, body, http.StatusForbidden)
+
+	resp, body = env.do(http.MethodPost, "/v1/stop-by-label", `{"labels":{"env":"dev"}}`, cron...)
+	expectStatus(t, resp, body, http.StatusOK)
+	for _, result := range dataField(body, "results").([]interface{}) {
+		result := result.(map[string]interface{})
+		if want := map[string]string{"prod-db": "skipped", testInstance: "changed"}[result["instance"].(string)]; result["outcome"] != want {
+			t.Errorf("%v: outcome %v, want %s", result["instance"], result["outcome"], want)
+		}
+	}
+	resp, body = env.do(http.MethodPost, "/v1/start-by-label", `{"labels":{"env":"dev"}}`, cron...)
+	expectStatus(t, resp, body, http.StatusForbidden)
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/prod-db/stop", `{"ActivationPolicy":"NEVER"}`, admin...)
+	expectStatus(t, resp, body, http.StatusOK)
+	resp, body = env.do(http.MethodGet, "/v1/schedules", "", admin...)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	// Listings and savings only show the instances the caller may check.
+	names := func(path string, list string, field string) []string {
+		t.Helper()
+		resp, body := env.do(http.MethodGet, path, "", viewer...)
+		expectStatus(t, resp, body, http.StatusOK)
+		var names []string
+		for _, item := range dataField(body, list).([]interface{}) {
+			names = append(names, item.(map[string]interface{})[field].(string))
+		}
+		return names
+	}
+	for _, path := range []string{"/v1/instances", "/v1/projects/" + testProject + "/instances"} {
+		if got := names(path, "instances", "name"); !slices.Equal(got, []string{testInstance}) {
+			t.Errorf("%s listed %v, want only %s", path, got, testInstance)
+		}
+	}
+	if got := names("/v1/stores?kind=cloudsql", "stores", "name"); !slices.Equal(got, []string{testInstance}) {
+		t.Errorf("stores = %v, want only %s", got, testInstance)
+	}
+	if got := names("/v1/savings", "instances", "instance"); slices.Contains(got, "prod-db") {
+		t.Errorf("savings = %v, want prod-db left out", got)
+	}
+	var streamedInstances []string
+collect:
+	for quiet := time.After(5 * time.Second); ; {
+		select {
+		case event := <-streamed:
+			streamedInstances = append(streamedInstances, event.Instance)
+			quiet = time.After(200 * time.Millisecond)
+		case <-quiet:
+			break collect
+		}
+	}
+	if len(streamedInstances) == 0 || slices.ContainsFunc(streamedInstances, func(name string) bool { return name != testInstance }) {
+		t.Errorf("streamed events of %v, want only %s", streamedInstances, testInstance)
+	}
+
+	entries, err := auditLog.query(context.Background(), auditQuery{Principal: "api-key#1", Action: scheduleActionStop, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || entries[len(entries)-1].StatusCode != http.StatusForbidden {
+		t.Errorf("audit entries = %+v, want the refused stop", entries)
+	}
+
+	invalid := AccessConfig{
+		Roles:    map[string]AccessRole{"broken": {Actions: []string{"drop"}, Instances: []string{"["}}},
+		Bindings: []AccessBinding{{Principals: []string{"api-key#1"}, Roles: []string{"missing"}}},
+	}
+	err = invalid.validate(AuthConfig{})
+	for _, want := range []string{"require authentication", `"drop" is not one of`, "access.roles.broken.instances[0]", `"missing" is not a role`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("validate() = %v, want %q reported", err, want)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	env := newTestEnv(t)
+	env.fake.addInstance(&sqladmin.DatabaseInstance{Name: "prod-db", Project: testProject, Settings: &sqladmin.Settings{
+		UserLabels:        map[string]string{"env": "prod"},
+		MaintenanceWindow: &sqladmin.MaintenanceWindow{Day: 6, Hour: 2},
+	}})
+	env.fake.addInstance(&sqladmin.DatabaseInstance{Name: "dev-db", Project: testProject, Settings: &sqladmin.Settings{UserLabels: map[string]string{"env": "dev"}}})
+	policies.store(Policies{
+		{Name: "never-stop-prod", Description: "production runs around the clock", Actions: []string{scheduleActionStop}, Labels: map[string]string{"env": "prod"}},
+		{Name: "tier-in-maintenance-window", Actions: []string{scheduleActionScale}, Instances: []string{"prod-*"}, OutsideMaintenanceWindow: true},
+	})
+	if err := policies.load().validate(); err != nil {
+		t.Fatal(err)
+	}
+	// Saturday 01:30 UTC, half an hour before the maintenance window.
+	now := time.Date(2024, 6, 1, 1, 30, 0, 0, time.UTC)
+	policyNow = func() time.Time { return now }
+	t.Cleanup(func() { policyNow = time.Now })
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/prod-db/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusForbidden)
+	if body["message_code"] != string(msgPolicyViolation) || body["policy"] != "never-stop-prod" || body["error_type"] != "policy_violation" {
+		t.Errorf("blocked stop answered %v", body)
+	}
+	resp, body = env.do(http.MethodPost, "/v1/instances/dev-db/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	// Reads are never blocked.
+	resp, body = env.do(http.MethodGet, "/v1/instances/prod-db/settings", "")
+	if resp.StatusCode == http.StatusForbidden {
+		t.Errorf("read blocked: %v", body)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/prod-db/tier", `{"tier":"db-g1-small"}`)
+	expectStatus(t, resp, body, http.StatusForbidden)
+	if body["policy"] != "tier-in-maintenance-window" {
+		t.Errorf("policy = %v, want tier-in-maintenance-window", body["policy"])
+	}
+	// Scale schedules are held to the same rules.
+	_, err := runTriggeredAction(context.Background(), triggeredAction{Action: scheduleActionScale, Tier: "db-g1-small", Project: testProject, Instance: "prod-db", Source: actionSourceSchedule, TriggeredBy: "schedule nightly"})
+	if !errors.Is(err, errPolicyViolation) {
+		t.Errorf("scheduled scale = %v, want it blocked", err)
+	}
+	env.fake.mu.Lock()
+	tier := env.fake.instances[testProject+"/prod-db"].Settings.Tier
+	env.fake.mu.Unlock()
+	if tier != "" {
+		t.Errorf("tier = %s, want prod-db left alone", tier)
+	}
+	now = now.Add(time.Hour)
+	resp, body = env.do(http.MethodPost, "/v1/instances/prod-db/tier?dry_run=true", `{"tier":"db-g1-small"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	resp, body = env.do(http.MethodPost, "/v1/stop-by-label", `{"labels":{"env":"prod"}}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	results := dataField(body, "results").([]interface{})
+	if len(results) != 1 || results[0].(map[string]interface{})["outcome"] != bulkOutcomeSkipped || !strings.Contains(results[0].(map[string]interface{})["reason"].(string), "never-stop-prod") {
+		t.Errorf("results = %v, want prod-db skipped by the policy", results)
+	}
+
+	// The data store API and chain steps are held to the same rules.
+	resp, body = env.do(http.MethodPost, "/v1/stores/cloudsql/asia-southeast2/prod-db/stop", "")
+	expectStatus(t, resp, body, http.StatusForbidden)
+	if body["policy"] != "never-stop-prod" {
+		t.Errorf("store stop answered %v, want it blocked by never-stop-prod", body)
+	}
+	chain := Chain{ID: "prod", Steps: []ChainStep{{ID: "db", Instance: "prod-db"}}}
+	chainResults, err := runChain(context.Background(), chain, triggeredAction{Action: scheduleActionStop, Project: testProject, Source: actionSourceSchedule})
+	if err == nil || len(chainResults) != 1 || chainResults[0].Outcome != bulkOutcomeFailed || !strings.Contains(chainResults[0].Error, "never-stop-prod") {
+		t.Errorf("chain stop = %+v, %v, want the step blocked by never-stop-prod", chainResults, err)
+	}
+
+	_, err = runTriggeredAction(context.Background(), triggeredAction{Action: scheduleActionStop, Project: testProject, Instance: "prod-db", Source: actionSourceSchedule, TriggeredBy: "schedule nightly"})
+	if !errors.Is(err, errPolicyViolation) {
+		t.Errorf("scheduled stop = %v, want it blocked", err)
+	}
+	env.fake.mu.Lock()
+	policy := env.fake.instances[testProject+"/prod-db"].Settings.ActivationPolicy
+	env.fake.mu.Unlock()
+	if policy != "ALWAYS" {
+		t.Errorf("activation policy = %s, want prod-db left running", policy)
+	}
+
+	invalid := Policies{{Actions: []string{"drop"}}, {Name: "a", Actions: []string{"*"}}, {Name: "a", Actions: []string{"stop"}, Projects: []string{"["}}}
+	err = invalid.validate()
+	for _, want := range []string{"policies[0].name: is required", `"drop" is not one of`, `"a" is already used by policies[1]`, "policies[2].projects[0]"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("validate() = %v, want %q reported", err, want)
+		}
+	}
+}
+
+func TestListInstances(t *testing.T) {
+	env := newTestEnv(t)
+	for i := 0; i < 5; i++ {
+		policy := "ALWAYS"
+		if i%2 == 1 {
+			policy = "NEVER"
+		}
+		env.fake.addInstance(&sqladmin.DatabaseInstance{
+			Name:     fmt.Sprintf("dev-%d", i),
+			Project:  testProject,
+			Region:   "us-central1",
+			Settings: &sqladmin.Settings{ActivationPolicy: policy, UserLabels: map[string]string{"env": "dev"}},
+		})
+	}
+
+	_, body := env.do(http.MethodGet, "/v1/instances?label=env=dev&page_size=2", "")
+	var names []string
+	for token := "start"; token != ""; {
+		data := body["data"].(map[string]interface{})
+		if data["total_size"] != 6.0 {
+			t.Fatalf("total_size = %v, want 6", data["total_size"])
+		}
+		for _, item := range data["instances"].([]interface{}) {
+			names = append(names, item.(map[string]interface{})["name"].(string))
+		}
+		token, _ = data["next_page_token"].(string)
+		if token != "" {
+			_, body = env.do(http.MethodGet, "/v1/instances?label=env=dev&page_size=2&page_token="+token, "")
+		}
+	}
+	if got := strings.Join(names, ","); got != "dev-0,dev-1,dev-2,dev-3,dev-4,"+testInstance {
+		t.Errorf("paged names = %s", got)
+	}
+
+	_, body = env.do(http.MethodGet, "/v1/instances?state=STOPPED&region=us-central1", "")
+	if total := dataField(body, "total_size"); total != 2.0 {
+		t.Errorf("stopped in us-central1 = %v, want 2", total)
+	}
+
+	resp, body := env.do(http.MethodGet, "/v1/instances?label=env&page_size=-1", "")
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	if errs := body["errors"].([]interface{}); len(errs) != 2 {
+		t.Errorf("errors = %v, want label and page_size", errs)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	env := newTestEnv(t)
+	admin := httptest.NewServer(newAdminMux())
+	t.Cleanup(admin.Close)
+
+	env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`)
+	env.do(http.MethodPost, "/v1/instances/missing/stop", `{"ActivationPolicy":"NEVER"}`)
+
+	resp, err := http.Get(admin.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+
+	for _, want := range []string{
+		`scheduler_db_actions_total{action="stop",reason="",result="success",source="api"}`,
+		`scheduler_db_actions_total{action="stop",reason="googleapi_404",result="failure",source="api"}`,
+		`scheduler_db_instance_state{instance="` + testInstance + `",project="` + testProject + `",state="RUNNABLE"} 1`,
+		`scheduler_db_sqladmin_request_duration_seconds_count{code="200",method="patch"}`,
+	} {
+		if !strings.Contains(string(raw), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	env := newTestEnv(t)
+	env.fake.addInstance(&sqladmin.DatabaseInstance{Name: "pay-db", Project: testProject, Settings: &sqladmin.Settings{}})
+	authenticators.store(AuthConfig{APIKeys: []string{"platform-key"}}.authenticators())
+	items := []Tenant{{Name: "payments", Project: testProject, Instances: []string{"pay-*"}, Actions: []string{scheduleActionStart, scheduleActionStop}, APIKeys: []string{"team-key"}}}
+	if err := validateTenants(items, nil); err != nil {
+		t.Fatal(err)
+	}
+	tenants.store(indexTenants(items))
+	team, platform := []string{"X-API-Key", "team-key"}, []string{"X-API-Key", "platform-key"}
+
+	resp, body := env.do(http.MethodPost, "/t/payments/v1/instances/pay-db/stop", `{"ActivationPolicy":"NEVER"}`, team...)
+	expectStatus(t, resp, body, http.StatusOK)
+	resp, body = env.do(http.MethodPost, "/t/payments/v1/instances/pay-db/stop", `{"ActivationPolicy":"NEVER"}`, platform...)
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+	resp, body = env.do(http.MethodPost, "/t/payments/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`, team...)
+	expectStatus(t, resp, body, http.StatusForbidden)
+	resp, body = env.do(http.MethodPost, "/t/payments/v1/instances/pay-db/restart", "", team...)
+	expectStatus(t, resp, body, http.StatusForbidden)
+	env.advance(10 * time.Minute)
+	resp, body = env.do(http.MethodPost, "/t/payments/v1/instances/pay-db/start?project=other", "", team...)
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(10 * time.Minute)
+	env.fake.mu.Lock()
+	env.fake.advance()
+	policy := env.fake.instances[testProject+"/pay-db"].Settings.ActivationPolicy
+	env.fake.mu.Unlock()
+	if policy != "ALWAYS" {
+		t.Errorf("activation policy = %s, want pay-db of the tenant's project started", policy)
+	}
+	resp, body = env.do(http.MethodGet, "/t/billing/v1/instances/pay-db", "", team...)
+	expectStatus(t, resp, body, http.StatusNotFound)
+	if body["message_code"] != string(msgTenantNotFound) {
+		t.Errorf("message_code = %v, want %s", body["message_code"], msgTenantNotFound)
+	}
+	// Tenant keys don't open the rest of the API.
+	resp, body = env.do(http.MethodGet, "/v1/schedules", "", team...)
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+
+	entries, err := auditLog.query(context.Background(), auditQuery{Principal: "tenant:payments/api-key#1", Action: scheduleActionStop, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("audit entries = %+v, want both stops of the tenant", entries)
+	}
+
+	declared := []DeclaredSchedule{
+		{ID: "nightly", ScheduleRequest: ScheduleRequest{Instance: "pay-db", Action: scheduleActionStop, Cron: "0 20 * * *"}},
+		{ID: "other", ScheduleRequest: ScheduleRequest{Instance: testInstance, Action: scheduleActionStop, Cron: "0 20 * * *"}},
+	}
+	_, err = tenantSchedules([]Tenant{{Name: "payments", Project: testProject, Instances: []string{"pay-*"}, Schedules: declared}}, []Schedule{{ID: "payments.nightly"}})
+	for _, want := range []string{`"payments.nightly" is used twice`, `tenants[0].schedules[1].instance: "` + testInstance + `" is not an instance of the tenant`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("tenantSchedules() = %v, want %q reported", err, want)
+		}
+	}
+	scheduled, err := tenantSchedules([]Tenant{{Name: "payments", Project: "pay-project", Instances: []string{"pay-*"}, Schedules: declared[:1]}}, nil)
+	if err != nil || len(scheduled) != 1 || scheduled[0].ID != "payments.nightly" || scheduled[0].Project != "pay-project" {
+		t.Errorf("tenantSchedules() = %+v, %v", scheduled, err)
+	}
+
+	invalid := []Tenant{
+		{Name: "Payments", Project: "a", Credentials: "impersonate:nobody"},
+		{Name: "search", Project: "b", Instances: []string{"*"}, APIKeys: []string{"k"}, Credentials: "/secrets/b.json"},
+		{Name: "search", Project: "b", Instances: []string{"*"}, APIKeys: []string{"k"}, Credentials: "/secrets/other.json"},
+	}
+	err = validateTenants(invalid, map[string]string{"a": "adc"})
+	for _, want := range []string{"tenants[0].name", "tenants[0].api_keys", "tenants[0].instances", "tenants[0].credentials", `"search" is already used`, "tenants[2].credentials: project \"b\" already has other credentials"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("validateTenants() = %v, want %q reported", err, want)
+		}
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`
+project_id: from-file
+instance_id: db-file
+projects: [from-file, analytics]
+server:
+  port: "8080"
+  check_cache_ttl: 10s
+auth:
+  api_keys: [k1, k2]
+schedules:
+  items:
+    - id: weekday-stop
+      instance: db-file
+      action: stop
+      cron: "0 20 * * 1-5"
+      timezone: Asia/Jakarta
+`)
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("PORT", "9090")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ProjectID != "from-file" || cfg.Port != "9090" || cfg.CheckCacheTTL != 10*time.Second {
+		t.Errorf("project %q, port %q, ttl %v: want file values with PORT from the environment", cfg.ProjectID, cfg.Port, cfg.CheckCacheTTL)
+	}
+	if len(cfg.Projects) != 2 || len(cfg.Auth.APIKeys) != 2 {
+		t.Errorf("projects %v, api keys %v", cfg.Projects, cfg.Auth.APIKeys)
+	}
+	if len(cfg.DeclaredSchedules) != 1 || cfg.DeclaredSchedules[0].ID != "weekday-stop" || cfg.DeclaredSchedules[0].Project != "from-file" {
+		t.Fatalf("declared schedules = %+v", cfg.DeclaredSchedules)
+	}
+
+	store := newScheduleStore(filepath.Join(dir, "schedules.json"), time.Hour)
+	if err := store.declare(cfg.DeclaredSchedules); err != nil {
+		t.Fatal(err)
+	}
+	cfg.DeclaredSchedules[0].Cron = "0 21 * * 1-5"
+	store.declare(cfg.DeclaredSchedules)
+	if items := store.list(false); len(items) != 1 || items[0].Cron != "0 21 * * 1-5" {
+		t.Errorf("schedules after redeclare = %+v", items)
+	}
+
+	write("project_id: p\nserver:\n  prot: \"80\"\n")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("misspelled key: err = %v, want its line reported", err)
+	}
+
+	write("project_id: p\ninstance_id: i\nschedules:\n  items:\n    - {id: a, instance: i, action: pause, cron: \"0 20 * * *\"}\n")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "schedules.items[0].action") {
+		t.Errorf("invalid schedule: err = %v", err)
+	}
+}
+
+func TestDrainPendingOperations(t *testing.T) {
+	env := newTestEnv(t)
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+
+	path := filepath.Join(t.TempDir(), "pending_operations.json")
+	operations = newOperationTracker(path)
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if pending := operations.pending(); len(pending) != 1 || pending[0].Instance != testInstance {
+		t.Fatalf("pending = %+v, want the stop operation", pending)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := operations.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("unfinished operation not saved: %v", err)
+	}
+
+	env.advance(time.Minute)
+	operations = newOperationTracker(path)
+	if err := operations.resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is removed after the operation is forgotten, outside the
+	// tracker's lock.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := os.Stat(path)
+		if len(operations.pending()) == 0 && os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("resumed operation never finished and removed from the file: %+v, %v", operations.pending(), err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFirestoreStateDocuments(t *testing.T) {
+	cfg := &Config{
+		SchedulesFile:         "/a/state.json",
+		OverridesFile:         "/b/state.json",
+		DelayedActionsFile:    defaultDelayedActionsFile,
+		PendingOperationsFile: defaultPendingOperationsFile,
+		SchedulerStateFile:    defaultSchedulerStateFile,
+	}
+	backend := &firestoreState{project: testProject, collection: defaultStateCollection, documents: cfg.stateDocuments()}
+
+	prefix := "projects/" + testProject + "/databases/(default)/documents/" + defaultStateCollection + "/"
+	for name, want := range map[string]string{
+		"/a/state.json":              defaultSchedulesFile,
+		"/b/state.json":              defaultOverridesFile,
+		defaultPendingOperationsFile: defaultPendingOperationsFile,
+		"/c/other.json":              "other.json",
+	} {
+		if got := backend.document(name); got != prefix+want {
+			t.Errorf("document(%q) = %q, want %q", name, got, prefix+want)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop?dry_run=true", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if body["message_code"] != "dry_run" {
+		t.Errorf("message_code = %v", body["message_code"])
+	}
+	if url := dataField(body, "url"); url != "/v1/projects/"+testProject+"/instances/"+testInstance {
+		t.Errorf("url = %v", url)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/stop-by-label?dry_run=true", `{"labels":{"env":"dev"}}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if changed := dataField(body, "changed"); changed != 1.0 {
+		t.Errorf("changed = %v, want 1", changed)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop?dry_run=true", `{"ActivationPolicy":"SOMETIMES"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	dryRun.store(true)
+	t.Cleanup(func() { dryRun.store(false) })
+	resp, body = env.do(http.MethodPatch, "/v1/instances/"+testInstance+"/settings", `{"userLabels":{"env":"prod"}}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if body["message_code"] != "dry_run" {
+		t.Errorf("DRY_RUN: message_code = %v", body["message_code"])
+	}
+
+	env.advance(time.Minute)
+	if instance := env.instance(); instance.State != "RUNNABLE" || instance.Settings.UserLabels["env"] != "dev" {
+		t.Errorf("instance modified by a dry run: state %s, labels %v", instance.State, instance.Settings.UserLabels)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	env := newTestEnv(t)
+
+	events := make(chan NotificationEvent, 10)
+	texts := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slack" {
+			var message map[string]string
+			json.NewDecoder(r.Body).Decode(&message)
+			texts <- message["text"]
+			return
+		}
+		var event NotificationEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	t.Cleanup(receiver.Close)
+
+	notifications.configure(NotifyConfig{SlackWebhookURL: receiver.URL + "/slack", WebhookURLs: []string{receiver.URL + "/hook"}, Template: defaultNotifyTemplate})
+	t.Cleanup(func() { notifications.configure(NotifyConfig{}) })
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+	notifications.wait(context.Background())
+
+	if len(events) != 2 || len(texts) != 2 {
+		t.Fatalf("got %d webhook and %d slack notifications, want 2 each", len(events), len(texts))
+	}
+	results := map[string]NotificationEvent{}
+	for range 2 {
+		event := <-events
+		results[event.Result] = event
+	}
+	if event := results["requested"]; event.Action != "stop" || event.Instance != testInstance || event.Operation == "" || event.TriggeredBy != "anonymous" || event.SchemaVersion != webhookSchemaVersion {
+		t.Errorf("requested event = %+v", event)
+	}
+	if event := results["failed"]; event.Error == "" {
+		t.Errorf("failed event = %+v, want an error", event)
+	}
+	if text := <-texts + <-texts; !strings.Contains(text, "stop "+testProject+"/"+testInstance+" requested, triggered by anonymous (api), operation ") {
+		t.Errorf("slack texts = %q", text)
+	}
+
+	if err := (NotifyConfig{WebhookURLs: []string{"ftp://example.com"}, Template: "{{.Action"}).validate(); err == nil {
+		t.Error("invalid URL and template accepted")
+	}
+}
+
+func TestWebhookSchema(t *testing.T) {
+	env := newTestEnv(t)
+	saved := authenticators.load()
+	authenticators.store([]authenticator{apiKeyAuthenticator{keys: []string{"secret"}}})
+	t.Cleanup(func() { authenticators.store(saved) })
+
+	// Served without credentials.
+	resp, err := http.Get(env.server.URL + "/schemas/webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/schema+json" {
+		t.Fatalf("GET /schemas/webhook = %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var schema map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema["$id"] != "urn:scheduler-db:schemas:webhook:1" {
+		t.Errorf("$id = %v", schema["$id"])
+	}
+
+	// Every field of a posted event is described.
+	raw, _ := json.Marshal(NotificationEvent{Schedule: "nightly", Operation: "op", Error: "boom"})
+	var event map[string]any
+	json.Unmarshal(raw, &event)
+	properties := schema["properties"].(map[string]any)
+	for name := range event {
+		property, _ := properties[name].(map[string]any)
+		if property == nil || property["description"] == nil {
+			t.Errorf("field %s is not described: %v", name, property)
+		}
+	}
+	if len(properties) != len(event) {
+		t.Errorf("schema has %d properties, the event %d fields", len(properties), len(event))
+	}
+	if version := properties["schema_version"].(map[string]any)["const"]; version != float64(webhookSchemaVersion) {
+		t.Errorf("schema_version const = %v", version)
+	}
+	want := []any{"action", "instance", "project", "result", "schema_version", "source", "text", "time", "triggered_by"}
+	if required := schema["required"]; !reflect.DeepEqual(required, want) {
+		t.Errorf("required = %v, want %v", required, want)
+	}
+}
+
+func TestEmailNotifications(t *testing.T) {
+	env := newTestEnv(t)
+
+	type email struct {
+		Personalizations []struct {
+			To []struct{ Email string } `json:"to"`
+		} `json:"personalizations"`
+		Subject string                   `json:"subject"`
+		Content []struct{ Value string } `json:"content"`
+	}
+	emails := make(chan email, 10)
+	sendGrid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sg-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var message email
+		json.NewDecoder(r.Body).Decode(&message)
+		emails <- message
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(sendGrid.Close)
+	endpoint := sendGridEndpoint
+	sendGridEndpoint = sendGrid.URL
+	t.Cleanup(func() { sendGridEndpoint = endpoint })
+
+	notifications.configure(NotifyConfig{Template: defaultNotifyTemplate, Email: EmailConfig{
+		From:           "Scheduler <scheduler@example.com>",
+		To:             []string{"dba@example.com"},
+		SendGridAPIKey: "sg-key",
+		Recipients: []EmailRecipients{
+			{Instances: []string{"test-*"}, To: []string{"dev@example.com", "dba@example.com"}},
+			{Instances: []string{"prod-*"}, To: []string{"oncall@example.com"}},
+		},
+	}})
+	t.Cleanup(func() { notifications.configure(NotifyConfig{}) })
+
+	resp, body := env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"stop","cron":"0 20 * * *","notify_emails":["owner@example.com"]}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	resp, body = env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"stop","cron":"0 20 * * *","notify_emails":["nobody"]}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	// API actions aren't emailed, scheduled ones are.
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/restart", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedRestartLatency)
+
+	sched := newScheduler(schedules)
+	sched.now = env.clock
+	sched.last = env.clock()
+	env.advance(11*time.Hour + time.Minute)
+	sched.tick()
+	notifications.wait(context.Background())
+
+	if len(emails) != 1 {
+		t.Fatalf("got %d emails, want the scheduled stop only", len(emails))
+	}
+	message := <-emails
+	var to []string
+	for _, recipient := range message.Personalizations[0].To {
+		to = append(to, recipient.Email)
+	}
+	if want := []string{"dba@example.com", "dev@example.com", "owner@example.com"}; !reflect.DeepEqual(to, want) {
+		t.Errorf("recipients = %v, want %v", to, want)
+	}
+	if message.Subject != "[scheduler-db] stop "+testProject+"/"+testInstance+" requested" || !strings.Contains(message.Content[0].Value, "Schedule:") {
+		t.Errorf("email = %+v, want the summary of the scheduled stop", message)
+	}
+
+	env.advance(simulatedStopLatency)
+	instance := env.instance()
+	env.fake.mu.Lock()
+	instance.State = "FAILED"
+	env.fake.mu.Unlock()
+	if _, err := runTriggeredAction(context.Background(), triggeredAction{Action: scheduleActionStop, Project: testProject, Instance: testInstance, Source: actionSourcePubSub, TriggeredBy: "pubsub"}); err != nil {
+		t.Fatal(err)
+	}
+	notifications.wait(context.Background())
+	if len(emails) != 1 {
+		t.Fatalf("got %d emails, want one about the FAILED instance", len(emails))
+	}
+	if message := <-emails; !strings.HasSuffix(message.Subject, " unexpected_state") || !strings.Contains(message.Content[0].Value, "instance is in state FAILED") {
+		t.Errorf("email = %+v, want an unexpected_state summary", message)
+	}
+
+	if err := (EmailConfig{SMTPAddr: "smtp.example.com", SendGridAPIKey: "key", To: []string{"not an address"}}).validate(); err == nil {
+		t.Error("invalid email config accepted")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodGet, "/v1/instances/"+testInstance, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	operation := dataField(body, "operation").(map[string]interface{})["name"]
+	resp, body = env.do(http.MethodPost, "/v1/instances/missing/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+
+	resp, body = env.do(http.MethodGet, "/v1/audit?action=stop", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	entries := dataField(body, "entries").([]interface{})
+	if len(entries) != 2 {
+		t.Fatalf("got %d stop entries, want 2", len(entries))
+	}
+	failed, stopped := entries[0].(map[string]interface{}), entries[1].(map[string]interface{})
+	if failed["instance"] != "missing" || failed["result"] != "failure" || failed["error"] == "" {
+		t.Errorf("newest entry = %v, want the failed stop", failed)
+	}
+	if stopped["instance"] != testInstance || stopped["status_code"] != 200.0 || stopped["operation"] != operation || stopped["payload"] != `{"ActivationPolicy":"NEVER"}` {
+		t.Errorf("stop entry = %v", stopped)
+	}
+
+	resp, body = env.do(http.MethodGet, "/v1/audit?instance="+testInstance+"&limit=1", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if entries := dataField(body, "entries").([]interface{}); len(entries) != 1 || entries[0].(map[string]interface{})["action"] != "stop" {
+		t.Errorf("limited entries = %v", entries)
+	}
+
+	// Entry times follow the response time format like every timestamp.
+	responseTimeFormat.store(timeFormatEpochMillis)
+	resp, body = env.do(http.MethodGet, "/v1/audit?limit=1", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if entries := dataField(body, "entries").([]interface{}); len(entries) != 1 {
+		t.Errorf("limited entries = %v", entries)
+	} else if _, ok := entries[0].(map[string]interface{})["time"].(float64); !ok {
+		t.Errorf("time = %v, want epoch millis", entries[0].(map[string]interface{})["time"])
+	}
+
+	resp, body = env.do(http.MethodGet, "/v1/audit?limit=0&since=yesterday", "")
+	expectStatus(t, resp, body, http.StatusBadRequest)
+}
+
+func TestSavings(t *testing.T) {
+	env := newTestEnv(t)
+	pricing.store(PricingConfig{Currency: "USD", VCPUHourlyPrice: defaultVCPUHourlyPrice, MemoryGBHourlyPrice: defaultMemoryGBHourlyPrice})
+	env.fake.addInstance(&sqladmin.DatabaseInstance{
+		Name:     "prod",
+		Project:  testProject,
+		Region:   "asia-southeast2",
+		Settings: &sqladmin.Settings{Tier: "db-custom-2-7680", AvailabilityType: "REGIONAL"},
+	})
+
+	at := func(day int, hour int) time.Time { return time.Date(2024, 6, day, hour, 0, 0, 0, time.UTC) }
+	for _, entry := range []AuditEntry{
+		{Time: at(1, 19), Action: "stop", Instance: testInstance, Result: "success"},
+		{Time: at(2, 7), Action: "start", Instance: testInstance, Result: "success"},
+		{Time: at(2, 19), Action: "stop", Instance: testInstance, Result: "success"},
+		{Time: at(2, 21), Action: "start", Instance: testInstance, Result: "failure"},
+		{Time: time.Date(2024, 5, 30, 19, 0, 0, 0, time.UTC), Action: "stop", Instance: "prod", Result: "success"},
+		{Time: at(1, 8), Action: "start", Instance: "prod", Result: "success"},
+		{Time: at(1, 9), Action: "stop", Instance: "", Result: "success"},
+	} {
+		entry.ID, entry.Project = randomID(8), testProject
+		if err := auditLog.append(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, body := env.do(http.MethodGet, "/v1/savings?from=2024-06-01T00:00:00Z&to=2024-06-03T07:00:00Z", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if total := dataField(body, "total_savings"); total != 2.41 {
+		t.Errorf("total_savings = %v, want 2.41", total)
+	}
+	if hours := dataField(body, "stopped_hours"); hours != 32.0 {
+		t.Errorf("stopped_hours = %v, want 32", hours)
+	}
+	instances := dataField(body, "instances").([]interface{})
+	if len(instances) != 2 {
+		t.Fatalf("got %d instances, want 2: %v", len(instances), instances)
+	}
+	for i, want := range []struct {
+		instance string
+		hours    float64
+		savings  float64
+	}{{"prod", 8, 2.16}, {testInstance, 24, 0.25}} {
+		got := instances[i].(map[string]interface{})
+		if got["instance"] != want.instance || got["stopped_hours"] != want.hours || got["savings"] != want.savings {
+			t.Errorf("instances[%d] = %v, want %s stopped %vh saving %v", i, got, want.instance, want.hours, want.savings)
+		}
+	}
+
+	resp, body = env.do(http.MethodGet, "/v1/savings?from=2024-06-03T00:00:00Z&to=2024-06-01T00:00:00Z", "")
+	expectStatus(t, resp, body, http.StatusBadRequest)
+}
+
+func TestGrafanaDatasource(t *testing.T) {
+	env := newTestEnv(t)
+	at := func(day int, hour int) time.Time { return time.Date(2024, 6, day, hour, 0, 0, 0, time.UTC) }
+	for _, entry := range []AuditEntry{
+		{Time: at(1, 19), Action: "stop", Instance: testInstance, Result: "success"},
+		{Time: at(2, 7), Action: "start", Instance: testInstance, Result: "success"},
+		{Time: at(2, 8), Action: "scale", Instance: testInstance, Result: "success"},
+		{Time: at(2, 19), Action: "stop", Instance: testInstance, Result: "failure"},
+		{Time: at(1, 10), Action: "check", Instance: testInstance, Result: "success"},
+	} {
+		entry.ID, entry.Project, entry.Principal = randomID(8), testProject, "api-key#1"
+		if err := auditLog.append(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post := func(path string, body string, v interface{}) {
+		t.Helper()
+		resp, err := http.Post(env.server.URL+path, contentTypeJSON, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			raw, _ := io.ReadAll(resp.Body)
+			t.Fatalf("POST %s: status %d: %s", path, resp.StatusCode, raw)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var targets []string
+	post("/v1/grafana/search", `{"target":""}`, &targets)
+	if !slices.Equal(targets, grafanaTargets) {
+		t.Errorf("targets = %v", targets)
+	}
+
+	var series []GrafanaTimeSeries
+	post("/v1/grafana/query", `{"panelId":2,"range":{"from":"2024-06-02T00:00:00Z","to":"2024-06-03T00:00:00Z","raw":{"from":"now-1d"}},"intervalMs":3600000,"maxDataPoints":100,"targets":[{"refId":"A","target":"uptime","payload":""},{"refId":"B","target":"actions","payload":{"instance":"`+testInstance+`"}}]}`, &series)
+	ms := func(t time.Time) float64 { return float64(t.UnixMilli()) }
+	wantUptime := [][2]float64{{0, ms(at(2, 0))}, {1, ms(at(2, 7))}, {1, ms(at(3, 0))}}
+	if len(series) != 5 || series[0].Target != testProject+"/"+testInstance || series[0].RefID != "A" || !slices.Equal(series[0].Datapoints, wantUptime) {
+		t.Fatalf("series = %+v", series)
+	}
+	counts := make(map[string]float64)
+	for _, s := range series[1:] {
+		if len(s.Datapoints) != 25 || s.RefID != "B" {
+			t.Errorf("series %s has %d points", s.Target, len(s.Datapoints))
+		}
+		for _, point := range s.Datapoints {
+			counts[s.Target] += point[0]
+		}
+	}
+	if want := map[string]float64{"start": 1, "stop": 0, "scale": 1, "failed": 1}; !maps.Equal(counts, want) {
+		t.Errorf("action counts = %v, want %v", counts, want)
+	}
+
+	var annotations []GrafanaAnnotation
+	post("/v1/grafana/annotations", `{"range":{"from":"2024-06-01T00:00:00Z","to":"2024-06-03T00:00:00Z"},"annotation":{"name":"actions","query":"`+testInstance+`"}}`, &annotations)
+	if len(annotations) != 4 || annotations[0].Title != "stop "+testInstance || annotations[0].Time != at(1, 19).UnixMilli() {
+		t.Errorf("annotations = %+v", annotations)
+	}
+
+	resp, err := http.Get(env.server.URL + "/v1/grafana/query?target=uptime&from=1717286400000&to=2024-06-03T00:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	series = nil
+	json.NewDecoder(resp.Body).Decode(&series)
+	resp.Body.Close()
+	if len(series) != 1 || !slices.Equal(series[0].Datapoints, wantUptime) {
+		t.Errorf("GET query series = %+v", series)
+	}
+	resp, body := env.do(http.MethodGet, "/v1/grafana/query?target=cpu", "")
+	expectStatus(t, resp, body, http.StatusBadRequest)
+}
+
+func TestReplicaOrdering(t *testing.T) {
+	env := newTestEnv(t)
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.instances[testProject+"/"+testInstance].ReplicaNames = []string{"test-db-replica"}
+	env.fake.mu.Unlock()
+	env.fake.addInstance(&sqladmin.DatabaseInstance{
+		Name:               "test-db-replica",
+		Project:            testProject,
+		MasterInstanceName: testProject + ":" + testInstance,
+		Settings:           &sqladmin.Settings{ActivationPolicy: "ALWAYS"},
+	})
+
+	state := func(name string) string {
+		env.fake.mu.Lock()
+		defer env.fake.mu.Unlock()
+		env.fake.advance()
+		return env.fake.instances[testProject+"/"+name].State
+	}
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop?include_replicas=true&dry_run=true", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if replicas := dataField(body, "replicas").([]interface{}); len(replicas) != 1 || replicas[0].(map[string]interface{})["outcome"] != "dry_run" {
+		t.Errorf("dry run replicas = %v", replicas)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop?include_replicas=true", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	replicas := dataField(body, "replicas").([]interface{})
+	if len(replicas) != 1 || replicas[0].(map[string]interface{})["outcome"] != "changed" {
+		t.Fatalf("stop replicas = %v", replicas)
+	}
+	if primary, replica := state(testInstance), state("test-db-replica"); primary != "STOPPED" || replica != "STOPPED" {
+		t.Errorf("after stop: primary %s, replica %s", primary, replica)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/start?include_replicas=true", `{"ActivationPolicy":"ALWAYS"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if status := dataField(body, "operation").(map[string]interface{})["status"]; status != "DONE" {
+		t.Errorf("primary operation status = %v, want DONE before replicas start", status)
+	}
+	if primary, replica := state(testInstance), state("test-db-replica"); primary != "RUNNABLE" || replica != "RUNNABLE" {
+		t.Errorf("after start: primary %s, replica %s", primary, replica)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if state("test-db-replica") != "RUNNABLE" {
+		t.Error("replica stopped without include_replicas")
+	}
+}
+
+func TestBackupBeforeStop(t *testing.T) {
+	env := newTestEnv(t)
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/backup?wait=true", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if operation := dataField(body, "operation").(map[string]interface{}); operation["operationType"] != "BACKUP_VOLUME" || operation["status"] != "DONE" {
+		t.Errorf("backup operation = %v", operation)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/start", `{"ActivationPolicy":"ALWAYS","backup_before_stop":true}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER","backup_before_stop":true}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if backup := dataField(body, "backup").(map[string]interface{}); backup["operationType"] != "BACKUP_VOLUME" || backup["status"] != "DONE" {
+		t.Errorf("backup before stop = %v, want a finished backup", backup)
+	}
+	if dataField(body, "operation").(map[string]interface{})["operationType"] != "UPDATE" {
+		t.Errorf("stop operation missing: %v", body["data"])
+	}
+
+	env.advance(time.Minute)
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/backup", "")
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+	if body["message_code"] != "backup_failed" {
+		t.Errorf("backup of a stopped instance: message_code = %v", body["message_code"])
+	}
+}
+
+func TestExport(t *testing.T) {
+	env := newTestEnv(t)
+	path := "/v1/instances/" + testInstance + "/export"
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+
+	for _, payload := range []string{`{}`, `{"uri":"s3://bucket/dump.sql"}`, `{"uri":"gs://bucket/","format":"xml"}`, `{"uri":"gs://bucket/","format":"csv"}`, `{"uri":"gs://bucket/","query":"SELECT 1"}`} {
+		resp, body := env.do(http.MethodPost, path, payload)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+	}
+
+	resp, body := env.do(http.MethodPost, path+"?wait=true", `{"uri":"gs://bucket/exports/","databases":["app"]}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	uri, _ := dataField(body, "uri").(string)
+	if !strings.HasPrefix(uri, "gs://bucket/exports/"+testInstance+"-") || !strings.HasSuffix(uri, ".sql.gz") {
+		t.Errorf("uri = %q, want a file named after the instance", uri)
+	}
+	if operation := dataField(body, "operation").(map[string]interface{}); operation["operationType"] != "EXPORT" || operation["status"] != "DONE" {
+		t.Errorf("export operation = %v", operation)
+	}
+
+	entries, err := auditLog.query(context.Background(), auditQuery{Action: actionExport, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].URI != uri || entries[0].Result != "success" {
+		t.Errorf("audit entries = %+v, want the export with its uri", entries)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER","export_before_stop":{"uri":"gs://bucket/orders.csv","format":"csv","databases":["app"],"query":"SELECT * FROM orders"}}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	export := dataField(body, "export").(map[string]interface{})
+	if context := export["exportContext"].(map[string]interface{}); export["status"] != "DONE" || context["uri"] != "gs://bucket/orders.csv" || context["fileType"] != "CSV" {
+		t.Errorf("export before stop = %v, want a finished CSV export", export)
+	}
+
+	env.advance(time.Minute)
+	resp, body = env.do(http.MethodPost, path, `{"uri":"gs://bucket/exports/"}`)
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+	if body["message_code"] != string(msgExportFailed) {
+		t.Errorf("export of a stopped instance: message_code = %v", body["message_code"])
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"start","cron":"0 7 * * *","export_before_stop":{"uri":"gs://bucket/"}}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	resp, body = env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"stop","cron":"0 20 * * *","export_before_stop":{"uri":"gs://bucket/"}}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	if export := dataField(body, "export_before_stop").(map[string]interface{}); export["uri"] != "gs://bucket/" {
+		t.Errorf("export_before_stop = %v", export)
+	}
+}
+
+func TestImport(t *testing.T) {
+	env := newTestEnv(t)
+	path := "/v1/instances/" + testInstance + "/import"
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+
+	for _, payload := range []string{`{}`, `{"uri":"gs://bucket/"}`, `{"uri":"gs://bucket/data.csv","format":"csv"}`, `{"uri":"gs://bucket/dump.sql","table":"orders"}`} {
+		resp, body := env.do(http.MethodPost, path, payload)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+	}
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/export", `{"uri":"gs://bucket/dump.sql.gz"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	resp, body = env.do(http.MethodPost, path, `{"uri":"gs://bucket/dump.sql.gz"}`)
+	expectStatus(t, resp, body, http.StatusConflict)
+	if body["message_code"] != string(msgImportBlocked) {
+		t.Errorf("import during an export: message_code = %v", body["message_code"])
+	}
+	env.advance(simulatedExportLatency)
+
+	resp, body = env.do(http.MethodPost, path, `{"uri":"gs://bucket/dump.sql.gz","database":"app"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	progress := dataField(body, "progress").(map[string]interface{})
+	if progress["status"] != "RUNNING" || progress["uri"] != "gs://bucket/dump.sql.gz" || progress["database"] != "app" {
+		t.Errorf("progress = %v, want a running import", progress)
+	}
+	name := progress["operation"].(string)
+
+	env.advance(simulatedImportLatency)
+	resp, body = env.do(http.MethodGet, path+"?operation="+name, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if status := dataField(body, "status"); status != "DONE" {
+		t.Errorf("status = %v after the import finished", status)
+	}
+	resp, body = env.do(http.MethodGet, "/v1/instances/test-db-other/import?operation="+name, "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+	resp, body = env.do(http.MethodPost, path+"?wait=true", `{"uri":"gs://bucket/missing.sql"}`)
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+	if body["error_type"] != "operation_failed" || len(body["errors"].([]interface{})) != 1 {
+		t.Errorf("failed import = %v, want the Cloud SQL errors", body)
+	}
+
+	env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`)
+	resp, body = env.do(http.MethodPost, path, `{"uri":"gs://bucket/dump.sql.gz"}`)
+	expectStatus(t, resp, body, http.StatusConflict)
+	if body["message_code"] != string(msgInstanceNotRunnable) {
+		t.Errorf("import into a stopped instance: message_code = %v", body["message_code"])
+	}
+}
+
+// flakyTransport answers the first len(failures) requests with those
+// statuses and bodies, then passes requests through.
+type flakyTransport struct {
+	base     http.RoundTripper
+	failures []string
+	attempts int
+}
+
+func (f *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.attempts++
+	if f.attempts > len(f.failures) {
+		return f.base.RoundTrip(req)
+	}
+	status, body, _ := strings.Cut(f.failures[f.attempts-1], " ")
+	code, _ := strconv.Atoi(status)
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": {contentTypeJSON}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestRetrySQLAdmin(t *testing.T) {
+	env := newTestEnv(t)
+	sqlAdminRetry.store(RetryConfig{MaxAttempts: 3, Deadline: time.Second, InitialBackoff: time.Millisecond})
+
+	inProgress := `409 {"error":{"code":409,"message":"another operation","errors":[{"reason":"operationInProgress"}]}}`
+	unavailable := `503 {"error":{"code":503,"message":"backend unavailable"}}`
+	for _, tc := range []struct {
+		name     string
+		failures []string
+		status   int
+		attempts int
+		detail   string
+	}{
+		{"recovers", []string{unavailable, inProgress}, http.StatusOK, 3, ""},
+		{"exhausted", []string{unavailable, unavailable, unavailable}, http.StatusInternalServerError, 3, "backend unavailable"},
+		{"conflict", []string{`409 {"error":{"code":409,"message":"instance already exists"}}`}, http.StatusInternalServerError, 1, "instance already exists"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flaky := &flakyTransport{base: http.DefaultTransport, failures: tc.failures}
+			sqlAdminTransport.store(flaky)
+			resetSQLAdminService()
+
+			resp, body := env.do(http.MethodGet, "/v1/instances/"+testInstance+"?fresh=true", "")
+			expectStatus(t, resp, body, tc.status)
+			if flaky.attempts != tc.attempts {
+				t.Errorf("attempts = %d, want %d", flaky.attempts, tc.attempts)
+			}
+			if description, _ := body["error_description"].(string); !strings.Contains(description, tc.detail) {
+				t.Errorf("error_description = %q, want the googleapi error %q", description, tc.detail)
+			}
+		})
+	}
+
+	// A POST failing with a 5xx may have started an operation, it is only
+	// retried while another operation is in progress.
+	flaky := &flakyTransport{failures: []string{inProgress, unavailable}}
+	req, _ := http.NewRequest(http.MethodPost, "https://sqladmin.googleapis.com/v1/projects/"+testProject+"/instances/"+testInstance+"/restart", nil)
+	resp, err := retrySQLAdmin(flaky, sqlAdminRetry.load()).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || flaky.attempts != 2 {
+		t.Errorf("POST answered %d after %d attempts, want the 503 after 2", resp.StatusCode, flaky.attempts)
+	}
+}
+
+// blockingTransport holds every call until its context is done and reports
+// why.
+type blockingTransport struct {
+	cancelled chan error
+}
+
+func (b *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	b.cancelled <- req.Context().Err()
+	return nil, req.Context().Err()
+}
+
+func TestSQLAdminCallContext(t *testing.T) {
+	env := newTestEnv(t)
+	blocking := &blockingTransport{cancelled: make(chan error, 1)}
+	sqlAdminTransport.store(blocking)
+	resetSQLAdminService()
+
+	sqlAdminCallTimeout.store(50 * time.Millisecond)
+	t.Cleanup(func() { sqlAdminCallTimeout.store(0) })
+
+	// A call cut short by its timeout answers 504, on reads and actions.
+	for _, call := range []struct{ method, path, body string }{
+		{http.MethodGet, "/check?fresh=true", ""},
+		{http.MethodPost, "/v1/instances/" + testInstance + "/stop", `{"ActivationPolicy":"NEVER"}`},
+	} {
+		resp, body := env.do(call.method, call.path, call.body)
+		expectStatus(t, resp, body, http.StatusGatewayTimeout)
+		if body["error_type"] != "timeout" || !strings.Contains(body["error_description"].(string), "deadline exceeded") {
+			t.Errorf("%s %s: error %v: %v, want the call timeout", call.method, call.path, body["error_type"], body["error_description"])
+		}
+		if err := <-blocking.cancelled; !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s %s: call ended with %v, want the call timeout", call.method, call.path, err)
+		}
+	}
+
+	// A client going away cancels the call in flight.
+	sqlAdminCallTimeout.store(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, env.server.URL+"/check?fresh=true", nil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Fatal("request succeeded")
+	}
+
+	select {
+	case err := <-blocking.cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("call ended with %v, want cancellation", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("call not cancelled when the client disconnected")
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	env := newTestEnv(t)
+
+	var out syncBuffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(&contextHandler{newLogHandler(&out, logFormatJSON)}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`, "X-Request-Id", "job-42")
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := resp.Header.Get("X-Request-Id"); got != "job-42" {
+		t.Errorf("X-Request-Id = %q, want the caller's ID", got)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"ALWAYS"}`, "X-Request-Id", "not valid!")
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	id := resp.Header.Get("X-Request-Id")
+	if id == "" || id == "not valid!" || body["request_id"] != id {
+		t.Errorf("X-Request-Id = %q, request_id = %v, want a generated ID in both", id, body["request_id"])
+	}
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		if entry["message"] == "request" {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) != 2 {
+		t.Fatalf("logged %d requests, want 2:\n%s", len(entries), out.String())
+	}
+
+	stop := entries[0]
+	if stop["severity"] != "INFO" || stop["request_id"] != "job-42" || stop["project"] != testProject ||
+		stop["instance"] != testInstance || stop["operation"] == nil || stop["latency_ms"] == nil {
+		t.Errorf("stop logged as %v", stop)
+	}
+	if rejected := entries[1]; rejected["severity"] != "WARNING" || rejected["request_id"] != id {
+		t.Errorf("rejected stop logged as %v", rejected)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	newTestEnv(t)
+
+	handler := withRequestLog(withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/started" {
+			w.WriteHeader(http.StatusOK)
+		}
+		var instance *sqladmin.DatabaseInstance
+		w.Write([]byte(instance.Name))
+	})))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/instances", nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q: %v", rec.Body.String(), err)
+	}
+	if rec.Code != http.StatusInternalServerError || body["message_code"] != "internal_error" || body["request_id"] != rec.Header().Get("X-Request-Id") {
+		t.Errorf("panic answered %d %v, want a 500 envelope", rec.Code, body)
+	}
+
+	func() {
+		defer func() {
+			if value := recover(); value != http.ErrAbortHandler {
+				t.Errorf("panic after the response started: recovered %v, want http.ErrAbortHandler", value)
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/started", nil))
+	}()
+
+	rec = httptest.NewRecorder()
+	writeErrorResponse(rec, httptest.NewRequest(http.MethodPost, "/v1/instances/db/start", nil), http.StatusInternalServerError, msgStartFailed, fmt.Errorf("start: %w", context.DeadlineExceeded))
+	body = nil
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusGatewayTimeout || body["error_type"] != "timeout" {
+		t.Errorf("deadline answered %d %v, want a 504 timeout", rec.Code, body)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	newTestEnv(t)
+
+	hung := withTimeout(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}, 10*time.Millisecond)
+	rec := httptest.NewRecorder()
+	hung.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/instances", nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q: %v", rec.Body.String(), err)
+	}
+	if rec.Code != http.StatusGatewayTimeout || body["message_code"] != "request_timed_out" || body["status_code"] != 504.0 {
+		t.Errorf("timeout answered %d %v, want a 504 envelope", rec.Code, body)
+	}
+
+	unavailable := withTimeout(func(w http.ResponseWriter, r *http.Request) {
+		writeErrorResponse(w, r, http.StatusServiceUnavailable, msgInternalError, "unavailable")
+	}, time.Second)
+	rec = httptest.NewRecorder()
+	unavailable.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/instances", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler 503 answered %d, want it passed on", rec.Code)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// pubsubCall is a request received by the fake Pub/Sub API.
+type pubsubCall struct {
+	Path string
+	Body map[string]interface{}
+}
+
+func newTestSubscriber(t *testing.T, env *testEnv) (*pubsubSubscriber, func() []pubsubCall) {
+	t.Helper()
+
+	var (
+		mu    sync.Mutex
+		calls []pubsubCall
+	)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		calls = append(calls, pubsubCall{Path: r.URL.Path, Body: body})
+		mu.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(api.Close)
+
+	service, err := pubsub.NewService(context.Background(), option.WithEndpoint(api.URL+"/"), option.WithHTTPClient(api.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriber := &pubsubSubscriber{
+		service:         service,
+		subscription:    "projects/test-project/subscriptions/commands",
+		deadLetterTopic: "projects/test-project/topics/commands-dead-letter",
+		maxMessages:     10,
+		now:             env.clock,
+		seen:            make(map[string]time.Time),
+	}
+	return subscriber, func() []pubsubCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]pubsubCall(nil), calls...)
+	}
+}
+
+func pubsubMessage(ackID string, id string, data string) *pubsub.ReceivedMessage {
+	return &pubsub.ReceivedMessage{
+		AckId:   ackID,
+		Message: &pubsub.PubsubMessage{MessageId: id, Data: base64.StdEncoding.EncodeToString([]byte(data))},
+	}
+}
+
+func TestPubSubSubscriber(t *testing.T) {
+	env := newTestEnv(t)
+	subscriber, calls := newTestSubscriber(t, env)
+
+	subscriber.handle(context.Background(), []*pubsub.ReceivedMessage{
+		pubsubMessage("a1", "m1", `{"ActivationPolicy":"NEVER"}`),
+		pubsubMessage("a2", "m1", `{"ActivationPolicy":"NEVER"}`),
+		pubsubMessage("a3", "m2", `stop it`),
+		pubsubMessage("a4", "m3", `{"action":"stop","instance":"missing-db"}`),
+	})
+
+	env.advance(simulatedStopLatency)
+	if state := env.instance().State; state != "STOPPED" {
+		t.Errorf("state = %s, want STOPPED", state)
+	}
+
+	var acked, deadLettered []string
+	for _, call := range calls() {
+		switch {
+		case strings.HasSuffix(call.Path, ":acknowledge"):
+			for _, id := range call.Body["ackIds"].([]interface{}) {
+				acked = append(acked, id.(string))
+			}
+		case strings.HasSuffix(call.Path, ":publish"):
+			message := call.Body["messages"].([]interface{})[0].(map[string]interface{})
+			attributes := message["attributes"].(map[string]interface{})
+			deadLettered = append(deadLettered, attributes["original_message_id"].(string))
+		case strings.HasSuffix(call.Path, ":modifyAckDeadline"):
+			if call.Body["ackDeadlineSeconds"] != float64(pubsubAckDeadline) {
+				t.Errorf("message nacked: %v", call.Body)
+			}
+		}
+	}
+	if got := strings.Join(acked, ","); got != "a1,a2,a3,a4" {
+		t.Errorf("acked %s, want every message", got)
+	}
+	if got := strings.Join(deadLettered, ","); got != "m2,m3" {
+		t.Errorf("dead-lettered %s, want the malformed message and the missing instance", got)
+	}
+}
+
+func TestPubSubNacksTransientErrors(t *testing.T) {
+	env := newTestEnv(t)
+	subscriber, calls := newTestSubscriber(t, env)
+	sqlAdminTransport.store(&chaosTransport{
+		base:   http.DefaultTransport,
+		config: ChaosConfig{ErrorRate: 1, Codes: []int{http.StatusServiceUnavailable}, Methods: []string{http.MethodGet}},
+	})
+	resetSQLAdminService()
+
+	subscriber.handle(context.Background(), []*pubsub.ReceivedMessage{pubsubMessage("a1", "m1", `{"action":"stop"}`)})
+
+	last := calls()[len(calls())-1]
+	if !strings.HasSuffix(last.Path, ":modifyAckDeadline") || last.Body["ackDeadlineSeconds"] != float64(0) {
+		t.Fatalf("last call %v, want a nack", last)
+	}
+
+	// The redelivery is processed, not taken for a duplicate.
+	sqlAdminTransport.store(nil)
+	resetSQLAdminService()
+	if outcome, err := subscriber.process(context.Background(), pubsubMessage("a2", "m1", `{"action":"stop"}`).Message); outcome != pubsubAck {
+		t.Errorf("redelivery outcome = %s (%v), want ack", outcome, err)
+	}
+}
+
+func TestCLI(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+
+	var stdout, stderr strings.Builder
+	if code := runCommand([]string{"teleport"}, &stdout, &stderr); code != exitUsage || !strings.Contains(stderr.String(), "status") {
+		t.Errorf("unknown command exited %d with %q", code, stderr.String())
+	}
+
+	stdout.Reset()
+	if err := cliStatus(ctx, &stdout, outputText); err != nil || !strings.Contains(stdout.String(), "RUNNABLE") {
+		t.Errorf("status printed %q (%v)", stdout.String(), err)
+	}
+
+	stdout.Reset()
+	options := activateOptions{cliOptions: cliOptions{output: outputJSON}, wait: true, timeout: time.Second}
+	if err := cliActivate(ctx, &stdout, scheduleActionStop, options); err != nil {
+		t.Fatal(err)
+	}
+	var result CLIActionResult
+	if err := json.Unmarshal([]byte(stdout.String()), &result); err != nil || result.Result != cliResultDone || result.State != "STOPPED" {
+		t.Errorf("stop printed %q (%v)", stdout.String(), err)
+	}
+
+	// Stopping a stopped instance is a no-op, so CI jobs can be re-run.
+	stdout.Reset()
+	options = activateOptions{cliOptions: cliOptions{output: outputText}}
+	if err := cliActivate(ctx, &stdout, scheduleActionStop, options); err != nil || !strings.Contains(stdout.String(), "skipped") {
+		t.Errorf("second stop printed %q (%v)", stdout.String(), err)
+	}
+
+	stdout.Reset()
+	if err := cliList(ctx, &stdout, outputText, []string{testProject}, instanceFilter{State: "STOPPED"}); err != nil ||
+		!strings.Contains(stdout.String(), testInstance) {
+		t.Errorf("list printed %q (%v)", stdout.String(), err)
+	}
+}
+
+func TestCLIRunOnce(t *testing.T) {
+	env := newTestEnv(t)
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+
+	for _, body := range []string{
+		`{"instance":"` + testInstance + `","action":"stop","cron":"30 20 * * *"}`,
+		// Fired before it was created, not caught up.
+		`{"instance":"` + testInstance + `","action":"start","cron":"0 8 * * *"}`,
+	} {
+		resp, respBody := env.do(http.MethodPost, "/v1/schedules", body)
+		expectStatus(t, resp, respBody, http.StatusCreated)
+	}
+
+	cfg := &Config{SchedulesFile: schedules.path, TrashRetention: time.Hour}
+	now := env.clock().Add(12 * time.Hour)
+	var stdout strings.Builder
+	if err := cliRunOnce(context.Background(), &stdout, outputJSON, cfg, now, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var results []RunOnceResult
+	if err := json.Unmarshal([]byte(stdout.String()), &results); err != nil || len(results) != 1 || results[0].Action != scheduleActionStop || results[0].Result != runOnceResultRan {
+		t.Fatalf("run-once printed %q (%v)", stdout.String(), err)
+	}
+	if state := env.instance().State; state != "STOPPED" {
+		t.Errorf("state = %s after run-once", state)
+	}
+
+	// The run was recorded, a second invocation has nothing to do.
+	stdout.Reset()
+	if err := cliRunOnce(context.Background(), &stdout, outputText, cfg, now.Add(time.Minute), time.Hour); err != nil || !strings.Contains(stdout.String(), "No schedule due") {
+		t.Errorf("second run-once printed %q (%v)", stdout.String(), err)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	env := newTestEnv(t)
+	idempotencyTTL.store(time.Hour)
+
+	operationCount := func() int {
+		env.fake.mu.Lock()
+		defer env.fake.mu.Unlock()
+		return len(env.fake.operations)
+	}
+
+	// Concurrent duplicates wait for the first request and share its result.
+	var wg sync.WaitGroup
+	replayed := make([]bool, 3)
+	for i := range replayed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`, "Idempotency-Key", "nightly-stop")
+			expectStatus(t, resp, body, http.StatusOK)
+			replayed[i] = resp.Header.Get(idempotentReplayedHeader) == "true"
+		}()
+	}
+	wg.Wait()
+	if got := operationCount(); got != 1 {
+		t.Fatalf("operations = %d, want 1", got)
+	}
+	if n := slices.Index(replayed, false); n < 0 || slices.Contains(replayed[n+1:], false) {
+		t.Errorf("replayed = %v, want exactly one original response", replayed)
+	}
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"ALWAYS"}`, "Idempotency-Key", "nightly-stop")
+	expectStatus(t, resp, body, http.StatusUnprocessableEntity)
+	if body["message_code"] != string(msgIdempotencyKeyReused) {
+		t.Errorf("message_code = %v, want %s", body["message_code"], msgIdempotencyKeyReused)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`, "Idempotency-Key", "bad\tkey")
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	// Once expired the key acts again, here rejected since the instance is
+	// already stopped.
+	env.advance(simulatedStopLatency + time.Hour)
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`, "Idempotency-Key", "nightly-stop")
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	if resp.Header.Get(idempotentReplayedHeader) != "" {
+		t.Error("expired key was replayed")
+	}
+
+	// A first request that never answered is not kept, the retry acts again.
+	calls := 0
+	silent := withIdempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls++ }))
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/v1/instances/"+testInstance+"/stop", nil)
+		req.Header.Set(idempotencyKeyHeader, "silent")
+		silent.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if calls != 2 {
+		t.Errorf("silent handler called %d times, want 2", calls)
+	}
+
+	// Requests without a key share one per window of the store clock.
+	idempotencyWindow.store(time.Minute)
+	t.Cleanup(func() { idempotencyWindow.store(0) })
+	env.advance(time.Minute - env.clock().Sub(env.clock().Truncate(time.Minute)))
+	windowed := withIdempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusAccepted) }))
+	for i, wantReplayed := range []string{"", "true", ""} {
+		if i == 2 {
+			env.advance(time.Minute)
+		}
+		rec := httptest.NewRecorder()
+		windowed.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/instances/"+testInstance+"/start", nil))
+		if got := rec.Header().Get(idempotentReplayedHeader); got != wantReplayed {
+			t.Errorf("request %d: %s = %q, want %q", i, idempotentReplayedHeader, got, wantReplayed)
+		}
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	env := newTestEnv(t)
+	path := "/v1/instances/" + testInstance + "/maintenance-window"
+
+	resp, body := env.do(http.MethodGet, path, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := dataField(body, "day_name"); got != "any" {
+		t.Errorf("day_name = %v, want any", got)
+	}
+
+	resp, body = env.do(http.MethodPatch, path, `{"day":6,"hour":0,"update_track":"stable"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedPatchLatency)
+
+	// Fields left out keep their value.
+	resp, body = env.do(http.MethodPatch, path, `{"hour":3}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedPatchLatency)
+
+	resp, body = env.do(http.MethodGet, path, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	want := map[string]interface{}{"day": 6.0, "day_name": "Saturday", "hour": 3.0, "update_track": "stable"}
+	if data := body["data"]; !reflect.DeepEqual(data, want) {
+		t.Errorf("window = %v, want %v", data, want)
+	}
+
+	for _, payload := range []string{`{}`, `{"day":8}`, `{"hour":24}`, `{"update_track":"beta"}`} {
+		resp, body = env.do(http.MethodPatch, path, payload)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	env := newTestEnv(t)
+	path := "/v1/instances/" + testInstance + "/storage"
+	key := testProject + "/" + testInstance
+
+	env.fake.mu.Lock()
+	env.fake.diskUsed = map[string]int64{key: 2 << 30}
+	env.fake.mu.Unlock()
+
+	resp, body := env.do(http.MethodGet, path, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	want := map[string]interface{}{"auto_resize": false, "auto_resize_limit_gb": 0.0, "data_disk_size_gb": 10.0, "data_disk_type": "PD_SSD", "used_gb": 2.0}
+	if data := body["data"]; !reflect.DeepEqual(data, want) {
+		t.Errorf("storage = %v, want %v", data, want)
+	}
+
+	resp, body = env.do(http.MethodPatch, path, `{"auto_resize":true,"auto_resize_limit_gb":200,"data_disk_size_gb":50}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedPatchLatency)
+
+	// Fields left out keep their value, a limit of 0 removes it.
+	resp, body = env.do(http.MethodPatch, path, `{"auto_resize_limit_gb":0}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedPatchLatency)
+
+	resp, body = env.do(http.MethodGet, path, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	want = map[string]interface{}{"auto_resize": true, "auto_resize_limit_gb": 0.0, "data_disk_size_gb": 50.0, "data_disk_type": "PD_SSD", "used_gb": 2.0}
+	if data := body["data"]; !reflect.DeepEqual(data, want) {
+		t.Errorf("storage = %v, want %v", data, want)
+	}
+
+	resp, body = env.do(http.MethodPatch, path, `{"data_disk_size_gb":20}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	if body["message_code"] != string(msgStorageShrinkUnsupported) {
+		t.Errorf("shrink answered %v", body["message_code"])
+	}
+	for _, payload := range []string{`{}`, `{"data_disk_size_gb":5}`, `{"auto_resize_limit_gb":-1}`, `{"data_disk_type":"HYPERDISK"}`} {
+		resp, body = env.do(http.MethodPatch, path, payload)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+	}
+
+	events := make(chan NotificationEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event NotificationEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	t.Cleanup(receiver.Close)
+	notifications.configure(NotifyConfig{WebhookURLs: []string{receiver.URL}, Template: defaultNotifyTemplate})
+	t.Cleanup(func() { notifications.configure(NotifyConfig{}) })
+
+	resp, body = env.do(http.MethodPost, "/v1/schedules", `{"chain":"nightly","action":"shrink_check","cron":"0 6 * * 1"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	resp, body = env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"shrink_check","cron":"0 6 * * 1"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	schedule, err := schedules.get(dataField(body, "id").(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 GB of 50 GB is under the default 25%.
+	if err := runScheduledAction(context.Background(), schedule); err != nil {
+		t.Fatal(err)
+	}
+	notifications.wait(context.Background())
+	if len(events) != 1 {
+		t.Fatalf("got %d notifications, want the shrink candidate", len(events))
+	}
+	if event := <-events; event.Result != notifyResultShrinkCandidate || event.Schedule != schedule.ID || !strings.Contains(event.Error, "2.0 GB used of 50 GB") {
+		t.Errorf("notification = %+v", event)
+	}
+
+	env.fake.mu.Lock()
+	env.fake.diskUsed[key] = 30 << 30
+	env.fake.mu.Unlock()
+	if err := runScheduledAction(context.Background(), schedule); err != nil {
+		t.Fatal(err)
+	}
+	notifications.wait(context.Background())
+	if len(events) != 0 {
+		t.Errorf("got %d notifications for a disk 60%% used", len(events))
+	}
+}
+
+func TestDatabaseFlags(t *testing.T) {
+	env := newTestEnv(t)
+	path := "/v1/instances/" + testInstance + "/flags"
+
+	resp, body := env.do(http.MethodPatch, path, `{"flags":{"log_min_duration_statement":"500","cloudsql.iam_authentication":"on"}}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if warning := resp.Header.Get("Warning"); warning != "" || body["message_code"] != string(msgDatabaseFlagsPatched) {
+		t.Errorf("patch without restart answered %v with warning %q", body["message_code"], warning)
+	}
+	env.advance(simulatedPatchLatency)
+
+	// Flags left out keep their value, null removes one.
+	resp, body = env.do(http.MethodPatch, path, `{"flags":{"max_connections":"200","cloudsql.iam_authentication":null}}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if warning := resp.Header.Get("Warning"); !strings.Contains(warning, "max_connections") || body["message_code"] != string(msgDatabaseFlagsPatchedRestart) {
+		t.Errorf("patch with restart answered %v with warning %q", body["message_code"], warning)
+	}
+	env.advance(simulatedPatchLatency)
+
+	resp, body = env.do(http.MethodGet, path, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	want := map[string]interface{}{
+		"database_version": "POSTGRES_15",
+		"flags": []interface{}{
+			map[string]interface{}{"name": "log_min_duration_statement", "value": "500", "type": "INTEGER"},
+			map[string]interface{}{"name": "max_connections", "value": "200", "type": "INTEGER", "requires_restart": true},
+		},
+	}
+	if data := body["data"]; !reflect.DeepEqual(data, want) {
+		t.Errorf("flags = %v, want %v", data, want)
+	}
+
+	// Setting a flag to its current value doesn't restart the instance.
+	resp, body = env.do(http.MethodPatch, path+"?dry_run=true", `{"flags":{"max_connections":"200"}}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if warning := resp.Header.Get("Warning"); warning != "" {
+		t.Errorf("unchanged flag warns %q", warning)
+	}
+
+	for _, payload := range []string{
+		`{}`,
+		`{"flags":{"slow_query_log":"on"}}`,
+		`{"flags":{"max_connections":"10"}}`,
+		`{"flags":{"max_connections":"many"}}`,
+		`{"flags":{"cloudsql.iam_authentication":"true"}}`,
+	} {
+		resp, body = env.do(http.MethodPatch, path, payload)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+	}
+}
+
+func TestAuthorizedNetworks(t *testing.T) {
+	env := newTestEnv(t)
+	networkSweeps.now = env.clock
+	t.Cleanup(func() { networkSweeps.now = time.Now })
+	path := "/v1/instances/" + testInstance + "/authorized-networks"
+
+	resp, body := env.do(http.MethodPost, path, `{"cidr":"198.51.100.0/24","name":"office"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedPatchLatency)
+	resp, body = env.do(http.MethodPost, path, `{"cidr":"203.0.113.7","name":"alice","expires_in":"8h"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedPatchLatency)
+
+	resp, body = env.do(http.MethodPost, path, `{"cidr":"203.0.113.7/32"}`)
+	expectStatus(t, resp, body, http.StatusConflict)
+	for _, payload := range []string{`{}`, `{"cidr":"203.0.113.300"}`, `{"cidr":"0.0.0.0/0"}`, `{"cidr":"10.0.0.1","expires_in":"90d"}`} {
+		resp, body = env.do(http.MethodPost, path, payload)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+	}
+
+	resp, body = env.do(http.MethodGet, path, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	want := []interface{}{
+		map[string]interface{}{"name": "office", "cidr": "198.51.100.0/24"},
+		map[string]interface{}{"name": "alice", "cidr": "203.0.113.7/32", "expires_at": "2024-06-03T17:00:05Z"},
+	}
+	if data := body["data"]; !reflect.DeepEqual(data, want) {
+		t.Errorf("authorized networks = %v, want %v", data, want)
+	}
+
+	resp, body = env.do(http.MethodDelete, path+"?cidr=192.0.2.0/24", "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+
+	// Entries are only swept once they expired.
+	if removed := networkSweeps.sweep(context.Background(), []string{testProject}); removed != 0 {
+		t.Errorf("swept %d entries before they expired", removed)
+	}
+	env.advance(8 * time.Hour)
+	if removed := networkSweeps.sweep(context.Background(), []string{testProject}); removed != 1 {
+		t.Errorf("swept %d entries, want the expired one", removed)
+	}
+	env.advance(simulatedPatchLatency)
+	if networks := newAuthorizedNetworks(env.instance().Settings); len(networks) != 1 || networks[0].CIDR != "198.51.100.0/24" {
+		t.Errorf("authorized networks after the sweep = %+v", networks)
+	}
+
+	resp, body = env.do(http.MethodDelete, path+"?cidr=198.51.100.0/24", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedPatchLatency)
+	if networks := newAuthorizedNetworks(env.instance().Settings); len(networks) != 0 {
+		t.Errorf("authorized networks after the removal = %+v", networks)
+	}
+}
+
+func TestHolidaysSkipScheduledStarts(t *testing.T) {
+	env := newTestEnv(t)
+
+	calendar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nDTSTART;VALUE=DATE:20240606\r\nDTEND;VALUE=DATE:20240607\r\nSUMMARY:Public\r\n  holiday\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n")
+	}))
+	t.Cleanup(calendar.Close)
+	holidays.configure(HolidayConfig{Dates: []string{"2024-06-04"}, ICalURL: calendar.URL})
+	if err := holidays.fetch(context.Background(), calendar.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// 08:00 in Jakarta is 01:00 UTC.
+	resp, body := env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"start","cron":"0 8 * * 1-5","timezone":"Asia/Jakarta"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+
+	resp, body = env.do(http.MethodGet, "/v1/instances/"+testInstance+"/schedule?count=4", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	var got []string
+	for _, item := range body["data"].([]interface{}) {
+		run := item.(map[string]interface{})
+		got = append(got, fmt.Sprintf("%v %v %v", run["local_time"], run["skipped"], run["holiday"]))
+	}
+	want := []string{
+		"2024-06-04 08:00:00 true holiday",
+		"2024-06-05 08:00:00 <nil> <nil>",
+		"2024-06-06 08:00:00 true Public holiday",
+		"2024-06-07 08:00:00 <nil> <nil>",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("preview = %q, want %q", got, want)
+	}
+
+	resp, body = env.do(http.MethodGet, "/v1/instances/"+testInstance+"/schedule?count=0", "")
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body = env.do(http.MethodPost, "/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedStopLatency)
+
+	sched := newScheduler(schedules)
+	sched.now = env.clock
+	sched.last = env.clock()
+
+	// 2024-06-04 01:01 UTC, the holiday start is skipped.
+	env.advance(16 * time.Hour)
+	sched.tick()
+	env.advance(time.Minute)
+	if state := env.instance().State; state != "STOPPED" {
+		t.Fatalf("state = %s after a start on a holiday", state)
+	}
+
+	env.advance(24 * time.Hour)
+	sched.tick()
+	env.advance(simulatedStartLatency)
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Fatalf("state = %s after a start on a working day", state)
+	}
+}
+
+func TestDelayedActions(t *testing.T) {
+	env := newTestEnv(t)
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+
+	resp, body := env.do(http.MethodPost, "/v1/schedule-once", `{"instance":"`+testInstance+`","action":"stop","after":"2h","reason":"after the migration"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	id := dataField(body, "id").(string)
+	if at := dataField(body, "at"); at != "2024-06-03T11:00:00Z" {
+		t.Errorf("at = %v, want two hours from now", at)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/schedule-once", `{"instance":"`+testInstance+`","action":"scale","at":"2024-06-02T22:00:00Z"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	if errs, _ := body["errors"].([]interface{}); len(errs) != 2 {
+		t.Errorf("errors = %v, want the missing tier and the past time", body["errors"])
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/schedule-once", `{"instance":"`+testInstance+`","action":"start","at":"2024-06-03T12:00:00Z"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	cancelled := dataField(body, "id").(string)
+	resp, body = env.do(http.MethodDelete, "/v1/schedule-once/"+cancelled, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	resp, body = env.do(http.MethodGet, "/v1/schedule-once/"+cancelled, "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+
+	resp, body = env.do(http.MethodGet, "/v1/schedule-once?instance="+testInstance, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if items := body["data"].([]interface{}); len(items) != 1 || items[0].(map[string]interface{})["id"] != id {
+		t.Errorf("delayed actions = %v, want only %s", items, id)
+	}
+
+	if runs := delayedActions.runDue(context.Background()); len(runs) != 0 {
+		t.Errorf("ran %+v before it was due", runs)
+	}
+	env.advance(2 * time.Hour)
+	runs := delayedActions.runDue(context.Background())
+	if len(runs) != 1 || runs[0].action.ID != id || runs[0].err != nil {
+		t.Fatalf("runs = %+v, want %s run", runs, id)
+	}
+	if state := env.instance().State; state != "STOPPED" {
+		t.Errorf("state = %s after the delayed stop", state)
+	}
+	if len(delayedActions.list()) != 0 {
+		t.Errorf("delayed actions left after the run: %+v", delayedActions.list())
+	}
+
+	// Actions missed by more than the grace period are dropped.
+	resp, body = env.do(http.MethodPost, "/v1/schedule-once", `{"instance":"`+testInstance+`","action":"start","after":"10m"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	env.advance(delayedActionGrace + time.Hour)
+	if runs := delayedActions.runDue(context.Background()); len(runs) != 0 || len(delayedActions.list()) != 0 {
+		t.Errorf("missed action ran or was kept: %+v", runs)
+	}
+}
+
+func TestOverridesSkipSchedules(t *testing.T) {
+	env := newTestEnv(t)
+
+	// Stops at 20:00 UTC, the clock starts on Monday 2024-06-03 09:00 UTC.
+	resp, body := env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"stop","cron":"0 20 * * *"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+
+	resp, body = env.do(http.MethodPost, "/v1/overrides", `{"instance":"`+testInstance+`","until":"2024-06-04T06:00:00Z","reason":"late demo"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	id := dataField(body, "id")
+	if got := dataField(body, "skip"); !reflect.DeepEqual(got, []interface{}{"stop"}) {
+		t.Errorf("skip = %v, want the stops by default", got)
+	}
+
+	for _, tt := range []struct{ name, body string }{
+		{"past", `{"instance":"` + testInstance + `","until":"2024-06-01T00:00:00Z"}`},
+		{"too far", `{"instance":"` + testInstance + `","until":"2024-12-01T00:00:00Z"}`},
+		{"unknown action", `{"instance":"` + testInstance + `","until":"2024-06-04T06:00:00Z","skip":["restart"]}`},
+	} {
+		resp, body = env.do(http.MethodPost, "/v1/overrides", tt.body)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+	}
+
+	resp, body = env.do(http.MethodGet, "/v1/instances/"+testInstance+"/schedule?count=2", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	runs := body["data"].([]interface{})
+	if first := runs[0].(map[string]interface{}); first["skipped"] != true || first["override"] != id {
+		t.Errorf("tonight's stop = %v, want skipped by override %v", first, id)
+	}
+	if second := runs[1].(map[string]interface{}); second["skipped"] != nil {
+		t.Errorf("tomorrow's stop = %v, want it to run", second)
+	}
+
+	sched := newScheduler(schedules)
+	sched.now = env.clock
+	sched.last = env.clock()
+
+	env.advance(11*time.Hour + time.Minute)
+	sched.tick()
+	env.advance(simulatedStopLatency)
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Fatalf("state = %s after a stop skipped by an override", state)
+	}
+
+	// Expired overrides are gone.
+	env.advance(12 * time.Hour)
+	resp, body = env.do(http.MethodGet, "/v1/overrides", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := body["data"].([]interface{}); len(got) != 0 {
+		t.Errorf("overrides after expiry = %v, want none", got)
+	}
+	resp, body = env.do(http.MethodGet, "/v1/overrides/"+id.(string), "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+
+	sched.tick()
+	env.advance(12*time.Hour + simulatedStopLatency)
+	sched.tick()
+	env.advance(simulatedStopLatency)
+	if state := env.instance().State; state != "STOPPED" {
+		t.Fatalf("state = %s after a stop once the override ended", state)
+	}
+}
+
+func TestDeleteOverride(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do(http.MethodPost, "/v1/overrides", `{"instance":"`+testInstance+`","skip":["start"],"until":"2024-06-05T00:00:00Z"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	id := dataField(body, "id").(string)
+
+	resp, body = env.do(http.MethodGet, "/v1/overrides?instance="+testInstance, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := body["data"].([]interface{}); len(got) != 1 {
+		t.Fatalf("overrides = %v, want the one created", got)
+	}
+
+	resp, body = env.do(http.MethodDelete, "/v1/overrides/"+id, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if got := overrides.skipping(testProject, testInstance, scheduleActionStart, env.clock()); got != nil {
+		t.Errorf("override %s still skips starts after DELETE", got.ID)
+	}
+	resp, body = env.do(http.MethodDelete, "/v1/overrides/"+id, "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+}
+
+func TestScheduleCalendar(t *testing.T) {
+	env := newTestEnv(t)
+
+	for _, schedule := range []string{
+		`{"instance":"` + testInstance + `","action":"start","cron":"0 8 * * 1-5","timezone":"Asia/Jakarta"}`,
+		`{"instance":"` + testInstance + `","action":"stop","cron":"0 20 * * 1-5","timezone":"Asia/Jakarta"}`,
+		`{"instance":"other-db","action":"stop","cron":"30 22 * * *"}`,
+	} {
+		resp, body := env.do(http.MethodPost, "/v1/schedules", schedule)
+		expectStatus(t, resp, body, http.StatusCreated)
+	}
+	// Skip Tuesday's start in Jakarta, 01:00 UTC.
+	resp, body := env.do(http.MethodPost, "/v1/overrides", `{"instance":"`+testInstance+`","skip":["start"],"until":"2024-06-04T12:00:00Z"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+
+	// The clock is Monday 2024-06-03 09:00 UTC, 16:00 in Jakarta.
+	resp, body = env.do(http.MethodGet, "/v1/schedule/preview?days=2", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	data := body["data"].(map[string]interface{})
+	var got []string
+	for _, item := range data["runs"].([]interface{}) {
+		run := item.(map[string]interface{})
+		got = append(got, fmt.Sprintf("%v %v %v %v", run["at"], run["instance"], run["action"], run["skipped"]))
+	}
+	want := []string{
+		"2024-06-03T13:00:00Z test-db stop <nil>",
+		"2024-06-03T22:30:00Z other-db stop <nil>",
+		"2024-06-04T01:00:00Z test-db start true",
+		"2024-06-04T13:00:00Z test-db stop <nil>",
+		"2024-06-04T22:30:00Z other-db stop <nil>",
+		"2024-06-05T01:00:00Z test-db start <nil>",
+	}
+	if !reflect.DeepEqual(got, want) || data["until"] != "2024-06-05T09:00:00Z" || data["truncated"] != nil {
+		t.Errorf("calendar = %q until %v, want %q", got, data["until"], want)
+	}
+
+	resp, body = env.do(http.MethodGet, "/v1/schedule/preview?days=1&instance=other-db", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if runs := body["data"].(map[string]interface{})["runs"].([]interface{}); len(runs) != 1 {
+		t.Errorf("calendar of other-db = %v, want one stop", runs)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/schedules", `{"instance":"busy-db","action":"stop","cron":"* * * * *"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	resp, body = env.do(http.MethodGet, "/v1/schedule/preview", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if data := body["data"].(map[string]interface{}); len(data["runs"].([]interface{})) != maxScheduleCalendarRuns || data["truncated"] != true {
+		t.Errorf("calendar with an every-minute schedule has %d runs, truncated %v", len(data["runs"].([]interface{})), data["truncated"])
+	}
+
+	resp, body = env.do(http.MethodGet, "/v1/schedule/preview?days=90", "")
+	expectStatus(t, resp, body, http.StatusBadRequest)
+}
+
+// newTestKubeAPI serves CloudSQLSchedules from items, keyed by name, and
+// stores the statuses written back.
+func newTestKubeAPI(t *testing.T, items map[string]*CloudSQLSchedule) *kubeClient {
+	t.Helper()
+
+	var mu sync.Mutex
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		collection := "/apis/scheduler-db.dev/v1alpha1/namespaces/default/cloudsqlschedules"
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == collection && r.URL.Query().Get("watch") == "":
+			list := kubeList[CloudSQLSchedule]{}
+			for _, name := range slices.Sorted(maps.Keys(items)) {
+				list.Items = append(list.Items, *items[name])
+			}
+			json.NewEncoder(w).Encode(list)
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/status"):
+			var schedule CloudSQLSchedule
+			if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			items[schedule.Metadata.Name].Status = schedule.Status
+			json.NewEncoder(w).Encode(schedule)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(api.Close)
+
+	client, err := newKubeClient(api.URL, cloudSQLSchedulePlural)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestOperatorReconcilesCloudSQLSchedules(t *testing.T) {
+	env := newTestEnv(t)
+
+	schedule := &CloudSQLSchedule{}
+	schedule.Metadata.Name, schedule.Metadata.Namespace, schedule.Metadata.Generation = "nightly", "default", 1
+	schedule.Spec.InstanceRef.Name = testInstance
+	schedule.Spec.Start, schedule.Spec.Stop = "0 7 * * 1-5", "0 20 * * 1-5"
+	invalid := &CloudSQLSchedule{}
+	invalid.Metadata.Name, invalid.Metadata.Namespace = "invalid", "default"
+	invalid.Spec.InstanceRef.Name, invalid.Spec.Stop = testInstance, "every evening"
+	items := map[string]*CloudSQLSchedule{"nightly": schedule, "invalid": invalid}
+
+	op := &operator{client: newTestKubeAPI(t, items), config: OperatorConfig{Namespace: "default"}, now: env.clock}
+	reconcile := func() CloudSQLCondition {
+		t.Helper()
+		if _, err := op.reconcileAll(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return schedule.Status.Conditions[0]
+	}
+
+	// The 07:00 start already fired and the instance is running.
+	if ready := reconcile(); ready.Status != "True" || ready.Reason != reasonInSync {
+		t.Fatalf("Ready = %+v, want InSync", ready)
+	}
+	if schedule.Status.DesiredAction != "start" || schedule.Status.NextStop != "2024-06-03T20:00:00Z" {
+		t.Errorf("status = %+v", schedule.Status)
+	}
+	if ready := invalid.Status.Conditions[0]; ready.Status != "False" || ready.Reason != reasonInvalidSpec {
+		t.Errorf("invalid schedule Ready = %+v, want InvalidSpec", ready)
+	}
+
+	env.advance(11*time.Hour + time.Minute)
+	if ready := reconcile(); ready.Reason != reasonProgressing || schedule.Status.Operation == "" {
+		t.Fatalf("Ready = %+v after the stop fired, want Progressing", ready)
+	}
+	env.advance(simulatedStopLatency)
+	if ready := reconcile(); ready.Status != "True" || schedule.Status.InstanceState != "STOPPED" {
+		t.Fatalf("Ready = %+v, state %s once stopped", ready, schedule.Status.InstanceState)
+	}
+
+	// A start by hand after the stop is left alone until the next transition.
+	resp, body := env.do(http.MethodPost, "/start", `{"ActivationPolicy":"ALWAYS"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	env.advance(simulatedStartLatency)
+	reconcile()
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Errorf("state = %s, the operator stopped the instance again", state)
+	}
+}
+
+// newTestLeaseAPI serves the Lease API with the resource version checks of
+// the API server.
+func newTestLeaseAPI(t *testing.T) (*kubeLease, func() *kubeLeaseObject) {
+	t.Helper()
+
+	var (
+		mu      sync.Mutex
+		lease   *kubeLeaseObject
+		version int
+	)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		collection := "/apis/coordination.k8s.io/v1/namespaces/default/leases"
+		var body kubeLeaseObject
+		if r.Method != http.MethodGet {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		switch {
+		case r.URL.Path == collection+"/scheduler-db" && r.Method == http.MethodGet && lease != nil:
+		case r.URL.Path == collection && r.Method == http.MethodPost && lease == nil:
+		case r.URL.Path == collection+"/scheduler-db" && r.Method == http.MethodPut && lease != nil:
+			if body.Metadata.ResourceVersion != lease.Metadata.ResourceVersion {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(kubeStatus{Message: "the object has been modified", Code: http.StatusConflict})
+				return
+			}
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(kubeStatus{Message: "already exists", Code: http.StatusConflict})
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			version++
+			body.Metadata.ResourceVersion = strconv.Itoa(version)
+			lease = &body
+		}
+		json.NewEncoder(w).Encode(lease)
+	}))
+	t.Cleanup(api.Close)
+
+	client, err := newKubeClient(api.URL, "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &kubeLease{client: client, namespace: "default", name: "scheduler-db"}, func() *kubeLeaseObject {
+		mu.Lock()
+		defer mu.Unlock()
+		return lease
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	env := newTestEnv(t)
+	lock, current := newTestLeaseAPI(t)
+	elector := func(identity string) *leaderElector {
+		e := newLeaderElector(lock, identity, 15*time.Second)
+		e.now = env.clock
+		return e
+	}
+	try := func(e *leaderElector) {
+		t.Helper()
+		if err := e.try(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := elector("replica-a"), elector("replica-b")
+
+	try(a)
+	try(b)
+	if !a.leading() || b.leading() {
+		t.Fatalf("leading a=%v b=%v, want a only", a.leading(), b.leading())
+	}
+	if lease := current(); lease.Spec.HolderIdentity != "replica-a" || lease.Spec.RenewTime != "2024-06-03T09:00:00.000000Z" || lease.Spec.LeaseDurationSeconds != 15 {
+		t.Errorf("lease = %+v", lease.Spec)
+	}
+	if got, want := b.status(), (&LeaderStatus{Identity: "replica-b", Holder: "replica-a"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("status = %+v, want %+v", got, want)
+	}
+
+	// Followers hold back automated actions and drop their last tick, so
+	// they catch up from the checkpoint once they take over.
+	leadership = b
+	t.Cleanup(func() { leadership = &leaderElector{now: time.Now} })
+	if !automationHeld(env.clock()) {
+		t.Error("automated actions run on a follower")
+	}
+	sched := newScheduler(schedules)
+	sched.now, sched.last = env.clock, env.clock()
+	sched.tick()
+	if !sched.last.IsZero() {
+		t.Errorf("follower ticked at %s", sched.last)
+	}
+
+	// A renewed lease is followed, an unrenewed one taken over.
+	env.advance(10 * time.Second)
+	try(a)
+	try(b)
+	env.advance(10 * time.Second)
+	try(b)
+	if b.leading() {
+		t.Fatal("b took over a renewed lease")
+	}
+	env.advance(6 * time.Second)
+	try(b)
+	try(a)
+	if !b.leading() || a.leading() {
+		t.Fatalf("leading a=%v b=%v after a stopped renewing, want b only", a.leading(), b.leading())
+	}
+	if automationHeld(env.clock()) {
+		t.Error("automated actions held on the leader")
+	}
+
+	// Updates based on a stale version lose.
+	if err := lock.update(context.Background(), leaseRecord{Holder: "replica-a", Renewed: env.clock(), Duration: 15 * time.Second, version: "1"}); !errors.Is(err, errLeaseConflict) {
+		t.Errorf("stale update = %v, want errLeaseConflict", err)
+	}
+
+	// Releasing hands over without waiting for the lease to expire.
+	b.release()
+	if b.leading() || current().Spec.HolderIdentity != "" {
+		t.Fatalf("lease = %+v after release", current().Spec)
+	}
+	try(a)
+	if !a.leading() {
+		t.Error("a did not take over the released lease")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	env := newTestEnv(t)
+	path := "/v1/instances/" + testInstance + "/restart"
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/backup", "")
+	expectStatus(t, resp, body, http.StatusOK)
+
+	resp, body = env.do(http.MethodPost, path, "")
+	expectStatus(t, resp, body, http.StatusConflict)
+	if body["message_code"] != string(msgRestartBlocked) {
+		t.Errorf("message_code = %v, want %s", body["message_code"], msgRestartBlocked)
+	}
+
+	env.advance(simulatedBackupLatency)
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+
+	resp, body = env.do(http.MethodPost, path+"?wait=true", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	data := body["data"].(map[string]interface{})
+	if operation := data["operation"].(map[string]interface{}); operation["operationType"] != "RESTART" || operation["status"] != "DONE" {
+		t.Errorf("operation = %v, want a finished RESTART", operation)
+	}
+	if state := data["instance"].(map[string]interface{})["state"]; state != "RUNNABLE" {
+		t.Errorf("instance state = %v, want RUNNABLE", state)
+	}
+
+	env.do(http.MethodPost, "/stop", `{"ActivationPolicy":"NEVER"}`)
+	resp, body = env.do(http.MethodPost, path, "")
+	expectStatus(t, resp, body, http.StatusBadRequest)
+}
+
+func TestScaleTier(t *testing.T) {
+	env := newTestEnv(t)
+	path := "/v1/instances/" + testInstance + "/tier"
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.unavailableTiers = map[string]bool{"db-custom-8-32768": true}
+	env.fake.mu.Unlock()
+
+	resp, body := env.do(http.MethodPost, path, `{"tier":"db-custom-2-7680"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if previous := dataField(body, "previous_tier"); previous != "db-f1-micro" {
+		t.Errorf("previous_tier = %v, want db-f1-micro", previous)
+	}
+	if tier := env.instance().Settings.Tier; tier != "db-custom-2-7680" {
+		t.Errorf("tier = %s after scaling up", tier)
+	}
+
+	resp, body = env.do(http.MethodPost, path, `{"tier":"db-custom-2-7680"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if body["message_code"] != string(msgTierUnchanged) {
+		t.Errorf("message_code = %v, want %s", body["message_code"], msgTierUnchanged)
+	}
+
+	resp, body = env.do(http.MethodPost, path, `{"tier":"huge"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body = env.do(http.MethodPost, path, `{"tier":"db-custom-8-32768"}`)
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+	if description, _ := body["error_description"].(string); !strings.Contains(description, "rolled back to db-custom-2-7680") {
+		t.Errorf("error_description = %q, want the rollback reported", description)
+	}
+	if tier := env.instance().Settings.Tier; tier != "db-custom-2-7680" {
+		t.Errorf("tier = %s, want the failed change rolled back", tier)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"scale","cron":"0 20 * * *"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	resp, body = env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"scale","tier":"db-g1-small","cron":"0 20 * * *"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+
+	schedule, err := schedules.get(dataField(body, "id").(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runScheduledAction(context.Background(), schedule); err != nil {
+		t.Fatal(err)
+	}
+	if tier := env.instance().Settings.Tier; tier != "db-custom-2-7680" {
+		t.Errorf("tier = %s, the scale schedule ran without resize_schedules", tier)
+	}
+	features.set(flagResizeSchedules, true)
+	t.Cleanup(func() { features.set(flagResizeSchedules, false) })
+	if err := runScheduledAction(context.Background(), schedule); err != nil {
+		t.Fatal(err)
+	}
+	if tier := env.instance().Settings.Tier; tier != "db-g1-small" {
+		t.Errorf("tier = %s after the scale schedule", tier)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	env := newTestEnv(t)
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/failover", "")
+	expectStatus(t, resp, body, http.StatusConflict)
+	if body["message_code"] != "failover_not_ha" {
+		t.Errorf("failover of a zonal instance = %v, want failover_not_ha", body)
+	}
+
+	env.fake.addInstance(&sqladmin.DatabaseInstance{
+		Name:             "prod-db",
+		Project:          testProject,
+		GceZone:          "asia-southeast2-a",
+		SecondaryGceZone: "asia-southeast2-b",
+		Settings:         &sqladmin.Settings{AvailabilityType: "REGIONAL", SettingsVersion: 7},
+	})
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/prod-db/failover?wait=true", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	data := body["data"].(map[string]interface{})
+	if data["previous_zone"] != "asia-southeast2-a" || data["zone"] != "asia-southeast2-b" || data["settings_version"] != 7.0 {
+		t.Errorf("failover = %v, want from zone a to b at settings version 7", data)
+	}
+	if operation := data["operation"].(map[string]interface{}); operation["operationType"] != "FAILOVER" || operation["status"] != "DONE" {
+		t.Errorf("operation = %v, want a finished FAILOVER", operation)
+	}
+}
+
+// TestFailoverStaleSettingsVersion checks that a failover refused because
+// the settings changed meanwhile is requested again with the new version.
+func TestPromoteReplica(t *testing.T) {
+	env := newTestEnv(t)
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.instances[testProject+"/"+testInstance].ReplicaNames = []string{"test-db-dr"}
+	env.fake.mu.Unlock()
+	env.fake.addInstance(&sqladmin.DatabaseInstance{
+		Name:               "test-db-dr",
+		Project:            testProject,
+		InstanceType:       "READ_REPLICA_INSTANCE",
+		MasterInstanceName: testProject + ":" + testInstance,
+	})
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/promote", "")
+	expectStatus(t, resp, body, http.StatusConflict)
+	if body["message_code"] != "promote_not_replica" {
+		t.Errorf("promoting a primary = %v, want promote_not_replica", body)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/test-db-dr/promote", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	token, _ := dataField(body, "confirmation_token").(string)
+	if body["message_code"] != "promote_confirmation_required" || token == "" || dataField(body, "primary") != testProject+":"+testInstance {
+		t.Fatalf("first call = %v, want a confirmation token", body)
+	}
+	env.fake.mu.Lock()
+	confirmed := env.fake.instances[testProject+"/test-db-dr"].MasterInstanceName == ""
+	env.fake.mu.Unlock()
+	if confirmed {
+		t.Fatal("replica promoted without confirmation")
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/test-db-dr/promote", `{"confirmation_token":"1.forged"}`)
+	expectStatus(t, resp, body, http.StatusConflict)
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/test-db-dr/promote?wait=true", `{"confirmation_token":"`+token+`"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if operation := dataField(body, "operation").(map[string]interface{}); operation["operationType"] != "PROMOTE_REPLICA" || operation["status"] != "DONE" {
+		t.Errorf("operation = %v, want a finished PROMOTE_REPLICA", operation)
+	}
+	env.fake.mu.Lock()
+	replica, primary := *env.fake.instances[testProject+"/test-db-dr"], *env.fake.instances[testProject+"/"+testInstance]
+	env.fake.mu.Unlock()
+	if replica.MasterInstanceName != "" || len(primary.ReplicaNames) != 0 {
+		t.Errorf("after promotion: replica of %q, primary replicas %v", replica.MasterInstanceName, primary.ReplicaNames)
+	}
+
+	entries, err := auditLog.query(context.Background(), auditQuery{Action: actionPromote, Limit: 10})
+	if err != nil || len(entries) != 4 || entries[0].Operation == "" {
+		t.Errorf("audit entries = %+v, err = %v, want every call with the operation of the promotion", entries, err)
+	}
+}
+
+func TestFailoverStaleSettingsVersion(t *testing.T) {
+	env := newTestEnv(t)
+	env.fake.addInstance(&sqladmin.DatabaseInstance{
+		Name:     "prod-db",
+		Project:  testProject,
+		Settings: &sqladmin.Settings{AvailabilityType: "REGIONAL", SettingsVersion: 3},
+	})
+
+	sqlService, err := sqlAdminService(testProject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := &sqladmin.DatabaseInstance{Name: "prod-db", Settings: &sqladmin.Settings{SettingsVersion: 2}}
+	operation, version, err := failover(context.Background(), sqlService, testProject, stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 || operation.OperationType != "FAILOVER" {
+		t.Errorf("failover = %s at version %d, want a FAILOVER at version 3", operation.OperationType, version)
+	}
+}
+
+func TestClone(t *testing.T) {
+	env := newTestEnv(t)
+	path := "/v1/instances/" + testInstance + "/clone"
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+
+	for _, payload := range []string{`{}`, `{"name":"Dev_DB"}`, `{"name":"` + testInstance + `"}`, `{"name":"dev-db","tier":"huge"}`, `{"name":"dev-db","timezone":"Asia/Jakarta"}`} {
+		resp, body := env.do(http.MethodPost, path, payload)
+		expectStatus(t, resp, body, http.StatusBadRequest)
+	}
+
+	resp, body := env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"stop","cron":"0 20 * * *","timezone":"Asia/Jakarta"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+
+	resp, body = env.do(http.MethodPost, path+"?wait=true", `{"name":"dev-db","tier":"db-g1-small","labels":{"env":"dev"}}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	data := body["data"].(map[string]interface{})
+	if operation := data["operation"].(map[string]interface{}); operation["operationType"] != "CLONE" || operation["status"] != "DONE" {
+		t.Errorf("operation = %v, want a finished CLONE", operation)
+	}
+	if state := data["instance"].(map[string]interface{})["state"]; state != "RUNNABLE" {
+		t.Errorf("clone state = %v, want RUNNABLE", state)
+	}
+	inherited := data["schedules"].([]interface{})
+	if len(inherited) != 1 || inherited[0].(map[string]interface{})["instance"] != "dev-db" || inherited[0].(map[string]interface{})["timezone"] != "Asia/Jakarta" {
+		t.Errorf("schedules = %v, want the stop schedule of the source", inherited)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		env.fake.mu.Lock()
+		env.fake.advance()
+		clone := env.fake.instances[testProject+"/dev-db"]
+		tier, labels := clone.Settings.Tier, clone.Settings.UserLabels
+		env.fake.mu.Unlock()
+		if tier == "db-g1-small" && labels["env"] == "dev" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("clone settings never applied: tier %s, labels %v", tier, labels)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tier := env.instance().Settings.Tier; tier != "db-f1-micro" {
+		t.Errorf("source tier = %s, want it untouched", tier)
+	}
+
+	resp, body = env.do(http.MethodPost, path, `{"name":"dev-db"}`)
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+
+	resp, body = env.do(http.MethodPost, path, `{"name":"qa-db","stop_cron":"0 19 * * 1-5"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if items := dataField(body, "schedules").([]interface{}); len(items) != 1 || items[0].(map[string]interface{})["cron"] != "0 19 * * 1-5" {
+		t.Errorf("schedules = %v, want one on stop_cron", items)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	env := newTestEnv(t)
+	events = newEventHub()
+	events.configure(10 * time.Millisecond)
+	t.Cleanup(func() { events.close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, env.server.URL+"/v1/events?instance="+testInstance, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+
+	received := make(chan InstanceEvent, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var event InstanceEvent
+				json.Unmarshal([]byte(data), &event)
+				received <- event
+			}
+		}
+	}()
+	next := func() InstanceEvent {
+		t.Helper()
+		select {
+		case event := <-received:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+			return InstanceEvent{}
+		}
+	}
+
+	resp2, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp2, body, http.StatusOK)
+	if event := next(); event.Type != eventOperationStarted || event.Action != "stop" || event.Operation != dataField(body, "operation").(map[string]interface{})["name"] {
+		t.Errorf("first event = %+v, want the stop operation started", event)
+	}
+
+	// Let the poller record the running state before the stop completes.
+	time.Sleep(50 * time.Millisecond)
+	env.advance(simulatedStopLatency)
+
+	got := map[string]InstanceEvent{}
+	for len(got) < 2 {
+		event := next()
+		got[event.Type] = event
+	}
+	if event := got[eventStateChanged]; event.From != "RUNNABLE" || event.To != "STOPPED" || event.Instance != testInstance {
+		t.Errorf("state event = %+v, want RUNNABLE to STOPPED", event)
+	}
+	if _, ok := got[eventOperationDone]; !ok {
+		t.Errorf("events = %v, want the stop operation done", got)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	env := newTestEnv(t)
+	saved := authenticators.load()
+	authenticators.store([]authenticator{apiKeyAuthenticator{keys: []string{"secret"}}})
+	t.Cleanup(func() { authenticators.store(saved) })
+
+	// Served without credentials.
+	resp, err := http.Get(env.server.URL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var document map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+
+	if document["openapi"] != openAPIVersion {
+		t.Errorf("openapi = %v", document["openapi"])
+	}
+	paths := document["paths"].(map[string]any)
+	for _, route := range []string{"/v1/instances/{instance}/start", "/v1/projects/{project}/instances/{instance}/stop", "/v1/schedules/{id}", "/v1/events", "/check"} {
+		if paths[route] == nil {
+			t.Errorf("path %s is not documented", route)
+		}
+	}
+	schemes := document["components"].(map[string]any)["securitySchemes"].(map[string]any)
+	if schemes["apiKey"] == nil || len(schemes) != 1 {
+		t.Errorf("securitySchemes = %v, want apiKey only", schemes)
+	}
+
+	// Every reference resolves and operation ids are unique.
+	schemas := document["components"].(map[string]any)["schemas"].(map[string]any)
+	ids := map[string]bool{}
+	var walk func(value any)
+	walk = func(value any) {
+		switch v := value.(type) {
+		case map[string]any:
+			if ref, ok := v["$ref"].(string); ok && schemas[strings.TrimPrefix(ref, "#/components/schemas/")] == nil {
+				t.Errorf("unresolved $ref %s", ref)
+			}
+			if id, ok := v["operationId"].(string); ok {
+				if ids[id] {
+					t.Errorf("duplicate operationId %s", id)
+				}
+				ids[id] = true
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(document)
+	for _, name := range []string{"Envelope", "ErrorEnvelope", "FieldError", "ActivationPolicyRequest", "sqladmin.Operation", "MaintenanceWindow", "sqladmin.MaintenanceWindow"} {
+		if schemas[name] == nil {
+			t.Errorf("schema %s is missing", name)
+		}
+	}
+
+	resp, err = http.Get(env.server.URL + "/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `url: "openapi.json"`) {
+		t.Errorf("GET /docs = %d %s", resp.StatusCode, body)
+	}
+
+	// The API itself still needs credentials.
+	resp, body2 := env.do(http.MethodGet, "/v1/schedules", "")
+	expectStatus(t, resp, body2, http.StatusUnauthorized)
+}
+
+func TestRateLimit(t *testing.T) {
+	env := newTestEnv(t)
+	now := time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC)
+	rateLimits = newRateLimiter()
+	rateLimits.now = func() time.Time { return now }
+	rateLimits.configure(RateLimitConfig{PerMinute: 6, Burst: 2})
+	t.Cleanup(func() { rateLimits = newRateLimiter() })
+
+	body := `{"ActivationPolicy":"ALWAYS"}`
+	for i := 0; i < 2; i++ {
+		resp, data := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/start", body)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("request %d rate limited: %s", i+1, data)
+		}
+	}
+
+	resp, data := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/start", body)
+	expectStatus(t, resp, data, http.StatusTooManyRequests)
+	if got := resp.Header.Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After = %q, want 10", got)
+	}
+	if got := data["error_type"]; got != "rate_limited" {
+		t.Errorf("error_type = %v, want rate_limited", got)
+	}
+
+	// Reads are not limited.
+	resp, data = env.do(http.MethodGet, "/v1/instances/"+testInstance, "")
+	expectStatus(t, resp, data, http.StatusOK)
+
+	now = now.Add(10 * time.Second)
+	resp, data = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/start", body)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		t.Errorf("request after refill rate limited: %s", data)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	env := newTestEnv(t)
+	for name, policy := range map[string]string{"dev-api": "ALWAYS", "dev-jobs": "NEVER"} {
+		env.fake.addInstance(&sqladmin.DatabaseInstance{Name: name, Project: testProject, Settings: &sqladmin.Settings{ActivationPolicy: policy}})
+	}
+
+	resp, body := env.do(http.MethodPost, "/v1/batch", `{"items":[{"instance":"dev-api","action":"pause"},{"instance":"dev-api","action":"stop"},{"project":"`+testProject+`","instance":"dev-api","action":"start"}]}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+	if errs, _ := body["errors"].([]interface{}); len(errs) != 3 {
+		t.Errorf("errors = %v, want the bad action and both duplicates", body["errors"])
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/batch", `{"items":[
+		{"instance":"dev-api","action":"stop"},
+		{"instance":"dev-jobs","action":"stop"},
+		{"instance":"missing","action":"stop"},
+		{"project":"`+testProject+`","instance":"`+testInstance+`","action":"start"}]}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if changed, failed := dataField(body, "changed"), dataField(body, "failed"); changed != 1.0 || failed != 1.0 {
+		t.Errorf("changed %v, failed %v, want 1 and 1", changed, failed)
+	}
+	results := dataField(body, "results").([]interface{})
+	var outcomes []string
+	for _, result := range results {
+		outcomes = append(outcomes, result.(map[string]interface{})["outcome"].(string))
+	}
+	if want := []string{"changed", "skipped", "failed", "skipped"}; !reflect.DeepEqual(outcomes, want) {
+		t.Errorf("outcomes = %v, want %v", outcomes, want)
+	}
+	if operation := results[0].(map[string]interface{})["operation"]; operation == nil {
+		t.Error("changed item has no operation")
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	env := newTestEnv(t)
+	queue := newJobQueue(1)
+	release := make(chan struct{})
+	item := func(instance string) bulkItem {
+		return bulkItem{Project: testProject, Instance: instance, Run: func(ctx context.Context) BulkResult {
+			<-release
+			return BulkResult{Project: testProject, Instance: instance, Outcome: bulkOutcomeChanged}
+		}}
+	}
+
+	done := make(chan []BulkResult)
+	go func() {
+		_, results := queue.run(context.Background(), actionBatch, "alice", []bulkItem{item("a"), item("b"), item("c")})
+		done <- results
+	}()
+	var statuses []BatchStatus
+	for deadline := time.Now().Add(time.Second); len(statuses) == 0 || statuses[0].Running == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("batch never started")
+		}
+		statuses = queue.list("alice")
+	}
+	if statuses[0].Pending != 2 || statuses[0].Running != 1 || len(queue.list("bob")) != 0 {
+		t.Fatalf("batches = %+v", statuses)
+	}
+
+	status, ok := queue.cancel(statuses[0].ID)
+	if !ok || status.Cancelled != 2 || status.Pending != 0 {
+		t.Errorf("cancel = %+v, %v", status, ok)
+	}
+	close(release)
+	results := <-done
+	var outcomes []string
+	for _, result := range results {
+		outcomes = append(outcomes, result.Outcome)
+	}
+	if want := []string{bulkOutcomeChanged, bulkOutcomeCancelled, bulkOutcomeCancelled}; !slices.Equal(outcomes, want) || results[2].Instance != "c" {
+		t.Errorf("results = %+v", results)
+	}
+	if _, ok := queue.cancel(statuses[0].ID); ok {
+		t.Error("finished batch cancelled again")
+	}
+
+	resp, body := env.do(http.MethodGet, "/v1/batches", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	resp, body = env.do(http.MethodDelete, "/v1/batches/missing", "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+
+	limiter := &qpsLimiter{}
+	limiter.configure(50)
+	start := time.Now()
+	for range 3 {
+		if err := limiter.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("3 calls at 50 QPS took %s", elapsed)
+	}
+
+	// Only SQL Admin calls are paced, Cloud Monitoring reads don't wait.
+	sqlAdminLimiter.configure(0.01)
+	t.Cleanup(func() { sqlAdminLimiter.configure(0) })
+	resetSQLAdminService()
+	sqlAdminLimiter.wait(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := activeConnections(ctx, testProject, testInstance); err != nil {
+		t.Errorf("Cloud Monitoring read: %v, want it not paced by SQLADMIN_QPS", err)
+	}
+}
+
+func TestStopRefusedWithOpenConnections(t *testing.T) {
+	env := newTestEnv(t)
+	connectionCheck.store(ConnectionCheckConfig{Enabled: true, MaxConnections: 5})
+	t.Cleanup(func() { connectionCheck.store(ConnectionCheckConfig{}) })
+	env.fake.mu.Lock()
+	env.fake.connections = map[string]int64{testProject + "/" + testInstance: 12}
+	env.fake.mu.Unlock()
+
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusConflict)
+	if body["message_code"] != string(msgConnectionsActive) || !strings.Contains(body["message"].(string), "12 open connections") {
+		t.Errorf("message = %v, want the open connections", body["message"])
+	}
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Errorf("state = %s, want the instance left running", state)
+	}
+
+	_, err := runTriggeredAction(context.Background(), triggeredAction{Action: scheduleActionStop, Project: testProject, Instance: testInstance, Source: actionSourceSchedule})
+	if !errors.Is(err, errConnectionsActive) {
+		t.Errorf("scheduled stop err = %v, want errConnectionsActive", err)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop?force=true", `{"ActivationPolicy":"NEVER"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+}
+
+func TestReconcile(t *testing.T) {
+	env := newTestEnv(t)
+	env.fake.mu.Lock()
+	instance := env.fake.instances[testProject+"/"+testInstance]
+	instance.State, instance.Settings.ActivationPolicy = "STOPPED", "NEVER"
+	env.fake.mu.Unlock()
+
+	events := make(chan NotificationEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event NotificationEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	t.Cleanup(receiver.Close)
+	notifications.configure(NotifyConfig{WebhookURLs: []string{receiver.URL}, Template: defaultNotifyTemplate})
+	t.Cleanup(func() { notifications.configure(NotifyConfig{}) })
+
+	// Running from 08:00 to 20:00 UTC, the test clock starts at 09:00.
+	config := ReconcileConfig{Interval: time.Minute, Instances: []DesiredState{{
+		Project:  testProject,
+		Instance: testInstance,
+		Windows:  []RunningWindow{{Start: "0 8 * * *", Stop: "0 20 * * *"}},
+	}}}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	reconciles.configure(config)
+	reconciles.now = env.clock
+	t.Cleanup(func() { reconciles.now = time.Now })
+
+	// Without the feature flag drift is left alone.
+	reconciles.check(context.Background())
+	notifications.wait(context.Background())
+	if len(events) != 0 {
+		t.Fatalf("got %d notifications without the reconciler flag", len(events))
+	}
+	features.set(flagReconciler, true)
+	t.Cleanup(func() { features.set(flagReconciler, false) })
+
+	reconciles.check(context.Background())
+	notifications.wait(context.Background())
+	if len(events) != 1 {
+		t.Fatalf("got %d notifications, want the correcting start", len(events))
+	}
+	if event := <-events; event.Action != scheduleActionStart || event.Source != actionSourceReconcile || !strings.Contains(event.TriggeredBy, "desired state running since 2024-06-03T08:00:00Z, found STOPPED") {
+		t.Errorf("notification = %+v", event)
+	}
+
+	// Nothing more is done while the start is in progress, nor once the
+	// instance runs.
+	reconciles.check(context.Background())
+	env.advance(simulatedStartLatency)
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Fatalf("state = %s, want the instance started", state)
+	}
+	reconciles.check(context.Background())
+	notifications.wait(context.Background())
+	if len(events) != 0 {
+		t.Fatalf("got %d more notifications for an instance in its desired state", len(events))
+	}
+
+	// After the window the instance is stopped, unless an override keeps
+	// it running.
+	env.advance(12 * time.Hour)
+	resp, body := env.do(http.MethodPost, "/v1/overrides", `{"instance":"`+testInstance+`","until":"2024-06-03T22:00:00Z","reason":"late deploy"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	reconciles.check(context.Background())
+	if policy := env.instance().Settings.ActivationPolicy; policy != "ALWAYS" {
+		t.Errorf("activation policy = %s with an override", policy)
+	}
+	env.advance(2 * time.Hour)
+	reconciles.check(context.Background())
+	env.advance(simulatedStopLatency)
+	if state := env.instance().State; state != "STOPPED" {
+		t.Errorf("state = %s, want the instance stopped after its window", state)
+	}
+
+	invalid := ReconcileConfig{Instances: []DesiredState{
+		{Project: testProject, Instance: "a", Timezone: "Mars/Olympus", Windows: []RunningWindow{{Start: "0 8 * * *", Stop: "later"}}},
+		{Project: testProject, Instance: "a"},
+	}}
+	err := invalid.validate()
+	for _, want := range []string{"RECONCILE_INTERVAL", "instances[0].timezone", "instances[0].windows[0].stop", testProject + "/a is already declared", "instances[1].windows: at least one"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("validate() = %v, want %q reported", err, want)
+		}
+	}
+}
+
+func TestIdleStop(t *testing.T) {
+	env := newTestEnv(t)
+	env.fake.addInstance(&sqladmin.DatabaseInstance{
+		Name:     "busy-db",
+		Project:  testProject,
+		Settings: &sqladmin.Settings{UserLabels: map[string]string{"env": "dev"}},
+	})
+	env.fake.mu.Lock()
+	env.fake.connections = map[string]int64{testProject + "/" + testInstance: 0, testProject + "/busy-db": 3}
+	env.fake.cpu = map[string]float64{testProject + "/" + testInstance: 0.01, testProject + "/busy-db": 0.01}
+	env.fake.mu.Unlock()
+
+	events := make(chan NotificationEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event NotificationEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	t.Cleanup(receiver.Close)
+	notifications.configure(NotifyConfig{WebhookURLs: []string{receiver.URL}, Template: defaultNotifyTemplate})
+	t.Cleanup(func() { notifications.configure(NotifyConfig{}) })
+
+	idleStops.configure(IdleStopConfig{After: time.Hour, GracePeriod: 15 * time.Minute, Labels: map[string]string{"env": "dev"}, MaxCPU: 0.05})
+	idleStops.now = env.clock
+	t.Cleanup(func() {
+		idleStops.now = time.Now
+		clear(idleStops.idle)
+	})
+
+	// Without the feature flag nothing is tracked.
+	idleStops.check(context.Background())
+	if len(idleStops.idle) != 0 {
+		t.Fatalf("idle instances tracked without auto_stop: %v", idleStops.idle)
+	}
+	features.set(flagAutoStop, true)
+	t.Cleanup(func() { features.set(flagAutoStop, false) })
+
+	idleStops.check(context.Background())
+	env.advance(45 * time.Minute)
+	idleStops.check(context.Background())
+	notifications.wait(context.Background())
+	if len(events) != 1 {
+		t.Fatalf("got %d notifications after 45m idle, want the warning", len(events))
+	}
+	if event := <-events; event.Result != notifyResultIdleWarning || event.Instance != testInstance || event.Source != actionSourceIdle || !strings.Contains(event.TriggeredBy, "stops at 2024-06-03T10:00:00Z") {
+		t.Errorf("warning = %+v", event)
+	}
+
+	// The warning is sent once.
+	env.advance(10 * time.Minute)
+	idleStops.check(context.Background())
+	if state := env.instance().State; state != "RUNNABLE" {
+		t.Fatalf("state = %s before the grace period ended", state)
+	}
+
+	env.advance(5 * time.Minute)
+	idleStops.check(context.Background())
+	notifications.wait(context.Background())
+	if len(events) != 1 {
+		t.Fatalf("got %d notifications at the stop, want the stop only", len(events))
+	}
+	if event := <-events; event.Result != notifyResultRequested || event.Action != scheduleActionStop || event.Source != actionSourceIdle {
+		t.Errorf("stop = %+v", event)
+	}
+	env.advance(simulatedStopLatency)
+	if state := env.instance().State; state != "STOPPED" {
+		t.Errorf("state = %s, want the idle instance stopped", state)
+	}
+
+	env.fake.mu.Lock()
+	busy := env.fake.instances[testProject+"/busy-db"].State
+	env.fake.mu.Unlock()
+	if busy != "RUNNABLE" {
+		t.Errorf("busy-db state = %s, want it left running", busy)
+	}
+
+	if err := (IdleStopConfig{After: time.Hour, GracePeriod: time.Hour, MaxCPU: 2}).validate(); err == nil {
+		t.Error("grace period as long as the idle time, no labels and a CPU above 1 accepted")
+	}
+}
+
+func TestDataStores(t *testing.T) {
+	env := newTestEnv(t)
+	env.fake.addAlloyDBCluster(testProject, "asia-southeast2", "analytics", map[string]string{"env": "dev"})
+	env.fake.addRedisInstance(testProject, "asia-southeast2", "cache", 5, nil)
+
+	resp, body := env.do(http.MethodGet, "/v1/stores?label=env=dev", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	stores, _ := dataField(body, "stores").([]interface{})
+	if len(stores) != 2 {
+		t.Fatalf("stores labelled env=dev = %v", stores)
+	}
+	for i, want := range []string{storeKindCloudSQL, storeKindAlloyDB} {
+		if store := stores[i].(map[string]interface{}); store["kind"] != want || store["state"] != storeStateRunning {
+			t.Errorf("stores[%d] = %v, want a running %s store", i, store, want)
+		}
+	}
+
+	// Redis instances are scaled down instead of stopped, and back up on
+	// start.
+	resp, body = env.do(http.MethodPost, "/v1/stores/redis/asia-southeast2/cache/stop", "")
+	expectStatus(t, resp, body, http.StatusAccepted)
+	cache := env.fake.redisInstances["projects/"+testProject+"/locations/asia-southeast2/instances/cache"]
+	if cache.MemorySizeGb != redisMinMemorySizeGb || cache.Labels[redisMemoryLabel] != "5" {
+		t.Fatalf("stopped redis instance = %d GiB, labels %v", cache.MemorySizeGb, cache.Labels)
+	}
+	if state := dataField(body, "state"); state != storeStateRunning {
+		t.Errorf("state before the stop = %v", state)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/stores/redis/asia-southeast2/cache/stop", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if dataField(body, "operation") != nil || dataField(body, "state") != storeStateStopped {
+		t.Errorf("second stop = %v, want nothing to do", body)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/stores/redis/asia-southeast2/cache/start", "")
+	expectStatus(t, resp, body, http.StatusAccepted)
+	if _, saved := cache.Labels[redisMemoryLabel]; cache.MemorySizeGb != 5 || saved {
+		t.Errorf("started redis instance = %d GiB, labels %v", cache.MemorySizeGb, cache.Labels)
+	}
+
+	// AlloyDB clusters stop with their primary, here from a schedule.
+	schedule, err := schedules.create(Schedule{Project: testProject, Instance: "analytics", Kind: storeKindAlloyDB, Location: "asia-southeast2", Action: scheduleActionStop, Cron: "0 20 * * *"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runScheduledAction(context.Background(), schedule); err != nil {
+		t.Fatal(err)
+	}
+	if state := env.fake.alloyDBClusters["projects/"+testProject+"/locations/asia-southeast2/clusters/analytics"].State; state != "STOPPED" {
+		t.Errorf("cluster state = %s after the stop schedule", state)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/schedules", `{"instance":"cache","kind":"redis","action":"scale","tier":"db-f1-micro","cron":"0 8 * * *"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body = env.do(http.MethodPost, "/v1/stores/alloydb/asia-southeast2/missing/start", "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+	resp, body = env.do(http.MethodPost, "/v1/stores/spanner/asia-southeast2/db/start", "")
+	expectStatus(t, resp, body, http.StatusNotFound)
+}
+
+func TestComputeSchedule(t *testing.T) {
+	env := newTestEnv(t)
+	env.fake.addVM(testProject, "asia-southeast2-a", "bastion", map[string]string{"env": "dev"})
+
+	resp, body := env.do(http.MethodPost, "/v1/schedules", `{"instance":"bastion","kind":"gce","location":"asia-southeast2-a","action":"stop","cron":"0 20 * * 1-5"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	schedule, err := schedules.get(dataField(body, "id").(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runScheduledAction(context.Background(), schedule); err != nil {
+		t.Fatal(err)
+	}
+	if status := env.fake.vms[testProject+"/asia-southeast2-a/bastion"].Status; status != "TERMINATED" {
+		t.Fatalf("VM status = %s after the stop schedule", status)
+	}
+
+	entries, err := auditLog.query(context.Background(), auditQuery{Instance: "bastion", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Source != actionSourceSchedule || entries[0].Operation == "" {
+		t.Errorf("audit entries = %+v", entries)
+	}
+
+	resp, body = env.do(http.MethodGet, "/v1/stores?kind=gce", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	stores, _ := dataField(body, "stores").([]interface{})
+	if len(stores) != 1 || stores[0].(map[string]interface{})["state"] != storeStateStopped {
+		t.Errorf("VMs = %v", stores)
+	}
+
+	resp, body = env.do(http.MethodPost, "/v1/stores/gce/asia-southeast2-a/bastion/start", "")
+	expectStatus(t, resp, body, http.StatusAccepted)
+	if status := env.fake.vms[testProject+"/asia-southeast2-a/bastion"].Status; status != "RUNNING" {
+		t.Errorf("VM status = %s after start", status)
+	}
+}
+
+func TestDependencyChain(t *testing.T) {
+	env := newTestEnv(t)
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+	env.fake.addVM(testProject, "asia-southeast2-a", "app", nil)
+
+	chain := Chain{ID: "dev", Steps: []ChainStep{
+		{ID: "app", Kind: storeKindCompute, Location: "asia-southeast2-a", Instance: "app", DependsOn: []string{"db"}},
+		{ID: "db", Instance: testInstance},
+	}}
+	if err := validateChains([]Chain{chain}); err != nil {
+		t.Fatal(err)
+	}
+	action := triggeredAction{Action: scheduleActionStop, Project: testProject, Source: actionSourceSchedule, TriggeredBy: "test"}
+	results, err := runChain(context.Background(), chain, action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Outcome != bulkOutcomeChanged {
+			t.Errorf("stop of step %s: %+v", result.Step, result)
+		}
+	}
+	if status := env.fake.vms[testProject+"/asia-southeast2-a/app"].Status; status != "TERMINATED" {
+		t.Errorf("VM status = %s after the chain stop", status)
+	}
+
+	chain.Steps[1].Instance = "missing"
+	action.Action = scheduleActionStart
+	results, err = runChain(context.Background(), chain, action)
+	if err == nil {
+		t.Fatal("chain with a missing instance started")
+	}
+	if results[0].Outcome != chainOutcomeBlocked || results[1].Outcome != bulkOutcomeFailed {
+		t.Errorf("results = %+v", results)
+	}
+	if status := env.fake.vms[testProject+"/asia-southeast2-a/app"].Status; status != "TERMINATED" {
+		t.Errorf("VM status = %s after a blocked start", status)
+	}
+
+	chain.Steps[1].DependsOn = []string{"app"}
+	if err := validateChains([]Chain{chain}); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("cycle error = %v", err)
+	}
+}
+
+func TestDatabaseUsers(t *testing.T) {
+	env := newTestEnv(t)
+	path := "/v1/instances/" + testInstance + "/users"
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+	storedPassword := func() string {
+		env.fake.mu.Lock()
+		defer env.fake.mu.Unlock()
+		if user := env.fake.users[userKey(testProject, testInstance, "app", "")]; user != nil {
+			return user.Password
+		}
+		return ""
+	}
+
+	resp, body := env.do(http.MethodPost, path, `{"name":"app"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	password, _ := dataField(body, "password").(string)
+	if len(password) != 32 || storedPassword() != password {
+		t.Fatalf("generated password %q, stored %q", password, storedPassword())
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control = %q", resp.Header.Get("Cache-Control"))
+	}
+
+	resp, body = env.do(http.MethodPost, path, `{"name":"app"}`)
+	expectStatus(t, resp, body, http.StatusInternalServerError)
+	resp, body = env.do(http.MethodPost, path, `{"name":"ops@example.com","type":"CLOUD_IAM_USER","password":"secret"}`)
+	expectStatus(t, resp, body, http.StatusBadRequest)
+
+	resp, body = env.do(http.MethodPost, path+"/app/password", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if rotated := dataField(body, "password"); rotated == password || storedPassword() != rotated {
+		t.Errorf("rotated password %v, stored %q", rotated, storedPassword())
+	}
+	resp, body = env.do(http.MethodPost, path+"/app/password", `{"password":"chosen-by-oncall"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	if dataField(body, "password") != nil || storedPassword() != "chosen-by-oncall" {
+		t.Errorf("given password echoed or not stored: %v", body)
+	}
+
+	resp, body = env.do(http.MethodGet, path, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	users, _ := dataField(body, "users").([]interface{})
+	if len(users) != 1 || users[0].(map[string]interface{})["name"] != "app" {
+		t.Fatalf("users = %v", users)
+	}
+
+	resp, body = env.do(http.MethodDelete, path+"/app", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	resp, body = env.do(http.MethodGet, path, "")
+	expectStatus(t, resp, body, http.StatusOK)
+	if users, _ := dataField(body, "users").([]interface{}); len(users) != 0 {
+		t.Errorf("users after delete = %v", users)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	env := newTestEnv(t)
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { waitPollInterval = interval })
+	env.fake.mu.Lock()
+	env.fake.latencyScale = 0
+	env.fake.mu.Unlock()
+
+	for range 2 {
+		resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/backup?wait=true", `{"description":"nightly"}`)
+		expectStatus(t, resp, body, http.StatusOK)
+	}
+	resp, body := env.do(http.MethodGet, "/v1/instances/"+testInstance+"/backups?limit=1", "")
+	expectStatus(t, resp, body, http.StatusOK)
+	backups, _ := dataField(body, "backups").([]interface{})
+	if len(backups) != 1 {
+		t.Fatalf("backups = %v", backups)
+	}
+	if backup := backups[0].(map[string]interface{}); backup["id"] != float64(2) || backup["status"] != "SUCCESSFUL" || backup["description"] != "nightly" {
+		t.Errorf("newest backup = %v", backup)
+	}
+
+	path := "/v1/instances/" + testInstance + "/restore"
+	resp, body = env.do(http.MethodPost, path, `{"backup_id":99}`)
+	expectStatus(t, resp, body, http.StatusNotFound)
+	resp, body = env.do(http.MethodPost, path, `{"backup_id":1}`)
+	expectStatus(t, resp, body, http.StatusOK)
+	token, _ := dataField(body, "confirmation_token").(string)
+	if token == "" {
+		t.Fatalf("no confirmation token: %v", body)
+	}
+	env.fake.mu.Lock()
+	operations := len(env.fake.operations)
+	env.fake.mu.Unlock()
+	if operations != 2 {
+		t.Errorf("unconfirmed restore started an operation")
+	}
+
+	resp, body = env.do(http.MethodPost, path, `{"backup_id":2,"confirmation_token":"`+token+`"}`)
+	expectStatus(t, resp, body, http.StatusConflict)
+	resp, body = env.do(http.MethodPost, path+"?wait=true", `{"backup_id":1,"confirmation_token":"`+token+`"}`)
+	expectStatus(t, resp, body, http.StatusOK)
+
+	if operation := dataField(body, "operation").(map[string]interface{}); operation["operationType"] != "RESTORE_VOLUME" || operation["status"] != "DONE" {
+		t.Errorf("restore operation = %v", operation)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	env := newTestEnv(t)
+	auth := AuthConfig{APIKeys: []string{"dashboard-key"}}
+	authenticators.store(auth.authenticators())
+	cors.store(CORSConfig{AllowedOrigins: []string{"https://*.example.com"}, AllowedMethods: defaultCORSMethods, AllowedHeaders: defaultCORSHeaders, MaxAge: defaultCORSMaxAge})
+
+	preflight := func(origin string) *http.Response {
+		req, err := http.NewRequest(http.MethodOptions, env.server.URL+"/v1/instances/"+testInstance+"/stop", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "x-api-key, content-type")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight("https://dash.example.com")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://dash.example.com" {
+		t.Fatalf("preflight = %d %v", resp.StatusCode, resp.Header)
+	}
+	if !strings.Contains(resp.Header.Get("Access-Control-Allow-Headers"), apiKeyHeader) || resp.Header.Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("preflight headers = %v", resp.Header)
+	}
+	if resp := preflight("https://evil.example.org"); resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight of another origin allowed: %v", resp.Header)
+	}
+
+	resp, body := env.do(http.MethodGet, "/v1/instances/"+testInstance, "", "Origin", "https://dash.example.com", "X-API-Key", "dashboard-key")
+	expectStatus(t, resp, body, http.StatusOK)
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://dash.example.com" || !strings.Contains(resp.Header.Get("Access-Control-Expose-Headers"), requestIDHeader) {
+		t.Errorf("response headers = %v", resp.Header)
+	}
+	resp, body = env.do(http.MethodGet, "/v1/instances/"+testInstance, "", "Origin", "https://dash.example.com")
+	expectStatus(t, resp, body, http.StatusUnauthorized)
+}
+
+// testCertificate issues a certificate for name, signed by parent or
+// self-signed when parent is nil.
+func testCertificate(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, any(key)
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writePEM(t *testing.T, path string, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	newTestEnv(t)
+	dir := t.TempDir()
+	ca := testCertificate(t, "scheduler-db test CA", nil)
+	server := testCertificate(t, "127.0.0.1", &ca)
+	client := testCertificate(t, "dashboard", &ca)
+	stranger := testCertificate(t, "stranger", nil)
+
+	config := TLSConfig{CertFile: filepath.Join(dir, "server.pem"), KeyFile: filepath.Join(dir, "server.key"), ClientCAFile: filepath.Join(dir, "ca.pem")}
+	writePEM(t, config.CertFile, "CERTIFICATE", server.Certificate[0])
+	key, err := x509.MarshalECPrivateKey(server.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, config.KeyFile, "EC PRIVATE KEY", key)
+	writePEM(t, config.ClientCAFile, "CERTIFICATE", ca.Certificate[0])
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := config.serverTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticators.store(AuthConfig{ClientCerts: true}.authenticators())
+	listener := httptest.NewUnstartedServer(newPublicHandler())
+	listener.TLS = tlsConfig
+	listener.StartTLS()
+	t.Cleanup(listener.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	get := func(certificates ...tls.Certificate) (*http.Response, error) {
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates}}}
+		return httpClient.Get(listener.URL + "/v1/instances/" + testInstance)
+	}
+
+	resp, err := get(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("with a client certificate: %d", resp.StatusCode)
+	}
+	if _, err := get(); err == nil {
+		t.Error("accepted a connection without a client certificate")
+	}
+	if _, err := get(stranger); err == nil {
+		t.Error("accepted a client certificate of another CA")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{client.Leaf}}}
+	if principal, err := (clientCertAuthenticator{}).authenticate(req); err != nil || principal != "cert:dashboard" {
+		t.Errorf("principal = %q, %v", principal, err)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+	env := newTestEnv(t)
+	inTrace := func(id trace.TraceID) map[string]sdktrace.ReadOnlySpan {
+		found := make(map[string]sdktrace.ReadOnlySpan)
+		for _, span := range spans.Ended() {
+			if span.SpanContext().TraceID() == id {
+				found[span.Name()] = span
+			}
+		}
+		return found
+	}
+
+	// Requests continue the trace of the caller, SQL Admin calls are its
+	// children.
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	resp, body := env.do(http.MethodPost, "/v1/instances/"+testInstance+"/stop", "", "traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	expectStatus(t, resp, body, http.StatusOK)
+	id, _ := trace.TraceIDFromHex(traceID)
+	found := inTrace(id)
+	server, ok := found["POST /v1/instances/"+testInstance+"/stop"]
+	if !ok || server.SpanKind() != trace.SpanKindServer || server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("spans of the trace = %v, want the server span under the caller's", slices.Collect(maps.Keys(found)))
+	}
+	clients := 0
+	for _, span := range found {
+		if span.SpanKind() == trace.SpanKindClient {
+			clients++
+		}
+	}
+	if clients == 0 {
+		t.Errorf("no SQL Admin call in the trace: %v", slices.Collect(maps.Keys(found)))
+	}
+
+	converted := cloudTraceSpan(testProject, server)
+	if want := "projects/" + testProject + "/traces/" + traceID + "/spans/" + server.SpanContext().SpanID().String(); converted.Name != want ||
+		converted.ParentSpanId != "00f067aa0ba902b7" || converted.SameProcessAsParentSpan || converted.SpanKind != "SERVER" {
+		t.Errorf("Cloud Trace span = %+v", converted)
+	}
+
+	// Scheduled runs start their own trace.
+	resp, body = env.do(http.MethodPost, "/v1/schedules", `{"instance":"`+testInstance+`","action":"start","cron":"30 9 * * *"}`)
+	expectStatus(t, resp, body, http.StatusCreated)
+	env.advance(simulatedStopLatency)
+	sched := newScheduler(schedules)
+	sched.now, sched.last = env.clock, env.clock()
+	env.advance(time.Hour)
+	sched.tick()
+
+	var run sdktrace.ReadOnlySpan
+	for _, span := range spans.Ended() {
+		if span.Name() == "schedule start" {
+			run = span
+		}
+	}
+	if run == nil || run.Parent().IsValid() {
+		t.Fatalf("scheduled run span = %v, want a root span", run)
+	}
+	if _, ok := inTrace(run.SpanContext().TraceID())["start instance"]; !ok {
+		t.Errorf("spans of the scheduled run = %v, want the start", slices.Collect(maps.Keys(inTrace(run.SpanContext().TraceID()))))
+	}
+}
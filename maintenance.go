@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// actionMaintenanceWindow names maintenance window changes in notifications
+// and the audit log.
+const actionMaintenanceWindow = "maintenance_window"
+
+// Update tracks accepted by Cloud SQL, deciding how early an instance gets
+// maintenance compared to the rest of the fleet.
+var updateTracks = map[string]bool{
+	"canary": true,
+	"stable": true,
+	"week5":  true,
+}
+
+// MaintenanceWindow is an instance's maintenance window. Day runs from 1
+// (Monday) to 7 (Sunday), 0 lets Cloud SQL pick any day. Hour is in UTC.
+type MaintenanceWindow struct {
+	Day         int64  `json:"day"`
+	DayName     string `json:"day_name"`
+	Hour        int64  `json:"hour"`
+	UpdateTrack string `json:"update_track,omitempty"`
+}
+
+func newMaintenanceWindow(window *sqladmin.MaintenanceWindow) *MaintenanceWindow {
+	if window == nil {
+		window = &sqladmin.MaintenanceWindow{}
+	}
+	return &MaintenanceWindow{
+		Day:         window.Day,
+		DayName:     maintenanceDayName(window.Day),
+		Hour:        window.Hour,
+		UpdateTrack: window.UpdateTrack,
+	}
+}
+
+func maintenanceDayName(day int64) string {
+	if day < 1 || day > 7 {
+		return "any"
+	}
+	return time.Weekday(day % 7).String()
+}
+
+// MaintenanceWindowRequest is the body of PATCH
+// /v1/instances/{instance}/maintenance-window. Fields left out keep their
+// current value.
+type MaintenanceWindowRequest struct {
+	Day         *int64 `json:"day"`
+	Hour        *int64 `json:"hour"`
+	UpdateTrack string `json:"update_track"`
+}
+
+func (req *MaintenanceWindowRequest) validate() validationErrors {
+	var errs validationErrors
+
+	if req.Day == nil && req.Hour == nil && req.UpdateTrack == "" {
+		errs = append(errs, fieldError{Message: "body must contain at least one of day, hour and update_track"})
+	}
+	if req.Day != nil && (*req.Day < 0 || *req.Day > 7) {
+		errs = append(errs, fieldError{Field: "day", Message: "must be between 1 (Monday) and 7 (Sunday), or 0 for any day"})
+	}
+	if req.Hour != nil && (*req.Hour < 0 || *req.Hour > 23) {
+		errs = append(errs, fieldError{Field: "hour", Message: "must be between 0 and 23"})
+	}
+	if req.UpdateTrack != "" && !updateTracks[req.UpdateTrack] {
+		errs = append(errs, fieldError{Field: "update_track", Message: "must be 'canary', 'stable' or 'week5'"})
+	}
+	return errs
+}
+
+// apply merges the request into the current window. The whole window is
+// sent so Cloud SQL doesn't reset the fields left out, and zero values are
+// forced since they are meaningful.
+func (req *MaintenanceWindowRequest) apply(current *sqladmin.MaintenanceWindow) *sqladmin.MaintenanceWindow {
+	window := &sqladmin.MaintenanceWindow{ForceSendFields: []string{"Day", "Hour"}}
+	if current != nil {
+		window.Day, window.Hour, window.UpdateTrack = current.Day, current.Hour, current.UpdateTrack
+	}
+	if req.Day != nil {
+		window.Day = *req.Day
+	}
+	if req.Hour != nil {
+		window.Hour = *req.Hour
+	}
+	if req.UpdateTrack != "" {
+		window.UpdateTrack = req.UpdateTrack
+	}
+	return window
+}
+
+// maintenanceWindowHandler shows an instance's maintenance window on GET and
+// changes it through a Settings patch on PATCH, so GCP maintenance can be
+// lined up with the instance's start/stop schedule.
+func maintenanceWindowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPatch {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	var payload MaintenanceWindowRequest
+	if r.Method == http.MethodPatch {
+		if err := decodeJSONBody(w, r, &payload); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		if errs := payload.validate(); len(errs) > 0 {
+			writeDecodeError(w, r, errs)
+			return
+		}
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	project, name := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	instance, err := sqlService.Instances.Get(project, name).Context(ctx).Do()
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	var current *sqladmin.MaintenanceWindow
+	if instance.Settings != nil {
+		current = instance.Settings.MaintenanceWindow
+	}
+
+	if r.Method == http.MethodGet {
+		writeSuccessResponse(w, r, http.StatusOK, msgMaintenanceWindowFound, newMaintenanceWindow(current))
+		return
+	}
+
+	patch := &sqladmin.DatabaseInstance{Settings: &sqladmin.Settings{MaintenanceWindow: payload.apply(current)}}
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunPatch(project, name, patch))
+		return
+	}
+
+	operation, err := sqlService.Instances.Patch(project, name, patch).Context(ctx).Do()
+	event := newNotificationEvent(actionMaintenanceWindow, actionSourceAPI, requestPrincipal(r), project, name)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgMaintenanceWindowPatchFailed, err)
+		return
+	}
+
+	operations.track(event, operation)
+	writeOperationResponse(w, r, project, name, operation, wait, timeout, operationSteps{}, msgMaintenanceWindowPatched, msgMaintenanceWindowPatchFailed)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/api/googleapi"
+)
+
+// Sources of start/stop actions, used as the source label.
+const (
+	actionSourceAPI       = "api"
+	actionSourceBulk      = "bulk"
+	actionSourceSchedule  = "schedule"
+	actionSourcePubSub    = "pubsub"
+	actionSourceCLI       = "cli"
+	actionSourceOperator  = "kubernetes"
+	actionSourceProxy     = "wake_proxy"
+	actionSourceIdle      = "idle"
+	actionSourceReconcile = "reconcile"
+	actionSourceDelayed   = "delayed"
+)
+
+var (
+	actionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "scheduler_db_actions_total",
+		Help: "Start/stop actions by source and result. reason is empty on success.",
+	}, []string{"action", "source", "result", "reason"})
+
+	sqlAdminRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "scheduler_db_sqladmin_request_duration_seconds",
+		Help:    "Latency of SQL Admin API calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	instanceState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "scheduler_db_instance_state",
+		Help: "Last observed state of each instance, 1 for the current state and 0 for the others.",
+	}, []string{"project", "instance", "state"})
+)
+
+// recordAction counts a start/stop attempt. Alert on
+// scheduler_db_actions_total{source="schedule",result="failure"} to catch
+// scheduled stops that fail silently.
+func recordAction(action string, source string, err error) {
+	if err == nil {
+		actionsTotal.WithLabelValues(action, source, "success", "").Inc()
+		return
+	}
+	actionsTotal.WithLabelValues(action, source, "failure", failureReason(err)).Inc()
+}
+
+// errInstanceNotRunnable is recorded when a stop is refused because the
+// instance isn't running.
+var errInstanceNotRunnable = errors.New("instance is not running")
+
+// failureReason classifies an error into a low-cardinality label value,
+// using the same names as the error_type response field.
+func failureReason(err error) string {
+	var apiErr *googleapi.Error
+	switch {
+	case errors.As(err, &apiErr):
+		return fmt.Sprintf("googleapi_%d", apiErr.Code)
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, errInstanceNotRunnable):
+		return "not_runnable"
+	case errors.Is(err, errInvalidTransition):
+		return "invalid_transition"
+	case errors.Is(err, errConnectionsActive):
+		return "connections_active"
+	case errors.Is(err, errPolicyViolation):
+		return "policy_violation"
+	default:
+		return "internal_error"
+	}
+}
+
+var instanceStateMu sync.Mutex
+
+// observeInstanceState updates the state gauge of an instance.
+func observeInstanceState(project string, instance string, state string) {
+	instanceStateMu.Lock()
+	defer instanceStateMu.Unlock()
+
+	for known := range instanceStates {
+		instanceState.WithLabelValues(project, instance, known).Set(0)
+	}
+	instanceState.WithLabelValues(project, instance, state).Set(1)
+}
+
+// instrumentSQLAdmin records the latency of every SQL Admin call made
+// through base.
+func instrumentSQLAdmin(base http.RoundTripper) http.RoundTripper {
+	return promhttp.InstrumentRoundTripperDuration(sqlAdminRequestDuration, base)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
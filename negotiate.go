@@ -0,0 +1,175 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeYAML = "application/yaml"
+)
+
+// yamlMediaTypes lists the Accept values that select a YAML response.
+var yamlMediaTypes = map[string]bool{
+	"application/yaml":   true,
+	"application/x-yaml": true,
+	"text/yaml":          true,
+	"text/x-yaml":        true,
+}
+
+// negotiateContentType picks the response format from the Accept header.
+// JSON is the default and wins ties, YAML is only used when explicitly
+// preferred by the client.
+func negotiateContentType(r *http.Request) string {
+	if r == nil {
+		return contentTypeJSON
+	}
+
+	best, bestQuality := contentTypeJSON, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if v, err := strconv.ParseFloat(q, 64); err == nil {
+					quality = v
+				}
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+
+		switch {
+		case yamlMediaTypes[mediaType] && quality > bestQuality:
+			best, bestQuality = contentTypeYAML, quality
+		case (mediaType == contentTypeJSON || mediaType == "*/*" || mediaType == "application/*") && quality >= bestQuality:
+			best, bestQuality = contentTypeJSON, quality
+		}
+	}
+
+	return best
+}
+
+// encodeResponse writes the response envelope in the negotiated format.
+func encodeResponse(w http.ResponseWriter, r *http.Request, statusCode int, response interface{}) {
+	contentType := negotiateContentType(r)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(statusCode)
+
+	if contentType == contentTypeYAML {
+		// Round-trip through JSON so field names follow the json tags of the
+		// sqladmin types instead of yaml's lower-cased Go field names.
+		raw, err := json.Marshal(response)
+		if err == nil {
+			var generic interface{}
+			if err = json.Unmarshal(raw, &generic); err == nil {
+				encoder := yaml.NewEncoder(w)
+				encoder.SetIndent(2)
+				encoder.Encode(generic)
+				encoder.Close()
+				return
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(io.Discard) },
+}
+
+// gzipResponseWriter compresses the body lazily so bodyless responses such as
+// 304 Not Modified are passed through untouched.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	writer      *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(statusCode int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	if statusCode != http.StatusNotModified && statusCode != http.StatusNoContent {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.Header().Del("Content-Length")
+	}
+	g.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if g.writer == nil {
+		g.WriteHeader(http.StatusOK)
+		g.writer = gzipWriterPool.Get().(*gzip.Writer)
+		g.writer.Reset(g.ResponseWriter)
+	}
+	return g.writer.Write(b)
+}
+
+// Flush sends what was compressed so far, for streamed responses.
+func (g *gzipResponseWriter) Flush() {
+	if g.writer != nil {
+		g.writer.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipResponseWriter) close() {
+	if g.writer != nil {
+		g.writer.Close()
+		gzipWriterPool.Put(g.writer)
+	}
+}
+
+// withCompression gzips responses for clients that advertise support for it
+// via Accept-Encoding.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		if strings.ToLower(strings.TrimSpace(fields[0])) != "gzip" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if v, err := strconv.ParseFloat(q, 64); err == nil && v <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// actionAuthorizedNetworks names authorized network changes in access
+// roles, notifications and the audit log.
+const actionAuthorizedNetworks = "authorized_networks"
+
+const (
+	// maxNetworkExpiry bounds how long a temporary entry may stay, longer
+	// ones are meant to be permanent.
+	maxNetworkExpiry = 30 * 24 * time.Hour
+
+	// networkSweepInterval is how often expired entries are looked for.
+	networkSweepInterval = 5 * time.Minute
+)
+
+// AuthorizedNetwork is an address range allowed to connect to the public
+// IP of an instance. ExpiresAt is set for temporary entries.
+type AuthorizedNetwork struct {
+	Name      string      `json:"name,omitempty"`
+	CIDR      string      `json:"cidr"`
+	ExpiresAt interface{} `json:"expires_at,omitempty"`
+}
+
+func newAuthorizedNetworks(settings *sqladmin.Settings) []AuthorizedNetwork {
+	networks := []AuthorizedNetwork{}
+	for _, entry := range currentAuthorizedNetworks(settings) {
+		network := AuthorizedNetwork{Name: entry.Name, CIDR: entry.Value}
+		if expires, err := time.Parse(time.RFC3339, entry.ExpirationTime); err == nil {
+			network.ExpiresAt = formatTimestamp(expires)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func currentAuthorizedNetworks(settings *sqladmin.Settings) []*sqladmin.AclEntry {
+	if settings == nil || settings.IpConfiguration == nil {
+		return nil
+	}
+	return settings.IpConfiguration.AuthorizedNetworks
+}
+
+// authorizedNetworksPatch replaces the authorized networks of an instance
+// with entries. The list is forced so removing the last entry clears it.
+func authorizedNetworksPatch(entries []*sqladmin.AclEntry) *sqladmin.DatabaseInstance {
+	if entries == nil {
+		entries = []*sqladmin.AclEntry{}
+	}
+	return &sqladmin.DatabaseInstance{Settings: &sqladmin.Settings{IpConfiguration: &sqladmin.IpConfiguration{
+		AuthorizedNetworks: entries,
+		ForceSendFields:    []string{"AuthorizedNetworks"},
+	}}}
+}
+
+// AuthorizedNetworkRequest is the body of POST
+// /v1/instances/{instance}/authorized-networks. A bare IP address stands
+// for itself alone. With ExpiresIn, a duration such as "8h", the entry is
+// removed once it expires.
+type AuthorizedNetworkRequest struct {
+	CIDR      string `json:"cidr"`
+	Name      string `json:"name"`
+	ExpiresIn string `json:"expires_in"`
+}
+
+func (req *AuthorizedNetworkRequest) validate() (time.Duration, validationErrors) {
+	var errs validationErrors
+	switch network, err := parseNetwork(req.CIDR); {
+	case req.CIDR == "":
+		errs = append(errs, fieldError{Field: "cidr", Message: "is required"})
+	case err != nil:
+		errs = append(errs, fieldError{Field: "cidr", Message: "must be an IP address or a CIDR range such as '203.0.113.0/24'"})
+	default:
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			errs = append(errs, fieldError{Field: "cidr", Message: "must not open the instance to every address"})
+		}
+		req.CIDR = network.String()
+	}
+
+	var expiresIn time.Duration
+	if req.ExpiresIn != "" {
+		parsed, err := time.ParseDuration(req.ExpiresIn)
+		switch {
+		case err != nil:
+			errs = append(errs, fieldError{Field: "expires_in", Message: "must be a duration such as '8h'"})
+		case parsed <= 0:
+			errs = append(errs, fieldError{Field: "expires_in", Message: "must be positive"})
+		case parsed > maxNetworkExpiry:
+			errs = append(errs, fieldError{Field: "expires_in", Message: fmt.Sprintf("must be within %s", maxNetworkExpiry)})
+		default:
+			expiresIn = parsed
+		}
+	}
+	return expiresIn, errs
+}
+
+// parseNetwork reads a CIDR range or a single IP address, normalized to
+// the range it stands for.
+func parseNetwork(value string) (*net.IPNet, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+// sameNetwork reports whether the authorized network value stands for the
+// normalized range cidr, as entries added elsewhere may be bare addresses.
+func sameNetwork(value string, cidr string) bool {
+	network, err := parseNetwork(value)
+	return err == nil && network.String() == cidr
+}
+
+// authorizedNetworksHandler lists the authorized networks of an instance
+// on GET, adds one on POST and removes the one given by ?cidr= on DELETE.
+// The whole list is patched each time, so concurrent changes to it may
+// overwrite each other.
+func authorizedNetworksHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		payload   AuthorizedNetworkRequest
+		expiresIn time.Duration
+		remove    string
+	)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := decodeJSONBody(w, r, &payload); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		var errs validationErrors
+		if expiresIn, errs = payload.validate(); len(errs) > 0 {
+			writeDecodeError(w, r, errs)
+			return
+		}
+	case http.MethodDelete:
+		network, err := parseNetwork(r.URL.Query().Get("cidr"))
+		if err != nil {
+			writeDecodeError(w, r, validationErrors{{Field: "cidr", Message: "query parameter must be the IP address or CIDR range to remove"}})
+			return
+		}
+		remove = network.String()
+	default:
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	project, name := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	instance, err := sqlService.Instances.Get(project, name).Context(ctx).Do()
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	current := currentAuthorizedNetworks(instance.Settings)
+
+	var (
+		entries []*sqladmin.AclEntry
+		message messageKey
+	)
+	switch r.Method {
+	case http.MethodGet:
+		writeSuccessResponse(w, r, http.StatusOK, msgAuthorizedNetworksFound, newAuthorizedNetworks(instance.Settings))
+		return
+	case http.MethodPost:
+		if slices.ContainsFunc(current, func(entry *sqladmin.AclEntry) bool { return sameNetwork(entry.Value, payload.CIDR) }) {
+			writeErrorResponse(w, r, http.StatusConflict, msgAuthorizedNetworkExists, "", payload.CIDR, name)
+			return
+		}
+		entry := &sqladmin.AclEntry{Name: payload.Name, Value: payload.CIDR}
+		if expiresIn > 0 {
+			entry.ExpirationTime = networkSweeps.now().Add(expiresIn).UTC().Format(time.RFC3339)
+		}
+		entries = append(slices.Clone(current), entry)
+		message = msgAuthorizedNetworkAdded
+	case http.MethodDelete:
+		entries = slices.DeleteFunc(slices.Clone(current), func(entry *sqladmin.AclEntry) bool { return sameNetwork(entry.Value, remove) })
+		if len(entries) == len(current) {
+			writeErrorResponse(w, r, http.StatusNotFound, msgAuthorizedNetworkNotFound, "", remove, name)
+			return
+		}
+		message = msgAuthorizedNetworkRemoved
+	}
+
+	patch := authorizedNetworksPatch(entries)
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunPatch(project, name, patch))
+		return
+	}
+
+	operation, err := sqlService.Instances.Patch(project, name, patch).Context(ctx).Do()
+	event := newNotificationEvent(actionAuthorizedNetworks, actionSourceAPI, requestPrincipal(r), project, name)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgAuthorizedNetworksPatchFailed, err)
+		return
+	}
+
+	operations.track(event, operation)
+	writeOperationResponse(w, r, project, name, operation, wait, timeout, operationSteps{}, message, msgAuthorizedNetworksPatchFailed)
+}
+
+// networkSweeper removes the expired authorized networks of the instances
+// of PROJECTS, whoever added them.
+type networkSweeper struct {
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+var networkSweeps = &networkSweeper{now: time.Now}
+
+// run sweeps every networkSweepInterval until stop is closed.
+func (s *networkSweeper) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(networkSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.sweep(context.Background(), managedProjects.load())
+		}
+	}
+}
+
+// sweep removes the expired entries of every instance of projects and
+// returns how many it removed.
+func (s *networkSweeper) sweep(ctx context.Context, projects []string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if automationHeld(now) {
+		return 0
+	}
+	removed := 0
+	for _, project := range projects {
+		instances, err := listProjectInstances(ctx, project)
+		if err != nil {
+			slog.Error("Failed to list instances for expired authorized networks", "project", project, "error", err)
+			continue
+		}
+		for _, instance := range instances {
+			n, err := revokeExpiredNetworks(ctx, project, instance, now)
+			if err != nil {
+				slog.Error("Failed to remove expired authorized networks", "project", project, "instance", instance.Name, "error", err)
+			}
+			removed += n
+		}
+	}
+	return removed
+}
+
+// revokeExpiredNetworks patches away the entries of instance that expired
+// at now and returns how many there were.
+func revokeExpiredNetworks(ctx context.Context, project string, instance *sqladmin.DatabaseInstance, now time.Time) (int, error) {
+	current := currentAuthorizedNetworks(instance.Settings)
+	var expired []string
+	entries := slices.DeleteFunc(slices.Clone(current), func(entry *sqladmin.AclEntry) bool {
+		expires, err := time.Parse(time.RFC3339, entry.ExpirationTime)
+		if err == nil && !expires.After(now) {
+			expired = append(expired, entry.Value)
+			return true
+		}
+		return false
+	})
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	if dryRun.load() {
+		slog.Info("Dry run, expired authorized networks kept", "project", project, "instance", instance.Name, "networks", expired)
+		return 0, nil
+	}
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	operation, err := sqlService.Instances.Patch(project, instance.Name, authorizedNetworksPatch(entries)).Context(ctx).Do()
+	event := newNotificationEvent(actionAuthorizedNetworks, actionSourceSchedule, "expired authorized networks", project, instance.Name)
+	notifyAction(event, operation, err)
+	if err != nil {
+		return 0, err
+	}
+	operations.track(event, operation)
+	slog.Info("Expired authorized networks removed", "project", project, "instance", instance.Name, "networks", expired)
+	return len(expired), nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+const notifyTimeout = 10 * time.Second
+
+// Results reported by notifications.
+const (
+	notifyResultRequested = "requested"
+	notifyResultFailed    = "failed"
+)
+
+// defaultNotifyTemplate renders the text of Slack and Google Chat messages.
+const defaultNotifyTemplate = `{{.Action}} {{.Project}}/{{.Instance}} {{.Result}}, triggered by {{.TriggeredBy}} ({{.Source}})` +
+	`{{with .Operation}}, operation {{.}}{{end}}{{with .Error}}: {{.}}{{end}}`
+
+// NotificationEvent describes a start, stop or settings change and is the
+// data of NOTIFY_TEMPLATE. Generic webhooks receive it as JSON, described
+// by webhookSchema. Schedule is the id of the schedule that triggered the
+// action, if any.
+type NotificationEvent struct {
+	SchemaVersion int       `json:"schema_version"`
+	Action        string    `json:"action"`
+	Project       string    `json:"project"`
+	Instance      string    `json:"instance"`
+	Source        string    `json:"source"`
+	TriggeredBy   string    `json:"triggered_by"`
+	Schedule      string    `json:"schedule,omitempty"`
+	Operation     string    `json:"operation,omitempty"`
+	Result        string    `json:"result"`
+	Error         string    `json:"error,omitempty"`
+	Time          time.Time `json:"time"`
+	Text          string    `json:"text"`
+}
+
+func newNotificationEvent(action string, source string, triggeredBy string, project string, instance string) NotificationEvent {
+	if triggeredBy == "" {
+		triggeredBy = "anonymous"
+	}
+	return NotificationEvent{Action: action, Project: project, Instance: instance, Source: source, TriggeredBy: triggeredBy}
+}
+
+// NotifyConfig selects where notifications are posted. With no URL set
+// and email disabled nothing is sent.
+type NotifyConfig struct {
+	SlackWebhookURL      string
+	GoogleChatWebhookURL string
+	WebhookURLs          []string
+	Template             string
+	Email                EmailConfig
+}
+
+func (n NotifyConfig) validate() error {
+	var errs []error
+	check := func(name string, raw string) {
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s: %q is not an http(s) URL", name, raw))
+		}
+	}
+	if n.SlackWebhookURL != "" {
+		check("NOTIFY_SLACK_WEBHOOK_URL", n.SlackWebhookURL)
+	}
+	if n.GoogleChatWebhookURL != "" {
+		check("NOTIFY_GOOGLE_CHAT_WEBHOOK_URL", n.GoogleChatWebhookURL)
+	}
+	for _, raw := range n.WebhookURLs {
+		check("NOTIFY_WEBHOOK_URLS", raw)
+	}
+	if _, err := template.New("notify").Parse(n.Template); err != nil {
+		errs = append(errs, fmt.Errorf("NOTIFY_TEMPLATE: %w", err))
+	}
+	if err := n.Email.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (n NotifyConfig) targets() []notificationTarget {
+	var targets []notificationTarget
+	if n.SlackWebhookURL != "" {
+		targets = append(targets, notificationTarget{kind: "slack", url: n.SlackWebhookURL})
+	}
+	if n.GoogleChatWebhookURL != "" {
+		targets = append(targets, notificationTarget{kind: "google_chat", url: n.GoogleChatWebhookURL})
+	}
+	for _, raw := range n.WebhookURLs {
+		targets = append(targets, notificationTarget{kind: "webhook", url: raw})
+	}
+	return targets
+}
+
+// notificationTarget is one URL notifications are posted to. Slack and
+// Google Chat incoming webhooks both take a {"text": ...} message, generic
+// webhooks get the whole event.
+type notificationTarget struct {
+	kind string
+	url  string
+}
+
+func (t notificationTarget) payload(event NotificationEvent) ([]byte, error) {
+	if t.kind == "webhook" {
+		return json.Marshal(event)
+	}
+	return json.Marshal(map[string]string{"text": event.Text})
+}
+
+// notifier posts events asynchronously so a slow or failing receiver never
+// delays the action it reports. Email is nil when disabled.
+type notifier struct {
+	mu       sync.RWMutex
+	targets  []notificationTarget
+	template *template.Template
+	email    *emailSender
+	client   *http.Client
+	wg       sync.WaitGroup
+}
+
+var notifications = &notifier{client: &http.Client{Timeout: notifyTimeout}}
+
+// configure replaces the targets and template, the config is validated.
+func (n *notifier) configure(cfg NotifyConfig) {
+	tmpl := template.Must(template.New("notify").Parse(cfg.Template))
+
+	var email *emailSender
+	if cfg.Email.enabled() {
+		email = &emailSender{config: cfg.Email, client: n.client}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.targets, n.template, n.email = cfg.targets(), tmpl, email
+}
+
+func (n *notifier) send(event NotificationEvent) {
+	n.mu.RLock()
+	targets, tmpl, email := n.targets, n.template, n.email
+	n.mu.RUnlock()
+	if email != nil && !email.wants(event) {
+		email = nil
+	}
+	if len(targets) == 0 && email == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	event.SchemaVersion = webhookSchemaVersion
+	var text strings.Builder
+	if err := tmpl.Execute(&text, event); err != nil {
+		slog.Error("Failed to render notification", "error", err)
+	}
+	event.Text = text.String()
+
+	for _, target := range targets {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			if err := n.post(target, event); err != nil {
+				slog.Error("Failed to send notification", "target", target.kind, "project", event.Project, "instance", event.Instance, "error", err)
+			}
+		}()
+	}
+	if email != nil {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			if err := email.send(event); err != nil {
+				slog.Error("Failed to send notification", "target", "email", "project", event.Project, "instance", event.Instance, "error", err)
+			}
+		}()
+	}
+}
+
+func (n *notifier) post(target notificationTarget, event NotificationEvent) error {
+	body, err := target.payload(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(target.url, contentTypeJSON, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", target.kind, resp.Status)
+	}
+	return nil
+}
+
+// wait blocks until the notifications in flight are sent or ctx expires.
+func (n *notifier) wait(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// notifyAction reports the outcome of a Patch call.
+func notifyAction(event NotificationEvent, operation *sqladmin.Operation, err error) {
+	event.Result = notifyResultRequested
+	if operation != nil {
+		event.Operation = operation.Name
+	}
+	if err != nil {
+		event.Result, event.Error = notifyResultFailed, err.Error()
+	}
+	notifications.send(event)
+}
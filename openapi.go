@@ -0,0 +1,618 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+const (
+	openAPIVersion = "3.0.3"
+	// swaggerUIVersion pins the Swagger UI release loaded by /docs.
+	swaggerUIVersion = "5.17.14"
+)
+
+// apiParam is a query, path or header parameter of an endpoint.
+type apiParam struct {
+	Name        string
+	In          string
+	Type        string
+	Description string
+}
+
+// Parameters shared by several endpoints.
+var (
+	paramWait           = apiParam{"wait", "query", "boolean", "Wait for the operation to finish and return the instance it left behind."}
+	paramTimeout        = apiParam{"timeout", "query", "string", "How long to wait, a Go duration (default 60s, max 10m)."}
+	paramDryRun         = apiParam{"dry_run", "query", "boolean", "Return the SQL Admin call instead of making it."}
+	paramReplicas       = apiParam{"include_replicas", "query", "boolean", "Apply the action to the read replicas too, default INCLUDE_REPLICAS."}
+	paramForce          = apiParam{"force", "query", "boolean", "Stop even with more open connections than STOP_MAX_CONNECTIONS."}
+	paramIdempotencyKey = apiParam{idempotencyKeyHeader, "header", "string", "Replays the first result of a repeated request with the same key."}
+)
+
+// apiEndpoint documents one method of a route. Instance endpoints are
+// served under both /v1/instances/{instance} and
+// /v1/projects/{project}/instances/{instance}, Path being the suffix. Data
+// lists the payloads a success envelope may carry.
+type apiEndpoint struct {
+	Method   string
+	Path     string
+	Instance bool
+	Summary  string
+	Params   []apiParam
+	Body     any
+	// OptionalBody marks a Body that may be left out.
+	OptionalBody bool
+	Status       int
+	Data         []any
+	Events       any
+	// Raw is the payload of endpoints answering without the envelope.
+	Raw        any
+	Deprecated bool
+	// OperationID replaces the operationId derived from Path, for routes
+	// whose derived ids collide.
+	OperationID string
+}
+
+// apiEndpoints is the public API described by /openapi.json. Keep it in
+// step with newPublicMux.
+var apiEndpoints = []apiEndpoint{
+	{Method: http.MethodGet, Path: "/v1/instances", Summary: "List instances", Params: []apiParam{
+		{"projects", "query", "string", "Comma-separated projects, default PROJECTS."},
+		{"state", "query", "string", "Only instances in this state."},
+		{"region", "query", "string", "Only instances in this region."},
+		{"label", "query", "string", "key=value pairs, comma separated, all of which must match."},
+		{"page_size", "query", "integer", "Instances per page."},
+		{"page_token", "query", "string", "The next_page_token of the previous page."},
+	}, Data: []any{InstanceListData{}}},
+	{Method: http.MethodGet, Path: "/v1/projects/{project}/instances", Summary: "List the instances of a project", Params: []apiParam{
+		{"state", "query", "string", "Only instances in this state."},
+		{"region", "query", "string", "Only instances in this region."},
+		{"label", "query", "string", "key=value pairs, comma separated, all of which must match."},
+		{"page_size", "query", "integer", "Instances per page."},
+		{"page_token", "query", "string", "The next_page_token of the previous page."},
+	}, Data: []any{InstanceListData{}}},
+	{Method: http.MethodGet, Instance: true, Summary: "Get the state of an instance", Params: []apiParam{
+		{"wait_for_state", "query", "string", "Wait until the instance reaches this state."},
+		paramTimeout,
+		{"fresh", "query", "boolean", "Bypass the cached state."},
+	}, Data: []any{CheckResponseData{}}},
+	{Method: http.MethodPost, Path: "/start", Instance: true, Summary: "Start an instance",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramReplicas, paramIdempotencyKey},
+		Body:   ActivationPolicyRequest{}, OptionalBody: true, Data: []any{OperationResult{}, DryRunData{}}},
+	{Method: http.MethodPost, Path: "/stop", Instance: true, Summary: "Stop an instance",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramReplicas, paramForce, paramIdempotencyKey},
+		Body:   ActivationPolicyRequest{}, OptionalBody: true, Data: []any{OperationResult{}, DryRunData{}}},
+	{Method: http.MethodPatch, Path: "/settings", Instance: true, Summary: "Change userLabels, insightsConfig or deletionProtectionEnabled",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   sqladmin.Settings{}, Data: []any{OperationResult{}, DryRunData{}}},
+	{Method: http.MethodPost, Path: "/backup", Instance: true, Summary: "Take an on-demand backup",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   BackupRequest{}, OptionalBody: true, Data: []any{OperationResult{}, DryRunData{}}},
+	{Method: http.MethodGet, Path: "/backups", Instance: true, Summary: "List the most recent backup runs, newest first",
+		Params: []apiParam{{"limit", "query", "integer", "How many backup runs to list (default 20, max 100)."}}, Data: []any{BackupsData{}}},
+	{Method: http.MethodPost, Path: "/restore", Instance: true, Summary: "Restore the instance from a backup run, once confirmed with the token of a first call",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   RestoreRequest{}, Data: []any{RestoreConfirmation{}, OperationResult{}, DryRunData{}}},
+	{Method: http.MethodPost, Path: "/restart", Instance: true, Summary: "Restart a running instance",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Data:   []any{OperationResult{}, DryRunData{}}},
+	{Method: http.MethodPost, Path: "/failover", Instance: true, Summary: "Fail a high availability instance over to its standby",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Data:   []any{FailoverResult{}, DryRunData{}}},
+	{Method: http.MethodPost, Path: "/promote", Instance: true, Summary: "Promote a read replica to a standalone instance, once confirmed with the token of a first call",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   PromoteRequest{}, OptionalBody: true, Data: []any{PromoteConfirmation{}, OperationResult{}, DryRunData{}}},
+	{Method: http.MethodPost, Path: "/tier", Instance: true, Summary: "Change the machine tier, rolling back on failure",
+		Params: []apiParam{{"timeout", "query", "string", "How long to wait, a Go duration (default and max 10m)."}, paramDryRun, paramIdempotencyKey},
+		Body:   TierRequest{}, Data: []any{ScaleResult{}, DryRunData{}}},
+	{Method: http.MethodPost, Path: "/clone", Instance: true, Summary: "Clone the instance into a new one with its own stop schedules",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   CloneRequest{}, Data: []any{CloneResult{}, DryRunData{}}},
+	{Method: http.MethodPost, Path: "/export", Instance: true, Summary: "Export databases to Cloud Storage",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   ExportRequest{}, Data: []any{ExportResult{}, DryRunData{}}},
+	{Method: http.MethodPost, Path: "/import", Instance: true, Summary: "Import a SQL dump or CSV file from Cloud Storage",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   ImportRequest{}, Data: []any{ImportResult{}, DryRunData{}}},
+	{Method: http.MethodGet, Path: "/import", Instance: true, Summary: "Get the progress of an import",
+		Params: []apiParam{{"operation", "query", "string", "Name of the import operation."}},
+		Data:   []any{ImportProgress{}}},
+	{Method: http.MethodGet, Path: "/maintenance-window", Instance: true, Summary: "Get the maintenance window", Data: []any{MaintenanceWindow{}}},
+	{Method: http.MethodPatch, Path: "/maintenance-window", Instance: true, Summary: "Move the maintenance window",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   MaintenanceWindowRequest{}, Data: []any{OperationResult{}, DryRunData{}}},
+	{Method: http.MethodGet, Path: "/storage", Instance: true, Summary: "Get the disk settings and usage", Data: []any{StorageSettings{}}},
+	{Method: http.MethodPatch, Path: "/storage", Instance: true, Summary: "Change the disk settings",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   StorageRequest{}, Data: []any{OperationResult{}, DryRunData{}}},
+	{Method: http.MethodGet, Path: "/authorized-networks", Instance: true, Summary: "List the authorized networks", Data: []any{[]AuthorizedNetwork{}}},
+	{Method: http.MethodPost, Path: "/authorized-networks", Instance: true, Summary: "Authorize a network, for good or until it expires",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   AuthorizedNetworkRequest{}, Data: []any{OperationResult{}, DryRunData{}}},
+	{Method: http.MethodDelete, Path: "/authorized-networks", Instance: true, Summary: "Remove an authorized network",
+		Params: []apiParam{{"cidr", "query", "string", "IP address or CIDR range to remove."}, paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Data:   []any{OperationResult{}, DryRunData{}}},
+	{Method: http.MethodGet, Path: "/flags", Instance: true, Summary: "Get the database flags", Data: []any{DatabaseFlagsData{}}},
+	{Method: http.MethodPatch, Path: "/flags", Instance: true, Summary: "Set or remove database flags",
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   DatabaseFlagsRequest{}, Data: []any{OperationResult{}, DryRunData{}}},
+	{Method: http.MethodGet, Path: "/users", Instance: true, Summary: "List the database users", Data: []any{UsersData{}}},
+	{Method: http.MethodPost, Path: "/users", Instance: true, Summary: "Create a database user, with a generated password unless given",
+		Params: []apiParam{paramTimeout, paramDryRun, paramIdempotencyKey}, Body: UserRequest{}, Data: []any{UserResult{}, DryRunData{}}},
+	{Method: http.MethodPost, Path: "/users/{user}/password", Instance: true, Summary: "Set a new password, generated unless given",
+		Params: []apiParam{{"host", "query", "string", "Host of a MySQL user."}, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   UserPasswordRequest{}, OptionalBody: true, Data: []any{UserResult{}, DryRunData{}}},
+	{Method: http.MethodDelete, Path: "/users/{user}", Instance: true, Summary: "Delete a database user",
+		Params: []apiParam{{"host", "query", "string", "Host of a MySQL user."}, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Data:   []any{UserResult{}, DryRunData{}}},
+	{Method: http.MethodGet, Path: "/schedule", Instance: true, Summary: "Preview the next scheduled runs", Params: []apiParam{
+		{"count", "query", "integer", "Number of runs, default 10, max 100."},
+	}, Data: []any{[]ScheduledActionData{}}},
+	{Method: http.MethodGet, Path: "/v1/stores", Summary: "List the data stores of every kind", Params: []apiParam{
+		{"project", "query", "string", "Default every project in PROJECTS."},
+		{"kind", "query", "string", "Comma-separated kinds: cloudsql, alloydb, redis, gce. Default all."},
+		{"label", "query", "string", "key=value pairs, comma separated, all of which must match."},
+	}, Data: []any{StoreListData{}}},
+	{Method: http.MethodPost, Path: "/v1/stores/{kind}/{location}/{instance}/start", Summary: "Start a data store of any kind",
+		Params: []apiParam{paramIdempotencyKey}, Status: http.StatusAccepted, Data: []any{StoreActionData{}}},
+	{Method: http.MethodPost, Path: "/v1/stores/{kind}/{location}/{instance}/stop", Summary: "Stop a data store, or scale a Redis instance down",
+		Params: []apiParam{paramForce, paramIdempotencyKey}, Status: http.StatusAccepted, Data: []any{StoreActionData{}}},
+	{Method: http.MethodPost, Path: "/v1/start-by-label", Summary: "Start every instance carrying the labels",
+		Params: []apiParam{paramDryRun, paramIdempotencyKey}, Body: LabelSelectorRequest{}, Data: []any{BulkResponseData{}}},
+	{Method: http.MethodPost, Path: "/v1/stop-by-label", Summary: "Stop every instance carrying the labels",
+		Params: []apiParam{paramDryRun, paramForce, paramIdempotencyKey}, Body: LabelSelectorRequest{}, Data: []any{BulkResponseData{}}},
+	{Method: http.MethodPost, Path: "/v1/batch", Summary: "Start or stop a list of instances",
+		Params: []apiParam{paramDryRun, paramForce, paramIdempotencyKey}, Body: BatchRequest{}, Data: []any{BulkResponseData{}}},
+	{Method: http.MethodGet, Path: "/v1/batches", Summary: "List the caller's batches still in the job queue", Data: []any{BatchesData{}}},
+	{Method: http.MethodDelete, Path: "/v1/batches/{id}", Summary: "Cancel the pending items of a batch", Data: []any{BatchStatus{}}},
+	{Method: http.MethodGet, Path: "/v1/audit", Summary: "List audit log entries, newest first", Params: []apiParam{
+		{"project", "query", "string", ""},
+		{"instance", "query", "string", ""},
+		{"action", "query", "string", ""},
+		{"principal", "query", "string", ""},
+		{"since", "query", "string", "RFC 3339 timestamp."},
+		{"until", "query", "string", "RFC 3339 timestamp."},
+		{"limit", "query", "integer", "Default 100, max 1000."},
+	}, Data: []any{AuditListData{}}},
+	{Method: http.MethodGet, Path: "/v1/events", Summary: "Stream instance events as Server-Sent Events", Params: []apiParam{
+		{"project", "query", "string", "Only events of this project."},
+		{"instance", "query", "string", "Only events of this instance."},
+	}, Events: InstanceEvent{}},
+	{Method: http.MethodGet, Path: "/v1/savings", Summary: "Estimate the savings of stopped hours", Params: []apiParam{
+		{"from", "query", "string", "RFC 3339 timestamp, default 30 days ago."},
+		{"to", "query", "string", "RFC 3339 timestamp, default now."},
+		{"project", "query", "string", ""},
+		{"instance", "query", "string", ""},
+	}, Data: []any{SavingsData{}}},
+	{Method: http.MethodGet, Path: "/v1/grafana", Summary: "Test the connection of a Grafana JSON datasource"},
+	{Method: http.MethodPost, Path: "/v1/grafana/search", Summary: "List the Grafana targets", Raw: []string{}},
+	{Method: http.MethodPost, Path: "/v1/grafana/metrics", Summary: "List the Grafana targets with their labels", Raw: []GrafanaMetric{}},
+	{Method: http.MethodPost, Path: "/v1/grafana/query", Summary: "Query uptime and action series for Grafana", Body: GrafanaQueryRequest{}, Raw: []GrafanaTimeSeries{}},
+	{Method: http.MethodGet, Path: "/v1/grafana/query", Summary: "Query a series for the Grafana Infinity datasource", Params: []apiParam{
+		{"target", "query", "string", "uptime or actions."},
+		{"from", "query", "string", "RFC 3339 timestamp or Unix milliseconds, default a day ago."},
+		{"to", "query", "string", "RFC 3339 timestamp or Unix milliseconds, default now."},
+		{"project", "query", "string", ""},
+		{"instance", "query", "string", ""},
+	}, Raw: []GrafanaTimeSeries{}},
+	{Method: http.MethodPost, Path: "/v1/grafana/annotations", Summary: "List starts, stops and scales as Grafana annotations", Body: GrafanaAnnotationRequest{}, Raw: []GrafanaAnnotation{}},
+	{Method: http.MethodGet, Path: "/v1/schedules", Summary: "List schedules", Params: []apiParam{
+		{"deleted", "query", "boolean", "List the trash instead."},
+	}, Data: []any{[]ScheduleData{}}},
+	{Method: http.MethodPost, Path: "/v1/schedules", Summary: "Create a schedule", Status: http.StatusCreated, Body: ScheduleRequest{}, Data: []any{ScheduleData{}}},
+	{Method: http.MethodPut, Path: "/v1/schedules", Summary: "Replace the active schedules with the given set", Params: []apiParam{paramDryRun},
+		Body: SyncSchedulesRequest{}, Data: []any{ScheduleDiffData{}}},
+	{Method: http.MethodGet, Path: "/v1/schedules/{id}", Summary: "Get a schedule", Data: []any{ScheduleData{}}},
+	{Method: http.MethodDelete, Path: "/v1/schedules/{id}", Summary: "Move a schedule to the trash", Data: []any{ScheduleData{}}},
+	{Method: http.MethodPost, Path: "/v1/schedules/{id}/restore", Summary: "Restore a schedule from the trash", Data: []any{ScheduleData{}}},
+	{Method: http.MethodGet, Path: "/v1/schedule/preview", Summary: "Preview the scheduled runs of every instance", Params: []apiParam{
+		{"days", "query", "integer", "Days ahead, default 7, max 31."},
+		{"project", "query", "string", ""},
+		{"instance", "query", "string", ""},
+	}, Data: []any{ScheduleCalendarData{}}},
+	{Method: http.MethodGet, Path: "/v1/overrides", Summary: "List the active overrides", Params: []apiParam{
+		{"instance", "query", "string", "Only the overrides of this instance."},
+	}, Data: []any{[]OverrideData{}}},
+	{Method: http.MethodPost, Path: "/v1/overrides", Summary: "Skip schedules of an instance until a given time", Status: http.StatusCreated, Body: OverrideRequest{}, Data: []any{OverrideData{}}},
+	{Method: http.MethodGet, Path: "/v1/overrides/{id}", Summary: "Get an override", Data: []any{OverrideData{}}},
+	{Method: http.MethodDelete, Path: "/v1/overrides/{id}", Summary: "End an override early", Data: []any{OverrideData{}}},
+	{Method: http.MethodGet, Path: "/v1/schedule-once", Summary: "List the pending delayed actions", OperationID: "listScheduleOnce", Params: []apiParam{
+		{"instance", "query", "string", "Only the delayed actions of this instance."},
+	}, Data: []any{DelayedActionData{}}},
+	{Method: http.MethodPost, Path: "/v1/schedule-once", Summary: "Start, stop or scale an instance once at a given time", Status: http.StatusCreated, Body: DelayedActionRequest{}, Data: []any{DelayedActionData{}}},
+	{Method: http.MethodGet, Path: "/v1/schedule-once/{id}", Summary: "Get a delayed action", Data: []any{DelayedActionData{}}},
+	{Method: http.MethodDelete, Path: "/v1/schedule-once/{id}", Summary: "Cancel a delayed action", Data: []any{DelayedActionData{}}},
+
+	{Method: http.MethodPost, Path: "/start", Summary: "Start the INSTANCE_ID instance", Deprecated: true,
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramReplicas, paramIdempotencyKey},
+		Body:   ActivationPolicyRequest{}, Data: []any{OperationResult{}, DryRunData{}}},
+	{Method: http.MethodPost, Path: "/stop", Summary: "Stop the INSTANCE_ID instance", Deprecated: true,
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramReplicas, paramForce, paramIdempotencyKey},
+		Body:   ActivationPolicyRequest{}, Data: []any{OperationResult{}, DryRunData{}}},
+	{Method: http.MethodGet, Path: "/check", Summary: "Get the state of the INSTANCE_ID instance", Deprecated: true, Data: []any{CheckResponseData{}}},
+	{Method: http.MethodPatch, Path: "/instances/{instance}/settings", Summary: "Change userLabels, insightsConfig or deletionProtectionEnabled", Deprecated: true,
+		Params: []apiParam{paramWait, paramTimeout, paramDryRun, paramIdempotencyKey},
+		Body:   sqladmin.Settings{}, Data: []any{OperationResult{}, DryRunData{}}},
+}
+
+// openAPIBuilder turns apiEndpoints into an OpenAPI document. Go types are
+// described by reflection from their json tags, named structs once under
+// components/schemas.
+type openAPIBuilder struct {
+	schemas map[string]any
+}
+
+// openAPIDocument describes the public API for the current configuration.
+func openAPIDocument() map[string]any {
+	b := &openAPIBuilder{schemas: map[string]any{}}
+	b.schemas["Envelope"] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"api_version":  map[string]any{"type": "string", "description": "Version of the API that answered, the path prefix."},
+			"status_code":  map[string]any{"type": "integer"},
+			"status_text":  map[string]any{"type": "string"},
+			"message":      map[string]any{"type": "string", "description": "Translated after Accept-Language."},
+			"message_code": map[string]any{"type": "string"},
+			"timestamp":    timestampSchema(),
+		},
+		"required": []string{"api_version", "status_code", "status_text", "message", "message_code", "timestamp"},
+	}
+	b.schemas["ErrorEnvelope"] = map[string]any{
+		"allOf": []any{
+			schemaRef("Envelope"),
+			map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"error_type":        map[string]any{"type": "string", "description": "validation_error, googleapi_<code>, operation_failed, invalid_transition, timeout, rate_limited, internal_error or unknown_error."},
+					"error_description": map[string]any{"type": "string"},
+					"request_id":        map[string]any{"type": "string"},
+					"errors":            map[string]any{"type": "array", "items": map[string]any{"oneOf": []any{b.schema(reflect.TypeOf(fieldError{})), b.schema(reflect.TypeOf(sqladmin.OperationError{}))}}},
+					"state":             map[string]any{"type": "string", "description": "State of the instance refusing an invalid_transition."},
+					"operation":         map[string]any{"type": "string", "description": "Operation in progress blocking an invalid_transition."},
+				},
+				"required": []string{"error_type", "error_description"},
+			},
+		},
+	}
+
+	paths := map[string]any{}
+	for _, endpoint := range apiEndpoints {
+		if !endpoint.Instance {
+			b.addOperation(paths, endpoint.Path, endpoint, nil)
+			continue
+		}
+		project := apiParam{"project", "query", "string", "Project of the instance, default PROJECT_ID."}
+		b.addOperation(paths, "/v1/instances/{instance}"+endpoint.Path, endpoint, []apiParam{project})
+		b.addOperation(paths, "/v1/projects/{project}/instances/{instance}"+endpoint.Path, endpoint, nil)
+	}
+
+	document := map[string]any{
+		"openapi": openAPIVersion,
+		"info": map[string]any{
+			"title":       "scheduler-db",
+			"description": "Starts, stops and manages Cloud SQL instances on demand and on schedules.",
+			"version":     apiVersion,
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": b.schemas},
+	}
+	if schemes, security := openAPISecurity(); len(schemes) > 0 {
+		document["components"].(map[string]any)["securitySchemes"] = schemes
+		document["security"] = security
+	}
+	return document
+}
+
+// openAPISecurity describes the authenticators enabled by AUTH_*, any one
+// of which is enough.
+func openAPISecurity() (map[string]any, []any) {
+	schemes := map[string]any{}
+	var security []any
+	for _, auth := range authenticators.load() {
+		switch auth.(type) {
+		case apiKeyAuthenticator:
+			schemes["apiKey"] = map[string]any{"type": "apiKey", "in": "header", "name": apiKeyHeader}
+			security = append(security, map[string]any{"apiKey": []string{}})
+		case hmacAuthenticator:
+			schemes["hmac"] = map[string]any{"type": "apiKey", "in": "header", "name": signatureHeader,
+				"description": "Hex HMAC-SHA256 of the timestamp, a newline and the body, with the Unix timestamp in " + signatureTimestampHeader + "."}
+			security = append(security, map[string]any{"hmac": []string{}})
+		case oidcAuthenticator:
+			schemes["oidc"] = map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "Google ID token"}
+			security = append(security, map[string]any{"oidc": []string{}})
+		}
+	}
+	return schemes, security
+}
+
+func (b *openAPIBuilder) addOperation(paths map[string]any, route string, endpoint apiEndpoint, extra []apiParam) {
+	var params []any
+	for _, name := range pathParameters(route) {
+		params = append(params, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+	}
+	for _, param := range append(extra, endpoint.Params...) {
+		spec := map[string]any{"name": param.Name, "in": param.In, "schema": map[string]any{"type": param.Type}}
+		if param.Description != "" {
+			spec["description"] = param.Description
+		}
+		params = append(params, spec)
+	}
+
+	status := endpoint.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	var success map[string]any
+	switch {
+	case endpoint.Events != nil:
+		success = map[string]any{
+			"description": "An event stream. Each event is named after its type and carries the JSON below as data.",
+			"content":     map[string]any{"text/event-stream": map[string]any{"schema": b.schema(reflect.TypeOf(endpoint.Events))}},
+		}
+	case endpoint.Raw != nil:
+		success = map[string]any{
+			"description": http.StatusText(status) + ", without the envelope.",
+			"content":     map[string]any{contentTypeJSON: map[string]any{"schema": b.schema(reflect.TypeOf(endpoint.Raw))}},
+		}
+	default:
+		success = map[string]any{
+			"description": http.StatusText(status),
+			"content":     envelopeContent(b.envelope(endpoint.Data)),
+		}
+	}
+	errorResponse := map[string]any{
+		"description": "The error envelope, also used for every other error status.",
+		"content":     envelopeContent(schemaRef("ErrorEnvelope")),
+	}
+
+	id := endpoint.OperationID
+	if id == "" {
+		id = operationID(endpoint.Method, route)
+	}
+	operation := map[string]any{
+		"summary":     endpoint.Summary,
+		"operationId": id,
+		"responses": map[string]any{
+			fmt.Sprint(status): success,
+			"400":              errorResponse,
+			"default":          errorResponse,
+		},
+	}
+	if len(params) > 0 {
+		operation["parameters"] = params
+	}
+	if endpoint.Body != nil {
+		operation["requestBody"] = map[string]any{
+			"required": !endpoint.OptionalBody,
+			"content":  map[string]any{contentTypeJSON: map[string]any{"schema": b.schema(reflect.TypeOf(endpoint.Body))}},
+		}
+	}
+	if endpoint.Deprecated {
+		operation["deprecated"] = true
+	}
+
+	item, _ := paths[route].(map[string]any)
+	if item == nil {
+		item = map[string]any{}
+		paths[route] = item
+	}
+	item[strings.ToLower(endpoint.Method)] = operation
+}
+
+// envelope is the success envelope with data holding one of the payloads.
+func (b *openAPIBuilder) envelope(payloads []any) map[string]any {
+	var data map[string]any
+	if len(payloads) == 1 {
+		data = b.schema(reflect.TypeOf(payloads[0]))
+	} else {
+		var oneOf []any
+		for _, payload := range payloads {
+			oneOf = append(oneOf, b.schema(reflect.TypeOf(payload)))
+		}
+		data = map[string]any{"oneOf": oneOf}
+	}
+	return map[string]any{
+		"allOf": []any{
+			schemaRef("Envelope"),
+			map[string]any{"type": "object", "properties": map[string]any{"data": data}, "required": []string{"data"}},
+		},
+	}
+}
+
+// Go types with a fixed schema.
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	rawJSONType   = reflect.TypeOf(json.RawMessage{})
+	interfaceType = reflect.TypeOf((*any)(nil)).Elem()
+)
+
+// schema describes t as encoding/json would encode it. Named structs are
+// added to the components and referenced.
+func (b *openAPIBuilder) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawJSONType, t == interfaceType:
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, ok := b.schemas[name]; !ok {
+			// Placeholder first, so self-referencing types terminate.
+			b.schemas[name] = map[string]any{}
+			b.schemas[name] = b.structSchema(t)
+		}
+		return schemaRef(name)
+	}
+	return map[string]any{}
+}
+
+func (b *openAPIBuilder) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	b.addProperties(properties, t)
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+// addProperties adds the JSON fields of t, including those of embedded
+// structs, to properties.
+func (b *openAPIBuilder) addProperties(properties map[string]any, t reflect.Type) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			b.addProperties(properties, fieldType)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		if strings.Contains(","+options+",", ",string,") {
+			properties[name] = map[string]any{"type": "string", "format": "int64"}
+			continue
+		}
+		properties[name] = b.schema(field.Type)
+	}
+}
+
+// schemaName names the component of t: its Go name, prefixed with the
+// package for types of other packages so sqladmin.MaintenanceWindow
+// doesn't collide with MaintenanceWindow.
+func schemaName(t reflect.Type) string {
+	if t.PkgPath() != localPackage {
+		return t.String()
+	}
+	return strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+}
+
+// localPackage is the import path of this package, "main" except in tests.
+var localPackage = reflect.TypeOf(apiParam{}).PkgPath()
+
+func schemaRef(name string) map[string]any {
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+// timestampSchema matches formatTimestamp: an RFC 3339 string, or epoch
+// milliseconds with RESPONSE_TIME_FORMAT=epoch_millis.
+func timestampSchema() map[string]any {
+	return map[string]any{"oneOf": []any{
+		map[string]any{"type": "string", "format": "date-time"},
+		map[string]any{"type": "integer", "format": "int64"},
+	}}
+}
+
+// envelopeContent offers the envelope in the formats encodeResponse
+// negotiates.
+func envelopeContent(schema map[string]any) map[string]any {
+	return map[string]any{
+		contentTypeJSON: map[string]any{"schema": schema},
+		contentTypeYAML: map[string]any{"schema": schema},
+	}
+}
+
+// pathParameters lists the {name} segments of route.
+func pathParameters(route string) []string {
+	var names []string
+	for _, segment := range strings.Split(route, "/") {
+		if name, ok := strings.CutPrefix(segment, "{"); ok {
+			names = append(names, strings.TrimSuffix(name, "}"))
+		}
+	}
+	return names
+}
+
+// operationID derives a stable operationId, e.g. postProjectInstanceStart
+// for POST /v1/projects/{project}/instances/{instance}/start. Collections
+// followed by a parameter are singular.
+func operationID(method string, route string) string {
+	id := strings.ToLower(method)
+	segments := strings.Split(route, "/")
+	for i, segment := range segments {
+		if segment == "" || segment == apiVersion || strings.HasPrefix(segment, "{") {
+			continue
+		}
+		if i+1 < len(segments) && strings.HasPrefix(segments[i+1], "{") {
+			segment = strings.TrimSuffix(segment, "s")
+		}
+		for _, word := range strings.Split(segment, "-") {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	if !strings.HasPrefix(route, "/"+apiVersion+"/") {
+		id += "Legacy"
+	}
+	return id
+}
+
+// openAPIHandler serves the OpenAPI document of the public API.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(openAPIDocument())
+}
+
+// docsHandler serves Swagger UI over /openapi.json. The page is part of the
+// binary, the Swagger UI assets are loaded from unpkg.com.
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, swaggerUIPage, swaggerUIVersion, swaggerUIVersion)
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>scheduler-db API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@%s/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@%s/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
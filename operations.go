@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+const (
+	defaultShutdownTimeout       = 25 * time.Second
+	defaultPendingOperationsFile = "pending_operations.json"
+)
+
+// pendingOperation is a SQL Admin operation started by this process that
+// was not known to be done yet.
+type pendingOperation struct {
+	Project     string    `json:"project"`
+	Instance    string    `json:"instance"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Action      string    `json:"action,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	TriggeredBy string    `json:"triggered_by,omitempty"`
+	Schedule    string    `json:"schedule,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+}
+
+// attrs are the log fields of the operation followed by extra.
+func (p pendingOperation) attrs(extra ...any) []any {
+	return append([]any{"operation", p.Name, "type", p.Type, "project", p.Project, "instance", p.Instance}, extra...)
+}
+
+// operationTracker remembers the operations started by handlers, bulk
+// requests and schedules, so shutdown can wait for them and the next
+// process picks up the ones still running. With a path every change is
+// saved to the state backend, so they are picked up after a crash too.
+type operationTracker struct {
+	mu sync.Mutex
+	// saveMu orders the saves, which run outside mu so a slow state
+	// backend doesn't hold up the handlers tracking operations.
+	saveMu     sync.Mutex
+	path       string
+	operations map[string]pendingOperation
+}
+
+var operations = newOperationTracker("")
+
+func newOperationTracker(path string) *operationTracker {
+	return &operationTracker{path: path, operations: make(map[string]pendingOperation)}
+}
+
+// track records an operation returned by the SQL Admin API for the action
+// described by event, and drops the cached state of its instance.
+func (t *operationTracker) track(event NotificationEvent, operation *sqladmin.Operation) {
+	if operation == nil {
+		return
+	}
+	inventoryCache.load().invalidate(event.Project, event.Instance)
+	if operation.Status == "DONE" {
+		return
+	}
+
+	pending := pendingOperation{
+		Project:     event.Project,
+		Instance:    event.Instance,
+		Name:        operation.Name,
+		Type:        operation.OperationType,
+		Action:      event.Action,
+		Source:      event.Source,
+		TriggeredBy: event.TriggeredBy,
+		Schedule:    event.Schedule,
+		StartedAt:   time.Now().UTC(),
+	}
+	t.mu.Lock()
+	t.operations[operation.Name] = pending
+	t.mu.Unlock()
+	t.saveLogged()
+
+	events.publishOperation(eventOperationStarted, pending, nil)
+}
+
+func (t *operationTracker) pending() []pendingOperation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sorted()
+}
+
+// sorted returns the operations, the oldest first. Callers must hold t.mu.
+func (t *operationTracker) sorted() []pendingOperation {
+	items := make([]pendingOperation, 0, len(t.operations))
+	for _, operation := range t.operations {
+		items = append(items, operation)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].StartedAt.Before(items[j].StartedAt) })
+	return items
+}
+
+// save writes the operations to the state backend, removing the file once
+// none are left. They are read once the previous save is done, so the last
+// save always has the latest operations.
+func (t *operationTracker) save() error {
+	if t.path == "" {
+		return nil
+	}
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	t.mu.Lock()
+	items := t.sorted()
+	t.mu.Unlock()
+	if len(items) == 0 {
+		return state.remove(t.path)
+	}
+
+	raw, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = state.write(t.path, raw)
+	return err
+}
+
+// saveLogged saves the operations, a failure only costs the resume after a
+// crash.
+func (t *operationTracker) saveLogged() {
+	if err := t.save(); err != nil {
+		slog.Error("Failed to save pending operations", "path", t.path, "error", err)
+	}
+}
+
+// finished forgets a done operation, reports it to event streams and
+// notifies when it failed.
+func (t *operationTracker) finished(operation *sqladmin.Operation, err error) {
+	t.mu.Lock()
+	pending, ok := t.operations[operation.Name]
+	if ok {
+		delete(t.operations, operation.Name)
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	inventoryCache.load().invalidate(pending.Project, pending.Instance)
+	t.saveLogged()
+
+	if err == nil {
+		events.publishOperation(eventOperationDone, pending, nil)
+		return
+	}
+	events.publishOperation(eventOperationFailed, pending, err)
+	event := newNotificationEvent(pending.Action, pending.Source, pending.TriggeredBy, pending.Project, pending.Instance)
+	event.Schedule = pending.Schedule
+	event.Operation, event.Result, event.Error = operation.Name, notifyResultFailed, err.Error()
+	notifications.send(event)
+}
+
+// drain waits until every tracked operation is done or ctx expires. The
+// operations still running are left in the tracker's file for resume.
+func (t *operationTracker) drain(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, pending := range t.pending() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.await(ctx, pending)
+		}()
+	}
+	wg.Wait()
+
+	remaining := t.pending()
+	if len(remaining) == 0 || t.path == "" {
+		return nil
+	}
+
+	slog.Warn("SQL Admin operations still running, saved for the next process", "count", len(remaining), "path", t.path)
+	return t.save()
+}
+
+// await polls one operation until it is done, logging its outcome.
+func (t *operationTracker) await(ctx context.Context, pending pendingOperation) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(maxWaitTimeout)
+	}
+
+	operation, err := waitForOperation(ctx, pending.Project, &sqladmin.Operation{Name: pending.Name}, time.Until(deadline))
+	if operation.Status != "DONE" {
+		return
+	}
+	t.finished(operation, err)
+
+	if err != nil {
+		slog.Error("Operation failed", pending.attrs("error", err)...)
+		return
+	}
+	slog.Info("Operation finished", pending.attrs("status", operation.Status)...)
+}
+
+// resume picks up the operations left running by the previous process,
+// whether it shut down or crashed, and follows them in the background until
+// they are done. They stay saved until then.
+func (t *operationTracker) resume(ctx context.Context) error {
+	if t.path == "" {
+		return nil
+	}
+	raw, _, err := state.read(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var items []pendingOperation
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return err
+	}
+
+	for _, pending := range items {
+		slog.Info("Resuming operation left running by the previous process", pending.attrs()...)
+		t.mu.Lock()
+		t.operations[pending.Name] = pending
+		t.mu.Unlock()
+		go t.await(ctx, pending)
+	}
+	return nil
+}
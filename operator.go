@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"scheduler-db/pkg/sqlctl"
+)
+
+// The CloudSQLSchedule custom resource, defined by deploy/crd.yaml.
+const (
+	cloudSQLScheduleGroup   = "scheduler-db.dev"
+	cloudSQLScheduleVersion = "v1alpha1"
+	cloudSQLSchedulePlural  = "cloudsqlschedules"
+
+	defaultOperatorResyncInterval = 30 * time.Second
+	operatorRetryDelay            = 5 * time.Second
+)
+
+// Reasons of the Ready condition of a CloudSQLSchedule.
+const (
+	reasonInSync       = "InSync"
+	reasonProgressing  = "Progressing"
+	reasonSuspended    = "Suspended"
+	reasonInvalidSpec  = "InvalidSpec"
+	reasonActionFailed = "ActionFailed"
+)
+
+// OperatorConfig enables the Kubernetes operator mode. An empty Namespace
+// watches every namespace.
+type OperatorConfig struct {
+	Enabled        bool
+	Namespace      string
+	APIURL         string
+	ResyncInterval time.Duration
+}
+
+// CloudSQLSchedule starts and stops a Cloud SQL instance on cron
+// expressions, managed as a Kubernetes resource.
+type CloudSQLSchedule struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+		Generation      int64  `json:"generation,omitempty"`
+	} `json:"metadata"`
+	Spec   CloudSQLScheduleSpec   `json:"spec"`
+	Status CloudSQLScheduleStatus `json:"status,omitempty"`
+}
+
+// CloudSQLScheduleSpec is the desired schedule. The project defaults to
+// PROJECT_ID, either of Start and Stop may be left out.
+type CloudSQLScheduleSpec struct {
+	InstanceRef struct {
+		Project string `json:"project,omitempty"`
+		Name    string `json:"name"`
+	} `json:"instanceRef"`
+	Start            string `json:"start,omitempty"`
+	Stop             string `json:"stop,omitempty"`
+	Timezone         string `json:"timezone,omitempty"`
+	BackupBeforeStop bool   `json:"backupBeforeStop,omitempty"`
+	Suspend          bool   `json:"suspend,omitempty"`
+}
+
+// CloudSQLScheduleStatus reports the last transition of the schedule and
+// whether the instance was brought in line with it. Times are RFC 3339 in
+// UTC, as usual in Kubernetes.
+type CloudSQLScheduleStatus struct {
+	ObservedGeneration int64               `json:"observedGeneration,omitempty"`
+	DesiredAction      string              `json:"desiredAction,omitempty"`
+	LastTransitionTime string              `json:"lastTransitionTime,omitempty"`
+	AppliedTransition  string              `json:"appliedTransition,omitempty"`
+	Operation          string              `json:"operation,omitempty"`
+	InstanceState      string              `json:"instanceState,omitempty"`
+	NextStart          string              `json:"nextStart,omitempty"`
+	NextStop           string              `json:"nextStop,omitempty"`
+	Conditions         []CloudSQLCondition `json:"conditions,omitempty"`
+}
+
+// CloudSQLCondition is a standard Kubernetes status condition.
+type CloudSQLCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason"`
+	Message            string `json:"message,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+}
+
+func (s CloudSQLSchedule) key() string {
+	return s.Metadata.Namespace + "/" + s.Metadata.Name
+}
+
+func (spec CloudSQLScheduleSpec) validate() validationErrors {
+	var errs validationErrors
+	if spec.InstanceRef.Name == "" {
+		errs = append(errs, fieldError{Field: "spec.instanceRef.name", Message: "is required"})
+	}
+	if spec.Start == "" && spec.Stop == "" {
+		errs = append(errs, fieldError{Field: "spec", Message: "must set start, stop or both"})
+	}
+	for field, expression := range map[string]string{"spec.start": spec.Start, "spec.stop": spec.Stop} {
+		if _, err := cron.ParseStandard(expression); expression != "" && err != nil {
+			errs = append(errs, fieldError{Field: field, Message: "is not a valid cron expression: " + err.Error()})
+		}
+	}
+	if _, err := time.LoadLocation(spec.Timezone); err != nil {
+		errs = append(errs, fieldError{Field: "spec.timezone", Message: "is not a valid IANA timezone"})
+	}
+	return errs
+}
+
+// schedules are the start and stop schedules of the resource, so they fire
+// and skip holidays exactly like schedules of the built-in scheduler.
+func (s CloudSQLSchedule) schedules() []Schedule {
+	project := s.Spec.InstanceRef.Project
+	if project == "" {
+		project = projectID.load()
+	}
+
+	var items []Schedule
+	for action, expression := range map[string]string{scheduleActionStart: s.Spec.Start, scheduleActionStop: s.Spec.Stop} {
+		if expression != "" {
+			items = append(items, Schedule{
+				ID:               s.key() + "/" + action,
+				Project:          project,
+				Instance:         s.Spec.InstanceRef.Name,
+				Action:           action,
+				Cron:             expression,
+				Timezone:         s.Spec.Timezone,
+				BackupBeforeStop: action == scheduleActionStop && s.Spec.BackupBeforeStop,
+			})
+		}
+	}
+	return items
+}
+
+// previous is the last time at or before t the schedule fired, skipping
+// starts on holidays, or the zero time when it didn't fire in the past
+// year. The lookback widens step by step so frequent schedules stay cheap.
+func (s Schedule) previous(t time.Time) (time.Time, error) {
+	for _, lookback := range []time.Duration{24 * time.Hour, 8 * 24 * time.Hour, 32 * 24 * time.Hour, 366 * 24 * time.Hour} {
+		var last time.Time
+		next, err := s.next(t.Add(-lookback))
+		for ; err == nil && !next.IsZero() && !next.After(t); next, err = s.next(next) {
+			if s.skippedHoliday(next) == "" {
+				last = next
+			}
+		}
+		if err != nil || !last.IsZero() {
+			return last, err
+		}
+	}
+	return time.Time{}, nil
+}
+
+// operator reconciles the activation policy of instances with the
+// CloudSQLSchedule resources of a cluster. Every transition of a schedule
+// is applied once, so an instance started by hand after its stop stays up
+// until the next transition.
+type operator struct {
+	client *kubeClient
+	config OperatorConfig
+	now    func() time.Time
+}
+
+func newOperator(config OperatorConfig) (*operator, error) {
+	client, err := newKubeClient(config.APIURL, cloudSQLSchedulePlural)
+	if err != nil {
+		return nil, err
+	}
+	return &operator{client: client, config: config, now: time.Now}, nil
+}
+
+// run lists and reconciles every schedule, then watches for changes until
+// the resync interval elapses, until stop is closed. The periodic relist
+// is what applies transitions as their cron time passes.
+func (o *operator) run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for ctx.Err() == nil {
+		resourceVersion, err := o.reconcileAll(ctx)
+		if err == nil {
+			err = o.client.watchCloudSQLSchedules(ctx, o.config.Namespace, resourceVersion, o.config.ResyncInterval, func(eventType string, schedule CloudSQLSchedule) {
+				if eventType != "DELETED" {
+					o.reconcile(ctx, schedule)
+				}
+			})
+		}
+		if err != nil && !errors.Is(err, errWatchExpired) && ctx.Err() == nil {
+			slog.Error("Failed to watch CloudSQLSchedules", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(operatorRetryDelay):
+			}
+		}
+	}
+}
+
+// reconcileAll reconciles every schedule and returns the resource version
+// of the list.
+func (o *operator) reconcileAll(ctx context.Context) (string, error) {
+	items, resourceVersion, err := o.client.listCloudSQLSchedules(ctx, o.config.Namespace)
+	if err != nil {
+		return "", err
+	}
+	for _, schedule := range items {
+		o.reconcile(ctx, schedule)
+	}
+	return resourceVersion, nil
+}
+
+// reconcile applies the last transition of a schedule to its instance, if
+// it wasn't yet, and writes the outcome to the resource's status. Only the
+// leader does, the next resync catches up after a failover.
+func (o *operator) reconcile(ctx context.Context, schedule CloudSQLSchedule) {
+	if !leadership.leading() {
+		return
+	}
+	status := schedule.Status
+	status.Conditions = append([]CloudSQLCondition(nil), status.Conditions...)
+	status.ObservedGeneration = schedule.Metadata.Generation
+	o.evaluate(ctx, schedule, &status)
+
+	if reflect.DeepEqual(status, schedule.Status) {
+		return
+	}
+	schedule.Status = status
+	if err := o.client.updateCloudSQLScheduleStatus(ctx, schedule); err != nil {
+		slog.Error("Failed to update the CloudSQLSchedule status", "schedule", schedule.key(), "error", err)
+	}
+}
+
+func (o *operator) evaluate(ctx context.Context, schedule CloudSQLSchedule, status *CloudSQLScheduleStatus) {
+	generation := schedule.Metadata.Generation
+	if errs := schedule.Spec.validate(); len(errs) > 0 {
+		status.setReady(o.now(), generation, false, reasonInvalidSpec, errs.Error())
+		return
+	}
+
+	now := o.now()
+	var (
+		desired    Schedule
+		transition time.Time
+	)
+	status.NextStart, status.NextStop = "", ""
+	for _, item := range schedule.schedules() {
+		if next, err := item.next(now); err == nil && !next.IsZero() {
+			if item.Action == scheduleActionStart {
+				status.NextStart = formatKubeTime(next)
+			} else {
+				status.NextStop = formatKubeTime(next)
+			}
+		}
+		if last, err := item.previous(now); err == nil && last.After(transition) {
+			desired, transition = item, last
+		}
+	}
+
+	if instance, err := checkStatusInstances(ctx, schedule.schedules()[0].Project, schedule.Spec.InstanceRef.Name); err == nil {
+		status.InstanceState = instance.State
+	}
+
+	if schedule.Spec.Suspend {
+		status.setReady(now, generation, true, reasonSuspended, "Schedule is suspended, the instance is left alone")
+		return
+	}
+	if transition.IsZero() {
+		status.setReady(now, generation, true, reasonInSync, "Schedule has not fired yet")
+		return
+	}
+	status.DesiredAction, status.LastTransitionTime = desired.Action, formatKubeTime(transition)
+
+	if status.Operation != "" {
+		done, err := operationDone(ctx, desired.Project, status.Operation)
+		switch {
+		case err != nil:
+			status.setReady(now, generation, false, reasonActionFailed, fmt.Sprintf("Operation %s failed: %v", status.Operation, err))
+			status.Operation = ""
+			return
+		case !done:
+			status.setReady(now, generation, false, reasonProgressing, fmt.Sprintf("Waiting for operation %s to %s the instance", status.Operation, desired.Action))
+			return
+		}
+		status.Operation = ""
+	}
+	if status.AppliedTransition == status.LastTransitionTime {
+		status.setReady(now, generation, true, reasonInSync, fmt.Sprintf("Instance was %sed at the last transition", desired.Action))
+		return
+	}
+
+	operation, err := runTriggeredAction(ctx, triggeredAction{
+		Action:           desired.Action,
+		Project:          desired.Project,
+		Instance:         desired.Instance,
+		Source:           actionSourceOperator,
+		TriggeredBy:      "cloudsqlschedule " + schedule.key(),
+		BackupBeforeStop: desired.BackupBeforeStop,
+	})
+	if err != nil {
+		status.setReady(now, generation, false, reasonActionFailed, err.Error())
+		return
+	}
+	if operation != nil {
+		status.Operation = operation.Name
+		status.setReady(now, generation, false, reasonProgressing, fmt.Sprintf("Waiting for operation %s to %s the instance", operation.Name, desired.Action))
+		return
+	}
+	status.AppliedTransition = status.LastTransitionTime
+	status.setReady(now, generation, true, reasonInSync, fmt.Sprintf("Instance was %sed at the last transition", desired.Action))
+}
+
+// setReady sets the Ready condition, keeping its transition time while its
+// status doesn't change.
+func (s *CloudSQLScheduleStatus) setReady(now time.Time, generation int64, ready bool, reason string, message string) {
+	condition := CloudSQLCondition{
+		Type:               "Ready",
+		Status:             "False",
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: formatKubeTime(now),
+		ObservedGeneration: generation,
+	}
+	if ready {
+		condition.Status = "True"
+	}
+
+	for i, existing := range s.Conditions {
+		if existing.Type == condition.Type {
+			if existing.Status == condition.Status {
+				condition.LastTransitionTime = existing.LastTransitionTime
+			}
+			s.Conditions[i] = condition
+			return
+		}
+	}
+	s.Conditions = append(s.Conditions, condition)
+}
+
+func formatKubeTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// operationDone reports whether a SQL Admin operation finished, with its
+// error when it failed.
+func operationDone(ctx context.Context, project string, name string) (bool, error) {
+	controller, err := sqlController(project)
+	if err != nil {
+		return false, err
+	}
+
+	operation, err := controller.Operation(ctx, project, name)
+	if err != nil {
+		return false, err
+	}
+	if operation.Status != "DONE" {
+		return false, nil
+	}
+	return true, sqlctl.OperationError(operation)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOverridesFile = "overrides.json"
+
+	// maxOverrideDuration bounds how far ahead an override may end, longer
+	// changes belong in the schedules themselves.
+	maxOverrideDuration = 30 * 24 * time.Hour
+)
+
+// accessActionOverrides is the action roles grant to manage overrides.
+const accessActionOverrides = "overrides"
+
+var errOverrideNotFound = errors.New("override not found")
+
+// overrideActions are the schedule actions an override may skip.
+var overrideActions = []string{scheduleActionStart, scheduleActionStop, scheduleActionScale}
+
+// Override suspends schedules of an instance until Until, e.g. to keep a dev
+// database running for a late demo or to skip tonight's stop. Skip lists
+// the schedule actions that don't run meanwhile.
+type Override struct {
+	ID        string    `json:"id"`
+	Project   string    `json:"project"`
+	Instance  string    `json:"instance"`
+	Skip      []string  `json:"skip"`
+	Until     time.Time `json:"until"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// skips reports whether the override suspends a run of action on the
+// instance at t.
+func (o Override) skips(project string, instance string, action string, t time.Time) bool {
+	return o.Project == project && o.Instance == instance && t.Before(o.Until) && !t.Before(o.CreatedAt) && slices.Contains(o.Skip, action)
+}
+
+// overrideStore keeps overrides in memory and persists every change to a
+// JSON file. Expired overrides are dropped as they are found.
+type overrideStore struct {
+	mu        sync.Mutex
+	path      string
+	now       func() time.Time
+	overrides map[string]*Override
+}
+
+var overrides = newOverrideStore("")
+
+func newOverrideStore(path string) *overrideStore {
+	return &overrideStore{path: path, now: time.Now, overrides: make(map[string]*Override)}
+}
+
+// load reads the overrides file from the state backend. A missing file is
+// an empty store.
+func (s *overrideStore) load() error {
+	raw, _, err := state.read(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var items []*Override
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return fmt.Errorf("invalid overrides file %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.overrides = make(map[string]*Override, len(items))
+	for _, item := range items {
+		s.overrides[item.ID] = item
+	}
+	s.expire()
+	return nil
+}
+
+// save writes the store atomically. Callers must hold s.mu.
+func (s *overrideStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	raw, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = state.write(s.path, raw)
+	return err
+}
+
+// expire drops the overrides that ended and reports whether there were
+// any. Callers must hold s.mu.
+func (s *overrideStore) expire() bool {
+	now := s.now()
+	expired := false
+	for id, override := range s.overrides {
+		if !now.Before(override.Until) {
+			slog.Info("Override expired", "override", id, "project", override.Project, "instance", override.Instance)
+			delete(s.overrides, id)
+			expired = true
+		}
+	}
+	return expired
+}
+
+// sorted returns copies of the overrides, the first to end first. Callers
+// must hold s.mu.
+func (s *overrideStore) sorted() []Override {
+	items := make([]Override, 0, len(s.overrides))
+	for _, override := range s.overrides {
+		items = append(items, *override)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].Until.Equal(items[j].Until) {
+			return items[i].Until.Before(items[j].Until)
+		}
+		return items[i].ID < items[j].ID
+	})
+	return items
+}
+
+// list returns the active overrides.
+func (s *overrideStore) list() []Override {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expire() {
+		if err := s.save(); err != nil {
+			slog.Error("Failed to save overrides", "error", err)
+		}
+	}
+	return s.sorted()
+}
+
+func (s *overrideStore) get(id string) (Override, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	override, ok := s.overrides[id]
+	if !ok || !s.now().Before(override.Until) {
+		return Override{}, errOverrideNotFound
+	}
+	return *override, nil
+}
+
+func (s *overrideStore) create(override Override) (Override, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	override.ID = randomID(8)
+	override.CreatedAt = s.now().UTC()
+	s.overrides[override.ID] = &override
+	if err := s.save(); err != nil {
+		delete(s.overrides, override.ID)
+		return Override{}, err
+	}
+	return override, nil
+}
+
+// delete ends an override before its time.
+func (s *overrideStore) delete(id string) (Override, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	override, ok := s.overrides[id]
+	if !ok {
+		return Override{}, errOverrideNotFound
+	}
+	delete(s.overrides, id)
+	if err := s.save(); err != nil {
+		s.overrides[id] = override
+		return Override{}, err
+	}
+	return *override, nil
+}
+
+// skipping returns the override suspending a run of action on the instance
+// at t, nil when the run goes ahead.
+func (s *overrideStore) skipping(project string, instance string, action string, t time.Time) *Override {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, override := range s.sorted() {
+		if override.skips(project, instance, action, t) {
+			return &override
+		}
+	}
+	return nil
+}
+
+// OverrideRequest is the body of POST /v1/overrides. Until is an RFC3339
+// time, Skip defaults to stop, which keeps the instance running.
+type OverrideRequest struct {
+	Project  string   `json:"project"`
+	Instance string   `json:"instance"`
+	Skip     []string `json:"skip"`
+	Until    string   `json:"until"`
+	Reason   string   `json:"reason"`
+}
+
+func (req *OverrideRequest) validate(now time.Time) (time.Time, validationErrors) {
+	var errs validationErrors
+	if req.Instance == "" {
+		errs = append(errs, fieldError{Field: "instance", Message: "is required"})
+	}
+	if len(req.Skip) == 0 {
+		req.Skip = []string{scheduleActionStop}
+	}
+	for i, action := range req.Skip {
+		if !slices.Contains(overrideActions, action) {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("skip[%d]", i), Message: "must be 'start', 'stop' or 'scale'"})
+		}
+	}
+
+	var until time.Time
+	switch parsed, err := time.Parse(time.RFC3339, req.Until); {
+	case req.Until == "":
+		errs = append(errs, fieldError{Field: "until", Message: "is required"})
+	case err != nil:
+		errs = append(errs, fieldError{Field: "until", Message: "must be an RFC3339 time such as '2025-06-06T18:00:00+07:00'"})
+	case !parsed.After(now):
+		errs = append(errs, fieldError{Field: "until", Message: "must be in the future"})
+	case parsed.Sub(now) > maxOverrideDuration:
+		errs = append(errs, fieldError{Field: "until", Message: fmt.Sprintf("must be within %s", maxOverrideDuration)})
+	default:
+		until = parsed
+	}
+	return until, errs
+}
+
+// OverrideData is the API representation of an Override.
+type OverrideData struct {
+	ID        string      `json:"id"`
+	Project   string      `json:"project"`
+	Instance  string      `json:"instance"`
+	Skip      []string    `json:"skip"`
+	Until     interface{} `json:"until"`
+	Reason    string      `json:"reason,omitempty"`
+	CreatedBy string      `json:"created_by,omitempty"`
+	CreatedAt interface{} `json:"created_at"`
+}
+
+func newOverrideData(override Override) OverrideData {
+	return OverrideData{
+		ID:        override.ID,
+		Project:   override.Project,
+		Instance:  override.Instance,
+		Skip:      override.Skip,
+		Until:     formatTimestamp(override.Until),
+		Reason:    override.Reason,
+		CreatedBy: override.CreatedBy,
+		CreatedAt: formatTimestamp(override.CreatedAt),
+	}
+}
+
+// overridesHandler serves GET /v1/overrides, the active overrides of the
+// instances the caller may manage (?instance= narrows them down), and POST
+// /v1/overrides.
+func overridesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		instance := r.URL.Query().Get("instance")
+		data := []OverrideData{}
+		for _, override := range overrides.list() {
+			if instance != "" && override.Instance != instance || !accessAllowed(r, accessActionOverrides, override.Project, override.Instance) {
+				continue
+			}
+			data = append(data, newOverrideData(override))
+		}
+		writeSuccessResponse(w, r, http.StatusOK, msgOverridesListed, data)
+	case http.MethodPost:
+		createOverrideHandler(w, r)
+	default:
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+	}
+}
+
+func createOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	var payload OverrideRequest
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	until, errs := payload.validate(overrides.now())
+	if len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	project := payload.Project
+	if project == "" {
+		project = projectID.load()
+	}
+	if !accessAllowed(r, accessActionOverrides, project, payload.Instance) {
+		writeErrorResponse(w, r, http.StatusForbidden, msgForbidden, "", requestPrincipal(r), accessActionOverrides)
+		return
+	}
+
+	override, err := overrides.create(Override{
+		Project:   project,
+		Instance:  payload.Instance,
+		Skip:      payload.Skip,
+		Until:     until.UTC(),
+		Reason:    payload.Reason,
+		CreatedBy: requestPrincipal(r),
+	})
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgOverrideSaveFailed, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Override created", "override", override.ID, "project", project, "instance", override.Instance, "skip", override.Skip, "until", override.Until)
+	writeSuccessResponse(w, r, http.StatusCreated, msgOverrideCreated, newOverrideData(override))
+}
+
+// overrideHandler serves GET and DELETE /v1/overrides/{id}. DELETE ends the
+// override right away.
+func overrideHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	override, err := overrides.get(id)
+	if err == nil && !accessAllowed(r, accessActionOverrides, override.Project, override.Instance) {
+		err = errOverrideNotFound
+	}
+
+	message := msgOverrideFetched
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		if err == nil {
+			override, err = overrides.delete(id)
+		}
+		message = msgOverrideDeleted
+	default:
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	switch {
+	case errors.Is(err, errOverrideNotFound):
+		writeErrorResponse(w, r, http.StatusNotFound, msgOverrideNotFound, err, id)
+	case err != nil:
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgOverrideSaveFailed, err)
+	default:
+		writeSuccessResponse(w, r, http.StatusOK, message, newOverrideData(override))
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxPauseDuration bounds the auto-resume time of a pause. Longer pauses
+// are left open and resumed by hand.
+const maxPauseDuration = 7 * 24 * time.Hour
+
+var schedulerPausedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "scheduler_db_scheduler_paused",
+	Help: "1 while automated actions are paused, 0 otherwise.",
+})
+
+// SchedulerStatus tells whether automated actions run. Reason, Since and
+// Until are set while paused, Until only for pauses that resume on their
+// own.
+type SchedulerStatus struct {
+	State  string      `json:"state"`
+	Reason string      `json:"reason,omitempty"`
+	Since  interface{} `json:"since,omitempty"`
+	Until  interface{} `json:"until,omitempty"`
+}
+
+// Scheduler states reported by SchedulerStatus.
+const (
+	schedulerStateRunning = "running"
+	schedulerStatePaused  = "paused"
+)
+
+// schedulerPause suspends every automated action during incidents or
+// migrations: schedules, desired states, idle stops, delayed actions and the
+// removal of expired authorized networks. Calls to the API, Pub/Sub
+// messages and the command line still act. Like a feature flag, a pause is
+// not persisted and is lost on restart.
+type schedulerPause struct {
+	mu     sync.Mutex
+	paused bool
+	reason string
+	since  time.Time
+	until  time.Time
+	now    func() time.Time
+}
+
+var pauses = &schedulerPause{now: time.Now}
+
+// pause suspends automated actions until resume is called or, when until
+// isn't zero, until then. Pausing again replaces the reason and until.
+func (p *schedulerPause) pause(reason string, until time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		p.since = p.now()
+	}
+	p.paused, p.reason, p.until = true, reason, until
+	schedulerPausedGauge.Set(1)
+}
+
+// resume runs automated actions again. Runs missed while paused are not
+// caught up.
+func (p *schedulerPause) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resumeLocked()
+}
+
+func (p *schedulerPause) resumeLocked() {
+	p.paused, p.reason, p.since, p.until = false, "", time.Time{}, time.Time{}
+	schedulerPausedGauge.Set(0)
+}
+
+// active reports whether automated actions are paused at now, resuming
+// them once the auto-resume time passed.
+func (p *schedulerPause) active(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.activeLocked(now)
+}
+
+func (p *schedulerPause) activeLocked(now time.Time) bool {
+	if p.paused && !p.until.IsZero() && !now.Before(p.until) {
+		slog.Info("Automated actions resumed", "paused_since", p.since, "until", p.until)
+		p.resumeLocked()
+	}
+	return p.paused
+}
+
+func (p *schedulerPause) status() SchedulerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.activeLocked(p.now()) {
+		return SchedulerStatus{State: schedulerStateRunning}
+	}
+	status := SchedulerStatus{State: schedulerStatePaused, Reason: p.reason, Since: formatTimestamp(p.since)}
+	if !p.until.IsZero() {
+		status.Until = formatTimestamp(p.until)
+	}
+	return status
+}
+
+// PauseRequest is the optional body of POST /scheduler/pause. Automated
+// actions resume on their own at Until, an RFC 3339 time, or after For, a
+// duration such as "2h". Without either they stay paused until
+// /scheduler/resume.
+type PauseRequest struct {
+	Reason string `json:"reason"`
+	Until  string `json:"until"`
+	For    string `json:"for"`
+}
+
+func (req *PauseRequest) validate(now time.Time) (time.Time, validationErrors) {
+	var (
+		until time.Time
+		errs  validationErrors
+	)
+	switch {
+	case req.Until != "" && req.For != "":
+		errs = append(errs, fieldError{Field: "until", Message: "cannot be combined with for"})
+	case req.Until != "":
+		parsed, err := time.Parse(time.RFC3339, req.Until)
+		if err != nil {
+			errs = append(errs, fieldError{Field: "until", Message: "must be an RFC 3339 time such as '2024-06-03T18:00:00Z'"})
+			break
+		}
+		until = parsed
+	case req.For != "":
+		parsed, err := time.ParseDuration(req.For)
+		if err != nil || parsed <= 0 {
+			errs = append(errs, fieldError{Field: "for", Message: "must be a positive duration such as '2h'"})
+			break
+		}
+		until = now.Add(parsed)
+	}
+
+	switch {
+	case until.IsZero():
+	case !until.After(now):
+		errs = append(errs, fieldError{Field: "until", Message: "must be in the future"})
+	case until.Sub(now) > maxPauseDuration:
+		errs = append(errs, fieldError{Field: "until", Message: fmt.Sprintf("must be within %s, leave it out to pause until resumed", maxPauseDuration)})
+	}
+	return until, errs
+}
+
+// pauseSchedulerHandler pauses automated actions.
+func pauseSchedulerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	var payload PauseRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(w, r, &payload); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+	}
+	until, errs := payload.validate(pauses.now())
+	if len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	pauses.pause(payload.Reason, until)
+	slog.Warn("Automated actions paused", "reason", payload.Reason, "until", until)
+	writeSuccessResponse(w, r, http.StatusOK, msgSchedulerPaused, pauses.status())
+}
+
+// resumeSchedulerHandler resumes automated actions, answering the same
+// when they weren't paused.
+func resumeSchedulerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	pauses.resume()
+	slog.Info("Automated actions resumed")
+	writeSuccessResponse(w, r, http.StatusOK, msgSchedulerResumed, pauses.status())
+}
@@ -0,0 +1,49 @@
+package sqlctl
+
+import (
+	"context"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// Client is the part of the SQL Admin API used by Controller. NewClient
+// implements it over a real client, sqlctltest.Fake keeps instances in
+// memory for tests.
+type Client interface {
+	GetInstance(ctx context.Context, project string, instance string) (*sqladmin.DatabaseInstance, error)
+	// PatchInstance applies the set fields of patch to an instance.
+	PatchInstance(ctx context.Context, project string, instance string, patch *sqladmin.DatabaseInstance) (*sqladmin.Operation, error)
+	// ListInstances returns every instance of project, all pages read.
+	ListInstances(ctx context.Context, project string) ([]*sqladmin.DatabaseInstance, error)
+	GetOperation(ctx context.Context, project string, operation string) (*sqladmin.Operation, error)
+}
+
+// NewClient returns a Client calling the SQL Admin API through service.
+func NewClient(service *sqladmin.Service) Client {
+	return &serviceClient{service: service}
+}
+
+type serviceClient struct {
+	service *sqladmin.Service
+}
+
+func (c *serviceClient) GetInstance(ctx context.Context, project string, instance string) (*sqladmin.DatabaseInstance, error) {
+	return c.service.Instances.Get(project, instance).Context(ctx).Do()
+}
+
+func (c *serviceClient) PatchInstance(ctx context.Context, project string, instance string, patch *sqladmin.DatabaseInstance) (*sqladmin.Operation, error) {
+	return c.service.Instances.Patch(project, instance, patch).Context(ctx).Do()
+}
+
+func (c *serviceClient) ListInstances(ctx context.Context, project string) ([]*sqladmin.DatabaseInstance, error) {
+	var instances []*sqladmin.DatabaseInstance
+	err := c.service.Instances.List(project).Pages(ctx, func(page *sqladmin.InstancesListResponse) error {
+		instances = append(instances, page.Items...)
+		return nil
+	})
+	return instances, err
+}
+
+func (c *serviceClient) GetOperation(ctx context.Context, project string, operation string) (*sqladmin.Operation, error) {
+	return c.service.Operations.Get(project, operation).Context(ctx).Do()
+}
@@ -0,0 +1,230 @@
+// Package sqlctl starts, stops and inspects Cloud SQL instances through the
+// SQL Admin API. It is the core of scheduler-db without the HTTP server,
+// schedules, notifications or audit log, for Go services that want to
+// embed it:
+//
+//	controller, err := sqlctl.NewFromOptions(ctx)
+//	...
+//	operation, err := controller.Stop(ctx, "my-project", "my-instance")
+//	...
+//	operation, err = controller.Wait(ctx, "my-project", operation)
+package sqlctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// Activation policies set by Start and Stop.
+const (
+	PolicyAlways = "ALWAYS"
+	PolicyNever  = "NEVER"
+)
+
+// StateRunnable is the state of a running instance.
+const StateRunnable = "RUNNABLE"
+
+// DefaultPollInterval is how often Wait polls when PollInterval is zero.
+const DefaultPollInterval = 5 * time.Second
+
+var (
+	// ErrAlreadyRunning is returned by Start for a running instance.
+	ErrAlreadyRunning = errors.New("instance is already running")
+	// ErrNotRunning is returned by Stop for an instance that isn't running.
+	ErrNotRunning = errors.New("instance is not running")
+	// ErrWaitTimeout is returned by Wait when the context deadline passes
+	// before the operation is done.
+	ErrWaitTimeout = errors.New("timed out waiting for operation")
+)
+
+// Instance is the state of a Cloud SQL instance.
+type Instance struct {
+	Project          string
+	Name             string
+	DatabaseVersion  string
+	Region           string
+	State            string
+	Tier             string
+	ActivationPolicy string
+}
+
+// Controller acts on instances with a SQL Admin client.
+type Controller struct {
+	Client Client
+
+	// PollInterval is how often Wait polls an operation, DefaultPollInterval
+	// when zero.
+	PollInterval time.Duration
+	// CallTimeout bounds each SQL Admin call. Zero leaves calls bounded by
+	// their context only.
+	CallTimeout time.Duration
+}
+
+// New returns a Controller using service.
+func New(service *sqladmin.Service) *Controller {
+	return &Controller{Client: NewClient(service)}
+}
+
+// NewFromOptions builds the SQL Admin client from opts, application
+// default credentials when there are none.
+func NewFromOptions(ctx context.Context, opts ...option.ClientOption) (*Controller, error) {
+	service, err := sqladmin.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return New(service), nil
+}
+
+// callContext bounds one SQL Admin call by CallTimeout.
+func (c *Controller) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.CallTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.CallTimeout)
+}
+
+// Status reads the current state of an instance.
+func (c *Controller) Status(ctx context.Context, project string, instance string) (*Instance, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	details, err := c.Client.GetInstance(ctx, project, instance)
+	if err != nil {
+		return nil, err
+	}
+	return newInstance(project, details), nil
+}
+
+// List reads the state of every instance of project.
+func (c *Controller) List(ctx context.Context, project string) ([]*Instance, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	items, err := c.Client.ListInstances(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]*Instance, 0, len(items))
+	for _, details := range items {
+		instances = append(instances, newInstance(project, details))
+	}
+	return instances, nil
+}
+
+func newInstance(project string, details *sqladmin.DatabaseInstance) *Instance {
+	status := &Instance{
+		Project:         project,
+		Name:            details.Name,
+		DatabaseVersion: details.DatabaseVersion,
+		Region:          details.Region,
+		State:           details.State,
+	}
+	if details.Settings != nil {
+		status.Tier = details.Settings.Tier
+		status.ActivationPolicy = details.Settings.ActivationPolicy
+	}
+	return status
+}
+
+// SetActivationPolicy patches the activation policy of an instance, ALWAYS
+// to start it and NEVER to stop it, without checking its state first.
+func (c *Controller) SetActivationPolicy(ctx context.Context, project string, instance string, policy string) (*sqladmin.Operation, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	return c.Client.PatchInstance(ctx, project, instance, &sqladmin.DatabaseInstance{
+		Settings: &sqladmin.Settings{ActivationPolicy: policy},
+	})
+}
+
+// Operation reads the current state of an operation.
+func (c *Controller) Operation(ctx context.Context, project string, name string) (*sqladmin.Operation, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	return c.Client.GetOperation(ctx, project, name)
+}
+
+// Start starts a stopped instance and returns the operation, or
+// ErrAlreadyRunning.
+func (c *Controller) Start(ctx context.Context, project string, instance string) (*sqladmin.Operation, error) {
+	status, err := c.Status(ctx, project, instance)
+	if err != nil {
+		return nil, err
+	}
+	if status.State == StateRunnable {
+		return nil, ErrAlreadyRunning
+	}
+	return c.SetActivationPolicy(ctx, project, instance, PolicyAlways)
+}
+
+// Stop stops a running instance and returns the operation, or
+// ErrNotRunning.
+func (c *Controller) Stop(ctx context.Context, project string, instance string) (*sqladmin.Operation, error) {
+	status, err := c.Status(ctx, project, instance)
+	if err != nil {
+		return nil, err
+	}
+	if status.State != StateRunnable {
+		return nil, fmt.Errorf("%w (%s)", ErrNotRunning, status.State)
+	}
+	return c.SetActivationPolicy(ctx, project, instance, PolicyNever)
+}
+
+// Wait polls an operation until it is DONE and returns it with its
+// OperationError. When ctx expires first, the last observed operation is
+// returned with ErrWaitTimeout, or with the context error if it was
+// cancelled.
+func (c *Controller) Wait(ctx context.Context, project string, operation *sqladmin.Operation) (*sqladmin.Operation, error) {
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for operation.Status != "DONE" {
+		select {
+		case <-ctx.Done():
+			return operation, waitError(ctx)
+		case <-ticker.C:
+		}
+
+		latest, err := c.Operation(ctx, project, operation.Name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return operation, waitError(ctx)
+			}
+			return operation, err
+		}
+		operation = latest
+	}
+
+	return operation, OperationError(operation)
+}
+
+func waitError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrWaitTimeout
+	}
+	return ctx.Err()
+}
+
+// OperationError reports the errors of a finished operation, if any.
+func OperationError(operation *sqladmin.Operation) error {
+	if operation.Error == nil || len(operation.Error.Errors) == 0 {
+		return nil
+	}
+
+	messages := make([]string, 0, len(operation.Error.Errors))
+	for _, e := range operation.Error.Errors {
+		messages = append(messages, e.Code+": "+e.Message)
+	}
+	return fmt.Errorf("operation %s failed: %s", operation.Name, strings.Join(messages, "; "))
+}
@@ -0,0 +1,137 @@
+package sqlctl_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sqladmin/v1"
+
+	"scheduler-db/pkg/sqlctl"
+	"scheduler-db/pkg/sqlctl/sqlctltest"
+)
+
+const (
+	testProject  = "test-project"
+	testInstance = "test-db"
+)
+
+func newTestController(t *testing.T) (*sqlctl.Controller, *sqlctltest.Fake) {
+	t.Helper()
+
+	fake := sqlctltest.NewFake()
+	fake.AddInstance(&sqladmin.DatabaseInstance{
+		Name:            testInstance,
+		Project:         testProject,
+		DatabaseVersion: "POSTGRES_15",
+		Settings:        &sqladmin.Settings{Tier: "db-f1-micro"},
+	})
+	return &sqlctl.Controller{Client: fake, PollInterval: time.Millisecond}, fake
+}
+
+func TestStopAndStart(t *testing.T) {
+	controller, fake := newTestController(t)
+	fake.Polls = 2
+	ctx := context.Background()
+
+	if _, err := controller.Start(ctx, testProject, testInstance); !errors.Is(err, sqlctl.ErrAlreadyRunning) {
+		t.Fatalf("Start of a running instance: got %v, want ErrAlreadyRunning", err)
+	}
+
+	operation, err := controller.Stop(ctx, testProject, testInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if operation.Status == "DONE" {
+		t.Fatal("stop operation done before being polled")
+	}
+	if _, err := controller.Wait(ctx, testProject, operation); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fake.Calls("GetOperation"); calls != 2 {
+		t.Errorf("GetOperation called %d times, want 2", calls)
+	}
+
+	status, err := controller.Status(ctx, testProject, testInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != "STOPPED" || status.ActivationPolicy != sqlctl.PolicyNever || status.Tier != "db-f1-micro" {
+		t.Errorf("after stop: %+v", status)
+	}
+
+	if _, err := controller.Stop(ctx, testProject, testInstance); !errors.Is(err, sqlctl.ErrNotRunning) {
+		t.Fatalf("Stop of a stopped instance: got %v, want ErrNotRunning", err)
+	}
+	if _, err := controller.Start(ctx, testProject, testInstance); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	controller, fake := newTestController(t)
+	fake.Polls = 1000
+
+	operation, err := controller.Stop(context.Background(), testProject, testInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := controller.Wait(ctx, testProject, operation); !errors.Is(err, sqlctl.ErrWaitTimeout) {
+		t.Fatalf("got %v, want ErrWaitTimeout", err)
+	}
+	if state := fake.Instance(testProject, testInstance).State; state != sqlctl.StateRunnable {
+		t.Errorf("state changed to %s before the operation was done", state)
+	}
+}
+
+func TestFakeErrors(t *testing.T) {
+	controller, fake := newTestController(t)
+	ctx := context.Background()
+
+	var apiErr *googleapi.Error
+	if _, err := controller.Status(ctx, testProject, "missing"); !errors.As(err, &apiErr) || apiErr.Code != 404 {
+		t.Fatalf("missing instance: got %v, want a 404", err)
+	}
+
+	injected := errors.New("quota exceeded")
+	fake.Fail("PatchInstance", injected)
+	if _, err := controller.Stop(ctx, testProject, testInstance); !errors.Is(err, injected) {
+		t.Fatalf("got %v, want the injected error", err)
+	}
+	fake.Fail("PatchInstance", nil)
+	if _, err := controller.Stop(ctx, testProject, testInstance); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestList(t *testing.T) {
+	controller, fake := newTestController(t)
+	fake.AddInstance(&sqladmin.DatabaseInstance{Name: "analytics", Project: testProject, Settings: &sqladmin.Settings{ActivationPolicy: sqlctl.PolicyNever}})
+	fake.AddInstance(&sqladmin.DatabaseInstance{Name: "other", Project: "other-project"})
+
+	instances, err := controller.List(context.Background(), testProject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 2 || instances[0].Name != "analytics" || instances[0].State != "STOPPED" || instances[1].Name != testInstance {
+		t.Errorf("got %+v", instances)
+	}
+}
+
+func TestOperationError(t *testing.T) {
+	operation := &sqladmin.Operation{Name: "op-1", Status: "DONE", Error: &sqladmin.OperationErrors{
+		Errors: []*sqladmin.OperationError{{Code: "INTERNAL_ERROR", Message: "boom"}},
+	}}
+	err := sqlctl.OperationError(operation)
+	if err == nil || err.Error() != "operation op-1 failed: INTERNAL_ERROR: boom" {
+		t.Errorf("got %v", err)
+	}
+	if err := sqlctl.OperationError(&sqladmin.Operation{Name: "op-2", Status: "DONE"}); err != nil {
+		t.Errorf("got %v for a successful operation", err)
+	}
+}
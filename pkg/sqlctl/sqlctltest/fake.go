@@ -0,0 +1,235 @@
+// Package sqlctltest provides an in-memory sqlctl.Client for tests of code
+// built on sqlctl, so they run without credentials or calls to Google.
+package sqlctltest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sqladmin/v1"
+
+	"scheduler-db/pkg/sqlctl"
+)
+
+// Fake keeps instances and operations in memory. Patches apply the
+// activation policy, tier and user labels of an instance when their
+// operation is done, and the state follows the activation policy.
+type Fake struct {
+	// Polls is how many times GetOperation reports an operation RUNNING
+	// before it is DONE. With 0 operations are done when returned.
+	Polls int
+
+	mu         sync.Mutex
+	instances  map[string]*sqladmin.DatabaseInstance
+	operations map[string]*fakeOperation
+	failures   map[string]error
+	calls      map[string]int
+}
+
+var _ sqlctl.Client = (*Fake)(nil)
+
+type fakeOperation struct {
+	op    *sqladmin.Operation
+	polls int
+	apply func()
+}
+
+// NewFake returns a Fake without instances.
+func NewFake() *Fake {
+	return &Fake{
+		instances:  make(map[string]*sqladmin.DatabaseInstance),
+		operations: make(map[string]*fakeOperation),
+		failures:   make(map[string]error),
+		calls:      make(map[string]int),
+	}
+}
+
+// AddInstance adds a copy of instance to instance.Project. Instances are
+// running unless their activation policy is NEVER.
+func (f *Fake) AddInstance(instance *sqladmin.DatabaseInstance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance = clone(instance)
+	if instance.Settings == nil {
+		instance.Settings = &sqladmin.Settings{}
+	}
+	if instance.Settings.ActivationPolicy == "" {
+		instance.Settings.ActivationPolicy = sqlctl.PolicyAlways
+	}
+	if instance.State == "" {
+		instance.State = stateForPolicy(instance.Settings.ActivationPolicy)
+	}
+	f.instances[instance.Project+"/"+instance.Name] = instance
+}
+
+// Instance returns a copy of an instance, nil when there is none.
+func (f *Fake) Instance(project string, name string) *sqladmin.DatabaseInstance {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if instance, ok := f.instances[project+"/"+name]; ok {
+		return clone(instance)
+	}
+	return nil
+}
+
+// Fail makes every call of method, e.g. "PatchInstance", return err until
+// it is called again with a nil err.
+func (f *Fake) Fail(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		delete(f.failures, method)
+		return
+	}
+	f.failures[method] = err
+}
+
+// Calls returns how many times method was called.
+func (f *Fake) Calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[method]
+}
+
+// call counts a call of method and returns its injected failure.
+func (f *Fake) call(ctx context.Context, method string) error {
+	f.calls[method]++
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.failures[method]
+}
+
+func (f *Fake) GetInstance(ctx context.Context, project string, instance string) (*sqladmin.DatabaseInstance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call(ctx, "GetInstance"); err != nil {
+		return nil, err
+	}
+	details, ok := f.instances[project+"/"+instance]
+	if !ok {
+		return nil, notFound("instance", instance)
+	}
+	return clone(details), nil
+}
+
+func (f *Fake) PatchInstance(ctx context.Context, project string, instance string, patch *sqladmin.DatabaseInstance) (*sqladmin.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call(ctx, "PatchInstance"); err != nil {
+		return nil, err
+	}
+	details, ok := f.instances[project+"/"+instance]
+	if !ok {
+		return nil, notFound("instance", instance)
+	}
+
+	settings := patch.Settings
+	if settings == nil {
+		settings = &sqladmin.Settings{}
+	}
+	apply := func() {
+		if settings.ActivationPolicy != "" {
+			details.Settings.ActivationPolicy = settings.ActivationPolicy
+			details.State = stateForPolicy(settings.ActivationPolicy)
+		}
+		if settings.Tier != "" {
+			details.Settings.Tier = settings.Tier
+		}
+		if settings.UserLabels != nil {
+			details.Settings.UserLabels = settings.UserLabels
+		}
+	}
+
+	op := &sqladmin.Operation{
+		Name:          fmt.Sprintf("operation-%d", len(f.operations)+1),
+		OperationType: "UPDATE",
+		TargetProject: project,
+		TargetId:      instance,
+		Status:        "RUNNING",
+	}
+	operation := &fakeOperation{op: op, polls: f.Polls, apply: apply}
+	f.operations[project+"/"+op.Name] = operation
+	if operation.polls <= 0 {
+		operation.finish()
+	}
+	return clone(op), nil
+}
+
+func (f *Fake) ListInstances(ctx context.Context, project string) ([]*sqladmin.DatabaseInstance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call(ctx, "ListInstances"); err != nil {
+		return nil, err
+	}
+	var instances []*sqladmin.DatabaseInstance
+	for _, instance := range f.instances {
+		if instance.Project == project {
+			instances = append(instances, clone(instance))
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	return instances, nil
+}
+
+func (f *Fake) GetOperation(ctx context.Context, project string, operation string) (*sqladmin.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call(ctx, "GetOperation"); err != nil {
+		return nil, err
+	}
+	pending, ok := f.operations[project+"/"+operation]
+	if !ok {
+		return nil, notFound("operation", operation)
+	}
+	if pending.op.Status != "DONE" {
+		pending.polls--
+		if pending.polls <= 0 {
+			pending.finish()
+		}
+	}
+	return clone(pending.op), nil
+}
+
+func (o *fakeOperation) finish() {
+	o.apply()
+	o.op.Status = "DONE"
+}
+
+func stateForPolicy(policy string) string {
+	if policy == sqlctl.PolicyNever {
+		return "STOPPED"
+	}
+	return sqlctl.StateRunnable
+}
+
+// notFound is the error the SQL Admin API returns for a missing resource.
+func notFound(kind string, name string) error {
+	return &googleapi.Error{Code: http.StatusNotFound, Message: fmt.Sprintf("The Cloud SQL %s %s does not exist.", kind, name)}
+}
+
+// clone deep copies v so callers can't change what the fake holds.
+func clone[T any](v *T) *T {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	var copied T
+	if err := json.Unmarshal(data, &copied); err != nil {
+		panic(err)
+	}
+	return &copied
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// policyActions are the actions policy rules may block, every action that
+// changes an instance.
+var policyActions = []string{
+	scheduleActionStart, scheduleActionStop, scheduleActionScale, actionSettings, actionBackup, actionRestore,
+	actionRestart, actionMaintenanceWindow, actionStorage, actionDatabaseFlags, actionExport, actionImport,
+	actionClone, actionFailover, actionPromote, actionUsers, actionAuthorizedNetworks,
+}
+
+// errPolicyViolation is recorded when a policy rule blocks an action.
+var errPolicyViolation = errors.New("blocked by policy")
+
+var policyViolationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "scheduler_db_policy_violations_total",
+	Help: "Actions blocked by a policy rule, by rule and action.",
+}, []string{"rule", "action"})
+
+// policyNow is the clock maintenance windows are checked against. A
+// variable so tests can set it.
+var policyNow = time.Now
+
+// PolicyRule blocks Actions on the Cloud SQL instances it matches, whoever
+// asks: a caller of the API, a schedule, a Pub/Sub message or the command
+// line. Projects and Instances are glob patterns, empty means any, and
+// Labels must all be carried by the instance. With
+// OutsideMaintenanceWindow the rule only blocks outside the hour of the
+// instance's maintenance window.
+type PolicyRule struct {
+	Name                     string            `yaml:"name"`
+	Description              string            `yaml:"description"`
+	Actions                  []string          `yaml:"actions"`
+	Projects                 []string          `yaml:"projects"`
+	Instances                []string          `yaml:"instances"`
+	Labels                   map[string]string `yaml:"labels"`
+	OutsideMaintenanceWindow bool              `yaml:"outside_maintenance_window"`
+}
+
+// targets reports whether the rule may block action on the instance,
+// before its labels and maintenance window are looked at.
+func (rule PolicyRule) targets(action string, project string, instance string) bool {
+	return (slices.Contains(rule.Actions, accessActionAny) || slices.Contains(rule.Actions, action)) &&
+		matchesAny(rule.Projects, project) && matchesAny(rule.Instances, instance)
+}
+
+// needsInstance reports whether the rule needs the details of the instance
+// to decide.
+func (rule PolicyRule) needsInstance() bool {
+	return len(rule.Labels) > 0 || rule.OutsideMaintenanceWindow
+}
+
+// blocks reports whether the rule blocks a targeted action on instance at
+// now. instance is only read when the rule needs it.
+func (rule PolicyRule) blocks(instance *sqladmin.DatabaseInstance, now time.Time) bool {
+	if len(rule.Labels) > 0 && !matchLabels(instance, rule.Labels) {
+		return false
+	}
+	if rule.OutsideMaintenanceWindow && instance.Settings != nil && inMaintenanceWindow(instance.Settings.MaintenanceWindow, now) {
+		return false
+	}
+	return true
+}
+
+// inMaintenanceWindow reports whether now falls in the hour of window. An
+// instance without a window never is.
+func inMaintenanceWindow(window *sqladmin.MaintenanceWindow, now time.Time) bool {
+	if window == nil {
+		return false
+	}
+	now = now.UTC()
+	day := int64(now.Weekday())
+	if day == 0 {
+		day = 7
+	}
+	return (window.Day == 0 || window.Day == day) && window.Hour == int64(now.Hour())
+}
+
+// Policies are the rules every change to an instance is checked against.
+// The first rule blocking an action wins.
+type Policies []PolicyRule
+
+func (p Policies) validate() error {
+	var errs []error
+	seen := make(map[string]int)
+	for i, rule := range p {
+		prefix := fmt.Sprintf("policies[%d]", i)
+		switch first, ok := seen[rule.Name]; {
+		case rule.Name == "":
+			errs = append(errs, fmt.Errorf("%s.name: is required", prefix))
+		case ok:
+			errs = append(errs, fmt.Errorf("%s.name: %q is already used by policies[%d]", prefix, rule.Name, first))
+		default:
+			seen[rule.Name] = i
+		}
+		if len(rule.Actions) == 0 {
+			errs = append(errs, fmt.Errorf("%s.actions: is required", prefix))
+		}
+		for j, action := range rule.Actions {
+			if action != accessActionAny && !slices.Contains(policyActions, action) {
+				errs = append(errs, fmt.Errorf("%s.actions[%d]: %q is not one of *, %s", prefix, j, action, strings.Join(policyActions, ", ")))
+			}
+		}
+		errs = append(errs, validatePatterns(prefix+".projects", rule.Projects)...)
+		errs = append(errs, validatePatterns(prefix+".instances", rule.Instances)...)
+	}
+	return errors.Join(errs...)
+}
+
+// targeting returns the rules that may block action on the instance.
+func (p Policies) targeting(action string, project string, instance string) Policies {
+	var rules Policies
+	for _, rule := range p {
+		if rule.targets(action, project, instance) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// check returns a *policyError for the first rule blocking action on
+// instance.
+func (p Policies) check(action string, instance *sqladmin.DatabaseInstance, now time.Time) error {
+	for _, rule := range p.targeting(action, instance.Project, instance.Name) {
+		if rule.blocks(instance, now) {
+			policyViolationsTotal.WithLabelValues(rule.Name, action).Inc()
+			return &policyError{Rule: rule.Name, Description: rule.Description, Action: action}
+		}
+	}
+	return nil
+}
+
+// policies are the running rules.
+var policies reloadable[Policies]
+
+// policyError is an action a rule blocked.
+type policyError struct {
+	Rule        string
+	Description string
+	Action      string
+}
+
+func (e *policyError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s %s %q: %s", e.Action, errPolicyViolation, e.Rule, e.Description)
+	}
+	return fmt.Sprintf("%s %s %q", e.Action, errPolicyViolation, e.Rule)
+}
+
+func (e *policyError) Unwrap() error { return errPolicyViolation }
+
+// checkPolicies returns a *policyError when a rule blocks action on the
+// instance. The instance is only read when a targeting rule needs its
+// labels or maintenance window.
+func checkPolicies(ctx context.Context, action string, project string, name string) error {
+	rules := policies.load().targeting(action, project, name)
+	if len(rules) == 0 {
+		return nil
+	}
+
+	instance := &sqladmin.DatabaseInstance{Project: project, Name: name}
+	if slices.ContainsFunc(rules, PolicyRule.needsInstance) {
+		sqlService, err := sqlAdminService(project)
+		if err != nil {
+			return err
+		}
+		if instance, err = getInstance(ctx, sqlService, project, name); err != nil {
+			return fmt.Errorf("failed to read the instance for the policies: %w", err)
+		}
+	}
+	return rules.check(action, instance, policyNow())
+}
+
+// withPolicy rejects with 403 the requests changing the targeted instance
+// that a policy rule blocks. Reads go through.
+func withPolicy(action string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		instance := targetInstance(r)
+		err := checkPolicies(r.Context(), action, targetProject(r), instance)
+		var blocked *policyError
+		switch {
+		case errors.As(err, &blocked):
+			writeErrorResponse(w, r, http.StatusForbidden, msgPolicyViolation, err, action, instance, blocked.Rule)
+			return
+		case err != nil:
+			writeErrorResponse(w, r, http.StatusInternalServerError, msgPolicyCheckFailed, err, instance)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
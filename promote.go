@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// actionPromote names replica promotions in access roles, notifications and
+// the audit log.
+const actionPromote = "promote"
+
+// PromoteRequest is the body of POST /v1/instances/{instance}/promote.
+// ConfirmationToken is left out on the first call and set to the token it
+// returned on the second.
+type PromoteRequest struct {
+	ConfirmationToken string `json:"confirmation_token"`
+}
+
+// PromoteConfirmation is the answer of a promotion without a confirmation
+// token: the replica, the primary it stops replicating from, and the token
+// confirming it.
+type PromoteConfirmation struct {
+	Project           string      `json:"project"`
+	Instance          string      `json:"instance"`
+	Primary           string      `json:"primary"`
+	ConfirmationToken string      `json:"confirmation_token"`
+	ExpiresAt         interface{} `json:"expires_at"`
+}
+
+// promoteConfirmationFields bind a token to the replica, its primary and the
+// caller.
+func promoteConfirmationFields(principal string, project string, instance string, primary string) []string {
+	return []string{actionPromote, principal, project, instance, primary}
+}
+
+// promoteHandler promotes a read replica to a standalone primary, for
+// disaster recovery runbooks. The promotion can't be undone: the replica
+// stops replicating for good. As with restores, a first call without
+// confirmation_token changes nothing and returns a token, valid for
+// confirmationTTL, and the promotion starts when the same caller
+// sends it back.
+func promoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	var payload PromoteRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(w, r, &payload); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	project, name := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	instance, err := getInstance(r.Context(), sqlService, project, name)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	if instance.MasterInstanceName == "" {
+		writeErrorResponse(w, r, http.StatusConflict, msgPromoteNotReplica, "instance has no primary", name)
+		return
+	}
+	if instance.State != "RUNNABLE" {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInstanceNotRunnable, "", instance.State)
+		return
+	}
+
+	principal := requestPrincipal(r)
+	fields := promoteConfirmationFields(principal, project, name, instance.MasterInstanceName)
+	if payload.ConfirmationToken == "" {
+		expires := time.Now().Add(confirmationTTL)
+		writeSuccessResponse(w, r, http.StatusOK, msgPromoteConfirmationRequired, PromoteConfirmation{
+			Project:           project,
+			Instance:          name,
+			Primary:           instance.MasterInstanceName,
+			ConfirmationToken: signConfirmation(expires, fields...),
+			ExpiresAt:         formatTimestamp(expires),
+		}, name, instance.MasterInstanceName)
+		return
+	}
+	if err := checkConfirmation(payload.ConfirmationToken, time.Now(), fields...); err != nil {
+		writeErrorResponse(w, r, http.StatusConflict, msgPromoteConfirmationInvalid, err)
+		return
+	}
+
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunCall(http.MethodPost, sqlAdminInstancePath(project, name)+"/promoteReplica", nil))
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	operation, err := sqlService.Instances.PromoteReplica(project, name).Context(ctx).Do()
+	event := newNotificationEvent(actionPromote, actionSourceAPI, principal, project, name)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgPromoteFailed, err)
+		return
+	}
+
+	operations.track(event, operation)
+	writeOperationResponse(w, r, project, name, operation, wait, timeout, operationSteps{}, msgPromoteStarted, msgPromoteFailed)
+}
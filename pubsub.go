@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/pubsub/v1"
+)
+
+const (
+	defaultPubSubMaxMessages = 10
+
+	// pubsubAckDeadline is set on pulled messages so a start or stop
+	// waiting for a backup isn't redelivered meanwhile.
+	pubsubAckDeadline = 600
+
+	// pubsubDedupWindow is how long a processed message ID is remembered,
+	// Pub/Sub redeliveries happen well within it.
+	pubsubDedupWindow = time.Hour
+
+	pubsubRetryDelay    = 5 * time.Second
+	pubsubSettleTimeout = 30 * time.Second
+)
+
+var pubsubResourceName = regexp.MustCompile(`^projects/[^/]+/(subscriptions|topics)/[^/]+$`)
+
+// PubSubConfig enables the Pub/Sub trigger mode. Short names are resolved
+// in PROJECT_ID.
+type PubSubConfig struct {
+	Subscription    string
+	DeadLetterTopic string
+	MaxMessages     int
+}
+
+func (p PubSubConfig) enabled() bool {
+	return p.Subscription != ""
+}
+
+func (p PubSubConfig) validate() error {
+	var errs []error
+	if strings.Contains(p.Subscription, "/") && !pubsubResourceName.MatchString(p.Subscription) {
+		errs = append(errs, fmt.Errorf("PUBSUB_SUBSCRIPTION: %q is neither a name nor projects/PROJECT/subscriptions/NAME", p.Subscription))
+	}
+	if strings.Contains(p.DeadLetterTopic, "/") && !pubsubResourceName.MatchString(p.DeadLetterTopic) {
+		errs = append(errs, fmt.Errorf("PUBSUB_DEAD_LETTER_TOPIC: %q is neither a name nor projects/PROJECT/topics/NAME", p.DeadLetterTopic))
+	}
+	if p.DeadLetterTopic != "" && !p.enabled() {
+		errs = append(errs, errors.New("PUBSUB_DEAD_LETTER_TOPIC: requires PUBSUB_SUBSCRIPTION"))
+	}
+	return errors.Join(errs...)
+}
+
+// qualify returns the full resource name of a subscription or topic.
+func qualify(project string, kind string, name string) string {
+	if name == "" || strings.Contains(name, "/") {
+		return name
+	}
+	return fmt.Sprintf("projects/%s/%s/%s", project, kind, name)
+}
+
+// PubSubCommand is the JSON payload of a message. It names the action
+// either directly or with the activation policy of the /start and /stop
+// body, so Cloud Scheduler jobs can publish the payload they used to POST.
+type PubSubCommand struct {
+	Action           string `json:"action"`
+	ActivationPolicy string `json:"ActivationPolicy"`
+	Project          string `json:"project"`
+	Instance         string `json:"instance"`
+	BackupBeforeStop bool   `json:"backup_before_stop"`
+}
+
+func (c *PubSubCommand) validate() validationErrors {
+	var errs validationErrors
+	switch {
+	case c.Action != "" && c.ActivationPolicy != "":
+		errs = append(errs, fieldError{Field: "action", Message: "can't be combined with ActivationPolicy"})
+	case c.Action == "" && c.ActivationPolicy == "":
+		errs = append(errs, fieldError{Field: "action", Message: "is required"})
+	case c.Action != "" && scheduleActivationPolicies[c.Action] == "":
+		errs = append(errs, fieldError{Field: "action", Message: "must be 'start' or 'stop'"})
+	case c.ActivationPolicy != "" && c.ActivationPolicy != "ALWAYS" && c.ActivationPolicy != "NEVER":
+		errs = append(errs, fieldError{Field: "ActivationPolicy", Message: "must be 'ALWAYS' or 'NEVER'", code: msgInvalidActivationPolicy})
+	}
+	if c.BackupBeforeStop && c.action() != scheduleActionStop {
+		errs = append(errs, fieldError{Field: "backup_before_stop", Message: "only applies to stops"})
+	}
+	return errs
+}
+
+func (c *PubSubCommand) action() string {
+	switch c.ActivationPolicy {
+	case "ALWAYS":
+		return scheduleActionStart
+	case "NEVER":
+		return scheduleActionStop
+	}
+	return c.Action
+}
+
+// parsePubSubCommand decodes a message strictly, an error means the message
+// can never succeed and belongs in the dead-letter topic.
+func parsePubSubCommand(message *pubsub.PubsubMessage) (*PubSubCommand, error) {
+	data, err := base64.StdEncoding.DecodeString(message.Data)
+	if err != nil {
+		return nil, fmt.Errorf("data is not base64: %w", err)
+	}
+
+	var command PubSubCommand
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&command); err != nil {
+		return nil, fmt.Errorf("data is not a valid command: %w", err)
+	}
+	if errs := command.validate(); len(errs) > 0 {
+		return nil, errs
+	}
+	return &command, nil
+}
+
+// What is done with a message once processed.
+type pubsubOutcome string
+
+const (
+	pubsubAck        pubsubOutcome = "ack"
+	pubsubNack       pubsubOutcome = "nack"
+	pubsubDeadLetter pubsubOutcome = "dead_letter"
+)
+
+// pubsubSubscriber pulls start and stop commands from a subscription. Each
+// message is acked once applied, nacked for redelivery when the SQL Admin
+// API failed transiently, and moved to the dead-letter topic when it can
+// never succeed.
+type pubsubSubscriber struct {
+	service         *pubsub.Service
+	subscription    string
+	deadLetterTopic string
+	maxMessages     int64
+	now             func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newPubSubSubscriber(ctx context.Context, cfg PubSubConfig, project string) (*pubsubSubscriber, error) {
+	service, err := pubsub.NewService(ctx, credentials.load().options()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Pub/Sub client: %w", err)
+	}
+	return &pubsubSubscriber{
+		service:         service,
+		subscription:    qualify(project, "subscriptions", cfg.Subscription),
+		deadLetterTopic: qualify(project, "topics", cfg.DeadLetterTopic),
+		maxMessages:     int64(cfg.MaxMessages),
+		now:             time.Now,
+		seen:            make(map[string]time.Time),
+	}, nil
+}
+
+// run pulls and processes messages until stop is closed. Messages being
+// processed when stop closes are finished, not abandoned.
+func (s *pubsubSubscriber) run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	slog.Info("Pulling start/stop commands from Pub/Sub", "subscription", s.subscription)
+	for ctx.Err() == nil {
+		resp, err := s.service.Projects.Subscriptions.Pull(s.subscription, &pubsub.PullRequest{MaxMessages: s.maxMessages}).Context(ctx).Do()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Failed to pull Pub/Sub messages", "subscription", s.subscription, "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(pubsubRetryDelay):
+			}
+			continue
+		}
+		s.handle(context.Background(), resp.ReceivedMessages)
+	}
+}
+
+// handle processes one pulled batch in order.
+func (s *pubsubSubscriber) handle(ctx context.Context, received []*pubsub.ReceivedMessage) {
+	if len(received) == 0 {
+		return
+	}
+
+	ackIDs := make([]string, 0, len(received))
+	for _, message := range received {
+		ackIDs = append(ackIDs, message.AckId)
+	}
+	if err := s.modifyAckDeadline(ctx, ackIDs, pubsubAckDeadline); err != nil {
+		slog.Warn("Failed to extend the Pub/Sub ack deadline", "subscription", s.subscription, "error", err)
+	}
+
+	for _, message := range received {
+		outcome, reason := s.process(ctx, message.Message)
+		s.settle(ctx, message, outcome, reason)
+	}
+}
+
+// process applies the command of a message and decides its outcome.
+// Duplicate deliveries of a message already acted on are acked untouched.
+func (s *pubsubSubscriber) process(ctx context.Context, message *pubsub.PubsubMessage) (pubsubOutcome, error) {
+	if s.processed(message.MessageId) {
+		slog.Info("Duplicate Pub/Sub message ignored", "message_id", message.MessageId, "subscription", s.subscription)
+		return pubsubAck, nil
+	}
+
+	command, err := parsePubSubCommand(message)
+	if err != nil {
+		s.remember(message.MessageId)
+		return pubsubDeadLetter, err
+	}
+
+	project, instance := command.Project, command.Instance
+	if project == "" {
+		project = projectID.load()
+	}
+	if instance == "" {
+		instance = instanceID.load()
+	}
+	action := command.action()
+
+	_, err = runTriggeredAction(ctx, triggeredAction{
+		Action:           action,
+		Project:          project,
+		Instance:         instance,
+		Source:           actionSourcePubSub,
+		TriggeredBy:      "pubsub message " + message.MessageId,
+		BackupBeforeStop: command.BackupBeforeStop,
+	})
+	if !dryRun.load() {
+		recordAction(action, actionSourcePubSub, err)
+	}
+	if err != nil && transientError(err) {
+		return pubsubNack, err
+	}
+
+	s.remember(message.MessageId)
+	if err != nil {
+		return pubsubDeadLetter, err
+	}
+	return pubsubAck, nil
+}
+
+// transientError reports whether retrying the message later may succeed.
+// Errors other than Google API ones, timeouts and network failures, are
+// considered transient.
+func transientError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	switch apiErr.Code {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	}
+	return apiErr.Code >= http.StatusInternalServerError
+}
+
+func (s *pubsubSubscriber) processed(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	at, ok := s.seen[id]
+	return ok && s.now().Sub(at) < pubsubDedupWindow
+}
+
+// remember records a message ID as processed and forgets the ones older
+// than pubsubDedupWindow.
+func (s *pubsubSubscriber) remember(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for seen, at := range s.seen {
+		if now.Sub(at) >= pubsubDedupWindow {
+			delete(s.seen, seen)
+		}
+	}
+	s.seen[id] = now
+}
+
+// settle acks, nacks or dead-letters a message. A message that can't be
+// dead-lettered is nacked so it isn't lost.
+func (s *pubsubSubscriber) settle(ctx context.Context, received *pubsub.ReceivedMessage, outcome pubsubOutcome, reason error) {
+	ctx, cancel := context.WithTimeout(ctx, pubsubSettleTimeout)
+	defer cancel()
+
+	attrs := []any{"message_id", received.Message.MessageId, "subscription", s.subscription, "outcome", string(outcome)}
+	if reason != nil {
+		attrs = append(attrs, "error", reason)
+	}
+
+	switch {
+	case outcome == pubsubDeadLetter && s.deadLetterTopic == "":
+		slog.Error("Pub/Sub message rejected, dropped as PUBSUB_DEAD_LETTER_TOPIC is not set", attrs...)
+	case outcome == pubsubDeadLetter:
+		if err := s.deadLetter(ctx, received.Message, reason); err != nil {
+			slog.Error("Failed to dead-letter Pub/Sub message, nacking it", append(attrs, "dead_letter_error", err)...)
+			outcome = pubsubNack
+			break
+		}
+		slog.Warn("Pub/Sub message dead-lettered", append(attrs, "topic", s.deadLetterTopic)...)
+	case outcome == pubsubNack:
+		slog.Warn("Pub/Sub message nacked for redelivery", attrs...)
+	default:
+		slog.Info("Pub/Sub message processed", attrs...)
+	}
+
+	var err error
+	if outcome == pubsubNack {
+		err = s.modifyAckDeadline(ctx, []string{received.AckId}, 0)
+	} else {
+		_, err = s.service.Projects.Subscriptions.Acknowledge(s.subscription, &pubsub.AcknowledgeRequest{AckIds: []string{received.AckId}}).Context(ctx).Do()
+	}
+	if err != nil {
+		slog.Error("Failed to settle Pub/Sub message", append(attrs, "settle_error", err)...)
+	}
+}
+
+// deadLetter republishes a message to the dead-letter topic with the
+// reason it was rejected.
+func (s *pubsubSubscriber) deadLetter(ctx context.Context, message *pubsub.PubsubMessage, reason error) error {
+	attributes := maps.Clone(message.Attributes)
+	if attributes == nil {
+		attributes = make(map[string]string)
+	}
+	attributes["error"] = reason.Error()
+	attributes["original_message_id"] = message.MessageId
+	attributes["subscription"] = s.subscription
+
+	_, err := s.service.Projects.Topics.Publish(s.deadLetterTopic, &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{Data: message.Data, Attributes: attributes}},
+	}).Context(ctx).Do()
+	return err
+}
+
+// modifyAckDeadline extends the deadline of messages, or nacks them when
+// seconds is 0.
+func (s *pubsubSubscriber) modifyAckDeadline(ctx context.Context, ackIDs []string, seconds int64) error {
+	_, err := s.service.Projects.Subscriptions.ModifyAckDeadline(s.subscription, &pubsub.ModifyAckDeadlineRequest{
+		AckIds:             ackIDs,
+		AckDeadlineSeconds: seconds,
+		ForceSendFields:    []string{"AckDeadlineSeconds"},
+	}).Context(ctx).Do()
+	return err
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultRateLimitBurst = 10
+
+// RateLimitConfig bounds how often each caller may call the mutating
+// endpoints. PerMinute is the sustained rate, 0 disables the limit, and
+// Burst how many calls may be made back to back.
+type RateLimitConfig struct {
+	PerMinute float64
+	Burst     int
+}
+
+// rateLimitBucket holds the tokens of one caller as of updated.
+type rateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter is a token bucket per caller: the authenticated principal,
+// or the client address when the API is open.
+type rateLimiter struct {
+	mu      sync.Mutex
+	config  RateLimitConfig
+	buckets map[string]*rateLimitBucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+var rateLimits = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*rateLimitBucket), now: time.Now}
+}
+
+// configure changes the limits. Callers keep the tokens they have, up to
+// the new burst.
+func (l *rateLimiter) configure(config RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.config = config
+}
+
+// allow takes a token from the caller's bucket. When it is empty, it
+// returns how long until the next token.
+func (l *rateLimiter) allow(caller string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.config.PerMinute <= 0 {
+		return true, 0
+	}
+	now := l.now()
+	perSecond := l.config.PerMinute / 60
+	burst := float64(max(l.config.Burst, 1))
+
+	bucket, ok := l.buckets[caller]
+	if !ok {
+		bucket = &rateLimitBucket{tokens: burst, updated: now}
+		l.buckets[caller] = bucket
+	}
+	bucket.tokens = min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*perSecond)
+	bucket.updated = now
+	l.sweep(now, burst/perSecond)
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep forgets, at most once a minute, the callers whose bucket has
+// refilled, which is the same as never having seen them.
+func (l *rateLimiter) sweep(now time.Time, refill float64) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for caller, bucket := range l.buckets {
+		if now.Sub(bucket.updated).Seconds() >= refill {
+			delete(l.buckets, caller)
+		}
+	}
+}
+
+// rateLimitCaller identifies the caller of r for rate limiting.
+func rateLimitCaller(r *http.Request) string {
+	if principal := requestPrincipal(r); principal != "" {
+		return principal
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+// withRateLimit answers 429 with Retry-After once the caller used up its
+// tokens, so a runaway script can't exhaust the SQL Admin quota of the
+// project. Reads are not limited.
+func withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		caller := rateLimitCaller(r)
+		if ok, wait := rateLimits.allow(caller); !ok {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			slog.WarnContext(r.Context(), "Request rate limited", "caller", caller, "retry_after", retryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeErrorResponse(w, r, http.StatusTooManyRequests, msgRateLimited, errRateLimited, retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// qpsLimiter spaces out calls to at most qps per second, shared by every
+// caller. 0 disables it.
+type qpsLimiter struct {
+	mu   sync.Mutex
+	qps  float64
+	next time.Time
+}
+
+// sqlAdminLimiter paces the calls of the SQL Admin clients, set from
+// SQLADMIN_QPS.
+var sqlAdminLimiter = &qpsLimiter{}
+
+func (l *qpsLimiter) configure(qps float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.qps = qps
+	l.next = time.Time{}
+}
+
+// wait blocks until the next call slot or until ctx is done.
+func (l *qpsLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	if l.qps <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	slot := l.next
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next = slot.Add(time.Duration(float64(time.Second) / l.qps))
+	l.mu.Unlock()
+
+	delay := slot.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// qpsTransport waits for a slot of limiter before each call, retries
+// included.
+type qpsTransport struct {
+	base    http.RoundTripper
+	limiter *qpsLimiter
+}
+
+func (t *qpsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
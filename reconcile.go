@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// defaultReconcileInterval is the default of RECONCILE_INTERVAL.
+const defaultReconcileInterval = 5 * time.Minute
+
+// RunningWindow is a time an instance should run: from each time the Start
+// cron expression fires until Stop fires next.
+type RunningWindow struct {
+	Start string `yaml:"start"`
+	Stop  string `yaml:"stop"`
+}
+
+// DesiredState declares when an instance should be running, stopped
+// outside its windows. Project defaults to PROJECT_ID and the windows are
+// in Timezone, UTC when unset.
+type DesiredState struct {
+	Project  string          `yaml:"project"`
+	Instance string          `yaml:"instance"`
+	Timezone string          `yaml:"timezone"`
+	Windows  []RunningWindow `yaml:"windows"`
+}
+
+// schedules are the starts and stops of the windows, so the desired state
+// follows holidays exactly like schedules of the built-in scheduler.
+func (d DesiredState) schedules() []Schedule {
+	var items []Schedule
+	for i, window := range d.Windows {
+		for _, item := range []struct{ action, cron string }{{scheduleActionStart, window.Start}, {scheduleActionStop, window.Stop}} {
+			items = append(items, Schedule{
+				ID:       fmt.Sprintf("reconcile/%s/%s/%d/%s", d.Project, d.Instance, i, item.action),
+				Project:  d.Project,
+				Instance: d.Instance,
+				Action:   item.action,
+				Cron:     item.cron,
+				Timezone: d.Timezone,
+			})
+		}
+	}
+	return items
+}
+
+// desired returns the action of the last window transition at or before
+// now and when it happened. The action is empty when no window started or
+// stopped in the past year.
+func (d DesiredState) desired(now time.Time) (string, time.Time, error) {
+	var (
+		action     string
+		transition time.Time
+	)
+	for _, item := range d.schedules() {
+		last, err := item.previous(now)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if last.After(transition) {
+			action, transition = item.Action, last
+		}
+	}
+	return action, transition, nil
+}
+
+// ReconcileConfig keeps the declared instances in their desired state,
+// checking them every Interval.
+type ReconcileConfig struct {
+	Interval  time.Duration
+	Instances []DesiredState
+}
+
+func (c ReconcileConfig) validate() error {
+	var errs []error
+	if c.Interval < time.Minute {
+		errs = append(errs, fmt.Errorf("RECONCILE_INTERVAL: %s must be at least 1m", c.Interval))
+	}
+	seen := make(map[string]int)
+	for i, desired := range c.Instances {
+		prefix := fmt.Sprintf("reconcile.instances[%d]", i)
+		key := desired.Project + "/" + desired.Instance
+		switch first, ok := seen[key]; {
+		case desired.Instance == "":
+			errs = append(errs, fmt.Errorf("%s.instance: is required", prefix))
+		case ok:
+			errs = append(errs, fmt.Errorf("%s.instance: %s is already declared by reconcile.instances[%d]", prefix, key, first))
+		default:
+			seen[key] = i
+		}
+		if desired.Timezone != "" {
+			if _, err := time.LoadLocation(desired.Timezone); err != nil {
+				errs = append(errs, fmt.Errorf("%s.timezone: %q is not a valid IANA timezone", prefix, desired.Timezone))
+			}
+		}
+		if len(desired.Windows) == 0 {
+			errs = append(errs, fmt.Errorf("%s.windows: at least one window is required", prefix))
+		}
+		for j, window := range desired.Windows {
+			for _, item := range []struct{ field, cron string }{{"start", window.Start}, {"stop", window.Stop}} {
+				if _, err := cron.ParseStandard(item.cron); err != nil {
+					errs = append(errs, fmt.Errorf("%s.windows[%d].%s: %q is not a valid cron expression", prefix, j, item.field, item.cron))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reconciler starts and stops the declared instances that drifted from
+// their desired state, e.g. a dev instance someone started by hand at
+// midnight. Overrides skipping the correcting action keep an instance as
+// it is.
+type reconciler struct {
+	mu     sync.Mutex
+	config ReconcileConfig
+	now    func() time.Time
+}
+
+var reconciles = &reconciler{now: time.Now, config: ReconcileConfig{Interval: defaultReconcileInterval}}
+
+// configure replaces the settings, the config is validated.
+func (s *reconciler) configure(config ReconcileConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+}
+
+// run checks the declared instances every interval until stop is closed.
+func (s *reconciler) run(stop <-chan struct{}) {
+	for {
+		s.mu.Lock()
+		interval := s.config.Interval
+		s.mu.Unlock()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.check(context.Background())
+		}
+	}
+}
+
+// check brings every declared instance in line with its desired state.
+func (s *reconciler) check(ctx context.Context) {
+	s.mu.Lock()
+	instances := s.config.Instances
+	s.mu.Unlock()
+
+	for _, desired := range instances {
+		if err := s.reconcile(ctx, desired); err != nil {
+			slog.Error("Failed to reconcile the instance", "project", desired.Project, "instance", desired.Instance, "error", err)
+		}
+	}
+}
+
+// reconcile starts or stops the instance when it isn't in its desired
+// state, with the reconciler feature flag. Instances in another state than
+// RUNNABLE or STOPPED, or with an operation in progress, are left to settle
+// first.
+func (s *reconciler) reconcile(ctx context.Context, desired DesiredState) error {
+	now := s.now()
+	if !features.enabled(flagReconciler) || automationHeld(now) {
+		return nil
+	}
+	action, since, err := desired.desired(now)
+	if err != nil || action == "" {
+		return err
+	}
+	if override := overrides.skipping(desired.Project, desired.Instance, action, now); override != nil {
+		return nil
+	}
+
+	sqlService, err := sqlAdminService(desired.Project)
+	if err != nil {
+		return err
+	}
+	instance, err := getInstance(ctx, sqlService, desired.Project, desired.Instance)
+	if err != nil {
+		return err
+	}
+	switch {
+	case action == scheduleActionStart && instance.State == "RUNNABLE", action == scheduleActionStop && instance.State == "STOPPED":
+		return nil
+	case instance.State != "RUNNABLE" && instance.State != "STOPPED":
+		return nil
+	}
+	running, err := runningOperation(ctx, sqlService, desired.Project, desired.Instance)
+	if err != nil || running != nil {
+		return err
+	}
+
+	wanted := "running"
+	if action == scheduleActionStop {
+		wanted = "stopped"
+	}
+	slog.Info("Instance drifted from its desired state", "project", desired.Project, "instance", desired.Instance, "state", instance.State, "desired", wanted, "since", since)
+	_, err = runTriggeredAction(ctx, triggeredAction{
+		Action:      action,
+		Project:     desired.Project,
+		Instance:    desired.Instance,
+		Source:      actionSourceReconcile,
+		TriggeredBy: fmt.Sprintf("desired state %s since %s, found %s", wanted, since.UTC().Format(time.RFC3339), instance.State),
+	})
+	if !dryRun.load() {
+		recordAction(action, actionSourceReconcile, err)
+	}
+	return err
+}
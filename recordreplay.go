@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// recordedExchange is one SQL Admin request/response pair as stored on disk.
+type recordedExchange struct {
+	Method       string          `json:"method"`
+	URL          string          `json:"url"`
+	RequestBody  json.RawMessage `json:"request_body,omitempty"`
+	StatusCode   int             `json:"status_code"`
+	ContentType  string          `json:"content_type,omitempty"`
+	ResponseBody json.RawMessage `json:"response_body,omitempty"`
+}
+
+// sensitiveQueryParams are dropped from recorded URLs.
+var sensitiveQueryParams = []string{"access_token", "key"}
+
+// sensitiveFieldPattern matches JSON fields whose values are redacted from
+// recorded bodies.
+var sensitiveFieldPattern = regexp.MustCompile(`("(?:password|rootPassword|privateKey|clientKey|secret)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// recordingTransport writes every exchange passing through it to dir, one
+// numbered JSON file each, with credentials stripped. It sits below the auth
+// transport, so Authorization headers are never persisted.
+type recordingTransport struct {
+	base http.RoundTripper
+	dir  string
+
+	mu  sync.Mutex
+	seq int
+}
+
+func newRecordingTransport(base http.RoundTripper, dir string) (*recordingTransport, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create record directory: %w", err)
+	}
+	return &recordingTransport{base: base, dir: dir}, nil
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	exchange := recordedExchange{Method: req.Method, URL: sanitizeURL(req)}
+
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		exchange.RequestBody = sanitizeBody(body)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	exchange.StatusCode = resp.StatusCode
+	exchange.ContentType = resp.Header.Get("Content-Type")
+	exchange.ResponseBody = sanitizeBody(body)
+
+	t.mu.Lock()
+	t.seq++
+	seq := t.seq
+	t.mu.Unlock()
+
+	name := fmt.Sprintf("%05d-%s-%s.json", seq, strings.ToLower(req.Method), unsafeFileChars.ReplaceAllString(strings.TrimPrefix(req.URL.Path, "/v1/projects/"), "_"))
+	raw, _ := json.MarshalIndent(exchange, "", "  ")
+	if err := os.WriteFile(filepath.Join(t.dir, name), raw, 0o600); err != nil {
+		// Recording is a debugging aid and must not fail the request.
+		slog.Error("Failed to record SQL Admin exchange", "error", err)
+	}
+
+	return resp, nil
+}
+
+func sanitizeURL(req *http.Request) string {
+	query := req.URL.Query()
+	for _, param := range sensitiveQueryParams {
+		query.Del(param)
+	}
+
+	u := req.URL.Path
+	if encoded := query.Encode(); encoded != "" {
+		u += "?" + encoded
+	}
+	return u
+}
+
+func sanitizeBody(body []byte) json.RawMessage {
+	if len(body) == 0 || !json.Valid(body) {
+		return nil
+	}
+	return sensitiveFieldPattern.ReplaceAll(body, []byte(`${1}"REDACTED"`))
+}
+
+// replayTransport answers SQL Admin requests from a directory written by
+// recordingTransport. Recordings for the same method and URL are served in
+// order, the last one repeating once exhausted so polling loops terminate.
+type replayTransport struct {
+	mu        sync.Mutex
+	exchanges map[string][]recordedExchange
+}
+
+func newReplayTransport(dir string) (*replayTransport, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recordings found in %s", dir)
+	}
+	sort.Strings(files)
+
+	t := &replayTransport{exchanges: make(map[string][]recordedExchange)}
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var exchange recordedExchange
+		if err := json.Unmarshal(raw, &exchange); err != nil {
+			return nil, fmt.Errorf("invalid recording %s: %w", file, err)
+		}
+
+		key := exchange.Method + " " + exchange.URL
+		t.exchanges[key] = append(t.exchanges[key], exchange)
+	}
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	key := req.Method + " " + sanitizeURL(req)
+
+	t.mu.Lock()
+	queue := t.exchanges[key]
+	var exchange recordedExchange
+	found := len(queue) > 0
+	if found {
+		exchange = queue[0]
+		if len(queue) > 1 {
+			t.exchanges[key] = queue[1:]
+		}
+	}
+	t.mu.Unlock()
+
+	if !found {
+		exchange = recordedExchange{
+			StatusCode:   http.StatusNotImplemented,
+			ContentType:  contentTypeJSON,
+			ResponseBody: json.RawMessage(fmt.Sprintf(`{"error":{"code":501,"message":%q}}`, "no recording for "+key)),
+		}
+	}
+
+	header := make(http.Header)
+	if exchange.ContentType != "" {
+		header.Set("Content-Type", exchange.ContentType)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", exchange.StatusCode, http.StatusText(exchange.StatusCode)),
+		StatusCode:    exchange.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(exchange.ResponseBody)),
+		ContentLength: int64(len(exchange.ResponseBody)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strconv"
+
+	redis "google.golang.org/api/redis/v1"
+)
+
+const (
+	// redisMemoryLabel keeps the memory size of a scaled down Redis
+	// instance, in GiB, so start can restore it.
+	redisMemoryLabel = "scheduler-db-memory-size-gb"
+
+	// redisMinMemorySizeGb is the smallest size Memorystore accepts.
+	redisMinMemorySizeGb = 1
+)
+
+// redisProvider manages Memorystore for Redis instances. They can't be
+// stopped, so stop scales the instance down to redisMinMemorySizeGb,
+// remembering its size in the redisMemoryLabel label, and start scales it
+// back. A scaled down instance is reported STOPPED. Scaling a Basic tier
+// instance flushes its data, and Memorystore refuses to scale down an
+// instance whose data doesn't fit.
+type redisProvider struct{}
+
+func (redisProvider) list(ctx context.Context, project string) ([]DataStore, error) {
+	service, err := redisService(project)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	var stores []DataStore
+	err = service.Projects.Locations.Instances.List("projects/"+project+"/locations/-").Pages(ctx, func(page *redis.ListInstancesResponse) error {
+		for _, instance := range page.Instances {
+			stores = append(stores, newRedisStore(project, instance))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stores, nil
+}
+
+func (redisProvider) get(ctx context.Context, project string, location string, name string) (DataStore, error) {
+	instance, err := getRedisInstance(ctx, project, location, name)
+	if err != nil {
+		return DataStore{}, err
+	}
+	return newRedisStore(project, instance), nil
+}
+
+func (redisProvider) start(ctx context.Context, store DataStore) (string, error) {
+	instance, err := getRedisInstance(ctx, store.Project, store.Location, store.Name)
+	if err != nil {
+		return "", err
+	}
+	size, err := strconv.ParseInt(instance.Labels[redisMemoryLabel], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("instance %s has no valid %s label to restore its size from", store.Name, redisMemoryLabel)
+	}
+
+	labels := maps.Clone(instance.Labels)
+	delete(labels, redisMemoryLabel)
+	return patchRedisInstance(ctx, store.Project, instance.Name, &redis.Instance{
+		MemorySizeGb: size,
+		Labels:       labels,
+		// Restoring an instance without other labels sends an empty map.
+		ForceSendFields: []string{"Labels"},
+	})
+}
+
+func (redisProvider) stop(ctx context.Context, store DataStore) (string, error) {
+	instance, err := getRedisInstance(ctx, store.Project, store.Location, store.Name)
+	if err != nil {
+		return "", err
+	}
+	if instance.MemorySizeGb <= redisMinMemorySizeGb {
+		return "", fmt.Errorf("instance %s already has the minimum size of %d GiB", store.Name, redisMinMemorySizeGb)
+	}
+
+	labels := maps.Clone(instance.Labels)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[redisMemoryLabel] = strconv.FormatInt(instance.MemorySizeGb, 10)
+	return patchRedisInstance(ctx, store.Project, instance.Name, &redis.Instance{MemorySizeGb: redisMinMemorySizeGb, Labels: labels})
+}
+
+func getRedisInstance(ctx context.Context, project string, location string, name string) (*redis.Instance, error) {
+	service, err := redisService(project)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	return service.Projects.Locations.Instances.Get(fmt.Sprintf("projects/%s/locations/%s/instances/%s", project, location, name)).Context(ctx).Do()
+}
+
+func patchRedisInstance(ctx context.Context, project string, name string, patch *redis.Instance) (string, error) {
+	service, err := redisService(project)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	operation, err := service.Projects.Locations.Instances.Patch(name, patch).UpdateMask("memorySizeGb,labels").Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return operation.Name, nil
+}
+
+func newRedisStore(project string, instance *redis.Instance) DataStore {
+	location, name := resourceLocation(instance.Name)
+	store := DataStore{Kind: storeKindRedis, Project: project, Location: location, Name: name, State: instance.State, Labels: instance.Labels}
+	if instance.State == "READY" {
+		store.State = storeStateRunning
+		if size, ok := instance.Labels[redisMemoryLabel]; ok {
+			store.State = storeStateStopped
+			store.Detail = "scaled down to " + strconv.FormatInt(instance.MemorySizeGb, 10) + " GiB, start restores " + size + " GiB"
+		}
+	}
+	return store
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/joho/godotenv"
+)
+
+// activeConfig is the configuration currently applied, kept so
+// POST /admin/reload can report what changed.
+var activeConfig reloadable[*Config]
+
+// reloadable holds a setting a reload replaces while handlers and background
+// jobs read it.
+type reloadable[T any] struct {
+	value atomic.Pointer[T]
+}
+
+func newReloadable[T any](value T) *reloadable[T] {
+	r := &reloadable[T]{}
+	r.store(value)
+	return r
+}
+
+// load returns the running value, the zero value before the first store.
+func (r *reloadable[T]) load() T {
+	if value := r.value.Load(); value != nil {
+		return *value
+	}
+	var zero T
+	return zero
+}
+
+func (r *reloadable[T]) store(value T) {
+	r.value.Store(&value)
+}
+
+// reloadMu serializes the reloads of POST /admin/reload and of the secrets
+// refresh.
+var reloadMu sync.Mutex
+
+// restartOnlySettings are Config fields baked into the listeners, the
+// simulator or the schedule store at startup. A reload reports changes to
+// them but keeps the running values.
+var restartOnlySettings = map[string]bool{
+	"Port":                  true,
+	"AdminPort":             true,
+	"HandlerTimeout":        true,
+	"ReadHeaderTimeout":     true,
+	"IdleTimeout":           true,
+	"MaxHeaderBytes":        true,
+	"KeepAlives":            true,
+	"H2C":                   true,
+	"TLS":                   true,
+	"Simulate":              true,
+	"SimulateLatencyScale":  true,
+	"SchedulesFile":         true,
+	"TrashRetention":        true,
+	"OverridesFile":         true,
+	"DelayedActionsFile":    true,
+	"Audit":                 true,
+	"State":                 true,
+	"Leader":                true,
+	"Tracing":               true,
+	"SchedulerStateFile":    true,
+	"SchedulerCatchUp":      true,
+	"PubSub":                true,
+	"Operator":              true,
+	"WakeProxy":             true,
+	"ShutdownTimeout":       true,
+	"LogFormat":             true,
+	"PendingOperationsFile": true,
+	"Scheduler":             true,
+	"DeclaredSchedules":     true,
+}
+
+// ReloadResult is the payload of POST /admin/reload.
+type ReloadResult struct {
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restart_required"`
+	ClientsRebuilt  bool     `json:"clients_rebuilt"`
+}
+
+// reloadHandler re-reads the environment (and .env when ENV=local), the
+// secrets it references and the credentials file, rebuilds the SQL Admin
+// client and applies the new configuration without restarting the process.
+// A configuration that fails validation or the startup checks is rejected
+// and the running one kept.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	if os.Getenv("ENV") == "local" {
+		if err := godotenv.Overload(".env"); err != nil {
+			writeErrorResponse(w, r, http.StatusInternalServerError, msgReloadFailed, err)
+			return
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgReloadInvalidConfig, err.Error())
+		return
+	}
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	result, err := reloadConfig(r.Context(), cfg)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgReloadFailed, err)
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgReloaded, result)
+}
+
+// reloadConfig applies cfg in place of the running configuration. Changes
+// to restartOnlySettings are reported and the running values kept. A
+// configuration failing the startup checks is rejected and the running one
+// kept.
+func reloadConfig(ctx context.Context, cfg *Config) (ReloadResult, error) {
+	previous := activeConfig.load()
+	// --simulate is a command line flag, not part of the environment.
+	cfg.Simulate = cfg.Simulate || previous.Simulate
+
+	result := ReloadResult{Changed: []string{}, RestartRequired: []string{}}
+	old := reflect.ValueOf(previous).Elem()
+	next := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < next.NumField(); i++ {
+		name := next.Type().Field(i).Name
+		if reflect.DeepEqual(old.Field(i).Interface(), next.Field(i).Interface()) {
+			continue
+		}
+		if restartOnlySettings[name] {
+			result.RestartRequired = append(result.RestartRequired, name)
+			next.Field(i).Set(old.Field(i))
+			continue
+		}
+		result.Changed = append(result.Changed, name)
+	}
+
+	if err := configureSQLAdmin(cfg); err != nil {
+		configureSQLAdmin(previous)
+		return result, err
+	}
+	if cfg.StartupChecks {
+		ctx, cancel := context.WithTimeout(ctx, startupCheckTimeout)
+		err := cfg.verify(ctx)
+		cancel()
+		if err != nil {
+			configureSQLAdmin(previous)
+			return result, err
+		}
+	}
+
+	cfg.apply()
+	result.ClientsRebuilt = true
+	return result, nil
+}
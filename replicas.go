@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// includeReplicasDefault is used when a request has no include_replicas
+// parameter. Set from INCLUDE_REPLICAS.
+var includeReplicasDefault reloadable[bool]
+
+// includeReplicas reports whether a start or stop also applies to the read
+// replicas of the instance.
+func includeReplicas(r *http.Request) bool {
+	switch r.URL.Query().Get("include_replicas") {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return includeReplicasDefault.load()
+}
+
+// targetReplicas returns the read replicas of an instance, sorted by name,
+// or nothing when the request excludes them.
+func targetReplicas(r *http.Request, sqlService *sqladmin.Service, project string, instance string) ([]*sqladmin.DatabaseInstance, error) {
+	if !includeReplicas(r) {
+		return nil, nil
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	primary, err := sqlService.Instances.Get(project, instance).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	names := append([]string(nil), primary.ReplicaNames...)
+	sort.Strings(names)
+
+	replicas := make([]*sqladmin.DatabaseInstance, 0, len(names))
+	for _, name := range names {
+		replica, err := sqlService.Instances.Get(project, name).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get replica %s: %w", name, err)
+		}
+		replicas = append(replicas, replica)
+	}
+	return replicas, nil
+}
+
+// dryRunReplicas reports what a start or stop would do to each replica.
+func dryRunReplicas(r *http.Request, sqlService *sqladmin.Service, action string, replicas []*sqladmin.DatabaseInstance) []BulkResult {
+	var results []BulkResult
+	for _, replica := range replicas {
+		results = append(results, applyActivation(r.Context(), sqlService, action, actionSourceAPI, replica, true, isForced(r), requestPrincipal(r)))
+	}
+	return results
+}
+
+// stopReplicas stops the replicas and waits for them to be stopped, so the
+// primary is never stopped under running replicas. It gives up at the first
+// replica that fails.
+func stopReplicas(r *http.Request, sqlService *sqladmin.Service, replicas []*sqladmin.DatabaseInstance, timeout time.Duration) ([]BulkResult, error) {
+	var results []BulkResult
+	for _, replica := range replicas {
+		result := applyActivation(r.Context(), sqlService, scheduleActionStop, actionSourceAPI, replica, false, isForced(r), requestPrincipal(r))
+		results = append(results, result)
+
+		switch result.Outcome {
+		case bulkOutcomeFailed:
+			return results, fmt.Errorf("failed to stop replica %s: %s", replica.Name, result.Reason)
+		case bulkOutcomeChanged:
+			if _, err := awaitOrdered(r.Context(), replica.Project, result.Operation, timeout); err != nil {
+				return results, fmt.Errorf("replica %s did not stop: %w", replica.Name, err)
+			}
+		}
+	}
+	return results, nil
+}
+
+// startReplicas starts the replicas once the primary is running. A replica
+// failing to start doesn't affect the others.
+func startReplicas(r *http.Request, sqlService *sqladmin.Service, replicas []*sqladmin.DatabaseInstance) []BulkResult {
+	var results []BulkResult
+	for _, replica := range replicas {
+		results = append(results, applyActivation(r.Context(), sqlService, scheduleActionStart, actionSourceAPI, replica, false, false, requestPrincipal(r)))
+	}
+	return results
+}
+
+// awaitOrdered waits for an operation the next step of an ordered start or
+// stop depends on, up to maxWaitTimeout when the request set no timeout.
+func awaitOrdered(ctx context.Context, project string, operation *sqladmin.Operation, timeout time.Duration) (*sqladmin.Operation, error) {
+	if timeout == 0 {
+		timeout = maxWaitTimeout
+	}
+
+	operation, err := waitForOperation(ctx, project, operation, timeout)
+	if operation.Status == "DONE" {
+		operations.finished(operation, err)
+	}
+	return operation, err
+}
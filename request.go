@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// defaultMaxBodyBytes is used when MAX_BODY_BYTES is not set.
+const defaultMaxBodyBytes = 1 << 20
+
+// ActivationPolicyRequest is the optional body accepted by /start and
+// /stop. The endpoint decides the policy, ActivationPolicy may be left out
+// and is only checked against it.
+type ActivationPolicyRequest struct {
+	ActivationPolicy string `json:"ActivationPolicy"`
+	BackupBeforeStop bool   `json:"backup_before_stop"`
+	// ExportBeforeStop exports the instance to Cloud Storage first.
+	ExportBeforeStop *ExportRequest `json:"export_before_stop"`
+}
+
+// validate checks the request against action, start or stop, and sets
+// ActivationPolicy to the policy of the action.
+func (req *ActivationPolicyRequest) validate(action string) validationErrors {
+	var errs validationErrors
+	policy := scheduleActivationPolicies[action]
+	switch given := strings.ToUpper(strings.TrimSpace(req.ActivationPolicy)); given {
+	case "", policy:
+		req.ActivationPolicy = policy
+	case "ALWAYS", "NEVER":
+		errs = append(errs, fieldError{Field: "ActivationPolicy", Message: fmt.Sprintf("is %s but /%s sets %s, leave it out", given, action, policy), code: msgInvalidActivationPolicy})
+	default:
+		errs = append(errs, fieldError{Field: "ActivationPolicy", Message: "must be 'ALWAYS' or 'NEVER', or left out", code: msgInvalidActivationPolicy})
+	}
+	if req.BackupBeforeStop && action != scheduleActionStop {
+		errs = append(errs, fieldError{Field: "backup_before_stop", Message: "only applies to stops"})
+	}
+	if req.ExportBeforeStop != nil {
+		if action != scheduleActionStop {
+			errs = append(errs, fieldError{Field: "export_before_stop", Message: "only applies to stops"})
+		}
+		for _, err := range req.ExportBeforeStop.validate() {
+			errs = append(errs, fieldError{Field: "export_before_stop." + err.Field, Message: err.Message})
+		}
+	}
+	return errs
+}
+
+// fieldError describes why a single request field was rejected. code is the
+// message code clients matched on before field-level errors, if any.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	code    messageKey
+}
+
+// validationErrors is returned to clients as the "errors" array of the error
+// envelope.
+type validationErrors []fieldError
+
+func (v validationErrors) Error() string {
+	messages := make([]string, 0, len(v))
+	for _, e := range v {
+		if e.Field == "" {
+			messages = append(messages, e.Message)
+		} else {
+			messages = append(messages, e.Field+" "+e.Message)
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// messageKey is the code shared by every error, falling back to
+// msgValidationFailed when they have none or disagree.
+func (v validationErrors) messageKey() messageKey {
+	if len(v) == 0 || v[0].code == "" {
+		return msgValidationFailed
+	}
+	for _, e := range v[1:] {
+		if e.code != v[0].code {
+			return msgValidationFailed
+		}
+	}
+	return v[0].code
+}
+
+// decodeJSONBody strictly decodes a single JSON object into dst, rejecting
+// unknown fields, trailing data and bodies larger than maxBodyBytes. Decoding
+// problems are reported as validationErrors, an oversized body as
+// *http.MaxBytesError.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes.load())
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(dst); err != nil {
+		return describeDecodeError(err)
+	}
+	if err := decoder.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return err
+		}
+		return validationErrors{{Message: "body must contain a single JSON object", code: msgInvalidJSON}}
+	}
+	return nil
+}
+
+func describeDecodeError(err error) error {
+	var (
+		syntaxErr   *json.SyntaxError
+		typeErr     *json.UnmarshalTypeError
+		maxBytesErr *http.MaxBytesError
+	)
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return err
+	case errors.Is(err, io.EOF):
+		return validationErrors{{Message: "body must not be empty", code: msgInvalidJSON}}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return validationErrors{{Message: "body contains malformed JSON", code: msgInvalidJSON}}
+	case errors.As(err, &syntaxErr):
+		return validationErrors{{Message: fmt.Sprintf("body contains malformed JSON at offset %d", syntaxErr.Offset), code: msgInvalidJSON}}
+	case errors.As(err, &typeErr):
+		code := msgInvalidJSON
+		if typeErr.Field == "ActivationPolicy" {
+			code = msgInvalidActivationPolicy
+		}
+		return validationErrors{{Field: typeErr.Field, Message: "must be of type " + typeErr.Type.String(), code: code}}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return validationErrors{{Field: field, Message: "is not a known field"}}
+	default:
+		return validationErrors{{Message: err.Error(), code: msgReadBodyFailed}}
+	}
+}
+
+// writeDecodeError answers a failed decodeJSONBody or validate call.
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeErrorResponse(w, r, http.StatusRequestEntityTooLarge, msgBodyTooLarge, err, maxBytesErr.Limit)
+		return
+	}
+	message := msgValidationFailed
+	var errs validationErrors
+	if errors.As(err, &errs) {
+		message = errs.messageKey()
+	}
+	writeErrorResponse(w, r, http.StatusBadRequest, message, err)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// actionRestart names restarts in notifications and the audit log.
+const actionRestart = "restart"
+
+// restartHandler restarts a running instance. It refuses while another
+// operation, such as a backup or maintenance, is in progress on the
+// instance instead of queueing behind it.
+func restartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	project, instance := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	status, err := checkStatusInstances(r.Context(), project, instance)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	if status.State != "RUNNABLE" {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInstanceNotRunnable, "", status.State)
+		return
+	}
+
+	running, err := runningOperation(r.Context(), sqlService, project, instance)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgRestartFailed, err)
+		return
+	}
+	if running != nil {
+		writeErrorResponse(w, r, http.StatusConflict, msgRestartBlocked, "operation "+running.Name+" is "+running.Status, running.OperationType)
+		return
+	}
+
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunCall(http.MethodPost, sqlAdminInstancePath(project, instance)+"/restart", nil))
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	operation, err := sqlService.Instances.Restart(project, instance).Context(ctx).Do()
+	event := newNotificationEvent(actionRestart, actionSourceAPI, requestPrincipal(r), project, instance)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgRestartFailed, err)
+		return
+	}
+
+	operations.track(event, operation)
+	writeOperationResponse(w, r, project, instance, operation, wait, timeout, operationSteps{WarmUp: true}, msgRestartStarted, msgRestartFailed)
+}
+
+// runningOperation returns an unfinished operation on the instance, nil when
+// there is none. Operations are listed newest first, so only the first page
+// is looked at.
+func runningOperation(ctx context.Context, sqlService *sqladmin.Service, project string, instance string) (*sqladmin.Operation, error) {
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	list, err := sqlService.Operations.List(project).Instance(instance).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	for _, operation := range list.Items {
+		if operation.Status == "PENDING" || operation.Status == "RUNNING" {
+			return operation, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+const (
+	// actionRestore names restores in access roles, notifications and the
+	// audit log.
+	actionRestore = "restore"
+
+	// confirmationTTL is how long a confirmation token is accepted.
+	confirmationTTL = 5 * time.Minute
+
+	defaultBackupsLimit = 20
+	maxBackupsLimit     = 100
+)
+
+var errConfirmationInvalid = errors.New("confirmation token is invalid, expired or for another action")
+
+// confirmationKey signs the confirmation tokens of restores and promotions.
+// It is drawn at startup, so a token is only accepted by the replica that
+// issued it.
+var confirmationKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// signConfirmation returns a token confirming the action described by
+// fields until expires.
+func signConfirmation(expires time.Time, fields ...string) string {
+	mac := hmac.New(sha256.New, confirmationKey)
+	for _, field := range fields {
+		fmt.Fprintf(mac, "%s\n", field)
+	}
+	fmt.Fprintf(mac, "%d", expires.Unix())
+	return strconv.FormatInt(expires.Unix(), 10) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkConfirmation verifies that token was issued for the action described
+// by fields and hasn't expired.
+func checkConfirmation(token string, now time.Time, fields ...string) error {
+	raw, _, _ := strings.Cut(token, ".")
+	unix, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return errConfirmationInvalid
+	}
+	expires := time.Unix(unix, 0)
+	want := signConfirmation(expires, fields...)
+	if !hmac.Equal([]byte(want), []byte(token)) || now.After(expires) {
+		return errConfirmationInvalid
+	}
+	return nil
+}
+
+// BackupRunData is one backup run of an instance.
+type BackupRunData struct {
+	ID          int64       `json:"id"`
+	Status      string      `json:"status"`
+	Type        string      `json:"type"`
+	Description string      `json:"description,omitempty"`
+	Location    string      `json:"location,omitempty"`
+	StartTime   interface{} `json:"start_time,omitempty"`
+	EndTime     interface{} `json:"end_time,omitempty"`
+}
+
+func newBackupRunData(run *sqladmin.BackupRun) BackupRunData {
+	data := BackupRunData{ID: run.Id, Status: run.Status, Type: run.Type, Description: run.Description, Location: run.Location}
+	if t, err := time.Parse(time.RFC3339Nano, run.StartTime); err == nil {
+		data.StartTime = formatTimestamp(t)
+	}
+	if t, err := time.Parse(time.RFC3339Nano, run.EndTime); err == nil {
+		data.EndTime = formatTimestamp(t)
+	}
+	return data
+}
+
+// BackupsData is the answer of GET /v1/instances/{instance}/backups.
+type BackupsData struct {
+	Backups []BackupRunData `json:"backups"`
+}
+
+// RestoreRequest is the body of POST /v1/instances/{instance}/restore.
+// SourceInstance and SourceProject name the instance the backup belongs to
+// when it isn't the restored one. ConfirmationToken is left out on the
+// first call and set to the token it returned on the second.
+type RestoreRequest struct {
+	BackupID          int64  `json:"backup_id"`
+	SourceInstance    string `json:"source_instance"`
+	SourceProject     string `json:"source_project"`
+	ConfirmationToken string `json:"confirmation_token"`
+}
+
+func (req *RestoreRequest) validate() validationErrors {
+	var errs validationErrors
+	if req.BackupID <= 0 {
+		errs = append(errs, fieldError{Field: "backup_id", Message: "is required"})
+	}
+	if req.SourceProject != "" && req.SourceInstance == "" {
+		errs = append(errs, fieldError{Field: "source_instance", Message: "is required with source_project"})
+	}
+	return errs
+}
+
+// RestoreConfirmation is the answer of a restore without a confirmation
+// token: what would be overwritten, and the token confirming it.
+type RestoreConfirmation struct {
+	Project           string        `json:"project"`
+	Instance          string        `json:"instance"`
+	Backup            BackupRunData `json:"backup"`
+	ConfirmationToken string        `json:"confirmation_token"`
+	ExpiresAt         interface{}   `json:"expires_at"`
+}
+
+// confirmationToken signs the restore for principal until expires.
+func confirmationToken(principal string, project string, instance string, req RestoreRequest, expires time.Time) string {
+	return signConfirmation(expires, restoreConfirmationFields(principal, project, instance, req)...)
+}
+
+// checkConfirmationToken verifies that the token of req was issued for this
+// restore and principal, and hasn't expired.
+func checkConfirmationToken(principal string, project string, instance string, req RestoreRequest, now time.Time) error {
+	return checkConfirmation(req.ConfirmationToken, now, restoreConfirmationFields(principal, project, instance, req)...)
+}
+
+func restoreConfirmationFields(principal string, project string, instance string, req RestoreRequest) []string {
+	return []string{actionRestore, principal, project, instance, strconv.FormatInt(req.BackupID, 10), req.SourceProject, req.SourceInstance}
+}
+
+// backupsHandler lists the most recent backup runs of an instance, newest
+// first, up to ?limit= (default 20, max 100).
+func backupsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	limit := defaultBackupsLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			writeDecodeError(w, r, validationErrors{{Field: "limit", Message: "must be a positive integer"}})
+			return
+		}
+		limit = min(n, maxBackupsLimit)
+	}
+
+	project, instance := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	list, err := sqlService.BackupRuns.List(project, instance).MaxResults(int64(limit)).Context(ctx).Do()
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgBackupsListFailed, err)
+		return
+	}
+	data := BackupsData{Backups: make([]BackupRunData, 0, len(list.Items))}
+	for _, run := range list.Items {
+		data.Backups = append(data.Backups, newBackupRunData(run))
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgBackupsListed, data)
+}
+
+// restoreHandler restores an instance from a backup run, overwriting its
+// data. A first call without confirmation_token changes nothing and
+// returns the backup and a token, valid for confirmationTTL; the
+// restore starts when the same caller sends the request again with it.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	var payload RestoreRequest
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if errs := payload.validate(); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	project, instance := targetProject(r), targetInstance(r)
+	sourceProject, sourceInstance := payload.SourceProject, payload.SourceInstance
+	if sourceInstance == "" {
+		sourceInstance = instance
+	}
+	if sourceProject == "" {
+		sourceProject = project
+	}
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	principal := requestPrincipal(r)
+	if payload.ConfirmationToken == "" {
+		backup, err := getBackupRun(r.Context(), sqlService, sourceProject, sourceInstance, payload.BackupID)
+		if err != nil {
+			writeErrorResponse(w, r, http.StatusNotFound, msgBackupNotFound, err, payload.BackupID)
+			return
+		}
+		expires := time.Now().Add(confirmationTTL)
+		writeSuccessResponse(w, r, http.StatusOK, msgRestoreConfirmationRequired, RestoreConfirmation{
+			Project:           project,
+			Instance:          instance,
+			Backup:            newBackupRunData(backup),
+			ConfirmationToken: confirmationToken(principal, project, instance, payload, expires),
+			ExpiresAt:         formatTimestamp(expires),
+		}, instance)
+		return
+	}
+	if err := checkConfirmationToken(principal, project, instance, payload, time.Now()); err != nil {
+		writeErrorResponse(w, r, http.StatusConflict, msgRestoreConfirmationInvalid, err)
+		return
+	}
+
+	restore := &sqladmin.InstancesRestoreBackupRequest{RestoreBackupContext: &sqladmin.RestoreBackupContext{
+		BackupRunId: payload.BackupID,
+		InstanceId:  sourceInstance,
+		Project:     sourceProject,
+	}}
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunCall(http.MethodPost, sqlAdminInstancePath(project, instance)+"/restoreBackup", restore))
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	operation, err := sqlService.Instances.RestoreBackup(project, instance, restore).Context(ctx).Do()
+	event := newNotificationEvent(actionRestore, actionSourceAPI, principal, project, instance)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgRestoreFailed, err)
+		return
+	}
+
+	operations.track(event, operation)
+	writeOperationResponse(w, r, project, instance, operation, wait, timeout, operationSteps{}, msgRestoreStarted, msgRestoreFailed)
+}
+
+func getBackupRun(ctx context.Context, sqlService *sqladmin.Service, project string, instance string, id int64) (*sqladmin.BackupRun, error) {
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	return sqlService.BackupRuns.Get(project, instance, id).Context(ctx).Do()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultRetryMaxAttempts    = 5
+	defaultRetryDeadline       = 30 * time.Second
+	defaultRetryInitialBackoff = 500 * time.Millisecond
+	maxRetryBackoff            = 8 * time.Second
+)
+
+// RetryConfig bounds the retries of SQL Admin calls. MaxAttempts counts the
+// first attempt, so 1 disables retrying.
+type RetryConfig struct {
+	MaxAttempts    int
+	Deadline       time.Duration
+	InitialBackoff time.Duration
+}
+
+// sqlAdminRetry is applied to every SQL Admin client, set by
+// configureSQLAdmin.
+var sqlAdminRetry reloadable[RetryConfig]
+
+// retryTransport retries SQL Admin calls failing with 429, a 409 because
+// another operation is in progress or, for GETs, 5xx, with exponential
+// backoff and full jitter. When attempts or the deadline run out the last
+// response is returned untouched, so callers get the original googleapi
+// error.
+type retryTransport struct {
+	base   http.RoundTripper
+	config RetryConfig
+}
+
+func retrySQLAdmin(base http.RoundTripper, config RetryConfig) http.RoundTripper {
+	if config.MaxAttempts <= 1 {
+		return base
+	}
+	return &retryTransport{base: base, config: config}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := replayableBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(t.config.Deadline)
+	backoff := t.config.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		if body != nil {
+			req.Body = body()
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || !retryable(req, resp) {
+			return resp, err
+		}
+
+		wait := retryAfter(resp, rand.N(backoff+1))
+		if attempt == t.config.MaxAttempts || time.Now().Add(wait).After(deadline) || req.Context().Err() != nil {
+			slog.WarnContext(req.Context(), "SQL Admin call failed, giving up", "method", req.Method, "path", req.URL.Path, "status", resp.StatusCode, "attempts", attempt)
+			return resp, nil
+		}
+
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		trace.SpanFromContext(req.Context()).AddEvent("SQL Admin call retried", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.Int("http.response.status_code", resp.StatusCode),
+			attribute.String("wait", wait.String()),
+		))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// replayableBody returns a function handing out fresh copies of the request
+// body for each attempt, or nil when there is no body.
+func replayableBody(req *http.Request) (func() io.ReadCloser, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		return func() io.ReadCloser {
+			body, _ := req.GetBody()
+			return body
+		}, nil
+	}
+
+	raw, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return func() io.ReadCloser { return io.NopCloser(bytes.NewReader(raw)) }, nil
+}
+
+// retryable reports whether a response is worth retrying. A 5xx is only
+// retried for GETs, a failed POST or PATCH may still have started an
+// operation. A 409 is only retried when Cloud SQL reports another operation
+// in progress, other conflicts won't go away by themselves. The body is put
+// back after being inspected.
+func retryable(req *http.Request, resp *http.Response) bool {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode >= 500:
+		return req.Method == http.MethodGet
+	case resp.StatusCode != http.StatusConflict:
+		return false
+	}
+
+	raw, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(raw))
+	return bytes.Contains(raw, []byte("operationInProgress"))
+}
+
+// retryAfter honours a Retry-After header in seconds, falling back to the
+// computed backoff.
+func retryAfter(resp *http.Response, backoff time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return backoff
+}
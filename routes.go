@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// newPublicHandler is the public API with its middleware. The API
+// description and the webhook schema are served without authentication,
+// so clients can be generated before credentials are handed out. Tenants
+// authenticate with their own keys instead of the ones of the deployment.
+func newPublicHandler() http.Handler {
+	public := newPublicMux()
+	mux := http.NewServeMux()
+	mux.Handle("/", withAuth(public))
+	mux.Handle("/t/{tenant}/", withTenant(public))
+	mux.HandleFunc("GET /openapi.json", openAPIHandler)
+	mux.HandleFunc("GET /docs", docsHandler)
+	mux.HandleFunc("GET /schemas/webhook", webhookSchemaHandler)
+	return withTracing(withRequestLog(withRecovery(withCORS(withCompression(mux)))))
+}
+
+// newPublicMux registers the start/stop API served on PORT. Endpoints live
+// under /v1/, the original unversioned routes are kept for existing Cloud
+// Scheduler jobs and answer with deprecation headers.
+func newPublicMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// These may long-poll for up to maxWaitTimeout. Mutating calls are rate
+	// limited per caller and replay the first result for a repeated
+	// Idempotency-Key. Callers may only take the actions their access roles
+	// grant, and nobody may make the changes a policy rule blocks.
+	start := withAudit(scheduleActionStart, true, withAccess(scheduleActionStart, true, withPolicy(scheduleActionStart, withRateLimit(withIdempotency(withTimeout(startInstanceHandler, maxWaitTimeout+handlerTimeout))))))
+	stop := withAudit(scheduleActionStop, true, withAccess(scheduleActionStop, true, withPolicy(scheduleActionStop, withRateLimit(withIdempotency(withTimeout(stopInstancesHandler, maxWaitTimeout+handlerTimeout))))))
+	check := withAudit(auditActionCheck, true, withAccess(auditActionCheck, true, withTimeout(checkInstancesHandler, maxWaitTimeout+handlerTimeout)))
+	settings := withAudit(actionSettings, true, withAccess(actionSettings, true, withPolicy(actionSettings, withRateLimit(withIdempotency(withTimeout(patchSettingsHandler, maxWaitTimeout+handlerTimeout))))))
+	backup := withAudit(actionBackup, true, withAccess(actionBackup, true, withPolicy(actionBackup, withRateLimit(withIdempotency(withTimeout(backupHandler, maxWaitTimeout+handlerTimeout))))))
+	restart := withAudit(actionRestart, true, withAccess(actionRestart, true, withPolicy(actionRestart, withRateLimit(withIdempotency(withTimeout(restartHandler, maxWaitTimeout+handlerTimeout))))))
+	promote := withAudit(actionPromote, true, withAccess(actionPromote, true, withPolicy(actionPromote, withRateLimit(withIdempotency(withTimeout(promoteHandler, maxWaitTimeout+handlerTimeout))))))
+	failover := withAudit(actionFailover, true, withAccess(actionFailover, true, withPolicy(actionFailover, withRateLimit(withIdempotency(withTimeout(failoverHandler, maxWaitTimeout+handlerTimeout))))))
+	tier := withAudit(scheduleActionScale, true, withAccess(scheduleActionScale, true, withPolicy(scheduleActionScale, withRateLimit(withIdempotency(withTimeout(scaleHandler, maxWaitTimeout+handlerTimeout))))))
+	export := withAudit(actionExport, true, withAccess(actionExport, true, withPolicy(actionExport, withRateLimit(withIdempotency(withTimeout(exportHandler, maxWaitTimeout+handlerTimeout))))))
+	imports := withAudit(actionImport, true, withAccess(actionImport, true, withPolicy(actionImport, withRateLimit(withIdempotency(withTimeout(importHandler, maxWaitTimeout+handlerTimeout))))))
+	clone := withAudit(actionClone, true, withAccess(actionClone, true, withPolicy(actionClone, withRateLimit(withIdempotency(withTimeout(cloneHandler, maxWaitTimeout+handlerTimeout))))))
+	flags := withAudit(actionDatabaseFlags, true, withAccess(actionDatabaseFlags, true, withPolicy(actionDatabaseFlags, withRateLimit(withIdempotency(withTimeout(databaseFlagsHandler, maxWaitTimeout+handlerTimeout))))))
+	storeStart := withAudit(scheduleActionStart, true, withAccess(scheduleActionStart, true, withRateLimit(withIdempotency(withTimeout(storeActionHandler(scheduleActionStart), handlerTimeout)))))
+	storeStop := withAudit(scheduleActionStop, true, withAccess(scheduleActionStop, true, withRateLimit(withIdempotency(withTimeout(storeActionHandler(scheduleActionStop), handlerTimeout)))))
+	users := withAudit(actionUsers, true, withAccess(actionUsers, true, withPolicy(actionUsers, withRateLimit(withIdempotency(withTimeout(usersHandler, maxWaitTimeout+handlerTimeout))))))
+	user := withAudit(actionUsers, true, withAccess(actionUsers, true, withPolicy(actionUsers, withRateLimit(withIdempotency(withTimeout(userHandler, maxWaitTimeout+handlerTimeout))))))
+	userPassword := withAudit(actionUsers, true, withAccess(actionUsers, true, withPolicy(actionUsers, withRateLimit(withIdempotency(withTimeout(userPasswordHandler, maxWaitTimeout+handlerTimeout))))))
+	backups := withAudit(actionBackup, true, withAccess(actionBackup, true, withTimeout(backupsHandler, handlerTimeout)))
+	restore := withAudit(actionRestore, true, withAccess(actionRestore, true, withPolicy(actionRestore, withRateLimit(withIdempotency(withTimeout(restoreHandler, maxWaitTimeout+handlerTimeout))))))
+	maintenance := withAudit(actionMaintenanceWindow, true, withAccess(actionMaintenanceWindow, true, withPolicy(actionMaintenanceWindow, withRateLimit(withIdempotency(withTimeout(maintenanceWindowHandler, maxWaitTimeout+handlerTimeout))))))
+	storage := withAudit(actionStorage, true, withAccess(actionStorage, true, withPolicy(actionStorage, withRateLimit(withIdempotency(withTimeout(storageHandler, maxWaitTimeout+handlerTimeout))))))
+	scheduleList := withAccess(accessActionSchedules, false, withTimeout(schedulesHandler, handlerTimeout))
+	schedule := withAccess(accessActionSchedules, false, withTimeout(scheduleHandler, handlerTimeout))
+	scheduleRestore := withAccess(accessActionSchedules, false, withTimeout(restoreScheduleHandler, handlerTimeout))
+	networks := withAudit(actionAuthorizedNetworks, true, withAccess(actionAuthorizedNetworks, true, withPolicy(actionAuthorizedNetworks, withRateLimit(withIdempotency(withTimeout(authorizedNetworksHandler, maxWaitTimeout+handlerTimeout))))))
+
+	v1 := http.NewServeMux()
+	v1.Handle("/v1/instances", withTimeout(listInstancesHandler, handlerTimeout))
+	v1.Handle("/v1/instances/{instance}", check)
+	v1.Handle("/v1/instances/{instance}/start", start)
+	v1.Handle("/v1/instances/{instance}/stop", stop)
+	v1.Handle("/v1/instances/{instance}/settings", settings)
+	v1.Handle("/v1/instances/{instance}/backup", backup)
+	v1.Handle("/v1/instances/{instance}/backups", backups)
+	v1.Handle("/v1/instances/{instance}/restore", restore)
+	v1.Handle("/v1/instances/{instance}/restart", restart)
+	v1.Handle("/v1/instances/{instance}/failover", failover)
+	v1.Handle("/v1/instances/{instance}/promote", promote)
+	v1.Handle("/v1/instances/{instance}/tier", tier)
+	v1.Handle("/v1/instances/{instance}/maintenance-window", maintenance)
+	v1.Handle("/v1/instances/{instance}/storage", storage)
+	v1.Handle("/v1/instances/{instance}/authorized-networks", networks)
+	v1.Handle("/v1/instances/{instance}/flags", flags)
+	v1.Handle("/v1/instances/{instance}/users", users)
+	v1.Handle("/v1/instances/{instance}/users/{user}", user)
+	v1.Handle("/v1/instances/{instance}/users/{user}/password", userPassword)
+	v1.Handle("/v1/instances/{instance}/clone", clone)
+	v1.Handle("/v1/instances/{instance}/export", export)
+	v1.Handle("/v1/instances/{instance}/import", imports)
+	v1.Handle("/v1/instances/{instance}/schedule", withTimeout(schedulePreviewHandler, handlerTimeout))
+	v1.Handle("/v1/projects/{project}/instances", withTimeout(listInstancesHandler, handlerTimeout))
+	v1.Handle("/v1/projects/{project}/instances/{instance}", check)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/start", start)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/stop", stop)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/settings", settings)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/backup", backup)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/backups", backups)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/restore", restore)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/restart", restart)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/failover", failover)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/promote", promote)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/tier", tier)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/maintenance-window", maintenance)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/storage", storage)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/authorized-networks", networks)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/flags", flags)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/users", users)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/users/{user}", user)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/users/{user}/password", userPassword)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/clone", clone)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/export", export)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/import", imports)
+	v1.Handle("/v1/projects/{project}/instances/{instance}/schedule", withTimeout(schedulePreviewHandler, handlerTimeout))
+	v1.Handle("/v1/stores", withTimeout(listStoresHandler, handlerTimeout))
+	v1.Handle("/v1/stores/{kind}/{location}/{instance}/start", storeStart)
+	v1.Handle("/v1/stores/{kind}/{location}/{instance}/stop", storeStop)
+	v1.Handle("/v1/projects/{project}/stores", withTimeout(listStoresHandler, handlerTimeout))
+	v1.Handle("/v1/projects/{project}/stores/{kind}/{location}/{instance}/start", storeStart)
+	v1.Handle("/v1/projects/{project}/stores/{kind}/{location}/{instance}/stop", storeStop)
+	v1.Handle("/v1/start-by-label", withAudit(scheduleActionStart, false, withAccess(scheduleActionStart, false, withRateLimit(withIdempotency(withTimeout(bulkActivationHandler(scheduleActionStart), handlerTimeout))))))
+	v1.Handle("/v1/stop-by-label", withAudit(scheduleActionStop, false, withAccess(scheduleActionStop, false, withRateLimit(withIdempotency(withTimeout(bulkActivationHandler(scheduleActionStop), handlerTimeout))))))
+	v1.Handle("/v1/batch", withAudit(actionBatch, false, withRateLimit(withIdempotency(withTimeout(batchHandler, handlerTimeout)))))
+	v1.Handle("/v1/batches", withTimeout(batchesHandler, handlerTimeout))
+	v1.Handle("/v1/batches/{id}", withAudit(actionBatch, false, withTimeout(batchCancelHandler, handlerTimeout)))
+	v1.Handle("/v1/audit", withAccess(accessActionAudit, false, withTimeout(auditHandler, handlerTimeout)))
+	// Streams until the client leaves, no timeout.
+	v1.HandleFunc("/v1/events", eventsHandler)
+	v1.Handle("/v1/savings", withTimeout(savingsHandler, handlerTimeout))
+	v1.Handle("/v1/grafana", withAccess(accessActionAudit, false, withTimeout(grafanaHandler, handlerTimeout)))
+	v1.Handle("/v1/grafana/search", withAccess(accessActionAudit, false, withTimeout(grafanaSearchHandler, handlerTimeout)))
+	v1.Handle("/v1/grafana/metrics", withAccess(accessActionAudit, false, withTimeout(grafanaSearchHandler, handlerTimeout)))
+	v1.Handle("/v1/grafana/query", withAccess(accessActionAudit, false, withTimeout(grafanaQueryHandler, handlerTimeout)))
+	v1.Handle("/v1/grafana/annotations", withAccess(accessActionAudit, false, withTimeout(grafanaAnnotationsHandler, handlerTimeout)))
+	v1.Handle("/v1/schedules", scheduleList)
+	v1.Handle("/v1/schedules/{id}", schedule)
+	v1.Handle("/v1/schedules/{id}/restore", scheduleRestore)
+	v1.Handle("/v1/schedule/preview", withAccess(accessActionSchedules, false, withTimeout(scheduleCalendarHandler, handlerTimeout)))
+	v1.Handle("/v1/overrides", withAccess(accessActionOverrides, false, withTimeout(overridesHandler, handlerTimeout)))
+	v1.Handle("/v1/overrides/{id}", withAccess(accessActionOverrides, false, withTimeout(overrideHandler, handlerTimeout)))
+	v1.Handle("/v1/schedule-once", withAccess(accessActionSchedules, false, withTimeout(delayedActionsHandler, handlerTimeout)))
+	v1.Handle("/v1/schedule-once/{id}", withAccess(accessActionSchedules, false, withTimeout(delayedActionHandler, handlerTimeout)))
+	mux.Handle("/v1/", withVersion(apiVersion, v1))
+
+	// The instance endpoints of each tenant, in the project of the tenant.
+	// Access is checked against the tenant, see withTenant.
+	tenant := http.NewServeMux()
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}", check)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/start", start)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/stop", stop)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/settings", settings)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/backup", backup)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/backups", backups)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/restore", restore)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/restart", restart)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/failover", failover)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/promote", promote)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/tier", tier)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/maintenance-window", maintenance)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/storage", storage)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/authorized-networks", networks)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/flags", flags)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/users", users)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/users/{user}", user)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/users/{user}/password", userPassword)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/clone", clone)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/export", export)
+	tenant.Handle("/t/{tenant}/v1/instances/{instance}/import", imports)
+	mux.Handle("/t/{tenant}/v1/", withVersion(apiVersion, tenant))
+
+	mux.Handle("/stop", deprecated(legacySuccessor("/stop"), stop))
+	mux.Handle("/start", deprecated(legacySuccessor("/start"), start))
+	mux.Handle("/check", deprecated(legacySuccessor(""), check))
+	mux.Handle("/instances/{instance}/settings", deprecated(legacySuccessor("/settings"), settings))
+	mux.Handle("/schedules", deprecated(versionedSuccessor, scheduleList))
+	mux.Handle("/schedules/{id}", deprecated(versionedSuccessor, schedule))
+	mux.Handle("/schedules/{id}/restore", deprecated(versionedSuccessor, scheduleRestore))
+
+	return mux
+}
+
+// versionedSuccessor points a legacy route at the same path under /v1.
+func versionedSuccessor(r *http.Request) string {
+	return "/v1" + r.URL.Path
+}
+
+// legacySuccessor points a legacy route at its /v1 equivalent for the
+// instance it acts on.
+func legacySuccessor(suffix string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return instancePath(targetProject(r), targetInstance(r)) + suffix
+	}
+}
+
+// newAdminMux registers the operational endpoints served on ADMIN_PORT, kept
+// off the public listener so they can be firewalled separately.
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/admin/flags", listFlagsHandler)
+	mux.HandleFunc("/admin/flags/{name}", setFlagHandler)
+	mux.HandleFunc("/admin/reload", reloadHandler)
+	mux.HandleFunc("/scheduler/pause", pauseSchedulerHandler)
+	mux.HandleFunc("/scheduler/resume", resumeSchedulerHandler)
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+// HealthData is the payload of GET /healthz. Scheduler tells whether
+// automated actions are paused, Leader which replica runs them when leader
+// election is on.
+type HealthData struct {
+	Status    string          `json:"status"`
+	Scheduler SchedulerStatus `json:"scheduler"`
+	Leader    *LeaderStatus   `json:"leader,omitempty"`
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeSuccessResponse(w, r, http.StatusOK, msgHealthy, HealthData{Status: "ok", Scheduler: pauses.status(), Leader: leadership.status()})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultRunOnceLookback is how far back run-once looks for runs of
+// schedules that never ran.
+const defaultRunOnceLookback = time.Hour
+
+// Results of run-once.
+const (
+	runOnceResultRan    = "ran"
+	runOnceResultFailed = "failed"
+)
+
+// RunOnceResult is one schedule run by run-once. Schedule is once:<id> for
+// delayed actions.
+type RunOnceResult struct {
+	Schedule string `json:"schedule"`
+	Action   string `json:"action"`
+	Project  string `json:"project"`
+	Instance string `json:"instance"`
+	Result   string `json:"result"`
+	Error    string `json:"error,omitempty"`
+}
+
+// runOnceCommand runs the schedules that fired since their last run, and
+// the delayed actions that are due, and exits, for deployments as a Cloud
+// Run job or any cron-like trigger instead of a long-running server. Schedules are read from SCHEDULES_FILE
+// and the config file, and the runs are recorded in SCHEDULES_FILE so the
+// next invocation doesn't run them again.
+func runOnceCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	var (
+		options  cliOptions
+		lookback time.Duration
+	)
+	flags := flag.NewFlagSet("run-once", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&options.config, "config", "", "YAML or JSON config file, overrides CONFIG_FILE")
+	flags.StringVar(&options.output, "output", outputText, "output format, text or json")
+	flags.DurationVar(&lookback, "lookback", defaultRunOnceLookback, "how far back to catch up on schedules that didn't run")
+
+	instanceRequired = false
+	if !parseCLI(flags, args, &options, stderr) {
+		return exitUsage
+	}
+	if lookback <= 0 {
+		fmt.Fprintln(stderr, "Error: --lookback: must be positive")
+		return exitUsage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cliTimeout)
+	defer cancel()
+	return finishCLI(cliRunOnce(ctx, stdout, options.output, options.cfg, time.Now(), lookback), stderr)
+}
+
+// cliRunOnce runs every active schedule that fired after its last run, or
+// after its creation for schedules that never ran, going back lookback from
+// now at most, and prints what ran. It fails when a run failed.
+func cliRunOnce(ctx context.Context, stdout io.Writer, output string, cfg *Config, now time.Time, lookback time.Duration) error {
+	backend, err := cfg.State.open(ctx, cfg.stateDocuments())
+	if err != nil {
+		return fmt.Errorf("failed to open the state backend: %w", err)
+	}
+	state = backend
+	schedules = newScheduleStore(cfg.SchedulesFile, cfg.TrashRetention)
+	if err := schedules.load(); err != nil {
+		return fmt.Errorf("failed to load schedules: %w", err)
+	}
+	if err := schedules.declare(cfg.DeclaredSchedules); err != nil {
+		return fmt.Errorf("failed to declare schedules: %w", err)
+	}
+	overrides = newOverrideStore(cfg.OverridesFile)
+	if err := overrides.load(); err != nil {
+		return fmt.Errorf("failed to load overrides: %w", err)
+	}
+	delayedActions = newDelayedStore(cfg.DelayedActionsFile)
+	if err := delayedActions.load(); err != nil {
+		return fmt.Errorf("failed to load delayed actions: %w", err)
+	}
+	delayedActions.now = func() time.Time { return now }
+	if cfg.Holidays.ICalURL != "" {
+		if err := holidays.fetch(ctx, cfg.Holidays.ICalURL); err != nil {
+			slog.Error("Failed to fetch the holiday calendar, starts run on holidays", "url", cfg.Holidays.ICalURL, "error", err)
+		}
+	}
+
+	results := []RunOnceResult{}
+	failed := 0
+	for _, schedule := range schedules.list(false) {
+		ran, err := runIfDue(schedules, schedule, schedule.runnableSince(now.Add(-lookback)), now)
+		if !ran && err == nil {
+			continue
+		}
+		result := RunOnceResult{Schedule: schedule.ID, Action: schedule.Action, Project: schedule.Project, Instance: schedule.Instance, Result: runOnceResultRan}
+		if err != nil {
+			result.Result, result.Error = runOnceResultFailed, err.Error()
+			failed++
+		}
+		results = append(results, result)
+	}
+	for _, run := range delayedActions.runDue(ctx) {
+		result := RunOnceResult{Schedule: "once:" + run.action.ID, Action: run.action.Action, Project: run.action.Project, Instance: run.action.Instance, Result: runOnceResultRan}
+		if run.err != nil {
+			result.Result, result.Error = runOnceResultFailed, run.err.Error()
+			failed++
+		}
+		results = append(results, result)
+	}
+
+	if err := printRunOnceResults(stdout, output, results); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d schedules failed", failed, len(results))
+	}
+	return nil
+}
+
+func printRunOnceResults(w io.Writer, output string, results []RunOnceResult) error {
+	if output == outputJSON {
+		return writeJSON(w, results)
+	}
+	if len(results) == 0 {
+		_, err := fmt.Fprintln(w, "No schedule due.")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCHEDULE\tACTION\tPROJECT\tINSTANCE\tRESULT")
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result.Schedule, result.Action, result.Project, result.Instance, result.Result)
+	}
+	return tw.Flush()
+}
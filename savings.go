@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSavingsPeriod   = 30 * 24 * time.Hour
+	defaultSavingsCurrency = "USD"
+
+	// activationLookback is how far before a period starts and stops are
+	// read, to know the state instances were in when it began.
+	activationLookback = 7 * 24 * time.Hour
+
+	// Cloud SQL Enterprise edition list prices in us-central1, per hour.
+	// Stopped instances still pay for storage and IP addresses, so only
+	// compute is saved.
+	defaultVCPUHourlyPrice     = 0.0413
+	defaultMemoryGBHourlyPrice = 0.007
+)
+
+// sharedCoreHourlyPrices are the list prices of the shared-core tiers,
+// which aren't billed per vCPU and GB.
+var sharedCoreHourlyPrices = map[string]float64{
+	"db-f1-micro": 0.0105,
+	"db-g1-small": 0.0350,
+}
+
+var (
+	customTier      = regexp.MustCompile(`^db-custom-(\d+)-(\d+)$`)
+	predefinedTier  = regexp.MustCompile(`^db-n1-(standard|highmem)-(\d+)$`)
+	memoryPerVCPUGB = map[string]float64{"standard": 3.75, "highmem": 6.5}
+)
+
+// PricingConfig prices instance tiers for the savings estimate. TierPrices
+// overrides the hourly price of whole tiers, e.g. negotiated prices or
+// tiers the vCPU and memory rates don't cover.
+type PricingConfig struct {
+	Currency            string
+	VCPUHourlyPrice     float64
+	MemoryGBHourlyPrice float64
+	TierPrices          map[string]float64
+}
+
+// pricing is set from the SAVINGS_* settings.
+var pricing reloadable[PricingConfig]
+
+// parseTierPrices reads a list of tier=price pairs.
+func parseTierPrices(items []string) (map[string]float64, error) {
+	prices := make(map[string]float64, len(items))
+	for _, item := range items {
+		tier, raw, ok := strings.Cut(item, "=")
+		price, err := strconv.ParseFloat(raw, 64)
+		if !ok || tier == "" || err != nil || price < 0 {
+			return nil, fmt.Errorf("%q is not a tier=price pair such as 'db-custom-2-7680=0.12'", item)
+		}
+		prices[tier] = price
+	}
+	return prices, nil
+}
+
+// hourlyPrice is the compute price of an instance per hour, doubled for
+// highly available (REGIONAL) instances. ok is false for tiers it can't
+// price.
+func (p PricingConfig) hourlyPrice(tier string, availabilityType string) (price float64, ok bool) {
+	price, ok = p.TierPrices[tier]
+	if !ok {
+		price, ok = sharedCoreHourlyPrices[tier]
+	}
+	if match := customTier.FindStringSubmatch(tier); !ok && match != nil {
+		vcpus, _ := strconv.Atoi(match[1])
+		memoryMB, _ := strconv.Atoi(match[2])
+		price, ok = float64(vcpus)*p.VCPUHourlyPrice+float64(memoryMB)/1024*p.MemoryGBHourlyPrice, true
+	}
+	if match := predefinedTier.FindStringSubmatch(tier); !ok && match != nil {
+		vcpus, _ := strconv.Atoi(match[2])
+		price, ok = float64(vcpus)*(p.VCPUHourlyPrice+memoryPerVCPUGB[match[1]]*p.MemoryGBHourlyPrice), true
+	}
+	if ok && availabilityType == "REGIONAL" {
+		price *= 2
+	}
+	return price, ok
+}
+
+// InstanceSavings is the estimate for one instance. HourlyPrice and Savings
+// are left out when the tier can't be priced.
+type InstanceSavings struct {
+	Project          string   `json:"project"`
+	Instance         string   `json:"instance"`
+	Tier             string   `json:"tier,omitempty"`
+	AvailabilityType string   `json:"availability_type,omitempty"`
+	StoppedHours     float64  `json:"stopped_hours"`
+	HourlyPrice      *float64 `json:"hourly_price,omitempty"`
+	Savings          *float64 `json:"savings,omitempty"`
+	Error            string   `json:"error,omitempty"`
+}
+
+// SavingsData is the payload of GET /v1/savings.
+type SavingsData struct {
+	From         interface{}       `json:"from"`
+	To           interface{}       `json:"to"`
+	Currency     string            `json:"currency"`
+	TotalSavings float64           `json:"total_savings"`
+	StoppedHours float64           `json:"stopped_hours"`
+	Instances    []InstanceSavings `json:"instances"`
+	// Truncated is set when the audit log held more entries than could be
+	// read, the estimate is then a lower bound.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// savingsHandler estimates the money saved by keeping instances stopped
+// between ?from= and ?to= (RFC 3339, the last 30 days by default). Stopped
+// time comes from the successful starts and stops in the audit log, priced
+// with the instance's current tier. Instances the caller may not check are
+// left out.
+func savingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+	if auditLog == nil {
+		writeErrorResponse(w, r, http.StatusNotFound, msgAuditDisabled, errAuditDisabled)
+		return
+	}
+
+	now := time.Now()
+	to, from := now, now.Add(-defaultSavingsPeriod)
+	var errs validationErrors
+	for _, param := range []struct {
+		name   string
+		target *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if raw := r.URL.Query().Get(param.name); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				errs = append(errs, fieldError{Field: param.name, Message: "must be an RFC 3339 timestamp"})
+			}
+			*param.target = t
+		}
+	}
+	if len(errs) == 0 && !to.After(from) {
+		errs = append(errs, fieldError{Field: "to", Message: "must be after from"})
+	}
+	if len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	project, instance := r.URL.Query().Get("project"), r.URL.Query().Get("instance")
+	stopped, truncated, err := stoppedIntervals(r.Context(), project, instance, from, minTime(to, now))
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgAuditQueryFailed, err)
+		return
+	}
+
+	data := SavingsData{
+		From:      formatTimestamp(from),
+		To:        formatTimestamp(to),
+		Currency:  pricing.load().Currency,
+		Instances: []InstanceSavings{},
+		Truncated: truncated,
+	}
+	for _, key := range sortedKeys(stopped) {
+		project, name, _ := strings.Cut(key, "/")
+		if !accessAllowed(r, auditActionCheck, project, name) {
+			continue
+		}
+		savings := InstanceSavings{Project: project, Instance: name, StoppedHours: roundTo(stopped[key].Hours(), 2)}
+
+		if details, err := instanceDetails(r.Context(), project, name); err != nil {
+			savings.Error = err.Error()
+		} else {
+			savings.Tier, savings.AvailabilityType = details.tier, details.availabilityType
+			if price, ok := pricing.load().hourlyPrice(details.tier, details.availabilityType); ok {
+				amount := roundTo(price*stopped[key].Hours(), 2)
+				savings.HourlyPrice, savings.Savings = &price, &amount
+				data.TotalSavings += amount
+			}
+		}
+		data.StoppedHours += savings.StoppedHours
+		data.Instances = append(data.Instances, savings)
+	}
+	data.TotalSavings, data.StoppedHours = roundTo(data.TotalSavings, 2), roundTo(data.StoppedHours, 2)
+
+	writeSuccessResponse(w, r, http.StatusOK, msgSavingsEstimated, data)
+}
+
+// stoppedIntervals sums, per project/instance, how long instances were
+// stopped between from and to. An instance is stopped from a successful
+// stop until the next successful start. Entries of the week before from
+// cover instances stopped before the period, older stops are missed.
+// Actions by label aren't counted, their entries name no instance.
+func stoppedIntervals(ctx context.Context, project string, instance string, from time.Time, to time.Time) (map[string]time.Duration, bool, error) {
+	q := auditQuery{Project: project, Instance: instance, Since: from.Add(-activationLookback), Until: to}
+	entries, truncated, err := auditEntries(ctx, q, scheduleActionStart, scheduleActionStop)
+	if err != nil {
+		return nil, false, err
+	}
+
+	stoppedSince := make(map[string]time.Time)
+	stopped := make(map[string]time.Duration)
+	add := func(key string, start time.Time, end time.Time) {
+		start, end = maxTime(start, from), minTime(end, to)
+		if end.After(start) {
+			stopped[key] += end.Sub(start)
+		}
+	}
+	for _, entry := range entries {
+		if entry.Instance == "" || entry.Result != "success" {
+			continue
+		}
+		key := entry.Project + "/" + entry.Instance
+		since, isStopped := stoppedSince[key]
+		switch {
+		case entry.Action == scheduleActionStop && !isStopped:
+			stoppedSince[key] = entry.Time
+		case entry.Action == scheduleActionStart && isStopped:
+			add(key, since, entry.Time)
+			delete(stoppedSince, key)
+		}
+	}
+	for key, since := range stoppedSince {
+		add(key, since, to)
+	}
+	return stopped, truncated, nil
+}
+
+// auditEntries reads the entries of q for each of actions, oldest first.
+// It reports whether an action had more than maxAuditQueryLimit entries,
+// the oldest of them are then missing.
+func auditEntries(ctx context.Context, q auditQuery, actions ...string) ([]AuditEntry, bool, error) {
+	var (
+		entries   []AuditEntry
+		truncated bool
+	)
+	q.Limit = maxAuditQueryLimit
+	for _, action := range actions {
+		q.Action = action
+		items, err := auditLog.query(ctx, q)
+		if err != nil {
+			return nil, false, err
+		}
+		truncated = truncated || len(items) == maxAuditQueryLimit
+		entries = append(entries, items...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, truncated, nil
+}
+
+type instanceBilling struct {
+	tier             string
+	availabilityType string
+}
+
+func instanceDetails(ctx context.Context, project string, instance string) (instanceBilling, error) {
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		return instanceBilling{}, err
+	}
+
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	details, err := sqlService.Instances.Get(project, instance).Context(ctx).Do()
+	if err != nil {
+		return instanceBilling{}, err
+	}
+	if details.Settings == nil {
+		return instanceBilling{}, errors.New("instance has no settings")
+	}
+	return instanceBilling{tier: details.Settings.Tier, availabilityType: details.Settings.AvailabilityType}, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func roundTo(value float64, decimals int) float64 {
+	scale := math.Pow10(decimals)
+	return math.Round(value*scale) / scale
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/sqladmin/v1"
+
+	"scheduler-db/pkg/sqlctl"
+)
+
+// schedulerInterval is how often the scheduler checks for due schedules and
+// for changes to the schedules file. Cron expressions have minute
+// resolution, so runs start at most this late.
+const schedulerInterval = 15 * time.Second
+
+const (
+	defaultSchedulerStateFile = "scheduler-state.json"
+	// defaultSchedulerCatchUp is the default of SCHEDULER_CATCH_UP.
+	defaultSchedulerCatchUp = time.Hour
+)
+
+// scheduleActivationPolicies maps schedule actions to the activation policy
+// patched onto the instance.
+var scheduleActivationPolicies = map[string]string{
+	scheduleActionStart: sqlctl.PolicyAlways,
+	scheduleActionStop:  sqlctl.PolicyNever,
+}
+
+// scheduler runs the start/stop schedules of a scheduleStore in-process, so
+// no external Cloud Scheduler job is needed. With a checkpoint, the time of
+// each tick is saved to the state backend so the next process catches up
+// on the runs missed while none ran, up to catchUp ago.
+type scheduler struct {
+	store      *scheduleStore
+	now        func() time.Time
+	last       time.Time
+	checkpoint string
+	catchUp    time.Duration
+}
+
+// schedulerCheckpoint is the document saved after every tick.
+type schedulerCheckpoint struct {
+	LastTick time.Time `json:"last_tick"`
+}
+
+func newScheduler(store *scheduleStore) *scheduler {
+	return &scheduler{store: store, now: time.Now}
+}
+
+// run checks schedules every schedulerInterval until stop is closed,
+// starting with the runs missed while the process was down.
+func (s *scheduler) run(stop <-chan struct{}) {
+	if s.recover() {
+		s.tick()
+	}
+
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.tick()
+		}
+	}
+}
+
+// tick reloads the schedules file if it changed and runs every schedule that
+// fired since the previous tick. Replicas that don't hold the leadership
+// only reload, and catch up from the checkpoint of the previous leader once
+// they take over.
+func (s *scheduler) tick() {
+	now := s.now()
+
+	if reloaded, err := s.store.reloadIfChanged(); err != nil {
+		slog.Error("Failed to reload schedules", "error", err)
+	} else if reloaded {
+		slog.Info("Reloaded schedules", "path", s.store.path)
+	}
+
+	if !leadership.leading() {
+		s.last = time.Time{}
+		return
+	}
+	if s.last.IsZero() {
+		s.recover()
+	}
+
+	for _, schedule := range s.store.list(false) {
+		runIfDue(s.store, schedule, schedule.runnableSince(s.last), now)
+	}
+
+	s.last = now
+	s.saveCheckpoint()
+}
+
+// recover starts the scheduler from the last tick of the previous process,
+// at most catchUp ago, and reports whether there are runs to catch up on.
+// Without a checkpoint, or with catchUp 0, it starts from now.
+func (s *scheduler) recover() bool {
+	now := s.now()
+	s.last = now
+	if s.checkpoint == "" || s.catchUp <= 0 {
+		return false
+	}
+
+	raw, _, err := state.read(s.checkpoint)
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	var saved schedulerCheckpoint
+	if err == nil {
+		err = json.Unmarshal(raw, &saved)
+	}
+	if err != nil {
+		slog.Error("Failed to read the scheduler checkpoint, missed runs are not caught up", "path", s.checkpoint, "error", err)
+		return false
+	}
+
+	since := saved.LastTick
+	if oldest := now.Add(-s.catchUp); since.Before(oldest) {
+		slog.Warn("Scheduler stopped for longer than SCHEDULER_CATCH_UP, older runs are not caught up", "last_tick", saved.LastTick, "catch_up", s.catchUp)
+		since = oldest
+	}
+	if !since.Before(now) {
+		return false
+	}
+	slog.Info("Catching up on the runs missed while the scheduler was down", "since", since)
+	s.last = since
+	return true
+}
+
+// saveCheckpoint saves the time of the last tick. A failure only costs the
+// catch up after a restart.
+func (s *scheduler) saveCheckpoint() {
+	if s.checkpoint == "" {
+		return
+	}
+	raw, err := json.Marshal(schedulerCheckpoint{LastTick: s.last.UTC()})
+	if err == nil {
+		_, err = state.write(s.checkpoint, raw)
+	}
+	if err != nil {
+		slog.Error("Failed to save the scheduler checkpoint", "path", s.checkpoint, "error", err)
+	}
+}
+
+// runIfDue runs the schedule if it fired after since and up to now, and
+// records the run in store. It reports whether the schedule ran, with the
+// error of the run or of an invalid schedule.
+func runIfDue(store *scheduleStore, schedule Schedule, since time.Time, now time.Time) (bool, error) {
+	next, err := schedule.next(since)
+	if err != nil {
+		slog.Error("Schedule is invalid", "schedule", schedule.ID, "error", err)
+		return false, err
+	}
+	if next.After(now) {
+		return false, nil
+	}
+	if holiday := schedule.skippedHoliday(next); holiday != "" {
+		slog.Info("Scheduled start skipped on a holiday", schedule.attrs("holiday", holiday)...)
+		return false, nil
+	}
+	if override := overrides.skipping(schedule.Project, schedule.Instance, schedule.Action, next); override != nil {
+		slog.Info("Scheduled action skipped by an override", schedule.attrs("override", override.ID, "until", override.Until)...)
+		return false, nil
+	}
+	if pauses.active(now) {
+		slog.Info("Scheduled action skipped, automated actions are paused", schedule.attrs()...)
+		return false, nil
+	}
+
+	ctx, span := startSpan(context.Background(), "schedule "+schedule.Action, append(instanceAttributes(schedule.Action, schedule.Project, schedule.Instance),
+		attribute.String("scheduler_db.schedule", schedule.ID))...)
+	err = runScheduledAction(ctx, schedule)
+	endSpan(span, err)
+	if !dryRun.load() {
+		recordAction(schedule.Action, actionSourceSchedule, err)
+	}
+	if err != nil {
+		slog.Error("Scheduled action failed", schedule.attrs("error", err)...)
+	}
+	if err := store.recordRun(schedule.ID, now, err); err != nil {
+		slog.Error("Failed to save schedules", "error", err)
+	}
+	return true, err
+}
+
+// runScheduledAction applies a schedule's action to its instance, or to its
+// data store for other kinds. Instances already in the requested state are
+// left alone.
+func runScheduledAction(ctx context.Context, schedule Schedule) error {
+	action := triggeredAction{
+		Action:           schedule.Action,
+		Project:          schedule.Project,
+		Instance:         schedule.Instance,
+		Source:           actionSourceSchedule,
+		TriggeredBy:      "schedule " + schedule.ID,
+		Schedule:         schedule.ID,
+		BackupBeforeStop: schedule.BackupBeforeStop,
+		ExportBeforeStop: schedule.ExportBeforeStop,
+		Tier:             schedule.Tier,
+	}
+	if schedule.Chain != "" {
+		chain, ok := chains.load()[schedule.Chain]
+		if !ok {
+			return fmt.Errorf("unknown chain %q", schedule.Chain)
+		}
+		_, err := runChain(ctx, chain, action)
+		return err
+	}
+	if schedule.Kind != "" && schedule.Kind != storeKindCloudSQL {
+		_, _, err := runStoreAction(ctx, schedule.Kind, schedule.Location, action)
+		return err
+	}
+	_, err := runTriggeredAction(ctx, action)
+	return err
+}
+
+// triggeredAction is a start, stop or scale that doesn't come from an API
+// call, but from a schedule, a Pub/Sub message or the command line. Force
+// skips the connection check of stops. Schedule is the id of the schedule
+// that triggered it, if any.
+type triggeredAction struct {
+	Action           string
+	Project          string
+	Instance         string
+	Source           string
+	TriggeredBy      string
+	Schedule         string
+	BackupBeforeStop bool
+	ExportBeforeStop *ExportRequest
+	Tier             string
+	Force            bool
+}
+
+// attrs are the log fields of the action followed by extra.
+func (a triggeredAction) attrs(extra ...any) []any {
+	return append([]any{"action", a.Action, "project", a.Project, "instance", a.Instance, "triggered_by", a.TriggeredBy}, extra...)
+}
+
+// runTriggeredAction applies the action to its instance, taking a backup
+// first when asked to, and returns the operation started. Instances already
+// in the requested state are left alone and no operation is returned.
+func runTriggeredAction(ctx context.Context, action triggeredAction) (*sqladmin.Operation, error) {
+	ctx, span := startSpan(ctx, action.Action+" instance", append(instanceAttributes(action.Action, action.Project, action.Instance),
+		attribute.String("scheduler_db.source", action.Source))...)
+	operation, err := applyTriggeredAction(ctx, action)
+	endSpan(span, err)
+	return operation, err
+}
+
+func applyTriggeredAction(ctx context.Context, action triggeredAction) (*sqladmin.Operation, error) {
+	if err := checkPolicies(ctx, action.Action, action.Project, action.Instance); err != nil {
+		event := newNotificationEvent(action.Action, action.Source, action.TriggeredBy, action.Project, action.Instance)
+		event.Schedule = action.Schedule
+		notifyAction(event, nil, err)
+		return nil, err
+	}
+	if action.Action == scheduleActionScale {
+		return runTriggeredScale(ctx, action)
+	}
+	if action.Action == scheduleActionShrinkCheck {
+		return nil, runShrinkCheck(ctx, action)
+	}
+
+	policy, ok := scheduleActivationPolicies[action.Action]
+	if !ok {
+		return nil, fmt.Errorf("unknown action %q", action.Action)
+	}
+
+	controller, err := sqlController(action.Project)
+	if err != nil {
+		return nil, err
+	}
+
+	// Failures before the action is requested are notified too, so a
+	// schedule never fails silently.
+	event := newNotificationEvent(action.Action, action.Source, action.TriggeredBy, action.Project, action.Instance)
+	event.Schedule = action.Schedule
+	status, err := checkStatusInstances(ctx, action.Project, action.Instance)
+	if err != nil {
+		notifyAction(event, nil, err)
+		return nil, err
+	}
+	notifyUnexpectedState(event, status.State)
+
+	switch {
+	case action.Action == scheduleActionStop && status.State != "RUNNABLE":
+		slog.Info("Instance is not running, nothing to stop", action.attrs("state", status.State)...)
+		return nil, nil
+	case action.Action == scheduleActionStart && status.State == "RUNNABLE":
+		slog.Info("Instance is already running", action.attrs()...)
+		return nil, nil
+	}
+	if action.Action == scheduleActionStop {
+		if err := checkConnections(ctx, action.Project, action.Instance, action.Force); err != nil {
+			notifyAction(event, nil, err)
+			return nil, err
+		}
+	}
+
+	if dryRun.load() {
+		slog.Info("Dry run, action skipped", action.attrs()...)
+		return nil, nil
+	}
+
+	if action.Action == scheduleActionStop && (action.BackupBeforeStop || action.ExportBeforeStop != nil) {
+		sqlService, err := sqlAdminService(action.Project)
+		if err != nil {
+			return nil, err
+		}
+		if action.BackupBeforeStop {
+			if _, err := backupBeforeStop(ctx, sqlService, event, maxWaitTimeout); err != nil {
+				return nil, err
+			}
+		}
+		if action.ExportBeforeStop != nil {
+			export, err := exportBeforeStop(ctx, sqlService, event, action.ExportBeforeStop, maxWaitTimeout)
+			exportAction := action
+			exportAction.Action = actionExport
+			auditAction(exportAction, export, err)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	operation, err := controller.SetActivationPolicy(ctx, action.Project, action.Instance, policy)
+	notifyAction(event, operation, err)
+	auditAction(action, operation, err)
+	if err != nil {
+		return nil, err
+	}
+	operations.track(event, operation)
+
+	slog.Info("Action requested", action.attrs("operation", operation.Name)...)
+	return operation, nil
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	defaultSchedulesFile  = "schedules.json"
+	defaultTrashRetention = 7 * 24 * time.Hour
+	schedulePurgeInterval = time.Hour
+	scheduleActionStart   = "start"
+	scheduleActionStop    = "stop"
+	scheduleActionScale   = "scale"
+
+	// scheduleActionShrinkCheck schedules only read the disk usage of the
+	// instance and notify when most of its disk is unused.
+	scheduleActionShrinkCheck = "shrink_check"
+)
+
+var (
+	errScheduleNotFound   = errors.New("schedule not found")
+	errScheduleNotDeleted = errors.New("schedule is not deleted")
+)
+
+// Schedule runs an action against an instance whenever its cron expression
+// fires. Deleted schedules stay in the trash, with DeletedAt set, until they
+// are purged after the retention period.
+type Schedule struct {
+	ID       string `json:"id"`
+	Project  string `json:"project"`
+	Instance string `json:"instance"`
+	Action   string `json:"action"`
+	Cron     string `json:"cron"`
+	Timezone string `json:"timezone,omitempty"`
+	// Kind is the kind of data store, empty for Cloud SQL instances, and
+	// Location its region when the kind needs one.
+	Kind     string `json:"kind,omitempty"`
+	Location string `json:"location,omitempty"`
+	// Chain is the id of the chain a schedule starts or stops instead of
+	// an instance.
+	Chain string `json:"chain,omitempty"`
+	// BackupBeforeStop makes a stop schedule take a backup first.
+	BackupBeforeStop bool `json:"backup_before_stop,omitempty"`
+	// ExportBeforeStop makes a stop schedule export the instance first.
+	ExportBeforeStop *ExportRequest `json:"export_before_stop,omitempty"`
+	// Tier is the machine tier a scale schedule moves the instance to.
+	Tier string `json:"tier,omitempty"`
+	// NotifyEmails are emailed about the runs of the schedule.
+	NotifyEmails []string `json:"notify_emails,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// attrs are the log fields of the schedule followed by extra.
+func (s Schedule) attrs(extra ...any) []any {
+	if s.Chain != "" {
+		return append([]any{"schedule", s.ID, "action", s.Action, "project", s.Project, "chain", s.Chain}, extra...)
+	}
+	return append([]any{"schedule", s.ID, "action", s.Action, "project", s.Project, "instance", s.Instance}, extra...)
+}
+
+// next is the first time after t the schedule fires, in its timezone (UTC
+// when unset).
+func (s Schedule) next(t time.Time) (time.Time, error) {
+	spec, err := cron.ParseStandard(s.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	location := time.UTC
+	if s.Timezone != "" {
+		if location, err = time.LoadLocation(s.Timezone); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return spec.Next(t.In(location)), nil
+}
+
+// runnableSince moves since to the creation or the last run of the
+// schedule when later, so catching up never runs it twice for the same
+// time nor for a time before it existed.
+func (s Schedule) runnableSince(since time.Time) time.Time {
+	if s.CreatedAt.After(since) {
+		since = s.CreatedAt
+	}
+	if s.LastRunAt != nil && s.LastRunAt.After(since) {
+		since = *s.LastRunAt
+	}
+	return since
+}
+
+// upcoming returns the next n times after t the schedule fires.
+func (s Schedule) upcoming(t time.Time, n int) ([]time.Time, error) {
+	times := make([]time.Time, 0, n)
+	for len(times) < n {
+		next, err := s.next(t)
+		if err != nil {
+			return nil, err
+		}
+		if next.IsZero() {
+			break
+		}
+		times = append(times, next)
+		t = next
+	}
+	return times, nil
+}
+
+// scheduleStore keeps schedules in memory and persists every change, last
+// runs included, to a JSON file of the state backend so they survive
+// restarts.
+type scheduleStore struct {
+	mu        sync.Mutex
+	path      string
+	retention time.Duration
+	now       func() time.Time
+	schedules map[string]*Schedule
+	modTime   time.Time
+}
+
+var schedules *scheduleStore
+
+func newScheduleStore(path string, retention time.Duration) *scheduleStore {
+	return &scheduleStore{
+		path:      path,
+		retention: retention,
+		now:       time.Now,
+		schedules: make(map[string]*Schedule),
+	}
+}
+
+// load reads the schedules file from the state backend. A missing file is
+// an empty store, entries written by hand without an id get one.
+func (s *scheduleStore) load() error {
+	raw, modTime, err := state.read(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var items []*Schedule
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return fmt.Errorf("invalid schedules file %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedules = make(map[string]*Schedule, len(items))
+	for _, item := range items {
+		if item.ID == "" {
+			item.ID = randomID(8)
+		}
+		s.schedules[item.ID] = item
+	}
+	s.modTime = modTime
+	return nil
+}
+
+// reloadIfChanged reloads the schedules file when it was modified by
+// something other than the store itself, e.g. edited by hand or replaced by
+// a deployment.
+func (s *scheduleStore) reloadIfChanged() (bool, error) {
+	if s.path == "" {
+		return false, nil
+	}
+
+	modTime, err := state.modified(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	unchanged := modTime.Equal(s.modTime)
+	s.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+	return true, s.load()
+}
+
+// save writes the store atomically. Callers must hold s.mu.
+func (s *scheduleStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	raw, err := json.MarshalIndent(s.sorted(func(*Schedule) bool { return true }), "", "  ")
+	if err != nil {
+		return err
+	}
+	modTime, err := state.write(s.path, raw)
+	if err != nil {
+		return err
+	}
+	s.modTime = modTime
+	return nil
+}
+
+// writeFileAtomic replaces path with raw through a temporary file, so
+// readers never see a partial file.
+func writeFileAtomic(path string, raw []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// sorted returns copies of the schedules matching keep, ordered by
+// creation. Callers must hold s.mu.
+func (s *scheduleStore) sorted(keep func(*Schedule) bool) []Schedule {
+	items := make([]Schedule, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		if keep(schedule) {
+			items = append(items, *schedule)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].CreatedAt.Equal(items[j].CreatedAt) {
+			return items[i].CreatedAt.Before(items[j].CreatedAt)
+		}
+		return items[i].ID < items[j].ID
+	})
+	return items
+}
+
+// list returns active schedules, or the trash when deleted is true.
+func (s *scheduleStore) list(deleted bool) []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sorted(func(schedule *Schedule) bool {
+		return (schedule.DeletedAt != nil) == deleted
+	})
+}
+
+func (s *scheduleStore) get(id string) (Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return Schedule{}, errScheduleNotFound
+	}
+	return *schedule, nil
+}
+
+func (s *scheduleStore) create(schedule Schedule) (Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now().UTC()
+	schedule.ID = randomID(8)
+	schedule.CreatedAt = now
+	schedule.UpdatedAt = now
+	schedule.DeletedAt = nil
+
+	s.schedules[schedule.ID] = &schedule
+	if err := s.save(); err != nil {
+		delete(s.schedules, schedule.ID)
+		return Schedule{}, err
+	}
+	return schedule, nil
+}
+
+// delete moves a schedule to the trash. Deleting a trashed schedule is a
+// no-op so retried DELETE requests don't extend its retention.
+func (s *scheduleStore) delete(id string) (Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return Schedule{}, errScheduleNotFound
+	}
+	if schedule.DeletedAt != nil {
+		return *schedule, nil
+	}
+
+	now := s.now().UTC()
+	schedule.DeletedAt = &now
+	schedule.UpdatedAt = now
+	if err := s.save(); err != nil {
+		schedule.DeletedAt = nil
+		return Schedule{}, err
+	}
+	return *schedule, nil
+}
+
+func (s *scheduleStore) restore(id string) (Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return Schedule{}, errScheduleNotFound
+	}
+	if schedule.DeletedAt == nil {
+		return Schedule{}, errScheduleNotDeleted
+	}
+
+	deletedAt := schedule.DeletedAt
+	schedule.DeletedAt = nil
+	schedule.UpdatedAt = s.now().UTC()
+	if err := s.save(); err != nil {
+		schedule.DeletedAt = deletedAt
+		return Schedule{}, err
+	}
+	return *schedule, nil
+}
+
+// declare creates or updates the schedules defined in the config file,
+// keyed by their id. Declared schedules found in the trash are restored,
+// schedules created through the API are left alone.
+func (s *scheduleStore) declare(items []Schedule) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now().UTC()
+	for _, item := range items {
+		s.upsert(item, now)
+	}
+	return s.save()
+}
+
+// upsert creates item or brings the schedule with its id in line with it,
+// restoring it from the trash, and reports what it did. Callers must hold
+// s.mu.
+func (s *scheduleStore) upsert(item Schedule, now time.Time) (created bool, updated bool) {
+	existing, ok := s.schedules[item.ID]
+	if !ok {
+		item.CreatedAt, item.UpdatedAt = now, now
+		s.schedules[item.ID] = &item
+		return true, false
+	}
+
+	if existing.Project == item.Project && existing.Instance == item.Instance && existing.Action == item.Action &&
+		existing.Cron == item.Cron && existing.Timezone == item.Timezone && existing.Kind == item.Kind &&
+		existing.Location == item.Location && existing.Chain == item.Chain && existing.BackupBeforeStop == item.BackupBeforeStop &&
+		reflect.DeepEqual(existing.ExportBeforeStop, item.ExportBeforeStop) && existing.Tier == item.Tier &&
+		slices.Equal(existing.NotifyEmails, item.NotifyEmails) && existing.DeletedAt == nil {
+		return false, false
+	}
+	existing.Project, existing.Instance, existing.Action = item.Project, item.Instance, item.Action
+	existing.Cron, existing.Timezone, existing.BackupBeforeStop = item.Cron, item.Timezone, item.BackupBeforeStop
+	existing.Kind, existing.Location, existing.Chain = item.Kind, item.Location, item.Chain
+	existing.ExportBeforeStop, existing.Tier = item.ExportBeforeStop, item.Tier
+	existing.NotifyEmails = item.NotifyEmails
+	existing.DeletedAt = nil
+	existing.UpdatedAt = now
+	return false, true
+}
+
+// ScheduleDiff lists what a sync changed, or would change on a dry run.
+type ScheduleDiff struct {
+	Created   []Schedule
+	Updated   []Schedule
+	Deleted   []Schedule
+	Unchanged int
+}
+
+// sync makes items, keyed by their id, the full set of active schedules:
+// missing ones are created, differing or trashed ones updated and active
+// schedules not in items moved to the trash. With dryRun the diff is
+// computed and nothing is changed.
+func (s *scheduleStore) sync(items []Schedule, dryRun bool) (ScheduleDiff, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := make(map[string]Schedule, len(s.schedules))
+	for id, schedule := range s.schedules {
+		previous[id] = *schedule
+	}
+	restore := func() {
+		s.schedules = make(map[string]*Schedule, len(previous))
+		for id, schedule := range previous {
+			s.schedules[id] = &schedule
+		}
+	}
+
+	var diff ScheduleDiff
+	now := s.now().UTC()
+	desired := make(map[string]bool, len(items))
+	for _, item := range items {
+		desired[item.ID] = true
+		switch created, updated := s.upsert(item, now); {
+		case created:
+			diff.Created = append(diff.Created, *s.schedules[item.ID])
+		case updated:
+			diff.Updated = append(diff.Updated, *s.schedules[item.ID])
+		default:
+			diff.Unchanged++
+		}
+	}
+	for _, schedule := range s.sorted(func(schedule *Schedule) bool { return schedule.DeletedAt == nil && !desired[schedule.ID] }) {
+		deletedAt := now
+		s.schedules[schedule.ID].DeletedAt = &deletedAt
+		s.schedules[schedule.ID].UpdatedAt = now
+		diff.Deleted = append(diff.Deleted, *s.schedules[schedule.ID])
+	}
+
+	if dryRun {
+		restore()
+		return diff, nil
+	}
+	if err := s.save(); err != nil {
+		restore()
+		return ScheduleDiff{}, err
+	}
+	return diff, nil
+}
+
+// recordRun stores the outcome of a scheduled run. Schedules deleted or
+// purged in the meantime are ignored.
+func (s *scheduleStore) recordRun(id string, at time.Time, runErr error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return nil
+	}
+
+	at = at.UTC()
+	schedule.LastRunAt = &at
+	schedule.LastError = ""
+	if runErr != nil {
+		schedule.LastError = runErr.Error()
+	}
+	return s.save()
+}
+
+// purge permanently removes schedules that have been in the trash longer
+// than the retention period and returns them.
+func (s *scheduleStore) purge() ([]Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := s.now().Add(-s.retention)
+	purged := s.sorted(func(schedule *Schedule) bool {
+		return schedule.DeletedAt != nil && schedule.DeletedAt.Before(cutoff)
+	})
+	if len(purged) == 0 {
+		return nil, nil
+	}
+
+	for _, schedule := range purged {
+		delete(s.schedules, schedule.ID)
+	}
+	return purged, s.save()
+}
+
+// purgeAt is when a trashed schedule will be removed for good.
+func (s *scheduleStore) purgeAt(schedule Schedule) *time.Time {
+	if schedule.DeletedAt == nil {
+		return nil
+	}
+	at := schedule.DeletedAt.Add(s.retention)
+	return &at
+}
+
+// runPurge purges the trash periodically until stop is closed.
+func (s *scheduleStore) runPurge(stop <-chan struct{}) {
+	ticker := time.NewTicker(schedulePurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := s.purge()
+		if err != nil {
+			slog.Error("Failed to purge deleted schedules", "error", err)
+		}
+		for _, schedule := range purged {
+			slog.Info("Purged deleted schedule", schedule.attrs()...)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ScheduleRequest is the body accepted by POST /schedules.
+type ScheduleRequest struct {
+	Project          string         `json:"project"`
+	Instance         string         `json:"instance"`
+	Action           string         `json:"action"`
+	Cron             string         `json:"cron"`
+	Timezone         string         `json:"timezone"`
+	Kind             string         `json:"kind"`
+	Location         string         `json:"location"`
+	Chain            string         `json:"chain"`
+	BackupBeforeStop bool           `json:"backup_before_stop" yaml:"backup_before_stop"`
+	ExportBeforeStop *ExportRequest `json:"export_before_stop" yaml:"export_before_stop"`
+	Tier             string         `json:"tier"`
+	NotifyEmails     []string       `json:"notify_emails" yaml:"notify_emails"`
+}
+
+func (req *ScheduleRequest) validate() validationErrors {
+	var errs validationErrors
+
+	switch {
+	case req.Chain != "" && (req.Instance != "" || req.Kind != "" || req.Location != ""):
+		errs = append(errs, fieldError{Field: "chain", Message: "replaces instance, kind and location, which must be left out"})
+	case req.Chain != "" && (req.Action == scheduleActionScale || req.Action == scheduleActionShrinkCheck || req.BackupBeforeStop || req.ExportBeforeStop != nil):
+		errs = append(errs, fieldError{Field: "chain", Message: "only supports start and stop schedules"})
+	case req.Chain == "" && req.Instance == "":
+		errs = append(errs, fieldError{Field: "instance", Message: "is required"})
+	}
+
+	switch req.Action {
+	case scheduleActionStart, scheduleActionStop, scheduleActionScale, scheduleActionShrinkCheck:
+	case "":
+		errs = append(errs, fieldError{Field: "action", Message: "is required"})
+	default:
+		errs = append(errs, fieldError{Field: "action", Message: "must be 'start', 'stop', 'scale' or 'shrink_check'"})
+	}
+
+	if req.Cron == "" {
+		errs = append(errs, fieldError{Field: "cron", Message: "is required"})
+	} else if _, err := cron.ParseStandard(req.Cron); err != nil {
+		errs = append(errs, fieldError{Field: "cron", Message: "is not a valid cron expression: " + err.Error()})
+	}
+
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			errs = append(errs, fieldError{Field: "timezone", Message: "is not a valid IANA timezone"})
+		}
+	}
+
+	// Other kinds of data stores are only started and stopped.
+	switch {
+	case req.Kind == "" || req.Kind == storeKindCloudSQL:
+	case !slices.Contains(storeKinds, req.Kind):
+		errs = append(errs, fieldError{Field: "kind", Message: "must be 'cloudsql', 'alloydb', 'redis' or 'gce'"})
+	case req.Location == "":
+		errs = append(errs, fieldError{Field: "location", Message: "is required for " + req.Kind + " schedules"})
+	case req.Action == scheduleActionScale || req.Action == scheduleActionShrinkCheck || req.BackupBeforeStop || req.ExportBeforeStop != nil:
+		errs = append(errs, fieldError{Field: "kind", Message: "only supports start and stop schedules"})
+	}
+
+	if req.BackupBeforeStop && req.Action != scheduleActionStop {
+		errs = append(errs, fieldError{Field: "backup_before_stop", Message: "only applies to stop schedules"})
+	}
+	if req.ExportBeforeStop != nil {
+		if req.Action != scheduleActionStop {
+			errs = append(errs, fieldError{Field: "export_before_stop", Message: "only applies to stop schedules"})
+		}
+		for _, err := range req.ExportBeforeStop.validate() {
+			errs = append(errs, fieldError{Field: "export_before_stop." + err.Field, Message: err.Message})
+		}
+	}
+
+	for i, address := range req.NotifyEmails {
+		if _, err := mail.ParseAddress(address); err != nil {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("notify_emails[%d]", i), Message: "is not an email address"})
+		}
+	}
+
+	switch {
+	case req.Action == scheduleActionScale && req.Tier == "":
+		errs = append(errs, fieldError{Field: "tier", Message: "is required for scale schedules"})
+	case req.Action == scheduleActionScale && !validTier.MatchString(req.Tier):
+		errs = append(errs, fieldError{Field: "tier", Message: "must be a Cloud SQL tier such as 'db-custom-2-7680'"})
+	case req.Action != scheduleActionScale && req.Tier != "":
+		errs = append(errs, fieldError{Field: "tier", Message: "only applies to scale schedules"})
+	}
+
+	return errs
+}
+
+// SyncSchedulesRequest is the body accepted by PUT /schedules: every
+// schedule that should exist, identified by an id chosen by the caller.
+type SyncSchedulesRequest struct {
+	Schedules []DeclaredSchedule `json:"schedules"`
+}
+
+func (req *SyncSchedulesRequest) validate() validationErrors {
+	var errs validationErrors
+	seen := make(map[string]int)
+	for i, item := range req.Schedules {
+		prefix := fmt.Sprintf("schedules[%d]", i)
+		switch first, ok := seen[item.ID]; {
+		case item.ID == "":
+			errs = append(errs, fieldError{Field: prefix + ".id", Message: "is required"})
+		case ok:
+			errs = append(errs, fieldError{Field: prefix + ".id", Message: fmt.Sprintf("is already used by schedules[%d]", first)})
+		default:
+			seen[item.ID] = i
+		}
+		for _, err := range item.validate() {
+			errs = append(errs, fieldError{Field: prefix + "." + err.Field, Message: err.Message})
+		}
+		if unknownChain(item.Chain) {
+			errs = append(errs, fieldError{Field: prefix + ".chain", Message: "is not a chain of the config file"})
+		}
+	}
+	return errs
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ScheduleData is the API representation of a Schedule.
+type ScheduleData struct {
+	ID               string         `json:"id"`
+	Project          string         `json:"project"`
+	Instance         string         `json:"instance"`
+	Action           string         `json:"action"`
+	Cron             string         `json:"cron"`
+	Timezone         string         `json:"timezone,omitempty"`
+	Kind             string         `json:"kind,omitempty"`
+	Location         string         `json:"location,omitempty"`
+	Chain            string         `json:"chain,omitempty"`
+	BackupBeforeStop bool           `json:"backup_before_stop,omitempty"`
+	ExportBeforeStop *ExportRequest `json:"export_before_stop,omitempty"`
+	Tier             string         `json:"tier,omitempty"`
+	NotifyEmails     []string       `json:"notify_emails,omitempty"`
+	CreatedAt        interface{}    `json:"created_at"`
+	UpdatedAt        interface{}    `json:"updated_at"`
+	DeletedAt        interface{}    `json:"deleted_at,omitempty"`
+	PurgeAt          interface{}    `json:"purge_at,omitempty"`
+	NextRunAt        interface{}    `json:"next_run_at,omitempty"`
+	LastRunAt        interface{}    `json:"last_run_at,omitempty"`
+	LastError        string         `json:"last_error,omitempty"`
+}
+
+func newScheduleData(schedule Schedule) ScheduleData {
+	data := ScheduleData{
+		ID:               schedule.ID,
+		Project:          schedule.Project,
+		Instance:         schedule.Instance,
+		Action:           schedule.Action,
+		Cron:             schedule.Cron,
+		Timezone:         schedule.Timezone,
+		Kind:             schedule.Kind,
+		Location:         schedule.Location,
+		Chain:            schedule.Chain,
+		BackupBeforeStop: schedule.BackupBeforeStop,
+		ExportBeforeStop: schedule.ExportBeforeStop,
+		Tier:             schedule.Tier,
+		NotifyEmails:     schedule.NotifyEmails,
+		CreatedAt:        formatTimestamp(schedule.CreatedAt),
+		UpdatedAt:        formatTimestamp(schedule.UpdatedAt),
+		LastError:        schedule.LastError,
+	}
+	if schedule.DeletedAt != nil {
+		data.DeletedAt = formatTimestamp(*schedule.DeletedAt)
+		data.PurgeAt = formatTimestamp(*schedules.purgeAt(schedule))
+	} else if next, err := schedule.next(schedules.now()); err == nil {
+		data.NextRunAt = formatTimestamp(next)
+	}
+	if schedule.LastRunAt != nil {
+		data.LastRunAt = formatTimestamp(*schedule.LastRunAt)
+	}
+	return data
+}
+
+func newScheduleDataList(items []Schedule) []ScheduleData {
+	data := make([]ScheduleData, 0, len(items))
+	for _, item := range items {
+		data = append(data, newScheduleData(item))
+	}
+	return data
+}
+
+// schedulesHandler serves GET /schedules (?deleted=true lists the trash),
+// POST /schedules and PUT /schedules.
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		items := schedules.list(r.URL.Query().Get("deleted") == "true")
+		writeSuccessResponse(w, r, http.StatusOK, msgSchedulesListed, newScheduleDataList(items))
+	case http.MethodPost:
+		createScheduleHandler(w, r)
+	case http.MethodPut:
+		syncSchedulesHandler(w, r)
+	default:
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+	}
+}
+
+func createScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var payload ScheduleRequest
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	errs := payload.validate()
+	if unknownChain(payload.Chain) {
+		errs = append(errs, fieldError{Field: "chain", Message: "is not a chain of the config file"})
+	}
+	if len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	project := payload.Project
+	if project == "" {
+		project = projectID.load()
+	}
+
+	schedule, err := schedules.create(Schedule{
+		Project:          project,
+		Instance:         payload.Instance,
+		Action:           payload.Action,
+		Cron:             payload.Cron,
+		Timezone:         payload.Timezone,
+		Kind:             payload.Kind,
+		Location:         payload.Location,
+		Chain:            payload.Chain,
+		BackupBeforeStop: payload.BackupBeforeStop,
+		ExportBeforeStop: payload.ExportBeforeStop,
+		Tier:             payload.Tier,
+		NotifyEmails:     payload.NotifyEmails,
+	})
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgScheduleSaveFailed, err)
+		return
+	}
+
+	writeSuccessResponse(w, r, http.StatusCreated, msgScheduleCreated, newScheduleData(schedule))
+}
+
+// ScheduleDiffData is the API representation of a ScheduleDiff.
+type ScheduleDiffData struct {
+	DryRun    bool           `json:"dry_run,omitempty"`
+	Created   []ScheduleData `json:"created"`
+	Updated   []ScheduleData `json:"updated"`
+	Deleted   []ScheduleData `json:"deleted"`
+	Unchanged int            `json:"unchanged"`
+}
+
+// syncSchedulesHandler replaces the active schedules with the ones in the
+// body, so a Terraform or GitOps pipeline can PUT its whole configuration
+// on every run. Applying the same body again changes nothing.
+func syncSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	var payload SyncSchedulesRequest
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if errs := payload.validate(); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	items := make([]Schedule, 0, len(payload.Schedules))
+	for _, item := range payload.Schedules {
+		project := item.Project
+		if project == "" {
+			project = projectID.load()
+		}
+		items = append(items, Schedule{
+			ID:               item.ID,
+			Project:          project,
+			Instance:         item.Instance,
+			Action:           item.Action,
+			Cron:             item.Cron,
+			Timezone:         item.Timezone,
+			Kind:             item.Kind,
+			Location:         item.Location,
+			Chain:            item.Chain,
+			BackupBeforeStop: item.BackupBeforeStop,
+			ExportBeforeStop: item.ExportBeforeStop,
+			Tier:             item.Tier,
+			NotifyEmails:     item.NotifyEmails,
+		})
+	}
+
+	diff, err := schedules.sync(items, isDryRun(r))
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgScheduleSaveFailed, err)
+		return
+	}
+
+	data := ScheduleDiffData{
+		DryRun:    isDryRun(r),
+		Created:   newScheduleDataList(diff.Created),
+		Updated:   newScheduleDataList(diff.Updated),
+		Deleted:   newScheduleDataList(diff.Deleted),
+		Unchanged: diff.Unchanged,
+	}
+	message := msgSchedulesSynced
+	if data.DryRun {
+		message = msgSchedulesSyncDryRun
+	}
+	writeSuccessResponse(w, r, http.StatusOK, message, data, len(data.Created), len(data.Updated), len(data.Deleted))
+}
+
+// scheduleHandler serves GET and DELETE /schedules/{id}. DELETE only moves
+// the schedule to the trash, see restoreScheduleHandler.
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		schedule Schedule
+		err      error
+		message  messageKey
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		schedule, err = schedules.get(r.PathValue("id"))
+		message = msgScheduleFetched
+	case http.MethodDelete:
+		schedule, err = schedules.delete(r.PathValue("id"))
+		message = msgScheduleDeleted
+	default:
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	if err != nil {
+		writeScheduleError(w, r, err)
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, message, newScheduleData(schedule))
+}
+
+func restoreScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	schedule, err := schedules.restore(r.PathValue("id"))
+	if err != nil {
+		writeScheduleError(w, r, err)
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgScheduleRestored, newScheduleData(schedule))
+}
+
+func writeScheduleError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errScheduleNotFound):
+		writeErrorResponse(w, r, http.StatusNotFound, msgScheduleNotFound, err, r.PathValue("id"))
+	case errors.Is(err, errScheduleNotDeleted):
+		writeErrorResponse(w, r, http.StatusConflict, msgScheduleNotDeleted, err, r.PathValue("id"))
+	default:
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgScheduleSaveFailed, err)
+	}
+}
+
+const (
+	defaultSchedulePreviewCount = 10
+	maxSchedulePreviewCount     = 100
+
+	defaultScheduleCalendarDays = 7
+	maxScheduleCalendarDays     = 31
+	// maxScheduleCalendarRuns bounds the calendar, a schedule firing every
+	// minute would otherwise list tens of thousands of runs.
+	maxScheduleCalendarRuns = 1000
+)
+
+// ScheduledActionData is one upcoming run of a schedule. LocalTime is in
+// the schedule's timezone. Skipped runs are start schedules falling on a
+// holiday and runs an override suspends.
+type ScheduledActionData struct {
+	ScheduleID string      `json:"schedule_id"`
+	Project    string      `json:"project"`
+	Instance   string      `json:"instance"`
+	Action     string      `json:"action"`
+	At         interface{} `json:"at"`
+	LocalTime  string      `json:"local_time"`
+	Timezone   string      `json:"timezone,omitempty"`
+	Skipped    bool        `json:"skipped,omitempty"`
+	Holiday    string      `json:"holiday,omitempty"`
+	Override   string      `json:"override,omitempty"`
+}
+
+// scheduledRun is an upcoming run with the time it is sorted by.
+type scheduledRun struct {
+	at   time.Time
+	data ScheduledActionData
+}
+
+// scheduledRuns returns the runs of the active schedules matching keep after
+// now and up to until, unless zero, at most limit of each schedule, in
+// order. Invalid schedules are logged and left out.
+func scheduledRuns(ctx context.Context, keep func(Schedule) bool, now time.Time, until time.Time, limit int) []scheduledRun {
+	var runs []scheduledRun
+	for _, schedule := range schedules.list(false) {
+		if !keep(schedule) {
+			continue
+		}
+		for at, n := now, 0; n < limit; n++ {
+			next, err := schedule.next(at)
+			if err != nil {
+				slog.ErrorContext(ctx, "Schedule is invalid", schedule.attrs("error", err)...)
+				break
+			}
+			if next.IsZero() || !until.IsZero() && next.After(until) {
+				break
+			}
+			runs = append(runs, scheduledRun{at: next, data: newScheduledActionData(schedule, next)})
+			at = next
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].at.Before(runs[j].at) })
+	return runs
+}
+
+// newScheduledActionData describes the run of schedule at t, with the
+// holiday or override skipping it.
+func newScheduledActionData(schedule Schedule, t time.Time) ScheduledActionData {
+	data := ScheduledActionData{
+		ScheduleID: schedule.ID,
+		Project:    schedule.Project,
+		Instance:   schedule.Instance,
+		Action:     schedule.Action,
+		At:         formatTimestamp(t),
+		LocalTime:  t.Format(time.DateTime),
+		Timezone:   schedule.Timezone,
+		Holiday:    schedule.skippedHoliday(t),
+	}
+	if override := overrides.skipping(schedule.Project, schedule.Instance, schedule.Action, t); override != nil {
+		data.Override = override.ID
+	}
+	data.Skipped = data.Holiday != "" || data.Override != ""
+	return data
+}
+
+// schedulePreviewHandler serves GET /v1/instances/{instance}/schedule, the
+// next ?count= (default 10) runs of the instance's schedules in order.
+func schedulePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	count := defaultSchedulePreviewCount
+	if raw := r.URL.Query().Get("count"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxSchedulePreviewCount {
+			writeDecodeError(w, r, validationErrors{{Field: "count", Message: fmt.Sprintf("must be between 1 and %d", maxSchedulePreviewCount)}})
+			return
+		}
+		count = n
+	}
+
+	project, instance := targetProject(r), targetInstance(r)
+	keep := func(schedule Schedule) bool {
+		return schedule.Project == project && schedule.Instance == instance
+	}
+	runs := scheduledRuns(r.Context(), keep, schedules.now(), time.Time{}, count)
+
+	data := make([]ScheduledActionData, 0, count)
+	for _, run := range runs[:min(count, len(runs))] {
+		data = append(data, run.data)
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgSchedulePreview, data)
+}
+
+// ScheduleCalendarData is the calendar of scheduled runs between From and
+// Until. Truncated is set when there were more than the runs listed.
+type ScheduleCalendarData struct {
+	From      interface{}           `json:"from"`
+	Until     interface{}           `json:"until"`
+	Runs      []ScheduledActionData `json:"runs"`
+	Truncated bool                  `json:"truncated,omitempty"`
+}
+
+// scheduleCalendarHandler serves GET /v1/schedule/preview, the runs of every
+// schedule in the next ?days= (default 7) in order, narrowed down with
+// ?project= and ?instance=, to check cron expressions, timezones, holidays
+// and overrides before relying on them.
+func scheduleCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	query := r.URL.Query()
+	days := defaultScheduleCalendarDays
+	if raw := query.Get("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxScheduleCalendarDays {
+			writeDecodeError(w, r, validationErrors{{Field: "days", Message: fmt.Sprintf("must be between 1 and %d", maxScheduleCalendarDays)}})
+			return
+		}
+		days = n
+	}
+
+	project, instance := query.Get("project"), query.Get("instance")
+	keep := func(schedule Schedule) bool {
+		return (project == "" || schedule.Project == project) && (instance == "" || schedule.Instance == instance)
+	}
+	now := schedules.now()
+	until := now.Add(time.Duration(days) * 24 * time.Hour)
+	runs := scheduledRuns(r.Context(), keep, now, until, maxScheduleCalendarRuns+1)
+
+	data := ScheduleCalendarData{From: formatTimestamp(now), Until: formatTimestamp(until), Runs: make([]ScheduledActionData, 0, len(runs))}
+	if len(runs) > maxScheduleCalendarRuns {
+		runs, data.Truncated = runs[:maxScheduleCalendarRuns], true
+	}
+	for _, run := range runs {
+		data.Runs = append(data.Runs, run.data)
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgScheduleCalendar, data, len(data.Runs), days)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// webhookSchemaVersion is the schema_version of the events posted to
+// generic webhooks. Fields are only ever added within a version, removing
+// or changing one bumps it.
+const webhookSchemaVersion = 1
+
+// webhookFieldDescriptions document the fields of NotificationEvent in the
+// published schema.
+var webhookFieldDescriptions = map[string]string{
+	"schema_version": "Version of this schema the event follows.",
+	"action":         "What was done, e.g. start, stop, scale, settings or backup.",
+	"project":        "Project of the instance.",
+	"instance":       "Name of the Cloud SQL instance.",
+	"source":         "What asked for the action: api, bulk, schedule, idle, delayed and so on.",
+	"triggered_by":   "The authenticated caller, the schedule or the component that acted.",
+	"schedule":       "Id of the schedule that triggered the action, if any.",
+	"operation":      "Name of the SQL Admin operation, once requested.",
+	"result":         "requested, failed or a result specific to the action, e.g. unexpected_state.",
+	"error":          "Why the action failed.",
+	"time":           "When the event happened.",
+	"text":           "The event rendered with NOTIFY_TEMPLATE.",
+}
+
+// webhookSchema is the JSON Schema of the events posted to generic
+// webhooks, derived from NotificationEvent like the OpenAPI document.
+// Receivers should accept fields they don't know.
+func webhookSchema() map[string]any {
+	b := &openAPIBuilder{schemas: map[string]any{}}
+	t := reflect.TypeOf(NotificationEvent{})
+	schema := b.structSchema(t)
+
+	properties := schema["properties"].(map[string]any)
+	for name, description := range webhookFieldDescriptions {
+		if property, ok := properties[name].(map[string]any); ok {
+			property["description"] = description
+		}
+	}
+	properties["schema_version"].(map[string]any)["const"] = webhookSchemaVersion
+
+	var required []string
+	for i := range t.NumField() {
+		name, options, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if !strings.Contains(","+options+",", ",omitempty,") {
+			required = append(required, name)
+		}
+	}
+	slices.Sort(required)
+
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = fmt.Sprintf("urn:scheduler-db:schemas:webhook:%d", webhookSchemaVersion)
+	schema["title"] = "NotificationEvent"
+	schema["description"] = "An action on a Cloud SQL instance, as posted to NOTIFY_WEBHOOK_URLS."
+	schema["required"] = required
+	schema["additionalProperties"] = true
+	return schema
+}
+
+// webhookSchemaHandler serves the JSON Schema of webhook events.
+func webhookSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(webhookSchema())
+}
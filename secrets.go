@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// secretReferencePrefix marks a setting read from Secret Manager, such as
+// AUTH_API_KEYS=secret:projects/my-project/secrets/api-keys. The version
+// defaults to latest.
+const secretReferencePrefix = "secret:"
+
+// defaultSecretsRefreshInterval is the default of SECRETS_REFRESH_INTERVAL.
+const defaultSecretsRefreshInterval = time.Hour
+
+// secretAccessTimeout bounds the Secret Manager calls of one load of the
+// configuration.
+const secretAccessTimeout = 30 * time.Second
+
+// secretManagerEndpoint overrides the Secret Manager API base URL. It is only
+// set in tests, where calls are sent unauthenticated.
+var secretManagerEndpoint string
+
+// secretVersionName completes a secret reference with the latest version
+// when it names none.
+func secretVersionName(reference string) (string, error) {
+	parts := strings.Split(reference, "/")
+	switch {
+	case len(parts) == 4 && parts[0] == "projects" && parts[2] == "secrets" && parts[1] != "" && parts[3] != "":
+		return reference + "/versions/latest", nil
+	case len(parts) == 6 && parts[0] == "projects" && parts[2] == "secrets" && parts[4] == "versions" && parts[1] != "" && parts[3] != "" && parts[5] != "":
+		return reference, nil
+	}
+	return "", fmt.Errorf("must be 'secret:' followed by a secret such as 'projects/my-project/secrets/api-keys' or one of its versions")
+}
+
+// secretDigest identifies the value of a secret in Config.Secrets, so a
+// rotation shows up in the reload diff without keeping the value twice.
+func secretDigest(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// secretReader reads the secrets referenced by the settings of one load of
+// the configuration. The client uses application default credentials, not
+// CREDENTIALS_FILE or CREDENTIALS_JSON, which may themselves be secrets.
+type secretReader struct {
+	service *secretmanager.Service
+	values  map[string]string
+	digests map[string]string
+	failed  map[string]bool
+}
+
+// read returns the value of the secret referenced by setting name.
+func (s *secretReader) read(name string, reference string) (string, error) {
+	if value, ok := s.values[name]; ok {
+		return value, nil
+	}
+	if s.values == nil {
+		s.values = make(map[string]string)
+		s.digests = make(map[string]string)
+		s.failed = make(map[string]bool)
+	}
+	version, err := secretVersionName(reference)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretAccessTimeout)
+	defer cancel()
+
+	if s.service == nil {
+		var opts []option.ClientOption
+		if secretManagerEndpoint != "" {
+			opts = append(opts, option.WithEndpoint(secretManagerEndpoint), option.WithoutAuthentication())
+		}
+		service, err := secretmanager.NewService(ctx, opts...)
+		if err != nil {
+			return "", fmt.Errorf("secret manager: %w", err)
+		}
+		s.service = service
+	}
+	response, err := s.service.Projects.Secrets.Versions.Access(version).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("cannot read %s: %w", version, err)
+	}
+	if response.Payload == nil {
+		return "", fmt.Errorf("%s has no payload", version)
+	}
+	data, err := base64.StdEncoding.DecodeString(response.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", version, err)
+	}
+
+	value := strings.TrimSpace(string(data))
+	s.values[name] = value
+	s.digests[name] = secretDigest(value)
+	return value, nil
+}
+
+// runSecretsRefresh reads the secrets of the configuration again every
+// SECRETS_REFRESH_INTERVAL and reloads it when one of them changed, so a
+// rotated key or webhook URL is picked up without a restart.
+func runSecretsRefresh(stop <-chan struct{}) {
+	for {
+		interval := activeConfig.load().SecretsRefresh
+		if interval <= 0 {
+			interval = defaultSecretsRefreshInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if config := activeConfig.load(); config.SecretsRefresh > 0 && len(config.Secrets) > 0 {
+			refreshSecrets(context.Background())
+		}
+	}
+}
+
+// refreshSecrets reloads the configuration when a secret it references
+// changed since it was applied.
+func refreshSecrets(ctx context.Context) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("Failed to refresh secrets", "error", err)
+		return
+	}
+	if maps.Equal(cfg.Secrets, activeConfig.load().Secrets) {
+		return
+	}
+	result, err := reloadConfig(ctx, cfg)
+	if err != nil {
+		slog.Error("Failed to apply rotated secrets", "error", err)
+		return
+	}
+	slog.Info("Applied rotated secrets", "changed", result.Changed, "restart_required", result.RestartRequired)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultHandlerTimeout    = 30 * time.Second
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultMaxHeaderBytes    = 64 << 10
+
+	// adminWriteTimeout leaves room for /debug/pprof/profile, which samples
+	// for 30s by default.
+	adminWriteTimeout = 2 * time.Minute
+)
+
+var handlerPanicsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "scheduler_db_handler_panics_total",
+	Help: "Requests whose handler panicked and were answered 500.",
+})
+
+// newServer builds the HTTP server. writeTimeout must cover the longest
+// per-route timeout, otherwise long-polling responses would be cut off.
+func newServer(addr string, handler http.Handler, writeTimeout time.Duration) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	// h2c lets gRPC-capable proxies (e.g. Cloud Run with --use-http2) speak
+	// HTTP/2 to the container without TLS.
+	protocols.SetUnencryptedHTTP2(enableH2C)
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readHeaderTimeout + handlerTimeout,
+		WriteTimeout:      writeTimeout + readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		Protocols:         protocols,
+	}
+	server.SetKeepAlivesEnabled(keepAlives)
+
+	return server
+}
+
+// handlerTimedOut is the body http.TimeoutHandler answers with once a
+// handler ran out of time, replaced by the error envelope.
+const handlerTimedOut = "scheduler-db: handler timed out"
+
+// withTimeout bounds a handler with http.TimeoutHandler so a hung SQL Admin
+// call can't pin the goroutine, answering 504 with the usual error envelope
+// like the other deadlines.
+func withTimeout(handler http.HandlerFunc, timeout time.Duration) http.Handler {
+	timeoutHandler := http.TimeoutHandler(handler, timeout, handlerTimedOut)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Header().Set("Content-Language", requestLanguage(r))
+		timeoutWriter := &gatewayTimeoutWriter{ResponseWriter: w, request: r, timeout: timeout}
+		timeoutHandler.ServeHTTP(timeoutWriter, r)
+		timeoutWriter.flush()
+	})
+}
+
+// gatewayTimeoutWriter turns the 503 http.TimeoutHandler answers once the
+// handler ran out of time into a 504 error envelope, built only then. A 503
+// of the handler itself is passed on: the status is held back until the
+// body shows which it is.
+type gatewayTimeoutWriter struct {
+	http.ResponseWriter
+	request *http.Request
+	timeout time.Duration
+	held    bool
+}
+
+func (w *gatewayTimeoutWriter) WriteHeader(statusCode int) {
+	if statusCode == http.StatusServiceUnavailable {
+		w.held = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *gatewayTimeoutWriter) Write(b []byte) (int, error) {
+	if w.held {
+		w.held = false
+		if string(b) == handlerTimedOut {
+			body, _ := json.Marshal(errorEnvelope(w.request, http.StatusGatewayTimeout, msgRequestTimedOut, context.DeadlineExceeded, w.timeout))
+			w.ResponseWriter.WriteHeader(http.StatusGatewayTimeout)
+			if _, err := w.ResponseWriter.Write(body); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+		w.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gatewayTimeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// flush sends a 503 still held back because no body followed it.
+func (w *gatewayTimeoutWriter) flush() {
+	if w.held {
+		w.held = false
+		w.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+// withRecovery answers a request whose handler panics with a 500 error
+// envelope and logs the stack, so one bad request can't take down the
+// process and the schedules running in it. When the response was already
+// started, the connection is dropped instead. http.ErrAbortHandler is
+// passed on, it is how handlers abort a response on purpose.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			if value == http.ErrAbortHandler {
+				panic(value)
+			}
+			handlerPanicsTotal.Inc()
+			slog.Error("Handler panicked", "method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(value), "stack", string(debug.Stack()))
+			if recorder.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeErrorResponse(recorder, r, http.StatusInternalServerError, msgInternalError, fmt.Sprintf("panic: %v", value))
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// patchableSettings is the allow-list of sqladmin.Settings fields (by JSON
+// name) that PATCH /v1/instances/{instance}/settings passes through.
+// Anything that can take an instance down or change its cost needs a
+// dedicated endpoint.
+var patchableSettings = map[string]bool{
+	"userLabels":                true,
+	"insightsConfig":            true,
+	"deletionProtectionEnabled": true,
+}
+
+// actionSettings names settings changes in notifications.
+const actionSettings = "settings"
+
+func patchSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	name := targetInstance(r)
+
+	var fields map[string]json.RawMessage
+	if err := decodeJSONBody(w, r, &fields); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	settings, errs := filterSettings(fields)
+	if len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	project := targetProject(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunPatch(project, name, &sqladmin.DatabaseInstance{Settings: settings}))
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	operation, err := sqlService.Instances.Patch(project, name, &sqladmin.DatabaseInstance{Settings: settings}).Context(ctx).Do()
+	event := newNotificationEvent(actionSettings, actionSourceAPI, requestPrincipal(r), project, name)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgSettingsPatchFailed, err)
+		return
+	}
+
+	operations.track(event, operation)
+	writeOperationResponse(w, r, project, name, operation, wait, timeout, operationSteps{}, msgSettingsPatched, msgSettingsPatchFailed)
+}
+
+// filterSettings rejects fields outside patchableSettings and strictly decodes
+// the remaining ones into sqladmin.Settings.
+func filterSettings(fields map[string]json.RawMessage) (*sqladmin.Settings, validationErrors) {
+	var errs validationErrors
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !patchableSettings[name] {
+			errs = append(errs, fieldError{Field: name, Message: "is not allowed to be patched"})
+		}
+	}
+	if len(fields) == 0 {
+		errs = append(errs, fieldError{Message: "body must contain at least one setting"})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	raw, _ := json.Marshal(fields)
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+
+	var settings sqladmin.Settings
+	if err := decoder.Decode(&settings); err != nil {
+		if v, ok := describeDecodeError(err).(validationErrors); ok {
+			return nil, v
+		}
+		return nil, validationErrors{{Message: err.Error()}}
+	}
+	return &settings, nil
+}
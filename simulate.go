@@ -0,0 +1,1197 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	alloydb "google.golang.org/api/alloydb/v1"
+	compute "google.golang.org/api/compute/v1"
+	monitoring "google.golang.org/api/monitoring/v3"
+	redis "google.golang.org/api/redis/v1"
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// Simulated operation latencies, roughly what Cloud SQL takes for a small
+// instance. Scaled by SIMULATE_LATENCY_SCALE.
+const (
+	simulatedStartLatency    = 40 * time.Second
+	simulatedStopLatency     = 20 * time.Second
+	simulatedPatchLatency    = 5 * time.Second
+	simulatedBackupLatency   = 30 * time.Second
+	simulatedRestartLatency  = 30 * time.Second
+	simulatedCloneLatency    = 3 * time.Minute
+	simulatedExportLatency   = time.Minute
+	simulatedImportLatency   = 2 * time.Minute
+	simulatedFailoverLatency = time.Minute
+	simulatedPromoteLatency  = 2 * time.Minute
+	simulatedUserLatency     = 2 * time.Second
+	simulatedRestoreLatency  = 3 * time.Minute
+)
+
+// fakeSQLAdmin is an in-memory implementation of the subset of the SQL Admin
+// REST API this service uses. Operations complete after a latency and their
+// effects are applied lazily on the next request, so no goroutines are
+// involved and state stays deterministic.
+type fakeSQLAdmin struct {
+	mu           sync.Mutex
+	now          func() time.Time
+	latencyScale float64
+	instances    map[string]*sqladmin.DatabaseInstance
+	operations   map[string]*fakeOperation
+	mux          *http.ServeMux
+
+	// unavailableTiers fail tier changes once applied, as when the zone
+	// runs out of capacity while the instance restarts.
+	unavailableTiers map[string]bool
+
+	// connections are the open connection counts reported to Cloud
+	// Monitoring, by project/instance. Instances without one report
+	// nothing.
+	connections map[string]int64
+
+	// cpu is the CPU utilization reported to Cloud Monitoring, by
+	// project/instance.
+	cpu map[string]float64
+
+	// diskUsed is the disk space used in bytes reported to Cloud
+	// Monitoring, by project/instance.
+	diskUsed map[string]int64
+
+	// files are the Cloud Storage files written by exports, imports of
+	// other files fail.
+	files map[string]bool
+
+	// users are the database users, by project/instance/name@host.
+	users map[string]*sqladmin.User
+
+	// backupRuns are the backup runs of each project/instance, oldest
+	// first, and lastBackupID the id of the last one taken.
+	backupRuns   map[string][]*sqladmin.BackupRun
+	lastBackupID int64
+
+	// alloyDBClusters, alloyDBInstances and redisInstances are the other
+	// kinds of data stores, by resource name, and vms the Compute Engine
+	// VMs by project/zone/name. Their changes apply at once.
+	alloyDBClusters  map[string]*alloydb.Cluster
+	alloyDBInstances map[string]*alloydb.Instance
+	redisInstances   map[string]*redis.Instance
+	vms              map[string]*compute.Instance
+}
+
+type fakeOperation struct {
+	op         *sqladmin.Operation
+	completeAt time.Time
+	apply      func()
+}
+
+func newFakeSQLAdmin(latencyScale float64) *fakeSQLAdmin {
+	f := &fakeSQLAdmin{
+		now:          time.Now,
+		latencyScale: latencyScale,
+		instances:    make(map[string]*sqladmin.DatabaseInstance),
+		operations:   make(map[string]*fakeOperation),
+		files:        make(map[string]bool),
+		users:        make(map[string]*sqladmin.User),
+		backupRuns:   make(map[string][]*sqladmin.BackupRun),
+		mux:          http.NewServeMux(),
+
+		alloyDBClusters:  make(map[string]*alloydb.Cluster),
+		alloyDBInstances: make(map[string]*alloydb.Instance),
+		redisInstances:   make(map[string]*redis.Instance),
+		vms:              make(map[string]*compute.Instance),
+	}
+
+	f.mux.HandleFunc("GET /v1/projects/{project}/instances", f.listInstances)
+	f.mux.HandleFunc("GET /v1/projects/{project}/instances/{instance}", f.getInstance)
+	f.mux.HandleFunc("PATCH /v1/projects/{project}/instances/{instance}", f.patchInstance)
+	f.mux.HandleFunc("GET /v1/projects/{project}/instances/{instance}/backupRuns", f.listBackupRuns)
+	f.mux.HandleFunc("GET /v1/projects/{project}/instances/{instance}/backupRuns/{id}", f.getBackupRun)
+	f.mux.HandleFunc("POST /v1/projects/{project}/instances/{instance}/backupRuns", f.insertBackupRun)
+	f.mux.HandleFunc("POST /v1/projects/{project}/instances/{instance}/restoreBackup", f.restoreBackup)
+	f.mux.HandleFunc("POST /v1/projects/{project}/instances/{instance}/restart", f.restartInstance)
+	f.mux.HandleFunc("POST /v1/projects/{project}/instances/{instance}/failover", f.failoverInstance)
+	f.mux.HandleFunc("POST /v1/projects/{project}/instances/{instance}/promoteReplica", f.promoteReplica)
+	f.mux.HandleFunc("POST /v1/projects/{project}/instances/{instance}/clone", f.cloneInstance)
+	f.mux.HandleFunc("POST /v1/projects/{project}/instances/{instance}/export", f.exportInstance)
+	f.mux.HandleFunc("POST /v1/projects/{project}/instances/{instance}/import", f.importInstance)
+	f.mux.HandleFunc("GET /v1/projects/{project}/instances/{instance}/users", f.listUsers)
+	f.mux.HandleFunc("POST /v1/projects/{project}/instances/{instance}/users", f.insertUser)
+	f.mux.HandleFunc("PUT /v1/projects/{project}/instances/{instance}/users", f.updateUser)
+	f.mux.HandleFunc("DELETE /v1/projects/{project}/instances/{instance}/users", f.deleteUser)
+	f.mux.HandleFunc("GET /v1/flags", f.listFlags)
+	f.mux.HandleFunc("GET /v1/projects/{project}/operations", f.listOperations)
+	f.mux.HandleFunc("GET /v1/projects/{project}/operations/{operation}", f.getOperation)
+	f.mux.HandleFunc("GET /v3/projects/{project}/timeSeries", f.listTimeSeries)
+	f.mux.HandleFunc("GET /v1/projects/{project}/locations/{location}/clusters", f.listAlloyDBClusters)
+	f.mux.HandleFunc("GET /v1/projects/{project}/locations/{location}/clusters/{cluster}", f.getAlloyDBCluster)
+	f.mux.HandleFunc("GET /v1/projects/{project}/locations/{location}/clusters/{cluster}/instances", f.listAlloyDBInstances)
+	f.mux.HandleFunc("PATCH /v1/projects/{project}/locations/{location}/clusters/{cluster}/instances/{instance}", f.patchAlloyDBInstance)
+	f.mux.HandleFunc("GET /v1/projects/{project}/locations/{location}/instances", f.listRedisInstances)
+	f.mux.HandleFunc("GET /v1/projects/{project}/locations/{location}/instances/{instance}", f.getRedisInstance)
+	f.mux.HandleFunc("PATCH /v1/projects/{project}/locations/{location}/instances/{instance}", f.patchRedisInstance)
+	f.mux.HandleFunc("GET /compute/v1/projects/{project}/aggregated/instances", f.listVMs)
+	f.mux.HandleFunc("GET /compute/v1/projects/{project}/zones/{zone}/instances/{instance}", f.getVM)
+	f.mux.HandleFunc("POST /compute/v1/projects/{project}/zones/{zone}/instances/{instance}/start", f.setVMStatus("RUNNING"))
+	f.mux.HandleFunc("POST /compute/v1/projects/{project}/zones/{zone}/instances/{instance}/stop", f.setVMStatus("TERMINATED"))
+
+	return f
+}
+
+// addInstance seeds an instance. Instances are created running unless their
+// activation policy is NEVER.
+func (f *fakeSQLAdmin) addInstance(instance *sqladmin.DatabaseInstance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if instance.Settings == nil {
+		instance.Settings = &sqladmin.Settings{}
+	}
+	if instance.Settings.ActivationPolicy == "" {
+		instance.Settings.ActivationPolicy = "ALWAYS"
+	}
+	if instance.State == "" {
+		instance.State = stateForPolicy(instance.Settings.ActivationPolicy)
+	}
+	if instance.Settings.SettingsVersion == 0 {
+		instance.Settings.SettingsVersion = 1
+	}
+	if instance.Settings.DataDiskSizeGb == 0 {
+		instance.Settings.DataDiskSizeGb = minDataDiskSizeGB
+	}
+	if instance.Settings.DataDiskType == "" {
+		instance.Settings.DataDiskType = "PD_SSD"
+	}
+	instance.Kind = "sql#instance"
+
+	f.instances[instance.Project+"/"+instance.Name] = instance
+}
+
+func stateForPolicy(policy string) string {
+	if policy == "NEVER" {
+		return "STOPPED"
+	}
+	return "RUNNABLE"
+}
+
+func (f *fakeSQLAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.advance()
+	f.mu.Unlock()
+
+	f.mux.ServeHTTP(w, r)
+}
+
+// advance applies every operation whose latency has elapsed. Callers must
+// hold f.mu.
+func (f *fakeSQLAdmin) advance() {
+	now := f.now()
+
+	pending := make([]*fakeOperation, 0, len(f.operations))
+	for _, operation := range f.operations {
+		if operation.op.Status != "DONE" && !now.Before(operation.completeAt) {
+			pending = append(pending, operation)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].completeAt.Before(pending[j].completeAt)
+	})
+
+	for _, operation := range pending {
+		operation.apply()
+		operation.op.Status = "DONE"
+		operation.op.EndTime = operation.completeAt.UTC().Format(time.RFC3339Nano)
+	}
+}
+
+func (f *fakeSQLAdmin) scale(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * f.latencyScale)
+}
+
+// startOperation registers an operation completing after latency. Callers
+// must hold f.mu.
+func (f *fakeSQLAdmin) startOperation(project string, instance string, operationType string, latency time.Duration, apply func()) *sqladmin.Operation {
+	id := make([]byte, 16)
+	rand.Read(id)
+	name := hex.EncodeToString(id)
+	now := f.now()
+
+	op := &sqladmin.Operation{
+		Kind:          "sql#operation",
+		Name:          name,
+		OperationType: operationType,
+		Status:        "RUNNING",
+		TargetId:      instance,
+		TargetProject: project,
+		InsertTime:    now.UTC().Format(time.RFC3339Nano),
+		StartTime:     now.UTC().Format(time.RFC3339Nano),
+		User:          "simulator@sql-scheduler",
+		SelfLink:      fmt.Sprintf("https://sqladmin.googleapis.com/v1/projects/%s/operations/%s", project, name),
+		TargetLink:    fmt.Sprintf("https://sqladmin.googleapis.com/v1/projects/%s/instances/%s", project, instance),
+	}
+	f.operations[name] = &fakeOperation{op: op, completeAt: now.Add(f.scale(latency)), apply: apply}
+
+	return op
+}
+
+func (f *fakeSQLAdmin) lookup(w http.ResponseWriter, r *http.Request) (*sqladmin.DatabaseInstance, bool) {
+	instance, ok := f.instances[r.PathValue("project")+"/"+r.PathValue("instance")]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "instanceDoesNotExist", "The Cloud SQL instance does not exist.")
+	}
+	return instance, ok
+}
+
+func (f *fakeSQLAdmin) getInstance(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if instance, ok := f.lookup(w, r); ok {
+		writeFakeJSON(w, instance)
+	}
+}
+
+func (f *fakeSQLAdmin) listInstances(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	project := r.PathValue("project")
+	var items []*sqladmin.DatabaseInstance
+	for _, instance := range f.instances {
+		if instance.Project == project {
+			items = append(items, instance)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	start = min(start, len(items))
+	end := len(items)
+	if maxResults, err := strconv.Atoi(r.URL.Query().Get("maxResults")); err == nil && maxResults > 0 {
+		end = min(start+maxResults, len(items))
+	}
+
+	response := &sqladmin.InstancesListResponse{Kind: "sql#instancesList", Items: items[start:end]}
+	if end < len(items) {
+		response.NextPageToken = strconv.Itoa(end)
+	}
+	writeFakeJSON(w, response)
+}
+
+// patchInstance merges the request body into the instance once the
+// operation completes, the way Instances.Patch applies partial updates.
+// Changing the activation policy moves the instance to RUNNABLE or STOPPED.
+func (f *fakeSQLAdmin) patchInstance(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	var patch map[string]interface{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+
+	if f.inProgress(instance) {
+		writeFakeError(w, http.StatusConflict, "operationInProgress", "Operation failed because another operation was already in progress.")
+		return
+	}
+
+	latency := simulatedPatchLatency
+	var policy, tier string
+	if settings, ok := patch["settings"].(map[string]interface{}); ok {
+		policy, _ = settings["activationPolicy"].(string)
+		tier, _ = settings["tier"].(string)
+	}
+	switch {
+	case policy == "ALWAYS" && instance.State != "RUNNABLE":
+		latency = simulatedStartLatency
+	case policy == "NEVER" && instance.State == "RUNNABLE":
+		latency = simulatedStopLatency
+	case tier != "" && tier != instance.Settings.Tier:
+		// Changing the tier restarts the instance.
+		latency = simulatedRestartLatency
+	}
+
+	var op *sqladmin.Operation
+	op = f.startOperation(instance.Project, instance.Name, "UPDATE", latency, func() {
+		mergeInstance(instance, patch)
+		instance.Settings.SettingsVersion++
+		if policy != "" {
+			instance.State = stateForPolicy(policy)
+		}
+		if f.unavailableTiers[tier] {
+			op.Error = &sqladmin.OperationErrors{Errors: []*sqladmin.OperationError{{
+				Code:    "ZONE_RESOURCE_POOL_EXHAUSTED",
+				Message: "The zone does not have enough resources available to fulfill the request.",
+			}}}
+		}
+	})
+	writeFakeJSON(w, op)
+}
+
+// insertBackupRun takes a backup of a running instance. The run is
+// listed at once and turns SUCCESSFUL when its operation completes.
+func (f *fakeSQLAdmin) insertBackupRun(w http.ResponseWriter, r *http.Request) {
+	var request sqladmin.BackupRun
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeFakeError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	if instance.State != "RUNNABLE" {
+		writeFakeError(w, http.StatusBadRequest, "invalidState", "Backups can only be taken of running instances.")
+		return
+	}
+	if f.inProgress(instance) {
+		writeFakeError(w, http.StatusConflict, "operationInProgress", "Operation failed because another operation was already in progress.")
+		return
+	}
+
+	f.lastBackupID++
+	run := &sqladmin.BackupRun{
+		Kind:        "sql#backupRun",
+		Id:          f.lastBackupID,
+		Instance:    instance.Name,
+		Status:      "RUNNING",
+		Type:        "ON_DEMAND",
+		Description: request.Description,
+		Location:    request.Location,
+		StartTime:   f.now().UTC().Format(time.RFC3339Nano),
+	}
+	key := instance.Project + "/" + instance.Name
+	f.backupRuns[key] = append(f.backupRuns[key], run)
+	writeFakeJSON(w, f.startOperation(instance.Project, instance.Name, "BACKUP_VOLUME", simulatedBackupLatency, func() {
+		run.Status = "SUCCESSFUL"
+		run.EndTime = f.now().UTC().Format(time.RFC3339Nano)
+	}))
+}
+
+// listBackupRuns serves the backup runs of an instance, newest first, up
+// to ?maxResults=.
+func (f *fakeSQLAdmin) listBackupRuns(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	runs := f.backupRuns[instance.Project+"/"+instance.Name]
+	response := &sqladmin.BackupRunsListResponse{Kind: "sql#backupRunsList"}
+	for i := len(runs) - 1; i >= 0; i-- {
+		response.Items = append(response.Items, runs[i])
+	}
+	if max, err := strconv.Atoi(r.URL.Query().Get("maxResults")); err == nil && max < len(response.Items) {
+		response.Items = response.Items[:max]
+	}
+	writeFakeJSON(w, response)
+}
+
+func (f *fakeSQLAdmin) getBackupRun(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	if run := f.backupRun(instance.Project, instance.Name, r.PathValue("id")); run != nil {
+		writeFakeJSON(w, run)
+		return
+	}
+	writeFakeError(w, http.StatusNotFound, "backupRunDoesNotExist", "The backup run does not exist.")
+}
+
+// backupRun returns the backup run id of project/instance, nil when there
+// is none.
+func (f *fakeSQLAdmin) backupRun(project string, instance string, id string) *sqladmin.BackupRun {
+	for _, run := range f.backupRuns[project+"/"+instance] {
+		if strconv.FormatInt(run.Id, 10) == id {
+			return run
+		}
+	}
+	return nil
+}
+
+// restoreBackup restores a successful backup run into an instance, which
+// is unavailable until the restore completes.
+func (f *fakeSQLAdmin) restoreBackup(w http.ResponseWriter, r *http.Request) {
+	var request sqladmin.InstancesRestoreBackupRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.RestoreBackupContext == nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid", "restoreBackupContext is required.")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	source := request.RestoreBackupContext
+	if source.Project == "" {
+		source.Project = instance.Project
+	}
+	if source.InstanceId == "" {
+		source.InstanceId = instance.Name
+	}
+	run := f.backupRun(source.Project, source.InstanceId, strconv.FormatInt(source.BackupRunId, 10))
+	if run == nil || run.Status != "SUCCESSFUL" {
+		writeFakeError(w, http.StatusNotFound, "backupRunDoesNotExist", "The backup run does not exist or hasn't succeeded.")
+		return
+	}
+	if f.inProgress(instance) {
+		writeFakeError(w, http.StatusConflict, "operationInProgress", "Operation failed because another operation was already in progress.")
+		return
+	}
+
+	state := instance.State
+	instance.State = "MAINTENANCE"
+	writeFakeJSON(w, f.startOperation(instance.Project, instance.Name, "RESTORE_VOLUME", simulatedRestoreLatency, func() {
+		instance.State = state
+	}))
+}
+
+// restartInstance restarts a running instance, it stays RUNNABLE.
+func (f *fakeSQLAdmin) restartInstance(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	if instance.State != "RUNNABLE" {
+		writeFakeError(w, http.StatusBadRequest, "invalidState", "Only running instances can be restarted.")
+		return
+	}
+	if f.inProgress(instance) {
+		writeFakeError(w, http.StatusConflict, "operationInProgress", "Operation failed because another operation was already in progress.")
+		return
+	}
+
+	writeFakeJSON(w, f.startOperation(instance.Project, instance.Name, "RESTART", simulatedRestartLatency, func() {}))
+}
+
+// failoverInstance moves the primary of a high availability instance to the
+// zone of its standby. The settings version must be the current one.
+func (f *fakeSQLAdmin) failoverInstance(w http.ResponseWriter, r *http.Request) {
+	var body sqladmin.InstancesFailoverRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FailoverContext == nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid", "failoverContext is required.")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	if instance.Settings.AvailabilityType != "REGIONAL" {
+		writeFakeError(w, http.StatusBadRequest, "invalidOperation", "The instance is not configured for high availability.")
+		return
+	}
+	if instance.State != "RUNNABLE" {
+		writeFakeError(w, http.StatusBadRequest, "invalidState", "Only running instances can fail over.")
+		return
+	}
+	if body.FailoverContext.SettingsVersion != instance.Settings.SettingsVersion {
+		writeFakeError(w, http.StatusPreconditionFailed, "staleData", "The settings version is out of date.")
+		return
+	}
+	if f.inProgress(instance) {
+		writeFakeError(w, http.StatusConflict, "operationInProgress", "Operation failed because another operation was already in progress.")
+		return
+	}
+
+	writeFakeJSON(w, f.startOperation(instance.Project, instance.Name, "FAILOVER", simulatedFailoverLatency, func() {
+		instance.GceZone, instance.SecondaryGceZone = instance.SecondaryGceZone, instance.GceZone
+	}))
+}
+
+// promoteReplica turns a read replica into a standalone instance and drops
+// it from the replicas of its primary.
+func (f *fakeSQLAdmin) promoteReplica(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	if instance.MasterInstanceName == "" {
+		writeFakeError(w, http.StatusBadRequest, "invalidOperation", "The instance is not a read replica.")
+		return
+	}
+	if f.inProgress(instance) {
+		writeFakeError(w, http.StatusConflict, "operationInProgress", "Operation failed because another operation was already in progress.")
+		return
+	}
+
+	writeFakeJSON(w, f.startOperation(instance.Project, instance.Name, "PROMOTE_REPLICA", simulatedPromoteLatency, func() {
+		project, name, _ := strings.Cut(instance.MasterInstanceName, ":")
+		if primary, ok := f.instances[project+"/"+name]; ok {
+			primary.ReplicaNames = slices.DeleteFunc(primary.ReplicaNames, func(replica string) bool { return replica == instance.Name })
+		}
+		instance.MasterInstanceName = ""
+		instance.InstanceType = "CLOUD_SQL_INSTANCE"
+		instance.ReplicaConfiguration = nil
+	}))
+}
+
+// cloneInstance copies an instance into a new one, created running with the
+// settings of the source once the operation completes.
+func (f *fakeSQLAdmin) cloneInstance(w http.ResponseWriter, r *http.Request) {
+	var body sqladmin.InstancesCloneRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.CloneContext == nil || body.CloneContext.DestinationInstanceName == "" {
+		writeFakeError(w, http.StatusBadRequest, "invalid", "cloneContext.destinationInstanceName is required.")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	source, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	name := body.CloneContext.DestinationInstanceName
+	if _, exists := f.instances[source.Project+"/"+name]; exists {
+		writeFakeError(w, http.StatusConflict, "instanceAlreadyExists", "The Cloud SQL instance already exists.")
+		return
+	}
+
+	settings := *source.Settings
+	settings.ActivationPolicy, settings.SettingsVersion = "ALWAYS", 1
+	settings.UserLabels = maps.Clone(source.Settings.UserLabels)
+	clone := &sqladmin.DatabaseInstance{
+		Kind:            "sql#instance",
+		Name:            name,
+		Project:         source.Project,
+		Region:          source.Region,
+		DatabaseVersion: source.DatabaseVersion,
+		State:           "PENDING_CREATE",
+		Settings:        &settings,
+	}
+	f.instances[clone.Project+"/"+clone.Name] = clone
+
+	writeFakeJSON(w, f.startOperation(clone.Project, clone.Name, "CLONE", simulatedCloneLatency, func() {
+		clone.State = "RUNNABLE"
+	}))
+}
+
+// exportInstance exports a running instance. The operation carries the
+// export context, as in the SQL Admin API.
+func (f *fakeSQLAdmin) exportInstance(w http.ResponseWriter, r *http.Request) {
+	var body sqladmin.InstancesExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ExportContext == nil || body.ExportContext.Uri == "" {
+		writeFakeError(w, http.StatusBadRequest, "invalid", "exportContext.uri is required.")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	if instance.State != "RUNNABLE" {
+		writeFakeError(w, http.StatusBadRequest, "invalidState", "Exports can only be taken of running instances.")
+		return
+	}
+	if f.inProgress(instance) {
+		writeFakeError(w, http.StatusConflict, "operationInProgress", "Operation failed because another operation was already in progress.")
+		return
+	}
+
+	uri := body.ExportContext.Uri
+	op := f.startOperation(instance.Project, instance.Name, "EXPORT", simulatedExportLatency, func() { f.files[uri] = true })
+	op.ExportContext = body.ExportContext
+	writeFakeJSON(w, op)
+}
+
+// importInstance imports a file into a running instance. Importing a file
+// no export wrote fails once the operation completes, as Cloud SQL only
+// finds out when it reads the file.
+func (f *fakeSQLAdmin) importInstance(w http.ResponseWriter, r *http.Request) {
+	var body sqladmin.InstancesImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ImportContext == nil || body.ImportContext.Uri == "" {
+		writeFakeError(w, http.StatusBadRequest, "invalid", "importContext.uri is required.")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	if instance.State != "RUNNABLE" {
+		writeFakeError(w, http.StatusBadRequest, "invalidState", "Imports can only be run on running instances.")
+		return
+	}
+	if f.inProgress(instance) {
+		writeFakeError(w, http.StatusConflict, "operationInProgress", "Operation failed because another operation was already in progress.")
+		return
+	}
+
+	uri := body.ImportContext.Uri
+	var op *sqladmin.Operation
+	op = f.startOperation(instance.Project, instance.Name, "IMPORT", simulatedImportLatency, func() {
+		if !f.files[uri] {
+			op.Error = &sqladmin.OperationErrors{Errors: []*sqladmin.OperationError{{
+				Code:    "ERROR_RDBMS",
+				Message: "Unable to read " + uri + ": the object does not exist.",
+			}}}
+		}
+	})
+	op.ImportContext = body.ImportContext
+	writeFakeJSON(w, op)
+}
+
+// inProgress reports whether instance has an unfinished operation. Callers
+// must hold f.mu.
+func (f *fakeSQLAdmin) inProgress(instance *sqladmin.DatabaseInstance) bool {
+	for _, operation := range f.operations {
+		if operation.op.Status != "DONE" && operation.op.TargetProject == instance.Project && operation.op.TargetId == instance.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeInstance applies a JSON merge patch to instance.
+func mergeInstance(instance *sqladmin.DatabaseInstance, patch map[string]interface{}) {
+	raw, _ := json.Marshal(instance)
+
+	var current map[string]interface{}
+	json.Unmarshal(raw, &current)
+	mergeJSON(current, patch)
+
+	raw, _ = json.Marshal(current)
+	var merged sqladmin.DatabaseInstance
+	json.Unmarshal(raw, &merged)
+	*instance = merged
+}
+
+func mergeJSON(dst map[string]interface{}, patch map[string]interface{}) {
+	for key, value := range patch {
+		child, isMap := value.(map[string]interface{})
+		existing, hasMap := dst[key].(map[string]interface{})
+		if isMap && hasMap {
+			mergeJSON(existing, child)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+// fakeFlags are a few of the flags Cloud SQL supports.
+var fakeFlags = []*sqladmin.Flag{
+	{Name: "cloudsql.iam_authentication", Type: "BOOLEAN", AppliesTo: []string{"POSTGRES_14", "POSTGRES_15"}},
+	{Name: "log_min_duration_statement", Type: "INTEGER", MinValue: -1, MaxValue: 2147483647, AppliesTo: []string{"POSTGRES_14", "POSTGRES_15"}},
+	{Name: "max_connections", Type: "INTEGER", MinValue: 14, MaxValue: 262143, RequiresRestart: true, AppliesTo: []string{"POSTGRES_14", "POSTGRES_15", "MYSQL_8_0"}},
+	{Name: "skip_show_database", Type: "NONE", AppliesTo: []string{"MYSQL_8_0"}},
+	{Name: "slow_query_log", Type: "BOOLEAN", AppliesTo: []string{"MYSQL_8_0"}},
+}
+
+// listFlags lists fakeFlags, those applying to ?databaseVersion= when set.
+func userKey(project string, instance string, name string, host string) string {
+	return project + "/" + instance + "/" + name + "@" + host
+}
+
+// listUsers serves the users of an instance, without their passwords like
+// the real API.
+func (f *fakeSQLAdmin) listUsers(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	response := &sqladmin.UsersListResponse{Kind: "sql#usersList"}
+	for _, key := range sortedKeys(f.users) {
+		if user := f.users[key]; user.Project == instance.Project && user.Instance == instance.Name {
+			listed := *user
+			listed.Password = ""
+			response.Items = append(response.Items, &listed)
+		}
+	}
+	writeFakeJSON(w, response)
+}
+
+func (f *fakeSQLAdmin) insertUser(w http.ResponseWriter, r *http.Request) {
+	var user sqladmin.User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	key := userKey(instance.Project, instance.Name, user.Name, user.Host)
+	if _, exists := f.users[key]; exists {
+		writeFakeError(w, http.StatusConflict, "userAlreadyExists", "The user already exists.")
+		return
+	}
+	user.Project, user.Instance, user.Kind = instance.Project, instance.Name, "sql#user"
+	writeFakeJSON(w, f.startOperation(instance.Project, instance.Name, "CREATE_USER", simulatedUserLatency, func() {
+		f.users[key] = &user
+	}))
+}
+
+// updateUser changes the password of the user named by ?name= and ?host=.
+func (f *fakeSQLAdmin) updateUser(w http.ResponseWriter, r *http.Request) {
+	var patch sqladmin.User
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	user, ok := f.users[userKey(instance.Project, instance.Name, r.URL.Query().Get("name"), r.URL.Query().Get("host"))]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "userDoesNotExist", "The user does not exist.")
+		return
+	}
+	writeFakeJSON(w, f.startOperation(instance.Project, instance.Name, "UPDATE_USER", simulatedUserLatency, func() {
+		user.Password = patch.Password
+	}))
+}
+
+func (f *fakeSQLAdmin) deleteUser(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.lookup(w, r)
+	if !ok {
+		return
+	}
+	key := userKey(instance.Project, instance.Name, r.URL.Query().Get("name"), r.URL.Query().Get("host"))
+	if _, ok := f.users[key]; !ok {
+		writeFakeError(w, http.StatusNotFound, "userDoesNotExist", "The user does not exist.")
+		return
+	}
+	writeFakeJSON(w, f.startOperation(instance.Project, instance.Name, "DELETE_USER", simulatedUserLatency, func() {
+		delete(f.users, key)
+	}))
+}
+
+func (f *fakeSQLAdmin) listFlags(w http.ResponseWriter, r *http.Request) {
+	version := r.URL.Query().Get("databaseVersion")
+	response := &sqladmin.FlagsListResponse{Kind: "sql#flagsList"}
+	for _, flag := range fakeFlags {
+		if version == "" || slices.Contains(flag.AppliesTo, version) {
+			response.Items = append(response.Items, flag)
+		}
+	}
+	writeFakeJSON(w, response)
+}
+
+func (f *fakeSQLAdmin) getOperation(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	operation, ok := f.operations[r.PathValue("operation")]
+	if !ok || operation.op.TargetProject != r.PathValue("project") {
+		writeFakeError(w, http.StatusNotFound, "operationDoesNotExist", "The Cloud SQL operation does not exist.")
+		return
+	}
+	writeFakeJSON(w, operation.op)
+}
+
+func (f *fakeSQLAdmin) listOperations(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	project := r.PathValue("project")
+	instance := r.URL.Query().Get("instance")
+
+	var items []*sqladmin.Operation
+	for _, operation := range f.operations {
+		if operation.op.TargetProject == project && (instance == "" || operation.op.TargetId == instance) {
+			items = append(items, operation.op)
+		}
+	}
+	// Newest first, like the real API.
+	sort.Slice(items, func(i, j int) bool { return items[i].InsertTime > items[j].InsertTime })
+
+	writeFakeJSON(w, &sqladmin.OperationsListResponse{Kind: "sql#operationsList", Items: items})
+}
+
+// listTimeSeries serves the connection count, the CPU utilization or the
+// disk usage of the instance named by the database_id of the filter, the
+// only Cloud Monitoring queries made.
+func (f *fakeSQLAdmin) listTimeSeries(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	filter := r.URL.Query().Get("filter")
+	_, databaseID, _ := strings.Cut(filter, `resource.labels.database_id = "`)
+	project, instance, _ := strings.Cut(strings.TrimSuffix(databaseID, `"`), ":")
+	key := project + "/" + instance
+
+	var metric string
+	var value *monitoring.TypedValue
+	if strings.Contains(filter, cpuUtilizationMetric) {
+		if utilization, ok := f.cpu[key]; ok {
+			metric, value = cpuUtilizationMetric, &monitoring.TypedValue{DoubleValue: &utilization}
+		}
+	} else if strings.Contains(filter, diskBytesUsedMetric) {
+		if used, ok := f.diskUsed[key]; ok {
+			metric, value = diskBytesUsedMetric, &monitoring.TypedValue{Int64Value: &used}
+		}
+	} else if count, ok := f.connections[key]; ok {
+		metric, value = connectionsMetric, &monitoring.TypedValue{Int64Value: &count}
+	}
+
+	response := &monitoring.ListTimeSeriesResponse{}
+	if value != nil {
+		response.TimeSeries = []*monitoring.TimeSeries{{
+			Metric: &monitoring.Metric{Type: metric},
+			Points: []*monitoring.Point{{
+				Interval: &monitoring.TimeInterval{EndTime: f.now().UTC().Format(time.RFC3339)},
+				Value:    value,
+			}},
+		}}
+	}
+	writeFakeJSON(w, response)
+}
+
+// addAlloyDBCluster seeds a running AlloyDB cluster with a primary instance.
+func (f *fakeSQLAdmin) addAlloyDBCluster(project string, location string, name string, labels map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cluster := fmt.Sprintf("projects/%s/locations/%s/clusters/%s", project, location, name)
+	f.alloyDBClusters[cluster] = &alloydb.Cluster{Name: cluster, State: "READY", Labels: labels}
+	f.alloyDBInstances[cluster+"/instances/"+name+"-primary"] = &alloydb.Instance{
+		Name:         cluster + "/instances/" + name + "-primary",
+		InstanceType: "PRIMARY",
+		State:        "READY",
+	}
+}
+
+// addRedisInstance seeds a ready Memorystore for Redis instance.
+func (f *fakeSQLAdmin) addRedisInstance(project string, location string, name string, memorySizeGb int64, labels map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance := fmt.Sprintf("projects/%s/locations/%s/instances/%s", project, location, name)
+	f.redisInstances[instance] = &redis.Instance{Name: instance, State: "READY", Tier: "BASIC", MemorySizeGb: memorySizeGb, Labels: labels}
+}
+
+// inLocations reports whether the resource name is under the project and
+// location of the request, any location for "-".
+func inLocations(r *http.Request, name string) bool {
+	parent := "projects/" + r.PathValue("project") + "/locations/"
+	if location := r.PathValue("location"); location != "-" {
+		parent += location + "/"
+	}
+	return strings.HasPrefix(name, parent)
+}
+
+// doneOperation is a long-running operation of the AlloyDB and Memorystore
+// APIs that already completed.
+func (f *fakeSQLAdmin) doneOperation(r *http.Request) map[string]interface{} {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return map[string]interface{}{
+		"name": fmt.Sprintf("projects/%s/locations/%s/operations/operation-%s", r.PathValue("project"), r.PathValue("location"), hex.EncodeToString(id)),
+		"done": true,
+	}
+}
+
+func (f *fakeSQLAdmin) listAlloyDBClusters(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	response := &alloydb.ListClustersResponse{}
+	for _, name := range sortedKeys(f.alloyDBClusters) {
+		if inLocations(r, name) {
+			response.Clusters = append(response.Clusters, f.alloyDBClusters[name])
+		}
+	}
+	writeFakeJSON(w, response)
+}
+
+func (f *fakeSQLAdmin) getAlloyDBCluster(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cluster, ok := f.alloyDBClusters[strings.TrimPrefix(r.URL.Path, "/v1/")]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "notFound", "The AlloyDB cluster does not exist.")
+		return
+	}
+	writeFakeJSON(w, cluster)
+}
+
+func (f *fakeSQLAdmin) listAlloyDBInstances(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/") + "/"
+	response := &alloydb.ListInstancesResponse{}
+	for _, name := range sortedKeys(f.alloyDBInstances) {
+		if strings.HasPrefix(name, prefix) {
+			response.Instances = append(response.Instances, f.alloyDBInstances[name])
+		}
+	}
+	writeFakeJSON(w, response)
+}
+
+// patchAlloyDBInstance applies an activation policy change, the only patch
+// made, and stops or starts the cluster along with its primary.
+func (f *fakeSQLAdmin) patchAlloyDBInstance(w http.ResponseWriter, r *http.Request) {
+	var patch struct {
+		ActivationPolicy string `json:"activationPolicy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || r.URL.Query().Get("updateMask") != "activationPolicy" {
+		writeFakeError(w, http.StatusBadRequest, "invalid", "Only the activation policy can be patched.")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.alloyDBInstances[strings.TrimPrefix(r.URL.Path, "/v1/")]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "notFound", "The AlloyDB instance does not exist.")
+		return
+	}
+	state := map[string]string{"ALWAYS": "READY", "NEVER": "STOPPED"}[patch.ActivationPolicy]
+	if state == "" {
+		writeFakeError(w, http.StatusBadRequest, "invalid", "Unknown activation policy "+patch.ActivationPolicy+".")
+		return
+	}
+	instance.State = state
+	if instance.InstanceType == "PRIMARY" {
+		cluster, _, _ := strings.Cut(instance.Name, "/instances/")
+		f.alloyDBClusters[cluster].State = state
+	}
+	writeFakeJSON(w, f.doneOperation(r))
+}
+
+func (f *fakeSQLAdmin) listRedisInstances(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	response := &redis.ListInstancesResponse{}
+	for _, name := range sortedKeys(f.redisInstances) {
+		if inLocations(r, name) {
+			response.Instances = append(response.Instances, f.redisInstances[name])
+		}
+	}
+	writeFakeJSON(w, response)
+}
+
+func (f *fakeSQLAdmin) getRedisInstance(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.redisInstances[strings.TrimPrefix(r.URL.Path, "/v1/")]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "notFound", "The Redis instance does not exist.")
+		return
+	}
+	writeFakeJSON(w, instance)
+}
+
+// patchRedisInstance applies the memory size and labels of the patch, the
+// only fields changed.
+func (f *fakeSQLAdmin) patchRedisInstance(w http.ResponseWriter, r *http.Request) {
+	var patch redis.Instance
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance, ok := f.redisInstances[strings.TrimPrefix(r.URL.Path, "/v1/")]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "notFound", "The Redis instance does not exist.")
+		return
+	}
+	if patch.MemorySizeGb < 1 {
+		writeFakeError(w, http.StatusBadRequest, "invalid", "memorySizeGb must be at least 1.")
+		return
+	}
+	instance.MemorySizeGb, instance.Labels = patch.MemorySizeGb, patch.Labels
+	writeFakeJSON(w, f.doneOperation(r))
+}
+
+// addVM seeds a running Compute Engine VM.
+func (f *fakeSQLAdmin) addVM(project string, zone string, name string, labels map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.vms[project+"/"+zone+"/"+name] = &compute.Instance{
+		Name:   name,
+		Zone:   fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/zones/%s", project, zone),
+		Status: "RUNNING",
+		Labels: labels,
+	}
+}
+
+func (f *fakeSQLAdmin) listVMs(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	response := &compute.InstanceAggregatedList{Items: make(map[string]compute.InstancesScopedList)}
+	for _, key := range sortedKeys(f.vms) {
+		project, zone, _ := strings.Cut(key, "/")
+		zone, _, _ = strings.Cut(zone, "/")
+		if project == r.PathValue("project") {
+			scope := response.Items["zones/"+zone]
+			scope.Instances = append(scope.Instances, f.vms[key])
+			response.Items["zones/"+zone] = scope
+		}
+	}
+	writeFakeJSON(w, response)
+}
+
+func (f *fakeSQLAdmin) getVM(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	vm, ok := f.vms[r.PathValue("project")+"/"+r.PathValue("zone")+"/"+r.PathValue("instance")]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "notFound", "The resource was not found.")
+		return
+	}
+	writeFakeJSON(w, vm)
+}
+
+// setVMStatus serves the start and stop of a VM, moving it to status.
+func (f *fakeSQLAdmin) setVMStatus(status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		vm, ok := f.vms[r.PathValue("project")+"/"+r.PathValue("zone")+"/"+r.PathValue("instance")]
+		if !ok {
+			writeFakeError(w, http.StatusNotFound, "notFound", "The resource was not found.")
+			return
+		}
+		vm.Status = status
+
+		id := make([]byte, 8)
+		rand.Read(id)
+		writeFakeJSON(w, &compute.Operation{Name: "operation-" + hex.EncodeToString(id), Status: "DONE", TargetLink: vm.SelfLink})
+	}
+}
+
+func writeFakeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeFakeError answers in the error format googleapi.CheckResponse parses.
+func writeFakeError(w http.ResponseWriter, statusCode int, reason string, message string) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    statusCode,
+			"message": message,
+			"errors": []map[string]string{
+				{"reason": reason, "message": message, "domain": "global"},
+			},
+		},
+	})
+}
+
+// startSimulator serves a fake SQL Admin API seeded with the configured
+// instance plus a few development instances, and returns its base URL.
+func startSimulator(cfg *Config) (string, error) {
+	fake := newFakeSQLAdmin(cfg.SimulateLatencyScale)
+
+	fake.addInstance(&sqladmin.DatabaseInstance{
+		Name:            cfg.InstanceID,
+		Project:         cfg.ProjectID,
+		DatabaseVersion: "POSTGRES_15",
+		Region:          "asia-southeast2",
+		Settings:        &sqladmin.Settings{Tier: "db-custom-2-7680", UserLabels: map[string]string{"env": "prod"}},
+	})
+	for _, seed := range []struct{ name, version, policy string }{
+		{"dev-postgres", "POSTGRES_15", "ALWAYS"},
+		{"dev-mysql", "MYSQL_8_0", "NEVER"},
+		{"staging-postgres", "POSTGRES_15", "ALWAYS"},
+	} {
+		fake.addInstance(&sqladmin.DatabaseInstance{
+			Name:            seed.name,
+			Project:         cfg.ProjectID,
+			DatabaseVersion: seed.version,
+			Region:          "asia-southeast2",
+			Settings: &sqladmin.Settings{
+				Tier:             "db-f1-micro",
+				ActivationPolicy: seed.policy,
+				UserLabels:       map[string]string{"env": "dev", "auto-schedule": "true"},
+			},
+		})
+	}
+
+	fake.users[userKey(cfg.ProjectID, cfg.InstanceID, "postgres", "")] = &sqladmin.User{Name: "postgres", Project: cfg.ProjectID, Instance: cfg.InstanceID, Type: "BUILT_IN"}
+	fake.addAlloyDBCluster(cfg.ProjectID, "asia-southeast2", "dev-alloydb", map[string]string{"env": "dev", "auto-schedule": "true"})
+	fake.addRedisInstance(cfg.ProjectID, "asia-southeast2", "dev-cache", 5, map[string]string{"env": "dev", "auto-schedule": "true"})
+	fake.addVM(cfg.ProjectID, "asia-southeast2-a", "dev-bastion", map[string]string{"env": "dev", "auto-schedule": "true"})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to start simulator: %w", err)
+	}
+	go http.Serve(listener, fake)
+
+	return "http://" + listener.Addr().String() + "/", nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// State backends, selected by STATE_BACKEND.
+const (
+	stateBackendFile      = "file"
+	stateBackendFirestore = "firestore"
+)
+
+const (
+	defaultStateCollection = "scheduler-db-state"
+	// stateTimeout bounds one read or write of the Firestore backend.
+	stateTimeout = 10 * time.Second
+)
+
+// stateBackend persists the JSON documents of the job state: schedules with
+// their last runs, overrides, delayed actions, in-flight operations and the
+// scheduler checkpoint. Documents are named after the files of the file
+// backend, see stateDocuments for the Firestore names. A missing document
+// reads as os.ErrNotExist. read, modified and write also return when the
+// document last changed, so edits made by something else can be noticed.
+type stateBackend interface {
+	read(name string) ([]byte, time.Time, error)
+	modified(name string) (time.Time, error)
+	write(name string, raw []byte) (time.Time, error)
+	remove(name string) error
+}
+
+// state is where the stores persist, local files unless STATE_BACKEND
+// says otherwise.
+var state stateBackend = fileState{}
+
+// StateConfig selects the state backend. Project and Collection are used by
+// the Firestore backend.
+type StateConfig struct {
+	Backend    string
+	Project    string
+	Collection string
+}
+
+func (c StateConfig) validate() error {
+	switch c.Backend {
+	case stateBackendFile, stateBackendFirestore:
+		return nil
+	}
+	return fmt.Errorf("STATE_BACKEND: %q is not one of file, firestore", c.Backend)
+}
+
+// open builds the configured backend. documents maps the configured file
+// of each store to the fixed name of its Firestore document.
+func (c StateConfig) open(ctx context.Context, documents map[string]string) (stateBackend, error) {
+	if c.Backend == stateBackendFirestore {
+		return newFirestoreState(ctx, c.Project, c.Collection, documents)
+	}
+	return fileState{}, nil
+}
+
+// stateDocuments maps the configured file of each store to the name of its
+// Firestore document, the default file name of the store, so stores whose
+// files share a base name in different directories don't overwrite each
+// other.
+func (c *Config) stateDocuments() map[string]string {
+	return map[string]string{
+		c.SchedulesFile:         defaultSchedulesFile,
+		c.OverridesFile:         defaultOverridesFile,
+		c.DelayedActionsFile:    defaultDelayedActionsFile,
+		c.PendingOperationsFile: defaultPendingOperationsFile,
+		c.SchedulerStateFile:    defaultSchedulerStateFile,
+	}
+}
+
+// fileState keeps each document in the file it is named after. Writes are
+// atomic, so a crash never leaves a partial file behind.
+type fileState struct{}
+
+func (fileState) read(name string) ([]byte, time.Time, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	raw, err := os.ReadFile(name)
+	return raw, info.ModTime(), err
+}
+
+func (fileState) modified(name string) (time.Time, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (s fileState) write(name string, raw []byte) (time.Time, error) {
+	if err := writeFileAtomic(name, raw); err != nil {
+		return time.Time{}, err
+	}
+	return s.modified(name)
+}
+
+func (fileState) remove(name string) error {
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// firestoreState keeps each document as the data string field of a
+// document of a collection of the default database, named by the store it
+// belongs to rather than by its path, so every instance of a service scaled
+// to zero and back finds the state of the previous ones.
+type firestoreState struct {
+	service    *firestore.Service
+	project    string
+	collection string
+	documents  map[string]string
+}
+
+func newFirestoreState(ctx context.Context, project string, collection string, documents map[string]string) (*firestoreState, error) {
+	service, err := firestore.NewService(ctx, credentials.load().options()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Firestore client: %w", err)
+	}
+	return &firestoreState{service: service, project: project, collection: collection, documents: documents}, nil
+}
+
+// document is the Firestore document of the file name, the base name of
+// files that are not the file of a store.
+func (s *firestoreState) document(name string) string {
+	id, ok := s.documents[name]
+	if !ok {
+		id = filepath.Base(name)
+	}
+	return fmt.Sprintf("projects/%s/databases/(default)/documents/%s/%s", s.project, s.collection, id)
+}
+
+func (s *firestoreState) get(name string, fields ...googleapi.Field) (*firestore.Document, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+
+	call := s.service.Projects.Databases.Documents.Get(s.document(name)).Context(ctx)
+	if len(fields) > 0 {
+		call.Fields(fields...)
+	}
+	document, err := call.Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", s.document(name), os.ErrNotExist)
+	}
+	return document, err
+}
+
+func (s *firestoreState) read(name string) ([]byte, time.Time, error) {
+	document, err := s.get(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	updated, _ := time.Parse(time.RFC3339Nano, document.UpdateTime)
+	return []byte(document.Fields["data"].StringValue), updated, nil
+}
+
+func (s *firestoreState) modified(name string) (time.Time, error) {
+	document, err := s.get(name, "updateTime")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, document.UpdateTime)
+}
+
+func (s *firestoreState) write(name string, raw []byte) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+
+	document := &firestore.Document{Fields: map[string]firestore.Value{"data": {StringValue: string(raw)}}}
+	document, err := s.service.Projects.Databases.Documents.Patch(s.document(name), document).Context(ctx).Do()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, document.UpdateTime)
+}
+
+func (s *firestoreState) remove(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+
+	_, err := s.service.Projects.Databases.Documents.Delete(s.document(name)).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
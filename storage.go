@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// actionStorage names storage changes in access roles, notifications and
+// the audit log.
+const actionStorage = "storage"
+
+const (
+	diskBytesUsedMetric = "cloudsql.googleapis.com/database/disk/bytes_used"
+
+	// minDataDiskSizeGB is the smallest disk Cloud SQL allocates.
+	minDataDiskSizeGB = 10
+
+	defaultShrinkCheckMaxUsage = 0.25
+)
+
+// notifyResultShrinkCandidate reports an instance whose disk is mostly
+// unused, found by a shrink_check schedule.
+const notifyResultShrinkCandidate = "shrink_candidate"
+
+// Data disk types accepted by Cloud SQL.
+var dataDiskTypes = map[string]bool{
+	"PD_SSD": true,
+	"PD_HDD": true,
+}
+
+// shrinkCheckMaxUsage is the share of the allocated disk, from 0 to 1, at
+// or under which a shrink check notifies. It is set from
+// SHRINK_CHECK_MAX_USAGE.
+var shrinkCheckMaxUsage = newReloadable(defaultShrinkCheckMaxUsage)
+
+// StorageSettings are the disk settings of an instance. UsedGB is the disk
+// space used as last reported by Cloud Monitoring, left out when unknown.
+type StorageSettings struct {
+	AutoResize        bool     `json:"auto_resize"`
+	AutoResizeLimitGB int64    `json:"auto_resize_limit_gb"`
+	DataDiskSizeGB    int64    `json:"data_disk_size_gb"`
+	DataDiskType      string   `json:"data_disk_type"`
+	UsedGB            *float64 `json:"used_gb,omitempty"`
+}
+
+func newStorageSettings(settings *sqladmin.Settings) *StorageSettings {
+	if settings == nil {
+		settings = &sqladmin.Settings{}
+	}
+	return &StorageSettings{
+		AutoResize:        settings.StorageAutoResize != nil && *settings.StorageAutoResize,
+		AutoResizeLimitGB: settings.StorageAutoResizeLimit,
+		DataDiskSizeGB:    settings.DataDiskSizeGb,
+		DataDiskType:      settings.DataDiskType,
+	}
+}
+
+// StorageRequest is the body of PATCH /v1/instances/{instance}/storage.
+// Fields left out keep their current value. An auto_resize_limit_gb of 0
+// removes the limit.
+type StorageRequest struct {
+	AutoResize        *bool  `json:"auto_resize"`
+	AutoResizeLimitGB *int64 `json:"auto_resize_limit_gb"`
+	DataDiskSizeGB    *int64 `json:"data_disk_size_gb"`
+	DataDiskType      string `json:"data_disk_type"`
+}
+
+func (req *StorageRequest) validate() validationErrors {
+	var errs validationErrors
+
+	if req.AutoResize == nil && req.AutoResizeLimitGB == nil && req.DataDiskSizeGB == nil && req.DataDiskType == "" {
+		errs = append(errs, fieldError{Message: "body must contain at least one of auto_resize, auto_resize_limit_gb, data_disk_size_gb and data_disk_type"})
+	}
+	if req.AutoResizeLimitGB != nil && *req.AutoResizeLimitGB < 0 {
+		errs = append(errs, fieldError{Field: "auto_resize_limit_gb", Message: "must not be negative"})
+	}
+	if req.DataDiskSizeGB != nil && *req.DataDiskSizeGB < minDataDiskSizeGB {
+		errs = append(errs, fieldError{Field: "data_disk_size_gb", Message: fmt.Sprintf("must be at least %d", minDataDiskSizeGB)})
+	}
+	if req.DataDiskType != "" && !dataDiskTypes[req.DataDiskType] {
+		errs = append(errs, fieldError{Field: "data_disk_type", Message: "must be 'PD_SSD' or 'PD_HDD'"})
+	}
+	return errs
+}
+
+// settings is the Settings patch of the request. The limit is forced since
+// 0 is meaningful.
+func (req *StorageRequest) settings() *sqladmin.Settings {
+	settings := &sqladmin.Settings{
+		StorageAutoResize: req.AutoResize,
+		DataDiskType:      req.DataDiskType,
+	}
+	if req.AutoResizeLimitGB != nil {
+		settings.StorageAutoResizeLimit = *req.AutoResizeLimitGB
+		settings.ForceSendFields = append(settings.ForceSendFields, "StorageAutoResizeLimit")
+	}
+	if req.DataDiskSizeGB != nil {
+		settings.DataDiskSizeGb = *req.DataDiskSizeGB
+	}
+	return settings
+}
+
+// storageHandler shows an instance's disk settings and usage on GET and
+// changes them through a Settings patch on PATCH. Cloud SQL disks only
+// grow, so a smaller data_disk_size_gb is refused.
+func storageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPatch {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	var payload StorageRequest
+	if r.Method == http.MethodPatch {
+		if err := decodeJSONBody(w, r, &payload); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		if errs := payload.validate(); len(errs) > 0 {
+			writeDecodeError(w, r, errs)
+			return
+		}
+	}
+
+	wait, timeout, err := parseOperationWait(r)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+		return
+	}
+
+	project, name := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	instance, err := sqlService.Instances.Get(project, name).Context(ctx).Do()
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	current := newStorageSettings(instance.Settings)
+
+	if r.Method == http.MethodGet {
+		used, reported, err := latestMetric(r.Context(), project, name, diskBytesUsedMetric)
+		switch {
+		case err != nil:
+			slog.Warn("Failed to read the disk usage", "project", project, "instance", name, "error", err)
+		case reported:
+			usedGB := used / (1 << 30)
+			current.UsedGB = &usedGB
+		}
+		writeSuccessResponse(w, r, http.StatusOK, msgStorageFound, current)
+		return
+	}
+
+	if payload.DataDiskSizeGB != nil && *payload.DataDiskSizeGB < current.DataDiskSizeGB {
+		writeErrorResponse(w, r, http.StatusBadRequest, msgStorageShrinkUnsupported, "", name, current.DataDiskSizeGB)
+		return
+	}
+
+	patch := &sqladmin.DatabaseInstance{Settings: payload.settings()}
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunPatch(project, name, patch))
+		return
+	}
+
+	operation, err := sqlService.Instances.Patch(project, name, patch).Context(ctx).Do()
+	event := newNotificationEvent(actionStorage, actionSourceAPI, requestPrincipal(r), project, name)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgStoragePatchFailed, err)
+		return
+	}
+
+	operations.track(event, operation)
+	writeOperationResponse(w, r, project, name, operation, wait, timeout, operationSteps{}, msgStoragePatched, msgStoragePatchFailed)
+}
+
+// runShrinkCheck notifies when a running instance uses at most
+// shrinkCheckMaxUsage of its disk. Nothing is changed: Cloud SQL can't
+// shrink a disk, the data has to move to a new instance with a smaller one.
+// Stopped instances and instances reporting no usage are skipped.
+func runShrinkCheck(ctx context.Context, action triggeredAction) error {
+	sqlService, err := sqlAdminService(action.Project)
+	if err != nil {
+		return err
+	}
+
+	instance, err := getInstance(ctx, sqlService, action.Project, action.Instance)
+	if err != nil {
+		return err
+	}
+	if instance.State != "RUNNABLE" {
+		slog.Info("Instance is not running, shrink check skipped", action.attrs("state", instance.State)...)
+		return nil
+	}
+	allocated := newStorageSettings(instance.Settings).DataDiskSizeGB
+	if allocated == 0 {
+		return fmt.Errorf("instance reports no disk size")
+	}
+
+	used, reported, err := latestMetric(ctx, action.Project, action.Instance, diskBytesUsedMetric)
+	if err != nil {
+		return fmt.Errorf("failed to read the disk usage: %w", err)
+	}
+	if !reported {
+		slog.Info("No disk usage reported, shrink check skipped", action.attrs()...)
+		return nil
+	}
+
+	usedGB := used / (1 << 30)
+	usage := usedGB / float64(allocated)
+	if usage > shrinkCheckMaxUsage.load() {
+		slog.Info("Disk usage checked", action.attrs("used_gb", usedGB, "allocated_gb", allocated)...)
+		return nil
+	}
+
+	slog.Info("Disk is mostly unused", action.attrs("used_gb", usedGB, "allocated_gb", allocated)...)
+	event := newNotificationEvent(action.Action, action.Source, action.TriggeredBy, action.Project, action.Instance)
+	event.Schedule = action.Schedule
+	event.Result = notifyResultShrinkCandidate
+	event.Error = fmt.Sprintf("%.1f GB used of %d GB allocated (%.0f%%), moving the data to an instance with a smaller disk would save its cost", usedGB, allocated, usage*100)
+	notifications.send(event)
+	return nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// Data store kinds, the {kind} of /v1/stores routes and the kind of
+// schedules. Compute Engine VMs aren't data stores, but are scheduled the
+// same way.
+const (
+	storeKindCloudSQL = "cloudsql"
+	storeKindAlloyDB  = "alloydb"
+	storeKindRedis    = "redis"
+	storeKindCompute  = "gce"
+)
+
+// Provider-neutral data store states. Stores changing state report the
+// state of their provider instead, e.g. UPDATING.
+const (
+	storeStateRunning = "RUNNING"
+	storeStateStopped = "STOPPED"
+)
+
+// storeKinds are the supported kinds, in the order they are listed.
+var storeKinds = []string{storeKindCloudSQL, storeKindAlloyDB, storeKindRedis, storeKindCompute}
+
+// storeProviders start and stop the data stores of each kind.
+var storeProviders = map[string]storeProvider{
+	storeKindCloudSQL: cloudSQLProvider{},
+	storeKindAlloyDB:  alloyDBProvider{},
+	storeKindRedis:    redisProvider{},
+	storeKindCompute:  computeProvider{},
+}
+
+// storeProvider manages the data stores of one kind. Location is the
+// region of the store, ignored by kinds whose names are unique per project.
+// start and stop return the name of the operation they started.
+type storeProvider interface {
+	list(ctx context.Context, project string) ([]DataStore, error)
+	get(ctx context.Context, project string, location string, name string) (DataStore, error)
+	start(ctx context.Context, store DataStore) (string, error)
+	stop(ctx context.Context, store DataStore) (string, error)
+}
+
+// DataStore is a managed data store of any kind: a Cloud SQL instance, an
+// AlloyDB cluster, a Memorystore for Redis instance or a Compute Engine VM.
+type DataStore struct {
+	Kind     string            `json:"kind"`
+	Project  string            `json:"project"`
+	Location string            `json:"location"`
+	Name     string            `json:"name"`
+	State    string            `json:"state"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	// Detail tells how the store is stopped when it isn't obvious, e.g.
+	// the memory size a Redis instance is restored to.
+	Detail string `json:"detail,omitempty"`
+}
+
+// StoreListData is the payload of GET /v1/stores.
+type StoreListData struct {
+	Stores []DataStore `json:"stores"`
+}
+
+// StoreActionData is the payload of POST /v1/stores/{kind}/{location}/{instance}/start
+// and /stop. Operation is empty when the store was already in the requested
+// state.
+type StoreActionData struct {
+	DataStore
+	Operation string `json:"operation,omitempty"`
+}
+
+// cloudSQLProvider manages Cloud SQL instances through their activation
+// policy, like the /v1/instances routes.
+type cloudSQLProvider struct{}
+
+func (cloudSQLProvider) list(ctx context.Context, project string) ([]DataStore, error) {
+	instances, err := listProjectInstances(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	stores := make([]DataStore, 0, len(instances))
+	for _, instance := range instances {
+		stores = append(stores, newCloudSQLStore(instance))
+	}
+	return stores, nil
+}
+
+func (cloudSQLProvider) get(ctx context.Context, project string, location string, name string) (DataStore, error) {
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		return DataStore{}, err
+	}
+	instance, err := getInstance(ctx, sqlService, project, name)
+	if err != nil {
+		return DataStore{}, err
+	}
+	return newCloudSQLStore(instance), nil
+}
+
+func (cloudSQLProvider) start(ctx context.Context, store DataStore) (string, error) {
+	return setCloudSQLActivationPolicy(ctx, store, "ALWAYS")
+}
+
+func (cloudSQLProvider) stop(ctx context.Context, store DataStore) (string, error) {
+	return setCloudSQLActivationPolicy(ctx, store, "NEVER")
+}
+
+func setCloudSQLActivationPolicy(ctx context.Context, store DataStore, policy string) (string, error) {
+	controller, err := sqlController(store.Project)
+	if err != nil {
+		return "", err
+	}
+	operation, err := controller.SetActivationPolicy(ctx, store.Project, store.Name, policy)
+	if err != nil {
+		return "", err
+	}
+	return operation.Name, nil
+}
+
+func newCloudSQLStore(instance *sqladmin.DatabaseInstance) DataStore {
+	store := DataStore{Kind: storeKindCloudSQL, Project: instance.Project, Location: instance.Region, Name: instance.Name, State: instance.State}
+	if instance.State == "RUNNABLE" {
+		store.State = storeStateRunning
+	}
+	if instance.Settings != nil {
+		store.Labels = instance.Settings.UserLabels
+	}
+	return store
+}
+
+// runStoreAction starts or stops a data store of any kind. Stores already
+// in the requested state are left alone and no operation is returned. Cloud
+// SQL instances are held to the policy rules, and their stops check the
+// open connections first, unless forced.
+func runStoreAction(ctx context.Context, kind string, location string, action triggeredAction) (DataStore, string, error) {
+	provider, ok := storeProviders[kind]
+	if !ok {
+		return DataStore{}, "", fmt.Errorf("unknown data store kind %q", kind)
+	}
+
+	event := newNotificationEvent(action.Action, action.Source, action.TriggeredBy, action.Project, action.Instance)
+	event.Schedule = action.Schedule
+	if kind == storeKindCloudSQL {
+		if err := checkPolicies(ctx, action.Action, action.Project, action.Instance); err != nil {
+			notifyAction(event, nil, err)
+			return DataStore{}, "", err
+		}
+	}
+	store, err := provider.get(ctx, action.Project, location, action.Instance)
+	if err != nil {
+		notifyAction(event, nil, err)
+		return DataStore{}, "", err
+	}
+	attrs := action.attrs("kind", kind, "location", store.Location, "state", store.State)
+
+	run := provider.start
+	switch {
+	case action.Action == scheduleActionStart && store.State == storeStateRunning:
+		slog.Info("Data store is already running", attrs...)
+		return store, "", nil
+	case action.Action == scheduleActionStop && store.State != storeStateRunning:
+		slog.Info("Data store is not running, nothing to stop", attrs...)
+		return store, "", nil
+	case action.Action == scheduleActionStop:
+		run = provider.stop
+	case action.Action != scheduleActionStart:
+		return store, "", fmt.Errorf("unknown action %q for a %s data store", action.Action, kind)
+	}
+
+	if action.Action == scheduleActionStop && kind == storeKindCloudSQL {
+		if err := checkConnections(ctx, action.Project, action.Instance, action.Force); err != nil {
+			notifyAction(event, nil, err)
+			return store, "", err
+		}
+	}
+	if dryRun.load() {
+		slog.Info("Dry run, action skipped", attrs...)
+		return store, "", nil
+	}
+
+	name, err := run(ctx, store)
+	// Notifications and the audit log only report the name of operations
+	// of other kinds.
+	var operation *sqladmin.Operation
+	if name != "" {
+		operation = &sqladmin.Operation{Name: name}
+	}
+	notifyAction(event, operation, err)
+	auditAction(action, operation, err)
+	if err != nil {
+		return store, "", err
+	}
+
+	slog.Info("Action requested", append(attrs, "operation", name)...)
+	return store, name, nil
+}
+
+// listStoresHandler serves GET /v1/stores: the data stores of every kind,
+// or of the kinds in ?kind=, in the projects of the request. ?label=
+// key=value narrows the list like for GET /v1/instances, and stores the
+// caller may not check are left out.
+func listStoresHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	kinds := splitList(r.URL.Query().Get("kind"))
+	if len(kinds) == 0 {
+		kinds = storeKinds
+	}
+	for _, kind := range kinds {
+		if _, ok := storeProviders[kind]; !ok {
+			writeErrorResponse(w, r, http.StatusBadRequest, msgStoreKindUnknown, "", kind)
+			return
+		}
+	}
+	selector, err := parseLabelSelector(strings.Join(r.URL.Query()["label"], ","))
+	if err != nil {
+		writeDecodeError(w, r, validationErrors{{Field: "label", Message: err.Error()}})
+		return
+	}
+
+	data := StoreListData{Stores: []DataStore{}}
+	for _, project := range defaultProjects(r) {
+		for _, kind := range kinds {
+			stores, err := storeProviders[kind].list(r.Context(), project)
+			if err != nil {
+				writeErrorResponse(w, r, http.StatusInternalServerError, msgListStoresFailed, err, kind, project)
+				return
+			}
+			for _, store := range stores {
+				if matchStoreLabels(store, selector) && accessAllowed(r, auditActionCheck, project, store.Name) {
+					data.Stores = append(data.Stores, store)
+				}
+			}
+		}
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgStoresListed, data)
+}
+
+func matchStoreLabels(store DataStore, selector map[string]string) bool {
+	for key, value := range selector {
+		if got, ok := store.Labels[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// storeActionHandler serves POST /v1/stores/{kind}/{location}/{instance}/start
+// and /stop for stores of any kind. Operations of other kinds than Cloud
+// SQL are not waited for, the answer names the operation started.
+func storeActionHandler(action string) http.HandlerFunc {
+	requested := msgStoreStartRequested
+	if action == scheduleActionStop {
+		requested = msgStoreStopRequested
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+			return
+		}
+
+		kind := r.PathValue("kind")
+		if !slices.Contains(storeKinds, kind) {
+			writeErrorResponse(w, r, http.StatusNotFound, msgStoreKindUnknown, "", kind)
+			return
+		}
+		store, operation, err := runStoreAction(r.Context(), kind, r.PathValue("location"), triggeredAction{
+			Action:      action,
+			Project:     targetProject(r),
+			Instance:    targetInstance(r),
+			Source:      actionSourceAPI,
+			TriggeredBy: requestPrincipal(r),
+			Force:       isForced(r),
+		})
+		recordAction(action, actionSourceAPI, err)
+
+		var apiErr *googleapi.Error
+		var blocked *policyError
+		switch {
+		case errors.As(err, &blocked):
+			writeErrorResponse(w, r, http.StatusForbidden, msgPolicyViolation, err, action, targetInstance(r), blocked.Rule)
+		case errors.Is(err, errConnectionsActive):
+			writeConnectionsError(w, r, targetInstance(r), err)
+		case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+			writeErrorResponse(w, r, http.StatusNotFound, msgStoreNotFound, err)
+		case err != nil:
+			writeErrorResponse(w, r, http.StatusInternalServerError, msgStoreActionFailed, err, action)
+		case operation == "":
+			writeSuccessResponse(w, r, http.StatusOK, msgStoreUnchanged, StoreActionData{DataStore: store})
+		default:
+			writeSuccessResponse(w, r, http.StatusAccepted, requested, StoreActionData{DataStore: store, Operation: operation})
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// tenantAccessRole names the role every caller of a tenant holds.
+const tenantAccessRole = "tenant"
+
+// tenantNamePattern keeps tenant names usable as a path segment.
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// Tenant is the namespace of one team, served under /t/{name}/ by the same
+// deployment as every other team. Its callers authenticate with APIKeys
+// only and may take Actions, any when empty, on the Instances of Project
+// matching the glob patterns, nothing else. Credentials, a source as in
+// PROJECT_CREDENTIALS, are used for Project. Schedules are declared as in
+// schedules.items and may only target the instances of the tenant.
+type Tenant struct {
+	Name        string             `yaml:"name"`
+	Project     string             `yaml:"project"`
+	Instances   []string           `yaml:"instances"`
+	Actions     []string           `yaml:"actions"`
+	Credentials string             `yaml:"credentials"`
+	APIKeys     []string           `yaml:"api_keys"`
+	Schedules   []DeclaredSchedule `yaml:"schedules"`
+}
+
+// access is the AccessConfig the callers of the tenant are held to in
+// place of the access roles of the deployment.
+func (t *Tenant) access() AccessConfig {
+	actions := t.Actions
+	if len(actions) == 0 {
+		actions = []string{accessActionAny}
+	}
+	return AccessConfig{
+		Roles:    map[string]AccessRole{tenantAccessRole: {Actions: actions, Projects: []string{t.Project}, Instances: t.Instances}},
+		Bindings: []AccessBinding{{Principals: []string{"tenant:" + t.Name + "/*"}, Roles: []string{tenantAccessRole}}},
+	}
+}
+
+// authenticate accepts the API keys of the tenant. The caller is named
+// tenant:<name>/api-key#<n>.
+func (t *Tenant) authenticate(r *http.Request) (string, error) {
+	principal, err := apiKeyAuthenticator{keys: t.APIKeys}.authenticate(r)
+	if err != nil {
+		return "", err
+	}
+	return "tenant:" + t.Name + "/" + principal, nil
+}
+
+// scheduleID is the id a schedule of the tenant is stored under, so ids
+// only need to be unique within the tenant.
+func (t *Tenant) scheduleID(id string) string {
+	return t.Name + "." + id
+}
+
+// validateTenants checks the tenants once their project defaults to
+// PROJECT_ID. A project may only have one source of credentials across
+// PROJECT_CREDENTIALS and the tenants.
+func validateTenants(tenants []Tenant, projectCredentials map[string]string) error {
+	var errs []error
+	seen := make(map[string]int)
+	sources := make(map[string]string)
+	for i, tenant := range tenants {
+		prefix := fmt.Sprintf("tenants[%d]", i)
+		switch first, ok := seen[tenant.Name]; {
+		case !tenantNamePattern.MatchString(tenant.Name):
+			errs = append(errs, fmt.Errorf("%s.name: %q must be lowercase letters, digits and dashes", prefix, tenant.Name))
+		case ok:
+			errs = append(errs, fmt.Errorf("%s.name: %q is already used by tenants[%d]", prefix, tenant.Name, first))
+		default:
+			seen[tenant.Name] = i
+		}
+		if len(tenant.APIKeys) == 0 {
+			errs = append(errs, fmt.Errorf("%s.api_keys: at least one key is required", prefix))
+		}
+		if len(tenant.Instances) == 0 {
+			errs = append(errs, fmt.Errorf("%s.instances: is required, use \"*\" for every instance of the project", prefix))
+		}
+		errs = append(errs, validatePatterns(prefix+".instances", tenant.Instances)...)
+		for j, action := range tenant.Actions {
+			if action != accessActionAny && !slices.Contains(accessActions, action) {
+				errs = append(errs, fmt.Errorf("%s.actions[%d]: %q is not one of *, %s", prefix, j, action, strings.Join(accessActions, ", ")))
+			}
+		}
+
+		if tenant.Credentials == "" {
+			continue
+		}
+		if _, err := parseProjectCredentials([]string{tenant.Project + "=" + tenant.Credentials}); err != nil {
+			errs = append(errs, fmt.Errorf("%s.credentials: %w", prefix, err))
+		}
+		if source, ok := projectCredentials[tenant.Project]; ok && source != tenant.Credentials {
+			errs = append(errs, fmt.Errorf("%s.credentials: project %q already has credentials in PROJECT_CREDENTIALS", prefix, tenant.Project))
+		} else if source, ok := sources[tenant.Project]; ok && source != tenant.Credentials {
+			errs = append(errs, fmt.Errorf("%s.credentials: project %q already has other credentials in another tenant", prefix, tenant.Project))
+		}
+		sources[tenant.Project] = tenant.Credentials
+	}
+	return errors.Join(errs...)
+}
+
+// tenantSchedules validates the schedules of the tenants and returns them
+// with their stored ids. taken are the schedules declared outside of the
+// tenants, whose ids they must not reuse.
+func tenantSchedules(tenants []Tenant, taken []Schedule) ([]Schedule, error) {
+	var (
+		items []Schedule
+		errs  []error
+	)
+	seen := make(map[string]bool)
+	for _, schedule := range taken {
+		seen[schedule.ID] = true
+	}
+	for i, tenant := range tenants {
+		for j, declared := range tenant.Schedules {
+			prefix := fmt.Sprintf("tenants[%d].schedules[%d]", i, j)
+			id := tenant.scheduleID(declared.ID)
+			switch {
+			case declared.ID == "":
+				errs = append(errs, fmt.Errorf("%s.id: is required", prefix))
+			case seen[id]:
+				errs = append(errs, fmt.Errorf("%s.id: %q is used twice", prefix, id))
+			}
+			seen[id] = true
+
+			for _, err := range declared.validate() {
+				errs = append(errs, fmt.Errorf("%s.%s: %s", prefix, err.Field, err.Message))
+			}
+			if declared.Chain != "" {
+				errs = append(errs, fmt.Errorf("%s.chain: is not available to tenants", prefix))
+			}
+			if declared.Project != "" && declared.Project != tenant.Project {
+				errs = append(errs, fmt.Errorf("%s.project: must be %q, the project of the tenant", prefix, tenant.Project))
+			}
+			if declared.Instance != "" && !matchesAny(tenant.Instances, declared.Instance) {
+				errs = append(errs, fmt.Errorf("%s.instance: %q is not an instance of the tenant", prefix, declared.Instance))
+			}
+
+			declared.ID = id
+			items = append(items, declared.schedule(tenant.Project))
+		}
+	}
+	return items, errors.Join(errs...)
+}
+
+// tenants are the running tenants by name.
+var tenants reloadable[map[string]*Tenant]
+
+func indexTenants(items []Tenant) map[string]*Tenant {
+	index := make(map[string]*Tenant, len(items))
+	for i := range items {
+		index[items[i].Name] = &items[i]
+	}
+	return index
+}
+
+type tenantContextKey struct{}
+
+// requestTenant is the tenant set by withTenant, nil outside of /t/.
+func requestTenant(r *http.Request) *Tenant {
+	tenant, _ := r.Context().Value(tenantContextKey{}).(*Tenant)
+	return tenant
+}
+
+// requestAccess is the AccessConfig the caller of r is held to: the one of
+// its tenant, or the access roles of the deployment.
+func requestAccess(r *http.Request) AccessConfig {
+	if tenant := requestTenant(r); tenant != nil {
+		return tenant.access()
+	}
+	return accessPolicy.load()
+}
+
+// withTenant serves the requests under /t/{tenant}/: unknown tenants answer
+// 404 and requests without one of the API keys of the tenant 401. The
+// authenticators of the deployment are not consulted, a tenant's callers
+// can't reach the rest of the API.
+func withTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("tenant")
+		tenant, ok := tenants.load()[name]
+		if !ok {
+			writeErrorResponse(w, r, http.StatusNotFound, msgTenantNotFound, "", name)
+			return
+		}
+
+		principal, err := tenant.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scheduler-db"`)
+			writeErrorResponse(w, r, http.StatusUnauthorized, msgUnauthorized, err)
+			return
+		}
+		annotateRequest(r, slog.String("tenant", tenant.Name), slog.String("principal", principal))
+		ctx := context.WithValue(r.Context(), principalContextKey{}, principal)
+		ctx = context.WithValue(ctx, tenantContextKey{}, tenant)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// validTier matches Cloud SQL machine tiers, e.g. db-f1-micro or
+// db-custom-8-32768.
+var validTier = regexp.MustCompile(`^db-[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// TierRequest is the body accepted by POST /v1/instances/{instance}/tier.
+type TierRequest struct {
+	Tier string `json:"tier"`
+}
+
+func (req *TierRequest) validate() validationErrors {
+	switch {
+	case req.Tier == "":
+		return validationErrors{{Field: "tier", Message: "is required"}}
+	case !validTier.MatchString(req.Tier):
+		return validationErrors{{Field: "tier", Message: "must be a Cloud SQL tier such as 'db-custom-2-7680'"}}
+	}
+	return nil
+}
+
+// ScaleResult describes a tier change. Rollback is the operation restoring
+// PreviousTier after the change failed.
+type ScaleResult struct {
+	PreviousTier string              `json:"previous_tier"`
+	Tier         string              `json:"tier"`
+	Operation    *sqladmin.Operation `json:"operation,omitempty"`
+	Rollback     *sqladmin.Operation `json:"rollback,omitempty"`
+	Instance     *SQLInstancesData   `json:"instance,omitempty"`
+}
+
+// scaleHandler changes the machine tier of an instance. Changing the tier
+// restarts the instance, so the request always waits for the operation,
+// up to ?timeout= (default and max 10m), and puts the previous tier back
+// when it fails.
+func scaleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	var payload TierRequest
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if errs := payload.validate(); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+
+	timeout := maxWaitTimeout
+	if raw := r.URL.Query().Get("timeout"); raw != "" {
+		var err error
+		if timeout, err = parseWaitTimeout(raw); err != nil {
+			writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+			return
+		}
+	}
+
+	project, instance := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	current, err := instanceTier(r.Context(), sqlService, project, instance)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	if current == payload.Tier {
+		writeSuccessResponse(w, r, http.StatusOK, msgTierUnchanged, ScaleResult{PreviousTier: current, Tier: current}, current)
+		return
+	}
+
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunPatch(project, instance, &sqladmin.DatabaseInstance{Settings: &sqladmin.Settings{Tier: payload.Tier}}))
+		return
+	}
+
+	event := newNotificationEvent(scheduleActionScale, actionSourceAPI, requestPrincipal(r), project, instance)
+	result, err := scaleInstance(r.Context(), sqlService, event, current, payload.Tier, timeout)
+	if result.Operation != nil {
+		auditOperation(r, result.Operation.Name)
+		annotateRequest(r, slog.String("operation", result.Operation.Name))
+	}
+	if errors.Is(err, errOperationWaitTimeout) {
+		writeErrorResponse(w, r, http.StatusRequestTimeout, msgOperationTimedOut, err, result.Operation.Name, timeout)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgScaleFailed, err, payload.Tier)
+		return
+	}
+
+	result.Instance, _, err = inventoryCache.load().get(r.Context(), project, instance, true)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgScaled, result, current, payload.Tier)
+}
+
+// runTriggeredScale applies a scale schedule, with the resize_schedules
+// feature flag. Instances already on the tier are left alone and no
+// operation is returned.
+func runTriggeredScale(ctx context.Context, action triggeredAction) (*sqladmin.Operation, error) {
+	if action.Source == actionSourceSchedule && !features.enabled(flagResizeSchedules) {
+		slog.Info("Scheduled tier change skipped, the resize_schedules feature flag is off", action.attrs("tier", action.Tier)...)
+		return nil, nil
+	}
+	sqlService, err := sqlAdminService(action.Project)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := instanceTier(ctx, sqlService, action.Project, action.Instance)
+	if err != nil {
+		return nil, err
+	}
+	if current == action.Tier {
+		slog.Info("Instance is already on the tier", action.attrs("tier", current)...)
+		return nil, nil
+	}
+	if dryRun.load() {
+		slog.Info("Dry run, action skipped", action.attrs("tier", action.Tier)...)
+		return nil, nil
+	}
+
+	event := newNotificationEvent(action.Action, action.Source, action.TriggeredBy, action.Project, action.Instance)
+	event.Schedule = action.Schedule
+	result, err := scaleInstance(ctx, sqlService, event, current, action.Tier, maxWaitTimeout)
+	auditAction(action, result.Operation, err)
+	if err != nil {
+		return result.Operation, err
+	}
+
+	slog.Info("Instance scaled", action.attrs("previous_tier", current, "tier", action.Tier, "operation", result.Operation.Name)...)
+	return result.Operation, nil
+}
+
+// scaleInstance moves an instance from the previous tier to tier and waits
+// for the operation. When the operation fails and left the instance on
+// another tier, the previous tier is patched back. A wait that times out is
+// not a failure, the change may still succeed.
+func scaleInstance(ctx context.Context, sqlService *sqladmin.Service, event NotificationEvent, previous string, tier string, timeout time.Duration) (ScaleResult, error) {
+	result := ScaleResult{PreviousTier: previous, Tier: tier}
+	deadline := time.Now().Add(timeout)
+
+	operation, err := patchTier(ctx, sqlService, event, tier)
+	if err != nil {
+		return result, err
+	}
+	result.Operation = operation
+
+	result.Operation, err = waitForOperation(ctx, event.Project, operation, time.Until(deadline))
+	if result.Operation.Status == "DONE" {
+		operations.finished(result.Operation, err)
+	}
+	if err == nil || result.Operation.Status != "DONE" {
+		return result, err
+	}
+
+	current, getErr := instanceTier(ctx, sqlService, event.Project, event.Instance)
+	if getErr != nil {
+		return result, fmt.Errorf("%w, and the tier after it is unknown: %v", err, getErr)
+	}
+	if current == previous {
+		return result, fmt.Errorf("%w, the instance stayed on %s", err, previous)
+	}
+
+	slog.Warn("Tier change failed, rolling back", "project", event.Project, "instance", event.Instance, "tier", tier, "previous_tier", previous, "error", err)
+	rollback, rollbackErr := patchTier(ctx, sqlService, event, previous)
+	if rollbackErr == nil {
+		result.Rollback = rollback
+		result.Rollback, rollbackErr = waitForOperation(ctx, event.Project, rollback, max(time.Until(deadline), defaultWaitTimeout))
+		if result.Rollback.Status == "DONE" {
+			operations.finished(result.Rollback, rollbackErr)
+		}
+	}
+	if rollbackErr != nil {
+		return result, fmt.Errorf("%w, and rolling back to %s failed: %v", err, previous, rollbackErr)
+	}
+	return result, fmt.Errorf("%w, rolled back to %s", err, previous)
+}
+
+func patchTier(ctx context.Context, sqlService *sqladmin.Service, event NotificationEvent, tier string) (*sqladmin.Operation, error) {
+	callCtx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	operation, err := sqlService.Instances.Patch(event.Project, event.Instance, &sqladmin.DatabaseInstance{
+		Settings: &sqladmin.Settings{Tier: tier},
+	}).Context(callCtx).Do()
+	notifyAction(event, operation, err)
+	if err != nil {
+		return nil, err
+	}
+	operations.track(event, operation)
+	return operation, nil
+}
+
+func instanceTier(ctx context.Context, sqlService *sqladmin.Service, project string, instance string) (string, error) {
+	ctx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	details, err := sqlService.Instances.Get(project, instance).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	if details.Settings == nil {
+		return "", errors.New("instance has no settings")
+	}
+	return details.Settings.Tier, nil
+}
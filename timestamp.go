@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Supported RESPONSE_TIME_FORMAT values.
+const (
+	timeFormatRFC3339     = "rfc3339"
+	timeFormatRFC3339Nano = "rfc3339nano"
+	timeFormatEpochMillis = "epoch_millis"
+)
+
+var (
+	responseLocation   = newReloadable(time.UTC)
+	responseTimeFormat = newReloadable(timeFormatRFC3339)
+)
+
+// formatTimestamp renders t for response payloads in the configured format
+// and timezone. Every timestamp returned to clients must go through it so
+// envelopes and payloads stay consistent.
+func formatTimestamp(t time.Time) interface{} {
+	switch responseTimeFormat.load() {
+	case timeFormatEpochMillis:
+		return t.UnixMilli()
+	case timeFormatRFC3339Nano:
+		return t.In(responseLocation.load()).Format(time.RFC3339Nano)
+	default:
+		return t.In(responseLocation.load()).Format(time.RFC3339)
+	}
+}
+
+func validateTimeFormat(format string) error {
+	switch format {
+	case timeFormatRFC3339, timeFormatRFC3339Nano, timeFormatEpochMillis:
+		return nil
+	}
+	return fmt.Errorf("must be one of %s, %s or %s", timeFormatRFC3339, timeFormatRFC3339Nano, timeFormatEpochMillis)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Values of TLS_CLIENT_AUTH.
+const (
+	tlsClientAuthRequire  = "require"
+	tlsClientAuthOptional = "optional"
+)
+
+// TLSConfig selects how the public listener serves HTTPS. Either a static
+// certificate/key pair or autocert hostnames may be set, never both. With
+// neither the server speaks plain HTTP, as when running behind Cloud Run.
+// ClientCAFile turns on mutual TLS: clients present a certificate signed by
+// one of its CAs, always or, with ClientAuth optional, when they have one.
+type TLSConfig struct {
+	CertFile      string
+	KeyFile       string
+	AutocertHosts []string
+	AutocertCache string
+	AutocertEmail string
+	ClientCAFile  string
+	ClientAuth    string
+}
+
+func (t TLSConfig) enabled() bool {
+	return t.CertFile != "" || len(t.AutocertHosts) > 0
+}
+
+func (t TLSConfig) validate() error {
+	var errs []error
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+	if t.CertFile != "" && len(t.AutocertHosts) > 0 {
+		errs = append(errs, errors.New("TLS_CERT_FILE and TLS_AUTOCERT_HOSTS are mutually exclusive"))
+	}
+	if t.ClientCAFile != "" && !t.enabled() {
+		errs = append(errs, errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE or TLS_AUTOCERT_HOSTS"))
+	}
+	for _, file := range []string{t.CertFile, t.KeyFile, t.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("TLS: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// serverTLSConfig builds the tls.Config for the public listener, or nil when
+// TLS is disabled.
+func (t TLSConfig) serverTLSConfig() (*tls.Config, error) {
+	if !t.enabled() {
+		return nil, nil
+	}
+
+	var config *tls.Config
+	if len(t.AutocertHosts) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(t.AutocertHosts...),
+			Cache:      autocert.DirCache(t.AutocertCache),
+			Email:      t.AutocertEmail,
+		}
+		// Certificates are obtained through the TLS-ALPN-01 challenge, so
+		// the public listener must be reachable on port 443.
+		config = manager.TLSConfig()
+	} else {
+		certificate, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		config = &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	if t.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in %s", t.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if t.ClientAuth == tlsClientAuthOptional {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return config, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
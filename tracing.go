@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/cloudtrace/v2"
+)
+
+// Tracing exporters, selected by TRACING_EXPORTER.
+const (
+	tracingExporterNone       = "none"
+	tracingExporterOTLP       = "otlp"
+	tracingExporterCloudTrace = "cloudtrace"
+)
+
+const (
+	tracingServiceName = "scheduler-db"
+
+	// tracingFlushTimeout bounds the export of the spans left on shutdown.
+	tracingFlushTimeout = 5 * time.Second
+)
+
+// TracingConfig exports OpenTelemetry spans of the API, of automated
+// actions and of SQL Admin calls. Endpoint is the OTLP/HTTP endpoint, the
+// OTEL_EXPORTER_OTLP_* variables apply when empty. Project is where Cloud
+// Trace keeps the traces. SampleRatio is the share of traces started here
+// that are kept, callers sending a traceparent header decide for theirs.
+type TracingConfig struct {
+	Exporter    string
+	Endpoint    string
+	Project     string
+	SampleRatio float64
+}
+
+func (c TracingConfig) validate() error {
+	switch c.Exporter {
+	case tracingExporterNone, tracingExporterOTLP, tracingExporterCloudTrace:
+	default:
+		return fmt.Errorf("TRACING_EXPORTER: %q is not one of none, otlp, cloudtrace", c.Exporter)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("TRACING_SAMPLE_RATIO: %s must be a share between 0 and 1", strconv.FormatFloat(c.SampleRatio, 'g', -1, 64))
+	}
+	return nil
+}
+
+// setup installs the global tracer provider and propagator and returns
+// what flushes the spans left on shutdown. Without an exporter nothing is
+// installed and spans cost next to nothing.
+func (c TracingConfig) setup(ctx context.Context) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	switch c.Exporter {
+	case tracingExporterOTLP:
+		var opts []otlptracehttp.Option
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(c.Endpoint))
+		}
+		otlp, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the OTLP exporter: %w", err)
+		}
+		exporter = otlp
+	case tracingExporterCloudTrace:
+		service, err := cloudtrace.NewService(ctx, credentials.load().options()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Cloud Trace client: %w", err)
+		}
+		exporter = &cloudTraceExporter{service: service, project: c.Project}
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracingServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// withTracing starts a server span for every request, continuing the trace
+// of the caller's traceparent header.
+func withTracing(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, tracingServiceName, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + r.URL.Path
+	}))
+}
+
+// traceSQLAdmin starts a client span for every attempt of a Google API call
+// made through base.
+func traceSQLAdmin(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + r.URL.Host
+	}))
+}
+
+// startSpan starts a span of the service, a root span unless ctx carries
+// one. The tracer is looked up on the global provider each time, spans are
+// dropped until tracing is set up.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := otel.GetTracerProvider().Tracer(tracingServiceName)
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed with err.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// instanceAttributes are the attributes of spans acting on an instance.
+func instanceAttributes(action string, project string, instance string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("scheduler_db.action", action),
+		attribute.String("scheduler_db.project", project),
+		attribute.String("scheduler_db.instance", instance),
+	}
+}
+
+// cloudTraceExporter writes spans with the Cloud Trace API, through the
+// same credentials as the other Google clients. The service account needs
+// roles/cloudtrace.agent.
+type cloudTraceExporter struct {
+	service *cloudtrace.Service
+	project string
+}
+
+func (e *cloudTraceExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	request := &cloudtrace.BatchWriteSpansRequest{}
+	for _, span := range spans {
+		request.Spans = append(request.Spans, cloudTraceSpan(e.project, span))
+	}
+	_, err := e.service.Projects.Traces.BatchWrite("projects/"+e.project, request).Context(ctx).Do()
+	return err
+}
+
+func (e *cloudTraceExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// cloudTraceSpanKinds map OpenTelemetry span kinds to Cloud Trace ones.
+var cloudTraceSpanKinds = map[trace.SpanKind]string{
+	trace.SpanKindInternal: "INTERNAL",
+	trace.SpanKindServer:   "SERVER",
+	trace.SpanKindClient:   "CLIENT",
+	trace.SpanKindProducer: "PRODUCER",
+	trace.SpanKindConsumer: "CONSUMER",
+}
+
+// cloudTraceSpan converts span to the Cloud Trace API, its events becoming
+// annotations.
+func cloudTraceSpan(project string, span sdktrace.ReadOnlySpan) *cloudtrace.Span {
+	sc := span.SpanContext()
+	converted := &cloudtrace.Span{
+		Name:        fmt.Sprintf("projects/%s/traces/%s/spans/%s", project, sc.TraceID(), sc.SpanID()),
+		SpanId:      sc.SpanID().String(),
+		DisplayName: &cloudtrace.TruncatableString{Value: span.Name()},
+		StartTime:   span.StartTime().UTC().Format(time.RFC3339Nano),
+		EndTime:     span.EndTime().UTC().Format(time.RFC3339Nano),
+		SpanKind:    cloudTraceSpanKinds[span.SpanKind()],
+		Attributes:  cloudTraceAttributes(append(span.Resource().Attributes(), span.Attributes()...)),
+	}
+	if parent := span.Parent(); parent.IsValid() {
+		converted.ParentSpanId = parent.SpanID().String()
+		converted.SameProcessAsParentSpan = !parent.IsRemote()
+	}
+	if status := span.Status(); status.Code == codes.Error {
+		converted.Status = &cloudtrace.Status{Code: 2, Message: status.Description}
+	}
+	if events := span.Events(); len(events) > 0 {
+		converted.TimeEvents = &cloudtrace.TimeEvents{}
+		for _, event := range events {
+			converted.TimeEvents.TimeEvent = append(converted.TimeEvents.TimeEvent, &cloudtrace.TimeEvent{
+				Time: event.Time.UTC().Format(time.RFC3339Nano),
+				Annotation: &cloudtrace.Annotation{
+					Description: &cloudtrace.TruncatableString{Value: event.Name},
+					Attributes:  cloudTraceAttributes(event.Attributes),
+				},
+			})
+		}
+	}
+	return converted
+}
+
+func cloudTraceAttributes(attrs []attribute.KeyValue) *cloudtrace.Attributes {
+	converted := &cloudtrace.Attributes{AttributeMap: make(map[string]cloudtrace.AttributeValue, len(attrs))}
+	for _, attr := range attrs {
+		var value cloudtrace.AttributeValue
+		switch attr.Value.Type() {
+		case attribute.BOOL:
+			value.BoolValue = attr.Value.AsBool()
+		case attribute.INT64:
+			value.IntValue = attr.Value.AsInt64()
+		default:
+			value.StringValue = &cloudtrace.TruncatableString{Value: attr.Value.Emit()}
+		}
+		converted.AttributeMap[string(attr.Key)] = value
+	}
+	return converted
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// errInvalidTransition is recorded when a start or stop is refused because
+// the instance can't make the transition in its current state.
+var errInvalidTransition = errors.New("invalid state transition")
+
+// stopRefusedStates are the states an instance can't be stopped from: Cloud
+// SQL is working on it during maintenance and a failed instance needs to be
+// repaired first.
+var stopRefusedStates = []string{"MAINTENANCE", "FAILED"}
+
+// transitionError is a start or stop the instance can't make now, with the
+// state it is in and the operation in progress on it, if any.
+type transitionError struct {
+	Action    string
+	State     string
+	Operation *sqladmin.Operation
+}
+
+func (e *transitionError) Error() string {
+	if e.Operation != nil {
+		return fmt.Sprintf("cannot %s instance in state %s: operation %s (%s) is %s", e.Action, e.State, e.Operation.Name, e.Operation.OperationType, e.Operation.Status)
+	}
+	return fmt.Sprintf("cannot %s instance in state %s", e.Action, e.State)
+}
+
+func (e *transitionError) Unwrap() error {
+	return errInvalidTransition
+}
+
+// operationName is the name of the operation in progress, empty when there
+// is none.
+func (e *transitionError) operationName() string {
+	if e.Operation == nil {
+		return ""
+	}
+	return e.Operation.Name
+}
+
+// message is the message a refused transition is answered with.
+func (e *transitionError) message() (messageKey, []interface{}) {
+	if e.Action == scheduleActionStart {
+		return msgStartBlocked, []interface{}{e.Operation.OperationType}
+	}
+	return msgStopRefused, []interface{}{e.State}
+}
+
+// checkTransition returns a *transitionError when the instance, in state,
+// can't make action now: a start while another operation is in progress,
+// which Cloud SQL would reject, or a stop from one of stopRefusedStates.
+func checkTransition(ctx context.Context, sqlService *sqladmin.Service, action string, project string, instance string, state string) error {
+	switch action {
+	case scheduleActionStart:
+		running, err := runningOperation(ctx, sqlService, project, instance)
+		if err != nil {
+			return err
+		}
+		if running != nil {
+			return &transitionError{Action: action, State: state, Operation: running}
+		}
+	case scheduleActionStop:
+		if slices.Contains(stopRefusedStates, state) {
+			// The operation is only reported, failing to find it doesn't
+			// change the answer.
+			running, _ := runningOperation(ctx, sqlService, project, instance)
+			return &transitionError{Action: action, State: state, Operation: running}
+		}
+	}
+	return nil
+}
+
+// writeTransitionError answers 409 with the state of the instance and the
+// operation in progress when checkTransition refuses action, and reports
+// whether the request may go on.
+func writeTransitionError(w http.ResponseWriter, r *http.Request, sqlService *sqladmin.Service, action string, project string, instance string, state string) bool {
+	err := checkTransition(r.Context(), sqlService, action, project, instance, state)
+	if err == nil {
+		return true
+	}
+	recordAction(action, actionSourceAPI, err)
+	var transition *transitionError
+	if !errors.As(err, &transition) {
+		failed := msgStartFailed
+		if action == scheduleActionStop {
+			failed = msgStopFailed
+		}
+		writeErrorResponse(w, r, http.StatusInternalServerError, failed, err)
+		return false
+	}
+	message, args := transition.message()
+	writeErrorResponse(w, r, http.StatusConflict, message, transition, args...)
+	return false
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/sqladmin/v1"
+)
+
+// actionUsers names database user changes in access roles, notifications
+// and the audit log.
+const actionUsers = "users"
+
+// generatedPasswordBytes is the entropy of generated passwords, 32
+// characters once encoded.
+const generatedPasswordBytes = 24
+
+// userTypes are the user types Cloud SQL accepts. Only built-in users have
+// a password.
+var userTypes = map[string]bool{
+	"BUILT_IN":                  true,
+	"CLOUD_IAM_USER":            true,
+	"CLOUD_IAM_SERVICE_ACCOUNT": true,
+	"CLOUD_IAM_GROUP":           true,
+}
+
+// DatabaseUser is a user of an instance. Host is only set for MySQL users.
+type DatabaseUser struct {
+	Name string `json:"name"`
+	Host string `json:"host,omitempty"`
+	Type string `json:"type"`
+}
+
+func newDatabaseUser(user *sqladmin.User) DatabaseUser {
+	data := DatabaseUser{Name: user.Name, Host: user.Host, Type: user.Type}
+	if data.Type == "" {
+		data.Type = "BUILT_IN"
+	}
+	return data
+}
+
+// UsersData is the answer of GET /v1/instances/{instance}/users.
+type UsersData struct {
+	Users []DatabaseUser `json:"users"`
+}
+
+// UserResult is the answer of user changes. Password is the password that
+// was set, only returned when the service generated it.
+type UserResult struct {
+	User      DatabaseUser        `json:"user"`
+	Password  string              `json:"password,omitempty"`
+	Operation *sqladmin.Operation `json:"operation"`
+}
+
+// UserRequest is the body of POST /v1/instances/{instance}/users. A
+// built-in user without a password gets a generated one.
+type UserRequest struct {
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Type     string `json:"type"`
+	Password string `json:"password"`
+}
+
+func (req *UserRequest) validate() validationErrors {
+	var errs validationErrors
+	if req.Name == "" {
+		errs = append(errs, fieldError{Field: "name", Message: "is required"})
+	}
+	if req.Type == "" {
+		req.Type = "BUILT_IN"
+	}
+	if !userTypes[req.Type] {
+		errs = append(errs, fieldError{Field: "type", Message: "must be BUILT_IN, CLOUD_IAM_USER, CLOUD_IAM_SERVICE_ACCOUNT or CLOUD_IAM_GROUP"})
+	} else if req.Type != "BUILT_IN" && req.Password != "" {
+		errs = append(errs, fieldError{Field: "password", Message: "only applies to BUILT_IN users"})
+	}
+	return errs
+}
+
+// UserPasswordRequest is the optional body of POST
+// /v1/instances/{instance}/users/{user}/password. Left out, a password is
+// generated.
+type UserPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// generatePassword returns a random password for a database user.
+func generatePassword() string {
+	b := make([]byte, generatedPasswordBytes)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// usersHandler lists the users of an instance on GET and creates one on
+// POST. Changes wait for their operation, up to ?timeout=, so a returned
+// password already works.
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listUsers(w, r)
+	case http.MethodPost:
+		createUser(w, r)
+	default:
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+	}
+}
+
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	project, instance := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	defer cancel()
+
+	list, err := sqlService.Users.List(project, instance).Context(ctx).Do()
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgUsersListFailed, err)
+		return
+	}
+	data := UsersData{Users: make([]DatabaseUser, 0, len(list.Items))}
+	for _, user := range list.Items {
+		data.Users = append(data.Users, newDatabaseUser(user))
+	}
+	writeSuccessResponse(w, r, http.StatusOK, msgUsersListed, data)
+}
+
+func createUser(w http.ResponseWriter, r *http.Request) {
+	var payload UserRequest
+	if err := decodeJSONBody(w, r, &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if errs := payload.validate(); len(errs) > 0 {
+		writeDecodeError(w, r, errs)
+		return
+	}
+	timeout, ok := userWaitTimeout(w, r)
+	if !ok {
+		return
+	}
+
+	project, instance := targetProject(r), targetInstance(r)
+	user := &sqladmin.User{Name: payload.Name, Host: payload.Host, Type: payload.Type, Password: payload.Password}
+	var generated string
+	if user.Type == "BUILT_IN" && user.Password == "" {
+		generated = generatePassword()
+		user.Password = generated
+	}
+	if isDryRun(r) {
+		redacted := *user
+		redacted.Password = ""
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunCall(http.MethodPost, sqlAdminInstancePath(project, instance)+"/users", &redacted))
+		return
+	}
+
+	runUserChange(w, r, user, generated, timeout, msgUserCreated, msgUserCreateFailed, func(ctx context.Context, sqlService *sqladmin.Service) (*sqladmin.Operation, error) {
+		return sqlService.Users.Insert(project, instance, user).Context(ctx).Do()
+	})
+}
+
+// userPasswordHandler sets a new password for a built-in user, the one in
+// the body or a generated one. ?host= selects MySQL users.
+func userPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+
+	var payload UserPasswordRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(w, r, &payload); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+	}
+	timeout, ok := userWaitTimeout(w, r)
+	if !ok {
+		return
+	}
+
+	project, instance := targetProject(r), targetInstance(r)
+	user := &sqladmin.User{Name: r.PathValue("user"), Host: r.URL.Query().Get("host"), Type: "BUILT_IN", Password: payload.Password}
+	var generated string
+	if user.Password == "" {
+		generated = generatePassword()
+		user.Password = generated
+	}
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunCall(http.MethodPut, sqlAdminInstancePath(project, instance)+"/users?name="+user.Name, &sqladmin.User{Name: user.Name, Host: user.Host}))
+		return
+	}
+
+	runUserChange(w, r, user, generated, timeout, msgUserPasswordRotated, msgUserPasswordRotateFailed, func(ctx context.Context, sqlService *sqladmin.Service) (*sqladmin.Operation, error) {
+		return sqlService.Users.Update(project, instance, user).Name(user.Name).Host(user.Host).Context(ctx).Do()
+	})
+}
+
+// userHandler deletes a user on DELETE. ?host= selects MySQL users.
+func userHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, msgMethodNotAllowed, "")
+		return
+	}
+	timeout, ok := userWaitTimeout(w, r)
+	if !ok {
+		return
+	}
+
+	project, instance := targetProject(r), targetInstance(r)
+	user := &sqladmin.User{Name: r.PathValue("user"), Host: r.URL.Query().Get("host")}
+	if isDryRun(r) {
+		writeSuccessResponse(w, r, http.StatusOK, msgDryRun, newDryRunCall(http.MethodDelete, sqlAdminInstancePath(project, instance)+"/users?name="+user.Name, nil))
+		return
+	}
+
+	runUserChange(w, r, user, "", timeout, msgUserDeleted, msgUserDeleteFailed, func(ctx context.Context, sqlService *sqladmin.Service) (*sqladmin.Operation, error) {
+		return sqlService.Users.Delete(project, instance).Name(user.Name).Host(user.Host).Context(ctx).Do()
+	})
+}
+
+// userWaitTimeout reads ?timeout= (default and max 10m), answering the
+// request when it is invalid.
+func userWaitTimeout(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	timeout := maxWaitTimeout
+	if raw := r.URL.Query().Get("timeout"); raw != "" {
+		var err error
+		if timeout, err = parseWaitTimeout(raw); err != nil {
+			writeErrorResponse(w, r, http.StatusBadRequest, msgInvalidWaitTimeout, err)
+			return 0, false
+		}
+	}
+	return timeout, true
+}
+
+// runUserChange makes a user change with call, notifies it and waits for
+// its operation. The answer is never cached, it may carry a password.
+func runUserChange(w http.ResponseWriter, r *http.Request, user *sqladmin.User, generated string, timeout time.Duration, succeeded messageKey, failed messageKey, call func(context.Context, *sqladmin.Service) (*sqladmin.Operation, error)) {
+	project, instance := targetProject(r), targetInstance(r)
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusUnauthorized, msgServiceAccountNotFound, err)
+		return
+	}
+
+	ctx, cancel := sqlAdminContext(r.Context())
+	operation, err := call(ctx, sqlService)
+	cancel()
+	event := newNotificationEvent(actionUsers, actionSourceAPI, requestPrincipal(r), project, instance)
+	notifyAction(event, operation, err)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, failed, err, user.Name)
+		return
+	}
+	operations.track(event, operation)
+	auditOperation(r, operation.Name)
+	annotateRequest(r, slog.String("operation", operation.Name), slog.String("user", user.Name))
+
+	operation, err = waitForOperation(r.Context(), project, operation, timeout)
+	if operation.Status == "DONE" {
+		operations.finished(operation, err)
+	}
+	if errors.Is(err, errOperationWaitTimeout) {
+		writeErrorResponse(w, r, http.StatusRequestTimeout, msgOperationTimedOut, err, operation.Name, timeout)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, failed, err, user.Name)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeSuccessResponse(w, r, http.StatusOK, succeeded, UserResult{User: newDatabaseUser(user), Password: generated, Operation: operation}, user.Name)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// apiVersion is the current path version. Endpoints are served under
+// /<apiVersion>/ and every response names the version that handled it.
+const apiVersion = "v1"
+
+// legacySunset is when the unversioned routes will be removed, zero while no
+// date has been announced.
+var legacySunset reloadable[time.Time]
+
+// withVersion tags responses with the API version that served them.
+func withVersion(version string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Version", version)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deprecated keeps a legacy route working while telling clients where it
+// moved: Deprecation and, once announced, Sunset headers plus a Link to the
+// successor endpoint.
+func deprecated(successor func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		if !legacySunset.load().IsZero() {
+			w.Header().Set("Sunset", legacySunset.load().UTC().Format(http.TimeFormat))
+		}
+		w.Header().Add("Link", "<"+successor(r)+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// targetProject is the project a request acts on: the {project} path
+// segment, the project query parameter, or PROJECT_ID.
+func targetProject(r *http.Request) string {
+	if tenant := requestTenant(r); tenant != nil {
+		return tenant.Project
+	}
+	return requestTarget(r, "project", projectID.load())
+}
+
+// defaultProjects are the projects searched by fleet-wide requests: the
+// {project} path segment or the project query parameter when given,
+// otherwise every project in PROJECTS.
+func defaultProjects(r *http.Request) []string {
+	if project := requestTarget(r, "project", ""); project != "" {
+		return []string{project}
+	}
+	return managedProjects.load()
+}
+
+// targetInstance is the instance a request acts on: the {instance} path
+// segment, the instance query parameter, or INSTANCE_ID.
+func targetInstance(r *http.Request) string {
+	return requestTarget(r, "instance", instanceID.load())
+}
+
+func requestTarget(r *http.Request, name string, def string) string {
+	if value := r.PathValue(name); value != "" {
+		return value
+	}
+	if value := r.URL.Query().Get(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// instancePath is the /v1 path of an instance, project-scoped unless it
+// lives in PROJECT_ID.
+func instancePath(project string, instance string) string {
+	if project == projectID.load() {
+		return "/" + apiVersion + "/instances/" + instance
+	}
+	return "/" + apiVersion + "/projects/" + project + "/instances/" + instance
+}
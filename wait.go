@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/sqladmin/v1"
+
+	"scheduler-db/pkg/sqlctl"
+)
+
+const (
+	defaultWaitTimeout = 60 * time.Second
+	maxWaitTimeout     = 10 * time.Minute
+)
+
+// waitPollInterval is how often waitForState and waitForOperation poll.
+var waitPollInterval = 5 * time.Second
+
+// instanceStates lists the values accepted by wait_for_state. STOPPED is not
+// documented by the SQL Admin API but is what it reports for instances whose
+// activation policy is NEVER.
+var instanceStates = map[string]bool{
+	"RUNNABLE":       true,
+	"STOPPED":        true,
+	"SUSPENDED":      true,
+	"PENDING_DELETE": true,
+	"PENDING_CREATE": true,
+	"MAINTENANCE":    true,
+	"FAILED":         true,
+	"REPAIRING":      true,
+}
+
+var (
+	errWaitTimeout          = errors.New("timed out waiting for instance state")
+	errOperationWaitTimeout = sqlctl.ErrWaitTimeout
+)
+
+// waitForState polls the instance until it reports the target state, the
+// timeout elapses or ctx is cancelled. The last observed state is returned
+// alongside errWaitTimeout so callers can report it.
+func waitForState(ctx context.Context, projectID string, instanceID string, target string, timeout time.Duration) (*SQLInstancesData, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	var last *SQLInstancesData
+	for {
+		instance, _, err := inventoryCache.load().get(ctx, projectID, instanceID, true)
+		if err != nil {
+			if last != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return last, errWaitTimeout
+			}
+			return nil, err
+		}
+		last = instance
+		if instance.State == target {
+			return instance, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return instance, errWaitTimeout
+			}
+			return instance, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// parseWaitTimeout reads a Go duration (e.g. "120s"), applying the default
+// when empty and capping it at maxWaitTimeout.
+func parseWaitTimeout(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultWaitTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, errors.New("timeout must be positive")
+	}
+	if timeout > maxWaitTimeout {
+		timeout = maxWaitTimeout
+	}
+	return timeout, nil
+}
+
+// OperationResult is returned by every endpoint starting an operation: the
+// operation and the steps taken before it, plus with ?wait=true the
+// instance state the finished operation left behind.
+type OperationResult struct {
+	Operation *sqladmin.Operation `json:"operation"`
+	Instance  *SQLInstancesData   `json:"instance,omitempty"`
+	Backup    *sqladmin.Operation `json:"backup,omitempty"`
+	Export    *sqladmin.Operation `json:"export,omitempty"`
+	Replicas  []BulkResult        `json:"replicas,omitempty"`
+	WarmUp    *WarmUpData         `json:"warm_up,omitempty"`
+}
+
+// operationSteps are what a start or stop did besides its own operation:
+// the backup and export taken before a stop and the replicas acted on.
+// WarmUp asks for the warm-up probe once a waited-for start is done.
+type operationSteps struct {
+	Backup   *sqladmin.Operation
+	Export   *sqladmin.Operation
+	Replicas []BulkResult
+	WarmUp   bool
+}
+
+// parseOperationWait reads the wait and timeout query parameters of mutating
+// endpoints. It must be called before the mutation so a bad timeout doesn't
+// leave an operation running behind an error response.
+func parseOperationWait(r *http.Request) (bool, time.Duration, error) {
+	if r.URL.Query().Get("wait") != "true" {
+		return false, 0, nil
+	}
+	timeout, err := parseWaitTimeout(r.URL.Query().Get("timeout"))
+	return true, timeout, err
+}
+
+// waitForOperation polls a SQL Admin operation until it is DONE, the
+// timeout elapses or ctx is cancelled. The last observed operation is
+// returned alongside errOperationWaitTimeout.
+func waitForOperation(ctx context.Context, project string, operation *sqladmin.Operation, timeout time.Duration) (done *sqladmin.Operation, err error) {
+	ctx, span := startSpan(ctx, "wait for operation", instanceAttributes(operation.OperationType, project, operation.TargetId)...)
+	span.SetAttributes(attribute.String("scheduler_db.operation", operation.Name))
+	defer func() { endSpan(span, err) }()
+
+	controller, err := sqlController(project)
+	if err != nil {
+		return operation, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return controller.Wait(ctx, project, operation)
+}
+
+// writeOperationResponse answers a mutating request with the operation it
+// started, or with the finished operation and resulting instance state when
+// the client asked to wait, after the warm-up probe when steps ask for it.
+// Any other steps taken are listed next to the operation.
+func writeOperationResponse(w http.ResponseWriter, r *http.Request, project string, instance string, operation *sqladmin.Operation, wait bool, timeout time.Duration, steps operationSteps, succeeded messageKey, failed messageKey) {
+	auditOperation(r, operation.Name)
+	annotateRequest(r, slog.String("operation", operation.Name))
+	if !wait {
+		writeSuccessResponse(w, r, http.StatusOK, succeeded, OperationResult{Operation: operation, Backup: steps.Backup, Export: steps.Export, Replicas: steps.Replicas})
+		return
+	}
+
+	operation, err := waitForOperation(r.Context(), project, operation, timeout)
+	if operation.Status == "DONE" {
+		operations.finished(operation, err)
+	}
+	if errors.Is(err, errOperationWaitTimeout) {
+		writeErrorResponse(w, r, http.StatusRequestTimeout, msgOperationTimedOut, err, operation.Name, timeout)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, failed, err)
+		return
+	}
+
+	var warm *WarmUpData
+	if steps.WarmUp {
+		if warm, err = warmUpInstance(r.Context(), project, instance); err != nil {
+			writeErrorResponse(w, r, http.StatusGatewayTimeout, msgWarmUpFailed, err, instance)
+			return
+		}
+	}
+
+	state, _, err := inventoryCache.load().get(r.Context(), project, instance, true)
+	if err != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, msgInstanceNotFound, err)
+		return
+	}
+
+	writeSuccessResponse(w, r, http.StatusOK, succeeded, OperationResult{Operation: operation, Instance: state, Backup: steps.Backup, Export: steps.Export, Replicas: steps.Replicas, WarmUp: warm})
+}
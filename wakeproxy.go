@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// WakeProxyConfig enables the wake-on-demand proxy: connections accepted on
+// Listen are forwarded to Target, the address of the instance, once the
+// instance is running. Project and Instance default to PROJECT_ID and
+// INSTANCE_ID.
+type WakeProxyConfig struct {
+	Listen       string
+	Target       string
+	Project      string
+	Instance     string
+	StartTimeout time.Duration
+}
+
+func (c WakeProxyConfig) enabled() bool {
+	return c.Listen != ""
+}
+
+func (c WakeProxyConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.Target == "" {
+		return fmt.Errorf("WAKE_PROXY_TARGET is required when WAKE_PROXY_LISTEN is set")
+	}
+	if c.Instance == "" {
+		return fmt.Errorf("WAKE_PROXY_INSTANCE or INSTANCE_ID is required when WAKE_PROXY_LISTEN is set")
+	}
+	return nil
+}
+
+// wakeProxy forwards TCP connections to a Cloud SQL instance, starting it
+// first when it is stopped. Connections arriving while it starts share the
+// same start and are held until it is RUNNABLE.
+type wakeProxy struct {
+	config   WakeProxyConfig
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	// waking is the start in progress, nil when there is none.
+	waking *wakeAttempt
+}
+
+// wakeAttempt is one start of the instance, done being closed once err is
+// set.
+type wakeAttempt struct {
+	done chan struct{}
+	err  error
+}
+
+func newWakeProxy(config WakeProxyConfig) (*wakeProxy, error) {
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return nil, err
+	}
+	return &wakeProxy{config: config, listener: listener, conns: make(map[net.Conn]struct{})}, nil
+}
+
+// run accepts connections until stop is closed, then closes the listener
+// and the connections still open.
+func (p *wakeProxy) run(stop <-chan struct{}) {
+	slog.Info("Wake proxy running", "listen", p.listener.Addr().String(), "target", p.config.Target, "project", p.config.Project, "instance", p.config.Instance)
+
+	var handlers sync.WaitGroup
+	go func() {
+		<-stop
+		p.listener.Close()
+		p.mu.Lock()
+		for conn := range p.conns {
+			conn.Close()
+		}
+		p.conns = nil
+		p.mu.Unlock()
+	}()
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			slog.Error("Wake proxy failed to accept a connection", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if !p.track(conn) {
+			conn.Close()
+			continue
+		}
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			defer p.untrack(conn)
+			p.handle(conn)
+		}()
+	}
+	handlers.Wait()
+}
+
+// track registers an open connection, refusing it once the proxy is
+// closing.
+func (p *wakeProxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns == nil {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *wakeProxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.conns, conn)
+	conn.Close()
+}
+
+// handle wakes the instance and then copies the connection to the target
+// both ways until either side closes.
+func (p *wakeProxy) handle(client net.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.StartTimeout)
+	defer cancel()
+
+	remote := client.RemoteAddr().String()
+	if err := p.wake(ctx, remote); err != nil {
+		slog.Error("Wake proxy could not start the instance, connection dropped", "remote", remote, "instance", p.config.Instance, "error", err)
+		return
+	}
+
+	var dialer net.Dialer
+	server, err := dialer.DialContext(ctx, "tcp", p.config.Target)
+	if err != nil {
+		slog.Error("Wake proxy could not reach the instance, connection dropped", "remote", remote, "target", p.config.Target, "error", err)
+		return
+	}
+	if !p.track(server) {
+		server.Close()
+		return
+	}
+	defer p.untrack(server)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(server, client)
+		closeWrite(server)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, server)
+		closeWrite(client)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// closeWrite half-closes a TCP connection so the other side sees EOF while
+// its answer can still be read.
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// wake returns once the instance is RUNNABLE, starting it if needed. A
+// start already in progress is waited for instead of requesting another.
+// The state comes from the instance cache, so a burst of connections to a
+// running instance costs one SQL Admin call per CHECK_CACHE_TTL.
+func (p *wakeProxy) wake(ctx context.Context, remote string) error {
+	status, _, err := inventoryCache.load().get(ctx, p.config.Project, p.config.Instance, false)
+	if err != nil {
+		return err
+	}
+	if status.State == "RUNNABLE" {
+		return nil
+	}
+
+	p.mu.Lock()
+	attempt := p.waking
+	if attempt == nil {
+		attempt = &wakeAttempt{done: make(chan struct{})}
+		p.waking = attempt
+		go p.start(attempt, remote)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-attempt.done:
+		return attempt.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start starts the instance on behalf of the connection from remote and
+// waits until it is RUNNABLE, and with warm-up until the target accepts
+// connections, then releases the connections waiting on attempt.
+func (p *wakeProxy) start(attempt *wakeAttempt, remote string) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.StartTimeout)
+	defer cancel()
+
+	slog.Info("Connection to a stopped instance, starting it", "remote", remote, "project", p.config.Project, "instance", p.config.Instance)
+	operation, err := runTriggeredAction(ctx, triggeredAction{
+		Action:      scheduleActionStart,
+		Project:     p.config.Project,
+		Instance:    p.config.Instance,
+		Source:      actionSourceProxy,
+		TriggeredBy: "wake proxy (" + remote + ")",
+	})
+	if operation != nil || err != nil {
+		recordAction(scheduleActionStart, actionSourceProxy, err)
+	}
+	if err == nil {
+		_, err = waitForState(ctx, p.config.Project, p.config.Instance, "RUNNABLE", p.config.StartTimeout)
+	}
+	if err == nil && warmUp.load().enabled() {
+		err = probeTCP(ctx, p.config.Target, warmUp.load().Timeout)
+	}
+
+	attempt.err = err
+	p.mu.Lock()
+	p.waking = nil
+	p.mu.Unlock()
+	close(attempt.done)
+}
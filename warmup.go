@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Probes of WARMUP_PROBE. A Cloud SQL connector probe running SELECT 1
+// would need the database credentials and a driver per engine, so only the
+// TCP probe is offered.
+const (
+	warmUpProbeNone = "none"
+	warmUpProbeTCP  = "tcp"
+)
+
+// IP types of WARMUP_IP_TYPE.
+const (
+	warmUpIPPrivate = "private"
+	warmUpIPPublic  = "public"
+)
+
+const (
+	defaultWarmUpTimeout = 2 * time.Minute
+
+	// warmUpDialTimeout bounds each connection attempt of the probe.
+	warmUpDialTimeout = 5 * time.Second
+)
+
+// warmUpProbeInterval is how often the probe retries. A variable so tests
+// can shorten it.
+var warmUpProbeInterval = 2 * time.Second
+
+// WarmUpConfig makes starts that wait for their operation also wait until
+// the database accepts TCP connections, as RUNNABLE is reported before it
+// does. The probe dials the private or public IP of the instance on Port,
+// the default port of the engine when zero, for at most Timeout.
+type WarmUpConfig struct {
+	Probe   string
+	IPType  string
+	Port    int
+	Timeout time.Duration
+}
+
+func (c WarmUpConfig) enabled() bool {
+	return c.Probe == warmUpProbeTCP
+}
+
+// warmUp is set from the WARMUP_* variables.
+var warmUp reloadable[WarmUpConfig]
+
+var errNoInstanceAddress = errors.New("instance has no IP address to probe")
+
+// WarmUpData is the probe that let a start report success.
+type WarmUpData struct {
+	Address string `json:"address"`
+	// Duration is how long the database took to accept a connection.
+	Duration string `json:"duration"`
+}
+
+// warmUpInstance waits until the database of a running instance accepts a
+// TCP connection. It returns nil data when warm-up is disabled.
+func warmUpInstance(ctx context.Context, project string, instance string) (*WarmUpData, error) {
+	config := warmUp.load()
+	if !config.enabled() {
+		return nil, nil
+	}
+	address, err := warmUpAddress(ctx, config, project, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	if err := probeTCP(ctx, address, config.Timeout); err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start).Round(time.Millisecond)
+	slog.Info("Instance accepts connections", "project", project, "instance", instance, "address", address, "duration", elapsed)
+	return &WarmUpData{Address: address, Duration: elapsed.String()}, nil
+}
+
+// warmUpAddress is the address the probe dials for an instance.
+func warmUpAddress(ctx context.Context, config WarmUpConfig, project string, instance string) (string, error) {
+	sqlService, err := sqlAdminService(project)
+	if err != nil {
+		return "", err
+	}
+
+	callCtx, cancel := sqlAdminContext(ctx)
+	defer cancel()
+
+	details, err := sqlService.Instances.Get(project, instance).Context(callCtx).Do()
+	if err != nil {
+		return "", err
+	}
+	ipType := "PRIVATE"
+	if config.IPType == warmUpIPPublic {
+		ipType = "PRIMARY"
+	}
+	var ip string
+	for _, address := range details.IpAddresses {
+		if address.Type == ipType {
+			ip = address.IpAddress
+			break
+		}
+	}
+	if ip == "" {
+		return "", fmt.Errorf("%w: no %s IP", errNoInstanceAddress, config.IPType)
+	}
+	port := config.Port
+	if port == 0 {
+		port = defaultDatabasePort(details.DatabaseVersion)
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(port)), nil
+}
+
+// defaultDatabasePort is the port the engine of databaseVersion listens on.
+func defaultDatabasePort(databaseVersion string) int {
+	switch {
+	case strings.HasPrefix(databaseVersion, "MYSQL"):
+		return 3306
+	case strings.HasPrefix(databaseVersion, "SQLSERVER"):
+		return 1433
+	default:
+		return 5432
+	}
+}
+
+// probeTCP dials address every warmUpProbeInterval until a connection is
+// accepted, for at most timeout.
+func probeTCP(ctx context.Context, address string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := net.Dialer{Timeout: warmUpDialTimeout}
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s does not accept connections after %s: %w", address, timeout, err)
+		case <-time.After(warmUpProbeInterval):
+		}
+	}
+}